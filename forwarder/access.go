@@ -0,0 +1,87 @@
+package forwarder
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net"
+	"strings"
+	"time"
+)
+
+// DefaultAuthTimeout is how long TCP clients have to send the password
+// unless Access.AuthTimeout is set.
+const DefaultAuthTimeout = 5 * time.Second
+
+// Access restricts who can receive forwarded messages.
+// A nil *Access allows everybody.
+type Access struct {
+	Allow       []*net.IPNet  // empty allows all addresses
+	Password    string        // required from TCP clients if not empty
+	AuthTimeout time.Duration // zero means DefaultAuthTimeout
+}
+
+// ParseNetblocks parses a comma-separated list of CIDR ranges such as
+// "10.0.0.0/8,fd00::/8". Single addresses without a prefix length are also accepted.
+func ParseNetblocks(list string) ([]*net.IPNet, error) {
+	blocks := []*net.IPNet{}
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, errors.New("Invalid IP address " + s)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			blocks = append(blocks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, block, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, errors.New("Invalid CIDR range " + s)
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks, nil
+}
+
+// inNetblocks checks whether any of the blocks contains the IP.
+func inNetblocks(ip net.IP, blocks []*net.IPNet) bool {
+	for _, block := range blocks {
+		if block.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Allows checks an IP address against the allowed ranges.
+func (a *Access) Allows(ip net.IP) bool {
+	return a == nil || len(a.Allow) == 0 || inNetblocks(ip, a.Allow)
+}
+
+// AllowsAddr checks an "ip:port" address such as http.Request.RemoteAddr.
+func (a *Access) AllowsAddr(addr string) bool {
+	if a == nil || len(a.Allow) == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && inNetblocks(ip, a.Allow)
+}
+
+// checkPassword compares in constant time to not reveal how much of it was correct.
+func (a *Access) checkPassword(password string) bool {
+	return subtle.ConstantTimeCompare([]byte(password), []byte(a.Password)) == 1
+}
+
+// The private unicast ranges of IPv4 and IPv6
+var privateNetblocks, _ = ParseNetblocks("10.0.0.0/8,172.16.0.0/12,192.168.0.0/16,fc00::/7")
@@ -0,0 +1,126 @@
+package forwarder
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	l "github.com/tormol/AIS/logger"
+)
+
+func TestNetblocks(t *testing.T) {
+	blocks, err := ParseNetblocks("10.0.0.0/8, 192.0.2.7,2001:db8::/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+	access := &Access{Allow: blocks}
+	for ip, allowed := range map[string]bool{
+		"10.1.2.3":        true,
+		"11.0.0.1":        false,
+		"192.0.2.7":       true,
+		"192.0.2.8":       false,
+		"2001:db8::1":     true,
+		"2001:db9::1":     false,
+		"::ffff:10.0.0.1": true,
+	} {
+		if access.Allows(net.ParseIP(ip)) != allowed {
+			t.Errorf("Expected %s to be allowed: %t", ip, allowed)
+		}
+	}
+	if !access.AllowsAddr("10.0.0.1:1234") || access.AllowsAddr("[2001:db9::1]:80") {
+		t.Error("AllowsAddr() doesn't match Allows()")
+	}
+	if !(*Access)(nil).Allows(net.ParseIP("8.8.8.8")) || !(&Access{}).AllowsAddr("8.8.8.8:1") {
+		t.Error("Expected no ranges to allow everything")
+	}
+	for _, list := range []string{"10.0.0.0/33", "example.com", "10.0.0/8"} {
+		if _, err := ParseNetblocks(list); err == nil {
+			t.Errorf("Expected %q to be invalid", list)
+		}
+	}
+
+	for ip, private := range map[string]bool{
+		"10.0.0.1": true, "172.16.0.1": true, "172.32.0.1": false,
+		"192.168.1.1": true, "8.8.8.8": false, "fd00::1": true, "2001:db8::1": false,
+	} {
+		if isPrivate(net.ParseIP(ip)) != private {
+			t.Errorf("Expected isPrivate(%s) to be %t", ip, private)
+		}
+	}
+}
+
+// startTCP starts a TCP forwarding server and returns its address and the
+// channel to forward packets through.
+func startTCP(t *testing.T, access *Access) (string, chan<- Packet) {
+	logger := l.NewLogger(os.Stderr, l.Debug)
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	add := make(chan Conn)
+	packets := make(chan Packet)
+	go Manager(logger, packets, add, nil)
+	go serveTCP(logger, listener, add, access, false) // never returns
+	return listener.Addr().String(), packets
+}
+
+// expectClosed checks that the server closes the connection,
+// after optionally sending a line starting with prefix.
+func expectClosed(t *testing.T, conn net.Conn, prefix, what string) {
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	r := bufio.NewReader(conn)
+	if prefix != "" {
+		if line, err := r.ReadString('\n'); !strings.HasPrefix(line, prefix) {
+			t.Errorf("Expected %s to get %q, got %q %v", what, prefix, line, err)
+		}
+	}
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Errorf("Expected %s to be disconnected, got %v", what, err)
+	}
+}
+
+func TestTCPAccess(t *testing.T) {
+	blocks, _ := ParseNetblocks("10.0.0.0/8")
+	addr, _ := startTCP(t, &Access{Allow: blocks})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	expectClosed(t, conn, "", "a client outside the allowed ranges")
+}
+
+func TestTCPPassword(t *testing.T) {
+	addr, packets := startTCP(t, &Access{Password: "secret", AuthTimeout: 200 * time.Millisecond})
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+
+	wrong := dial()
+	defer wrong.Close()
+	wrong.Write([]byte("AUTH guess\r\n"))
+	expectClosed(t, wrong, "ERROR", "a client with the wrong password")
+
+	silent := dial()
+	defer silent.Close()
+	expectClosed(t, silent, "", "a client that didn't send a password")
+
+	right := dial()
+	defer right.Close()
+	right.Write([]byte("AUTH secret\r\n"))
+	time.Sleep(50 * time.Millisecond) // let it be added
+	packets <- Packet{Raw: []byte("!AIVDM\r\n")}
+	right.SetReadDeadline(time.Now().Add(2 * time.Second))
+	line, err := bufio.NewReader(right).ReadString('\n')
+	if err != nil || line != "!AIVDM\r\n" {
+		t.Errorf("Expected an authenticated client to get packets, got %q %v", line, err)
+	}
+}
@@ -1,9 +1,12 @@
 package forwarder
 
 import (
+	"bufio"
+	"errors"
 	"io"
 	"net"
 	"net/http"
+	"strings"
 	"sync/atomic"
 	"time"
 
@@ -12,9 +15,12 @@ import (
 
 // A WriteCloser for http forwarding
 type httpForwarderConn struct {
-	http.ResponseWriter // implements io.Writer
-	// Request details doesn't matter any longer
-	ended chan struct{} // For the request handles to block on
+	http.ResponseWriter               // implements io.Writer
+	ended               chan struct{} // For the request handles to block on
+	remote              string        // only the address is kept from the request
+	filterHolder
+	tagsOption
+	resumeOption
 }
 
 func (hfc *httpForwarderConn) Write(data []byte) (int, error) {
@@ -27,6 +33,10 @@ func (hfc *httpForwarderConn) Write(data []byte) (int, error) {
 	return n, err
 }
 
+func (hfc *httpForwarderConn) String() string {
+	return "HTTP " + hfc.remote
+}
+
 func (hfc *httpForwarderConn) Close() error {
 	hfc.ended <- struct{}{} // makes handler return
 	return nil              // the Responsewriter is closed when the handler returns
@@ -35,24 +45,116 @@ func (hfc *httpForwarderConn) Close() error {
 // ToHTTP sets up the writer for forwarding and passes it to add.
 // Doesn't return until the client disconnects or there is an I/O error.
 // Packets sent through this will be concatenated and split as the ResponseWriter sees fit.
-func ToHTTP(sendTo chan<- Conn, w http.ResponseWriter, _ *http.Request) {
+// filter can be nil to forward everything. (see ParseFilter)
+// If tags is true, every sentence is prefixed with a TAG block. (see TagBlock)
+// If resumeAfter is not nil and sendTo is a SequencedManager, the client
+// first gets what it missed after that sequence number.
+func ToHTTP(sendTo chan<- Conn, w http.ResponseWriter, r *http.Request, filter *Filter, tags bool,
+	resumeAfter *uint64) {
 	w.Header().Set("Transfer-Encoding", "chunked")
 	// Need to stay in this function while the connection lasts,
 	// so there is no point in trying to extract (Hijack) a TCPConn.
 	w.WriteHeader(http.StatusOK)
-	hfc := &httpForwarderConn{w, make(chan struct{})}
+	hfc := &httpForwarderConn{ResponseWriter: w, ended: make(chan struct{}), remote: r.RemoteAddr,
+		tagsOption: tagsOption{tags}, resumeOption: newResumeOption(resumeAfter)}
+	hfc.setFilter(filter)
 	hfc.Write(nil) // flush headers
 	sendTo <- hfc
 	// TODO detect add closed
 	<-hfc.ended
 }
 
+// maxCommandLength is the longest FILTER or OPTIONS command that is accepted.
+const maxCommandLength = 2048
+
+// keepAlivePeriod is how often TCP clients are probed when idle, so that
+// clients whose network disappeared without closing the connection are
+// detected even when there is nothing to forward.
+const keepAlivePeriod = 15 * time.Second
+
+// parseFilterCommand parses "FILTER bbox=...&mmsi=..." (see ParseFilter),
+// or "OPTIONS types=... max_per_ship=...", which is the same with spaces
+// between the parameters.
+// Either replaces the current filter, and without parameters removes it.
+// isCommand is false if the line is something else, which should be ignored.
+func parseFilterCommand(line string) (f *Filter, isCommand bool, err error) {
+	line = strings.TrimSpace(line)
+	if line == "FILTER" || strings.HasPrefix(line, "FILTER ") {
+		f, err = ParseFilter(strings.TrimSpace(line[len("FILTER"):]))
+		return f, true, err
+	} else if line == "OPTIONS" || strings.HasPrefix(line, "OPTIONS ") {
+		f, err = ParseFilter(strings.Join(strings.Fields(line[len("OPTIONS"):]), "&"))
+		return f, true, err
+	}
+	return nil, false, nil
+}
+
+// A WriteCloser for TCP forwarding, whose filter can be set by the client
+type tcpForwarderConn struct {
+	*net.TCPConn
+	reader *bufio.Reader // might have buffered more than the AUTH line
+	filterHolder
+	tagsOption
+}
+
+func (tfc *tcpForwarderConn) String() string {
+	return "TCP " + tfc.RemoteAddr().String()
+}
+
+// authenticate requires the first line from the client to be "AUTH $password".
+// Returns false if it isn't, or takes too long.
+func (tfc *tcpForwarderConn) authenticate(access *Access) bool {
+	timeout := access.AuthTimeout
+	if timeout == 0 {
+		timeout = DefaultAuthTimeout
+	}
+	tfc.SetReadDeadline(time.Now().Add(timeout))
+	line, err := tfc.reader.ReadSlice('\n') // fails if longer than the buffer
+	if err != nil {
+		return false
+	}
+	tfc.SetReadDeadline(time.Time{})
+	password := strings.TrimRight(string(line), "\r\n")
+	if !strings.HasPrefix(password, "AUTH ") || !access.checkPassword(password[len("AUTH "):]) {
+		tfc.Write([]byte("ERROR Wrong password\r\n"))
+		return false
+	}
+	return true
+}
+
+// readCommands reads lines from the client until the connection is closed,
+// and applies FILTER and OPTIONS commands from then on.
+// Clients that don't send anything get everything like before.
+func (tfc *tcpForwarderConn) readCommands(log *l.Logger) {
+	scanner := bufio.NewScanner(tfc.reader)
+	scanner.Buffer(make([]byte, 0, 256), maxCommandLength)
+	for scanner.Scan() {
+		f, isCommand, err := parseFilterCommand(scanner.Text())
+		if err != nil {
+			// net.Conn writes are synchronized, so this won't end up in the middle of a packet
+			tfc.Write([]byte("ERROR " + err.Error() + "\r\n"))
+		} else if isCommand {
+			tfc.setFilter(f)
+		}
+	}
+	if err := scanner.Err(); err == bufio.ErrTooLong {
+		log.Log(ClientLogLevel, "TCP forwarding client %s sent a too long line, ignoring it from now on",
+			tfc.RemoteAddr())
+	}
+}
+
 // TCPServer listens for TCP connections and passes the connection to add.
 // Never returns, but any IO error from ResolveTCPAddr(), ListenTCP()
 // or AcceptTCP() is fatal.
 // As TCP is stream-oriented, packets might be split or merged
 // even without delays to send bigger and fewer packets.
-func TCPServer(log *l.Logger, serveAddr string, add chan<- Conn) {
+// Clients can send a FILTER or OPTIONS command at any time to only get some
+// packets, see parseFilterCommand.
+// Clients not allowed by access are disconnected, and if it has a password
+// it must be sent as "AUTH $password" before anything is forwarded.
+// Clients that don't read what is sent are disconnected after WriteTimeout.
+// If tags is true, every sentence is prefixed with a TAG block. (see TagBlock)
+func TCPServer(log *l.Logger, serveAddr string, add chan<- Conn, access *Access, tags bool) {
 	a, err := net.ResolveTCPAddr("tcp", serveAddr)
 	log.FatalIfErr(err, "resolve forwarding TCP address")
 	l, err := net.ListenTCP("tcp", a)
@@ -63,10 +165,37 @@ func TCPServer(log *l.Logger, serveAddr string, add chan<- Conn) {
 			log.Error("Error closing TCP server: %s", err.Error())
 		}
 	}()
+	serveTCP(log, l, add, access, tags)
+}
+
+// serveTCP is TCPServer after listening.
+func serveTCP(log *l.Logger, l *net.TCPListener, add chan<- Conn, access *Access, tags bool) {
 	for {
 		conn, err := l.AcceptTCP()
 		log.FatalIfErr(err, "accept forwarding TCP connection")
-		add <- conn // TCPConn implements WriteCloser
+		if !access.Allows(conn.RemoteAddr().(*net.TCPAddr).IP) {
+			log.Log(ClientLogLevel, "TCP forwarding client %s is not allowed", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		conn.SetKeepAlive(true)
+		conn.SetKeepAlivePeriod(keepAlivePeriod)
+		tfc := &tcpForwarderConn{TCPConn: conn, reader: bufio.NewReaderSize(conn, maxCommandLength),
+			tagsOption: tagsOption{tags}}
+		if access == nil || access.Password == "" {
+			go tfc.readCommands(log)
+			add <- tfc
+			continue
+		}
+		go func() { // don't block accepting other clients
+			if !tfc.authenticate(access) {
+				log.Log(ClientLogLevel, "TCP forwarding client %s failed to authenticate", tfc.RemoteAddr())
+				tfc.Close()
+				return
+			}
+			go tfc.readCommands(log)
+			add <- tfc
+		}()
 	}
 }
 
@@ -84,6 +213,8 @@ type udpForwarderConn struct {
 	to       *net.UDPAddr // immutable, used by forwarder
 	flag     int32        // see consts
 	timeout  time.Time    // not atomic; controlled by server
+	filterHolder
+	tagsOption
 }
 
 func (ufc *udpForwarderConn) Write(slice []byte) (int, error) {
@@ -96,6 +227,11 @@ func (ufc *udpForwarderConn) Write(slice []byte) (int, error) {
 	}
 	return n, err
 }
+
+func (ufc *udpForwarderConn) String() string {
+	return "UDP " + ufc.to.String()
+}
+
 func (ufc *udpForwarderConn) Close() error {
 	atomic.StoreInt32(&ufc.flag, udpStopped)
 	return nil
@@ -105,13 +241,60 @@ func (ufc *udpForwarderConn) Close() error {
 // (such as 192.168.0.0/16)
 // There is no such function in the `net` package.
 func isPrivate(ip net.IP) bool {
-	if v4 := ip.To4(); v4 != nil {
-		return v4[0] == 10 /* 10.0.0.0/8 */ ||
-			(v4[0] == 192 && v4[1] == 168) /* 192.168.0.0/16 */ ||
-			(v4[0] == 172 && (v4[1]&0xf0) == 16) /* 172.16.0.0/12 */
+	return inNetblocks(ip, privateNetblocks)
+}
+
+// What a received UDP packet asks for
+type udpCommand int
+
+const (
+	udpUnknown udpCommand = iota // renews existing subscriptions
+	udpSubscribe
+	udpStopCommand
+)
+
+// maxUDPSubscription limits how long a single SUB can last, as the client
+// might go away without sending STOP.
+const maxUDPSubscription = 10 * time.Minute
+
+// A received UDP packet
+type udpRequest struct {
+	from      *net.UDPAddr
+	command   udpCommand
+	duration  time.Duration // for udpSubscribe
+	filter    *Filter
+	setFilter bool
+}
+
+// parseUDPCommand parses the content of a packet from a UDP client:
+// "SUB" or "SUB $duration" subscribes or renews for UDPTimeout or the duration,
+// "STOP" unsubscribes, and "FILTER ..." (see parseFilterCommand) subscribes
+// or renews with a filter.
+// Everything else is udpUnknown.
+func parseUDPCommand(payload string) (udpRequest, error) {
+	line := strings.TrimSpace(payload)
+	switch {
+	case line == "STOP":
+		return udpRequest{command: udpStopCommand}, nil
+	case line == "SUB":
+		return udpRequest{command: udpSubscribe, duration: UDPTimeout}, nil
+	case strings.HasPrefix(line, "SUB "):
+		d, err := time.ParseDuration(strings.TrimSpace(line[len("SUB "):]))
+		if err != nil || d <= 0 {
+			return udpRequest{}, errors.New("Invalid duration")
+		}
+		if d > maxUDPSubscription {
+			d = maxUDPSubscription
+		}
+		return udpRequest{command: udpSubscribe, duration: d}, nil
 	}
-	// fc00::/7 is the IPv6 private area
-	return (len(ip) == 16 && (ip[0] == 0xfc || ip[0] == 0xfd))
+	f, isCommand, err := parseFilterCommand(line)
+	if err != nil {
+		return udpRequest{}, err
+	} else if isCommand {
+		return udpRequest{command: udpSubscribe, duration: UDPTimeout, filter: f, setFilter: true}, nil
+	}
+	return udpRequest{command: udpUnknown}, nil
 }
 
 // UDPServer listens for UDP packets and starts / stops / times out forwarders
@@ -119,37 +302,67 @@ func isPrivate(ip net.IP) bool {
 // or ReadFromUDP() is fatal.
 // Packets will never be merged or split, but
 // if the receivers buffer is too small it might not see everything.
-func UDPServer(log *l.Logger, listenAddr string, add chan<- Conn) {
+// Clients control forwarding with commands, see parseUDPCommand.
+// Other packets only renew existing subscriptions, for compatibility with
+// clients from before the commands.
+// Only clients on the local network that are also allowed by access get anything.
+// If tags is true, every sentence is prefixed with a TAG block. (see TagBlock)
+func UDPServer(log *l.Logger, listenAddr string, add chan<- Conn, access *Access, tags bool) {
 	laddr, err := net.ResolveUDPAddr("udp", listenAddr)
 	log.FatalIfErr(err, "resolve forwarding UDP address")
 	listener, err := net.ListenUDP("udp", laddr)
 	log.FatalIfErr(err, "listen for UDP")
+	serveUDP(log, listener, add, access, tags)
+}
 
+// serveUDP is UDPServer after listening.
+func serveUDP(log *l.Logger, listener *net.UDPConn, add chan<- Conn, access *Access, tags bool) {
 	connections := make(map[string]*udpForwarderConn)
 	stop := time.NewTicker(1 * time.Second).C
-	start := make(chan *net.UDPAddr, 16)
+	start := make(chan udpRequest, 16)
 
-	// Receive UDP packets and send the source addr to a channel that can be selected over
+	// Receive UDP packets and send the parsed command to a channel that can be selected over
 	go func() {
 		defer func() {
 			log.FatalIfErr(listener.Close(), "close forwarder UDP server")
 		}()
-		buf := make([]byte, 32) // avoid an empty buffer in case it could cause issues
+		buf := make([]byte, maxCommandLength)
 		for {
-			_, from, err := listener.ReadFromUDP(buf)
+			n, from, err := listener.ReadFromUDP(buf)
 			log.FatalIfErr(err, "accept forwarding UDP connection")
-			start <- from
+			req, err := parseUDPCommand(string(buf[:n]))
+			if err != nil {
+				// starting without the filter would send what the client wanted to avoid
+				log.Log(ClientLogLevel, "Invalid command from UDP client %s: %s", from, err.Error())
+				continue
+			}
+			req.from = from
+			start <- req
 		}
 	}()
 
 	for {
 		select {
-		case from := <-start:
-			now := time.Now()
-			timeout := now.Add(UDPTimeout)
+		case req := <-start:
+			from := req.from
 			fromAddrStr := from.String()
 			ufc := connections[fromAddrStr]
+			if req.command == udpStopCommand {
+				if ufc != nil {
+					// the forwarder returns on the next packet
+					atomic.CompareAndSwapInt32(&ufc.flag, udpRunning, udpStop)
+					delete(connections, fromAddrStr)
+				}
+				continue
+			}
+			timeout := time.Now().Add(UDPTimeout)
+			if req.command == udpSubscribe {
+				timeout = time.Now().Add(req.duration)
+			}
 			if ufc == nil { // new connection
+				if req.command != udpSubscribe {
+					continue
+				}
 				// IP addresses can be spoofed, and UDP lacks TCP's segment
 				// ID which protects against it. This service can reply with tens
 				// of kilobytes per received byte, (record is 200KB) which makes
@@ -158,25 +371,37 @@ func UDPServer(log *l.Logger, listenAddr string, add chan<- Conn) {
 				// Allow everything except global public unicast or multicast; on
 				// a LAN it's easier to find and stop the source or stop the server.
 				if !(isPrivate(from.IP) || from.IP.IsLoopback() || from.IP.IsLinkLocalUnicast() ||
-					from.IP.IsLinkLocalMulticast() || from.IP.IsInterfaceLocalMulticast()) {
+					from.IP.IsLinkLocalMulticast() || from.IP.IsInterfaceLocalMulticast()) ||
+					!access.Allows(from.IP) {
 					// Any length of response can be used for DDoS amplification,
 					// so just ignore the packet
 					continue
 				}
 				ufc = &udpForwarderConn{
-					listener: listener,
-					to:       from,
-					flag:     udpRunning,
-					timeout:  timeout,
+					listener:   listener,
+					to:         from,
+					flag:       udpRunning,
+					timeout:    timeout,
+					tagsOption: tagsOption{tags},
 				}
+				ufc.setFilter(req.filter)
 				connections[fromAddrStr] = ufc
 				add <- ufc
 			} else if atomic.LoadInt32(&ufc.flag) == udpRunning {
-				// reset timeout if it hasn't been stopped
-				ufc.timeout = timeout
+				// reset timeout if it hasn't been stopped,
+				// but don't let other packets shorten a long SUB
+				if req.command == udpSubscribe || timeout.After(ufc.timeout) {
+					ufc.timeout = timeout
+				}
+				if req.setFilter {
+					ufc.setFilter(req.filter)
+				}
 			} else { // reset and restart if there somehow was an error
 				ufc.flag = udpRunning
 				ufc.timeout = timeout
+				if req.setFilter {
+					ufc.setFilter(req.filter)
+				}
 				add <- ufc
 			}
 		case now := <-stop:
@@ -0,0 +1,149 @@
+package forwarder
+
+import (
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	l "github.com/tormol/AIS/logger"
+)
+
+func TestParseUDPCommand(t *testing.T) {
+	cases := []struct {
+		payload  string
+		command  udpCommand
+		duration time.Duration
+	}{
+		{"SUB", udpSubscribe, UDPTimeout},
+		{"SUB 30s\n", udpSubscribe, 30 * time.Second},
+		{"SUB 24h", udpSubscribe, maxUDPSubscription},
+		{"STOP\r\n", udpStopCommand, 0},
+		{"FILTER mmsi=1", udpSubscribe, UDPTimeout},
+		{"\n", udpUnknown, 0},
+		{"SUBMARINE", udpUnknown, 0},
+	}
+	for _, c := range cases {
+		req, err := parseUDPCommand(c.payload)
+		if err != nil || req.command != c.command || req.duration != c.duration {
+			t.Errorf("%q: expected %d for %s, got %d for %s (%v)",
+				c.payload, c.command, c.duration, req.command, req.duration, err)
+		}
+	}
+	for _, payload := range []string{"SUB x", "SUB -1s", "FILTER mmsi=x"} {
+		if _, err := parseUDPCommand(payload); err == nil {
+			t.Errorf("Expected %q to be invalid", payload)
+		}
+	}
+}
+
+func TestUDPSubscription(t *testing.T) {
+	logger := l.NewLogger(os.Stderr, l.Debug)
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	add := make(chan Conn)
+	packets := make(chan Packet)
+	go Manager(logger, packets, add, nil)
+	go serveUDP(logger, server, add, nil, false) // never returns
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	send := func(payload string) {
+		if _, err := client.WriteToUDP([]byte(payload), server.LocalAddr().(*net.UDPAddr)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	buf := make([]byte, 100)
+	// forwards a packet and returns whether the client received it
+	forward := func(wait time.Duration) bool {
+		packets <- Packet{Raw: []byte("!AIVDM\r\n")}
+		client.SetReadDeadline(time.Now().Add(wait))
+		n, _, err := client.ReadFromUDP(buf)
+		if err == nil && string(buf[:n]) != "!AIVDM\r\n" {
+			t.Fatalf("Received unexpected packet %q", buf[:n])
+		}
+		return err == nil
+	}
+	drain := func() {
+		for {
+			client.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+			if _, _, err := client.ReadFromUDP(buf); err != nil {
+				return
+			}
+		}
+	}
+
+	send("hello")
+	time.Sleep(50 * time.Millisecond)
+	if forward(200 * time.Millisecond) {
+		t.Fatal("Expected an unknown packet from a new address to be ignored")
+	}
+
+	send("SUB 30s")
+	received := false
+	for i := 0; i < 20 && !received; i++ {
+		received = forward(100 * time.Millisecond)
+	}
+	if !received {
+		t.Fatal("Expected to receive packets after SUB")
+	}
+	drain()
+
+	send("STOP")
+	time.Sleep(50 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		if forward(100 * time.Millisecond) {
+			t.Fatal("Expected no packets after STOP")
+		}
+	}
+	send("hello")
+	time.Sleep(50 * time.Millisecond)
+	if forward(200 * time.Millisecond) {
+		t.Fatal("Expected an unknown packet to not resubscribe after STOP")
+	}
+}
+
+// Tests that a TCP client which is connected but never reads is
+// disconnected once a write has blocked for WriteTimeout.
+func TestStalledTCPClientTimesOut(t *testing.T) {
+	defer func(timeout time.Duration) { WriteTimeout = timeout }(WriteTimeout)
+	WriteTimeout = 200 * time.Millisecond
+	logger := l.NewLogger(os.Stderr, l.Debug)
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	add := make(chan Conn)
+	packets := make(chan Packet)
+	stats := NewStatsRequests()
+	go Manager(logger, packets, add, stats)
+	go serveTCP(logger, listener, add, nil, false) // never returns
+	defer close(packets)
+
+	client, err := net.DialTCP("tcp", nil, listener.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetReadBuffer(4096)
+	for len(stats.Stats()) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// fill the socket buffers until the server gives up on the client
+	packet := Packet{Raw: make([]byte, 64*1024)}
+	started := time.Now()
+	for len(stats.Stats()) != 0 {
+		if time.Since(started) > 10*time.Second {
+			t.Fatal("The stalled client was never disconnected")
+		}
+		for i := 0; i < 10; i++ {
+			packets <- packet
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
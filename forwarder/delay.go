@@ -0,0 +1,78 @@
+package forwarder
+
+import (
+	"time"
+
+	l "github.com/tormol/AIS/logger"
+)
+
+// DefaultMaxDelayedBytes is how much Delay holds by default before it
+// starts dropping the oldest packets.
+const DefaultMaxDelayedBytes = 256 << 20
+
+// delayResolution is how often Delay checks for packets that have waited long enough.
+const delayResolution = 100 * time.Millisecond
+
+// delayedPacketOverhead is roughly what a waiting packet uses in addition to
+// its Raw bytes, so that many small packets are also bounded by maxBytes.
+const delayedPacketOverhead = 128
+
+// delayedPacket is a packet and when Delay received it.
+type delayedPacket struct {
+	arrived time.Time
+	Packet
+}
+
+// Delay sends packets from in to out after holding each of them for delay,
+// in the order they were received.
+// At most maxBytes of packets are held; when more arrive, the oldest are
+// dropped.
+// Receiving from in doesn't wait for out, so a burst of packets doesn't
+// block whoever is sending them.
+// When in is closed, out is closed and the packets still waiting are dropped.
+func Delay(log *l.Logger, in <-chan Packet, out chan<- Packet, delay time.Duration, maxBytes int) {
+	ticker := time.NewTicker(delayResolution)
+	defer ticker.Stop()
+	delayPackets(log, in, out, delay, maxBytes, time.Now, ticker.C)
+}
+
+// delayPackets is Delay with the clock and the ticker passed in,
+// so that tests don't have to wait.
+func delayPackets(log *l.Logger, in <-chan Packet, out chan<- Packet, delay time.Duration, maxBytes int,
+	now func() time.Time, tick <-chan time.Time) {
+	defer close(out)
+	var waiting []delayedPacket // oldest first
+	bytes := 0
+	var due time.Time // packets that arrived before this can be sent
+	for {
+		var send chan<- Packet // nil unless the oldest packet is due
+		var next Packet
+		if len(waiting) != 0 && !waiting[0].arrived.After(due) {
+			send, next = out, waiting[0].Packet
+		}
+		select {
+		case p, notClosed := <-in:
+			if !notClosed {
+				if len(waiting) != 0 {
+					log.Debug("Dropping %d delayed packets", len(waiting))
+				}
+				return
+			}
+			waiting = append(waiting, delayedPacket{now(), p})
+			bytes += len(p.Raw) + delayedPacketOverhead
+			for bytes > maxBytes {
+				bytes -= len(waiting[0].Raw) + delayedPacketOverhead
+				waiting[0] = delayedPacket{}
+				waiting = waiting[1:]
+				log.Limited("delay_dropped", time.Minute).Warning(
+					"More than %d bytes of packets are delayed, dropping the oldest", maxBytes)
+			}
+		case send <- next:
+			bytes -= len(waiting[0].Raw) + delayedPacketOverhead
+			waiting[0] = delayedPacket{}
+			waiting = waiting[1:]
+		case <-tick:
+			due = now().Add(-delay)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package forwarder
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	l "github.com/tormol/AIS/logger"
+)
+
+// fakeClock is advanced by tests instead of waiting.
+type fakeClock struct {
+	lock sync.Mutex
+	at   time.Time
+}
+
+func (fc *fakeClock) now() time.Time {
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+	return fc.at
+}
+
+func (fc *fakeClock) advance(d time.Duration) time.Time {
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+	fc.at = fc.at.Add(d)
+	return fc.at
+}
+
+func TestDelayedForwarding(t *testing.T) {
+	clock := &fakeClock{at: time.Now()}
+	tick := make(chan time.Time)
+	in := make(chan Packet)
+	toManager := make(chan Packet)
+	logger := l.NewLogger(os.Stderr, l.Debug)
+	go delayPackets(logger, in, toManager, 10*time.Minute, DefaultMaxDelayedBytes, clock.now, tick)
+	add := make(chan Conn)
+	go Manager(logger, toManager, add, nil)
+	client := &filteredTester{received: make(chan string, 10)}
+	add <- client
+
+	in <- Packet{Raw: []byte("delayed"), MMSI: 258439000, Type: 1, Received: clock.now()}
+	tick <- clock.now() // so that the packet has been stamped before the clock changes
+	tick <- clock.advance(5 * time.Minute)
+	tick <- clock.advance(4*time.Minute + 59*time.Second)
+	select {
+	case p := <-client.received:
+		t.Fatalf("Got %q before the delay had passed", p)
+	case <-time.After(50 * time.Millisecond):
+	}
+	tick <- clock.advance(time.Second)
+	select {
+	case p := <-client.received:
+		if p != "delayed" {
+			t.Errorf("Expected the delayed packet, got %q", p)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("The packet wasn't forwarded after the delay")
+	}
+	close(in)
+	if _, open := <-client.received; open {
+		t.Error("Expected the client to be closed when the input is")
+	}
+}
+
+func TestDelayIsBounded(t *testing.T) {
+	clock := &fakeClock{at: time.Now()}
+	tick := make(chan time.Time)
+	in := make(chan Packet)
+	out := make(chan Packet, 100)
+	maxBytes := 10 * (len("packet") + delayedPacketOverhead)
+	go delayPackets(l.NewLogger(os.Stderr, l.Debug), in, out, time.Minute, maxBytes, clock.now, tick)
+	for i := uint32(1); i <= 100000; i++ {
+		in <- Packet{Raw: []byte("packet"), MMSI: i}
+	}
+	tick <- clock.now() // so that the last packet has been stamped before the clock changes
+	tick <- clock.advance(time.Minute)
+	sent := []uint32{}
+	for len(sent) < 10 {
+		select {
+		case p := <-out:
+			sent = append(sent, p.MMSI)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected the 10 packets that fit to be sent, got %v", sent)
+		}
+	}
+	close(in)
+	if p, open := <-out; open {
+		t.Errorf("Expected only 10 packets, also got %+v", p)
+	}
+	for i, mmsi := range sent {
+		if mmsi != uint32(100000-9+i) {
+			t.Fatalf("Expected the newest packets in order, got %v", sent)
+		}
+	}
+}
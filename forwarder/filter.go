@@ -0,0 +1,169 @@
+package forwarder
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/tormol/AIS/geo"
+	"github.com/tormol/AIS/nmeais"
+)
+
+// Packet is a message to forward, with what filters need to know about it.
+type Packet struct {
+	Raw      []byte
+	MMSI     uint32
+	Type     uint8 // AIS message type, 0 if it's not a message
+	Lat, Lon float64
+	HasPos   bool // the message's position or the last known position of the ship
+	Received time.Time
+	Source   string // name of the source the message was first received from
+}
+
+// Filter selects which packets a client wants.
+// A packet must match the rectangles, the MMSIs and the types that are set.
+// Packets without a position never match rectangles.
+// A nil *Filter matches everything.
+type Filter struct {
+	Rects []geo.Rectangle
+	MMSIs map[uint32]struct{}
+	Types map[uint8]struct{}
+	// Forward at most one packet per ship in this interval, zero forwards all.
+	// This needs state per connection, so it's applied by Manager and not Matches.
+	MaxPerShip time.Duration
+}
+
+// maxFilterMMSIs prevents a client from making the server allocate a huge map.
+const maxFilterMMSIs = 1000
+
+// ParseFilter parses a query string with bbox=, mmsi=, types= and max_per_ship= parameters.
+// All but max_per_ship can be repeated, bbox in the format of geo.ParseViewRects
+// and mmsi and types as comma-separated numbers. max_per_ship is a duration
+// such as 30s. Other parameters are ignored.
+// Returns nil if there are no filter parameters.
+func ParseFilter(query string) (*Filter, error) {
+	bboxes, mmsis, types, maxPerShip := []string{}, []string{}, []string{}, []string{}
+	// url.ParseQuery() ignores parameters containing semicolons, which bbox can have
+	for _, param := range strings.Split(query, "&") {
+		var values *[]string
+		if strings.HasPrefix(param, "bbox=") {
+			values = &bboxes
+		} else if strings.HasPrefix(param, "mmsi=") {
+			values = &mmsis
+		} else if strings.HasPrefix(param, "types=") {
+			values = &types
+		} else if strings.HasPrefix(param, "max_per_ship=") {
+			values = &maxPerShip
+		} else {
+			continue
+		}
+		value := param[strings.IndexByte(param, '=')+1:]
+		if unescaped, err := url.QueryUnescape(value); err == nil {
+			value = unescaped
+		}
+		*values = append(*values, value)
+	}
+	if len(bboxes) == 0 && len(mmsis) == 0 && len(types) == 0 && len(maxPerShip) == 0 {
+		return nil, nil
+	}
+	f := &Filter{}
+	if len(bboxes) != 0 {
+		rects, err := geo.ParseViewRects(bboxes)
+		if err != nil {
+			return nil, err
+		}
+		f.Rects = rects
+	}
+	if len(mmsis) != 0 {
+		f.MMSIs = make(map[uint32]struct{})
+		for _, list := range mmsis {
+			for _, s := range strings.Split(list, ",") {
+				mmsi, err := strconv.ParseUint(s, 10, 32)
+				if err != nil || mmsi == 0 || mmsi > 999999999 {
+					return nil, errors.New("Invalid MMSI " + strconv.Quote(s))
+				}
+				f.MMSIs[uint32(mmsi)] = struct{}{}
+			}
+		}
+		if len(f.MMSIs) > maxFilterMMSIs {
+			return nil, errors.New("Too many MMSIs")
+		}
+	}
+	if len(types) != 0 {
+		f.Types = make(map[uint8]struct{})
+		for _, list := range types {
+			for _, s := range strings.Split(list, ",") {
+				t, err := strconv.ParseUint(s, 10, 8)
+				if err != nil || t == 0 || t > nmeais.MaxType {
+					return nil, errors.New("Invalid message type " + strconv.Quote(s))
+				}
+				f.Types[uint8(t)] = struct{}{}
+			}
+		}
+	}
+	if len(maxPerShip) > 1 {
+		return nil, errors.New("max_per_ship is repeated")
+	} else if len(maxPerShip) == 1 {
+		d, err := time.ParseDuration(maxPerShip[0])
+		if err != nil || d < 0 {
+			return nil, errors.New("Invalid max_per_ship " + strconv.Quote(maxPerShip[0]))
+		}
+		f.MaxPerShip = d
+	}
+	return f, nil
+}
+
+// Matches checks whether a client with this filter wants the packet.
+func (f *Filter) Matches(p *Packet) bool {
+	if f == nil {
+		return true
+	}
+	if f.MMSIs != nil {
+		if _, ok := f.MMSIs[p.MMSI]; !ok {
+			return false
+		}
+	}
+	if f.Types != nil {
+		if _, ok := f.Types[p.Type]; !ok {
+			return false
+		}
+	}
+	if f.Rects != nil {
+		if !p.HasPos {
+			return false
+		}
+		pos := geo.Point{Lat: p.Lat, Long: p.Lon}
+		for i := range f.Rects {
+			if f.Rects[i].ContainsPoint(pos) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// filtered is implemented by connections that can have a filter.
+type filtered interface {
+	Filter() *Filter
+}
+
+// filterHolder is embedded in connections whose filter can be replaced
+// while packets are being forwarded to it.
+type filterHolder struct {
+	filter atomic.Value // *Filter
+}
+
+// Filter returns the current filter, which might be nil.
+func (fh *filterHolder) Filter() *Filter {
+	f, _ := fh.filter.Load().(*Filter)
+	return f
+}
+
+// setFilter replaces the filter, nil removes it.
+func (fh *filterHolder) setFilter(f *Filter) {
+	fh.filter.Store(f)
+}
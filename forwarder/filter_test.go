@@ -0,0 +1,182 @@
+package forwarder
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	l "github.com/tormol/AIS/logger"
+)
+
+func TestParseFilter(t *testing.T) {
+	if f, err := ParseFilter("x=1"); f != nil || err != nil {
+		t.Errorf("Expected no filter without filter parameters, got %v %v", f, err)
+	}
+	f, err := ParseFilter("bbox=5,59,6,60;176,-20,-179,-16&mmsi=258439000,257000001&mmsi=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(f.Rects) != 3 { // the second box is split at the antimeridian
+		t.Errorf("Expected 3 rectangles, got %d", len(f.Rects))
+	}
+	if len(f.MMSIs) != 3 {
+		t.Errorf("Expected 3 MMSIs, got %v", f.MMSIs)
+	}
+	f, err = ParseFilter("types=5,24&types=1&max_per_ship=30s")
+	if err != nil || len(f.Types) != 3 || f.MaxPerShip != 30*time.Second || f.MMSIs != nil {
+		t.Errorf("Expected 3 types and 30s, got %+v %v", f, err)
+	}
+	for _, query := range []string{"bbox=5,60,6,59", "mmsi=x", "mmsi=1,,2", "mmsi=1000000000",
+		"types=0", "types=28", "max_per_ship=30", "max_per_ship=-1s", "max_per_ship=1s&max_per_ship=2s"} {
+		if _, err := ParseFilter(query); err == nil {
+			t.Errorf("Expected %q to be rejected", query)
+		}
+	}
+
+	f, isCommand, err := parseFilterCommand("FILTER mmsi=1\r\n")
+	if !isCommand || err != nil || len(f.MMSIs) != 1 {
+		t.Errorf("Expected a command with one MMSI, got %v %t %v", f, isCommand, err)
+	}
+	if f, isCommand, _ := parseFilterCommand("FILTER\n"); !isCommand || f != nil {
+		t.Errorf("Expected FILTER without parameters to remove the filter, got %v", f)
+	}
+	f, isCommand, err = parseFilterCommand("OPTIONS types=1,2,3  max_per_ship=10s\r\n")
+	if !isCommand || err != nil || len(f.Types) != 3 || f.MaxPerShip != 10*time.Second {
+		t.Errorf("Expected OPTIONS with three types and 10s, got %+v %t %v", f, isCommand, err)
+	}
+	if _, isCommand, _ := parseFilterCommand("hello"); isCommand {
+		t.Error("Expected other lines to not be commands")
+	}
+}
+
+// A forwarder.Conn mock which can be filtered
+type filteredTester struct {
+	received chan string
+	filterHolder
+}
+
+func (ft *filteredTester) Write(packet []byte) (int, error) {
+	ft.received <- string(packet)
+	return len(packet), nil
+}
+
+func (ft *filteredTester) Close() error {
+	close(ft.received)
+	return nil
+}
+
+func TestManagerFilters(t *testing.T) {
+	newTester := func(query string) *filteredTester {
+		ft := &filteredTester{received: make(chan string, 10)}
+		f, err := ParseFilter(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ft.setFilter(f)
+		return ft
+	}
+	all := newTester("")
+	area := newTester("bbox=5,59,6,60")
+	mmsis := newTester("mmsi=273316960,1")
+
+	packets := make(chan Packet)
+	add := make(chan Conn)
+	go Manager(l.NewLogger(os.Stderr, l.Debug), packets, add, nil)
+	add <- all
+	add <- area
+	add <- mmsis // unbuffered, so registered before the packets are received
+	packets <- Packet{Raw: []byte("inside"), MMSI: 258439000, Lat: 59.40, Lon: 5.26, HasPos: true}
+	packets <- Packet{Raw: []byte("outside"), MMSI: 273316960, Lat: 62.44, Lon: 6.27, HasPos: true}
+	packets <- Packet{Raw: []byte("unknown"), MMSI: 305305000}
+	close(packets)
+
+	expect := func(name string, ft *filteredTester, want ...string) {
+		got := []string{}
+		for p := range ft.received {
+			got = append(got, p)
+		}
+		if len(got) != len(want) {
+			t.Errorf("%s: expected %v, got %v", name, want, got)
+			return
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("%s: expected %v, got %v", name, want, got)
+				return
+			}
+		}
+	}
+	expect("unfiltered", all, "inside", "outside", "unknown")
+	expect("bbox", area, "inside")
+	expect("mmsi", mmsis, "outside")
+}
+
+func TestManagerDownsampling(t *testing.T) {
+	newTester := func(query string) *filteredTester {
+		ft := &filteredTester{received: make(chan string, 200)}
+		f, err := ParseFilter(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ft.setFilter(f)
+		return ft
+	}
+	all := newTester("")
+	throttled := newTester("max_per_ship=30s")
+	static := newTester("types=5,24")
+
+	packets := make(chan Packet)
+	add := make(chan Conn)
+	stats := NewStatsRequests()
+	go Manager(l.NewLogger(os.Stderr, l.Debug), packets, add, stats)
+	add <- all
+	add <- throttled
+	add <- static
+	start := time.Now()
+	for i := 0; i < 100; i++ {
+		received := start.Add(time.Duration(i) * time.Second)
+		packets <- Packet{Raw: []byte("position"), MMSI: 258439000, Type: 1, Received: received}
+		if i%50 == 0 {
+			packets <- Packet{Raw: []byte("static"), MMSI: 258439000, Type: 5, Received: received}
+		}
+	}
+	clients := stats.Stats()
+	close(packets)
+
+	count := func(ft *filteredTester) map[string]int {
+		got := make(map[string]int)
+		for p := range ft.received {
+			got[p]++
+		}
+		return got
+	}
+	if got := count(all); got["position"] != 100 || got["static"] != 2 {
+		t.Errorf("Expected the unthrottled client to get everything, got %v", got)
+	}
+	// at 0s, 30s, 60s and 90s, and the static report at 50s is from the same ship
+	if got := count(throttled); got["position"]+got["static"] != 4 {
+		t.Errorf("Expected the throttled client to get one message per 30s, got %v", got)
+	}
+	if got := count(static); got["position"] != 0 || got["static"] != 2 {
+		t.Errorf("Expected only the static reports, got %v", got)
+	}
+	if clients[0].Suppressed != 0 || clients[1].Suppressed != 98 || clients[2].Suppressed != 0 {
+		t.Errorf("Expected the throttled client to have 98 suppressed, got %+v", clients)
+	}
+}
+
+func TestShipThrottleIsBounded(t *testing.T) {
+	st := newShipThrottle()
+	at := time.Now()
+	for mmsi := uint32(1); mmsi <= maxThrottledShips+10; mmsi++ {
+		if !st.allow(mmsi, at, time.Minute) {
+			t.Fatalf("Expected the first packet from %d to be allowed", mmsi)
+		}
+	}
+	if len(st.sent) != maxThrottledShips || st.lru.Len() != maxThrottledShips {
+		t.Errorf("Expected %d ships to be remembered, got %d and %d", maxThrottledShips, len(st.sent), st.lru.Len())
+	}
+	if !st.allow(1, at, time.Minute) || st.allow(maxThrottledShips+10, at, time.Minute) {
+		t.Error("Expected the oldest ship to be forgotten and the newest to be remembered")
+	}
+}
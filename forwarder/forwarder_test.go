@@ -3,9 +3,12 @@ package forwarder
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"io"
 	"math"
 	"os"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -60,6 +63,10 @@ func (mt *managerTester) Write(packet []byte) (int, error) {
 	return len(packet), nil
 }
 
+func (mt *managerTester) String() string {
+	return fmt.Sprintf("mock %d", mt.id)
+}
+
 func (mt *managerTester) Close() error {
 	if mt.packetIndex != len(mt.packets) {
 		mt.t.Errorf("conn %d: Wanted %d packets, got %d",
@@ -97,17 +104,27 @@ func TestManager(t *testing.T) {
 	}
 
 	add := make(chan Conn)
-	sender := make(chan []byte, 10)
+	sender := make(chan Packet, 10)
 	l := l.NewLogger(os.Stderr, l.Info)
-	go Manager(l, sender, add)
+	stats := NewStatsRequests()
+	go Manager(l, sender, add, stats)
 	for _, c := range conns {
 		add <- c
 	}
+	clients := stats.Stats()
+	if len(clients) != len(conns) {
+		t.Fatalf("Expected %d clients, got %d", len(conns), len(clients))
+	}
+	for i, c := range clients {
+		if c.Remote != conns[i].String() || c.Sent != 0 || c.Connected.IsZero() {
+			t.Errorf("Unexpected stats for conn %d: %+v", conns[i].id, c)
+		}
+	}
 
 	// the sum of time up to p packets is int (maxmaxdelay/2)(sin(p/10)+1) dp
 	// = (p-10 cos(p/10))*maxmaxdelay/2
-	// test that channels are flushed before closing the connection is closed:
-	waitFor := float64(len(packets) - ConnChannelCap/2)
+	// test that buffers are flushed before closing the connection is closed:
+	waitFor := float64(len(packets) - 10)
 	// the sum of time for that is int_0^waitFor (maxmaxdelay/2)(sin(p/10)+1) dp
 	// = (waitfor-10 cos(waitfor/10))*maxmaxdelay/2 - (0-10 cos(0/10))*maxmaxdelay/2
 	// = (waitfor-10 cos(waitfor/10) + 10)*maxmaxdelay/2
@@ -115,12 +132,17 @@ func TestManager(t *testing.T) {
 	avg := time.Duration(duration) / time.Duration(len(packets))
 	for _, p := range packets {
 		time.Sleep(avg)
-		sender <- p
+		sender <- Packet{Raw: p}
 	}
 	for running > 0 {
 		<-closer
 		running--
 	}
+	for _, c := range stats.Stats() {
+		if c.Remote != conns[3].String() && (c.Sent != uint64(len(packets)) || c.Dropped != 0) {
+			t.Errorf("Expected %s to have been sent all packets, got %+v", c.Remote, c)
+		}
+	}
 
 	close(sender)
 	time.Sleep(500 * time.Millisecond) // wait until it's finished
@@ -134,3 +156,82 @@ func TestManager(t *testing.T) {
 		}
 	}
 }
+
+// slowConn is a Conn that doesn't accept anything until unblocked,
+// and then accepts at most 7 bytes per Write.
+type slowConn struct {
+	unblock  chan struct{}
+	lock     sync.Mutex
+	received []byte
+	closed   chan struct{}
+}
+
+func (sc *slowConn) Write(data []byte) (int, error) {
+	<-sc.unblock
+	if len(data) > 7 {
+		data = data[:7]
+	}
+	sc.lock.Lock()
+	sc.received = append(sc.received, data...)
+	sc.lock.Unlock()
+	return len(data), io.ErrShortWrite
+}
+
+func (sc *slowConn) Close() error {
+	close(sc.closed)
+	return nil
+}
+
+// Tests that a client which doesn't keep up loses the oldest whole packets,
+// and gets the rest once it catches up.
+func TestSlowClientDropsWholePackets(t *testing.T) {
+	defer func(size int) { ConnBufferSize = size }(ConnBufferSize)
+	ConnBufferSize = 1000
+	add := make(chan Conn)
+	sender := make(chan Packet)
+	stats := NewStatsRequests()
+	go Manager(l.NewLogger(os.Stderr, l.Info), sender, add, stats)
+	sc := &slowConn{unblock: make(chan struct{}), closed: make(chan struct{})}
+	add <- sc
+
+	const n = 200
+	for i := 0; i < n; i++ { // 15 bytes each, so only some fit
+		sender <- Packet{Raw: []byte(fmt.Sprintf("!AIVDM,%d,x\r\n", 1000+i))}
+	}
+	clients := stats.Stats()
+	if len(clients) != 1 || clients[0].Sent != n || clients[0].Dropped == 0 {
+		t.Fatalf("Expected %d sent with some dropped, got %+v", n, clients)
+	}
+	close(sc.unblock)
+	close(sender)
+	select {
+	case <-sc.closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("The connection wasn't closed")
+	}
+
+	lines := strings.SplitAfter(string(sc.received), "\r\n")
+	if lines[len(lines)-1] != "" {
+		t.Errorf("Expected the stream to end with a complete packet, got %q", lines[len(lines)-1])
+	}
+	lines = lines[:len(lines)-1]
+	// The first packet might have been popped before the others were pushed,
+	// so only the ones after it have to be contiguous.
+	next := n - len(lines) + 1
+	for i, line := range lines {
+		var num int
+		if _, err := fmt.Sscanf(line, "!AIVDM,%d,x\r\n", &num); err != nil || len(line) != 15 {
+			t.Fatalf("Expected whole packets, got %q", line)
+		} else if i != 0 && num != 1000+next {
+			t.Fatalf("Expected packet %d after %q, got %q", next, lines[i-1], line)
+		} else if i != 0 {
+			next++
+		}
+	}
+	if uint64(len(lines))+clients[0].Dropped != n {
+		t.Errorf("Received %d packets, but %d of %d were dropped", len(lines), clients[0].Dropped, n)
+	}
+	if next != n {
+		t.Errorf("Expected the newest packet to be received, ended before %d", next)
+	}
+}
@@ -1,7 +1,9 @@
 package forwarder
 
 import (
+	"fmt"
 	"io"
+	"sort"
 	"strings"
 	"time"
 
@@ -9,16 +11,36 @@ import (
 )
 
 const (
-	// ConnChannelCap is the capacity of the channel to each connection wrapper
-	ConnChannelCap = 20
+	// DefaultConnBufferSize is the default of ConnBufferSize
+	DefaultConnBufferSize = 256 * 1024
 	// UDPTimeout is how long packets will be sent for after a received packet
 	UDPTimeout = 5 * time.Second
+	// DefaultWriteTimeout is the default of WriteTimeout
+	DefaultWriteTimeout = 30 * time.Second
 )
 
 // ClientLogLevel controls weither client IO errors should be logged
 var ClientLogLevel = l.Ignore
 
+// ConnBufferSize is how many bytes of packets can wait to be written to each
+// connection before the oldest are dropped.
+// Changing it only affects connections added afterwards.
+var ConnBufferSize = DefaultConnBufferSize
+
+// WriteTimeout is how long a write to a TCP connection can block before
+// the client is disconnected, so that clients which have gone away without
+// closing the connection don't keep their goroutine stuck forever.
+// Zero disables it.
+var WriteTimeout = DefaultWriteTimeout
+
+// deadliner is the part of net.Conn that forwardTo uses to time out writes.
+type deadliner interface {
+	SetWriteDeadline(time.Time) error
+}
+
 // Conn abstracts away the actual trait from other files
+// If it also implements fmt.Stringer, that is used to describe the client
+// in ClientStats.
 type Conn interface {
 	io.WriteCloser
 }
@@ -26,13 +48,123 @@ type Conn interface {
 // monotonically increasing ID sent when a forwarder stops on its own.
 type token uint64
 
+// A forwarder as seen by Manager()
+type connection struct {
+	packets  *packetRing
+	filter   filtered // nil if the connection cannot be filtered
+	tags     bool     // prefix sentences with TAG blocks
+	stats    ClientStats
+	throttle *shipThrottle // created when the filter first has MaxPerShip
+}
+
+// wants checks the filter of the connection, and whether a packet from the
+// ship has been sent too recently.
+func (c *connection) wants(p *Packet) bool {
+	if c.filter == nil {
+		return true
+	}
+	f := c.filter.Filter()
+	if !f.Matches(p) {
+		return false
+	}
+	if f == nil || f.MaxPerShip == 0 {
+		return true
+	}
+	if c.throttle == nil {
+		c.throttle = newShipThrottle()
+	}
+	if !c.throttle.allow(p.MMSI, p.Received, f.MaxPerShip) {
+		c.stats.Suppressed++
+		return false
+	}
+	return true
+}
+
+// resume pushes the packets the connection missed after seq, or the gap
+// marker if they're not all remembered.
+// Must be called before any new packets are pushed.
+func (c *connection) resume(replay *Replay, seq uint64) {
+	missed, gap := replay.After(seq)
+	if gap {
+		c.packets.push(gapMarker)
+	}
+	for i := range missed {
+		if c.wants(&missed[i].Packet) {
+			c.stats.Sent++
+			c.stats.Dropped += uint64(c.packets.push(missed[i].Packet.Raw))
+		}
+	}
+}
+
+// ClientStats describes a connection and how well it keeps up.
+type ClientStats struct {
+	Token     uint64    `json:"token"`
+	Remote    string    `json:"remote"`
+	Connected time.Time `json:"connected"`
+	Sent      uint64    `json:"sent"`    // packets passed to the connection
+	Dropped   uint64    `json:"dropped"` // of Sent, because its buffer was full
+	// Not sent because of Filter.MaxPerShip
+	Suppressed uint64 `json:"suppressed"`
+}
+
+// StatsRequests lets other goroutines ask a Manager for statistics.
+type StatsRequests chan chan<- []ClientStats
+
+// NewStatsRequests creates the channel to pass to Manager.
+func NewStatsRequests() StatsRequests {
+	return make(StatsRequests)
+}
+
+// Stats returns statistics for the current connections, oldest first.
+// Blocks forever if the Manager has returned.
+func (sr StatsRequests) Stats() []ClientStats {
+	reply := make(chan []ClientStats, 1)
+	sr <- reply
+	return <-reply
+}
+
+// describe returns the String() of connections that have it.
+func describe(c Conn) string {
+	if s, ok := c.(fmt.Stringer); ok {
+		return s.String()
+	}
+	return fmt.Sprintf("%T", c)
+}
+
 // Manager starts new forwarders and cancels them if they stop consuming packets.
 // Returns when the packet channel is closed.
 // forwarders do not merge buffered packets, but TCP-based connections might
 // both merge and split packets.
-func Manager(log *l.Logger, packets <-chan []byte, add <-chan Conn) {
+// Each connection has a buffer of ConnBufferSize bytes, and when a client
+// doesn't keep up the oldest whole packets in it are dropped.
+// Connections which have a Filter() only get the packets that match it,
+// and at most one per ship per Filter.MaxPerShip, and connections whose TagBlocks() returns true get a TAG block before every sentence.
+// Statistics can be requested through stats, which can be nil.
+func Manager(log *l.Logger, packets <-chan Packet, add <-chan Conn, stats StatsRequests) {
+	manage(log, packets, add, stats, nil)
+}
+
+// gapMarker is sent to clients that resume from a packet that is no longer
+// remembered, before the new packets.
+var gapMarker = []byte("{\"gap\":true}\n")
+
+// SequencedManager is a Manager for packets that are JSON objects, which
+// get a sequence number from replay, see Replay.AddObject.
+// Connections that implement ResumeAfter() first get the packets replay
+// remembers after the sequence number they want to resume after, or
+// {"gap":true} if some of them have been forgotten.
+// Because the numbers are assigned here, they're in the order the packets
+// are forwarded in even when several goroutines send to packets.
+func SequencedManager(log *l.Logger, packets <-chan Packet, add <-chan Conn, stats StatsRequests,
+	replay *Replay) {
+	manage(log, packets, add, stats, replay)
+}
+
+// manage is Manager and SequencedManager, replay is nil for Manager.
+func manage(log *l.Logger, packets <-chan Packet, add <-chan Conn, stats StatsRequests,
+	replay *Replay) {
 	prevToken := token(0)
-	connections := make(map[token]chan<- []byte)
+	connections := make(map[token]*connection)
 	closer := make(chan token) // unbuffered
 	for {
 		select {
@@ -40,25 +172,56 @@ func Manager(log *l.Logger, packets <-chan []byte, add <-chan Conn) {
 			if !notClosed {
 				// close all connections and stop
 				for _, c := range connections {
-					close(c)
+					c.packets.close()
 				}
 				return
 			}
+			if replay != nil {
+				p = replay.AddObject(p).Packet
+			}
 			// Forward packet to all connections, but don't block on full
-			// channels in case it's full because the client or connections is
+			// buffers in case it's full because the client or connections is
 			// slow. Slow clients will just not get all packets.
+			var withTag []byte // created when needed
 			for _, c := range connections {
-				select {
-				case c <- p:
-				default:
+				if !c.wants(&p) {
+					continue
+				}
+				send := p.Raw
+				if c.tags {
+					if withTag == nil {
+						withTag = withTags(p.Raw, TagBlock(p.Received, p.Source))
+					}
+					send = withTag
 				}
+				c.stats.Sent++
+				c.stats.Dropped += uint64(c.packets.push(send))
+			}
+		case reply := <-stats:
+			all := make([]ClientStats, 0, len(connections))
+			for _, c := range connections {
+				all = append(all, c.stats)
 			}
+			sort.Slice(all, func(i, j int) bool { return all[i].Token < all[j].Token })
+			reply <- all
 		case t := <-closer: // a forwarder stopped on its own
 			delete(connections, t)
 		case to := <-add: // create new forwarder
-			c := make(chan []byte, ConnChannelCap)
+			c := newPacketRing(ConnBufferSize)
 			prevToken++
-			connections[prevToken] = c
+			f, _ := to.(filtered)
+			t, _ := to.(tagged)
+			conn := &connection{c, f, t != nil && t.TagBlocks(), ClientStats{
+				Token:     uint64(prevToken),
+				Remote:    describe(to),
+				Connected: time.Now(),
+			}, nil}
+			connections[prevToken] = conn
+			if r, ok := to.(resuming); ok && replay != nil {
+				if after, resume := r.ResumeAfter(); resume {
+					conn.resume(replay, after)
+				}
+			}
 			go forwardTo(log, to, c, prevToken, closer)
 		}
 	}
@@ -66,11 +229,19 @@ func Manager(log *l.Logger, packets <-chan []byte, add <-chan Conn) {
 
 // Wrapper around forwarders created by Manager().
 // Returns when there is an error or manager cancels it.
-func forwardTo(log *l.Logger, to Conn, packets <-chan []byte,
+func forwardTo(log *l.Logger, to Conn, packets *packetRing,
 	token token, closer chan<- token) {
+	deadline, _ := to.(deadliner)
 get:
-	for packet := range packets {
+	for {
+		packet, open := packets.pop()
+		if !open {
+			break
+		}
 		for {
+			if deadline != nil && WriteTimeout != 0 {
+				deadline.SetWriteDeadline(time.Now().Add(WriteTimeout))
+			}
 			sent, err := to.Write(packet)
 			if err != nil && err != io.ErrShortWrite {
 				if !strings.Contains(err.Error(), "broken pipe") {
@@ -85,7 +256,7 @@ get:
 			}
 		}
 	}
-	// Don't send token if channel was closed: manager has already removed us.
+	// Don't send token if the ring was closed: manager has already removed us.
 	err := to.Close()
 	if err != nil {
 		log.Log(ClientLogLevel, "forwarder %d Close() error: %s", token, err.Error())
@@ -0,0 +1,143 @@
+package forwarder
+
+import (
+	"strconv"
+	"sync"
+)
+
+// Sequenced is a packet with its sequence number.
+type Sequenced struct {
+	Seq    uint64
+	Packet Packet
+}
+
+// Replay assigns sequence numbers to packets and remembers the most recent
+// ones, so that a client that was briefly disconnected can get what it missed.
+// Sequence numbers start at 1 and are only unique within a process.
+// For the numbers to match the order packets are sent in, Add() must be
+// called where the packets are fanned out, by the goroutine doing it.
+type Replay struct {
+	lock   sync.Mutex
+	ring   []Sequenced
+	oldest int    // index in ring
+	stored int    // number of packets in ring
+	next   uint64 // sequence number of the next packet
+}
+
+// NewReplay creates a Replay that remembers the last capacity packets.
+func NewReplay(capacity int) *Replay {
+	if capacity < 0 {
+		capacity = 0
+	}
+	return &Replay{
+		ring: make([]Sequenced, capacity),
+		next: 1,
+	}
+}
+
+// Add assigns the next sequence number to a packet and remembers it,
+// forgetting the oldest packet if full.
+// The packet must not be modified afterwards.
+func (r *Replay) Add(packet Packet) Sequenced {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.add(packet)
+}
+
+// AddObject is Add for packets that are a JSON object followed by a newline,
+// which get the sequence number as the first field, "seq".
+func (r *Replay) AddObject(packet Packet) Sequenced {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	packet.Raw = withSeq(packet.Raw, r.next)
+	return r.add(packet)
+}
+
+// withSeq returns a copy of a JSON object with "seq" added as the first field.
+func withSeq(object []byte, seq uint64) []byte {
+	if len(object) < 2 || object[0] != '{' {
+		return object
+	}
+	with := make([]byte, 0, len(object)+30)
+	with = append(with, `{"seq":`...)
+	with = strconv.AppendUint(with, seq, 10)
+	if object[1] != '}' {
+		with = append(with, ',')
+	}
+	return append(with, object[1:]...)
+}
+
+// add is Add without locking.
+func (r *Replay) add(packet Packet) Sequenced {
+	s := Sequenced{Seq: r.next, Packet: packet}
+	r.next++
+	if len(r.ring) == 0 {
+		return s
+	}
+	if r.stored == len(r.ring) {
+		r.ring[r.oldest] = s
+		r.oldest = (r.oldest + 1) % len(r.ring)
+	} else {
+		r.ring[(r.oldest+r.stored)%len(r.ring)] = s
+		r.stored++
+	}
+	return s
+}
+
+// Last returns the sequence number of the most recently added packet,
+// or zero if none has been added.
+func (r *Replay) Last() uint64 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.next - 1
+}
+
+// After returns the remembered packets with a sequence number greater than
+// seq, oldest first.
+// If some of them have been forgotten, or seq is from the future (such as
+// from before a restart), nothing is returned and gap is true:
+// the client should start fresh and be told that it missed something.
+// To not miss or repeat packets, a client should start receiving new
+// packets before calling this, and skip those that were also returned here.
+func (r *Replay) After(seq uint64) (missed []Sequenced, gap bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if seq >= r.next {
+		return nil, true
+	}
+	oldestSeq := r.next - uint64(r.stored)
+	if seq+1 < oldestSeq {
+		return nil, true
+	}
+	skip := int(seq + 1 - oldestSeq)
+	missed = make([]Sequenced, 0, r.stored-skip)
+	for i := skip; i < r.stored; i++ {
+		missed = append(missed, r.ring[(r.oldest+i)%len(r.ring)])
+	}
+	return missed, false
+}
+
+// resuming is implemented by connections that can resume a sequenced stream.
+type resuming interface {
+	ResumeAfter() (seq uint64, resume bool)
+}
+
+// resumeOption is embedded in connections that can resume.
+type resumeOption struct {
+	after  uint64 // immutable
+	resume bool
+}
+
+// newResumeOption resumes after *seq, or doesn't resume if seq is nil.
+func newResumeOption(seq *uint64) resumeOption {
+	if seq == nil {
+		return resumeOption{}
+	}
+	return resumeOption{*seq, true}
+}
+
+// ResumeAfter returns the sequence number the client got last,
+// and false if it doesn't want to resume.
+func (ro resumeOption) ResumeAfter() (uint64, bool) {
+	return ro.after, ro.resume
+}
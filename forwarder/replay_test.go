@@ -0,0 +1,118 @@
+package forwarder
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func addN(r *Replay, from, n int) {
+	for i := from; i < from+n; i++ {
+		r.Add(Packet{Raw: []byte(strconv.Itoa(i))})
+	}
+}
+
+func checkMissed(t *testing.T, missed []Sequenced, firstSeq uint64, n int) {
+	if len(missed) != n {
+		t.Fatalf("Expected %d packets, got %d: %v", n, len(missed), missed)
+	}
+	for i, s := range missed {
+		seq := firstSeq + uint64(i)
+		if s.Seq != seq || string(s.Packet.Raw) != strconv.Itoa(int(seq)) {
+			t.Errorf("Expected packet %d to be %d, got %d %s", i, seq, s.Seq, s.Packet.Raw)
+		}
+	}
+}
+
+func TestReplayResume(t *testing.T) {
+	r := NewReplay(10)
+	if r.Last() != 0 {
+		t.Errorf("Expected Last() to be 0 before anything is added, got %d", r.Last())
+	}
+	addN(r, 1, 5)
+	// a client that got 3 reconnects
+	missed, gap := r.After(3)
+	if gap {
+		t.Error("Expected no gap")
+	}
+	checkMissed(t, missed, 4, 2)
+	// a client that is up to date
+	missed, gap = r.After(5)
+	if gap || len(missed) != 0 {
+		t.Errorf("Expected nothing to be missed, got %v %t", missed, gap)
+	}
+	// a client that connected before anything was sent
+	missed, gap = r.After(0)
+	if gap {
+		t.Error("Expected no gap")
+	}
+	checkMissed(t, missed, 1, 5)
+}
+
+func TestReplayAfterEviction(t *testing.T) {
+	r := NewReplay(4)
+	addN(r, 1, 10)
+	missed, gap := r.After(5)
+	if !gap || missed != nil {
+		t.Errorf("Expected a gap for an evicted packet, got %v %t", missed, gap)
+	}
+	// the oldest remembered is 7, so resuming after 6 misses nothing
+	missed, gap = r.After(6)
+	if gap {
+		t.Error("Expected no gap")
+	}
+	checkMissed(t, missed, 7, 4)
+	// from before a restart
+	missed, gap = r.After(11)
+	if !gap || missed != nil {
+		t.Errorf("Expected a gap for a sequence number from the future, got %v %t", missed, gap)
+	}
+
+	empty := NewReplay(0)
+	addN(empty, 1, 3)
+	if _, gap := empty.After(2); !gap {
+		t.Error("Expected a gap when nothing is remembered")
+	}
+	if missed, gap := empty.After(3); gap || len(missed) != 0 {
+		t.Errorf("Expected nothing missed when up to date, got %v %t", missed, gap)
+	}
+}
+
+// Sequence numbers must be in the order the packets are stored,
+// even with concurrent adders.
+func TestReplayConcurrentAdd(t *testing.T) {
+	r := NewReplay(1000)
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 250; i++ {
+				r.Add(Packet{})
+			}
+		}()
+	}
+	wg.Wait()
+	missed, gap := r.After(0)
+	if gap || len(missed) != 1000 {
+		t.Fatalf("Expected 1000 packets, got %d %t", len(missed), gap)
+	}
+	for i, s := range missed {
+		if s.Seq != uint64(i+1) {
+			t.Fatalf("Expected packet %d to have seq %d, got %d", i, i+1, s.Seq)
+		}
+	}
+}
+
+func TestReplayAddObject(t *testing.T) {
+	r := NewReplay(2)
+	if s := r.AddObject(Packet{Raw: []byte("{\"mmsi\":1}\n")}); string(s.Packet.Raw) != "{\"seq\":1,\"mmsi\":1}\n" {
+		t.Errorf("Expected seq to be the first field, got %q", s.Packet.Raw)
+	}
+	if s := r.AddObject(Packet{Raw: []byte("{}\n")}); string(s.Packet.Raw) != "{\"seq\":2}\n" {
+		t.Errorf("Expected seq to be the only field, got %q", s.Packet.Raw)
+	}
+	if missed, _ := r.After(1); len(missed) != 1 || string(missed[0].Packet.Raw) != "{\"seq\":2}\n" {
+		t.Errorf("Expected the packet to be remembered with seq, got %v", missed)
+	}
+}
@@ -0,0 +1,71 @@
+package forwarder
+
+import "sync"
+
+// packetRing is the packets waiting to be written to a connection.
+// Like a ring buffer it has a fixed size in bytes and overwrites the oldest
+// data when full, but it always drops whole packets, so that a client never
+// gets half of a message.
+type packetRing struct {
+	lock    sync.Mutex
+	ready   sync.Cond // signalled when a packet is added or the ring is closed
+	packets [][]byte  // oldest first
+	bytes   int       // total length of packets
+	size    int
+	closed  bool
+}
+
+// newPacketRing creates an empty ring that can hold size bytes.
+func newPacketRing(size int) *packetRing {
+	r := &packetRing{size: size}
+	r.ready.L = &r.lock
+	return r
+}
+
+// push adds a packet, after dropping the oldest packets that must go to make
+// room for it, and returns how many were dropped.
+// A packet bigger than the whole ring is dropped itself, and so are packets
+// pushed after close.
+func (r *packetRing) push(packet []byte) (dropped int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.closed || len(packet) > r.size {
+		return 1
+	}
+	for r.bytes+len(packet) > r.size {
+		r.bytes -= len(r.packets[0])
+		r.packets[0] = nil
+		r.packets = r.packets[1:]
+		dropped++
+	}
+	r.packets = append(r.packets, packet)
+	r.bytes += len(packet)
+	r.ready.Signal()
+	return dropped
+}
+
+// pop removes and returns the oldest packet, and waits for one if empty.
+// Returns false when the ring has been closed and all packets have been popped.
+func (r *packetRing) pop() ([]byte, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for len(r.packets) == 0 && !r.closed {
+		r.ready.Wait()
+	}
+	if len(r.packets) == 0 {
+		return nil, false
+	}
+	packet := r.packets[0]
+	r.packets[0] = nil
+	r.packets = r.packets[1:]
+	r.bytes -= len(packet)
+	return packet, true
+}
+
+// close makes pop return false once the remaining packets have been popped.
+func (r *packetRing) close() {
+	r.lock.Lock()
+	r.closed = true
+	r.ready.Broadcast()
+	r.lock.Unlock()
+}
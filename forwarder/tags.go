@@ -0,0 +1,60 @@
+package forwarder
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tagged is implemented by connections that might want TAG blocks.
+type tagged interface {
+	TagBlocks() bool
+}
+
+// tagsOption is embedded in connections where TAG blocks are optional.
+type tagsOption struct {
+	tags bool // immutable
+}
+
+// TagBlocks returns whether the client wants TAG blocks.
+func (to tagsOption) TagBlocks() bool {
+	return to.tags
+}
+
+// tagSourceReplacer removes characters that would end the s: field or the TAG block.
+var tagSourceReplacer = strings.NewReplacer(",", "_", "*", "_", "\\", "_", "\r", "_", "\n", "_")
+
+// TagBlock creates an IEC 61162-1 TAG block with the time in seconds and the source,
+// such as `\c:1492683034,s:Kystverket*16\`.
+func TagBlock(received time.Time, source string) []byte {
+	fields := "c:" + strconv.FormatInt(received.Unix(), 10) + ",s:" + tagSourceReplacer.Replace(source)
+	checksum := byte(0)
+	for i := 0; i < len(fields); i++ {
+		checksum ^= fields[i]
+	}
+	return []byte(fmt.Sprintf("\\%s*%02X\\", fields, checksum))
+}
+
+// withTags prefixes every sentence in raw with tag,
+// replacing any TAG block the sentence was received with.
+func withTags(raw, tag []byte) []byte {
+	tagged := make([]byte, 0, len(raw)+2*len(tag))
+	for len(raw) != 0 {
+		end := bytes.IndexByte(raw, '\n') + 1
+		if end == 0 {
+			end = len(raw)
+		}
+		sentence := raw[:end]
+		raw = raw[end:]
+		if sentence[0] == '\\' {
+			if tagEnd := bytes.IndexByte(sentence[1:], '\\'); tagEnd != -1 {
+				sentence = sentence[tagEnd+2:]
+			}
+		}
+		tagged = append(tagged, tag...)
+		tagged = append(tagged, sentence...)
+	}
+	return tagged
+}
@@ -0,0 +1,62 @@
+package forwarder
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	l "github.com/tormol/AIS/logger"
+	"github.com/tormol/AIS/nmeais"
+)
+
+func TestTagBlock(t *testing.T) {
+	received := time.Unix(1492683034, 0)
+	if tag := string(TagBlock(received, "Kystverket")); tag != "\\c:1492683034,s:Kystverket*16\\" {
+		t.Errorf("Expected \\c:1492683034,s:Kystverket*16\\, got %s", tag)
+	}
+	tag := TagBlock(received, "a,b*c\\d")
+	s, err := nmeais.ParseSentence(append(tag, "!BSVDM,1,1,,A,14S:Eb001ePRmHBTAAFnrmV60PRk,0*1F\r\n"...),
+		time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.TagTime.Equal(received) || s.TagSource != "a_b_c_d" {
+		t.Errorf("Expected the TAG block to be valid, got %s from %q", s.TagTime, s.TagSource)
+	}
+}
+
+func TestManagerTags(t *testing.T) {
+	raw := "!AIVDM,2,1,1,A,55?MbV02;H;s<HtKR20EHE:0@T4@Dn2222222216L961O5Gf0NSQEp6ClRp8,0*1C\r\n" +
+		"\\g:2-2-3456*59\\!AIVDM,2,2,1,A,88888888880,2*25\r\n"
+	plain := &filteredTester{received: make(chan string, 10)}
+	tags := &struct {
+		filteredTester
+		tagsOption
+	}{filteredTester{received: make(chan string, 10)}, tagsOption{true}}
+
+	packets := make(chan Packet)
+	add := make(chan Conn)
+	go Manager(l.NewLogger(os.Stderr, l.Debug), packets, add, nil)
+	add <- plain
+	add <- tags
+	packets <- Packet{Raw: []byte(raw), Received: time.Unix(1492683034, 0), Source: "test"}
+	close(packets)
+
+	if got := <-plain.received; got != raw {
+		t.Errorf("Expected the packet to be unchanged without tags, got %q", got)
+	}
+	sentences := strings.SplitAfter(<-tags.received, "\n")
+	if len(sentences) != 3 || sentences[2] != "" {
+		t.Fatalf("Expected two sentences, got %q", sentences)
+	}
+	for i, text := range sentences[:2] {
+		s, err := nmeais.ParseSentence([]byte(text), time.Now())
+		if err != nil {
+			t.Errorf("sentence %d: %s", i, err.Error())
+		} else if !s.TagTime.Equal(time.Unix(1492683034, 0)) || s.TagSource != "test" ||
+			strings.Count(text, "\\") != 2 {
+			t.Errorf("Expected sentence %d to have one valid TAG block, got %q", i, text)
+		}
+	}
+}
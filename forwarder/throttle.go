@@ -0,0 +1,56 @@
+package forwarder
+
+import (
+	"container/list"
+	"time"
+)
+
+// maxThrottledShips bounds the memory used per connection by Filter.MaxPerShip.
+// When there are more ships, the one that was sent least recently is
+// forgotten, and its next packet is always sent.
+const maxThrottledShips = 50000
+
+// shipThrottle remembers when a packet from each ship was last sent to a
+// connection, for Filter.MaxPerShip.
+// It is only used by Manager, and so isn't synchronized.
+type shipThrottle struct {
+	sent map[uint32]*list.Element // of *throttledShip
+	lru  *list.List               // most recently sent first
+}
+
+type throttledShip struct {
+	mmsi uint32
+	at   time.Time
+}
+
+func newShipThrottle() *shipThrottle {
+	return &shipThrottle{
+		sent: make(map[uint32]*list.Element),
+		lru:  list.New(),
+	}
+}
+
+// allow returns whether a packet from mmsi received at should be sent,
+// and if so remembers it.
+// Packets without an MMSI are always allowed.
+func (st *shipThrottle) allow(mmsi uint32, at time.Time, interval time.Duration) bool {
+	if mmsi == 0 {
+		return true
+	}
+	if e, known := st.sent[mmsi]; known {
+		ts := e.Value.(*throttledShip)
+		if at.Before(ts.at.Add(interval)) {
+			return false
+		}
+		ts.at = at
+		st.lru.MoveToFront(e)
+		return true
+	}
+	if st.lru.Len() >= maxThrottledShips {
+		oldest := st.lru.Back()
+		delete(st.sent, oldest.Value.(*throttledShip).mmsi)
+		st.lru.Remove(oldest)
+	}
+	st.sent[mmsi] = st.lru.PushFront(&throttledShip{mmsi, at})
+	return true
+}
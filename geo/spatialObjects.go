@@ -3,8 +3,13 @@ package geo
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
 	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // Point is a set of <latitude, longitude> coordinates.
@@ -30,11 +35,116 @@ func (a Point) DistanceTo(b Point) float64 {
 	return hypotenuse // [3.] end
 }
 
+// EarthRadius is the mean radius of the earth in meters.
+const EarthRadius = 6371008.8
+
+// longDifference returns b - a in radians, normalized to [-π, π]
+// so that it goes the short way around across the antimeridian.
+func longDifference(a, b float64) float64 {
+	d := math.Mod(b-a, 360)
+	if d > 180 {
+		d -= 360
+	} else if d < -180 {
+		d += 360
+	}
+	return d * math.Pi / 180
+}
+
+// HaversineDistanceTo returns the great-circle distance to another point in meters.
+// Unlike DistanceTo it's a real-world distance, but it's also slower.
+func (a Point) HaversineDistanceTo(b Point) float64 {
+	lat1, lat2 := a.Lat*math.Pi/180, b.Lat*math.Pi/180
+	sinLat := math.Sin((lat2 - lat1) / 2)
+	sinLong := math.Sin(longDifference(a.Long, b.Long) / 2)
+	h := sinLat*sinLat + math.Cos(lat1)*math.Cos(lat2)*sinLong*sinLong
+	return 2 * EarthRadius * math.Asin(math.Sqrt(math.Min(h, 1))) // rounding can make h slightly above 1
+}
+
+// BearingTo returns the initial bearing of the great circle to another point,
+// in degrees clockwise from north in the range [0, 360).
+func (a Point) BearingTo(b Point) float64 {
+	lat1, lat2 := a.Lat*math.Pi/180, b.Lat*math.Pi/180
+	dLong := longDifference(a.Long, b.Long)
+	y := math.Sin(dLong) * math.Cos(lat2)
+	x := math.Cos(lat1)*math.Sin(lat2) - math.Sin(lat1)*math.Cos(lat2)*math.Cos(dLong)
+	bearing := math.Atan2(y, x) * 180 / math.Pi
+	return math.Mod(bearing+360, 360)
+}
+
+// ProjectPosition returns where something at p moving with the given course
+// (degrees clockwise from north) and speed (knots) will be after dt.
+// It treats the earth as flat with longitudes scaled by cos(latitude),
+// which is accurate enough for the few nautical miles ships move in minutes.
+// The longitude is normalized when crossing the antimeridian,
+// and the latitude stops at the poles.
+// Within PoleMargin of a pole only the latitude changes, see OffsetPoint.
+func ProjectPosition(p Point, courseDeg, speedKnots float64, dt time.Duration) Point {
+	return OffsetPoint(p, courseDeg, speedKnots*dt.Hours()*metersPerNauticalMile)
+}
+
+// metersPerNauticalMile is the definition of a nautical mile,
+// which is also a minute of latitude.
+const metersPerNauticalMile = 1852
+
+// OffsetPoint returns the point that is meters away from p in the direction
+// bearingDeg (degrees clockwise from north).
+// It uses the same flat-earth approximation as ProjectPosition, so it's only
+// accurate for short distances.
+// Within PoleMargin of a pole the longitude is left unchanged.
+func OffsetPoint(p Point, bearingDeg, meters float64) Point {
+	degrees := meters / (60 * metersPerNauticalMile)
+	bearing := bearingDeg * math.Pi / 180
+	lat := p.Lat + degrees*math.Cos(bearing)
+	long := p.Long
+	if !NearPole(p.Lat) {
+		long += degrees * math.Sin(bearing) / math.Cos(p.Lat*math.Pi/180)
+	}
+	return Point{Lat: math.Max(-90, math.Min(90, lat)), Long: normalizeLong(long)}
+}
+
+// PoleMargin is how many degrees from a pole a latitude is considered to be at it.
+// Going a few meters east or west there changes the longitude by more than 360°.
+const PoleMargin = 0.01 // about 1 km
+
+// NearPole returns true if the latitude is within PoleMargin of either pole.
+func NearPole(lat float64) bool {
+	return 90-math.Abs(lat) < PoleMargin
+}
+
 // MarshalJSON returns the GeoJSON representation of the coordinates.
 func (p Point) MarshalJSON() ([]byte, error) {
 	return json.Marshal([]float64{p.Long, p.Lat})
 }
 
+// FullPrecision can be passed to RoundTo and Point.Rounded to not round at all.
+const FullPrecision = -1
+
+// DefaultPrecision is the number of decimals coordinates are rounded to in
+// responses unless the client asks for something else.
+// 5 decimals is about one meter, which is as precise as AIS positions get.
+const DefaultPrecision = 5
+
+// RoundTo rounds f to the given number of decimals.
+// Negative decimals returns f unchanged.
+// Negative zero is normalized to zero so that JSON doesn't end up with "-0".
+func RoundTo(f float64, decimals int) float64 {
+	if decimals < 0 || math.IsNaN(f) || math.IsInf(f, 0) {
+		return f
+	}
+	scale := math.Pow(10, float64(decimals))
+	r := math.Round(f*scale) / scale
+	if r == 0 {
+		return 0 // also true for -0
+	}
+	return r
+}
+
+// Rounded returns a copy of the point with both coordinates rounded to decimals.
+// The point itself is not modified.
+func (p Point) Rounded(decimals int) Point {
+	return Point{Lat: RoundTo(p.Lat, decimals), Long: RoundTo(p.Long, decimals)}
+}
+
 // UnmarshalJSON unmarshals the JSON-data in b to a Point-object.
 func (p *Point) UnmarshalJSON(b []byte) error {
 	var s []float64
@@ -183,7 +293,11 @@ func (a *Rectangle) AreaDifference(b *Rectangle) float64 {
 // SplitViewRect maps any rectangular view of the earth to a set of
 // non-overlapping, valid rectangles.
 // More than one rectangle is needed if the view crosses the date line
-// or a pole. (the latter is'nt supported yet)
+// or a pole.
+// A view that extends past a pole continues down on the opposite side of
+// the earth, so the part beyond it becomes a rectangle 180° away at the
+// latitudes reflected around the pole. If the view is 180° or wider, the two
+// sides overlap, and all longitudes are visible closest to the pole.
 func SplitViewRect(minLat, minLong, maxLat, maxLong float64) []Rectangle {
 	// reject troublesome special values
 	for _, f := range [...]float64{minLat, minLong, maxLat, maxLong} {
@@ -191,23 +305,17 @@ func SplitViewRect(minLat, minLong, maxLat, maxLong float64) []Rectangle {
 			return nil
 		}
 	}
+	longSpan := 360.0
 	if maxLong-minLong >= 360.0 {
 		// all longtitudes
 		minLong = -180
 		maxLong = 180
 	} else {
-		// move
-		for minLong < -180.0 {
-			minLong += 360.0
-		}
-		for minLong > 180.0 {
-			minLong -= 360.0
-		}
-		for maxLong < -180.0 {
-			maxLong += 360.0
-		}
-		for maxLong > 180.0 {
-			maxLong -= 360.0
+		minLong = normalizeLong(minLong)
+		maxLong = normalizeLong(maxLong)
+		longSpan = maxLong - minLong
+		if longSpan < 0 {
+			longSpan += 360
 		}
 	}
 
@@ -219,25 +327,181 @@ func SplitViewRect(minLat, minLong, maxLat, maxLong float64) []Rectangle {
 		minLat = -90
 		maxLat = 90
 	}
+	if minLat >= -90.0 && maxLat <= 90.0 {
+		return splitLongitudes(minLat, minLong, maxLat, maxLong)
+	}
+
+	// The latitudes that are visible on the opposite side of the pole
+	reflectedMin, reflectedMax := -90.0, 90.0
+	if maxLat > 90.0 {
+		reflectedMin, maxLat = 180.0-maxLat, 90.0
+	} else {
+		reflectedMax, minLat = -180.0-minLat, -90.0
+	}
+	if longSpan >= 360.0 {
+		// the part beyond the pole only extends the view
+		return []Rectangle{{
+			min: Point{math.Min(minLat, reflectedMin), -180.0},
+			max: Point{math.Max(maxLat, reflectedMax), 180.0},
+		}}
+	}
+	oppositeMin, oppositeMax := normalizeLong(minLong+180.0), normalizeLong(maxLong+180.0)
+	var rects []Rectangle
+	if longSpan < 180.0 {
+		rects = append(splitLongitudes(minLat, minLong, maxLat, maxLong),
+			splitLongitudes(reflectedMin, oppositeMin, reflectedMax, oppositeMax)...)
+	} else {
+		// All longitudes are visible where the two sides overlap,
+		// and then one of them extends further from the pole.
+		capMin, capMax := math.Max(minLat, reflectedMin), math.Min(maxLat, reflectedMax)
+		rects = []Rectangle{{min: Point{capMin, -180.0}, max: Point{capMax, 180.0}}}
+		if minLat < capMin {
+			rects = append(rects, splitLongitudes(minLat, minLong, capMin, maxLong)...)
+		} else if reflectedMin < capMin {
+			rects = append(rects, splitLongitudes(reflectedMin, oppositeMin, capMin, oppositeMax)...)
+		} else if maxLat > capMax {
+			rects = append(rects, splitLongitudes(capMax, minLong, maxLat, maxLong)...)
+		} else if reflectedMax > capMax {
+			rects = append(rects, splitLongitudes(capMax, oppositeMin, reflectedMax, oppositeMax)...)
+		}
+	}
+	// west to east, like when crossing the date line
+	sort.Slice(rects, func(i, j int) bool {
+		if rects[i].min.Long != rects[j].min.Long {
+			return rects[i].min.Long < rects[j].min.Long
+		}
+		return rects[i].min.Lat < rects[j].min.Lat
+	})
+	return rects
+}
+
+// normalizeLong moves a longitude into [-180, 180].
+func normalizeLong(long float64) float64 {
+	if long < -180.0 || long > 180.0 {
+		long = math.Mod(long, 360.0) // keeps the sign, so ±180 stays
+		if long < -180.0 {
+			long += 360.0
+		} else if long > 180.0 {
+			long -= 360.0
+		}
+	}
+	return long
+}
 
-	if maxLong >= minLong && minLat >= -90.0 && maxLat <= 90.0 {
+// splitLongitudes returns one rectangle, or two if maxLong < minLong,
+// which means the rectangle crosses the date line.
+// The latitudes must be valid and the longitudes normalized.
+func splitLongitudes(minLat, minLong, maxLat, maxLong float64) []Rectangle {
+	if maxLong >= minLong {
 		// single
-		return []Rectangle{Rectangle{
+		return []Rectangle{{
 			min: Point{minLat, minLong},
 			max: Point{maxLat, maxLong},
 		}}
-	} else if maxLong < minLong && minLat >= -90.0 && maxLat <= 90.0 {
-		return []Rectangle{
-			Rectangle{min: Point{minLat, -180.0}, max: Point{maxLat, maxLong}}, // west
-			Rectangle{min: Point{minLat, minLong}, max: Point{maxLat, 180.0}},  // east
+	}
+	return []Rectangle{
+		{min: Point{minLat, -180.0}, max: Point{maxLat, maxLong}}, // west
+		{min: Point{minLat, minLong}, max: Point{maxLat, 180.0}},  // east
+	}
+}
+
+// parseBBoxValues parses a bounding box of the form "west,south,east,north",
+// which is the order used by GeoJSON and the bbox parameter of most APIs.
+// Only the syntax is checked; pass the values to SplitViewRect to validate them.
+func parseBBoxValues(s string) (minLat, minLong, maxLat, maxLong float64, err error) {
+	parts := strings.Split(strings.TrimSpace(s), ",")
+	if len(parts) != 4 {
+		return 0, 0, 0, 0, fmt.Errorf("bbox must be four numbers west,south,east,north, got %d", len(parts))
+	}
+	var values [4]float64
+	for i, part := range parts {
+		values[i], err = strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return 0, 0, 0, 0, fmt.Errorf("bbox has malformed number %q", part)
 		}
 	}
-	return nil // TODO mirroring around poles (not encountered from the web view)
-	// if math.Abs(maxLon-minLon) > 45.0 we must be careful to avoid overlapping
-	// if the date line is visible a horizontal split isn't enough, so drop that
-	// above/below the latitude closest to the pole all latitudes are visible,
-	// and then there is a smaller rectangle next to it with height equal to the
-	// reflected difference in latitude.
+	return values[1], values[0], values[3], values[2], nil
+}
+
+// bboxRectangle validates the values of a bounding box that must be a single
+// rectangle.
+func bboxRectangle(minLat, minLong, maxLat, maxLong float64) (Rectangle, error) {
+	if !LegalCoord(minLat, minLong) || !LegalCoord(maxLat, maxLong) {
+		return Rectangle{}, errors.New("bbox has coordinates outside -180,-90,180,90")
+	} else if minLat > maxLat {
+		return Rectangle{}, errors.New("bbox has south > north")
+	} else if minLong > maxLong {
+		return Rectangle{}, errors.New("bbox has west > east, use SplitViewRect for boxes that cross the antimeridian")
+	}
+	return Rectangle{min: Point{minLat, minLong}, max: Point{maxLat, maxLong}}, nil
+}
+
+// ParseBBox parses a bounding box of the form "west,south,east,north" into a
+// rectangle.
+// Unlike ParseViewRects it doesn't accept boxes that cross the antimeridian or
+// a pole, as they can't be a single rectangle.
+func ParseBBox(s string) (Rectangle, error) {
+	minLat, minLong, maxLat, maxLong, err := parseBBoxValues(s)
+	if err != nil {
+		return Rectangle{}, err
+	}
+	return bboxRectangle(minLat, minLong, maxLat, maxLong)
+}
+
+// String returns the rectangle in the form ParseBBox accepts.
+func (a Rectangle) String() string {
+	return fmt.Sprintf("%g,%g,%g,%g", a.min.Long, a.min.Lat, a.max.Long, a.max.Lat)
+}
+
+// MarshalJSON returns the rectangle as a GeoJSON bbox: [west, south, east, north].
+func (a Rectangle) MarshalJSON() ([]byte, error) {
+	return json.Marshal([4]float64{a.min.Long, a.min.Lat, a.max.Long, a.max.Lat})
+}
+
+// UnmarshalJSON parses a GeoJSON bbox: [west, south, east, north].
+// The same limitations as for ParseBBox apply.
+func (a *Rectangle) UnmarshalJSON(b []byte) error {
+	var values []float64
+	if err := json.Unmarshal(b, &values); err != nil {
+		return err
+	}
+	if len(values) != 4 {
+		return fmt.Errorf("bbox must be four numbers [west, south, east, north], got %d", len(values))
+	}
+	rect, err := bboxRectangle(values[1], values[0], values[3], values[2])
+	if err != nil {
+		return err
+	}
+	*a = rect
+	return nil
+}
+
+// ParseViewRects parses one or more bounding boxes and maps them to valid rectangles
+// with SplitViewRect.
+// Each string can contain multiple boxes separated by semicolons.
+// If any box is invalid, the error says which (counting from zero).
+// The returned rectangles might overlap.
+func ParseViewRects(bboxes []string) ([]Rectangle, error) {
+	rects := []Rectangle{}
+	index := 0
+	for _, param := range bboxes {
+		for _, bbox := range strings.Split(param, ";") {
+			minLat, minLong, maxLat, maxLong, err := parseBBoxValues(bbox)
+			if err != nil {
+				return nil, fmt.Errorf("Malformed coordinates in bbox %d", index)
+			}
+			split := SplitViewRect(minLat, minLong, maxLat, maxLong)
+			if split == nil {
+				return nil, fmt.Errorf("Invalid coordinates in bbox %d", index)
+			}
+			rects = append(rects, split...)
+			index++
+		}
+	}
+	if index == 0 {
+		return nil, errors.New("No bbox")
+	}
+	return rects, nil
 }
 
 /*
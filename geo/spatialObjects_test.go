@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"math"
 	"testing"
+	"time"
 )
 
 func TestDistanceTo(t *testing.T) {
@@ -28,6 +29,104 @@ func TestDistanceTo(t *testing.T) {
 	}
 }
 
+func TestHaversineDistanceTo(t *testing.T) {
+	cases := []struct {
+		name string
+		a, b Point
+		km   float64
+	}{
+		{"London - Paris", Point{51.5074, -0.1278}, Point{48.8566, 2.3522}, 343.5},
+		{"Oslo - Bergen", Point{59.9139, 10.7522}, Point{60.3913, 5.3221}, 305},
+		{"New York - Los Angeles", Point{40.7128, -74.0060}, Point{34.0522, -118.2437}, 3936},
+		{"Sydney - Auckland", Point{-33.8688, 151.2093}, Point{-36.8485, 174.7633}, 2156},
+		{"Tokyo - San Francisco", Point{35.6762, 139.6503}, Point{37.7749, -122.4194}, 8280},
+		{"across the antimeridian", Point{0, 179.5}, Point{0, -179.5}, 111.2},
+		{"pole to pole", Point{90, 0}, Point{-90, 0}, 20015},
+	}
+	for _, c := range cases {
+		for _, meters := range []float64{c.a.HaversineDistanceTo(c.b), c.b.HaversineDistanceTo(c.a)} {
+			if math.Abs(meters/1000-c.km) > c.km*0.005 {
+				t.Errorf("%s: expected %.1f km, got %.1f", c.name, c.km, meters/1000)
+			}
+		}
+	}
+	if d := (Point{59, 5}).HaversineDistanceTo(Point{59, 5}); d != 0 {
+		t.Errorf("Expected the distance to the same point to be zero, got %f", d)
+	}
+}
+
+func TestBearingTo(t *testing.T) {
+	cases := []struct {
+		a, b    Point
+		bearing float64
+	}{
+		{Point{0, 0}, Point{1, 0}, 0},
+		{Point{0, 0}, Point{0, 1}, 90},
+		{Point{0, 0}, Point{-1, 0}, 180},
+		{Point{0, 0}, Point{0, -1}, 270},
+		{Point{0, 179.5}, Point{0, -179.5}, 90},
+		{Point{0, -179.5}, Point{0, 179.5}, 270},
+		{Point{51.5074, -0.1278}, Point{48.8566, 2.3522}, 148.1},    // London - Paris
+		{Point{35.6762, 139.6503}, Point{37.7749, -122.4194}, 54.4}, // Tokyo - San Francisco
+	}
+	for _, c := range cases {
+		if bearing := c.a.BearingTo(c.b); math.Abs(bearing-c.bearing) > 0.1 {
+			t.Errorf("%v to %v: expected %.1f°, got %.1f°", c.a, c.b, c.bearing, bearing)
+		}
+	}
+}
+
+func TestProjectPosition(t *testing.T) {
+	cases := []struct {
+		p             Point
+		course, speed float64
+		dt            time.Duration
+		expected      Point
+	}{
+		{Point{0, 0}, 0, 60, time.Hour, Point{1, 0}},
+		{Point{0, 0}, 45, 60, time.Hour, Point{math.Sqrt2 / 2, math.Sqrt2 / 2}},
+		{Point{10, 5}, 180, 0, time.Hour, Point{10, 5}},
+		{Point{60, 5}, 90, 12, 30 * time.Minute, Point{60, 5.2}},            // 6 nm is 0.2° at 60°N
+		{Point{60, 179.9}, 90, 12, 30 * time.Minute, Point{60, -179.9}},     // across the antimeridian eastwards
+		{Point{0, -179.95}, 270, 6, time.Hour, Point{0, 179.95}},            // and westwards
+		{Point{-60, -179.95}, 225, 6, time.Hour, Point{-60.0707, 179.9086}}, // 0.0707° south and 0.1414° west
+		{Point{89.9, 0}, 0, 60, time.Hour, Point{90, 0}},
+		{Point{90, 10}, 90, 12, time.Hour, Point{90, 10}},        // east or west is meaningless at the poles
+		{Point{-90, 10}, 45, 12, time.Hour, Point{-89.8586, 10}}, // but north isn't
+	}
+	for _, c := range cases {
+		p := ProjectPosition(c.p, c.course, c.speed, c.dt)
+		if math.Abs(p.Lat-c.expected.Lat) > 1e-4 || math.Abs(p.Long-c.expected.Long) > 1e-4 {
+			t.Errorf("%v with course %.0f° and %.0f knots for %s: expected %v, got %v",
+				c.p, c.course, c.speed, c.dt, c.expected, p)
+		}
+	}
+}
+
+func TestOffsetPoint(t *testing.T) {
+	p := OffsetPoint(Point{60, 5}, 90, 1000)
+	if d := (Point{60, 5}).HaversineDistanceTo(p); math.Abs(d-1000) > 1 || math.Abs(p.Lat-60) > 1e-4 || p.Long <= 5 {
+		t.Errorf("Expected a point 1000 m east, got %v %.1f m away", p, d)
+	}
+	if p := OffsetPoint(Point{0, 180}, 45, 100); p.Long > -179.99 || p.Lat <= 0 {
+		t.Errorf("Expected the longitude to be normalized, got %v", p)
+	}
+	for _, lat := range []float64{90, -90, 89.995} {
+		if p := OffsetPoint(Point{lat, 5}, 90, 100); p.Lat != lat || p.Long != 5 {
+			t.Errorf("Expected the point at latitude %f to not move east, got %v", lat, p)
+		}
+	}
+	// just outside PoleMargin a ship's length is still a large but valid change of longitude
+	if p := OffsetPoint(Point{90 - 2*PoleMargin, 5}, 90, 500); p.Long <= 5 || p.Long > 180 {
+		t.Errorf("Expected the point to move east by less than 180°, got %v", p)
+	}
+	for long, expected := range map[float64]float64{180: 180, -180: -180, 540: 180, -190: 170, 3610: 10} {
+		if normalized := normalizeLong(long); math.Abs(normalized-expected) > 1e-9 {
+			t.Errorf("Expected %g to be normalized to %g, got %g", long, expected, normalized)
+		}
+	}
+}
+
 func TestMarshalJSON(t *testing.T) {
 	cases := []struct {
 		p        Point
@@ -72,6 +171,42 @@ func TestUnmarshalJSON(t *testing.T) {
 	}
 }
 
+func TestRoundTo(t *testing.T) {
+	cases := []struct {
+		f        float64
+		decimals int
+		expected string // compare the JSON to catch "-0"
+	}{
+		{5.453866666666, 5, `5.45387`},
+		{-170.809010123, 5, `-170.80901`},
+		{-0.000001, 5, `0`},
+		{math.Copysign(0, -1), 5, `0`},
+		{-0.000006, 5, `-0.00001`},
+		{59.047083333, 0, `59`},
+		{59.047083333, FullPrecision, `59.047083333`},
+	}
+	for _, c := range cases {
+		j, _ := json.Marshal(RoundTo(c.f, c.decimals))
+		if string(j) != c.expected {
+			t.Errorf("RoundTo(%v, %d): expected %s got %s", c.f, c.decimals, c.expected, string(j))
+		}
+	}
+	if !math.IsNaN(RoundTo(math.NaN(), 2)) {
+		t.Error("RoundTo(NaN) is not NaN")
+	}
+}
+
+func TestRounded(t *testing.T) {
+	p := Point{Lat: -59.0470833333, Long: -0.0000001}
+	j, _ := json.Marshal(p.Rounded(5))
+	if string(j) != `[0,-59.04708]` {
+		t.Errorf("expected [0,-59.04708] got %s", string(j))
+	}
+	if p.Lat != -59.0470833333 || p.Long != -0.0000001 {
+		t.Errorf("Rounded() modified the original: %v", p)
+	}
+}
+
 func TestLegalCoords(t *testing.T) {
 	cases := []struct {
 		lat, long float64
@@ -305,7 +440,24 @@ var splitViewRectTests = []struct {
 	{r(0, 110, 0, 180), []Rectangle{r(0, 110, 0, 180)}},
 	{r(0, 110, 0, 181), []Rectangle{r(0, -180, 0, -179), r(0, 110, 0, 180)}},
 	{r(0, 110, 0, 10), []Rectangle{r(0, -180, 0, 10), r(0, 110, 0, 180)}},
-	{r(85, 10, 95, 20), nil}, // TODO: {r(85, 10, 95, 20), []Rectangle{r(85, -170, 90, -160), r(85, 10, 90, 20)}},
+	{r(85, 10, 95, 20), []Rectangle{r(85, -170, 90, -160), r(85, 10, 90, 20)}},
+	{r(88, 10, 95, 20), []Rectangle{r(85, -170, 90, -160), r(88, 10, 90, 20)}},
+	{r(-95, 10, -85, 20), []Rectangle{r(-90, -170, -85, -160), r(-90, 10, -85, 20)}},
+	{r(-100, -20, -70, 0), []Rectangle{r(-90, -20, -70, 0), r(-90, 160, -80, 180)}},
+	// the pole and the date line
+	{r(80, 170, 95, -170), []Rectangle{r(80, -180, 90, -170), r(85, -10, 90, 10), r(80, 170, 90, 180)}},
+	{r(80, -10, 95, 10), []Rectangle{r(85, -180, 90, -170), r(80, -10, 90, 10), r(85, 170, 90, 180)}},
+	// 180° or wider: all longitudes closest to the pole
+	{r(60, -100, 100, 100), []Rectangle{r(80, -180, 90, 180), r(60, -100, 80, 100)}},
+	{r(85, -100, 110, 100), []Rectangle{r(70, -180, 85, -80), r(85, -180, 90, 180), r(70, 80, 85, 180)}},
+	{r(-100, 0, -60, 200), []Rectangle{r(-90, -180, -80, 180), r(-80, -180, -60, -160), r(-80, 0, -60, 180)}},
+	{r(80, -180, 100, 180), []Rectangle{r(80, -180, 90, 180)}},
+	{r(-95, 0, 95, 10), []Rectangle{r(-90, 0, 90, 10)}},
+	{r(91, 0, 95, 10), nil},
+	{r(-95, 0, -91, 10), nil},
+	{r(85, math.NaN(), 95, 20), nil},
+	{r(85, 10, math.Inf(1), 20), nil},
+	{r(math.Inf(-1), 10, -85, 20), nil},
 	{r(1, 0, -1, 0), nil},
 }
 
@@ -349,3 +501,91 @@ func TestSplitViewRect(t *testing.T) {
 		test(r(0, 0, 0, bad), nil)
 	}
 }
+
+func TestParseViewRects(t *testing.T) {
+	cases := []struct {
+		bboxes []string
+		want   []Rectangle
+		err    string
+	}{
+		{[]string{"0,0,1,1"}, []Rectangle{r(0, 0, 1, 1)}, ""},
+		{[]string{"5.5,58.9,5.9,59.1"}, []Rectangle{r(58.9, 5.5, 59.1, 5.9)}, ""},
+		{[]string{"0,0,1,1", "2,2,3,3"}, []Rectangle{r(0, 0, 1, 1), r(2, 2, 3, 3)}, ""},
+		{[]string{"0,0,1,1;2,2,3,3"}, []Rectangle{r(0, 0, 1, 1), r(2, 2, 3, 3)}, ""},
+		{[]string{"170,0,190,1", "0,0,1,1"}, []Rectangle{r(0, -180, 1, -170), r(0, 170, 1, 180), r(0, 0, 1, 1)}, ""},
+		{[]string{"10,85,20,95"}, []Rectangle{r(85, -170, 90, -160), r(85, 10, 90, 20)}, ""},
+		{[]string{"0,0,1,1;2,2,3", "4,4,5,5"}, nil, "Malformed coordinates in bbox 1"},
+		{[]string{"0,0,1,1", "4,4,5,5", "0,1,0,-1"}, nil, "Invalid coordinates in bbox 2"},
+		{[]string{"0,0,1,1trailing"}, nil, "Malformed coordinates in bbox 0"},
+		{[]string{}, nil, "No bbox"},
+	}
+	for _, c := range cases {
+		got, err := ParseViewRects(c.bboxes)
+		if c.err != "" {
+			if err == nil || err.Error() != c.err {
+				t.Errorf("%v: expected error %q, got %v", c.bboxes, c.err, err)
+			}
+		} else if err != nil {
+			t.Errorf("%v: unexpected error %s", c.bboxes, err.Error())
+		} else if fmt.Sprint(got) != fmt.Sprint(c.want) {
+			t.Errorf("%v: expected %v got %v", c.bboxes, c.want, got)
+		}
+	}
+}
+
+func TestParseBBox(t *testing.T) {
+	got, err := ParseBBox(" 5.5, 58.9,5.9,59.1")
+	if err != nil || got != r(58.9, 5.5, 59.1, 5.9) {
+		t.Errorf("Expected %v, got %v %v", r(58.9, 5.5, 59.1, 5.9), got, err)
+	}
+	if s := got.String(); s != "5.5,58.9,5.9,59.1" {
+		t.Errorf("Expected String() to be in bbox order, got %s", s)
+	}
+	if again, err := ParseBBox(got.String()); err != nil || again != got {
+		t.Errorf("Expected String() to round-trip, got %v %v", again, err)
+	}
+	cases := []struct {
+		bbox string
+		err  string
+	}{
+		{"0,0,1,1trailing", `bbox has malformed number "1trailing"`},
+		{"0,0,1", "bbox must be four numbers west,south,east,north, got 3"},
+		{"0,0,1,1,", "bbox must be four numbers west,south,east,north, got 5"},
+		{"0,1,1,0", "bbox has south > north"},
+		{"0,0,1,91", "bbox has coordinates outside -180,-90,180,90"},
+		{"0,0,NaN,1", "bbox has coordinates outside -180,-90,180,90"},
+		{"170,0,-170,1", "bbox has west > east, use SplitViewRect for boxes that cross the antimeridian"},
+	}
+	for _, c := range cases {
+		if _, err := ParseBBox(c.bbox); err == nil || err.Error() != c.err {
+			t.Errorf("%s: expected error %q, got %v", c.bbox, c.err, err)
+		}
+	}
+}
+
+func TestRectangleJSON(t *testing.T) {
+	encoded, err := json.Marshal(struct {
+		BBox Rectangle `json:"bbox"`
+	}{r(59, 5, 60, 6.25)})
+	if err != nil || string(encoded) != `{"bbox":[5,59,6.25,60]}` {
+		t.Errorf("Expected a GeoJSON bbox, got %s %v", encoded, err)
+	}
+	var decoded struct {
+		BBox Rectangle `json:"bbox"`
+	}
+	if err := json.Unmarshal(encoded, &decoded); err != nil || decoded.BBox != r(59, 5, 60, 6.25) {
+		t.Errorf("Expected the rectangle to round-trip, got %v %v", decoded.BBox, err)
+	}
+	for bbox, expected := range map[string]string{
+		`[5,59,6]`:        "bbox must be four numbers [west, south, east, north], got 3",
+		`[5,60,6,59]`:     "bbox has south > north",
+		`[5,59,6,60.5e9]`: "bbox has coordinates outside -180,-90,180,90",
+		`[170,0,-170,1]`:  "bbox has west > east, use SplitViewRect for boxes that cross the antimeridian",
+		`{"west":5}`:      "", // any error from encoding/json
+	} {
+		var rect Rectangle
+		if err := json.Unmarshal([]byte(bbox), &rect); err == nil || (expected != "" && err.Error() != expected) {
+			t.Errorf("%s: expected error %q, got %v", bbox, expected, err)
+		}
+	}
+}
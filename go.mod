@@ -5,5 +5,4 @@ go 1.17
 require (
 	github.com/andmarios/aislib v0.0.0-20190131232958-3a9a58899c39
 	github.com/cenkalti/backoff v2.2.1+incompatible
-	github.com/tormol/AIS v0.0.0-20181230234101-81f005650a97
 )
@@ -0,0 +1,130 @@
+package logger
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// maxLimitedKeys bounds the memory used for rate limiting.
+// The least recently used key is forgotten when there are more.
+const maxLimitedKeys = 1000
+
+// rateLimit is the state of one key
+type rateLimit struct {
+	key        string
+	next       time.Time // when the next message is allowed
+	suppressed int
+}
+
+// groups related fields in Logger
+type rateLimits struct {
+	lock sync.Mutex
+	keys map[string]*list.Element // values are *rateLimit
+	lru  list.List                // most recently used first
+}
+
+// allow checks whether a message with the key can be written now, and if it
+// can, returns how many messages were suppressed since the last one.
+func (rl *rateLimits) allow(key string, per time.Duration, now time.Time) (suppressed int, allowed bool) {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	if rl.keys == nil {
+		rl.keys = make(map[string]*list.Element)
+	}
+	e, ok := rl.keys[key]
+	if !ok {
+		if rl.lru.Len() >= maxLimitedKeys {
+			oldest := rl.lru.Back()
+			rl.lru.Remove(oldest)
+			delete(rl.keys, oldest.Value.(*rateLimit).key)
+		}
+		rl.keys[key] = rl.lru.PushFront(&rateLimit{key: key, next: now.Add(per)})
+		return 0, true
+	}
+	rl.lru.MoveToFront(e)
+	r := e.Value.(*rateLimit)
+	if now.Before(r.next) {
+		r.suppressed++
+		return 0, false
+	}
+	suppressed = r.suppressed
+	r.suppressed = 0
+	r.next = now.Add(per)
+	return suppressed, true
+}
+
+// Limited writes at most one message per interval for a key,
+// for messages that can be repeated very often, such as about bad input.
+// The first message after some were suppressed says how many.
+// Messages that are below the threshold doesn't count.
+type Limited struct {
+	logger *Logger
+	key    string
+	per    time.Duration
+}
+
+// Limited returns a rate-limited logger for messages with the key.
+// It's cheap, so there's no need to store the returned value.
+func (l *Logger) Limited(key string, per time.Duration) Limited {
+	return Limited{l, key, per}
+}
+
+// Log writes the message if the key hasn't been used the last interval.
+func (ll Limited) Log(level Level, format string, args ...interface{}) {
+	if level > ll.logger.Treshold {
+		return
+	}
+	suppressed, allowed := ll.logger.limits.allow(ll.key, ll.per, time.Now())
+	if !allowed {
+		return
+	}
+	if len(args) != 0 {
+		format = fmt.Sprintf(format, args...)
+	}
+	if suppressed != 0 {
+		ll.logger.Log(level, "%s\n(suppressed %d similar messages)", format, suppressed)
+	} else {
+		ll.logger.Log(level, "%s", format)
+	}
+}
+
+// Compose returns a Composer that does nothing if the message is suppressed.
+// If messages were suppressed the first line says how many.
+func (ll Limited) Compose(level Level) Composer {
+	if level > ll.logger.Treshold {
+		return Composer{}
+	}
+	suppressed, allowed := ll.logger.limits.allow(ll.key, ll.per, time.Now())
+	if !allowed {
+		return Composer{}
+	}
+	c := ll.logger.Compose(level)
+	if suppressed != 0 {
+		c.Writeln("(suppressed %d similar messages)", suppressed)
+	}
+	return c
+}
+
+// Wrappers around Log()
+
+// Debug prints possibly interesting information
+func (ll Limited) Debug(format string, args ...interface{}) {
+	ll.Log(Debug, format, args...)
+}
+
+// Info prints unimportant but noteworthy events or information
+func (ll Limited) Info(format string, args ...interface{}) {
+	ll.Log(Info, format, args...)
+}
+
+// Warning prints an error that might be recovered from
+func (ll Limited) Warning(format string, args ...interface{}) {
+	ll.Log(Warning, format, args...)
+}
+
+// Error prints a non-fatal but permanent error
+func (ll Limited) Error(format string, args ...interface{}) {
+	ll.Log(Error, format, args...)
+}
@@ -1,9 +1,13 @@
 package logger
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 )
@@ -21,6 +25,34 @@ const (
 	Ignore               // don't print
 )
 
+// String returns the lowercase name of the level, as used in JSON records.
+func (level Level) String() string {
+	switch level {
+	case Debug:
+		return "debug"
+	case Fatal:
+		return "fatal"
+	case Error:
+		return "error"
+	case Warning:
+		return "warning"
+	case Info:
+		return "info"
+	default:
+		return "ignore"
+	}
+}
+
+// ParseLevel is the inverse of Level.String(), for command line flags.
+func ParseLevel(name string) (Level, error) {
+	for level := Debug; level <= Ignore; level++ {
+		if strings.EqualFold(name, level.String()) {
+			return level, nil
+		}
+	}
+	return Ignore, fmt.Errorf("Unknown log level %q", name)
+}
+
 // fatalExitCode is the code Logger will abort the process with if a fatal-level message is printed
 const fatalExitCode int = 3
 
@@ -34,6 +66,8 @@ type Logger struct {
 	writeLock sync.Mutex
 	Treshold  Level
 	p         periodic
+	json      bool // write one JSON object per message instead of text
+	limits    rateLimits
 }
 
 // NewLogger creates a new logger with a minimum importance level and the interval to check the periodic loggers
@@ -49,6 +83,16 @@ func NewLogger(writeTo io.WriteCloser, treshold Level) *Logger {
 	return l
 }
 
+// NewJSONLogger creates a logger which writes each message as a JSON object
+// on one line, with the fields ts, level and msg.
+// Messages from a Composer become one object, and fields passed to LogFields()
+// are added to the object.
+func NewJSONLogger(writeTo io.WriteCloser, treshold Level) *Logger {
+	l := NewLogger(writeTo, treshold)
+	l.json = true
+	return l
+}
+
 // Close the underlying Writer
 func (l *Logger) Close() {
 	l.writeLock.Lock()
@@ -60,34 +104,72 @@ func (l *Logger) Close() {
 	l.writeLock.Unlock()
 }
 
-func (l *Logger) prefixMessage(level Level) {
+// SetOutput replaces the writer and closes the previous one,
+// for example to reopen a log file after it has been rotated.
+// Messages are never split between the two writers,
+// because Composers hold the lock until they're finished.
+func (l *Logger) SetOutput(writeTo io.WriteCloser) error {
+	l.writeLock.Lock()
+	defer l.writeLock.Unlock()
+	old := l.writeTo
+	l.writeTo = writeTo
+	return old.Close()
+}
+
+// prefixMessage writes the level to the text output (which is the buffer of
+// a Composer in JSON mode).
+func (l *Logger) prefixMessage(w io.Writer, level Level) {
 	if l.Treshold < Debug {
-		fmt.Fprint(l.writeTo, time.Now().Format("2006-01-02 15:04:05: "))
+		fmt.Fprint(w, time.Now().Format("2006-01-02 15:04:05: "))
 	}
 	if level == Warning {
-		fmt.Fprint(l.writeTo, "WARNING: ")
+		fmt.Fprint(w, "WARNING: ")
 	} else if level == Error {
-		fmt.Fprint(l.writeTo, "ERROR: ")
+		fmt.Fprint(w, "ERROR: ")
 	} else if level == Fatal && l.Treshold != Debug {
-		fmt.Fprint(l.writeTo, "FATAL: ")
+		fmt.Fprint(w, "FATAL: ")
 	}
 }
 
-// Compose allows holding the lock between multiple print
-func (l *Logger) Compose(level Level) Composer {
-	if level > l.Treshold {
-		return Composer{
-			writeTo:  nil,
-			heldLock: nil,
-			fatal:    false,
-		}
+// writeRecord writes a JSON object. The lock must be held.
+// Fields are sorted by key, and values that cannot be encoded are written as strings.
+func (l *Logger) writeRecord(level Level, msg string, fields map[string]interface{}) {
+	buf := bytes.Buffer{}
+	buf.WriteString(`{"ts":"` + time.Now().UTC().Format(time.RFC3339Nano) + `","level":"` + level.String() + `","msg":`)
+	appendJSON(&buf, msg)
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
 	}
-	l.writeLock.Lock()
-	l.prefixMessage(level)
+	sort.Strings(keys)
+	for _, key := range keys {
+		buf.WriteByte(',')
+		appendJSON(&buf, key)
+		buf.WriteByte(':')
+		appendJSON(&buf, fields[key])
+	}
+	buf.WriteString("}\n")
+	l.writeTo.Write(buf.Bytes())
+}
+
+// appendJSON encodes v without escaping HTML characters.
+func appendJSON(buf *bytes.Buffer, v interface{}) {
+	e := json.NewEncoder(buf)
+	e.SetEscapeHTML(false)
+	if e.Encode(v) != nil { // nothing is written on errors
+		e.Encode(fmt.Sprint(v))
+	}
+	buf.Truncate(buf.Len() - 1) // Encode() adds a newline
+}
+
+// Compose returns a Composer for writing a message with multiple statements.
+// The message is assembled in memory and written when the Composer is closed,
+// so composing a message doesn't hold up other messages.
+func (l *Logger) Compose(level Level) Composer {
 	return Composer{
-		writeTo:  l.writeTo,
-		heldLock: &l.writeLock,
-		fatal:    level == Fatal,
+		logger: l,
+		level:  level,
+		fatal:  level == Fatal && level <= l.Treshold,
 	}
 }
 
@@ -96,12 +178,19 @@ func (l *Logger) Log(level Level, format string, args ...interface{}) {
 	if level <= l.Treshold {
 		l.writeLock.Lock()
 		defer l.writeLock.Unlock()
-		l.prefixMessage(level)
-		if len(args) == 0 {
-			fmt.Fprintln(l.writeTo, format)
+		if l.json {
+			if len(args) != 0 {
+				format = fmt.Sprintf(format, args...)
+			}
+			l.writeRecord(level, format, nil)
 		} else {
-			fmt.Fprintf(l.writeTo, format, args...)
-			fmt.Fprintln(l.writeTo)
+			l.prefixMessage(l.writeTo, level)
+			if len(args) == 0 {
+				fmt.Fprintln(l.writeTo, format)
+			} else {
+				fmt.Fprintf(l.writeTo, format, args...)
+				fmt.Fprintln(l.writeTo)
+			}
 		}
 		if level == Fatal {
 			os.Exit(fatalExitCode)
@@ -109,6 +198,32 @@ func (l *Logger) Log(level Level, format string, args ...interface{}) {
 	}
 }
 
+// LogFields writes a message with key/value pairs.
+// In JSON mode the fields are added to the object (and should not be named
+// ts, level or msg), otherwise they are appended as key=value, sorted by key.
+func (l *Logger) LogFields(level Level, msg string, fields map[string]interface{}) {
+	if level > l.Treshold {
+		return
+	} else if !l.json {
+		keys := make([]string, 0, len(fields))
+		for key := range fields {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			msg += fmt.Sprintf(" %s=%v", key, fields[key])
+		}
+		l.Log(level, "%s", msg)
+		return
+	}
+	l.writeLock.Lock()
+	defer l.writeLock.Unlock()
+	l.writeRecord(level, msg, fields)
+	if level == Fatal {
+		os.Exit(fatalExitCode)
+	}
+}
+
 // WriteAdapter returns a Writer that writes through this logger with the given level.
 // Writes that don't end in a newline are buffered to not split messages, but
 // Composer-written messages might get split.
@@ -169,19 +284,67 @@ func (l *Logger) FatalIfErr(err error, format string, args ...interface{}) {
 
 // Composer lets you split a long message into multiple write statements
 // End the message by calling Finish() or Close()
+// The message is buffered, and the logger is only locked while Close() writes
+// it, so other messages are never written in the middle of it, but they can
+// be written before it even if they were logged after it was started.
+// A Composer should not be used by multiple goroutines.
 type Composer struct {
-	fatal    bool
-	writeTo  io.Writer // nil if level is ignored
-	heldLock *sync.Mutex
+	logger *Logger // nil if rate limited or closed
+	buf    *bytes.Buffer
+	level  Level          // of the lines being written
+	parts  []composedPart // lines before the last SetLevel()
+	fatal  bool           // exit after writing
+}
+
+// composedPart is lines of a Composer that have a different level than the
+// lines after them.
+type composedPart struct {
+	level Level
+	end   int // in Composer.buf
+}
+
+// Enabled returns false if the composer will not write anything,
+// either because of its current level or because it was rate limited.
+func (c *Composer) Enabled() bool {
+	return c.logger != nil && c.level <= c.logger.Treshold
+}
+
+// SetLevel changes the level of the lines written after it, such as to make
+// some lines of periodic statistics warnings. They are filtered and prefixed
+// as if logged on their own, but are still written together with the rest of
+// the message. (In JSON mode each level becomes a separate object.)
+// It should be called at the start of a line.
+func (c *Composer) SetLevel(level Level) {
+	if c.logger == nil || level == c.level {
+		return
+	}
+	if c.buf != nil && c.buf.Len() > c.partStart() {
+		c.parts = append(c.parts, composedPart{c.level, c.buf.Len()})
+	}
+	c.level = level
+	if level == Fatal && level <= c.logger.Treshold {
+		c.fatal = true
+	}
+}
+
+// partStart returns where in buf the lines with the current level start.
+func (c *Composer) partStart() int {
+	if len(c.parts) == 0 {
+		return 0
+	}
+	return c.parts[len(c.parts)-1].end
 }
 
 // Write writes formatted text without a newline
 func (c *Composer) Write(format string, args ...interface{}) {
-	if c.writeTo != nil {
+	if c.Enabled() {
+		if c.buf == nil {
+			c.buf = &bytes.Buffer{}
+		}
 		if len(args) == 0 {
-			fmt.Fprint(c.writeTo, format)
+			c.buf.WriteString(format)
 		} else {
-			fmt.Fprintf(c.writeTo, format, args...)
+			fmt.Fprintf(c.buf, format, args...)
 		}
 	}
 }
@@ -189,13 +352,9 @@ func (c *Composer) Write(format string, args ...interface{}) {
 // Writeln writes a formatted string plus a newline.
 // This is identical to what Logger.Log() does.
 func (c *Composer) Writeln(format string, args ...interface{}) {
-	if c.writeTo != nil {
-		if len(args) == 0 {
-			fmt.Fprintln(c.writeTo, format)
-		} else {
-			fmt.Fprintf(c.writeTo, format, args...)
-			fmt.Fprintln(c.writeTo)
-		}
+	if c.Enabled() {
+		c.Write(format, args...)
+		c.buf.WriteByte('\n')
 	}
 }
 
@@ -205,14 +364,39 @@ func (c *Composer) Finish(format string, args ...interface{}) {
 	c.Close()
 }
 
-// Close releases the mutex on the logger and exits the process for `Fatal` errors.
+// Close writes the message and exits the process for `Fatal` errors.
+// Nothing is written after the first call.
 func (c *Composer) Close() {
-	if c.writeTo != nil {
-		c.heldLock.Unlock()
-		c.writeTo = nil
-		if c.fatal {
-			os.Exit(fatalExitCode)
+	l := c.logger
+	if l == nil {
+		return
+	}
+	c.logger = nil
+	if c.buf != nil {
+		parts := append(c.parts, composedPart{c.level, c.buf.Len()})
+		l.writeLock.Lock()
+		start := 0
+		for _, part := range parts {
+			if text := c.buf.Bytes()[start:part.end]; len(text) != 0 {
+				l.writeComposed(part.level, text)
+			}
+			start = part.end
 		}
+		l.writeLock.Unlock()
+	}
+	if c.fatal {
+		os.Exit(fatalExitCode)
+	}
+}
+
+// writeComposed writes the lines of a Composer that have the same level.
+// The lock must be held.
+func (l *Logger) writeComposed(level Level, text []byte) {
+	if l.json {
+		l.writeRecord(level, strings.TrimSuffix(string(text), "\n"), nil)
+	} else {
+		l.prefixMessage(l.writeTo, level)
+		l.writeTo.Write(text)
 	}
 }
 
@@ -0,0 +1,414 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// bufferCloser is a bytes.Buffer that can be passed to NewLogger()
+type bufferCloser struct {
+	bytes.Buffer
+}
+
+func (bc *bufferCloser) Close() error {
+	return nil
+}
+
+// records parses the output of a JSON logger
+func records(t *testing.T, output string) []map[string]interface{} {
+	records := []map[string]interface{}{}
+	for _, line := range strings.SplitAfter(output, "\n") {
+		if line == "" {
+			continue
+		}
+		record := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("%q is not JSON: %s", line, err.Error())
+		}
+		for _, field := range []string{"ts", "level", "msg"} {
+			if _, ok := record[field]; !ok {
+				t.Errorf("%q has no %s", line, field)
+			}
+		}
+		if _, err := time.Parse(time.RFC3339Nano, record["ts"].(string)); err != nil {
+			t.Errorf("%q has an invalid timestamp: %s", line, err.Error())
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestJSONLogger(t *testing.T) {
+	out := &bufferCloser{}
+	l := NewJSONLogger(out, Info)
+	defer l.Close()
+	l.Warning("two\nlines with <%s>", "html")
+	l.Log(Ignore, "not written")
+	l.LogFields(Error, "with fields", map[string]interface{}{
+		"source": "Kystverket", "count": 3, "bad": func() {},
+	})
+	c := l.Compose(Info)
+	c.Writeln("first")
+	c.Finish("second %d", 2)
+	l.WriteAdapter(Warning).Write([]byte("adapted\n"))
+
+	if strings.Count(out.String(), "\n") != 4 {
+		t.Fatalf("Expected one line per message, got %q", out.String())
+	}
+	r := records(t, out.String())
+	expected := []struct{ level, msg string }{
+		{"warning", "two\nlines with <html>"},
+		{"error", "with fields"},
+		{"info", "first\nsecond 2"},
+		{"warning", "adapted"},
+	}
+	for i, e := range expected {
+		if r[i]["level"] != e.level || r[i]["msg"] != e.msg {
+			t.Errorf("Expected %s %q, got %v", e.level, e.msg, r[i])
+		}
+	}
+	if r[1]["source"] != "Kystverket" || r[1]["count"] != 3.0 {
+		t.Errorf("Expected the fields to be added, got %v", r[1])
+	}
+	if _, ok := r[1]["bad"].(string); !ok {
+		t.Errorf("Expected values that cannot be encoded to be strings, got %v", r[1])
+	}
+}
+
+func TestTextLoggerUnchanged(t *testing.T) {
+	out := &bufferCloser{}
+	l := NewLogger(out, Info)
+	defer l.Close()
+	l.Warning("warning %d", 1)
+	l.Info("info")
+	l.LogFields(Error, "with fields", map[string]interface{}{"b": 2, "a": "1"})
+	c := l.Compose(Info)
+	c.Write("com")
+	c.Finish("posed")
+	expected := "WARNING: warning 1\ninfo\nERROR: with fields a=1 b=2\ncomposed\n"
+	if out.String() != expected {
+		t.Errorf("Expected %q, got %q", expected, out.String())
+	}
+}
+
+// closeCounter is a synchronized bufferCloser that counts how many times it's closed
+type closeCounter struct {
+	lock   sync.Mutex
+	buf    bytes.Buffer
+	closed int
+}
+
+func (cc *closeCounter) Write(b []byte) (int, error) {
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+	if cc.closed != 0 {
+		return 0, errors.New("write after close")
+	}
+	return cc.buf.Write(b)
+}
+
+func (cc *closeCounter) Close() error {
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+	cc.closed++
+	return nil
+}
+
+func TestSetOutput(t *testing.T) {
+	const goroutines, messages, swaps = 4, 500, 20
+	outputs := []*closeCounter{{}}
+	l := NewLogger(outputs[0], Info)
+	wg := sync.WaitGroup{}
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			wa := l.WriteAdapter(Info)
+			for i := 0; i < messages; i++ {
+				switch i % 3 {
+				case 0:
+					l.Info("%d %d", g, i)
+				case 1:
+					c := l.Compose(Info)
+					c.Write("%d ", g)
+					c.Finish("%d", i)
+				case 2:
+					wa.Write([]byte(strconv.Itoa(g) + " "))
+					wa.Write([]byte(strconv.Itoa(i) + "\n"))
+				}
+			}
+		}(g)
+	}
+	for i := 0; i < swaps; i++ {
+		outputs = append(outputs, &closeCounter{})
+		if err := l.SetOutput(outputs[i+1]); err != nil {
+			t.Error(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	wg.Wait()
+	l.Close()
+
+	lines := 0
+	for i, o := range outputs {
+		if o.closed != 1 {
+			t.Errorf("Expected output %d to be closed once, was closed %d times", i, o.closed)
+		}
+		for _, line := range strings.Split(strings.TrimSuffix(o.buf.String(), "\n"), "\n") {
+			if line == "" {
+				continue
+			}
+			if len(strings.Fields(line)) != 2 {
+				t.Errorf("Expected messages to not be split, got %q in output %d", line, i)
+			}
+			lines++
+		}
+	}
+	if lines != goroutines*messages {
+		t.Errorf("Expected %d lines, got %d", goroutines*messages, lines)
+	}
+}
+
+func TestLimited(t *testing.T) {
+	out := &bufferCloser{}
+	l := NewLogger(out, Info)
+	defer l.Close()
+	const per = 20 * time.Millisecond
+	const goroutines, duration = 4, 100 * time.Millisecond
+	wg := sync.WaitGroup{}
+	started := time.Now()
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for time.Since(started) < duration {
+				l.Limited("bad", per).Warning("bad sentence")
+				c := l.Limited("composed", per).Compose(Info)
+				c.Finish("bad packet")
+			}
+		}()
+	}
+	wg.Wait()
+	// the last message from the goroutines might have been allowed
+	l.Limited("bad", per).Warning("bad sentence")
+	l.Limited("bad", per).Warning("bad sentence")
+	elapsed := time.Since(started)
+	time.Sleep(per)
+	l.Limited("bad", per).Warning("last")
+
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	counts := map[string]int{}
+	for _, line := range lines {
+		counts[line]++
+	}
+	if max := int(elapsed/per) + 1; counts["WARNING: bad sentence"] > max || counts["bad packet"] > max {
+		t.Errorf("Expected at most %d of each message, got %v", max, counts)
+	}
+	if !strings.HasPrefix(lines[len(lines)-1], "(suppressed ") ||
+		lines[len(lines)-2] != "WARNING: last" {
+		t.Errorf("Expected the last message to say how many were suppressed, got %q", lines[len(lines)-2:])
+	}
+}
+
+func TestLimitedKeysAreBounded(t *testing.T) {
+	l := NewLogger(&bufferCloser{}, Ignore)
+	defer l.Close()
+	for i := 0; i < 2*maxLimitedKeys; i++ {
+		l.Limited(strconv.Itoa(i), time.Hour).Warning("message %d", i)
+	}
+	if len(l.limits.keys) != maxLimitedKeys || l.limits.lru.Len() != maxLimitedKeys {
+		t.Errorf("Expected %d keys, got %d", maxLimitedKeys, len(l.limits.keys))
+	}
+	if _, ok := l.limits.keys["0"]; ok {
+		t.Error("Expected the oldest key to be evicted")
+	}
+}
+
+// periodicTester runs the periodic loggers of a logger with a fake clock.
+type periodicTester struct {
+	l   *Logger
+	out *bufferCloser
+	at  time.Time
+	ran map[string][]time.Duration // sinceLast of each run, by ID
+}
+
+func newPeriodicTester() *periodicTester {
+	pt := &periodicTester{out: &bufferCloser{}, at: time.Now(), ran: map[string][]time.Duration{}}
+	pt.l = NewLogger(pt.out, Info)
+	pt.l.p.now = func() time.Time { return pt.at }
+	return pt
+}
+
+func (pt *periodicTester) logger(id string) loggerFunc {
+	return func(_ *Composer, sinceLast time.Duration) {
+		pt.ran[id] = append(pt.ran[id], sinceLast)
+	}
+}
+
+// advance moves the clock forward in steps, running the loggers that are due like periodicRunner() would.
+func (pt *periodicTester) advance(d, step time.Duration) {
+	for end := pt.at.Add(d); pt.at.Before(end); {
+		pt.at = pt.at.Add(step)
+		pt.l.p.m.Lock()
+		runPeriodic(pt.l, periodicMinSleep, pt.at)
+		resetTimer(pt.l, pt.at)
+		pt.l.p.m.Unlock()
+	}
+}
+
+func TestOneShot(t *testing.T) {
+	pt := newPeriodicTester()
+	defer pt.l.Close()
+	pt.l.AddOneShot("summary", 30*time.Second, pt.logger("summary"))
+	pt.l.AddOneShot("removed", 30*time.Second, pt.logger("removed"))
+	pt.advance(20*time.Second, time.Second)
+	pt.l.RemovePeriodic("removed")
+	if len(pt.ran) != 0 {
+		t.Fatalf("Expected nothing to run before the delay, got %v", pt.ran)
+	}
+	pt.advance(time.Hour, time.Second)
+	if len(pt.ran["summary"]) != 1 || len(pt.ran["removed"]) != 0 {
+		t.Errorf("Expected only the one-shot that wasn't removed to run once, got %v", pt.ran)
+	}
+	if len(pt.l.p.loggers) != 0 {
+		t.Errorf("Expected the one-shot to remove itself, %d loggers remain", len(pt.l.p.loggers))
+	}
+	if strings.Contains(pt.out.String(), "ERROR") {
+		t.Errorf("Expected no errors, got %q", pt.out.String())
+	}
+}
+
+func TestRunAllPeriodicKeepsSchedule(t *testing.T) {
+	pt := newPeriodicTester()
+	defer pt.l.Close()
+	pt.l.AddPeriodic("stats", time.Minute, time.Hour, pt.logger("stats"))
+	pt.l.AddOneShot("summary", time.Hour, pt.logger("summary"))
+	for i := 0; i < 10; i++ {
+		pt.advance(5*time.Second, 5*time.Second)
+		pt.l.RunAllPeriodic()
+	}
+	if len(pt.ran["stats"]) != 10 || len(pt.ran["summary"]) != 1 {
+		t.Fatalf("Expected RunAllPeriodic to run every logger, but one-shots only once, got %v", pt.ran)
+	}
+	pt.advance(20*time.Minute, 5*time.Second)
+	// the last run by RunAllPeriodic, then the scheduled runs
+	expected := []time.Duration{5 * time.Second, 10 * time.Second, 3 * time.Minute, 9 * time.Minute}
+	got := pt.ran["stats"][9:]
+	if len(got) != len(expected) {
+		t.Fatalf("Expected the intervals after RunAllPeriodic to be %v, got %v", expected, got)
+	}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Fatalf("Expected the intervals after RunAllPeriodic to be %v, got %v", expected, got)
+		}
+	}
+	if len(pt.ran["summary"]) != 1 {
+		t.Errorf("Expected the one-shot to not run again, got %v", pt.ran["summary"])
+	}
+}
+
+func TestPeriodicIntervalIsClamped(t *testing.T) {
+	pt := newPeriodicTester()
+	defer pt.l.Close()
+	pt.l.AddPeriodic("forever", time.Minute, time.Hour, pt.logger("forever"))
+	pt.l.AddPeriodicUntil("starting", time.Minute, time.Hour, 2*time.Hour, pt.logger("starting"))
+	pt.advance(1000*time.Hour, time.Minute)
+
+	forever := pt.ran["forever"]
+	expected := []time.Duration{time.Minute, 3 * time.Minute, 9 * time.Minute, 27 * time.Minute, time.Hour}
+	if len(forever) < 1000-100 {
+		t.Fatalf("Expected the logger to keep running every hour, it ran %d times", len(forever))
+	}
+	for i, interval := range forever {
+		if i < len(expected) && interval != expected[i] || i >= len(expected) && interval != time.Hour {
+			t.Fatalf("Expected the intervals to grow to an hour and stay there, got %v", forever[:i+1])
+		}
+	}
+	if starting := pt.ran["starting"]; len(starting) != 6 {
+		t.Errorf("Expected AddPeriodicUntil to stop after the first run past two hours, got %v", starting)
+	}
+	if len(pt.l.p.loggers) != 1 || !strings.Contains(pt.out.String(), "Stopping periodic logger starting") {
+		t.Errorf("Expected the stopped logger to be removed with a message, got %q", pt.out.String())
+	}
+}
+
+func TestComposerLevels(t *testing.T) {
+	compose := func(l *Logger) {
+		c := l.Compose(Info)
+		c.Writeln("stats")
+		c.SetLevel(Warning)
+		c.Writeln("bad")
+		c.SetLevel(Info)
+		c.Finish("more")
+	}
+	out := &bufferCloser{}
+	l := NewLogger(out, Info)
+	defer l.Close()
+	compose(l)
+	if expected := "stats\nWARNING: bad\nmore\n"; out.String() != expected {
+		t.Errorf("Expected %q, got %q", expected, out.String())
+	}
+	out.Reset()
+	l.Treshold = Warning
+	compose(l)
+	if expected := "WARNING: bad\n"; out.String() != expected {
+		t.Errorf("Expected only the warning when Info is filtered, got %q", out.String())
+	}
+
+	out.Reset()
+	jl := NewJSONLogger(out, Info)
+	defer jl.Close()
+	compose(jl)
+	r := records(t, out.String())
+	if len(r) != 3 || r[0]["msg"] != "stats" || r[1]["level"] != "warning" || r[1]["msg"] != "bad" ||
+		r[2]["level"] != "info" {
+		t.Errorf("Expected one object per level, got %v", r)
+	}
+
+	pt := newPeriodicTester()
+	defer pt.l.Close()
+	pt.l.Treshold = Warning
+	pt.l.AddOneShot("warns", time.Minute, func(c *Composer, _ time.Duration) {
+		c.Writeln("statistics")
+		c.SetLevel(Warning)
+		c.Writeln("falling behind")
+	})
+	pt.advance(time.Minute, time.Second)
+	if expected := "WARNING: falling behind\n"; pt.out.String() != expected {
+		t.Errorf("Expected periodic loggers to be able to warn, got %q", pt.out.String())
+	}
+}
+
+func TestSlowComposerDoesntBlock(t *testing.T) {
+	out := &closeCounter{}
+	l := NewLogger(out, Info)
+	defer l.Close()
+	c := l.Compose(Info)
+	c.Writeln("slow")
+	took := make(chan time.Duration)
+	go func() {
+		started := time.Now()
+		l.Info("fast")
+		took <- time.Since(started)
+	}()
+	select {
+	case d := <-took:
+		if d > 5*time.Millisecond {
+			t.Errorf("Logging took %s while a composer was open", d)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Logging waits for open composers")
+	}
+	c.Finish("composer")
+	out.lock.Lock()
+	defer out.lock.Unlock()
+	if expected := "fast\nslow\ncomposer\n"; out.buf.String() != expected {
+		t.Errorf("Expected %q, got %q", expected, out.buf.String())
+	}
+}
@@ -26,6 +26,8 @@ type periodicLogger struct {
 	interval backoff.ExponentialBackOff
 	nextRun  time.Time
 	lastRun  time.Time
+	oneShot  bool // remove after running once
+	canStop  bool // remove when interval says Stop, instead of staying at MaxInterval
 }
 
 // groups related fields in Logger
@@ -33,15 +35,22 @@ type periodic struct {
 	timer   *time.Timer
 	loggers []*periodicLogger
 	m       sync.Mutex
-	stop    bool // tell periodicRunner() to exit
+	stop    bool             // tell periodicRunner() to exit
+	now     func() time.Time // replaced by tests
 }
 
 func newPeriodic() periodic {
 	return periodic{
 		timer: time.NewTimer(periodicMaxSleep),
+		now:   time.Now,
 	}
 	// NewLogger starts periodicRunner()
 }
+
+// Now makes the clock of periodic usable by backoff.
+func (p *periodic) Now() time.Time {
+	return p.now()
+}
 func (p *periodic) Close() {
 	p.m.Lock()
 	defer p.m.Unlock()
@@ -67,40 +76,64 @@ func resetTimer(l *Logger, now time.Time) {
 	l.p.timer.Reset(next.Sub(now))
 }
 
-// Run all loggers that want to be run before (now + minSleep)
-func runPeriodic(l *Logger, minSleep time.Duration, started time.Time) {
+// run calls the closure with its own Composer, which the caller must close.
+// The composer is at Info level afterwards, even if the closure changed it.
+func (pl *periodicLogger) run(l *Logger, now time.Time) Composer {
 	c := l.Compose(Info)
-	defer c.Close()
+	pl.logger(&c, now.Sub(pl.lastRun))
+	pl.lastRun = now
+	c.SetLevel(Info)
+	return c
+}
+
+// Run all loggers that want to be run before (now + minSleep),
+// and schedule their next run.
+// One-shot loggers and those whose interval has stopped are removed.
+// Each logger's output is written as a separate message.
+func runPeriodic(l *Logger, minSleep time.Duration, started time.Time) {
 	limit := started.Add(minSleep)
+	keep := l.p.loggers[:0]
 	for _, pl := range l.p.loggers {
-		if limit.After(pl.nextRun) {
-			pl.logger(&c, started.Sub(pl.lastRun))
-			pl.lastRun = started
-			next := pl.interval.NextBackOff()
-			if next <= 0 {
-				// Cannot use l.Warn() because l.writeLock is locked by c
-				l.prefixMessage(Warning)
-				c.Writeln("Stopping periodic logger %s", pl.id)
-				next = periodicMaxSleep
-			}
-			if DebugPeriodicIntervals {
-				c.Writeln("(%s until next %s)", RoundDuration(next, time.Second), pl.id)
-			}
-			pl.nextRun = started.Add(next)
+		if !limit.After(pl.nextRun) {
+			keep = append(keep, pl)
+			continue
+		}
+		c := pl.run(l, started)
+		if pl.oneShot {
+			c.Close()
+			continue
+		}
+		next := pl.interval.NextBackOff()
+		if next <= 0 && pl.canStop {
+			c.Finish("Stopping periodic logger %s", pl.id)
+			continue
+		} else if next <= 0 {
+			next = pl.interval.MaxInterval
 		}
+		if DebugPeriodicIntervals {
+			c.Writeln("(%s until next %s)", RoundDuration(next, time.Second), pl.id)
+		}
+		c.Close()
+		pl.nextRun = started.Add(next)
+		keep = append(keep, pl)
+	}
+	for i := len(keep); i < len(l.p.loggers); i++ {
+		l.p.loggers[i] = nil
 	}
+	l.p.loggers = keep
 }
 
 // Runs until l.p.stop is true
 func periodicRunner(l *Logger) {
 	for {
-		now := <-l.p.timer.C
+		<-l.p.timer.C
 		// Somebody else could take the lock here, but then no loggers will be run.
 		l.p.m.Lock()
 		if l.p.stop {
 			l.p.m.Unlock()
 			break
 		}
+		now := l.p.now()
 		runPeriodic(l, periodicMinSleep, now)
 		resetTimer(l, now)
 		l.p.m.Unlock()
@@ -108,24 +141,58 @@ func periodicRunner(l *Logger) {
 }
 
 // RunAllPeriodic runs all the closures right now, ignoring any intervals.
+// The loggers are still run when they were scheduled to, and their intervals
+// don't grow, so it can be called for other reasons than shutting down.
+// One-shot loggers are removed as they have now run.
 func (l *Logger) RunAllPeriodic() {
 	l.p.m.Lock()
 	defer l.p.m.Unlock()
-	n := time.Now()
-	runPeriodic(l, periodicMaxSleep, n)
+	n := l.p.now()
+	keep := l.p.loggers[:0]
+	for _, pl := range l.p.loggers {
+		c := pl.run(l, n)
+		c.Close()
+		if !pl.oneShot {
+			keep = append(keep, pl)
+		}
+	}
+	for i := len(keep); i < len(l.p.loggers); i++ {
+		l.p.loggers[i] = nil
+	}
+	l.p.loggers = keep
 	resetTimer(l, n)
 }
 
 // AddPeriodic stores a closure that will be called periodically
-// with an interval that increases from minInterval to maxInterval exponentally.
+// with an interval that increases from minInterval to maxInterval exponentally,
+// and then stays at maxInterval.
 func (l *Logger) AddPeriodic(id string, minInterval, maxInterval time.Duration, f loggerFunc) {
+	l.addPeriodic(id, minInterval, maxInterval, 0, false, f)
+}
+
+// AddPeriodicUntil is AddPeriodic for loggers that are only interesting for
+// a while: the logger is removed after the first run that is more than
+// stopAfter after it was added.
+func (l *Logger) AddPeriodicUntil(id string, minInterval, maxInterval, stopAfter time.Duration, f loggerFunc) {
+	l.addPeriodic(id, minInterval, maxInterval, stopAfter, false, f)
+}
+
+// AddOneShot stores a closure that will be called once after a delay,
+// such as for a summary some time after starting.
+// It's removed after running, and can be removed with RemovePeriodic() before that.
+func (l *Logger) AddOneShot(id string, after time.Duration, f loggerFunc) {
+	l.addPeriodic(id, after, after, 0, true, f)
+}
+
+func (l *Logger) addPeriodic(id string, minInterval, maxInterval, stopAfter time.Duration, oneShot bool,
+	f loggerFunc) {
 	b := backoff.ExponentialBackOff{
 		InitialInterval:     minInterval,
 		MaxInterval:         maxInterval,
 		Multiplier:          3.0,
 		RandomizationFactor: 0.0,
-		MaxElapsedTime:      0, // disabled
-		Clock:               backoff.SystemClock,
+		MaxElapsedTime:      stopAfter, // disabled if 0
+		Clock:               &l.p,
 	}
 	b.Reset()
 
@@ -138,13 +205,15 @@ func (l *Logger) AddPeriodic(id string, minInterval, maxInterval time.Duration,
 			return
 		}
 	}
-	added := time.Now()
+	added := l.p.now()
 	l.p.loggers = append(l.p.loggers, &periodicLogger{
 		id:       id,
 		logger:   f,
 		interval: b,
 		lastRun:  added,
 		nextRun:  added.Add(b.NextBackOff()),
+		oneShot:  oneShot,
+		canStop:  stopAfter != 0,
 	})
 	resetTimer(l, added)
 }
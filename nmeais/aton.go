@@ -0,0 +1,57 @@
+package nmeais
+
+import (
+	"fmt"
+
+	"github.com/tormol/AIS/geo"
+)
+
+// AidToNavigation is a decoded aid-to-navigation report (type 21),
+// which is sent by or on behalf of buoys, lighthouses and similar.
+type AidToNavigation struct {
+	MMSI        uint32
+	AidType     uint8     // See storage.AtoNType
+	Name        string    // Including the name extension
+	Accuracy    bool      // High accuracy (<10m)
+	Pos         geo.Point // 91 and 181 means not available
+	ToBow       uint16    // Dimensions in meters, or the radius for floating aids
+	ToStern     uint16
+	ToPort      uint8
+	ToStarboard uint8
+	Second      uint8 // UTC second, 60-63 means not available
+	OffPosition bool  // Floating aid is off its charted position, only valid if Second < 60
+	Virtual     bool  // Doesn't physically exist
+	Assigned    bool  // Assigned mode
+}
+
+// Minimum number of bits needed to decode an aid-to-navigation report.
+// The name extension is optional, and the spare bit before it is allowed to be missing.
+const aidToNavigationBits = 271 // of 272-360
+
+// DecodeAidToNavigation decodes message type 21.
+func DecodeAidToNavigation(pb PayloadBits) (AidToNavigation, error) {
+	aton := AidToNavigation{MMSI: pb.Uint(8, 30)}
+	if t := pb.Uint(0, 6); t != 21 {
+		return aton, fmt.Errorf("type %d is not an aid-to-navigation report", t)
+	} else if pb.Len() < aidToNavigationBits {
+		return aton, fmt.Errorf("type 21 is too short (%d bits)", pb.Len())
+	}
+	aton.AidType = uint8(pb.Uint(38, 5))
+	aton.Name = pb.Text(43, 20)
+	if pb.Len() > 272 {
+		aton.Name += pb.Text(272, (pb.Len()-272)/6)
+	}
+	aton.Accuracy = pb.Bool(163)
+	// in 1/10000 minutes
+	aton.Pos.Long = float64(pb.Int(164, 28)) / 600000
+	aton.Pos.Lat = float64(pb.Int(192, 27)) / 600000
+	aton.ToBow = uint16(pb.Uint(219, 9))
+	aton.ToStern = uint16(pb.Uint(228, 9))
+	aton.ToPort = uint8(pb.Uint(237, 6))
+	aton.ToStarboard = uint8(pb.Uint(243, 6))
+	aton.Second = uint8(pb.Uint(253, 6))
+	aton.OffPosition = pb.Bool(259)
+	aton.Virtual = pb.Bool(269)
+	aton.Assigned = pb.Bool(270)
+	return aton, nil
+}
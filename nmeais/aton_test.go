@@ -0,0 +1,68 @@
+package nmeais
+
+import (
+	"math"
+	"testing"
+)
+
+func TestDecodeAidToNavigation(t *testing.T) {
+	// a virtual aid by the San Francisco-Oakland Bay Bridge
+	aton, err := DecodeAidToNavigation(NewPayloadBits("E>kb9O9aS@7PUh10dh19@;0Tah2cWrfP:l?M`00003vP100", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aton.MMSI != 993692028 || aton.AidType != 19 || aton.Name != "SF OAK BAY BR VAIS E" {
+		t.Errorf("Wrong identity: %d %d %q", aton.MMSI, aton.AidType, aton.Name)
+	}
+	if math.Abs(aton.Pos.Lat-37.805622) > 0.000001 || math.Abs(aton.Pos.Long+122.369867) > 0.000001 {
+		t.Errorf("Wrong position: %v", aton.Pos)
+	}
+	if !aton.Virtual || aton.OffPosition || aton.Assigned || aton.Accuracy || aton.Second != 61 {
+		t.Errorf("Wrong flags: %+v", aton)
+	}
+
+	// split over two sentences, with the name extension in the second
+	pb := NewPayloadBits("E1mg=5J1T4W0h97aRh6ba84<h2d;W:Te=eLvH50```q"+":D44QDlp0C1DU00", 2)
+	aton, err = DecodeAidToNavigation(pb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aton.MMSI != 123456789 || aton.AidType != 20 || aton.Name != "CHINA ROSE MURPHY EXPRESS ALERT" {
+		t.Errorf("Wrong identity: %d %d %q", aton.MMSI, aton.AidType, aton.Name)
+	}
+	if aton.ToBow != 5 || aton.ToStern != 5 || aton.ToPort != 5 || aton.ToStarboard != 5 || aton.Second != 50 {
+		t.Errorf("Wrong dimensions or second: %+v", aton)
+	}
+	if aton.Virtual || aton.OffPosition {
+		t.Errorf("Wrong flags: %+v", aton)
+	}
+
+	short := &testPayload{}
+	short.add(21, 6).add(0, 260)
+	if _, err := DecodeAidToNavigation(short.payloadBits()); err == nil {
+		t.Error("Expected truncated type 21 to fail")
+	}
+	other := &testPayload{}
+	other.add(1, 6).add(0, 270)
+	if _, err := DecodeAidToNavigation(other.payloadBits()); err == nil {
+		t.Error("Expected type 1 to fail")
+	}
+}
+
+func TestPayloadText(t *testing.T) {
+	tp := &testPayload{}
+	for _, c := range "AB @" {
+		tp.add(int64(c)&63, 6)
+	}
+	tp.add(int64('Z')&63, 6).add(0, 4)
+	pb := tp.payloadBits()
+	if text := pb.Text(0, 3); text != "AB" {
+		t.Errorf("Expected trailing space to be trimmed, got %q", text)
+	}
+	if text := pb.Text(0, 5); text != "AB @Z" {
+		t.Errorf("Expected \"AB @Z\", got %q", text)
+	}
+	if text := pb.Text(24, 10); text != "Z" {
+		t.Errorf("Expected text to stop at the end of the payload, got %q", text)
+	}
+}
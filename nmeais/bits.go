@@ -0,0 +1,110 @@
+package nmeais
+
+import (
+	"strings"
+)
+
+// PayloadBits gives access to individual fields of a message payload
+// without de-armoring more than needed.
+// The payload is kept in its six-bit ASCII form and fields are extracted
+// directly from that, so it's cheap to create.
+type PayloadBits struct {
+	armored string
+	bits    uint // excludes padding
+}
+
+// NewPayloadBits wraps an armored payload.
+// padding is the number of bits at the end of the last character that aren't part of the message.
+func NewPayloadBits(armored string, padding uint8) PayloadBits {
+	bits := uint(len(armored)) * 6
+	if uint(padding) > bits {
+		bits = 0
+	} else {
+		bits -= uint(padding)
+	}
+	return PayloadBits{armored: armored, bits: bits}
+}
+
+// Bits returns the combined payload of all the sentences of the message.
+// Only the padding of the last sentence is respected.
+func (m *Message) Bits() PayloadBits {
+	last := m.Sentences()[len(m.Sentences())-1]
+	_, padding := last.Payload()
+	if padding > 5 {
+		padding = 0 // 6 is sometimes seen, but makes no sense
+	}
+	return NewPayloadBits(m.ArmoredPayload(), padding)
+}
+
+// Len returns the number of bits in the payload.
+func (pb PayloadBits) Len() uint {
+	return pb.bits
+}
+
+// Uint extracts an unsigned field of up to 32 bits starting at bit offset start.
+// Bits beyond the end of the payload are read as zero.
+func (pb PayloadBits) Uint(start, length uint) uint32 {
+	v := uint32(0)
+	for i := start; i < start+length; i++ {
+		v <<= 1
+		if i < pb.bits {
+			char := deArmorByte(pb.armored[i/6])
+			v |= uint32(char>>(5-i%6)) & 1
+		}
+	}
+	return v
+}
+
+// Int extracts a two's complement signed field of up to 32 bits starting at bit offset start.
+func (pb PayloadBits) Int(start, length uint) int32 {
+	v := pb.Uint(start, length)
+	if length > 0 && length < 32 && v&(1<<(length-1)) != 0 {
+		v |= ^uint32(0) << length // sign extend
+	}
+	return int32(v)
+}
+
+// Bool extracts a single bit.
+func (pb PayloadBits) Bool(at uint) bool {
+	return pb.Uint(at, 1) != 0
+}
+
+// Text extracts a string of chars six-bit characters starting at bit offset start.
+// Characters beyond the end of the payload are left out, and trailing
+// padding ('@') and spaces are removed.
+func (pb PayloadBits) Text(start, chars uint) string {
+	text := make([]byte, 0, chars)
+	for i := start; i+6 <= pb.bits && i < start+chars*6; i += 6 {
+		c := byte(pb.Uint(i, 6))
+		if c < 32 {
+			c += 64
+		}
+		text = append(text, c)
+	}
+	return strings.TrimRight(string(text), "@ ")
+}
+
+// Position returns the position of position reports (type 1, 2, 3, 9, 18 and 19).
+// ok is false for other types and when the position is not available.
+func (m *Message) Position() (lat, long float64, ok bool) {
+	var at uint // of longitude, latitude follows
+	switch m.Type() {
+	case 1, 2, 3, 9:
+		at = 61
+	case 18, 19:
+		at = 57
+	default:
+		return 0, 0, false
+	}
+	pb := m.Bits()
+	if pb.Len() < at+28+27 {
+		return 0, 0, false
+	}
+	// in 1/10000 minutes, 181 and 91 degrees means not available
+	long = float64(pb.Int(at, 28)) / 600000
+	lat = float64(pb.Int(at+28, 27)) / 600000
+	if long < -180 || long > 180 || lat < -90 || lat > 90 {
+		return 0, 0, false
+	}
+	return lat, long, true
+}
@@ -13,7 +13,8 @@ import (
 // `next` is the index of the first byte that wasn't copied,
 // it is len(bufferSlice) if the entire input was used.
 // Otherwise it's ensured that `copiedSentence`` ends with a "\r\n" line delimiter.
-// Bytes before the first '!' are considered noise and skipped.
+// Bytes before the first '!' are considered noise and skipped,
+// except a TAG block (`\...\`) directly before it, which is kept with the sentence.
 // This newline fixing and '!'-seeking means that `next` might be different from
 // len(copiedSentence)-len(incomplete).
 // The sentence is always copied so that the input buffer can be reused immediately.
@@ -28,20 +29,34 @@ func FirstSentenceInBuffer(incomplete, bufferSlice []byte) (copiedSentence []byt
 	if len(incomplete) == 0 {
 		start := bytes.IndexByte(bufferSlice, '!')
 		if start == -1 {
-			return []byte{}, -1
+			// might be a TAG block split from its sentence
+			start = bytes.IndexByte(bufferSlice, '\\')
+			if start == -1 {
+				return []byte{}, -1
+			}
+			return append(incomplete, bufferSlice[start:]...), -1
 		}
+		start = tagBlockStart(bufferSlice, 0, start)
 		bufferSlice = bufferSlice[start:]
-		// start search after the '!' at index 0
-		nextm1 := bytes.IndexByte(bufferSlice[1:], '!') // next minus one
+		// start search after the '!' of this sentence
+		bang := bytes.IndexByte(bufferSlice, '!')
+		nextm1 := bytes.IndexByte(bufferSlice[bang+1:], '!') // next minus one
 		if nextm1 != -1 {
-			next = nextm1 + 1
+			next = tagBlockStart(bufferSlice, bang+1, bang+1+nextm1)
 		}
 	} else {
 		// do look at the first byte; if the connection was restarted, the server might have
 		// forgotten how fa the clien was and started sending a new sentence.
 		// `incomplete` might just have been missing a newline,
 		// so return it even if it will likely be invalid.
-		next = bytes.IndexByte(bufferSlice, '!')
+		from := 0
+		if incomplete[0] == '\\' && bytes.IndexByte(incomplete, '!') == -1 {
+			// the first '!' belongs to the TAG block in incomplete
+			from = bytes.IndexByte(bufferSlice, '!') + 1
+		}
+		if nextm1 := bytes.IndexByte(bufferSlice[from:], '!'); nextm1 != -1 {
+			next = tagBlockStart(bufferSlice, from, from+nextm1)
+		}
 	}
 
 	end := bytes.IndexByte(bufferSlice, '\n')
@@ -65,6 +80,20 @@ func FirstSentenceInBuffer(incomplete, bufferSlice []byte) (copiedSentence []byt
 	}
 }
 
+// tagBlockStart returns the index of the '\\' that starts a TAG block directly
+// before the '!' at index bang, or bang if there is no TAG block.
+// The TAG block cannot start before from.
+func tagBlockStart(b []byte, from, bang int) int {
+	if bang-1 <= from || b[bang-1] != '\\' {
+		return bang
+	}
+	start := bytes.LastIndexByte(b[from:bang-1], '\\')
+	if start == -1 || bytes.IndexByte(b[from+start:bang], '\n') != -1 {
+		return bang
+	}
+	return from + start
+}
+
 func reserveCapacity(b []byte, add int) []byte {
 	if cap(b) >= len(b)+add {
 		return b
@@ -25,6 +25,13 @@ var testPackets = []struct {
 	{"!BSVDM,2", ",2,,,2CQSp888880,2*0F\n!next", "!BSVDM,2,2,,,2CQSp888880,2*0F\r\n", 22},
 	{"!AIVDM,2,2,,,00", "", "!AIVDM,2,2,,,00", -1},
 	{"!AIVDM,1,1,,B,ENk`so91S@@@@@@@@@@@@@@@@@@==Fm;9bGh000003vP000,2*11\r", "\n", "!AIVDM,1,1,,B,ENk`so91S@@@@@@@@@@@@@@@@@@==Fm;9bGh000003vP000,2*11\r\n", 1},
+	// TAG blocks
+	{"", "\\s:2573145,c:1492683034*0B\\!BSVDM,1,1,,A,14S:Eb001ePRmHBTAAFnrmV60PRk,0*1F\r\n", "\\s:2573145,c:1492683034*0B\\!BSVDM,1,1,,A,14S:Eb001ePRmHBTAAFnrmV60PRk,0*1F\r\n", 76},
+	{"", "noise\\c:1492683034*5D\\!BSVDM,1,1,,A,14S:Eb001ePRmHBTAAFnrmV60PRk,0*1F\r\n", "\\c:1492683034*5D\\!BSVDM,1,1,,A,14S:Eb001ePRmHBTAAFnrmV60PRk,0*1F\r\n", 66},
+	{"", "\\c:1492683034*5D\\!BSVDM,1,1,,A,14S:Eb001ePRmHBTAAFnrmV60PRk,0*1F\\c:1492683034*5D\\!BSVDM", "\\c:1492683034*5D\\!BSVDM,1,1,,A,14S:Eb001ePRmHBTAAFnrmV60PRk,0*1F\r\n", 64},
+	{"", "\\s:2573145,c:14", "\\s:2573145,c:14", -1},
+	{"\\s:2573145,c:14", "92683034*0B\\!BSVDM,1,1,,A,14S:Eb001ePRmHBTAAFnrmV60PRk,0*1F\r\n", "\\s:2573145,c:1492683034*0B\\!BSVDM,1,1,,A,14S:Eb001ePRmHBTAAFnrmV60PRk,0*1F\r\n", 61},
+	{"!BSVDM,2,2,8,B,88888888880,2*36", "\\c:1492683034*5D\\!BSVDM", "!BSVDM,2,2,8,B,88888888880,2*36\r\n", 0},
 }
 
 func TestPackets(t *testing.T) {
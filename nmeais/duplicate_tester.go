@@ -11,9 +11,16 @@ import (
 // What's considered recent is controlled by a parmater to the constructor,
 // and a package might be comparaed against all received within the double of that.
 // It uses internal locking, which makes it safe to share instances between goroutines.
+//
+// Messages are compared by a 64-bit hash of the payload of all sentences and the padding,
+// ignoring the rest of the NMEA envelope, so that the same message is recognized
+// even if the talker ID, channel, sequential message ID or checksum differs.
+// Two different messages can be considered duplicates if their hashes collide.
+// With the some thousand messages that are kept, the probability of that
+// happening for a message is around 1 in 10^15, which is accepted.
 type DuplicateTester struct {
-	active  map[string]struct{} //Points to the oldest map (the one where incoming messages are being tested against)
-	pending map[string]struct{} //Points to the pending map
+	active  map[uint64]struct{} //Points to the oldest map (the one where incoming messages are being tested against)
+	pending map[uint64]struct{} //Points to the pending map
 	mu      sync.Mutex          //Not a pointer because copying the struct will break tableOrganizer anyway.
 	stop    bool                //tells tableOrganizer to stop
 }
@@ -29,34 +36,41 @@ input:
 */
 func NewDuplicateTester(minKeepAlive time.Duration) *DuplicateTester {
 	dt := &DuplicateTester{
-		active:  make(map[string]struct{}, 0),
-		pending: make(map[string]struct{}, 0),
+		active:  make(map[uint64]struct{}, 0),
+		pending: make(map[uint64]struct{}, 0),
 		mu:      sync.Mutex{},
 	}
 	go tableOrganizer(dt, minKeepAlive)
 	return dt
 }
 
-/*
-TODO:
-	- could be improved by occasionally testing the amount of messages recieved per seconds in order to allocate a more suitable amount of memory for the maps
-*/
 //this function organizes the creation and resetting of the maps. It is run in its own goroutine
 func tableOrganizer(dt *DuplicateTester, keepAlive time.Duration) {
 	for {
 		time.Sleep(keepAlive) // every keepAlive, one table is cleared, and the other Table is set as active
-		dt.mu.Lock()
-		empty := make(map[string]struct{}, len(dt.active)+100) // +100 to account for uneven traffic
-		dt.active = dt.pending                                 // set new active
-		dt.pending = empty                                     // the "pending"-map is now a empty map
-		stop := dt.stop
-		dt.mu.Unlock()
-		if stop { // prevent deadlock, even if that would make bugs more noticable.
-			return
+		if !dt.rotate() {
+			return // prevent deadlock, even if that would make bugs more noticable.
 		}
 	}
 }
 
+// rotate replaces the active map with the pending map, and the pending map with an empty one.
+// The empty map is sized for the number of messages received in the previous period,
+// and is allocated without holding the lock.
+// Returns false if the DuplicateTester has been closed.
+func (dt *DuplicateTester) rotate() bool {
+	dt.mu.Lock()
+	received := len(dt.pending) // since the last rotation
+	dt.mu.Unlock()
+	empty := make(map[uint64]struct{}, received+received/8+100) // to account for uneven traffic
+	dt.mu.Lock()
+	dt.active = dt.pending // set new active
+	dt.pending = empty     // the "pending"-map is now a empty map
+	stop := dt.stop
+	dt.mu.Unlock()
+	return !stop
+}
+
 // Close tells the internal goroutine to stop.
 func (dt *DuplicateTester) Close() {
 	dt.mu.Lock()
@@ -64,21 +78,50 @@ func (dt *DuplicateTester) Close() {
 	dt.mu.Unlock()
 }
 
+// Parameters of the 64-bit FNV-1a hash
+const (
+	fnvOffset64 = 14695981039346656037
+	fnvPrime64  = 1099511628211
+)
+
+// fnv1a continues the 64-bit FNV-1a hash h with s.
+// It's implemented here because hash/fnv would require converting s to a []byte.
+func fnv1a(h uint64, s string) uint64 {
+	for i := 0; i < len(s); i++ {
+		h ^= uint64(s[i])
+		h *= fnvPrime64
+	}
+	return h
+}
+
+// payloadHash hashes the combined payload and the padding of the message.
+func payloadHash(msg *Message) uint64 {
+	h := uint64(fnvOffset64)
+	padding := uint8(0)
+	for _, s := range msg.Sentences() {
+		var payload string
+		payload, padding = s.Payload()
+		h = fnv1a(h, payload)
+	}
+	h ^= uint64(padding) // of the last sentence, can't be confused with payload characters
+	return h * fnvPrime64
+}
+
 /*
 IsDuplicate compares msg against all messages passed to IsDuplicate within
 the last 1x to 20 minKeepAlive.
 
-Input: 	msg    - Only the raw text of the first sentence is used. (for speed and simplicity)
+Input: 	msg    - Only the payloads and the padding are used, not the source or the rest of the envelope.
 Output:	exists - true if the message is previously known
                - false if the message is new
 */
 func (dt *DuplicateTester) IsDuplicate(msg *Message) bool {
+	h := payloadHash(msg)
 	dt.mu.Lock()
-	s := msg.Sentences()[0].Text
-	_, exists := dt.active[s]
+	_, exists := dt.active[h]
 	if !exists { //The message is not previously known
-		dt.active[s] = struct{}{}  // mark the message as known
-		dt.pending[s] = struct{}{} // to both maps
+		dt.active[h] = struct{}{}  // mark the message as known
+		dt.pending[h] = struct{}{} // to both maps
 	}
 	dt.mu.Unlock()
 	return exists
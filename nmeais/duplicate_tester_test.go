@@ -0,0 +1,110 @@
+package nmeais
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// randomMessages creates n single-sentence messages with random payloads,
+// where about a third are repeated from a recent message as if received from
+// another source.
+func randomMessages(b *testing.B, n int) []*Message {
+	const armor = "0123456789:;<=>?@ABCDEFGHIJKLMNOPQRSTUVW`abcdefghijklmnopqrstuvw"
+	messages := make([]*Message, n)
+	payload := make([]byte, 28)
+	for i := range messages {
+		if i > 10 && rand.Intn(3) == 0 {
+			messages[i] = messages[i-1-rand.Intn(10)]
+			continue
+		}
+		payload[0] = "1235"[rand.Intn(4)]
+		for j := 1; j < len(payload); j++ {
+			payload[j] = armor[rand.Intn(len(armor))]
+		}
+		text := fmt.Sprintf("!AIVDM,1,1,,%c,%s,0*00\r\n", "AB"[rand.Intn(2)], payload)
+		s, err := ParseSentence([]byte(text), time.Now())
+		if err != nil {
+			b.Fatal(err)
+		}
+		messages[i] = &Message{sentences: []Sentence{s}, started: s.Received, ended: s.Received}
+	}
+	return messages
+}
+
+func TestIsDuplicate(t *testing.T) {
+	dt := NewDuplicateTester(time.Hour)
+	defer dt.Close()
+	ma := NewMessageAssembler(10, time.Minute, "test")
+	message := func(sentences ...string) *Message {
+		var m *Message
+		for _, text := range sentences {
+			s, err := ParseSentence([]byte(text), time.Now())
+			if err != nil {
+				t.Fatal(err)
+			}
+			m, _ = ma.Accept(s)
+		}
+		if m == nil {
+			t.Fatalf("%q didn't complete a message", sentences)
+		}
+		return m
+	}
+	cases := []struct {
+		sentences []string
+		duplicate bool
+	}{
+		{[]string{"!BSVDM,1,1,,A,14S:Eb001ePRmHBTAAFnrmV60PRk,0*1F\r\n"}, false},
+		{[]string{"!BSVDM,1,1,,A,14S:Eb001ePRmHBTAAFnrmV60PRk,0*1F\r\n"}, true},
+		// the same payload from another source
+		{[]string{"!AIVDM,1,1,,B,14S:Eb001ePRmHBTAAFnrmV60PRk,0*05\r\n"}, true},
+		{[]string{"!AIVDM,1,1,3,A,14S:Eb001ePRmHBTAAFnrmV60PRk,0\r\n"}, true},
+		// different payloads
+		{[]string{"!BSVDM,1,1,,A,14S:Eb001ePRmHBTAAFnrmV60PRl,0*18\r\n"}, false},
+		{[]string{"!BSVDM,1,1,,A,04S:Eb001ePRmHBTAAFnrmV60PRk,0*1E\r\n"}, false},
+		{[]string{"!BSVDM,1,1,,A,14S:Eb001ePRmHBTAAFnrmV60PR,0*74\r\n"}, false},
+		{[]string{"!BSVDM,1,1,,A,14S:Eb001ePRmHBTAAFnrmV60PRk,2*1D\r\n"}, false},
+		// multi-sentence messages
+		{[]string{
+			"!AIVDM,2,1,1,A,55?MbV02;H;s<HtKR20EHE:0@T4@Dn2222222216L961O5Gf0NSQEp6ClRp8,0*1C\r\n",
+			"!AIVDM,2,2,1,A,88888888880,2*25\r\n",
+		}, false},
+		{[]string{
+			"!BSVDM,2,1,7,B,55?MbV02;H;s<HtKR20EHE:0@T4@Dn2222222216L961O5Gf0NSQEp6ClRp8,0\r\n",
+			"!BSVDM,2,2,7,B,88888888880,2\r\n",
+		}, true},
+		{[]string{
+			"!AIVDM,2,1,1,A,55?MbV02;H;s<HtKR20EHE:0@T4@Dn2222222216L961O5Gf0NSQEp6ClRp8,0*1C\r\n",
+			"!AIVDM,2,2,1,A,88888888881,2*24\r\n",
+		}, false}, // only the last part differs
+	}
+	for _, c := range cases {
+		if dt.IsDuplicate(message(c.sentences...)) != c.duplicate {
+			t.Errorf("Expected %q to be a duplicate: %t", c.sentences, c.duplicate)
+		}
+	}
+	dt.rotate()
+	if !dt.IsDuplicate(message(cases[0].sentences...)) {
+		t.Error("Expected messages to be remembered for one rotation")
+	}
+	dt.rotate()
+	dt.rotate()
+	if dt.IsDuplicate(message(cases[4].sentences...)) {
+		t.Error("Expected messages to be forgotten after two rotations")
+	}
+}
+
+func BenchmarkIsDuplicate(b *testing.B) {
+	messages := randomMessages(b, 8000) // two seconds at 2000 messages per second, twice
+	dt := NewDuplicateTester(time.Hour)
+	defer dt.Close()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if i%len(messages) == 0 && i != 0 {
+			dt.rotate() // as if the period has passed
+		}
+		dt.IsDuplicate(messages[i%len(messages)])
+	}
+}
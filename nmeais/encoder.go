@@ -0,0 +1,314 @@
+package nmeais
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// maxSentenceLength is the most characters a sentence can have including
+// the "\r\n", according to NMEA 0183.
+const maxSentenceLength = 82
+
+// checksum XORs together the characters between '!' and '*' of a sentence.
+func checksum(between []byte) byte {
+	sum := byte(0)
+	for _, b := range between {
+		sum ^= b
+	}
+	return sum
+}
+
+func armorByte(v uint8) byte {
+	if v >= 40 {
+		return v + 56
+	}
+	return v + 48
+}
+
+// ArmorPayload does the six-bit ASCII armoring of the first bits bits of data,
+// and returns how many bits of the last character are padding.
+func ArmorPayload(data []byte, bits uint) (string, uint8) {
+	if bits > uint(len(data))*8 {
+		bits = uint(len(data)) * 8
+	}
+	armored := make([]byte, (bits+5)/6)
+	for i := range armored {
+		v := uint8(0)
+		for bit := uint(i) * 6; bit < uint(i)*6+6; bit++ {
+			v <<= 1
+			if bit < bits {
+				v |= (data[bit/8] >> (7 - bit%8)) & 1
+			}
+		}
+		armored[i] = armorByte(v)
+	}
+	return string(armored), uint8(uint(len(armored))*6 - bits)
+}
+
+// EncodeSentence creates a sentence such as "!AIVDM,1,1,,A,13u?etPv2;0n:dDPwUM1U1Cb069D,0*24\r\n"
+// with the checksum.
+// The values are like in Sentence: partIndex starts at 0, smid 10 leaves the
+// SMID field empty and channel '*' leaves the channel empty.
+// It returns an error if a value is invalid or the sentence would be longer than 82 characters.
+func EncodeSentence(identifier string, parts, partIndex, smid uint8, channel byte,
+	armoredPayload string, padding uint8) (string, error) {
+	if len(identifier) != 5 {
+		return "", fmt.Errorf("identifier must be five characters, not %q", identifier)
+	} else if parts == 0 || parts > 9 {
+		return "", fmt.Errorf("parts must be between 1 and 9, not %d", parts)
+	} else if partIndex >= parts {
+		return "", fmt.Errorf("part index %d is too high for %d parts", partIndex, parts)
+	} else if smid > 10 {
+		return "", fmt.Errorf("SMID must be a digit or 10 for none, not %d", smid)
+	} else if padding > 5 {
+		return "", fmt.Errorf("padding must be between 0 and 5, not %d", padding)
+	} else if !(channel >= 'A' && channel <= 'Z') && !(channel >= '0' && channel <= '9') && channel != '*' {
+		return "", fmt.Errorf("invalid channel %q", channel)
+	}
+	for i := 0; i < len(armoredPayload); i++ {
+		if !validArmor(armoredPayload[i]) {
+			return "", fmt.Errorf("invalid character %q in payload", armoredPayload[i])
+		}
+	}
+	smidField, channelField := "", ""
+	if smid != 10 {
+		smidField = string(rune('0' + smid))
+	}
+	if channel != '*' {
+		channelField = string(rune(channel))
+	}
+	body := fmt.Sprintf("%s,%d,%d,%s,%s,%s,%d",
+		identifier, parts, partIndex+1, smidField, channelField, armoredPayload, padding)
+	sentence := fmt.Sprintf("!%s*%02X\r\n", body, checksum([]byte(body)))
+	if len(sentence) > maxSentenceLength {
+		return "", fmt.Errorf("sentence would be %d characters long", len(sentence))
+	}
+	return sentence, nil
+}
+
+// SplitIntoSentences splits an armored payload into the payloads of the parts
+// of a message, so that each sentence created from them by EncodeSentence
+// with smid and a channel is at most maxLen characters including "\r\n".
+// maxLen is capped to 82. It returns nil if more than nine sentences would be needed.
+func SplitIntoSentences(payload string, maxLen int, smid uint8) []string {
+	if maxLen <= 0 || maxLen > maxSentenceLength {
+		maxLen = maxSentenceLength
+	}
+	// !AIVDM,p,i,s,c,payload,0*hh\r\n
+	overhead := len("!AIVDM,1,1,0,A,,0*00\r\n")
+	if smid == 10 {
+		overhead--
+	}
+	perSentence := maxLen - overhead
+	if perSentence < 1 {
+		return nil
+	}
+	parts := []string{}
+	for len(payload) > perSentence {
+		parts = append(parts, payload[:perSentence])
+		payload = payload[perSentence:]
+	}
+	parts = append(parts, payload)
+	if len(parts) > 9 {
+		return nil
+	}
+	return parts
+}
+
+// PayloadWriter builds a message payload one field at a time,
+// for generating messages. The zero value is an empty payload.
+type PayloadWriter struct {
+	data []byte
+	bits uint
+}
+
+// Len returns the number of bits written so far.
+func (pw *PayloadWriter) Len() uint {
+	return pw.bits
+}
+
+// PutUint appends the lowest length bits of v.
+func (pw *PayloadWriter) PutUint(length uint, v uint32) {
+	for i := length; i > 0; i-- {
+		if pw.bits%8 == 0 {
+			pw.data = append(pw.data, 0)
+		}
+		bit := uint8(0)
+		if i <= 32 {
+			bit = uint8(v>>(i-1)) & 1
+		}
+		pw.data[len(pw.data)-1] |= bit << (7 - pw.bits%8)
+		pw.bits++
+	}
+}
+
+// PutInt appends a two's complement signed field.
+func (pw *PayloadWriter) PutInt(length uint, v int32) {
+	pw.PutUint(length, uint32(v))
+}
+
+// PutBool appends a single bit.
+func (pw *PayloadWriter) PutBool(b bool) {
+	if b {
+		pw.PutUint(1, 1)
+	} else {
+		pw.PutUint(1, 0)
+	}
+}
+
+// PutText appends text as chars six-bit characters, padded with '@'.
+// Lowercase letters are uppercased, and other characters that cannot be
+// encoded are replaced with '?'. Longer text is cut.
+func (pw *PayloadWriter) PutText(chars uint, text string) {
+	text = strings.ToUpper(text)
+	for i := uint(0); i < chars; i++ {
+		c := byte('@')
+		if i < uint(len(text)) {
+			c = text[i]
+		}
+		if c < 32 || c > 95 {
+			c = '?'
+		}
+		pw.PutUint(6, uint32(c&63))
+	}
+}
+
+// Armored returns the payload in its six-bit ASCII form,
+// and how many bits of the last character are padding.
+func (pw *PayloadWriter) Armored() (string, uint8) {
+	return ArmorPayload(pw.data, pw.bits)
+}
+
+// Bits returns the payload as PayloadBits, for reading it back.
+func (pw *PayloadWriter) Bits() PayloadBits {
+	return NewPayloadBits(pw.Armored())
+}
+
+// Sentences splits the payload into as many !AIVDM sentences as needed,
+// each ending with "\r\n".
+// smid is the sequential message ID of multi-sentence messages, and should be 0-9.
+// channel is 'A' or 'B'.
+// It returns "" if the payload needs more than nine sentences.
+func (pw *PayloadWriter) Sentences(channel byte, smid uint8) string {
+	armored, padding := pw.Armored()
+	smid %= 10
+	parts := SplitIntoSentences(armored, maxSentenceLength, smid)
+	if len(parts) == 1 {
+		smid = 10 // standalone sentences have no SMID
+	}
+	text := strings.Builder{}
+	for i, part := range parts {
+		pad := uint8(0)
+		if i == len(parts)-1 {
+			pad = padding
+		}
+		// cannot fail with the values used here
+		sentence, _ := EncodeSentence("AIVDM", uint8(len(parts)), uint8(i), smid, channel, part, pad)
+		text.WriteString(sentence)
+	}
+	return text.String()
+}
+
+// PositionReport is the content of a class A position report (type 1, 2 or 3).
+// NaN means not available for the float fields.
+type PositionReport struct {
+	Type     uint8 // 1, 2 or 3
+	MMSI     uint32
+	Status   uint8   // navigational status, 15 is not defined
+	Turn     int8    // rate of turn as encoded, -128 is not available
+	Speed    float32 // knots
+	Accuracy bool
+	Lat      float64
+	Long     float64
+	Course   float32 // degrees
+	Heading  uint16  // degrees, 511 is not available
+	Second   uint8   // of the UTC minute, 60 is not available
+}
+
+// tenths rounds v*10, or returns notAvailable if v is NaN.
+func tenths(v float32, notAvailable uint32) uint32 {
+	if math.IsNaN(float64(v)) {
+		return notAvailable
+	}
+	return uint32(math.Round(float64(v) * 10))
+}
+
+// EncodePositionReport packs a position report into a 168-bit payload.
+func EncodePositionReport(r PositionReport) *PayloadWriter {
+	pw := &PayloadWriter{}
+	pw.PutUint(6, uint32(r.Type))
+	pw.PutUint(2, 0) // repeat indicator
+	pw.PutUint(30, r.MMSI)
+	pw.PutUint(4, uint32(r.Status))
+	pw.PutInt(8, int32(r.Turn))
+	speed := tenths(r.Speed, 1023)
+	if speed > 1022 && !math.IsNaN(float64(r.Speed)) {
+		speed = 1022 // 102.2 knots or higher
+	}
+	pw.PutUint(10, speed)
+	pw.PutBool(r.Accuracy)
+	// in 1/10000 minutes, 181 and 91 degrees means not available
+	long, lat := int32(181*600000), int32(91*600000)
+	if !math.IsNaN(r.Long) && !math.IsNaN(r.Lat) {
+		long = int32(math.Round(r.Long * 600000))
+		lat = int32(math.Round(r.Lat * 600000))
+	}
+	pw.PutInt(28, long)
+	pw.PutInt(27, lat)
+	pw.PutUint(12, tenths(r.Course, 3600))
+	pw.PutUint(9, uint32(r.Heading))
+	pw.PutUint(6, uint32(r.Second))
+	pw.PutUint(2, 0)  // maneuver indicator
+	pw.PutUint(3, 0)  // spare
+	pw.PutBool(false) // RAIM
+	pw.PutUint(19, 0) // radio status
+	return pw
+}
+
+// StaticVoyageData is the content of a static and voyage related data message (type 5).
+type StaticVoyageData struct {
+	MMSI        uint32
+	IMO         uint32
+	Callsign    string // up to 7 characters
+	Name        string // up to 20 characters
+	ShipType    uint8
+	ToBow       uint16 // meters, up to 511
+	ToStern     uint16 // meters, up to 511
+	ToPort      uint8  // meters, up to 63
+	ToStarboard uint8  // meters, up to 63
+	ETAMonth    uint8  // 0 is not available
+	ETADay      uint8  // 0 is not available
+	ETAHour     uint8  // 24 is not available
+	ETAMinute   uint8  // 60 is not available
+	Draught     uint8  // in 1/10 meters
+	Destination string // up to 20 characters
+}
+
+// EncodeStaticVoyageData packs static and voyage data into a 424-bit payload,
+// which needs two sentences.
+func EncodeStaticVoyageData(d StaticVoyageData) *PayloadWriter {
+	pw := &PayloadWriter{}
+	pw.PutUint(6, 5)
+	pw.PutUint(2, 0) // repeat indicator
+	pw.PutUint(30, d.MMSI)
+	pw.PutUint(2, 0) // AIS version
+	pw.PutUint(30, d.IMO)
+	pw.PutText(7, d.Callsign)
+	pw.PutText(20, d.Name)
+	pw.PutUint(8, uint32(d.ShipType))
+	pw.PutUint(9, uint32(d.ToBow))
+	pw.PutUint(9, uint32(d.ToStern))
+	pw.PutUint(6, uint32(d.ToPort))
+	pw.PutUint(6, uint32(d.ToStarboard))
+	pw.PutUint(4, 1) // EPFD: GPS
+	pw.PutUint(4, uint32(d.ETAMonth))
+	pw.PutUint(5, uint32(d.ETADay))
+	pw.PutUint(5, uint32(d.ETAHour))
+	pw.PutUint(6, uint32(d.ETAMinute))
+	pw.PutUint(8, uint32(d.Draught))
+	pw.PutText(20, d.Destination)
+	pw.PutBool(false) // DTE: ready
+	pw.PutUint(1, 0)  // spare
+	return pw
+}
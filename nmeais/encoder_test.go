@@ -0,0 +1,239 @@
+package nmeais
+
+import (
+	"bytes"
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andmarios/aislib"
+)
+
+// assemble parses generated sentences and checks that they form one message.
+func assemble(t *testing.T, sentences string) *Message {
+	ma := NewMessageAssembler(5, time.Second, "test")
+	lines := strings.SplitAfter(sentences, "\n")
+	lines = lines[:len(lines)-1] // after the last "\r\n"
+	for i, line := range lines {
+		if len(line) > 82 {
+			t.Errorf("Sentence is longer than 82 characters: %q", line)
+		}
+		s, err := ParseSentence([]byte(line), time.Now())
+		if err == nil {
+			err = s.Validate(nil)
+		}
+		if err != nil {
+			t.Fatalf("Invalid sentence %q: %s", line, err.Error())
+		} else if s.Checksum != ChecksumPassed {
+			t.Fatalf("Wrong checksum in %q", line)
+		}
+		m, err := ma.Accept(s)
+		if err != nil {
+			t.Fatalf("%q: %s", line, err.Error())
+		} else if (m != nil) != (i == len(lines)-1) {
+			t.Fatalf("Expected %d sentences to form one message, got %v after %d", len(lines), m, i+1)
+		} else if m != nil {
+			return m
+		}
+	}
+	t.Fatal("No sentences")
+	return nil
+}
+
+func TestEncodePositionReport(t *testing.T) {
+	r := PositionReport{
+		Type:     1,
+		MMSI:     257000001,
+		Status:   7,
+		Turn:     -128,
+		Speed:    12.3,
+		Accuracy: true,
+		Lat:      -59.123456,
+		Long:     5.5,
+		Course:   271.4,
+		Heading:  270,
+		Second:   42,
+	}
+	m := assemble(t, EncodePositionReport(r).Sentences('A', 0))
+	if mmsi, ok := m.MMSI(); m.Type() != 1 || mmsi != r.MMSI || !ok {
+		t.Errorf("Expected a type 1 message from %d, got type %d from %d", r.MMSI, m.Type(), mmsi)
+	}
+	decoded, err := aislib.DecodeClassAPositionReport(m.ArmoredPayload())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Type != r.Type || decoded.MMSI != r.MMSI || decoded.Status != r.Status ||
+		decoded.Turn != float32(r.Turn) || decoded.Speed != r.Speed || decoded.Accuracy != r.Accuracy ||
+		decoded.Course != r.Course || decoded.Heading != r.Heading || decoded.Second != r.Second {
+		t.Errorf("Expected %+v, got %+v", r, decoded)
+	}
+	if math.Abs(decoded.Lat-r.Lat) > 1e-6 || math.Abs(decoded.Lon-r.Long) > 1e-6 {
+		t.Errorf("Expected position %f,%f, got %f,%f", r.Lat, r.Long, decoded.Lat, decoded.Lon)
+	}
+	if lat, long, ok := m.Position(); !ok || math.Abs(lat-r.Lat) > 1e-6 || math.Abs(long-r.Long) > 1e-6 {
+		t.Errorf("Expected position %f,%f, got %f,%f", r.Lat, r.Long, lat, long)
+	}
+
+	r = PositionReport{Type: 3, MMSI: 1, Turn: -128, Speed: float32(math.NaN()),
+		Lat: math.NaN(), Long: math.NaN(), Course: float32(math.NaN()), Heading: 511, Second: 60}
+	m = assemble(t, EncodePositionReport(r).Sentences('B', 0))
+	if _, _, ok := m.Position(); ok {
+		t.Error("Expected the position to not be available")
+	}
+	decoded, _ = aislib.DecodeClassAPositionReport(m.ArmoredPayload())
+	if decoded.Speed != 1023 || decoded.Course != 360 || decoded.Heading != 511 || decoded.Second != 60 {
+		t.Errorf("Expected values for not available, got %+v", decoded)
+	}
+}
+
+func TestEncodeStaticVoyageData(t *testing.T) {
+	d := StaticVoyageData{
+		MMSI:        257000002,
+		IMO:         9074729,
+		Callsign:    "LAXY7",
+		Name:        "Test vessel",
+		ShipType:    70,
+		ToBow:       100,
+		ToStern:     20,
+		ToPort:      5,
+		ToStarboard: 7,
+		ETAMonth:    12,
+		ETADay:      24,
+		ETAHour:     18,
+		ETAMinute:   30,
+		Draught:     54,
+		Destination: "STAVANGER",
+	}
+	pw := EncodeStaticVoyageData(d)
+	if pw.Len() != 424 {
+		t.Errorf("Expected 424 bits, got %d", pw.Len())
+	}
+	sentences := pw.Sentences('B', 3)
+	if !strings.HasPrefix(sentences, "!AIVDM,2,1,3,B,") {
+		t.Errorf("Unexpected first sentence in %q", sentences)
+	}
+	m := assemble(t, sentences)
+	decoded, err := aislib.DecodeStaticVoyageData(m.ArmoredPayload())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.MMSI != d.MMSI || decoded.IMO != d.IMO || decoded.ShipType != d.ShipType ||
+		decoded.ToBow != d.ToBow || decoded.ToStern != d.ToStern ||
+		decoded.ToPort != d.ToPort || decoded.ToStarboard != d.ToStarboard ||
+		decoded.Draught != d.Draught || decoded.ETA.Month() != time.December ||
+		decoded.ETA.Day() != 24 || decoded.ETA.Hour() != 18 || decoded.ETA.Minute() != 30 {
+		t.Errorf("Expected %+v, got %+v", d, decoded)
+	}
+	// aislib keeps the padding
+	if strings.TrimRight(decoded.Callsign, "@ ") != "LAXY7" ||
+		strings.TrimRight(decoded.VesselName, "@ ") != "TEST VESSEL" ||
+		strings.TrimRight(decoded.Destination, "@ ") != "STAVANGER" {
+		t.Errorf("Unexpected text fields %q, %q and %q", decoded.Callsign, decoded.VesselName, decoded.Destination)
+	}
+	if name := m.Bits().Text(112, 20); name != "TEST VESSEL" {
+		t.Errorf("Expected the name to be read back as TEST VESSEL, got %q", name)
+	}
+}
+
+func TestPutText(t *testing.T) {
+	pw := PayloadWriter{}
+	pw.PutText(6, "ab{~ longer")
+	if text := pw.Bits().Text(0, 6); text != "AB?? L" {
+		t.Errorf("Expected \"AB?? L\", got %q", text)
+	}
+	pw.PutInt(7, -3)
+	if v := pw.Bits().Int(36, 7); v != -3 {
+		t.Errorf("Expected -3, got %d", v)
+	}
+}
+
+func TestEncodeSentence(t *testing.T) {
+	sentence, err := EncodeSentence("AIVDM", 1, 0, 10, 'A', "13u?etPv2;0n:dDPwUM1U1Cb069D", 0)
+	if err != nil {
+		t.Fatal(err)
+	} else if sentence != "!AIVDM,1,1,,A,13u?etPv2;0n:dDPwUM1U1Cb069D,0*24\r\n" {
+		t.Errorf("Unexpected sentence %q", sentence)
+	}
+	s, err := ParseSentence([]byte(sentence), time.Now())
+	if err = s.Validate(err); err != nil {
+		t.Fatal(err)
+	} else if s.Checksum != ChecksumPassed {
+		t.Errorf("Expected the checksum to pass in %q", sentence)
+	}
+
+	sentence, err = EncodeSentence("BSVDO", 2, 1, 7, '*', "0000", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err = ParseSentence([]byte(sentence), time.Now())
+	if err = s.Validate(err); err != nil {
+		t.Fatalf("%q: %s", sentence, err.Error())
+	}
+	if s.Checksum != ChecksumPassed || s.Parts != 2 || s.PartIndex != 1 || s.SMID != 7 || s.Channel != '*' {
+		t.Errorf("Unexpected values %+v", s)
+	}
+
+	for _, invalid := range []func() (string, error){
+		func() (string, error) { return EncodeSentence("AIVD", 1, 0, 10, 'A', "0", 0) },
+		func() (string, error) { return EncodeSentence("AIVDM", 0, 0, 10, 'A', "0", 0) },
+		func() (string, error) { return EncodeSentence("AIVDM", 2, 2, 1, 'A', "0", 0) },
+		func() (string, error) { return EncodeSentence("AIVDM", 1, 0, 10, ',', "0", 0) },
+		func() (string, error) { return EncodeSentence("AIVDM", 1, 0, 10, 'A', "0,0", 0) },
+		func() (string, error) { return EncodeSentence("AIVDM", 1, 0, 10, 'A', "0", 6) },
+		func() (string, error) { return EncodeSentence("AIVDM", 1, 0, 10, 'A', strings.Repeat("0", 62), 0) },
+	} {
+		if sentence, err := invalid(); err == nil {
+			t.Errorf("Expected an error, got %q", sentence)
+		}
+	}
+}
+
+func TestArmorRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for n := 0; n < 200; n++ {
+		data := make([]byte, 1+rng.Intn(120))
+		rng.Read(data)
+		bits := uint(len(data))*8 - uint(rng.Intn(8))
+		armored, padding := ArmorPayload(data, bits)
+		if uint(len(armored))*6-uint(padding) != bits || padding > 5 {
+			t.Fatalf("%d bits became %d characters with %d padding", bits, len(armored), padding)
+		}
+		smid := uint8(n % 10)
+		parts := SplitIntoSentences(armored, 0, smid)
+		if len(parts) == 1 {
+			smid = 10
+		}
+		sentences := ""
+		for i, part := range parts {
+			pad := uint8(0)
+			if i == len(parts)-1 {
+				pad = padding
+			}
+			sentence, err := EncodeSentence("AIVDM", uint8(len(parts)), uint8(i), smid, 'B', part, pad)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sentences += sentence
+		}
+		m := assemble(t, sentences)
+		pb := m.Bits()
+		if pb.Len() != bits {
+			t.Fatalf("Expected %d bits, got %d", bits, pb.Len())
+		}
+		for i := uint(0); i < bits; i++ {
+			if pb.Bool(i) != ((data[i/8]>>(7-i%8))&1 == 1) {
+				t.Fatalf("Bit %d of %x differs after armoring as %s", i, data, armored)
+			}
+		}
+		// zero the unused bits of the last byte
+		data[len(data)-1] &= 0xff << (uint(len(data))*8 - bits)
+		if dearmored := m.DearmoredPayload(); !bytes.Equal(dearmored, data) {
+			t.Fatalf("Expected %x to be dearmored back, got %x", data, dearmored)
+		}
+	}
+	if parts := SplitIntoSentences(strings.Repeat("0", 9*60+1), 82, 0); parts != nil {
+		t.Errorf("Expected a payload needing ten sentences to be rejected, got %d", len(parts))
+	}
+}
@@ -0,0 +1,49 @@
+package nmeais
+
+import (
+	"fmt"
+
+	"github.com/tormol/AIS/geo"
+)
+
+// LongRange is a decoded long-range position report (type 27), which is
+// sent by class A transponders for reception by satellites.
+// It is shorter than other position reports, so the position and motion
+// are coarser.
+type LongRange struct {
+	MMSI      uint32
+	Accuracy  bool      // High accuracy (<10m)
+	RAIM      bool      // Receiver autonomous integrity monitoring is in use
+	NavStatus uint8     // Like class A position reports
+	Pos       geo.Point // in 1/10 minutes, 91 and 181 means not available
+	Speed     uint8     // knots, 63 means not available
+	Course    uint16    // degrees, 511 means not available
+	Delayed   bool      // The position is more than five seconds old
+}
+
+// LongRangeResolution is the resolution of long-range positions in meters,
+// which is 1/10 minute of latitude.
+const LongRangeResolution = 185.2
+
+// Minimum number of bits needed to decode a long-range position report.
+// It ends with a spare bit, which is allowed to be missing.
+const longRangeBits = 95 // of 96
+
+// DecodeLongRange decodes message type 27.
+func DecodeLongRange(pb PayloadBits) (LongRange, error) {
+	lr := LongRange{MMSI: pb.Uint(8, 30)}
+	if t := pb.Uint(0, 6); t != 27 {
+		return lr, fmt.Errorf("type %d is not a long-range position report", t)
+	} else if pb.Len() < longRangeBits {
+		return lr, fmt.Errorf("type 27 is too short (%d bits)", pb.Len())
+	}
+	lr.Accuracy = pb.Bool(38)
+	lr.RAIM = pb.Bool(39)
+	lr.NavStatus = uint8(pb.Uint(40, 4))
+	lr.Pos = decodeCorner(pb, 44, 62) // same format as regional commands
+	lr.Speed = uint8(pb.Uint(79, 6))
+	lr.Course = uint16(pb.Uint(85, 9))
+	// the flag is 0 for less than five seconds
+	lr.Delayed = pb.Bool(94)
+	return lr, nil
+}
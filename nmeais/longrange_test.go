@@ -0,0 +1,34 @@
+package nmeais
+
+import (
+	"math"
+	"testing"
+)
+
+func TestDecodeLongRange(t *testing.T) {
+	tp := (&testPayload{}).add(27, 6).add(0, 2).add(257012345, 30).add(0, 1).add(1, 1).add(5, 4)
+	tp.add(3012, 18).add(-21150, 17) // 5.02 E, 35.25 S in 1/10 minutes
+	tp.add(12, 6).add(274, 9).add(1, 1).add(0, 1)
+	lr, err := DecodeLongRange(tp.payloadBits())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lr.MMSI != 257012345 || lr.Accuracy || !lr.RAIM || lr.NavStatus != 5 || !lr.Delayed {
+		t.Errorf("Wrong identity or flags: %+v", lr)
+	}
+	if math.Abs(lr.Pos.Long-5.02) > 0.000001 || math.Abs(lr.Pos.Lat+35.25) > 0.000001 {
+		t.Errorf("Wrong position: %v", lr.Pos)
+	}
+	if lr.Speed != 12 || lr.Course != 274 {
+		t.Errorf("Wrong speed or course: %d %d", lr.Speed, lr.Course)
+	}
+
+	tp.bits = tp.bits[:95] // without the spare bit
+	if _, err = DecodeLongRange(tp.payloadBits()); err != nil {
+		t.Errorf("Expected the spare bit to be optional, got %s", err.Error())
+	}
+	tp.bits = tp.bits[:90]
+	if _, err = DecodeLongRange(tp.payloadBits()); err == nil {
+		t.Error("Expected a truncated report to not be decoded")
+	}
+}
@@ -0,0 +1,94 @@
+package nmeais
+
+import (
+	"fmt"
+
+	"github.com/tormol/AIS/geo"
+)
+
+// RegionalCommand is a decoded channel management (type 22) or
+// group assignment (type 23) message.
+// Base stations send these to change how transponders within a region
+// (or two specific transponders) behave, for example how often they report.
+// Fields that don't exist in the message type are left zero.
+type RegionalCommand struct {
+	Type         uint8
+	Station      uint32    // MMSI of the base station that sent it
+	Addressed    bool      // Type 22 can be sent to two stations instead of a region
+	Destinations [2]uint32 // The addressed stations, only set if Addressed
+	NE           geo.Point // North-east corner of the region, only set if !Addressed
+	SW           geo.Point // South-west corner of the region, only set if !Addressed
+	TxRxMode     uint8     // Which channels to transmit and receive on
+
+	// Channel management (type 22)
+	ChannelA uint16 // Frequency channel numbers
+	ChannelB uint16
+	LowPower bool // 1W instead of 12.5W
+	NarrowA  bool // 12.5 kHz bandwidth on channel A instead of 25 kHz
+	NarrowB  bool
+	ZoneSize uint8 // Size of the transitional zone in nautical miles minus one
+
+	// Group assignment (type 23)
+	StationType    uint8 // Which kind of stations are affected (0 = all)
+	ShipType       uint8 // Which ship types are affected (0 = all)
+	ReportInterval uint8 // Code for the assigned reporting interval
+	QuietTime      uint8 // Minutes to be silent (0 = none)
+}
+
+// Minimum number of bits needed to decode the message types.
+// Both end with spare bits, which are allowed to be missing.
+const (
+	channelManagementBits = 145 // of 168
+	groupAssignmentBits   = 154 // of 160
+)
+
+// decodeCorner converts coordinates in 1/10 minutes to degrees.
+func decodeCorner(pb PayloadBits, lonAt, latAt uint) geo.Point {
+	return geo.Point{
+		Long: float64(pb.Int(lonAt, 18)) / 600.0,
+		Lat:  float64(pb.Int(latAt, 17)) / 600.0,
+	}
+}
+
+// DecodeRegionalCommand decodes message type 22 or 23.
+func DecodeRegionalCommand(pb PayloadBits) (RegionalCommand, error) {
+	rc := RegionalCommand{
+		Type:    uint8(pb.Uint(0, 6)),
+		Station: pb.Uint(8, 30),
+	}
+	switch rc.Type {
+	case 22:
+		if pb.Len() < channelManagementBits {
+			return rc, fmt.Errorf("type 22 is too short (%d bits)", pb.Len())
+		}
+		rc.ChannelA = uint16(pb.Uint(40, 12))
+		rc.ChannelB = uint16(pb.Uint(52, 12))
+		rc.TxRxMode = uint8(pb.Uint(64, 4))
+		rc.LowPower = pb.Bool(68)
+		rc.Addressed = pb.Bool(139)
+		if rc.Addressed {
+			rc.Destinations[0] = pb.Uint(69, 30)
+			rc.Destinations[1] = pb.Uint(104, 30)
+		} else {
+			rc.NE = decodeCorner(pb, 69, 87)
+			rc.SW = decodeCorner(pb, 104, 122)
+		}
+		rc.NarrowA = pb.Bool(140)
+		rc.NarrowB = pb.Bool(141)
+		rc.ZoneSize = uint8(pb.Uint(142, 3))
+	case 23:
+		if pb.Len() < groupAssignmentBits {
+			return rc, fmt.Errorf("type 23 is too short (%d bits)", pb.Len())
+		}
+		rc.NE = decodeCorner(pb, 40, 58)
+		rc.SW = decodeCorner(pb, 75, 93)
+		rc.StationType = uint8(pb.Uint(110, 4))
+		rc.ShipType = uint8(pb.Uint(114, 8))
+		rc.TxRxMode = uint8(pb.Uint(144, 2))
+		rc.ReportInterval = uint8(pb.Uint(146, 4))
+		rc.QuietTime = uint8(pb.Uint(150, 4))
+	default:
+		return rc, fmt.Errorf("type %d is not a regional command", rc.Type)
+	}
+	return rc, nil
+}
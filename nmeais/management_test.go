@@ -0,0 +1,177 @@
+package nmeais
+
+import (
+	"testing"
+
+	"github.com/tormol/AIS/geo"
+)
+
+// testPayload builds armored payloads bit by bit.
+type testPayload struct {
+	bits []bool
+}
+
+func (tp *testPayload) add(v int64, length uint) *testPayload {
+	for i := int(length) - 1; i >= 0; i-- {
+		tp.bits = append(tp.bits, (v>>uint(i))&1 != 0)
+	}
+	return tp
+}
+
+// armor returns the six-bit ASCII encoding and the number of padding bits.
+func (tp *testPayload) armor() (string, uint8) {
+	padding := uint8((6 - len(tp.bits)%6) % 6)
+	bits := append(append([]bool{}, tp.bits...), make([]bool, padding)...)
+	armored := make([]byte, 0, len(bits)/6)
+	for i := 0; i < len(bits); i += 6 {
+		v := byte(0)
+		for _, b := range bits[i : i+6] {
+			v <<= 1
+			if b {
+				v |= 1
+			}
+		}
+		if v < 40 {
+			armored = append(armored, v+48)
+		} else {
+			armored = append(armored, v+56)
+		}
+	}
+	return string(armored), padding
+}
+
+func (tp *testPayload) payloadBits() PayloadBits {
+	armored, padding := tp.armor()
+	return NewPayloadBits(armored, padding)
+}
+
+func TestPayloadBits(t *testing.T) {
+	tp := &testPayload{}
+	tp.add(22, 6).add(-5, 7).add(0x2aaaa, 18).add(1, 1)
+	pb := tp.payloadBits()
+	if pb.Len() != 32 {
+		t.Errorf("Expected 32 bits, got %d", pb.Len())
+	}
+	if v := pb.Uint(0, 6); v != 22 {
+		t.Errorf("Expected type 22, got %d", v)
+	}
+	if v := pb.Int(6, 7); v != -5 {
+		t.Errorf("Expected -5, got %d", v)
+	}
+	if v := pb.Uint(6, 7); v != 0x7b {
+		t.Errorf("Expected unsigned -5 to be 0x7b, got 0x%x", v)
+	}
+	if v := pb.Uint(13, 18); v != 0x2aaaa {
+		t.Errorf("Expected 0x2aaaa, got 0x%x", v)
+	}
+	if !pb.Bool(31) {
+		t.Error("Expected the last bit to be set")
+	}
+	if v := pb.Uint(30, 10); v != 1<<8 {
+		t.Errorf("Expected bits past the end to be zero, got 0x%x", v)
+	}
+}
+
+// in 1/10 minutes
+func tenthMinutes(degrees float64) int64 {
+	if degrees < 0 {
+		return int64(degrees*600 - 0.5)
+	}
+	return int64(degrees*600 + 0.5)
+}
+
+func checkCorner(t *testing.T, which string, got geo.Point, lat, long float64) {
+	const e = 1.0 / 600 / 2
+	if got.Lat < lat-e || got.Lat > lat+e || got.Long < long-e || got.Long > long+e {
+		t.Errorf("Expected %s corner to be %f,%f, got %f,%f", which, lat, long, got.Lat, got.Long)
+	}
+}
+
+func TestDecodeChannelManagement(t *testing.T) {
+	tp := &testPayload{}
+	tp.add(22, 6).add(0, 2).add(2573000, 30).add(0, 2)
+	tp.add(2087, 12).add(2088, 12).add(1, 4).add(1, 1)
+	tp.add(tenthMinutes(6.25), 18).add(tenthMinutes(59.5), 17)   // NE
+	tp.add(tenthMinutes(-5.125), 18).add(tenthMinutes(-0.1), 17) // SW
+	tp.add(0, 1).add(1, 1).add(0, 1).add(4, 3).add(0, 23)
+	if len(tp.bits) != 168 {
+		t.Fatalf("Built %d bits instead of 168", len(tp.bits))
+	}
+	rc, err := DecodeRegionalCommand(tp.payloadBits())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rc.Type != 22 || rc.Station != 2573000 || rc.Addressed {
+		t.Errorf("Wrong header: %d %d %t", rc.Type, rc.Station, rc.Addressed)
+	}
+	if rc.ChannelA != 2087 || rc.ChannelB != 2088 || rc.TxRxMode != 1 || !rc.LowPower {
+		t.Errorf("Wrong parameters: %d %d %d %t", rc.ChannelA, rc.ChannelB, rc.TxRxMode, rc.LowPower)
+	}
+	if !rc.NarrowA || rc.NarrowB || rc.ZoneSize != 4 {
+		t.Errorf("Wrong bandwidth or zone size: %t %t %d", rc.NarrowA, rc.NarrowB, rc.ZoneSize)
+	}
+	checkCorner(t, "north-east", rc.NE, 59.5, 6.25)
+	checkCorner(t, "south-west", rc.SW, -0.1, -5.125)
+}
+
+func TestDecodeAddressedChannelManagement(t *testing.T) {
+	tp := &testPayload{}
+	tp.add(22, 6).add(0, 2).add(2573000, 30).add(0, 2)
+	tp.add(2087, 12).add(2088, 12).add(0, 4).add(0, 1)
+	tp.add(257000001, 30).add(0, 5).add(257000002, 30).add(0, 5)
+	tp.add(1, 1).add(0, 1).add(0, 1).add(4, 3).add(0, 23)
+	rc, err := DecodeRegionalCommand(tp.payloadBits())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rc.Addressed || rc.Destinations != [2]uint32{257000001, 257000002} {
+		t.Errorf("Wrong destinations: %t %v", rc.Addressed, rc.Destinations)
+	}
+	if rc.NE != (geo.Point{}) || rc.SW != (geo.Point{}) {
+		t.Errorf("Addressed message should not have a region: %v %v", rc.NE, rc.SW)
+	}
+}
+
+func TestDecodeGroupAssignment(t *testing.T) {
+	tp := &testPayload{}
+	tp.add(23, 6).add(0, 2).add(2573000, 30).add(0, 2)
+	tp.add(tenthMinutes(-179.9), 18).add(tenthMinutes(-33.8), 17) // NE
+	tp.add(tenthMinutes(179.9), 18).add(tenthMinutes(-34.0), 17)  // SW
+	tp.add(6, 4).add(30, 8).add(0, 22)
+	tp.add(2, 2).add(9, 4).add(15, 4).add(0, 6)
+	if len(tp.bits) != 160 {
+		t.Fatalf("Built %d bits instead of 160", len(tp.bits))
+	}
+	rc, err := DecodeRegionalCommand(tp.payloadBits())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rc.Type != 23 || rc.Station != 2573000 {
+		t.Errorf("Wrong header: %d %d", rc.Type, rc.Station)
+	}
+	if rc.StationType != 6 || rc.ShipType != 30 || rc.TxRxMode != 2 ||
+		rc.ReportInterval != 9 || rc.QuietTime != 15 {
+		t.Errorf("Wrong parameters: %d %d %d %d %d",
+			rc.StationType, rc.ShipType, rc.TxRxMode, rc.ReportInterval, rc.QuietTime)
+	}
+	checkCorner(t, "north-east", rc.NE, -33.8, -179.9)
+	checkCorner(t, "south-west", rc.SW, -34.0, 179.9)
+}
+
+func TestDecodeRegionalCommandErrors(t *testing.T) {
+	short := &testPayload{}
+	short.add(22, 6).add(0, 130)
+	if _, err := DecodeRegionalCommand(short.payloadBits()); err == nil {
+		t.Error("Expected truncated type 22 to fail")
+	}
+	short = &testPayload{}
+	short.add(23, 6).add(0, 140)
+	if _, err := DecodeRegionalCommand(short.payloadBits()); err == nil {
+		t.Error("Expected truncated type 23 to fail")
+	}
+	other := &testPayload{}
+	other.add(1, 6).add(0, 162)
+	if _, err := DecodeRegionalCommand(other.payloadBits()); err == nil {
+		t.Error("Expected type 1 to fail")
+	}
+}
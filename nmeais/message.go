@@ -19,57 +19,104 @@ func (m *Message) Sentences() []Sentence {
 	return m.sentences[:m.sentences[0].Parts]
 }
 
+// IsOwnShip returns true if the message is from the receiving station itself (VDO).
+// Only the first sentence is checked, as the parts are expected to agree.
+func (m *Message) IsOwnShip() bool {
+	return m.sentences[0].IsOwnShip()
+}
+
+// MaxType is the highest defined message type.
+const MaxType = 27
+
 // Type de-armors only the first byte of the payload.
 // This is kinda too high level for this package, but avoids de-armoring the
 // whole payload for message types that won't be decoded further.
+// Returns 0 (which isn't a defined type) if the payload is empty.
 func (m *Message) Type() uint8 {
 	payload, _ := m.sentences[0].Payload()
+	if len(payload) == 0 {
+		return 0
+	}
 	return deArmorByte(payload[0])
 }
 
+// KnownType returns Type() if it's a defined message type (1 to MaxType),
+// and 0 otherwise, so that it can be used as an index into [MaxType+1] arrays.
+func (m *Message) KnownType() uint8 {
+	t := m.Type()
+	if t > MaxType {
+		return 0
+	}
+	return t
+}
+
+// validArmor returns true if c is one of the 64 characters used in payloads.
+func validArmor(c byte) bool {
+	return (c >= '0' && c <= 'W') || (c >= '`' && c <= 'w')
+}
+
+// deArmorByte returns the six-bit value of a payload character.
+// Invalid characters are not detected, check them with validArmor() where it matters.
 func deArmorByte(b byte) uint8 {
 	v := uint8(b) - 48
 	if v > 40 {
 		v -= 8
 	}
-	// TODO validation ?
 	return v & 0x3f // 0b0011_1111
 }
 
-// DearmoredPayload undoes the siz-bit ASCII encoding of the payload.
-// This function is completely untested.
-func (m *Message) DearmoredPayload() []byte {
-	first, _ := m.sentences[0].Payload()
-	data := make([]byte, 0, len(first)*8/6)
-	bitbuf := uint32(0)
-	bits := uint(0)
-	for i := range m.sentences {
-		payload, _pad := m.sentences[i].Payload()
-		for _, b := range []byte(payload) {
-			bitbuf = (bitbuf << 6) | uint32(deArmorByte(b))
-			bits += 6
-			if bits >= 24 { // leave one byte in case it's the last and there is padding
-				bits -= 8
-				data = append(data, uint8(bitbuf>>bits))
-				bits -= 8
-				data = append(data, uint8(bitbuf>>bits))
-			}
+// mmsiChars is the number of payload characters needed to get the MMSI at bit 8-37.
+const mmsiChars = (8 + 30 + 5) / 6
+
+// MMSI returns the source MMSI, which every message type has at bit 8-37.
+// ok is false if the payload is too short or the characters are not valid six-bit ASCII.
+// It's cheap enough to call for every message: Only the first seven
+// characters are de-armored, and the payloads of multi-sentence messages
+// are not joined unless the first one is too short.
+func (m *Message) MMSI() (mmsi uint32, ok bool) {
+	payload, padding := m.sentences[0].Payload()
+	if len(m.sentences) != 1 {
+		padding = 0 // only the last sentence has padding
+		if len(payload) < mmsiChars {
+			payload = m.ArmoredPayload()
+			_, padding = m.sentences[len(m.sentences)-1].Payload()
 		}
-		// TODO validated pad and handle 6
-		// if pad > 6 {// FIXME report error and discard message
-		// 	return fmt.Errorf("padding is not a digit but %c", byte(s.Padding)+byte('0'))
-		// }
-		pad := 5 - uint(_pad) // I REALLY doubt this is correct, but esr says so..
-		bits -= pad
-		bitbuf >>= pad
-	}
-	for bits >= 8 {
-		bits -= 8
-		data = append(data, uint8(bitbuf>>bits))
+	}
+	if padding > 5 {
+		padding = 0 // 6 is sometimes seen, but makes no sense
+	}
+	if len(payload) < mmsiChars || (len(payload) == mmsiChars && 6*mmsiChars-int(padding) < 8+30) {
+		return 0, false
+	}
+	bits := uint64(0)
+	for i := 0; i < mmsiChars; i++ {
+		if !validArmor(payload[i]) {
+			return 0, false
+		}
+		bits = bits<<6 | uint64(deArmorByte(payload[i]))
+	}
+	return uint32(bits>>(6*mmsiChars-8-30)) & (1<<30 - 1), true
+}
+
+// DearmoredPayload undoes the six-bit ASCII encoding of the payload.
+// Only the padding of the last sentence is respected, like by Bits(),
+// and if the number of bits is not a multiple of eight the last byte is
+// filled with zero bits.
+func (m *Message) DearmoredPayload() []byte {
+	pb := m.Bits()
+	data := make([]byte, (pb.Len()+7)/8)
+	for i := range data {
+		data[i] = uint8(pb.Uint(uint(i)*8, 8))
 	}
 	return data
 }
 
+// Received returns when the first sentence of the message was received,
+// which is the closest to when it was sent.
+func (m *Message) Received() time.Time {
+	return m.started
+}
+
 // ArmoredPayload joins together the payload part of the sentences the message was parsed from.
 func (m *Message) ArmoredPayload() string {
 	if len(m.sentences) == 1 {
@@ -147,6 +194,7 @@ func (ma *MessageAssembler) reset(smid uint8) {
 		ma.incomplete[smid].sentences[i].Text = ""
 	}
 	ma.incomplete[smid].have = 0
+	ma.incomplete[smid].parts = 0
 	ma.incomplete[smid].missing = 0
 }
 
@@ -211,17 +259,51 @@ func (ma *MessageAssembler) Accept(s Sentence) (*Message, error) {
 		ma.incomplete[s.SMID].have |= 1 << s.PartIndex
 		ma.incomplete[s.SMID].missing--
 		if ma.incomplete[s.SMID].missing == 0 {
-			return &Message{
+			m := &Message{
 				sentences:  append([]Sentence{}, ma.incomplete[s.SMID].sentences[:s.Parts]...),
 				SourceName: ma.SourceName,
 				started:    ma.incomplete[s.SMID].started,
 				ended:      s.Received,
-			}, nil
+			}
+			// Don't let the next message with this SMID be compared against this one.
+			ma.reset(s.SMID)
+			return m, nil
 		}
 		return nil, nil
 	}
 }
 
+// AbandonedMessage describes an incomplete message that was dropped by Expire().
+type AbandonedMessage struct {
+	SMID     uint8
+	Parts    uint8         // the number of sentences in the message
+	Received uint8         // the number of sentences that were received
+	Age      time.Duration // since the first received sentence
+}
+
+// Expire drops incomplete messages where the first sentence was received
+// MaxMessageTimespan or more before now, and returns what was dropped.
+// Without this, incomplete messages are only dropped when their SMID is reused.
+func (ma *MessageAssembler) Expire(now time.Time) []AbandonedMessage {
+	var abandoned []AbandonedMessage
+	for smid := range ma.incomplete {
+		im := &ma.incomplete[smid]
+		if im.missing == 0 {
+			continue
+		}
+		if age := now.Sub(im.started); age >= ma.MaxMessageTimespan {
+			abandoned = append(abandoned, AbandonedMessage{
+				SMID:     uint8(smid),
+				Parts:    im.parts,
+				Received: im.parts - im.missing,
+				Age:      age,
+			})
+			ma.reset(uint8(smid))
+		}
+	}
+	return abandoned
+}
+
 // Invalidate message if one that failed the checksum has the same SMID and part,
 // and the part index haven't already been received.
 func (ma *MessageAssembler) abortSMID(s Sentence) bool {
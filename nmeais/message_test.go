@@ -0,0 +1,222 @@
+package nmeais
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/andmarios/aislib"
+)
+
+func testSentence(t *testing.T, parts, part, smid int, payload string, received time.Time) Sentence {
+	text := fmt.Sprintf("!AIVDM,%d,%d,%d,A,%s,0\r\n", parts, part, smid, payload)
+	s, err := ParseSentence([]byte(text), received)
+	if err != nil {
+		t.Fatalf("%s: %s", text, err.Error())
+	}
+	return s
+}
+
+// Accept a sentence and expect it to complete a message with the given payload,
+// or to not complete anything if payload is empty.
+func acceptTest(t *testing.T, ma *MessageAssembler, s Sentence, payload string) {
+	m, err := ma.Accept(s)
+	if err != nil {
+		t.Fatalf("%s: unexpected error: %s", s.Text, err.Error())
+	} else if payload == "" && m != nil {
+		t.Fatalf("%s: completed a message too early: %s", s.Text, m.ArmoredPayload())
+	} else if payload != "" && m == nil {
+		t.Fatalf("%s: didn't complete a message", s.Text)
+	} else if m != nil && m.ArmoredPayload() != payload {
+		t.Fatalf("%s: expected payload %s, got %s", s.Text, payload, m.ArmoredPayload())
+	}
+}
+
+func TestSMIDReuseAfterCompletion(t *testing.T) {
+	ma := NewMessageAssembler(7, time.Minute, "test")
+	now := time.Now()
+	acceptTest(t, &ma, testSentence(t, 2, 1, 3, "5aaa", now), "")
+	acceptTest(t, &ma, testSentence(t, 2, 2, 3, "bbb", now), "5aaabbb")
+	if ma.incomplete[3].parts != 0 || ma.incomplete[3].have != 0 || ma.incomplete[3].sentences[0].Text != "" {
+		t.Error("Expected the slot to be cleared after completion")
+	}
+	// a new message with the same SMID within the same second, out of order
+	acceptTest(t, &ma, testSentence(t, 3, 2, 3, "ddd", now), "")
+	acceptTest(t, &ma, testSentence(t, 3, 1, 3, "5ccc", now), "")
+	acceptTest(t, &ma, testSentence(t, 3, 3, 3, "eee", now), "5cccdddeee")
+}
+
+func TestSMIDReuseWithSameParts(t *testing.T) {
+	ma := NewMessageAssembler(7, time.Minute, "test")
+	now := time.Now()
+	acceptTest(t, &ma, testSentence(t, 2, 2, 0, "bbb", now), "")
+	acceptTest(t, &ma, testSentence(t, 2, 1, 0, "5aaa", now), "5aaabbb")
+	// same number of parts and the last part first again
+	acceptTest(t, &ma, testSentence(t, 2, 2, 0, "ddd", now), "")
+	acceptTest(t, &ma, testSentence(t, 2, 1, 0, "5ccc", now), "5cccddd")
+}
+
+func TestExpire(t *testing.T) {
+	ma := NewMessageAssembler(7, time.Minute, "test")
+	start := time.Date(2017, 12, 31, 12, 0, 0, 0, time.UTC)
+	acceptTest(t, &ma, testSentence(t, 2, 1, 3, "5aaa", start), "")
+	acceptTest(t, &ma, testSentence(t, 3, 2, 4, "bbb", start.Add(time.Second)), "")
+	acceptTest(t, &ma, testSentence(t, 3, 1, 4, "5ccc", start.Add(2*time.Second)), "")
+	if abandoned := ma.Expire(start.Add(time.Minute - time.Nanosecond)); len(abandoned) != 0 {
+		t.Errorf("Expected nothing to expire before the limit, got %v", abandoned)
+	}
+	abandoned := ma.Expire(start.Add(time.Minute))
+	expected := AbandonedMessage{SMID: 3, Parts: 2, Received: 1, Age: time.Minute}
+	if len(abandoned) != 1 || abandoned[0] != expected {
+		t.Errorf("Expected %v to be abandoned, got %v", expected, abandoned)
+	}
+	if ma.incomplete[3].missing != 0 || ma.incomplete[3].sentences[0].Text != "" {
+		t.Error("Expected the slot to be cleared")
+	}
+	// the second part would have completed it
+	acceptTest(t, &ma, testSentence(t, 2, 2, 3, "ddd", start.Add(time.Minute)), "")
+
+	// just under the limit
+	acceptTest(t, &ma, testSentence(t, 3, 3, 4, "eee", start.Add(time.Minute)), "5cccbbbeee")
+	abandoned = ma.Expire(start.Add(2 * time.Minute))
+	if len(abandoned) != 1 || abandoned[0].SMID != 3 || abandoned[0].Received != 1 {
+		t.Errorf("Expected only the second part with SMID 3 to be abandoned, got %v", abandoned)
+	}
+}
+
+func TestEmptyPayload(t *testing.T) {
+	s, err := ParseSentence([]byte("!ABVDM,1,1,,,,0\r\n"), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ma := NewMessageAssembler(1, time.Minute, "test")
+	m, _ := ma.Accept(s)
+	if m == nil {
+		t.Fatal("Expected the sentence to complete a message")
+	}
+	if m.Type() != 0 || m.KnownType() != 0 {
+		t.Errorf("Expected type 0, got %d and %d", m.Type(), m.KnownType())
+	}
+	if mmsi, ok := m.MMSI(); m.ArmoredPayload() != "" || len(m.DearmoredPayload()) != 0 || ok {
+		t.Errorf("Expected an empty payload, got %q %v %d", m.ArmoredPayload(), m.DearmoredPayload(), mmsi)
+	}
+	if _, _, ok := m.Position(); ok {
+		t.Error("Expected no position")
+	}
+
+	m, _ = ma.Accept(testSentence(t, 1, 1, 0, "t", time.Now())) // 60
+	if m.Type() != 60 || m.KnownType() != 0 {
+		t.Errorf("Expected type 60 to be unknown, got %d and %d", m.Type(), m.KnownType())
+	}
+}
+
+func TestMessagePosition(t *testing.T) {
+	ma := NewMessageAssembler(1, time.Minute, "test")
+	s := testSentence(t, 1, 1, 0, "14S:Eb001ePRmHBTAAFnrmV60PRk", time.Now())
+	m, _ := ma.Accept(s)
+	if mmsi, ok := m.MMSI(); mmsi != 305305000 || !ok {
+		t.Errorf("Expected MMSI 305305000, got %d", mmsi)
+	}
+	lat, long, ok := m.Position()
+	if !ok || math.Abs(lat-63.386178) > 0.000001 || math.Abs(long-7.609615) > 0.000001 {
+		t.Errorf("Expected position 63.386178,7.609615, got %f,%f (%t)", lat, long, ok)
+	}
+
+	s = testSentence(t, 1, 1, 0, "403OviQuMGCqWrRO9>E6fE700@GO", time.Now()) // base station report
+	m, _ = ma.Accept(s)
+	if _, _, ok := m.Position(); ok {
+		t.Error("Expected no position for message type 4")
+	}
+	s = testSentence(t, 1, 1, 0, "14S:Eb", time.Now())
+	m, _ = ma.Accept(s)
+	if _, _, ok := m.Position(); ok {
+		t.Error("Expected no position for a truncated message")
+	}
+}
+
+// messageFrom assembles sentences given without "\r\n".
+func messageFrom(t testing.TB, sentences ...string) *Message {
+	ma := NewMessageAssembler(1, time.Minute, "test")
+	for i, text := range sentences {
+		s, err := ParseSentence([]byte(text+"\r\n"), time.Now())
+		if err != nil {
+			t.Fatalf("%s: %s", text, err.Error())
+		}
+		m, err := ma.Accept(s)
+		if err != nil {
+			t.Fatalf("%s: %s", text, err.Error())
+		} else if (m != nil) != (i == len(sentences)-1) {
+			t.Fatalf("%s: expected the last sentence to complete the message", text)
+		} else if m != nil {
+			return m
+		}
+	}
+	return nil
+}
+
+func TestMessageMMSI(t *testing.T) {
+	// from sentence_test.go
+	for _, test := range []struct {
+		sentences []string
+		mmsi      uint32
+	}{
+		{[]string{"!BSVDM,1,1,,A,14S:Eb001ePRmHBTAAFnrmV60PRk,0*1F"}, 305305000},
+		{[]string{"!BSVDM,1,1,,A,13nMoF00000H56fQwFDLFD<800Rg,0*71"}, 258439000},
+		{[]string{"!BSVDM,1,1,,B,144atH00000Lf9nSffVf49TP00S9,0*1D"}, 273316960},
+		{[]string{"!AIVDM,2,1,1,A,55?MbV02;H;s<HtKR20EHE:0@T4@Dn2222222216L961O5Gf0NSQEp6ClRp8,0*1C",
+			"!AIVDM,2,2,1,A,88888888880,2*25"}, 351759000},
+		// first sentence too short to contain the MMSI
+		{[]string{"!AIVDM,2,1,2,A,55?Mb,0", "!AIVDM,2,2,2,A,V02;H;s<HtKR20,0"}, 351759000},
+	} {
+		m := messageFrom(t, test.sentences...)
+		if mmsi, ok := m.MMSI(); mmsi != test.mmsi || !ok {
+			t.Errorf("%s: expected %d, got %d, %t", test.sentences[0], test.mmsi, mmsi, ok)
+		}
+	}
+
+	for _, invalid := range []string{
+		"!AIVDM,1,1,,A,14S:Eb,0",  // 36 bits
+		"!AIVDM,1,1,,A,14S:Eb0,5", // 37 bits
+		"!AIVDM,1,1,,A,14S:Eb ,0", // not six-bit ASCII
+		"!AIVDM,1,1,,A,14S:Xb001,0",
+		"!AIVDM,1,1,,A,14S:Eb\x7f01,0",
+	} {
+		m := messageFrom(t, invalid)
+		if mmsi, ok := m.MMSI(); ok {
+			t.Errorf("%q: expected no MMSI, got %d", invalid, mmsi)
+		}
+	}
+	if mmsi, ok := messageFrom(t, "!AIVDM,1,1,,A,14S:Eb0,4").MMSI(); !ok || mmsi != 305305000 {
+		t.Errorf("Expected exactly 38 bits to be enough, got %d, %t", mmsi, ok)
+	}
+}
+
+func BenchmarkMMSI(b *testing.B) {
+	m := messageFrom(b, "!BSVDM,1,1,,A,14S:Eb001ePRmHBTAAFnrmV60PRk,0*1F")
+	for i := 0; i < b.N; i++ {
+		if mmsi, _ := m.MMSI(); mmsi != 305305000 {
+			b.Fatal(mmsi)
+		}
+	}
+}
+
+func BenchmarkMMSIWithAislib(b *testing.B) {
+	m := messageFrom(b, "!BSVDM,1,1,,A,14S:Eb001ePRmHBTAAFnrmV60PRk,0*1F")
+	for i := 0; i < b.N; i++ {
+		if r, _ := aislib.DecodeClassAPositionReport(m.ArmoredPayload()); r.MMSI != 305305000 {
+			b.Fatal(r.MMSI)
+		}
+	}
+}
+
+func TestIsOwnShip(t *testing.T) {
+	vdm := messageFrom(t, "!AIVDM,1,1,,A,14S:Eb001ePRmHBTAAFnrmV60PRk,0*06")
+	vdo := messageFrom(t, "!AIVDO,1,1,,A,14S:Eb001ePRmHBTAAFnrmV60PRk,0*04")
+	if vdm.IsOwnShip() || vdm.Sentences()[0].IsOwnShip() {
+		t.Error("Expected VDM to not be from own ship")
+	}
+	if !vdo.IsOwnShip() || !vdo.Sentences()[0].IsOwnShip() {
+		t.Error("Expected VDO to be from own ship")
+	}
+}
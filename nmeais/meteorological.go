@@ -0,0 +1,113 @@
+package nmeais
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/tormol/AIS/geo"
+)
+
+// Binary broadcasts (type 8) carry an application-specific payload,
+// identified by a designated area code (DAC) and a function identifier (FI).
+// DAC 1 is international, and is defined by the IMO.
+const (
+	DACInternational    = 1
+	FIMeteorological    = 31 // IMO circular 289, replaces FI 11 from circular 236
+	binaryBroadcastBits = 56 // header, DAC and FI
+)
+
+// BinaryApplication returns the DAC and FI of a binary broadcast (type 8).
+func BinaryApplication(pb PayloadBits) (dac uint16, fi uint8, err error) {
+	if t := pb.Uint(0, 6); t != 8 {
+		return 0, 0, fmt.Errorf("type %d is not a binary broadcast", t)
+	} else if pb.Len() < binaryBroadcastBits {
+		return 0, 0, fmt.Errorf("type 8 is too short (%d bits)", pb.Len())
+	}
+	return uint16(pb.Uint(40, 10)), uint8(pb.Uint(50, 6)), nil
+}
+
+// Meteorological is a decoded meteorological and hydrological data report
+// (type 8 with DAC 1 and FI 31), which coast stations broadcast for weather
+// stations and buoys.
+// Values that are not available are NaN.
+type Meteorological struct {
+	Station  uint32    // MMSI of the transmitting station, which can report for several positions
+	Pos      geo.Point // 91 and 181 means not available
+	Accuracy bool      // High accuracy (<10m)
+	Day      uint8     // UTC day of month when measured, 0 means not available
+	Hour     uint8     // 24 means not available
+	Minute   uint8     // 60 means not available
+
+	WindSpeed        float32 // 10-minute average in knots, 126 means 126 or more
+	GustSpeed        float32 // knots
+	WindDirection    float32 // degrees
+	GustDirection    float32
+	AirTemperature   float32 // degrees Celsius
+	Humidity         float32 // relative, percent
+	DewPoint         float32 // degrees Celsius
+	AirPressure      float32 // hPa, 799 means 799 or less and 1201 means 1201 or more
+	Visibility       float32 // nautical miles
+	VisibilityOver   bool    // visibility is greater than Visibility
+	WaterLevel       float32 // meters above chart datum, including tide
+	WaveHeight       float32 // significant wave height in meters
+	WavePeriod       float32 // seconds
+	WaveDirection    float32 // degrees
+	WaterTemperature float32 // degrees Celsius
+}
+
+// Minimum number of bits needed to decode a meteorological report.
+// It ends with spare bits, which are allowed to be missing.
+const meteorologicalBits = 350 // of 360
+
+// available returns v*scale+offset, or NaN if v is notAvailable or above.
+func available(v uint32, notAvailable uint32, scale, offset float32) float32 {
+	if v >= notAvailable {
+		return float32(math.NaN())
+	}
+	return float32(v)*scale + offset
+}
+
+// availableSigned is available() for signed fields,
+// where only notAvailable itself is invalid.
+func availableSigned(v int32, notAvailable int32, scale float32) float32 {
+	if v == notAvailable {
+		return float32(math.NaN())
+	}
+	return float32(v) * scale
+}
+
+// DecodeMeteorological decodes a type 8 message with DAC 1 and FI 31.
+// Other binary applications return an error.
+func DecodeMeteorological(pb PayloadBits) (Meteorological, error) {
+	met := Meteorological{Station: pb.Uint(8, 30)}
+	if dac, fi, err := BinaryApplication(pb); err != nil {
+		return met, err
+	} else if dac != DACInternational || fi != FIMeteorological {
+		return met, fmt.Errorf("DAC %d FI %d is not meteorological data", dac, fi)
+	} else if pb.Len() < meteorologicalBits {
+		return met, fmt.Errorf("meteorological data is too short (%d bits)", pb.Len())
+	}
+	// in 1/1000 minutes
+	met.Pos.Long = float64(pb.Int(56, 25)) / 60000
+	met.Pos.Lat = float64(pb.Int(81, 24)) / 60000
+	met.Accuracy = pb.Bool(105)
+	met.Day = uint8(pb.Uint(106, 5))
+	met.Hour = uint8(pb.Uint(111, 5))
+	met.Minute = uint8(pb.Uint(116, 6))
+	met.WindSpeed = available(pb.Uint(122, 7), 127, 1, 0)
+	met.GustSpeed = available(pb.Uint(129, 7), 127, 1, 0)
+	met.WindDirection = available(pb.Uint(136, 9), 360, 1, 0)
+	met.GustDirection = available(pb.Uint(145, 9), 360, 1, 0)
+	met.AirTemperature = availableSigned(pb.Int(154, 11), -1024, 0.1)
+	met.Humidity = available(pb.Uint(165, 7), 101, 1, 0)
+	met.DewPoint = availableSigned(pb.Int(172, 10), 501, 0.1)
+	met.AirPressure = available(pb.Uint(182, 9), 403, 1, 799)
+	met.VisibilityOver = pb.Bool(193)
+	met.Visibility = available(pb.Uint(194, 7), 127, 0.1, 0)
+	met.WaterLevel = available(pb.Uint(201, 12), 4001, 0.01, -10)
+	met.WaveHeight = available(pb.Uint(276, 8), 251, 0.1, 0)
+	met.WavePeriod = available(pb.Uint(284, 6), 61, 1, 0)
+	met.WaveDirection = available(pb.Uint(290, 9), 360, 1, 0)
+	met.WaterTemperature = availableSigned(pb.Int(326, 10), 501, 0.1)
+	return met, nil
+}
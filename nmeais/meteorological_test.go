@@ -0,0 +1,80 @@
+package nmeais
+
+import (
+	"math"
+	"testing"
+)
+
+// meteorologicalPayload creates a type 8 message with DAC 1 and FI 31 from
+// a weather station near Bergen, where current, swell, precipitation,
+// salinity and ice are not available.
+func meteorologicalPayload(fi int64) *testPayload {
+	tp := &testPayload{}
+	tp.add(8, 6).add(0, 2).add(2579999, 30).add(0, 2).add(1, 10).add(fi, 6)
+	tp.add(319002, 25).add(3624000, 24).add(1, 1)        // 5.3167 E 60.4 N, high accuracy
+	tp.add(14, 5).add(10, 5).add(20, 6)                  // 14th 10:20
+	tp.add(12, 7).add(18, 7).add(225, 9).add(360, 9)     // wind, gust, wind direction, gust direction not available
+	tp.add(-35, 11).add(101, 7).add(-62, 10).add(214, 9) // -3.5°C, humidity not available, dew point -6.2°C, 1013 hPa
+	tp.add(0, 2).add(1, 1).add(85, 7)                    // pressure steady, visibility more than 8.5 NM
+	tp.add(1150, 12).add(3, 2)                           // water level 1.5 m, trend not available
+	// surface current and two current layers
+	for i := 0; i < 3; i++ {
+		tp.add(251, 8).add(360, 9)
+		if i != 0 {
+			tp.add(31, 5)
+		}
+	}
+	tp.add(23, 8).add(61, 6).add(360, 9)  // wave height 2.3 m, period and direction not available
+	tp.add(251, 8).add(61, 6).add(360, 9) // swell
+	tp.add(13, 4).add(81, 10).add(7, 3)   // sea state, water 8.1°C, precipitation
+	tp.add(510, 9).add(3, 2).add(0, 10)   // salinity, ice and spare
+	return tp
+}
+
+func TestDecodeMeteorological(t *testing.T) {
+	tp := meteorologicalPayload(FIMeteorological)
+	if len(tp.bits) != 360 {
+		t.Fatalf("Test payload has %d bits, not 360", len(tp.bits))
+	}
+	dac, fi, err := BinaryApplication(tp.payloadBits())
+	if dac != 1 || fi != 31 || err != nil {
+		t.Errorf("Expected DAC 1 and FI 31, got %d, %d and %v", dac, fi, err)
+	}
+	met, err := DecodeMeteorological(tp.payloadBits())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if met.Station != 2579999 || math.Abs(met.Pos.Lat-60.4) > 0.000001 ||
+		math.Abs(met.Pos.Long-5.3167) > 0.000001 || !met.Accuracy {
+		t.Errorf("Wrong station or position: %d %v", met.Station, met.Pos)
+	}
+	if met.Day != 14 || met.Hour != 10 || met.Minute != 20 {
+		t.Errorf("Wrong time: %d %d:%d", met.Day, met.Hour, met.Minute)
+	}
+	near := func(v, expected float32) bool {
+		return math.Abs(float64(v-expected)) < 0.0001
+	}
+	if !near(met.WindSpeed, 12) || !near(met.GustSpeed, 18) || !near(met.WindDirection, 225) ||
+		!math.IsNaN(float64(met.GustDirection)) {
+		t.Errorf("Wrong wind: %+v", met)
+	}
+	if !near(met.AirTemperature, -3.5) || !math.IsNaN(float64(met.Humidity)) ||
+		!near(met.DewPoint, -6.2) || !near(met.AirPressure, 1013) {
+		t.Errorf("Wrong temperature, humidity or pressure: %+v", met)
+	}
+	if !near(met.Visibility, 8.5) || !met.VisibilityOver || !near(met.WaterLevel, 1.5) {
+		t.Errorf("Wrong visibility or water level: %+v", met)
+	}
+	if !near(met.WaveHeight, 2.3) || !math.IsNaN(float64(met.WavePeriod)) ||
+		!math.IsNaN(float64(met.WaveDirection)) || !near(met.WaterTemperature, 8.1) {
+		t.Errorf("Wrong waves or water temperature: %+v", met)
+	}
+
+	if _, err := DecodeMeteorological(meteorologicalPayload(11).payloadBits()); err == nil {
+		t.Error("Expected FI 11 to not be decoded")
+	}
+	tp.bits = tp.bits[:300]
+	if _, err := DecodeMeteorological(tp.payloadBits()); err == nil {
+		t.Error("Expected a truncated report to not be decoded")
+	}
+}
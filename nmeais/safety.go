@@ -0,0 +1,49 @@
+package nmeais
+
+import (
+	"fmt"
+)
+
+// SafetyMessage is a decoded addressed (type 12) or broadcast (type 14)
+// safety-related message, which is free text such as a navigational warning.
+type SafetyMessage struct {
+	Type          uint8
+	Source        uint32 // MMSI of the sender
+	Destination   uint32 // MMSI of the addressed station, only for type 12
+	Sequence      uint8  // Sequence number of addressed messages, 0-3
+	Retransmitted bool   // Addressed message that has been retransmitted
+	Text          string
+}
+
+// Offset of the text in the message types.
+// The text can be up to 156 (type 12) or 161 (type 14) characters,
+// and is allowed to be empty.
+const (
+	addressedSafetyText = 72
+	broadcastSafetyText = 40
+)
+
+// DecodeSafetyMessage decodes message type 12 or 14.
+func DecodeSafetyMessage(pb PayloadBits) (SafetyMessage, error) {
+	sm := SafetyMessage{
+		Type:   uint8(pb.Uint(0, 6)),
+		Source: pb.Uint(8, 30),
+	}
+	var textAt uint
+	switch sm.Type {
+	case 12:
+		textAt = addressedSafetyText
+		sm.Sequence = uint8(pb.Uint(38, 2))
+		sm.Destination = pb.Uint(40, 30)
+		sm.Retransmitted = pb.Bool(70)
+	case 14:
+		textAt = broadcastSafetyText
+	default:
+		return sm, fmt.Errorf("type %d is not a safety-related message", sm.Type)
+	}
+	if pb.Len() < textAt {
+		return sm, fmt.Errorf("type %d is too short (%d bits)", sm.Type, pb.Len())
+	}
+	sm.Text = pb.Text(textAt, (pb.Len()-textAt)/6)
+	return sm, nil
+}
@@ -0,0 +1,58 @@
+package nmeais
+
+import (
+	"testing"
+)
+
+// addText adds six-bit characters, which must be between ' ' and '_'.
+func (tp *testPayload) addText(text string) *testPayload {
+	for _, c := range []byte(text) {
+		tp.add(int64(c&63), 6)
+	}
+	return tp
+}
+
+func TestSixBitCharacterSet(t *testing.T) {
+	tp := &testPayload{}
+	for v := int64(0); v < 64; v++ {
+		tp.add(v, 6)
+	}
+	expected := "@ABCDEFGHIJKLMNOPQRSTUVWXYZ[\\]^_ !\"#$%&'()*+,-./0123456789:;<=>?"
+	if text := tp.payloadBits().Text(0, 64); text != expected {
+		t.Errorf("Expected %q, got %q", expected, text)
+	}
+	// trailing @ and spaces are padding
+	tp = (&testPayload{}).addText("@ 1@2 @ @@")
+	if text := tp.payloadBits().Text(0, 10); text != "@ 1@2" {
+		t.Errorf("Expected only the trailing padding to be removed, got %q", text)
+	}
+}
+
+func TestDecodeSafetyMessage(t *testing.T) {
+	tp := (&testPayload{}).add(12, 6).add(0, 2).add(257012345, 30).add(2, 2).add(2579999, 30).add(1, 1).add(0, 1)
+	tp.addText("SECURITE: BUOY #3 OFF POSITION, 59-30N 005-12E.@@@")
+	sm, err := DecodeSafetyMessage(tp.payloadBits())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sm.Type != 12 || sm.Source != 257012345 || sm.Destination != 2579999 || sm.Sequence != 2 || !sm.Retransmitted {
+		t.Errorf("Wrong header: %+v", sm)
+	}
+	if sm.Text != "SECURITE: BUOY #3 OFF POSITION, 59-30N 005-12E." {
+		t.Errorf("Wrong text: %q", sm.Text)
+	}
+
+	tp = (&testPayload{}).add(14, 6).add(0, 2).add(2570001, 30).add(0, 2).addText("TEST")
+	tp.add(0, 2) // not a whole character
+	if sm, err = DecodeSafetyMessage(tp.payloadBits()); err != nil || sm.Source != 2570001 || sm.Text != "TEST" {
+		t.Errorf("Expected TEST from 2570001, got %+v and %v", sm, err)
+	}
+	tp = (&testPayload{}).add(14, 6).add(0, 2).add(2570001, 30).add(0, 2)
+	if sm, err = DecodeSafetyMessage(tp.payloadBits()); err != nil || sm.Text != "" {
+		t.Errorf("Expected an empty text, got %+v and %v", sm, err)
+	}
+	tp = (&testPayload{}).add(12, 6).add(0, 2).add(257012345, 30).add(0, 2).add(2579, 12)
+	if _, err = DecodeSafetyMessage(tp.payloadBits()); err == nil {
+		t.Error("Expected a type 12 without destination to be too short")
+	}
+}
@@ -5,6 +5,8 @@ package nmeais
 import (
 	"bytes"
 	"fmt" // Only Errorf()
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -34,11 +36,7 @@ func checkChecksum(between []byte, hex1, hex2 byte) ChecksumResult {
 	second := hexDigit(hex2)
 	// if the first is >= 8 there is an odd number of non-ASCII characters
 	if first < 8 && second < 16 {
-		sum := (first << 4) | second
-		for _, b := range between {
-			sum ^= b
-		}
-		if sum == 0 {
+		if (first<<4)|second == checksum(between) {
 			return ChecksumPassed
 		}
 	}
@@ -60,8 +58,11 @@ type Sentence struct {
 	Checksum     ChecksumResult
 	payloadStart uint16 // .Text[.payloadStart:.payloadEnd]
 	payloadEnd   uint16
+	tagEnd       uint16 // .Text[.tagEnd] is the '!', zero if there is no TAG block
 	Received     time.Time
-	Text         string // everything plus "\r\n"
+	TagTime      time.Time // from the c: field of a TAG block, zero if absent
+	TagSource    string    // from the s: field of a TAG block
+	Text         string    // everything including any TAG block plus "\r\n"
 }
 
 // Payload returns a view of the ASCII-armored payload
@@ -70,13 +71,24 @@ func (s Sentence) Payload() (string, uint8) {
 	return s.Text[s.payloadStart:s.payloadEnd], s.padding
 }
 
+// IsOwnShip returns true if the identifier ends in O, as in !AIVDO,
+// which means the sentence was sent by the receiving station itself
+// and not received from another one.
+func (s Sentence) IsOwnShip() bool {
+	return s.Identifier[4] == 'O'
+}
+
 // ParseSentence extracts the fields out of an assumed NMEA0183 AIS-containing sentence.
 // It does the minimum possible validation for the sentence to be useful:
 // All fields (except Received) might contain invalid values, call .Validate() to check them.
 // The checksum is evaluated if present, but not even a checksum mismatch is an error;
 // the result is stored in .Checksum.
 // For speed, ParseSentence assumes the correct width of fixed-width fields.
+// The sentence can be prefixed by an IEC 61162-1 TAG block, see parseTagged().
 func ParseSentence(b []byte, received time.Time) (Sentence, error) {
+	if len(b) != 0 && b[0] == '\\' {
+		return parseTagged(b, received)
+	}
 	if len(b) < 17 /* len("!AIVDM,1,1,,,0,2\r\n") */ {
 		return Sentence{}, fmt.Errorf("too short (%d bytes)", len(b))
 	}
@@ -142,6 +154,49 @@ func ParseSentence(b []byte, received time.Time) (Sentence, error) {
 	}
 }
 
+// parseTagged parses a sentence prefixed by a TAG block such as
+// `\s:2573145,c:1492683034*0A\`, which is kept as part of .Text.
+// The source (s:) and the UNIX timestamp (c:) are extracted if the block's
+// checksum is absent or correct, other fields such as grouping (g:) are ignored.
+// A timestamp in milliseconds is also accepted.
+func parseTagged(b []byte, received time.Time) (Sentence, error) {
+	end := bytes.IndexByte(b[1:], '\\') + 1
+	if end == 0 {
+		return Sentence{}, fmt.Errorf("unterminated TAG block")
+	} else if end >= 1<<16 {
+		return Sentence{}, fmt.Errorf("TAG block is too long")
+	}
+	s, err := ParseSentence(b[end+1:], received)
+	if err != nil {
+		return s, err
+	}
+	s.Text = string(b)
+	s.tagEnd = uint16(end + 1)
+	s.payloadStart += s.tagEnd
+	s.payloadEnd += s.tagEnd
+
+	tag := b[1:end]
+	if star := bytes.IndexByte(tag, '*'); star != -1 {
+		if star+3 != len(tag) || checkChecksum(tag[:star], tag[star+1], tag[star+2]) != ChecksumPassed {
+			return s, nil // ignore the TAG block
+		}
+		tag = tag[:star]
+	}
+	for _, field := range strings.Split(string(tag), ",") {
+		if strings.HasPrefix(field, "s:") {
+			s.TagSource = field[2:]
+		} else if strings.HasPrefix(field, "c:") {
+			unix, err := strconv.ParseInt(field[2:], 10, 64)
+			if err == nil && unix > 1e11 { // milliseconds
+				s.TagTime = time.Unix(unix/1000, (unix%1000)*int64(time.Millisecond))
+			} else if err == nil && unix > 0 {
+				s.TagTime = time.Unix(unix, 0)
+			}
+		}
+	}
+	return s, nil
+}
+
 // Validate performs many checks that ParseSentence doesn't.
 func (s Sentence) Validate(parserErr error) error {
 	identifiers := [...]string{
@@ -151,6 +206,7 @@ func (s Sentence) Validate(parserErr error) error {
 	if parserErr != nil {
 		return parserErr
 	}
+	s.Text = s.Text[s.tagEnd:] // only the TAG block is variable-width before the payload
 	valid := false
 	for _, id := range identifiers {
 		if string(s.Identifier[:4]) == id {
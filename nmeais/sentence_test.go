@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"log"
 	"testing"
+	"time"
 
 	l "github.com/tormol/AIS/logger"
 )
@@ -202,6 +203,79 @@ var testSentences = []struct {
 		Checksum:     ChecksumPassed,
 	}},
 	{"!AIVDM,1,1,,2,456789012345678901234567890,", "error in padding or checksum (-2 characters after payload)", "", Sentence{}},
+	// TAG blocks as sent by Kystverket and kplex
+	{"\\s:2573145,c:1492683034*0B\\!BSVDM,1,1,,A,14S:Eb001ePRmHBTAAFnrmV60PRk,0*1F\r\n", "", "", Sentence{
+		Identifier:   [5]byte{'B', 'S', 'V', 'D', 'M'},
+		Parts:        1,
+		PartIndex:    0,
+		HasSMID:      false,
+		SMID:         10,
+		Channel:      'A',
+		payloadStart: 27 + 14,
+		payloadEnd:   27 + 42,
+		tagEnd:       27,
+		padding:      0,
+		Checksum:     ChecksumPassed,
+		TagSource:    "2573145",
+		TagTime:      time.Unix(1492683034, 0),
+	}},
+	{"\\s:2573250,c:1492683034123*3C\\!BSVDM,1,1,,A,14S:Eb001ePRmHBTAAFnrmV60PRk,0*1F\r\n", "", "", Sentence{
+		Identifier:   [5]byte{'B', 'S', 'V', 'D', 'M'},
+		Parts:        1,
+		PartIndex:    0,
+		HasSMID:      false,
+		SMID:         10,
+		Channel:      'A',
+		payloadStart: 30 + 14,
+		payloadEnd:   30 + 42,
+		tagEnd:       30,
+		padding:      0,
+		Checksum:     ChecksumPassed,
+		TagSource:    "2573250",
+		TagTime:      time.Unix(1492683034, 123000000), // milliseconds
+	}},
+	{"\\s:2573145,c:1492683034*0C\\!BSVDM,1,1,,A,14S:Eb001ePRmHBTAAFnrmV60PRk,0*1F\r\n", "", "", Sentence{
+		Identifier:   [5]byte{'B', 'S', 'V', 'D', 'M'},
+		Parts:        1,
+		PartIndex:    0,
+		HasSMID:      false,
+		SMID:         10,
+		Channel:      'A',
+		payloadStart: 27 + 14,
+		payloadEnd:   27 + 42,
+		tagEnd:       27,
+		padding:      0,
+		Checksum:     ChecksumPassed, // but the TAG block's failed, so it's ignored
+	}},
+	{"\\g:1-2-3456,s:2573145,c:1492683034*7D\\!AIVDM,2,1,1,A,55?MbV02;H;s<HtKR20EHE:0@T4@Dn2222222216L961O5Gf0NSQEp6ClRp8,0*1C\r\n", "", "", Sentence{
+		Identifier:   [5]byte{'A', 'I', 'V', 'D', 'M'},
+		Parts:        2,
+		PartIndex:    0,
+		HasSMID:      true,
+		SMID:         1,
+		Channel:      'A',
+		payloadStart: 38 + 15,
+		payloadEnd:   38 + 75,
+		tagEnd:       38,
+		padding:      0,
+		Checksum:     ChecksumPassed,
+		TagSource:    "2573145",
+		TagTime:      time.Unix(1492683034, 0),
+	}},
+	{"\\g:2-2-3456*59\\!AIVDM,2,2,1,A,88888888880,2*25\r\n", "", "", Sentence{
+		Identifier:   [5]byte{'A', 'I', 'V', 'D', 'M'},
+		Parts:        2,
+		PartIndex:    1,
+		HasSMID:      true,
+		SMID:         1,
+		Channel:      'A',
+		payloadStart: 15 + 15,
+		payloadEnd:   15 + 26,
+		tagEnd:       15,
+		padding:      2,
+		Checksum:     ChecksumPassed,
+	}},
+	{"\\s:2573145!BSVDM,1,1,,A,14S:Eb001ePRmHBTAAFnrmV60PRk,0*1F\r\n", "unterminated TAG block", "", Sentence{}},
 	{"!12345,2,2,8,0,567890123456789longest7valid3sentence23456789012345678901234,0*77\r\n", "", "unrecognized identifier: 12345", Sentence{
 		Identifier:   [5]byte{'1', '2', '3', '4', '5'},
 		Parts:        2,
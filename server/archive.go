@@ -1,180 +1,831 @@
 package main
 
 import (
+	"encoding/csv"
 	"errors"
+	"fmt"
+	"io"
 	"math"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	ais "github.com/andmarios/aislib"
+	"github.com/tormol/AIS/forwarder"
 	"github.com/tormol/AIS/geo"
+	l "github.com/tormol/AIS/logger"
 	"github.com/tormol/AIS/nmeais"
 	"github.com/tormol/AIS/storage"
 )
 
-//The Archive stores the information about the ships (and works as a temp. solution for the RTree concurrency)
+//The Archive stores the information about the ships
 type Archive struct {
-	rt *storage.RTree //Stores the points
-	rw *sync.RWMutex  //works as a lock for the RTree (#TODO: RTree should be improved to handle concurrency on its own)
+	changes    uint64                     //Incremented after every update of a ship, used as ETag. First for alignment of atomic operations.
+	stored     [nmeais.MaxType + 1]uint64 //Number of messages of each type that were stored, also atomic
+	skipped    SkippedMessages            //Also atomic
+	notIndexed uint64                     //Position reports that were stored but couldn't be indexed, also atomic
+	lastSaved  int64                      //UnixNano of when Save last got a message, also atomic
+
+	rt storage.Index //Stores the points, can be searched while it's being updated. Only replaced before Save is started
 
 	db *storage.ShipDB //Contains tracklog and other info for each ship
+
+	maxShips             int          //Evict the least recently updated ships when there are more than this, 0 means no limit
+	allowImplausibleMMSI bool         //Store ships with MMSIs that don't match any kind of station, see storage.Mmsi.Plausible()
+	evictLock            sync.RWMutex //Held for writing while evicting, and for reading while saving a message or searching rt (and for terse and clustered results, looking up the ships in db)
+
+	commands *storage.RegionalCommandLog //Recent type 22 and 23 messages, for diagnostics
+	weather  *storage.MetDB              //Latest meteorological report from each position
+	safety   *storage.SafetyMessageLog   //Recent type 12 and 14 messages, replaced by main for -safety-messages
+
+	subsLock    sync.Mutex
+	subscribers map[*subscription]struct{} //Clients streaming updates for an area
+
+	decoded chan<- forwarder.Packet //Stored messages as JSON lines, nil if not wanted
+
+	fences geofences //Areas to create events for ships entering or leaving
+
+	skew *ClockSkew //Corrects the time of positions from late sources if not nil, set by main for -correct-skew
+}
+
+// A client that wants to know about updates to ships within an area.
+type subscription struct {
+	rects   []geo.Rectangle
+	updates chan []byte
 }
 
-// NewArchive returns a pointer to a new Archive
-func NewArchive(historyMax uint, goneThreshold, leftAreaThreshold time.Duration) *Archive {
+// covers checks whether a point is within any of the rectangles.
+func (s *subscription) covers(p geo.Point) bool {
+	for i := range s.rects {
+		if s.rects[i].ContainsPoint(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// How many regional commands (message type 22 and 23) to remember for each
+// base station, and how many stations to remember them from.
+const (
+	commandsPerStation = 5
+	maxCommandStations = 200
+)
+
+// How many positions to keep meteorological reports from.
+const maxWeatherPositions = 2000
+
+// defaultSafetyMessages is how many safety-related messages are kept by default.
+const defaultSafetyMessages = 100
+
+// recentShips is how recently a ship must have sent a position to be counted
+// as recent by Stats().
+const recentShips = 10 * time.Minute
+
+// How many updates can be waiting to be sent to a streaming client before
+// new ones are dropped.
+const subscriberBuffer = 100
+
+// NewArchive returns a pointer to a new Archive.
+// See storage.NewShipDB for the parameters.
+func NewArchive(historyMax uint, historySpan time.Duration,
+	minDistance float64, minInterval time.Duration,
+	goneThreshold, leftAreaThreshold time.Duration, statusChanges uint) *Archive {
 	return &Archive{
 		rt: storage.NewRTree(),
-		rw: &sync.RWMutex{},
-		db: storage.NewShipDB(historyMax, goneThreshold, leftAreaThreshold),
+		db: storage.NewShipDB(historyMax, historySpan, minDistance, minInterval,
+			goneThreshold, leftAreaThreshold, statusChanges),
+
+		commands: storage.NewRegionalCommandLog(commandsPerStation, maxCommandStations),
+		weather:  storage.NewMetDB(maxWeatherPositions),
+		safety:   storage.NewSafetyMessageLog(defaultSafetyMessages),
+
+		subscribers: make(map[*subscription]struct{}),
+	}
+}
+
+// ForwardDecoded makes Save send every stored position and static report
+// as a line of JSON to to, see decoded.go.
+// Sending blocks, so to should be read by a forwarder.Manager.
+// Must be called before Save, and to is never closed by the archive.
+func (a *Archive) ForwardDecoded(to chan<- forwarder.Packet) {
+	a.decoded = to
+}
+
+// decodeSpeed undoes aislib leaving the values that mean not available
+// and 102.2 knots or more in tenths of knots, so that storage.SanitizePos() can recognize them.
+func decodeSpeed(speed float32) float32 {
+	if speed >= 1022 {
+		return speed / 10
 	}
+	return speed
 }
 
-func decodeHeading(heading uint16) float32 {
-	if heading != 511 {
-		return float32(heading)
+// decodeRateOfTurn converts the raw rate of turn field of class A position
+// reports to degrees per minute.
+// aislib's Turn is not used because it is already converted except for
+// the special values, which makes them ambiguous.
+// -128 means not available, and ±127 means more than 5° per 30 seconds
+// without a turn indicator, which can't be converted to a rate and is also not available.
+func decodeRateOfTurn(rot int8) float32 {
+	if rot <= -127 || rot >= 127 {
+		return float32(math.NaN())
+	}
+	r := float32(rot) / 4.733
+	if rot < 0 {
+		return -r * r
 	}
-	return float32(math.NaN())
+	return r * r
 }
 
-func decodeCourseOverGround(cog float32) float32 {
-	if cog < 360 { // I assume 360 means unknown
-		return cog
+// decodeETA reads the ETA fields of a type 5 message directly, because
+// aislib parses them into a time without year.
+func decodeETA(m *nmeais.Message, received time.Time) time.Time {
+	bits := m.Bits()
+	return storage.ETAFromFields(uint8(bits.Uint(274, 4)), uint8(bits.Uint(278, 5)),
+		uint8(bits.Uint(283, 5)), uint8(bits.Uint(288, 6)), received)
+}
+
+// maxClockSkew is how far into the future a fix time from fixTime() can be
+// before it's assumed to be from the previous minute.
+const maxClockSkew = 5 * time.Second
+
+// fixTime combines the UTC second of a position report with the minute it
+// was received in, to get a better estimate of when the position was measured.
+// The second field is 60-63 when the time is not available, and then the
+// receive time is returned.
+// A second after the receive time means the fix happened in the previous minute,
+// unless it's less than maxClockSkew after, which is assumed to be clocks
+// that are slightly off, and then the receive time is used.
+func fixTime(second uint8, received time.Time) time.Time {
+	if second >= 60 {
+		return received
 	}
-	return float32(math.NaN())
+	fix := received.Truncate(time.Minute).Add(time.Duration(second) * time.Second)
+	if fix.Sub(received) > maxClockSkew {
+		return fix.Add(-time.Minute)
+	} else if fix.After(received) {
+		return received
+	}
+	return fix
 }
 
-func decodeRateOfTurn(rot float32) float32 {
-	if rot >= -127 && rot <= 127 {
-		// doesn't handle the edge cases of ±127 meaning " or more"
-		return (rot / 4.733) * float32(math.Abs(float64(rot)/4.733))
+// reportTime combines the UTC day, hour and minute of a meteorological report
+// with the month it was received in.
+// If any of them are not available the receive time is returned.
+// A time after the receive time means the report is from the previous month,
+// unless it's less than maxClockSkew after.
+func reportTime(day, hour, minute uint8, received time.Time) time.Time {
+	if day == 0 || day > 31 || hour >= 24 || minute >= 60 {
+		return received
+	}
+	received = received.UTC()
+	at := time.Date(received.Year(), received.Month(), int(day), int(hour), int(minute), 0, 0, time.UTC)
+	if at.Sub(received) > maxClockSkew {
+		at = time.Date(received.Year(), received.Month()-1, int(day), int(hour), int(minute), 0, 0, time.UTC)
+	} else if at.After(received) {
+		return received
 	}
-	return float32(math.NaN())
+	return at
 }
 
+// Minimum number of payload bits for the fields that are used.
+// aislib decodes missing bits as zero, so shorter payloads would be stored
+// with zero values.
+const (
+	minClassABits        = 143 // up to and including the UTC second
+	minClassBBits        = 139 // up to and including the UTC second
+	minStaticVoyageBits  = 302 // up to and including draught, the destination can be truncated
+	minStaticReportABits = 40  // up to and including the part number, the name can be truncated
+	minStaticReportBBits = 162 // up to and including the dimensions
+	minAtoNBits          = 271 // up to and including the assigned mode flag
+)
+
+// Why a message was not stored, also used for tracing.
+const (
+	skippedUndecodable    = "undecodable"
+	skippedBadMMSI        = "bad MMSI"
+	skippedImplausible    = "implausible MMSI"
+	skippedBadCoordinates = "bad coordinates"
+	skippedNoPosition     = "position not available"
+	skippedType           = "ignored type"
+	skippedApplication    = "unknown binary application"
+	skippedRepeated       = "repeated safety message"
+	skippedOutdated       = "older or coarser than the current position"
+)
+
 // Save stores the information in the relevant Ais message
 // types recieved form the channel
+// Several can run at the same time as long as the messages about a ship
+// always go to the same one, see SaveRouter.
 func (a *Archive) Save(msg chan *nmeais.Message) {
 	for m := range msg {
-		var err error
-		ps := (*ais.PositionReport)(nil)
-		switch m.Type() {
-		case 1, 2, 3: // class A position report (longest)
-			cApr, e := ais.DecodeClassAPositionReport(m.ArmoredPayload())
-			ps = &cApr.PositionReport
-			if e != nil {
-				continue
+		atomic.StoreInt64(&a.lastSaved, time.Now().UnixNano())
+		// evicting must not happen between looking up the old position of
+		// a ship and moving it in the R-tree
+		a.evictLock.RLock()
+		decision, err := a.save(m)
+		a.evictLock.RUnlock()
+		switch decision {
+		case skippedUndecodable:
+			atomic.AddUint64(&a.skipped.Undecodable, 1)
+		case skippedBadMMSI:
+			atomic.AddUint64(&a.skipped.BadMMSI, 1)
+		case skippedImplausible:
+			atomic.AddUint64(&a.skipped.ImplausibleMMSI, 1)
+		case skippedBadCoordinates:
+			atomic.AddUint64(&a.skipped.BadCoordinates, 1)
+		case skippedNoPosition:
+			atomic.AddUint64(&a.skipped.NoPosition, 1)
+		case skippedApplication:
+			atomic.AddUint64(&a.skipped.UnknownApplication, 1)
+		case skippedType, skippedRepeated, skippedOutdated: // jitter is counted by db
+		default:
+			atomic.AddUint64(&a.stored[m.KnownType()], 1)
+			if decision == "position not indexed" {
+				atomic.AddUint64(&a.notIndexed, 1)
 			}
-			err = a.updatePos(ps)
-			pos := storage.ShipPos{
-				time.Now(),
-				geo.Point{ps.Lat, ps.Lon},
-				storage.Accuracy(ps.Accuracy),
-				storage.ShipNavStatus(cApr.Status),
-				decodeHeading(ps.Heading),
-				decodeCourseOverGround(ps.Course),
-				ps.Speed,
-				decodeRateOfTurn(cApr.Turn)}
-			a.db.UpdateDynamic(ps.MMSI, pos)
-		case 5: // static voyage data
-			svd, e := ais.DecodeStaticVoyageData(m.ArmoredPayload())
-			if e != nil && svd.MMSI <= 0 {
-				continue
+			if m.IsOwnShip() {
+				a.markOwnShip(m)
 			}
-			length := uint16(svd.ToBow + svd.ToStern)
-			lOffset := int16(length/2 - svd.ToBow)
-			width := uint16(svd.ToPort + svd.ToStarboard)
-			wOffset := int16(width/2 - uint16(svd.ToStarboard))
-			a.db.UpdateStatic(svd.MMSI, storage.ShipInfo{storage.ShipType(svd.ShipType), svd.Draught, length, width, lOffset, wOffset, svd.Callsign, svd.VesselName, svd.Destination, svd.ETA})
-		case 18: // basic class B position report (shorter)
-			cBpr, e := ais.DecodeClassBPositionReport(m.ArmoredPayload())
-			ps = &cBpr.PositionReport
-			if e != nil {
-				continue
+			if a.maxShips > 0 {
+				a.evict()
 			}
-			err = a.updatePos(ps)
-			pos := storage.ShipPos{
-				time.Now(),
-				geo.Point{ps.Lat, ps.Lon},
-				storage.Accuracy(ps.Accuracy),
-				storage.ShipNavStatus(15),
-				decodeHeading(ps.Heading),
-				decodeCourseOverGround(ps.Course),
-				ps.Speed,
-				float32(math.NaN()) /*rate of turn*/}
-			a.db.UpdateDynamic(ps.MMSI, pos)
-		case 24: // static data report
-			sdr, e := ais.DecodeStaticDataReport(m.ArmoredPayload())
-			if e != nil && sdr.MMSI <= 0 {
-				continue
+		}
+		switch decision {
+		case skippedUndecodable, skippedBadMMSI, skippedImplausible, skippedBadCoordinates:
+			c := Log.Limited(m.SourceName+"_bad", badSentenceLogInterval).Compose(l.Warning)
+			c.Writeln("%s: Type %d message not stored: %s: %s", m.SourceName, m.Type(), decision, err.Error())
+			c.SetLevel(l.Debug) // the payload is only needed for debugging the decoding
+			c.Finish("%s", l.Escape([]byte(m.ArmoredPayload())))
+		}
+		if Trace.Active() {
+			details := ""
+			if err != nil {
+				details = err.Error()
 			}
+			Trace.Record(m, "archive", decision, details)
+		}
+	}
+}
+
+// evict removes the least recently updated ships from both db and rt
+// if there are more than maxShips.
+// Searches wait until both are done, so that they never find a ship in rt
+// that is no longer in db. (WriteWithin looks them up afterwards, and skips those evicted since)
+func (a *Archive) evict() {
+	if a.db.Count() <= a.maxShips {
+		return
+	}
+	a.evictLock.Lock()
+	evicted := a.db.EvictOldest(a.maxShips)
+	for _, s := range evicted {
+		if math.IsNaN(s.Pos.Lat) {
+			continue // static information only, so not indexed
+		}
+		if err := a.rt.Remove(s.MMSI, s.Pos.Lat, s.Pos.Long); err != nil {
+			Log.Warning("Failed to remove evicted ship %09d from the R-tree: %s", s.MMSI, err.Error())
+		}
+	}
+	a.evictLock.Unlock()
+	if len(evicted) != 0 {
+		a.changed()
+	}
+}
+
+// markOwnShip flags the ship a stored VDO message was from,
+// so that it's hidden from the map by default.
+func (a *Archive) markOwnShip(m *nmeais.Message) {
+	if mmsi, ok := m.MMSI(); ok && a.db.MarkOwnShip(mmsi) {
+		a.changed() // so that clients polling in_area see it disappear
+	}
+}
+
+// checkLength returns an error if the payload has fewer than min bits.
+func checkLength(m *nmeais.Message, min uint) error {
+	if bits := m.Bits().Len(); bits < min {
+		return fmt.Errorf("payload is too short: %d bits, expected at least %d", bits, min)
+	}
+	return nil
+}
+
+// checkPosition returns why a position report cannot be stored,
+// or "" if it can.
+func checkPosition(ps *ais.PositionReport) (string, error) {
+	if !storage.ValidMMSI(ps.MMSI) {
+		return skippedBadMMSI, fmt.Errorf("MMSI %d", ps.MMSI)
+	} else if ps.Lat == 91 || ps.Lon == 181 {
+		return skippedNoPosition, nil
+	} else if !okCoords(ps.Lat, ps.Lon) {
+		return skippedBadCoordinates, fmt.Errorf("%f,%f", ps.Lat, ps.Lon)
+	}
+	return "", nil
+}
+
+// decodedMessage is the information in one message that the archive stores.
+// Which fields are set depends on the type of the message.
+type decodedMessage struct {
+	MMSI    uint32
+	Pos     *storage.ShipPos        // position reports and aids to navigation
+	Info    *storage.ShipInfo       // static reports and aids to navigation
+	AtoN    *storage.AtoNInfo       // aids to navigation
+	Command *nmeais.RegionalCommand // channel management and group assignment
+	Weather *storage.MetReport      // meteorological binary broadcasts
+	Safety  *nmeais.SafetyMessage   // addressed and broadcast safety-related text
+}
+
+// decodeMessage decodes a message of one of the types the archive stores.
+// received is used to complete the time of position reports.
+// Messages that cannot be stored return one of the skipped* constants and
+// an error describing the problem, or skippedType for other types.
+func decodeMessage(m *nmeais.Message, received time.Time) (decodedMessage, string, error) {
+	switch m.Type() {
+	case 1, 2, 3: // class A position report (longest)
+		if e := checkLength(m, minClassABits); e != nil {
+			return decodedMessage{}, skippedUndecodable, e
+		}
+		cApr, e := ais.DecodeClassAPositionReport(m.ArmoredPayload())
+		ps := &cApr.PositionReport
+		if e != nil {
+			return decodedMessage{}, skippedUndecodable, e
+		}
+		if skip, e := checkPosition(ps); skip != "" {
+			return decodedMessage{}, skip, e
+		}
+		return decodedMessage{MMSI: ps.MMSI, Pos: &storage.ShipPos{
+			At:          fixTime(ps.Second, received),
+			Received:    received,
+			Pos:         geo.Point{Lat: ps.Lat, Long: ps.Lon},
+			PosAccuracy: storage.Accuracy(ps.Accuracy),
+			NavStatus:   storage.ShipNavStatus(cApr.Status),
+			BowHeading:  float32(ps.Heading),
+			Course:      ps.Course,
+			Speed:       decodeSpeed(ps.Speed),
+			RateOfTurn:  decodeRateOfTurn(int8(m.Bits().Int(42, 8))),
+		}}, "", nil
+	case 5: // static voyage data
+		if e := checkLength(m, minStaticVoyageBits); e != nil {
+			return decodedMessage{}, skippedUndecodable, e
+		}
+		svd, e := ais.DecodeStaticVoyageData(m.ArmoredPayload())
+		if e != nil {
+			return decodedMessage{}, skippedUndecodable, e
+		} else if !storage.ValidMMSI(svd.MMSI) {
+			return decodedMessage{}, skippedBadMMSI, fmt.Errorf("MMSI %d", svd.MMSI)
+		}
+		length := uint16(svd.ToBow + svd.ToStern)
+		lOffset := int16(length/2 - svd.ToBow)
+		width := uint16(svd.ToPort + svd.ToStarboard)
+		wOffset := int16(width/2 - uint16(svd.ToStarboard))
+		return decodedMessage{MMSI: svd.MMSI, Info: &storage.ShipInfo{
+			VesselType:   storage.ShipType(svd.ShipType),
+			IMO:          svd.IMO,
+			Draught:      svd.Draught,
+			Length:       length,
+			Width:        width,
+			LengthOffset: lOffset,
+			WidthOffset:  wOffset,
+			Callsign:     svd.Callsign,
+			ShipName:     svd.VesselName,
+			Dest:         svd.Destination,
+			ETA:          decodeETA(m, received),
+		}}, "", nil
+	case 8: // binary broadcast, only meteorological data is decoded
+		if dac, fi, e := nmeais.BinaryApplication(m.Bits()); e != nil {
+			return decodedMessage{}, skippedUndecodable, e
+		} else if dac != nmeais.DACInternational || fi != nmeais.FIMeteorological {
+			return decodedMessage{}, skippedApplication, fmt.Errorf("DAC %d FI %d", dac, fi)
+		}
+		met, e := nmeais.DecodeMeteorological(m.Bits())
+		if e != nil {
+			return decodedMessage{}, skippedUndecodable, e
+		}
+		if skip, e := checkPosition(&ais.PositionReport{
+			MMSI: met.Station,
+			Lat:  met.Pos.Lat,
+			Lon:  met.Pos.Long,
+		}); skip != "" {
+			return decodedMessage{}, skip, e
+		}
+		return decodedMessage{MMSI: met.Station, Weather: &storage.MetReport{
+			At:             reportTime(met.Day, met.Hour, met.Minute, received),
+			Received:       received,
+			Meteorological: met,
+		}}, "", nil
+	case 12, 14: // addressed and broadcast safety-related messages
+		sm, e := nmeais.DecodeSafetyMessage(m.Bits())
+		if e != nil {
+			return decodedMessage{}, skippedUndecodable, e
+		} else if !storage.ValidMMSI(sm.Source) {
+			return decodedMessage{}, skippedBadMMSI, fmt.Errorf("MMSI %d", sm.Source)
+		}
+		return decodedMessage{MMSI: sm.Source, Safety: &sm}, "", nil
+	case 27: // long-range position report, for satellites
+		lr, e := nmeais.DecodeLongRange(m.Bits())
+		if e != nil {
+			return decodedMessage{}, skippedUndecodable, e
+		}
+		if skip, e := checkPosition(&ais.PositionReport{
+			MMSI: lr.MMSI,
+			Lat:  lr.Pos.Lat,
+			Lon:  lr.Pos.Long,
+		}); skip != "" {
+			return decodedMessage{}, skip, e
+		}
+		speed := float32(lr.Speed)
+		if lr.Speed == 63 {
+			speed = storage.SpeedNotAvailable
+		}
+		// there is no second, and satellite feeds can deliver the report long
+		// after it was sent, which UpdateDynamic accounts for with Resolution
+		return decodedMessage{MMSI: lr.MMSI, Pos: &storage.ShipPos{
+			At:          received,
+			Received:    received,
+			Pos:         lr.Pos,
+			PosAccuracy: false,
+			NavStatus:   storage.ShipNavStatus(lr.NavStatus),
+			BowHeading:  storage.HeadingNotAvailable,
+			Course:      float32(lr.Course),
+			Speed:       speed,
+			RateOfTurn:  float32(math.NaN()),
+			Resolution:  nmeais.LongRangeResolution,
+		}}, "", nil
+	case 18: // basic class B position report (shorter)
+		if e := checkLength(m, minClassBBits); e != nil {
+			return decodedMessage{}, skippedUndecodable, e
+		}
+		cBpr, e := ais.DecodeClassBPositionReport(m.ArmoredPayload())
+		ps := &cBpr.PositionReport
+		if e != nil {
+			return decodedMessage{}, skippedUndecodable, e
+		}
+		if skip, e := checkPosition(ps); skip != "" {
+			return decodedMessage{}, skip, e
+		}
+		return decodedMessage{MMSI: ps.MMSI, Pos: &storage.ShipPos{
+			At:          fixTime(ps.Second, received),
+			Received:    received,
+			Pos:         geo.Point{Lat: ps.Lat, Long: ps.Lon},
+			PosAccuracy: storage.Accuracy(ps.Accuracy),
+			NavStatus:   storage.ShipNavStatus(15),
+			BowHeading:  float32(ps.Heading),
+			Course:      ps.Course,
+			Speed:       decodeSpeed(ps.Speed),
+			RateOfTurn:  float32(math.NaN()),
+		}}, "", nil
+	case 21: // aid-to-navigation report
+		if e := checkLength(m, minAtoNBits); e != nil {
+			return decodedMessage{}, skippedUndecodable, e
+		}
+		aton, e := nmeais.DecodeAidToNavigation(m.Bits())
+		if e != nil {
+			return decodedMessage{}, skippedUndecodable, e
+		}
+		if skip, e := checkPosition(&ais.PositionReport{
+			MMSI: aton.MMSI,
+			Lat:  aton.Pos.Lat,
+			Lon:  aton.Pos.Long,
+		}); skip != "" {
+			return decodedMessage{}, skip, e
+		}
+		pos := storage.UnknownPos
+		pos.At = fixTime(aton.Second, received)
+		pos.Received = received
+		pos.Pos = aton.Pos
+		pos.PosAccuracy = storage.Accuracy(aton.Accuracy)
+		length := aton.ToBow + aton.ToStern
+		width := uint16(aton.ToPort) + uint16(aton.ToStarboard)
+		return decodedMessage{MMSI: aton.MMSI, Pos: &pos, Info: &storage.ShipInfo{
+			Length:       length,
+			Width:        width,
+			LengthOffset: int16(length/2) - int16(aton.ToBow),
+			WidthOffset:  int16(width/2) - int16(aton.ToStarboard),
+			ShipName:     aton.Name,
+		}, AtoN: &storage.AtoNInfo{
+			Type:        storage.AtoNType(aton.AidType),
+			OffPosition: aton.OffPosition && aton.Second < 60,
+			Virtual:     aton.Virtual,
+		}}, "", nil
+	case 22, 23: // channel management and group assignment
+		rc, e := nmeais.DecodeRegionalCommand(m.Bits())
+		if e != nil {
+			return decodedMessage{}, skippedUndecodable, e
+		}
+		return decodedMessage{MMSI: rc.Station, Command: &rc}, "", nil
+	case 24: // static data report
+		min := uint(minStaticReportABits)
+		if m.Bits().Uint(38, 2) != 0 {
+			min = minStaticReportBBits
+		}
+		if e := checkLength(m, min); e != nil {
+			return decodedMessage{}, skippedUndecodable, e
+		}
+		sdr, e := ais.DecodeStaticDataReport(m.ArmoredPayload())
+		if e != nil {
+			return decodedMessage{}, skippedUndecodable, e
+		} else if !storage.ValidMMSI(sdr.MMSI) {
+			return decodedMessage{}, skippedBadMMSI, fmt.Errorf("MMSI %d", sdr.MMSI)
+		}
+		// The two parts are sent separately, and UpdateStatic only overwrites
+		// the fields that are set.
+		var update storage.ShipInfo
+		switch sdr.PartNo {
+		case 0:
+			// aislib reads the name from where it is in type 5
+			update.ShipName = m.Bits().Text(40, 20)
+		case 1:
 			length := uint16(sdr.ToBow + sdr.ToStern)
-			lOffset := int16(length/2 - sdr.ToBow)
 			width := uint16(sdr.ToPort + sdr.ToStarboard)
-			wOffset := int16(width/2 - uint16(sdr.ToStarboard))
-			a.db.UpdateStatic(sdr.MMSI, storage.ShipInfo{storage.ShipType(sdr.ShipType), 0, length, width, lOffset, wOffset, sdr.CallSign, sdr.VesselName, "", time.Date(0001, 1, 1, 0, 0, 0, 0, time.UTC)})
+			update = storage.ShipInfo{
+				VesselType:   storage.ShipType(sdr.ShipType),
+				Length:       length,
+				Width:        width,
+				LengthOffset: int16(length/2 - sdr.ToBow),
+				WidthOffset:  int16(width/2 - uint16(sdr.ToStarboard)),
+				Callsign:     sdr.CallSign,
+			}
+		default:
+			return decodedMessage{}, skippedUndecodable, fmt.Errorf("part number %d", sdr.PartNo)
+		}
+		return decodedMessage{MMSI: sdr.MMSI, Info: &update}, "", nil
+	}
+	return decodedMessage{}, skippedType, nil
+}
+
+// save stores the information in one message,
+// and returns what was done with it for tracing.
+// Messages that are not stored return one of the skipped* constants and
+// an error describing the problem, and errors that don't stop the
+// message from being stored are also returned.
+func (a *Archive) save(m *nmeais.Message) (string, error) {
+	received := m.Received()
+	if received.IsZero() {
+		received = time.Now()
+	}
+	// positions from sources that deliver late get the time they were
+	// probably sent, but Received is still when they arrived
+	d, skip, err := decodeMessage(m, received.Add(-a.skew.Correction(m.SourceName)))
+	if skip != "" {
+		return skip, err
+	} else if d.Command == nil && !a.allowImplausibleMMSI && !storage.Mmsi(d.MMSI).Plausible() {
+		return skippedImplausible, fmt.Errorf("MMSI %09d", d.MMSI)
+	}
+	if d.Pos != nil {
+		d.Pos.Received = received
+	}
+	switch {
+	case d.Command != nil:
+		rc := d.Command
+		// they're common, and kept for /api/v1/debug/channel_management
+		if rc.Addressed {
+			Log.Debug("Type %d from %d addressed to %d and %d", rc.Type, rc.Station,
+				rc.Destinations[0], rc.Destinations[1])
+		} else {
+			Log.Debug("Type %d from %d for region %.3f,%.3f,%.3f,%.3f", rc.Type, rc.Station,
+				rc.SW.Long, rc.SW.Lat, rc.NE.Long, rc.NE.Lat)
+		}
+		a.commands.Add(time.Now(), *rc)
+		return "command logged", nil
+	case d.Weather != nil:
+		a.weather.Add(*d.Weather)
+		return "weather saved", nil
+	case d.Safety != nil:
+		if !a.safety.Add(received, *d.Safety) {
+			return skippedRepeated, nil
 		}
+		return "safety message logged", nil
+	case d.Pos == nil: // static report
+		a.db.UpdateStatic(d.MMSI, m.SourceName, received, *d.Info)
+		a.changed()
+		a.forwardStatic(m, d.MMSI, received, *d.Info)
+		a.publish(d.MMSI, nil)
+		return "static saved", nil
+	case d.AtoN != nil:
+		oldPos, _, err := a.updatePos(d.MMSI, d.Pos.Pos, func() bool {
+			a.db.UpdateAtoN(d.MMSI, m.SourceName, received, *d.Pos, *d.Info, *d.AtoN)
+			return true
+		})
+		a.changed()
 		if err != nil {
-			continue //TODO do something...
+			return "position not indexed", err
 		}
+		a.publish(d.MMSI, oldPos)
+		return "aid to navigation saved", nil
 	}
+	oldPos, stored, err := a.updatePos(d.MMSI, d.Pos.Pos, func() bool {
+		return a.db.UpdateDynamic(d.MMSI, m.SourceName, *d.Pos)
+	})
+	if !stored {
+		return skippedOutdated, nil
+	}
+	a.changed()
+	a.forwardPosition(m, d.MMSI, *d.Pos)
+	if err != nil {
+		return "position not indexed", err
+	}
+	a.publish(d.MMSI, oldPos)
+	a.checkGeofences(m, d.MMSI, oldPos, *d.Pos)
+	return "position saved", nil
+}
+
+// changed registers that a ship has been updated.
+// Must be called after the update is visible to readers.
+func (a *Archive) changed() {
+	atomic.AddUint64(&a.changes, 1)
+}
+
+// Changes returns a counter that is incremented every time a ship is updated.
+// The counter is global: It changes even if the ships in an area you're
+// interested in didn't.
+func (a *Archive) Changes() uint64 {
+	return atomic.LoadUint64(&a.changes)
+}
+
+// LastMessage returns when Save last got a message, or the zero time if it hasn't.
+func (a *Archive) LastMessage() time.Time {
+	if last := atomic.LoadInt64(&a.lastSaved); last != 0 {
+		return time.Unix(0, last)
+	}
+	return time.Time{}
 }
 
 // NumberOfShips returns the number of known ships
 func (a *Archive) NumberOfShips() int {
-	a.rw.RLock()
-	defer a.rw.RUnlock()
 	return a.rt.NumOfBoats()
 }
 
-//Updates the ships position in the structures (message type 1,2,3,18)
-func (a *Archive) updatePos(ps *ais.PositionReport) error {
-	mmsi := ps.MMSI
-	if !okCoords(ps.Lat, ps.Lon) || mmsi <= 0 { //This happends quite frequently (coordinates are set to 91,181)
-		return errors.New("Cannot update position")
+// ArchiveStats is a snapshot of what the archive contains.
+type ArchiveStats struct {
+	storage.ShipCounts
+	Indexed      int               `json:"indexed"` // ships in the R-tree
+	TreeHeight   int               `json:"tree_height"`
+	TreeNodes    int               `json:"tree_nodes"`
+	Changes      uint64            `json:"changes"`
+	Vanished     uint64            `json:"vanished"`       // see VanishedShips()
+	Implausible  uint64            `json:"implausible"`    // positions implying speeds above storage.MaxPlausibleSpeed
+	Jitter       uint64            `json:"jitter"`         // positions dropped as jitter between receivers
+	Evicted      uint64            `json:"evicted"`        // ships removed because there were more than -max-ships
+	StoredByType map[string]uint64 `json:"stored_by_type"` // message type (as string for JSON) to count
+	Skipped      SkippedMessages   `json:"skipped"`
+	NotIndexed   uint64            `json:"not_indexed"` // positions stored but not in the R-tree
+	// recent safety-related messages, see SafetyMessages()
+	SafetyMessages int `json:"safety_messages"`
+}
+
+// SkippedMessages counts messages that were not stored, by why.
+type SkippedMessages struct {
+	Undecodable     uint64 `json:"undecodable"` // too short or failed to decode
+	BadMMSI         uint64 `json:"bad_mmsi"`
+	ImplausibleMMSI uint64 `json:"implausible_mmsi"` // not a kind of station, unless -check-mmsi=false
+	BadCoordinates  uint64 `json:"bad_coordinates"`
+	NoPosition      uint64 `json:"no_position"` // position reports with position not available
+	// binary broadcasts that are not meteorological data
+	UnknownApplication uint64 `json:"unknown_application"`
+}
+
+// Stats counts the ships and messages.
+// It walks the R-tree and iterates over all ships, but only holds each lock
+// for a short time, so the numbers might not be consistent with each other.
+func (a *Archive) Stats() ArchiveStats {
+	stats := ArchiveStats{
+		ShipCounts:   a.db.Counts(recentShips),
+		Changes:      a.Changes(),
+		Vanished:     a.db.Vanished(),
+		Implausible:  a.db.Implausible(),
+		Jitter:       a.db.Jitter(),
+		Evicted:      a.db.Evicted(),
+		StoredByType: make(map[string]uint64),
+		Skipped: SkippedMessages{
+			Undecodable:        atomic.LoadUint64(&a.skipped.Undecodable),
+			BadMMSI:            atomic.LoadUint64(&a.skipped.BadMMSI),
+			ImplausibleMMSI:    atomic.LoadUint64(&a.skipped.ImplausibleMMSI),
+			BadCoordinates:     atomic.LoadUint64(&a.skipped.BadCoordinates),
+			NoPosition:         atomic.LoadUint64(&a.skipped.NoPosition),
+			UnknownApplication: atomic.LoadUint64(&a.skipped.UnknownApplication),
+		},
+		NotIndexed:     atomic.LoadUint64(&a.notIndexed),
+		SafetyMessages: a.safety.Len(),
 	}
-	//Check if it is a known ship
-	if a.db.Known(mmsi) {
-		oldLat, oldLong := a.db.Coords(mmsi) //get the previous coordinates
-		if oldLat == 0 && oldLong == 0 {
-			return errors.New("The ship has no known coordinates")
+	stats.Indexed = a.rt.NumOfBoats()
+	stats.TreeHeight = a.rt.Height()
+	stats.TreeNodes = a.rt.NodeCount()
+	for t := range a.stored {
+		if n := atomic.LoadUint64(&a.stored[t]); n != 0 {
+			stats.StoredByType[strconv.Itoa(t)] = n
 		}
-		a.rw.Lock()
-		err := a.rt.Update(mmsi, oldLat, oldLong, ps.Lat, ps.Lon) //update the position in the R*Tree
-		a.rw.Unlock()
+	}
+	return stats
+}
+
+// VanishedShips returns the number of ships that were removed between being
+// found in the index and being looked up.
+func (a *Archive) VanishedShips() uint64 {
+	return a.db.Vanished()
+}
+
+//Updates the ships position in the structures (message type 1,2,3,18,21,27)
+//store is called to update db after the previous position has been looked up,
+//and the ship is only moved in rt if it returns true, so that rt never has a
+//position that db rejected as outdated.
+//Returns the previous position, or nil if the ship is new, and what store returned.
+func (a *Archive) updatePos(mmsi uint32, pos geo.Point, store func() bool) (*geo.Point, bool, error) {
+	//Check if it is a known ship and get the previous coordinates
+	//Ships with only static information are not in the R*Tree yet.
+	oldLat, oldLong, known := a.db.KnownCoords(mmsi)
+	if !store() {
+		return nil, false, nil
+	}
+	if !okCoords(pos.Lat, pos.Long) || !storage.ValidMMSI(mmsi) { //This happends quite frequently (coordinates are set to 91,181)
+		return nil, true, errors.New("Cannot update position")
+	}
+	if known && !math.IsNaN(oldLat) {
+		err := a.rt.Update(mmsi, oldLat, oldLong, pos.Lat, pos.Long) //update the position in the R*Tree
 		if err != nil {
-			return errors.New("The archive failed to update the position of the ship")
+			return nil, true, errors.New("The archive failed to update the position of the ship")
 		}
-	} else {
-		a.rw.Lock()
-		a.rt.InsertData(ps.Lat, ps.Lon, mmsi) //insert a new ship into the R*Tree
-		a.rw.Unlock()
+		return &geo.Point{Lat: oldLat, Long: oldLong}, true, nil
 	}
-	return nil
+	a.rt.InsertData(pos.Lat, pos.Long, mmsi) //insert a new ship into the R*Tree
+	return nil, true, nil
+}
+
+// KnownPosition returns the last known position of a ship.
+func (a *Archive) KnownPosition(mmsi uint32) (lat, long float64, known bool) {
+	lat, long, known = a.db.KnownCoords(mmsi)
+	if math.IsNaN(lat) { // static information but no position yet
+		return 0, 0, false
+	}
+	return lat, long, known
 }
 
 // FindAll returns a GeoJSON FeatureCollection containing all the known ships
 func (a *Archive) FindAll() string {
-	geoJSONFC, _ := a.FindWithin(-89.999999, -179.999999, 89.999999, 179.999999)
-	return geoJSONFC
+	rects := geo.SplitViewRect(-90, -180, 90, 180)
+	json, _ := a.FindWithin(rects, storage.MatchFilter{}, geo.FullPrecision, false, false, false, false, 0)
+	return json
 }
 
-// FindWithin uses the index to find all ships within a bounding box.
-// The bounding box can cross the date line or be offset 360°.
-// The ships are returned as a GeoJSON FeatureCollection.	output:
-func (a *Archive) FindWithin(minLat, minLong, maxLat, maxLong float64) (string, error) {
-	rects := geo.SplitViewRect(minLat, minLong, maxLat, maxLong)
-	if rects == nil {
-		return "{}", errors.New("ERROR, invalid rectangle coordinates")
-	}
-	matches := []storage.Match{}
-	a.rw.RLock()
-	for _, r := range rects {
-		m := a.rt.FindWithin(&r)
-		matches = append(matches, *m...)
-	}
-	a.rw.RUnlock()
+// FindWithin uses the index to find all ships within any of the rectangles,
+// which can be produced by geo.SplitViewRect or geo.ParseViewRects.
+// filter selects whether to include ships, aids to navigation or both,
+// and which kinds of ships.
+// All rectangles are searched under the same lock so that the result is consistent,
+// and ships within more than one of them are only included once.
+// The ships are returned as a GeoJSON FeatureCollection,
+// or as parallel arrays if terse is true. (see storage.TerseMatches)
+// If extrapolate is true, moving ships are placed where they're projected to be now,
+// which cannot be combined with terse.
+// If verbose is true, when each ship was first seen is included, which also
+// cannot be combined with terse.
+// If shapes is true, ships with known dimensions and heading are drawn as
+// polygons of their outline, which cannot be combined with terse.
+// If limit is positive, at most that many ships are included in the
+// FeatureCollection, which gets "truncated":true if there were more.
+// It cannot be combined with terse either.
+// Coordinates are rounded to precision decimals unless it's geo.FullPrecision.
+// Also returns the value of Changes() from before the search, so that the result
+// is known to include all changes up to and including it.
+func (a *Archive) FindWithin(rects []geo.Rectangle, filter storage.MatchFilter, precision int,
+	terse, extrapolate, verbose, shapes bool, limit int) (string, uint64) {
+	changes := a.Changes()
 	// TODO return rectangles?
-	return storage.Matches(&matches, a.db, Log), nil
+	if terse {
+		a.evictLock.RLock()
+		defer a.evictLock.RUnlock()
+		matches := a.rt.FindWithinAny(rects)
+		storage.FilterMatches(matches, a.db, filter)
+		return storage.TerseMatches(matches, a.db, precision, Log), changes
+	}
+	var sb strings.Builder
+	a.WriteWithin(&sb, rects, filter, precision, extrapolate, verbose, shapes, limit)
+	return sb.String(), changes
+}
+
+// WriteWithin writes the FeatureCollection of FindWithin to w as the ships
+// are looked up, and returns the first error from writing.
+// Only the search is done under evictLock, as saving waits for it while
+// evicting does, so a slow client doesn't hold up anything.
+// Ships evicted before they're looked up are left out.
+// Call Changes() before it for the value FindWithin returns.
+func (a *Archive) WriteWithin(w io.Writer, rects []geo.Rectangle, filter storage.MatchFilter, precision int,
+	extrapolate, verbose, shapes bool, limit int) error {
+	a.evictLock.RLock()
+	matches := a.rt.FindWithinAny(rects)
+	a.evictLock.RUnlock()
+	_, err := storage.WriteMatches(w, *matches, a.db, filter, precision, extrapolate, verbose, shapes, limit, Log)
+	return err
+}
+
+// FindClustered is FindWithin with ships aggregated into cells of a grid
+// with gridSize degrees between the lines. (see storage.ClusteredMatches)
+func (a *Archive) FindClustered(rects []geo.Rectangle, filter storage.MatchFilter, gridSize float64, precision int) (string, uint64) {
+	changes := a.Changes()
+	a.evictLock.RLock()
+	defer a.evictLock.RUnlock()
+	matches := a.rt.FindWithinAny(rects)
+	storage.FilterMatches(matches, a.db, filter)
+	return storage.ClusteredMatches(matches, rects, gridSize, a.db, precision, Log), changes
 }
 
 // Check if the coordinates are ok.	(<91, 181> seems to be a fallback value for the coordinates)
@@ -186,6 +837,172 @@ func okCoords(lat, long float64) bool {
 }
 
 // Select returns the information about the ship and its tracklog as GeoJSON
-func (a *Archive) Select(mmsi uint32) string {
-	return a.db.Select(mmsi, Log)
+// See storage.ShipDB.SelectTrack for the parameters.
+// Suppressed ships are treated as unknown.
+func (a *Archive) Select(mmsi uint32, precision, maxPoints int, since time.Duration, extrapolate bool) string {
+	if a.db.Suppressed(mmsi) {
+		return ""
+	}
+	return a.db.SelectTrack(mmsi, precision, maxPoints, since, extrapolate, Log)
+}
+
+// WithIMO returns the MMSI that last sent an IMO number,
+// unless that ship is suppressed.
+func (a *Archive) WithIMO(imo uint32) (mmsi uint32, known bool) {
+	mmsi, known = a.db.WithIMO(imo)
+	if known && a.db.Suppressed(mmsi) {
+		return 0, false
+	}
+	return mmsi, known
+}
+
+// Track returns the information about a ship and its tracklog for formats
+// other than GeoJSON. See storage.ShipDB.Track.
+// Suppressed ships are treated as unknown.
+func (a *Archive) Track(mmsi uint32, maxPoints int, since time.Duration) (
+	storage.ShipInfo, storage.ShipPos, []storage.TrackPoint, bool) {
+	if a.db.Suppressed(mmsi) {
+		return storage.ShipInfo{}, storage.ShipPos{}, nil, false
+	}
+	return a.db.Track(mmsi, maxPoints, since)
+}
+
+// csvHeader is the first line of ExportCSV.
+var csvHeader = []string{"mmsi", "name", "callsign", "vessel_type", "length", "width",
+	"destination", "eta", "latitude", "longitude", "status", "heading", "course", "speed",
+	"last_updated", "history_points"}
+
+// ExportCSV writes the information about all ships as CSV, one ship per line.
+// Unknown values are empty, and suppressed ships are left out.
+func (a *Archive) ExportCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	err := cw.Write(csvHeader)
+	formatFloat := func(f float64, bits int) string {
+		if math.IsNaN(f) {
+			return ""
+		}
+		return strconv.FormatFloat(f, 'f', -1, bits)
+	}
+	formatTime := func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.UTC().Format(time.RFC3339)
+	}
+	formatUint := func(u uint64) string {
+		if u == 0 {
+			return ""
+		}
+		return strconv.FormatUint(u, 10)
+	}
+	a.db.ForEach(func(mmsi uint32, info storage.ShipInfo, pos storage.ShipPos, history []geo.Point) bool {
+		if err != nil {
+			return false
+		} else if a.db.SuppressTypes[info.VesselType] {
+			return true
+		}
+		err = cw.Write([]string{
+			strconv.FormatUint(uint64(mmsi), 10),
+			info.ShipName,
+			info.Callsign,
+			info.VesselType.String(),
+			formatUint(uint64(info.Length)),
+			formatUint(uint64(info.Width)),
+			info.Dest,
+			formatTime(info.ETA),
+			formatFloat(pos.Pos.Lat, 64),
+			formatFloat(pos.Pos.Long, 64),
+			pos.NavStatus.String(),
+			formatFloat(float64(pos.BowHeading), 32),
+			formatFloat(float64(pos.Course), 32),
+			formatFloat(float64(pos.Speed), 32),
+			formatTime(pos.At),
+			strconv.Itoa(len(history)),
+		})
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// Subscribe returns a channel that receives a GeoJSON Feature every time a
+// ship within or leaving any of the rectangles is updated, and a function
+// which must be called to stop receiving.
+// Updates are dropped if the receiver doesn't keep up, so the channel is
+// never closed by the archive.
+func (a *Archive) Subscribe(rects []geo.Rectangle) (<-chan []byte, func()) {
+	s := &subscription{
+		rects:   rects,
+		updates: make(chan []byte, subscriberBuffer),
+	}
+	a.subsLock.Lock()
+	a.subscribers[s] = struct{}{}
+	a.subsLock.Unlock()
+	return s.updates, func() {
+		a.subsLock.Lock()
+		delete(a.subscribers, s)
+		a.subsLock.Unlock()
+	}
+}
+
+// publish sends the current state of a ship to the subscribers whose area
+// it is within or was within before the update.
+// oldPos is nil if the ship had no other position before the update.
+// Suppressed ships are never sent.
+func (a *Archive) publish(mmsi uint32, oldPos *geo.Point) {
+	a.subsLock.Lock()
+	defer a.subsLock.Unlock()
+	if len(a.subscribers) == 0 || a.db.Suppressed(mmsi) {
+		return
+	}
+	lat, long, known := a.db.KnownCoords(mmsi)
+	if !known {
+		return
+	}
+	pos := geo.Point{Lat: lat, Long: long}
+	var feature []byte // only created if anybody wants it
+	for s := range a.subscribers {
+		if !s.covers(pos) && (oldPos == nil || !s.covers(*oldPos)) {
+			continue
+		}
+		if feature == nil {
+			f := a.db.MapFeature(mmsi, geo.DefaultPrecision, Log)
+			if f == "" {
+				return
+			}
+			feature = []byte(f)
+		}
+		select {
+		case s.updates <- feature:
+		default: // slow client
+		}
+	}
+}
+
+// DebugRTree returns the nodes of the spatial index as GeoJSON,
+// see storage.RTree.DebugGeoJSON.
+func (a *Archive) DebugRTree() string {
+	a.evictLock.RLock()
+	defer a.evictLock.RUnlock()
+	return a.rt.DebugGeoJSON(Log)
+}
+
+// SafetyMessages returns the stored safety-related messages received after since, newest first.
+func (a *Archive) SafetyMessages(since time.Time) []storage.ReceivedSafetyMessage {
+	return a.safety.Since(since)
+}
+
+// Weather returns the latest meteorological report from each position within
+// any of rects as a GeoJSON FeatureCollection.
+func (a *Archive) Weather(rects []geo.Rectangle) string {
+	return a.weather.GeoJSON(rects, Log)
+}
+
+// RegionalCommands returns the recently received channel management and
+// group assignment commands as a GeoJSON FeatureCollection.
+func (a *Archive) RegionalCommands() string {
+	return a.commands.GeoJSON(Log)
 }
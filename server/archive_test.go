@@ -0,0 +1,757 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tormol/AIS/geo"
+	"github.com/tormol/AIS/nmeais"
+	"github.com/tormol/AIS/storage"
+)
+
+func TestArchiveStats(t *testing.T) {
+	a := NewArchive(10, 0, 0, 0, 0, 0, 0)
+	replay(a, "!BSVDM,1,1,,A,14S:Eb001ePRmHBTAAFnrmV60PRk,0*1F\r\n"+ // type 1 from 305305000
+		"!BSVDM,1,1,,B,144atH00000Lf9nSffVf49TP00S9,0*1D\r\n"+ // type 1 from 273316960
+		"!AIVDM,2,1,1,A,55?MbV02;H;s<HtKR20EHE:0@T4@Dn2222222216L961O5Gf0NSQEp6ClRp8,0*1C\r\n"+
+		"!AIVDM,2,2,1,A,88888888880,2*25\r\n"+ // type 5 from 351759000
+		"!AIVDM,1,1,,B,B5NJ;PP005l4ot5Isbl03wsUkP06,0*75\r\n") // type 18 from 367430530
+	stats := a.Stats()
+	if stats.Ships != 4 || stats.Indexed != 3 || stats.Recent != 3 {
+		t.Errorf("Expected 4 ships of which 3 have positions, got %+v", stats)
+	}
+	if stats.WithStatic != 1 || stats.PositionOnly != 3 || stats.HistoryPoints != 3 {
+		t.Errorf("Expected one ship with only static info, got %+v", stats)
+	}
+	if stats.TreeHeight != 1 || stats.TreeNodes != 1 {
+		t.Errorf("Expected the R-tree to be a single leaf, got %+v", stats)
+	}
+	expected := map[string]uint64{"1": 2, "5": 1, "18": 1}
+	if len(stats.StoredByType) != len(expected) {
+		t.Errorf("Expected %v, got %v", expected, stats.StoredByType)
+	}
+	for typ, n := range expected {
+		if stats.StoredByType[typ] != n {
+			t.Errorf("Expected %v, got %v", expected, stats.StoredByType)
+		}
+	}
+
+	// the same ship again
+	replay(a, "!AIVDM,2,1,1,A,55?MbV02;H;s<HtKR20EHE:0@T4@Dn2222222216L961O5Gf0NSQEp6ClRp8,0*1C\r\n"+
+		"!AIVDM,2,2,1,A,88888888880,2*25\r\n")
+	if stats = a.Stats(); stats.WithStatic != 1 || stats.StoredByType["5"] != 2 {
+		t.Errorf("Expected updating static info to not count the ship again, got %+v", stats)
+	}
+}
+
+func TestEmptyPayloadIsSkipped(t *testing.T) {
+	a := NewArchive(10, 0, 0, 0, 0, 0, 0)
+	replay(a, "!ABVDM,1,1,,,,0\r\n"+
+		"!BSVDM,1,1,,A,14S:Eb001ePRmHBTAAFnrmV60PRk,0*1F\r\n") // type 1 from 305305000
+	stats := a.Stats()
+	if stats.Ships != 1 || stats.StoredByType["0"] != 0 || stats.StoredByType["1"] != 1 {
+		t.Errorf("Expected only the position report to be stored, got %+v", stats)
+	}
+}
+
+// payloadBits builds a payload one bit at a time.
+type payloadBits []byte
+
+// put appends the lowest length bits of value.
+func (pb *payloadBits) put(length uint, value int64) {
+	for i := length; i > 0; i-- {
+		*pb = append(*pb, byte(value>>(i-1))&1)
+	}
+}
+
+// sentences armors the payload and splits it into !AIVDM sentences.
+func (pb payloadBits) sentences() string {
+	return pb.sentencesAs("AIVDM")
+}
+
+// ownShip armors the payload into !AIVDO sentences, as sent about the receiver itself.
+func (pb payloadBits) ownShip() string {
+	return pb.sentencesAs("AIVDO")
+}
+
+// sentencesAs armors the payload and splits it into sentences with the identifier.
+func (pb payloadBits) sentencesAs(identifier string) string {
+	padding := (6 - len(pb)%6) % 6
+	armored := []byte{}
+	for i := 0; i < len(pb); i += 6 {
+		v := byte(0)
+		for j := i; j < i+6; j++ {
+			v <<= 1
+			if j < len(pb) {
+				v |= pb[j]
+			}
+		}
+		if v >= 40 {
+			v += 8
+		}
+		armored = append(armored, v+48)
+	}
+	parts := (len(armored) + 59) / 60
+	text := ""
+	for i := 0; i < parts; i++ {
+		chunk, pad := armored[i*60:], 0
+		if len(chunk) > 60 {
+			chunk = chunk[:60]
+		} else {
+			pad = padding
+		}
+		body := fmt.Sprintf("%s,%d,%d,1,A,%s,%d", identifier, parts, i+1, chunk, pad)
+		checksum := byte(0)
+		for j := 0; j < len(body); j++ {
+			checksum ^= body[j]
+		}
+		text += fmt.Sprintf("!%s*%02X\r\n", body, checksum)
+	}
+	return text
+}
+
+// positionReport creates a type 1 or 18 message.
+func positionReport(msgType uint8, mmsi uint32, lat, long float64) payloadBits {
+	pb := payloadBits{}
+	pb.put(6, int64(msgType))
+	pb.put(2, 0)
+	pb.put(30, int64(mmsi))
+	if msgType == 18 {
+		pb.put(8, 0)
+	} else {
+		pb.put(4, 0)    // status
+		pb.put(8, -128) // rate of turn not available
+	}
+	pb.put(10, 100) // 10 knots
+	pb.put(1, 0)
+	pb.put(28, int64(long*600000))
+	pb.put(27, int64(lat*600000))
+	pb.put(12, 900) // course
+	pb.put(9, 90)   // heading
+	pb.put(6, 30)   // second
+	pb.put(uint(168-len(pb)), 0)
+	return pb
+}
+
+// staticReport creates a type 5 or a type 24 part B message.
+func staticReport(msgType uint8, mmsi uint32) payloadBits {
+	pb := payloadBits{}
+	pb.put(6, int64(msgType))
+	pb.put(2, 0)
+	pb.put(30, int64(mmsi))
+	if msgType == 24 {
+		pb.put(2, 1)  // part B
+		pb.put(8, 70) // cargo
+		pb.put(88, 0) // vendor, model, serial and callsign
+		pb.put(30, 10<<21|10<<12|2<<6|2)
+		pb.put(6, 0)
+	} else {
+		pb.put(194, 0) // version, IMO, callsign and name
+		pb.put(8, 70)
+		pb.put(30, 10<<21|10<<12|2<<6|2)
+		pb.put(154, 0) // EPFD, ETA, draught and destination
+	}
+	return pb
+}
+
+// withIMO sets the IMO number of a type 5 message from staticReport.
+func (pb payloadBits) withIMO(imo uint32) payloadBits {
+	imoBits := payloadBits{}
+	imoBits.put(30, int64(imo))
+	copy(pb[40:70], imoBits)
+	return pb
+}
+
+// withShipType sets the ship type of a type 5 message from staticReport.
+func (pb payloadBits) withShipType(shipType uint8) payloadBits {
+	typeBits := payloadBits{}
+	typeBits.put(8, int64(shipType))
+	copy(pb[232:240], typeBits)
+	return pb
+}
+
+func TestCorruptMessagesAreSkipped(t *testing.T) {
+	a := NewArchive(10, 0, 0, 0, 0, 0, 0)
+	short := func(pb payloadBits, bits int) payloadBits {
+		return pb[:bits]
+	}
+	replay(a, positionReport(1, 0, 60, 5).sentences()+
+		positionReport(1, 1000000000, 60, 5).sentences()+
+		positionReport(1, 257000001, 95, 5).sentences()+
+		positionReport(18, 257000002, -60, -200).sentences()+
+		positionReport(1, 257000003, 91, 181).sentences()+ // not available
+		short(positionReport(1, 257000004, 60, 5), 100).sentences()+
+		short(positionReport(18, 257000005, 60, 5), 100).sentences()+
+		staticReport(5, 0).sentences()+
+		short(staticReport(5, 257000006), 200).sentences()+
+		staticReport(24, 0).sentences()+
+		short(staticReport(24, 257000007), 150).sentences())
+	stats := a.Stats()
+	if stats.Ships != 0 || len(stats.StoredByType) != 0 {
+		t.Errorf("Expected nothing to be stored, got %+v", stats)
+	}
+	expected := SkippedMessages{Undecodable: 4, BadMMSI: 4, BadCoordinates: 2, NoPosition: 1}
+	if stats.Skipped != expected {
+		t.Errorf("Expected %+v, got %+v", expected, stats.Skipped)
+	}
+
+	// the valid ones are stored
+	replay(a, staticReport(5, 257000006).sentences()+
+		staticReport(24, 257000007).sentences()+
+		positionReport(18, 257000005, 60, 5).sentences())
+	if stats = a.Stats(); stats.Ships != 3 || stats.WithStatic != 2 || stats.Indexed != 1 {
+		t.Errorf("Expected three ships of which one has a position, got %+v", stats)
+	}
+	// a position for a ship with only static information
+	replay(a, positionReport(1, 257000006, 60.5, 5.5).sentences())
+	if stats = a.Stats(); stats.Indexed != 2 || stats.NotIndexed != 0 {
+		t.Errorf("Expected the position to be indexed, got %+v", stats)
+	}
+}
+
+func TestImplausibleMMSIsAreSkipped(t *testing.T) {
+	a := NewArchive(10, 0, 0, 0, 0, 0, 0)
+	messages := positionReport(1, 123456789, 60, 5).sentences() + // leading 1 is reserved
+		positionReport(18, 999999999, 60, 5).sentences() +
+		staticReport(5, 900000001).sentences() +
+		positionReport(1, 111257001, 60, 5).sentences() + // SAR aircraft
+		staticReport(5, 2570001).sentences() // coast station
+	replay(a, messages)
+	stats := a.Stats()
+	if stats.Ships != 2 || stats.Skipped.ImplausibleMMSI != 3 {
+		t.Errorf("Expected three implausible MMSIs to be skipped, got %+v", stats)
+	}
+
+	a = NewArchive(10, 0, 0, 0, 0, 0, 0)
+	a.allowImplausibleMMSI = true
+	replay(a, messages)
+	if stats = a.Stats(); stats.Ships != 5 || stats.Skipped.ImplausibleMMSI != 0 {
+		t.Errorf("Expected all ships to be stored when allowed, got %+v", stats)
+	}
+}
+
+// safetyMessage creates a broadcast (type 14) or addressed (type 12) safety-related message.
+func safetyMessage(mmsi, destination uint32, text string) payloadBits {
+	pb := payloadBits{}
+	if destination == 0 {
+		pb.put(6, 14)
+		pb.put(2, 0)
+		pb.put(30, int64(mmsi))
+		pb.put(2, 0)
+	} else {
+		pb.put(6, 12)
+		pb.put(2, 0)
+		pb.put(30, int64(mmsi))
+		pb.put(2, 0) // sequence number
+		pb.put(30, int64(destination))
+		pb.put(2, 0)
+	}
+	for _, c := range []byte(text) {
+		pb.put(6, int64(c&63))
+	}
+	return pb
+}
+
+func TestSafetyMessages(t *testing.T) {
+	a := NewArchive(10, 0, 0, 0, 0, 0, 0)
+	replay(a, safetyMessage(2570001, 0, "GALE WARNING").sentences()+
+		safetyMessage(2570001, 0, "GALE WARNING").sentences()+ // retransmitted
+		safetyMessage(257012345, 2570001, "QSL").sentences())
+	stats := a.Stats()
+	if stats.SafetyMessages != 2 || stats.StoredByType["14"] != 1 || stats.StoredByType["12"] != 1 {
+		t.Errorf("Expected two safety messages to be stored, got %+v", stats)
+	}
+	messages := a.SafetyMessages(time.Now().Add(-time.Hour))
+	if len(messages) != 2 || messages[0].Text != "QSL" || messages[0].Destination != 2570001 ||
+		messages[1].Text != "GALE WARNING" || messages[1].Source != 2570001 {
+		t.Errorf("Expected the addressed message before the broadcast, got %+v", messages)
+	}
+	if messages = a.SafetyMessages(time.Now()); len(messages) != 0 {
+		t.Errorf("Expected no messages received in the future, got %+v", messages)
+	}
+}
+
+// longRangeReport creates a long-range position report (type 27),
+// with positions in 1/10 minutes.
+func longRangeReport(mmsi uint32, lat, long float64) payloadBits {
+	pb := payloadBits{}
+	pb.put(6, 27)
+	pb.put(2, 0)
+	pb.put(30, int64(mmsi))
+	pb.put(1, 0) // accuracy
+	pb.put(1, 0) // RAIM
+	pb.put(4, 0) // status
+	pb.put(18, int64(long*600))
+	pb.put(17, int64(lat*600))
+	pb.put(6, 10) // speed
+	pb.put(9, 90) // course
+	pb.put(1, 1)  // not delayed
+	pb.put(1, 0)
+	return pb
+}
+
+func TestLongRangeReports(t *testing.T) {
+	a := NewArchive(10, 0, 0, 0, 0, 0, 0)
+	// received 45 seconds past, so that the second of type 1 is this minute
+	start := time.Now().Truncate(time.Hour).Add(-time.Hour + 45*time.Second)
+	save := func(after time.Duration, pb payloadBits) {
+		messages := make(chan *nmeais.Message, 1)
+		messages <- parseMessages([]string{pb.sentences()}, start.Add(after), 0)[0]
+		close(messages)
+		a.Save(messages)
+	}
+	expect := func(when string, lat, long float64, coarse bool) {
+		if lat2, long2, _ := a.db.KnownCoords(257012345); lat2 != lat || long2 != long {
+			t.Errorf("%s: expected the ship at %f,%f, got %f,%f", when, lat, long, lat2, long2)
+		}
+		selected := a.db.SelectTrack(257012345, 6, 0, 0, false, Log)
+		if strings.Contains(selected, `"position_resolution_m":185.2`) != coarse {
+			t.Errorf("%s: expected resolution %t in %s", when, coarse, selected)
+		}
+		rects := geo.SplitViewRect(lat-0.01, long-0.01, lat+0.01, long+0.01)
+		if json, _ := a.FindWithin(rects, storage.MatchFilter{}, 6, false, false, false, false, 0); !strings.Contains(json, "257012345") {
+			t.Errorf("%s: expected to find the ship at %f,%f, got %s", when, lat, long, json)
+		}
+	}
+	save(0, positionReport(1, 257012345, 60, 5))
+	expect("first", 60, 5, false)
+	save(time.Minute, longRangeReport(257012345, 60.2, 5.2))
+	expect("coarse just after precise", 60, 5, false)
+	save(12*time.Minute, longRangeReport(257012345, 60.4, 5.4))
+	expect("coarse long after precise", 60.4, 5.4, true)
+	// a precise fix that is a little older than the coarse one
+	save(8*time.Minute, positionReport(1, 257012345, 60.1, 5.1))
+	expect("precise after coarse", 60.1, 5.1, false)
+	save(13*time.Minute, longRangeReport(257012345, 60.6, 5.6))
+	expect("coarse shortly after precise", 60.1, 5.1, false)
+
+	if stats := a.Stats(); stats.StoredByType["27"] != 1 || stats.StoredByType["1"] != 2 {
+		t.Errorf("Expected one long-range and two precise positions to be stored, got %+v", stats)
+	}
+}
+
+func TestSuppressedClasses(t *testing.T) {
+	a := NewArchive(10, 0, 0, 0, 0, 0, 0)
+	a.db.SuppressTypes = map[storage.ShipType]bool{35: true, 55: true}
+	const military, cargo = 257000035, 257000070
+	messages := make(chan *nmeais.Message, 4)
+	for _, m := range parseMessages([]string{
+		positionReport(1, military, 60, 5).sentences(),
+		positionReport(1, cargo, 60.01, 5.01).sentences(),
+		staticReport(5, military).withShipType(35).sentences(),
+		staticReport(5, cargo).sentences(),
+	}, time.Now(), time.Second) {
+		messages <- m
+	}
+	close(messages)
+	a.Save(messages)
+
+	rects := geo.SplitViewRect(59, 4, 61, 6)
+	for _, filter := range []storage.MatchFilter{{}, {Items: storage.OnlyShips}} {
+		json, _ := a.FindWithin(rects, filter, 6, false, false, false, false, 0)
+		if strings.Contains(json, "257000035") || !strings.Contains(json, "257000070") {
+			t.Errorf("Expected only the cargo ship with filter %+v, got %s", filter, json)
+		}
+		terse, _ := a.FindWithin(rects, filter, 6, true, false, false, false, 0)
+		if strings.Contains(terse, "257000035") || !strings.Contains(terse, "257000070") {
+			t.Errorf("Expected only the cargo ship in terse results, got %s", terse)
+		}
+	}
+	if selected := a.Select(military, 6, 0, 0, false); selected != "" {
+		t.Errorf("Expected the military ship to be unknown, got %s", selected)
+	}
+	if _, _, _, known := a.Track(military, 0, 0); known {
+		t.Error("Expected no track for the military ship")
+	}
+	csv := &strings.Builder{}
+	if err := a.ExportCSV(csv); err != nil || strings.Contains(csv.String(), "257000035") {
+		t.Errorf("Expected the military ship to be left out of the CSV export, got %v %s", err, csv.String())
+	}
+	if lat, _, known := a.db.KnownCoords(military); !known || lat != 60 {
+		t.Error("Expected the military ship to still be stored")
+	}
+}
+
+// weatherReport creates a binary broadcast (type 8) from a coast station,
+// which is meteorological data with only wind and air temperature if fi is 31.
+func weatherReport(fi uint8, lat, long float64, windSpeed, temperature int64) payloadBits {
+	pb := payloadBits{}
+	pb.put(6, 8)
+	pb.put(2, 0)
+	pb.put(30, 2579999)
+	pb.put(2, 0)
+	pb.put(10, 1) // international
+	pb.put(6, int64(fi))
+	pb.put(25, int64(long*60000))
+	pb.put(24, int64(lat*60000))
+	pb.put(1, 0)
+	pb.put(5, 14) // 14th 10:20
+	pb.put(5, 10)
+	pb.put(6, 20)
+	pb.put(7, windSpeed)
+	pb.put(7, 127) // gust
+	pb.put(9, 225) // wind direction
+	pb.put(9, 360) // gust direction
+	pb.put(11, temperature)
+	pb.put(7, 101) // humidity
+	pb.put(10, 501)
+	pb.put(9, 403) // pressure
+	pb.put(uint(360-len(pb)), 0)
+	return pb
+}
+
+func TestWeatherReports(t *testing.T) {
+	a := NewArchive(10, 0, 0, 0, 0, 0, 0)
+	replay(a, weatherReport(31, 60.4, 5.3, 12, -35).sentences()+
+		weatherReport(31, 60.4, 5.3, 127, -30).sentences()+ // replaces the first
+		weatherReport(31, 91, 181, 10, 0).sentences()+
+		weatherReport(11, 59, 5, 10, 0).sentences())
+	stats := a.Stats()
+	if stats.StoredByType["8"] != 2 || stats.Skipped.UnknownApplication != 1 || stats.Skipped.NoPosition != 1 {
+		t.Errorf("Expected two reports to be stored and the others skipped, got %+v", stats)
+	}
+	if stats.Ships != 0 {
+		t.Errorf("Expected weather reports to not create ships, got %d", stats.Ships)
+	}
+	rects, _ := geo.ParseViewRects([]string{"5,60,6,61"})
+	geojson := a.Weather(rects)
+	if !strings.Contains(geojson, `"wind_direction":225,"air_temperature":-3,`) {
+		t.Errorf("Expected the second report with air temperature and wind direction, got %s", geojson)
+	}
+	if strings.Contains(geojson, "wind_speed") || strings.Contains(geojson, "humidity") {
+		t.Errorf("Expected values that are not available to be left out, got %s", geojson)
+	}
+	if !strings.Contains(geojson, `-14T10:20:00Z","received":`) {
+		t.Errorf("Expected the report time to be from the message, got %s", geojson)
+	}
+}
+
+func TestStaticReportPartsAreMerged(t *testing.T) {
+	a := NewArchive(10, 0, 0, 0, 0, 0, 0)
+	expect := func(when string, expected ...string) {
+		selected := a.db.SelectTrack(271041815, 6, 0, 0, false, Log)
+		for _, e := range expected {
+			if !strings.Contains(selected, e) {
+				t.Errorf("%s: expected %s in %s", when, e, selected)
+			}
+		}
+	}
+	// needs a position to be selected
+	replay(a, positionReport(1, 271041815, 41, 29).sentences())
+	partA := "!AIVDM,1,1,,A,H42O55i18tMET00000000000000,2*6D\r\n"
+	partB := "!AIVDM,1,1,,A,H42O55lti4hhhilD3nink000?050,0*40\r\n"
+	replay(a, partA+partB)
+	expect("part A then B", `"name":"PROGUY"`, `"callSign":"TC6163"`, `"length":15`, `"width":5`)
+	replay(a, partA)
+	expect("part A again", `"name":"PROGUY"`, `"callSign":"TC6163"`, `"length":15`)
+	replay(a, staticReport(5, 271041815).sentences())
+	expect("type 5", `"name":"PROGUY"`, `"callSign":"TC6163"`, `"length":20`, `"width":4`)
+
+	before := a.Stats().Skipped.Undecodable
+	partC := payloadBits{}
+	partC.put(6, 24)
+	partC.put(2, 0)
+	partC.put(30, 271041815)
+	partC.put(2, 2)
+	partC.put(128, 0)
+	replay(a, partC.sentences())
+	if a.Stats().Skipped.Undecodable != before+1 {
+		t.Error("Expected a type 24 with part number 2 to be skipped")
+	}
+}
+
+func TestReflaggedShipsAreLinked(t *testing.T) {
+	a := NewArchive(10, 0, 0, 0, 0, 0, 0)
+	rects := geo.SplitViewRect(59, 4, 61, 6)
+	replay(a, staticReport(5, 257000001).withIMO(9074729).sentences()+
+		positionReport(1, 257000001, 60, 5).sentences())
+	// reflagged
+	replay(a, staticReport(5, 311000001).withIMO(9074729).sentences()+
+		positionReport(1, 311000001, 60.1, 5.1).sentences())
+
+	if mmsi, known := a.WithIMO(9074729); !known || mmsi != 311000001 {
+		t.Errorf("Expected the IMO number to belong to the new MMSI, got %d %t", mmsi, known)
+	}
+	if selected := a.Select(311000001, 6, 0, 0, false); !strings.Contains(selected, `"previous_mmsi":257000001`) ||
+		!strings.Contains(selected, `"imo":9074729`) {
+		t.Errorf("Expected the new ship to link to the old, got %s", selected)
+	}
+	if selected := a.Select(257000001, 6, 0, 0, false); !strings.Contains(selected, `"replaced_by_mmsi":311000001`) {
+		t.Errorf("Expected the old ship to link to the new, got %s", selected)
+	}
+	if json, _ := a.FindWithin(rects, storage.MatchFilter{}, 6, false, false, false, false, 0); strings.Contains(json, "257000001") ||
+		!strings.Contains(json, "311000001") {
+		t.Errorf("Expected only the new ship on the map, got %s", json)
+	}
+
+	// unless the old MMSI is still in use
+	pos := storage.UnknownPos
+	pos.Pos = geo.Point{Lat: 60, Long: 5}
+	pos.At, pos.Received = time.Now().Add(time.Minute), time.Now().Add(time.Second)
+	a.db.UpdateDynamic(257000001, "test", pos)
+	if json, _ := a.FindWithin(rects, storage.MatchFilter{}, 6, false, false, false, false, 0); !strings.Contains(json, "257000001") {
+		t.Errorf("Expected the old ship to be shown after sending a position, got %s", json)
+	}
+	// invalid IMO numbers are not linked
+	replay(a, staticReport(5, 257000002).withIMO(1234560).sentences()+
+		staticReport(5, 257000003).withIMO(1234560).sentences())
+	if selected := a.Select(257000003, 6, 0, 0, false); strings.Contains(selected, "previous_mmsi") ||
+		strings.Contains(selected, `"imo"`) {
+		t.Errorf("Expected an invalid IMO number to be ignored, got %s", selected)
+	}
+}
+
+func TestOwnShipIsHidden(t *testing.T) {
+	a := NewArchive(10, 0, 0, 0, 0, 0, 0)
+	replay(a, positionReport(1, 257000001, 59, 5).sentences()+
+		positionReport(1, 257000002, 59.1, 5).ownShip()+
+		staticReport(5, 257000002).ownShip())
+	if stats := a.Stats(); stats.Ships != 2 || stats.Indexed != 2 {
+		t.Errorf("Expected the own ship to be stored like other ships, got %+v", stats)
+	}
+	rects := geo.SplitViewRect(-90, -180, 90, 180)
+	found, _ := a.FindWithin(rects, storage.MatchFilter{}, geo.FullPrecision, false, false, false, false, 0)
+	if !strings.Contains(found, `"id":257000001`) || strings.Contains(found, `"id":257000002`) {
+		t.Errorf("Expected the own ship to be excluded, got %s", found)
+	}
+	found, _ = a.FindWithin(rects, storage.MatchFilter{IncludeOwnShip: true}, geo.FullPrecision, false, false, false, false, 0)
+	if !strings.Contains(found, `"id":257000001`) || !strings.Contains(found, `"item_type":"Own ship"`) {
+		t.Errorf("Expected the own ship to be included, got %s", found)
+	}
+	if selected := a.Select(257000002, 6, 0, 0, false); !strings.Contains(selected, `"item_type":"Own ship"`) {
+		t.Errorf("Expected the own ship to be tagged, got %s", selected)
+	}
+	if selected := a.Select(257000001, 6, 0, 0, false); strings.Contains(selected, `"item_type":"Own ship"`) {
+		t.Errorf("Expected only the own ship to be tagged, got %s", selected)
+	}
+}
+
+func TestEvictLeastRecentlyUpdated(t *testing.T) {
+	a := NewArchive(10, 0, 0, 0, 0, 0, 0)
+	a.maxShips = 100
+	a.db.Evictable = true
+	replay(a, staticReport(5, 257999999).sentences())
+	for i := 0; i < 1000; i += 50 { // replay() blocks with more than 100 sentences
+		sentences := ""
+		for j := i; j < i+50; j++ {
+			sentences += positionReport(1, uint32(257000000+j), 50+float64(j)/100, 5).sentences()
+		}
+		replay(a, sentences)
+	}
+	stats := a.Stats()
+	if stats.Ships != 100 || stats.Indexed != 100 || stats.Evicted != 901 {
+		t.Fatalf("Expected 100 ships after evicting 901, got %+v", stats)
+	}
+	rects := geo.SplitViewRect(-90, -180, 90, 180)
+	found, _ := a.FindWithin(rects, storage.MatchFilter{}, geo.FullPrecision, false, false, false, false, 0)
+	if n := strings.Count(found, `"id":`); n != 100 || a.VanishedShips() != 0 {
+		t.Errorf("Expected to find 100 ships that are all in the DB, found %d and %d vanished", n, a.VanishedShips())
+	}
+	for i := 0; i < 1000; i++ {
+		_, _, known := a.KnownPosition(uint32(257000000 + i))
+		if known != (i >= 900) {
+			t.Errorf("Expected ship %d to be kept: %t, got %t", i, i >= 900, known)
+		}
+	}
+}
+
+func TestWriteWithinDoesntBlockEviction(t *testing.T) {
+	a := NewArchive(10, 0, 0, 0, 0, 0, 0)
+	replay(a, positionReport(1, 257000001, 60, 5).sentences())
+	r, w := io.Pipe()
+	go func() {
+		err := a.WriteWithin(w, geo.SplitViewRect(-90, -180, 90, 180), storage.MatchFilter{}, 6, false, false, false, 0)
+		w.CloseWithError(err)
+	}()
+	// reading one byte leaves WriteWithin blocked on writing the rest,
+	// like a slow client
+	first := make([]byte, 1)
+	if _, err := io.ReadFull(r, first); err != nil {
+		t.Fatal(err)
+	}
+	evicted := make(chan struct{})
+	go func() {
+		a.evictLock.Lock()
+		a.evictLock.Unlock()
+		close(evicted)
+	}()
+	select {
+	case <-evicted:
+	case <-time.After(time.Second):
+		t.Error("Expected evicting to not wait for the client")
+	}
+	rest, err := io.ReadAll(r)
+	if err != nil || !strings.Contains(string(first)+string(rest), `"id":257000001`) {
+		t.Errorf("Expected the ship, got %v %s%s", err, first, rest)
+	}
+}
+
+func TestJitterDoesntMoveTheIndex(t *testing.T) {
+	a := NewArchive(10, 0, 0, 0, 0, 0, 0)
+	start := time.Now().Truncate(time.Minute).Add(-time.Hour)
+	save := func(source string, after time.Duration, lat float64) string {
+		m := parseMessages([]string{positionReport(1, 257012345, lat, 5).sentences()}, start.Add(after), 0)[0]
+		m.SourceName = source
+		decision, err := a.save(m)
+		if err != nil {
+			t.Errorf("Unexpected error saving %f from %s: %s", lat, source, err.Error())
+		}
+		return decision
+	}
+	indexedAt := func(lat float64) bool {
+		rects := geo.SplitViewRect(lat-0.00001, 4.9999, lat+0.00001, 5.0001)
+		return len(*a.rt.FindWithinAny(rects)) == 1
+	}
+	save("a", 0, 60)
+	// another receiver hears the same report a second later
+	if decision := save("b", time.Second, 60.0001); decision != skippedOutdated {
+		t.Errorf("Expected the position from another receiver to be dropped, got %q", decision)
+	}
+	if !indexedAt(60) || indexedAt(60.0001) {
+		t.Error("Expected the index to keep the position that was stored")
+	}
+	if decision := save("a", time.Minute, 60.01); decision != "position saved" {
+		t.Errorf("Expected the next position to be saved, got %q", decision)
+	}
+	if !indexedAt(60.01) || indexedAt(60) {
+		t.Error("Expected the index to follow the next position")
+	}
+	if stats := a.Stats(); stats.Jitter != 1 || stats.NotIndexed != 0 {
+		t.Errorf("Expected one position dropped as jitter and none not indexed, got %+v", stats)
+	}
+}
+
+func TestExportCSV(t *testing.T) {
+	a := NewArchive(10, 0, 0, 0, 0, 0, 0)
+	replay(a, "!BSVDM,1,1,,A,14S:Eb001ePRmHBTAAFnrmV60PRk,0*1F\r\n"+ // type 1 from 305305000
+		"!AIVDM,2,1,1,A,55?MbV02;H;s<HtKR20EHE:0@T4@Dn2222222216L961O5Gf0NSQEp6ClRp8,0*1C\r\n"+
+		"!AIVDM,2,2,1,A,88888888880,2*25\r\n") // type 5 from 351759000
+	buf := &bytes.Buffer{}
+	if err := a.ExportCSV(buf); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(buf).ReadAll()
+	if err != nil {
+		t.Fatalf("Invalid CSV: %s", err.Error())
+	}
+	if len(rows) != 3 || len(rows[0]) != len(csvHeader) || rows[0][0] != "mmsi" {
+		t.Fatalf("Expected a header and two ships, got %v", rows)
+	}
+	if rows[1][0] != "305305000" || rows[1][8] == "" || rows[1][1] != "" || rows[1][15] != "1" {
+		t.Errorf("Expected a position without name for 305305000, got %v", rows[1])
+	}
+	if rows[2][0] != "351759000" || rows[2][1] == "" || rows[2][8] != "" || rows[2][15] != "0" {
+		t.Errorf("Expected a name without position for 351759000, got %v", rows[2])
+	}
+}
+
+func TestDecodeRateOfTurn(t *testing.T) {
+	cases := []struct {
+		raw      int8
+		expected float32
+	}{
+		{0, 0},
+		{1, 0.0446},
+		{-1, -0.0446},
+		{126, 708.7},
+		{-126, -708.7},
+		{127, float32(math.NaN())},  // more than 5°/30s right
+		{-127, float32(math.NaN())}, // more than 5°/30s left
+		{-128, float32(math.NaN())}, // not available
+	}
+	for _, c := range cases {
+		got := decodeRateOfTurn(c.raw)
+		if math.IsNaN(float64(c.expected)) != math.IsNaN(float64(got)) ||
+			math.Abs(float64(got-c.expected)) > 0.1 {
+			t.Errorf("Expected %d to be %f, got %f", c.raw, c.expected, got)
+		}
+	}
+	if speed := decodeSpeed(1023); speed != float32(1023)/10 {
+		t.Errorf("Expected speed not available to be converted to 102.3, got %f", speed)
+	}
+}
+
+func TestFixTime(t *testing.T) {
+	at := func(hour, minute, second, ms int) time.Time {
+		return time.Date(2017, 12, 31, hour, minute, second, ms*1000000, time.UTC)
+	}
+	cases := []struct {
+		second   uint8
+		received time.Time
+		expected time.Time
+	}{
+		{30, at(12, 0, 31, 500), at(12, 0, 30, 0)},
+		{31, at(12, 0, 31, 500), at(12, 0, 31, 0)},
+		{0, at(12, 1, 0, 0), at(12, 1, 0, 0)},
+		{59, at(12, 1, 1, 0), at(12, 0, 59, 0)},                      // from the previous minute
+		{59, at(0, 0, 2, 0), at(23, 59, 59, 0).Add(-24 * time.Hour)}, // and the previous day
+		{33, at(12, 0, 31, 0), at(12, 0, 31, 0)},                     // a clock is slightly off
+		{40, at(12, 0, 31, 0), at(11, 59, 40, 0)},                    // a delay of almost a minute
+		{60, at(12, 0, 31, 500), at(12, 0, 31, 500)},                 // not available
+		{63, at(12, 0, 31, 500), at(12, 0, 31, 500)},                 // dead reckoning
+	}
+	for _, c := range cases {
+		if fix := fixTime(c.second, c.received); !fix.Equal(c.expected) {
+			t.Errorf("Expected second %d received at %s to be %s, got %s",
+				c.second, c.received.Format(time.StampMilli), c.expected.Format(time.StampMilli),
+				fix.Format(time.StampMilli))
+		}
+	}
+}
+
+func TestReportTime(t *testing.T) {
+	received := time.Date(2018, 1, 14, 10, 20, 30, 0, time.UTC)
+	cases := []struct {
+		day, hour, minute uint8
+		expected          time.Time
+	}{
+		{14, 10, 20, time.Date(2018, 1, 14, 10, 20, 0, 0, time.UTC)},
+		{13, 23, 59, time.Date(2018, 1, 13, 23, 59, 0, 0, time.UTC)},
+		{14, 10, 21, time.Date(2017, 12, 14, 10, 21, 0, 0, time.UTC)}, // the previous month
+		{31, 0, 0, time.Date(2017, 12, 31, 0, 0, 0, 0, time.UTC)},     // and year
+		{0, 10, 20, received}, // not available
+		{14, 24, 20, received},
+		{14, 10, 60, received},
+	}
+	for _, c := range cases {
+		if at := reportTime(c.day, c.hour, c.minute, received); !at.Equal(c.expected) {
+			t.Errorf("Expected day %d %02d:%02d to be %s, got %s", c.day, c.hour, c.minute, c.expected, at)
+		}
+	}
+}
+
+// Compares the size of in_area responses for 10k ships with and without
+// rounding the coordinates.
+func BenchmarkFindWithinPrecision(b *testing.B) {
+	a := NewArchive(10, 0, 0, 0, 0, 0, 0)
+	rand.Seed(1)
+	for mmsi := uint32(257000000); mmsi < 257010000; mmsi++ {
+		pos := storage.UnknownPos
+		pos.At = time.Now()
+		pos.Pos = geo.Point{Lat: rand.Float64()*170 - 85, Long: rand.Float64()*360 - 180}
+		pos.Speed, pos.Course = rand.Float32()*30, rand.Float32()*360
+		a.rt.InsertData(pos.Pos.Lat, pos.Pos.Long, mmsi)
+		a.db.UpdateDynamic(mmsi, "benchmark", pos)
+	}
+	rects := geo.SplitViewRect(-90, -180, 90, 180)
+	for _, c := range []struct {
+		name      string
+		precision int
+	}{{"full", geo.FullPrecision}, {"default", geo.DefaultPrecision}} {
+		b.Run(c.name, func(b *testing.B) {
+			size := 0
+			for i := 0; i < b.N; i++ {
+				json, _ := a.FindWithin(rects, storage.MatchFilter{}, c.precision, false, false, false, false, 0)
+				size = len(json)
+			}
+			b.ReportMetric(float64(size), "bytes/response")
+		})
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tormol/AIS/nmeais"
+	"github.com/tormol/AIS/storage"
+)
+
+// The decode subcommand decodes captured NMEA sentences offline, with the
+// same code the archive stores messages with:
+//
+//	ais_server decode [-format=json|csv] [-types=1,2,3] [-stats] [-validate] [file]...
+//
+// It reads the files (or stdin if none or -) one sentence per line,
+// and writes one JSON object or CSV row per message to stdout.
+
+// decodeCSVColumns is the header of -format=csv, which only has position reports.
+var decodeCSVColumns = []string{"mmsi", "type", "time", "lat", "lon", "speed", "course", "heading", "nav_status"}
+
+// decodedAtoN is the line written for aids to navigation (type 21).
+type decodedAtoN struct {
+	MMSI        uint32    `json:"mmsi"`
+	Type        uint8     `json:"type"`
+	Lat         float64   `json:"lat"`
+	Lon         float64   `json:"lon"`
+	Name        string    `json:"name,omitempty"`
+	AidType     string    `json:"aid_type"`
+	Virtual     bool      `json:"virtual"`
+	OffPosition bool      `json:"off_position"`
+	Time        time.Time `json:"time"`
+	Source      string    `json:"source"`
+}
+
+// decodedWeather is the line written for meteorological reports (type 8).
+type decodedWeather struct {
+	Type   uint8   `json:"type"`
+	Lat    float64 `json:"lat"`
+	Lon    float64 `json:"lon"`
+	Source string  `json:"source"`
+	storage.MetProperties
+}
+
+// offlineDecoder is the state of the decode subcommand.
+type offlineDecoder struct {
+	format   string         // json or csv
+	types    map[uint8]bool // nil means all
+	stats    bool           // only print the summary
+	validate bool           // run Sentence.Validate() and report failures
+	now      time.Time      // received time of sentences without a TAG block
+	out      *bufio.Writer  // records
+	csv      *csv.Writer    // wraps out if format is csv
+	errOut   io.Writer      // failures and the summary
+	ma       nmeais.MessageAssembler
+	lines    uint64                      // that are not empty
+	failed   uint64                      // lines that couldn't be parsed
+	messages uint64                      // assembled
+	results  map[uint8]map[string]uint64 // per message type, "decoded" or why not
+	errors   map[string]uint64           // of sentences and assembling
+}
+
+// parseTypes parses a comma-separated list of message types.
+func parseTypes(list string) (map[uint8]bool, error) {
+	if list == "" {
+		return nil, nil
+	}
+	types := make(map[uint8]bool)
+	for _, t := range strings.Split(list, ",") {
+		n, err := strconv.ParseUint(strings.TrimSpace(t), 10, 8)
+		if err != nil || n == 0 || n > nmeais.MaxType {
+			return nil, fmt.Errorf("%q is not a message type", t)
+		}
+		types[uint8(n)] = true
+	}
+	return types, nil
+}
+
+// runDecode runs the decode subcommand with the arguments after "decode",
+// and returns the exit status:
+// 1 if more than -max-failed of the lines couldn't be parsed,
+// and 2 if the arguments are invalid or a file cannot be read.
+func runDecode(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("decode", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	format := flags.String("format", "json", "Write json lines, or csv with only position reports")
+	types := flags.String("types", "", "Comma-separated message types to decode. Default is all")
+	stats := flags.Bool("stats", false, "Print how many messages of each type were decoded and why others failed, instead of the messages")
+	validate := flags.Bool("validate", false, "Check sentences more strictly, and report the lines that fail")
+	maxFailed := flags.Float64("max-failed", 0.1, "Exit with status 1 if more than this fraction of the lines cannot be parsed")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	d := &offlineDecoder{
+		format:   *format,
+		stats:    *stats,
+		validate: *validate,
+		now:      time.Now(),
+		out:      bufio.NewWriter(stdout),
+		errOut:   stderr,
+		results:  make(map[uint8]map[string]uint64),
+		errors:   make(map[string]uint64),
+	}
+	var err error
+	if d.types, err = parseTypes(*types); err != nil {
+		fmt.Fprintf(stderr, "-types: %s\n", err.Error())
+		return 2
+	}
+	switch d.format {
+	case "json":
+	case "csv":
+		d.csv = csv.NewWriter(d.out)
+		if !d.stats {
+			d.csv.Write(decodeCSVColumns)
+		}
+	default:
+		fmt.Fprintf(stderr, "-format must be json or csv, not %q\n", d.format)
+		return 2
+	}
+
+	files := flags.Args()
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+	for _, name := range files {
+		if name == "-" {
+			err = d.decode(stdin, "stdin")
+		} else if f, openErr := os.Open(name); openErr != nil {
+			err = openErr
+		} else {
+			err = d.decode(f, name)
+			f.Close()
+		}
+		if err != nil {
+			fmt.Fprintf(stderr, "%s: %s\n", name, err.Error())
+			return 2
+		}
+	}
+
+	if d.csv != nil {
+		d.csv.Flush()
+	}
+	if d.stats {
+		d.printStats()
+	}
+	d.out.Flush()
+	if d.lines != 0 && float64(d.failed)/float64(d.lines) > *maxFailed {
+		fmt.Fprintf(stderr, "%d of %d lines could not be parsed\n", d.failed, d.lines)
+		return 1
+	}
+	return 0
+}
+
+// decode reads and decodes the sentences of one file.
+// source is used in the records and in reported failures.
+func (d *offlineDecoder) decode(r io.Reader, source string) error {
+	d.ma = nmeais.NewMessageAssembler(maxSentencesBetween, maxMessageTimespan, source)
+	tagOffset := time.Duration(0) // like decodeSentences()
+	lines := bufio.NewScanner(r)
+	lines.Buffer(make([]byte, 0, 4096), 1024*1024)
+	for n := 1; lines.Scan(); n++ {
+		line := strings.TrimSpace(lines.Text())
+		if line == "" {
+			continue
+		}
+		d.lines++
+		// ParseSentence expects the line ending
+		s, err := nmeais.ParseSentence([]byte(line+"\r\n"), d.now)
+		if d.validate {
+			err = s.Validate(err)
+		}
+		if err != nil {
+			d.failed++
+			d.fail(source, n, err.Error())
+			continue
+		}
+		if !s.TagTime.IsZero() {
+			tagOffset = s.TagTime.Sub(d.now)
+		}
+		s.Received = s.Received.Add(tagOffset)
+		m, err := d.ma.Accept(s)
+		if err != nil {
+			d.fail(source, n, err.Error())
+		}
+		if m != nil {
+			d.messages++
+			d.record(m)
+		}
+	}
+	return lines.Err()
+}
+
+// fail counts an error, and reports it with the line if -validate is used.
+func (d *offlineDecoder) fail(source string, line int, err string) {
+	d.errors[err]++
+	if d.validate {
+		fmt.Fprintf(d.errOut, "%s:%d: %s\n", source, line, err)
+	}
+}
+
+// record decodes a message and writes it unless only stats are printed.
+func (d *offlineDecoder) record(m *nmeais.Message) {
+	t := m.Type()
+	if d.types != nil && !d.types[t] {
+		return
+	}
+	received := m.Received()
+	decoded, skip, err := decodeMessage(m, received)
+	if d.results[t] == nil {
+		d.results[t] = make(map[string]uint64)
+	}
+	if skip != "" {
+		if err != nil && skip != skippedType {
+			skip += ": " + err.Error()
+		}
+		d.results[t][skip]++
+		return
+	}
+	d.results[t]["decoded"]++
+	if d.stats {
+		return
+	}
+	if d.csv != nil {
+		if decoded.Pos != nil && decoded.AtoN == nil {
+			d.writeCSV(m, decoded)
+		}
+		return
+	}
+	var line interface{}
+	switch {
+	case decoded.Command != nil:
+		line = decoded.Command
+	case decoded.Safety != nil:
+		line = decoded.Safety
+	case decoded.Weather != nil:
+		line = decodedWeather{
+			Type:          t,
+			Lat:           decoded.Weather.Pos.Lat,
+			Lon:           decoded.Weather.Pos.Long,
+			Source:        m.SourceName,
+			MetProperties: decoded.Weather.Properties(),
+		}
+	case decoded.AtoN != nil:
+		pos := storage.SanitizePos(*decoded.Pos)
+		line = decodedAtoN{
+			MMSI:        decoded.MMSI,
+			Type:        t,
+			Lat:         pos.Pos.Lat,
+			Lon:         pos.Pos.Long,
+			Name:        decoded.Info.ShipName,
+			AidType:     decoded.AtoN.Type.String(),
+			Virtual:     decoded.AtoN.Virtual,
+			OffPosition: decoded.AtoN.OffPosition,
+			Time:        pos.At.UTC(),
+			Source:      m.SourceName,
+		}
+	case decoded.Pos != nil:
+		line = newDecodedPosition(m, decoded.MMSI, *decoded.Pos)
+	default:
+		line = newDecodedStatic(m, decoded.MMSI, received, *decoded.Info)
+	}
+	encoded, err := json.Marshal(line)
+	if err != nil {
+		d.errors["JSON error: "+err.Error()]++
+		return
+	}
+	d.out.Write(append(encoded, '\n'))
+}
+
+// writeCSV writes a position report as a row of decodeCSVColumns.
+func (d *offlineDecoder) writeCSV(m *nmeais.Message, decoded decodedMessage) {
+	line := newDecodedPosition(m, decoded.MMSI, *decoded.Pos)
+	optional := func(v *float32) string {
+		if v == nil {
+			return ""
+		}
+		return strconv.FormatFloat(float64(*v), 'f', -1, 32)
+	}
+	d.csv.Write([]string{
+		strconv.FormatUint(uint64(line.MMSI), 10),
+		strconv.Itoa(int(line.Type)),
+		line.Time.Format(time.RFC3339),
+		strconv.FormatFloat(line.Lat, 'f', -1, 64),
+		strconv.FormatFloat(line.Lon, 'f', -1, 64),
+		optional(line.Speed),
+		optional(line.Course),
+		optional(line.Heading),
+		decoded.Pos.NavStatus.String(),
+	})
+}
+
+// printStats writes the number of lines and messages,
+// then what happened to each message type, and then the errors by frequency.
+func (d *offlineDecoder) printStats() {
+	fmt.Fprintf(d.out, "%d lines, %d failed to parse, %d messages\n", d.lines, d.failed, d.messages)
+	types := make([]int, 0, len(d.results))
+	for t := range d.results {
+		types = append(types, int(t))
+	}
+	sort.Ints(types)
+	for _, t := range types {
+		fmt.Fprintf(d.out, "type %d:\n", t)
+		printCounts(d.out, d.results[uint8(t)])
+	}
+	if len(d.errors) != 0 {
+		fmt.Fprintln(d.out, "errors:")
+		printCounts(d.out, d.errors)
+	}
+}
+
+// printCounts writes the counts from highest to lowest, indented.
+func printCounts(w io.Writer, counts map[string]uint64) {
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	for _, k := range keys {
+		fmt.Fprintf(w, "\t%d %s\n", counts[k], k)
+	}
+}
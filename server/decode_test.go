@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+// decodeFixture has a tagged type 1, a type 5 in two parts,
+// an aid to navigation, a corrupted sentence and a base station report.
+const decodeFixture = "\\s:2573145,c:1492683034*0B\\!BSVDM,1,1,,A,14S:Eb001ePRmHBTAAFnrmV60PRk,0*1F\r\n" +
+	"!AIVDM,2,1,1,A,55?MbV02;H;s<HtKR20EHE:0@T4@Dn2222222216L961O5Gf0NSQEp6ClRp8,0*1C\r\n" +
+	"!AIVDM,2,2,1,A,88888888880,2*25\r\n" +
+	"!AIVDM,1,1,,B,E>kb9O9aS@7PUh10dh19@;0Tah2cWrfP:l?M`00003vP100,0*01\r\n" +
+	"!AIVDM,1,1\r\n" +
+	"!BSVDM,1,1,,A,4030p:1umR@<?Nw`rHOL0m?02@GH,0*05\r\n"
+
+func TestDecodeMessage(t *testing.T) {
+	received := time.Date(2017, 4, 20, 10, 10, 34, 0, time.UTC)
+	messages := parseMessages([]string{decodeFixture +
+		positionReport(18, 257000001, 59.5, 5.5).sentences() +
+		positionReport(1, 257000002, 91, 181).sentences() +
+		positionReport(1, 0, 59.5, 5.5).sentences() +
+		staticReport(24, 257000003).sentences(),
+	}, received, 0)
+	if len(messages) != 8 {
+		t.Fatalf("Expected 8 messages, got %d", len(messages))
+	}
+	cases := []struct {
+		mmsi            uint32
+		skip            string
+		pos, info, aton bool
+	}{
+		{305305000, "", true, false, false},
+		{351759000, "", false, true, false},
+		{993692028, "", true, true, true},
+		{0, skippedType, false, false, false},
+		{257000001, "", true, false, false},
+		{0, skippedNoPosition, false, false, false},
+		{0, skippedBadMMSI, false, false, false},
+		{257000003, "", false, true, false},
+	}
+	for i, c := range cases {
+		d, skip, _ := decodeMessage(messages[i], received)
+		if skip != c.skip || d.MMSI != c.mmsi ||
+			(d.Pos != nil) != c.pos || (d.Info != nil) != c.info || (d.AtoN != nil) != c.aton {
+			t.Errorf("%d: expected MMSI %d, skip %q, position %t, info %t and AtoN %t, got %d, %q and %+v",
+				i, c.mmsi, c.skip, c.pos, c.info, c.aton, d.MMSI, skip, d)
+		}
+	}
+	if d, _, _ := decodeMessage(messages[4], received); d.Pos.Pos.Lat != 59.5 || d.Pos.Speed != 10 ||
+		!d.Pos.At.Equal(time.Date(2017, 4, 20, 10, 10, 30, 0, time.UTC)) {
+		t.Errorf("Expected the class B report at 59.5 with 10 knots at second 30, got %+v", d.Pos)
+	}
+	if d, _, _ := decodeMessage(messages[1], received); d.Info.ShipName == "" || d.Info.Length == 0 {
+		t.Errorf("Expected the name and size from type 5, got %+v", d.Info)
+	}
+}
+
+func TestDecodeSubcommand(t *testing.T) {
+	run := func(input string, args ...string) (int, string, string) {
+		var stdout, stderr bytes.Buffer
+		status := runDecode(args, strings.NewReader(input), &stdout, &stderr)
+		return status, stdout.String(), stderr.String()
+	}
+
+	status, out, errOut := run(decodeFixture)
+	lines := strings.Split(strings.TrimSuffix(out, "\n"), "\n")
+	if status != 1 || len(lines) != 3 || !strings.Contains(errOut, "1 of 6 lines") {
+		t.Fatalf("Expected three records and too many failures, got %d, %q and %q", status, out, errOut)
+	}
+	var position decodedPosition
+	if err := json.Unmarshal([]byte(lines[0]), &position); err != nil {
+		t.Fatalf("Invalid JSON %q: %s", lines[0], err.Error())
+	}
+	if position.MMSI != 305305000 || position.Source != "stdin" ||
+		!position.Time.Equal(time.Date(2017, 4, 20, 10, 10, 3, 0, time.UTC)) {
+		t.Errorf("Expected 305305000 at the time of the TAG block, got %+v", position)
+	}
+	if !strings.Contains(lines[1], `"name":"`) || !strings.Contains(lines[2], `"aid_type":`) {
+		t.Errorf("Expected a static report and an aid to navigation, got %q", lines[1:])
+	}
+
+	if status, _, _ := run(decodeFixture, "-max-failed=0.2"); status != 0 {
+		t.Errorf("Expected one failed line of six to be below -max-failed=0.2, got status %d", status)
+	}
+
+	status, out, _ = run(decodeFixture, "-format=csv", "-types=1,5", "-max-failed=1")
+	expected := "mmsi,type,time,lat,lon,speed,course,heading,nav_status\n" +
+		"305305000,1,2017-04-20T10:10:03Z,63.38617833333333,7.609615,10.9,177.1,179,Under way using engine\n"
+	if status != 0 || out != expected {
+		t.Errorf("Expected CSV with only the type 1 message, got %d and %q", status, out)
+	}
+
+	_, out, _ = run(decodeFixture, "-stats", "-max-failed=1")
+	for _, expected := range []string{"6 lines, 1 failed to parse, 4 messages\n",
+		"type 1:\n\t1 decoded\n", "type 4:\n\t1 ignored type\n", "errors:\n\t1 too short"} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Expected %q in the summary, got %q", expected, out)
+		}
+	}
+
+	_, _, errOut = run(decodeFixture, "-validate", "-stats", "-max-failed=1")
+	if !strings.Contains(errOut, "stdin:5: too short") {
+		t.Errorf("Expected the failed line to be reported with its number, got %q", errOut)
+	}
+
+	if status, _, _ := run("", "-types=64"); status != 2 {
+		t.Errorf("Expected an invalid type to fail with status 2, got %d", status)
+	}
+}
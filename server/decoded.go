@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"time"
+
+	"github.com/tormol/AIS/forwarder"
+	"github.com/tormol/AIS/nmeais"
+	"github.com/tormol/AIS/storage"
+)
+
+// The decoded stream is the messages the archive stores as one JSON object
+// per line, for clients that don't want to run their own AIS decoder.
+// It's forwarded by a separate forwarder.Manager, so filtering and dropping
+// lines for slow clients works like for the raw stream.
+
+// decodedPosition is the line sent for position reports (type 1, 2, 3, 18 and 27).
+// Fields that are not available are omitted.
+type decodedPosition struct {
+	MMSI    uint32    `json:"mmsi"`
+	Type    uint8     `json:"type"`
+	Lat     float64   `json:"lat"`
+	Lon     float64   `json:"lon"`
+	Speed   *float32  `json:"speed,omitempty"`
+	Course  *float32  `json:"course,omitempty"`
+	Heading *float32  `json:"heading,omitempty"`
+	Time    time.Time `json:"time"`
+	Source  string    `json:"source"`
+	// of long-range reports
+	Resolution float32 `json:"position_resolution_m,omitempty"`
+}
+
+// decodedStatic is the line sent for static reports (type 5 and 24).
+// Type 24 is sent in two parts, so only some of the fields are set in each.
+type decodedStatic struct {
+	MMSI        uint32    `json:"mmsi"`
+	Type        uint8     `json:"type"`
+	IMO         uint32    `json:"imo,omitempty"`
+	Name        string    `json:"name,omitempty"`
+	Callsign    string    `json:"callsign,omitempty"`
+	VesselType  string    `json:"vesseltype,omitempty"`
+	Length      uint16    `json:"length,omitempty"`
+	Width       uint16    `json:"width,omitempty"`
+	Destination string    `json:"destination,omitempty"`
+	Time        time.Time `json:"time"`
+	Source      string    `json:"source"`
+}
+
+// available returns a pointer to v, or nil if v is NaN.
+func available(v float32) *float32 {
+	if math.IsNaN(float64(v)) {
+		return nil
+	}
+	return &v
+}
+
+// newDecodedPosition creates the line for a position report.
+func newDecodedPosition(m *nmeais.Message, mmsi uint32, pos storage.ShipPos) decodedPosition {
+	pos = storage.SanitizePos(pos)
+	return decodedPosition{
+		MMSI:    mmsi,
+		Type:    m.Type(),
+		Lat:     pos.Pos.Lat,
+		Lon:     pos.Pos.Long,
+		Speed:   available(pos.Speed),
+		Course:  available(pos.Course),
+		Heading: available(pos.BowHeading),
+		Time:    pos.At.UTC(),
+		Source:  m.SourceName,
+
+		Resolution: pos.Resolution,
+	}
+}
+
+// newDecodedStatic creates the line for a static report.
+func newDecodedStatic(m *nmeais.Message, mmsi uint32, received time.Time, info storage.ShipInfo) decodedStatic {
+	line := decodedStatic{
+		MMSI:        mmsi,
+		Type:        m.Type(),
+		Name:        info.ShipName,
+		Callsign:    info.Callsign,
+		Length:      info.Length,
+		Width:       info.Width,
+		Destination: info.Dest,
+		Time:        received.UTC(),
+		Source:      m.SourceName,
+	}
+	if storage.ValidIMO(info.IMO) {
+		line.IMO = info.IMO
+	}
+	if vesselType := info.VesselType.String(); info.VesselType != 0 && vesselType != "Not available" {
+		line.VesselType = vesselType
+	}
+	return line
+}
+
+// forwardPosition sends a stored position report to the decoded stream.
+func (a *Archive) forwardPosition(m *nmeais.Message, mmsi uint32, pos storage.ShipPos) {
+	if a.decoded == nil {
+		return
+	}
+	a.forwardDecoded(m, mmsi, newDecodedPosition(m, mmsi, pos))
+}
+
+// forwardStatic sends stored static information to the decoded stream.
+func (a *Archive) forwardStatic(m *nmeais.Message, mmsi uint32, received time.Time, info storage.ShipInfo) {
+	if a.decoded == nil {
+		return
+	}
+	a.forwardDecoded(m, mmsi, newDecodedStatic(m, mmsi, received, info))
+}
+
+// forwardDecoded encodes a line and sends it with what filters need to know.
+// Static reports are filtered by the last known position of the ship.
+// Nothing is sent for suppressed ships.
+func (a *Archive) forwardDecoded(m *nmeais.Message, mmsi uint32, line interface{}) {
+	if a.db.Suppressed(mmsi) {
+		return
+	}
+	encoded, err := json.Marshal(line)
+	if err != nil {
+		Log.Error("Error JSON-encoding decoded type %d message: %s", m.Type(), err.Error())
+		return
+	}
+	p := forwarder.Packet{Raw: append(encoded, '\n'), MMSI: mmsi, Type: m.Type(),
+		Received: m.Received(), Source: m.SourceName}
+	p.Lat, p.Lon, p.HasPos = a.db.KnownCoords(mmsi)
+	a.decoded <- p
+}
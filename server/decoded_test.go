@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/tormol/AIS/forwarder"
+)
+
+func TestJSONStream(t *testing.T) {
+	a := NewArchive(10, 0, 0, 0, 0, 0, 0)
+	packets := make(chan forwarder.Packet)
+	a.ForwardDecoded(packets)
+	add := make(chan forwarder.Conn)
+	stats := forwarder.NewStatsRequests()
+	go forwarder.Manager(Log, packets, add, stats)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwardStream(w, r, add, nil, "application/x-ndjson", false, true)
+	}))
+	defer server.Close()
+	defer close(packets) // makes the handler return
+
+	client := http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(server.URL + "/api/v1/json-stream?mmsi=305305000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "application/x-ndjson" {
+		t.Errorf("Unexpected Content-Type %q", resp.Header.Get("Content-Type"))
+	}
+	// the headers are sent before the connection is passed to the manager
+	for len(stats.Stats()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	saveSentence(t, a, "!BSVDM,1,1,,B,144atH00000Lf9nSffVf49TP00S9,0*1D\r\n") // filtered out
+	saveSentence(t, a, "!BSVDM,1,1,,A,14S:Eb001ePRmHBTAAFnrmV60PRk,0*1F\r\n")
+	line, err := bufio.NewReader(resp.Body).ReadBytes('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	var position map[string]interface{}
+	if err := json.Unmarshal(line, &position); err != nil {
+		t.Fatalf("Invalid JSON line %q: %s", line, err.Error())
+	}
+	if position["mmsi"] != float64(305305000) || position["type"] != float64(1) || position["source"] != "test" {
+		t.Errorf("Unexpected line %s", line)
+	}
+	if lat, _ := position["lat"].(float64); lat < 63 || lat > 64 {
+		t.Errorf("Expected a latitude around 63.4, got %s", line)
+	}
+	if _, ok := position["time"].(string); !ok {
+		t.Errorf("Expected a time, got %s", line)
+	}
+}
+
+func TestJSONStreamResume(t *testing.T) {
+	a := NewArchive(10, 0, 0, 0, 0, 0, 0)
+	packets := make(chan forwarder.Packet)
+	a.ForwardDecoded(packets)
+	add := make(chan forwarder.Conn)
+	stats := forwarder.NewStatsRequests()
+	go forwarder.SequencedManager(Log, packets, add, stats, forwarder.NewReplay(3))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwardStream(w, r, add, nil, "application/x-ndjson", false, true)
+	}))
+	defer server.Close()
+	defer close(packets)
+
+	clients := 0
+	connect := func(query string) (*bufio.Reader, func()) {
+		client := http.Client{Timeout: 5 * time.Second}
+		resp, err := client.Get(server.URL + "/api/v1/decoded?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		clients++
+		// disconnected clients might have been removed
+		for all := stats.Stats(); len(all) == 0 || all[len(all)-1].Token != uint64(clients); all = stats.Stats() {
+			time.Sleep(time.Millisecond)
+		}
+		return bufio.NewReader(resp.Body), func() { resp.Body.Close() }
+	}
+	next := 257000001
+	save := func() {
+		saveSentence(t, a, positionReport(1, uint32(next), 60, 5).sentences())
+		next++
+	}
+	expect := func(what string, lines *bufio.Reader, seq uint64, mmsi int) {
+		line, err := lines.ReadBytes('\n')
+		if err != nil {
+			t.Fatalf("%s: %s", what, err.Error())
+		}
+		var decoded struct {
+			Seq  uint64 `json:"seq"`
+			MMSI int    `json:"mmsi"`
+			Gap  bool   `json:"gap"`
+		}
+		if err := json.Unmarshal(line, &decoded); err != nil {
+			t.Fatalf("%s: invalid JSON line %q: %s", what, line, err.Error())
+		}
+		if decoded.Seq != seq || decoded.MMSI != mmsi || decoded.Gap != (seq == 0) {
+			t.Errorf("%s: expected seq %d from %d, got %s", what, seq, mmsi, line)
+		}
+	}
+
+	save()
+	save()
+	lines, disconnect := connect("resume_after=1")
+	expect("missed", lines, 2, 257000002)
+	save()
+	expect("new", lines, 3, 257000003)
+	disconnect()
+
+	// 4, 5 and 6 are remembered, so 3 has been forgotten
+	save()
+	save()
+	save()
+	lines, disconnect = connect("resume_after=2")
+	expect("after eviction", lines, 0, 0)
+	save()
+	expect("after the gap", lines, 7, 257000007)
+	disconnect()
+
+	lines, disconnect = connect("resume_after=5&mmsi=257000006,257000009")
+	expect("filtered", lines, 6, 257000006)
+	save()
+	save()
+	expect("new filtered", lines, 9, 257000009)
+	disconnect()
+
+	if resp, err := http.Get(server.URL + "/api/v1/decoded?resume_after=x"); err != nil {
+		t.Fatal(err)
+	} else if resp.Body.Close(); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected an invalid resume_after to be rejected, got %d", resp.StatusCode)
+	}
+}
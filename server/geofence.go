@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tormol/AIS/forwarder"
+	"github.com/tormol/AIS/geo"
+	"github.com/tormol/AIS/nmeais"
+	"github.com/tormol/AIS/storage"
+)
+
+// Geofences are named areas where ships entering or leaving them are logged
+// as events, for example to know when a tanker approaches a port.
+// Every position update is checked against every fence, which is fine for a
+// handful of fences. With many more, the fences could be put in an R-tree;
+// only geofences.crossed() would need to change.
+
+// Kinds of GeofenceEvent
+const (
+	GeofenceEnter = "ENTER"
+	GeofenceExit  = "EXIT"
+)
+
+// geofenceEvents is how many events are remembered for each fence.
+const geofenceEvents = 100
+
+// GeofenceEvent is a ship that crossed the boundary of a fence.
+type GeofenceEvent struct {
+	Time  time.Time `json:"time"` // of the position inside or outside the fence
+	MMSI  uint32    `json:"mmsi"`
+	Name  string    `json:"name,omitempty"` // of the ship, if known
+	Fence string    `json:"fence"`
+	Kind  string    `json:"kind"` // GeofenceEnter or GeofenceExit
+}
+
+// geofenceEventLine is how events are sent in the streams,
+// where they're mixed with ship updates.
+type geofenceEventLine struct {
+	Event string `json:"event"` // always "geofence"
+	GeofenceEvent
+}
+
+// Geofence is the public information about a fence.
+type Geofence struct {
+	ID     int                 `json:"id"`
+	Name   string              `json:"name"`
+	Rect   geo.Rectangle       `json:"bbox"` // west, south, east, north
+	Filter storage.MatchFilter `json:"-"`    // which ships to create events for
+}
+
+// geofence is a fence and its recent events.
+type geofence struct {
+	Geofence
+	events []GeofenceEvent // oldest first
+}
+
+// geofences are the fences of an archive.
+type geofences struct {
+	lock   sync.Mutex
+	nextID int
+	fences map[int]*geofence
+}
+
+// add registers a fence and returns its ID, which are never reused.
+func (gf *geofences) add(name string, rect geo.Rectangle, filter storage.MatchFilter) int {
+	gf.lock.Lock()
+	defer gf.lock.Unlock()
+	if gf.fences == nil {
+		gf.fences = make(map[int]*geofence)
+	}
+	gf.nextID++
+	gf.fences[gf.nextID] = &geofence{Geofence: Geofence{
+		ID:     gf.nextID,
+		Name:   name,
+		Rect:   rect,
+		Filter: filter,
+	}}
+	return gf.nextID
+}
+
+// remove forgets a fence and its events, and returns false if it doesn't exist.
+func (gf *geofences) remove(id int) bool {
+	gf.lock.Lock()
+	defer gf.lock.Unlock()
+	_, exists := gf.fences[id]
+	delete(gf.fences, id)
+	return exists
+}
+
+// list returns all fences sorted by ID.
+func (gf *geofences) list() []Geofence {
+	gf.lock.Lock()
+	defer gf.lock.Unlock()
+	list := make([]Geofence, 0, len(gf.fences))
+	for _, f := range gf.fences {
+		list = append(list, f.Geofence)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// events returns a copy of the recent events of a fence, oldest first.
+func (gf *geofences) events(id int) ([]GeofenceEvent, bool) {
+	gf.lock.Lock()
+	defer gf.lock.Unlock()
+	f, exists := gf.fences[id]
+	if !exists {
+		return nil, false
+	}
+	return append([]GeofenceEvent{}, f.events...), true
+}
+
+// crossed returns the fences that a ship moving from one position to another entered and exited.
+func (gf *geofences) crossed(from, to geo.Point) (entered, exited []Geofence) {
+	gf.lock.Lock()
+	defer gf.lock.Unlock()
+	for _, f := range gf.fences {
+		wasInside, isInside := f.Rect.ContainsPoint(from), f.Rect.ContainsPoint(to)
+		if !wasInside && isInside {
+			entered = append(entered, f.Geofence)
+		} else if wasInside && !isInside {
+			exited = append(exited, f.Geofence)
+		}
+	}
+	return entered, exited
+}
+
+// record remembers an event, and drops the oldest if the fence has too many.
+// Events for fences that have been removed are ignored.
+func (gf *geofences) record(id int, e GeofenceEvent) {
+	gf.lock.Lock()
+	defer gf.lock.Unlock()
+	f, exists := gf.fences[id]
+	if !exists {
+		return
+	}
+	if len(f.events) >= geofenceEvents {
+		f.events = f.events[:copy(f.events, f.events[1:])]
+	}
+	f.events = append(f.events, e)
+}
+
+// AddGeofence starts creating events for ships matching filter that enter
+// or leave rect, and returns the ID of the fence.
+func (a *Archive) AddGeofence(name string, rect geo.Rectangle, filter storage.MatchFilter) int {
+	return a.fences.add(name, rect, filter)
+}
+
+// RemoveGeofence stops creating events for a fence and forgets its events.
+// Returns false if there is no fence with the ID.
+func (a *Archive) RemoveGeofence(id int) bool {
+	return a.fences.remove(id)
+}
+
+// Geofences returns the registered fences.
+func (a *Archive) Geofences() []Geofence {
+	return a.fences.list()
+}
+
+// GeofenceEvents returns the last events of a fence, oldest first,
+// or false if there is no fence with the ID.
+func (a *Archive) GeofenceEvents(id int) ([]GeofenceEvent, bool) {
+	return a.fences.events(id)
+}
+
+// checkGeofences creates events for the fences a ship entered or exited
+// by moving from oldPos to its new position.
+// Nothing is created for ships without a previous position, as it's not
+// known whether they were inside before, or if pos was older than the
+// position in the database and therefore not stored.
+// The events are also sent to the streams.
+func (a *Archive) checkGeofences(m *nmeais.Message, mmsi uint32, oldPos *geo.Point, pos storage.ShipPos) {
+	if oldPos == nil {
+		return
+	} else if lat, long, _ := a.db.KnownCoords(mmsi); lat != pos.Pos.Lat || long != pos.Pos.Long {
+		return
+	}
+	entered, exited := a.fences.crossed(*oldPos, pos.Pos)
+	if len(entered) == 0 && len(exited) == 0 {
+		return
+	}
+	name := a.db.Name(mmsi)
+	for _, kind := range []string{GeofenceEnter, GeofenceExit} {
+		fences := entered
+		if kind == GeofenceExit {
+			fences = exited
+		}
+		for _, f := range fences {
+			if !a.db.Includes(mmsi, f.Filter) {
+				continue
+			}
+			e := GeofenceEvent{Time: pos.At.UTC(), MMSI: mmsi, Name: name, Fence: f.Name, Kind: kind}
+			a.fences.record(f.ID, e)
+			Log.Debug("Geofence %q: %d %s", f.Name, mmsi, kind)
+			a.publishGeofenceEvent(m, e, *oldPos, pos.Pos)
+		}
+	}
+}
+
+// publishGeofenceEvent sends an event to the streaming clients whose area
+// contains either position, and to the decoded stream.
+func (a *Archive) publishGeofenceEvent(m *nmeais.Message, e GeofenceEvent, oldPos, newPos geo.Point) {
+	line, err := json.Marshal(geofenceEventLine{"geofence", e})
+	if err != nil {
+		Log.Error("Error JSON-encoding geofence event: %s", err.Error())
+		return
+	}
+	a.subsLock.Lock()
+	for s := range a.subscribers {
+		if s.covers(newPos) || s.covers(oldPos) {
+			select {
+			case s.updates <- line:
+			default: // slow client
+			}
+		}
+	}
+	a.subsLock.Unlock()
+	if a.decoded != nil {
+		p := forwarder.Packet{Raw: append(line, '\n'), MMSI: e.MMSI, Received: m.Received(),
+			Source: m.SourceName, Lat: newPos.Lat, Lon: newPos.Long, HasPos: true}
+		a.decoded <- p
+	}
+}
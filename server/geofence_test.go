@@ -0,0 +1,168 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tormol/AIS/forwarder"
+	"github.com/tormol/AIS/geo"
+	"github.com/tormol/AIS/storage"
+)
+
+// movingShip creates a type 1 message without UTC second,
+// so that the position is timestamped when it's received.
+func movingShip(mmsi uint32, lat, long float64) string {
+	pb := positionReport(1, mmsi, lat, long)
+	second := payloadBits{}
+	second.put(6, 60)
+	copy(pb[137:143], second)
+	return pb.sentences()
+}
+
+func TestGeofenceEvents(t *testing.T) {
+	a := NewArchive(10, 0, 0, 0, 0, 0, 0)
+	rect, _ := geo.NewRectangle(59, 5, 60, 6)
+	approach := a.AddGeofence("Approach", *rect, storage.MatchFilter{})
+	tankers := a.AddGeofence("Tankers", *rect, storage.MatchFilter{Types: map[storage.ShipType]bool{80: true}})
+	updates, unsubscribe := a.Subscribe(geo.SplitViewRect(59.5, 5, 61, 6))
+	defer unsubscribe()
+	decoded := make(chan forwarder.Packet, 20)
+	a.ForwardDecoded(decoded)
+
+	for _, lat := range []float64{58.5, 58.9, 59.2, 59.5, 59.9, 60.5, 61} {
+		replay(a, movingShip(257000001, lat, 5.5))
+		time.Sleep(time.Millisecond) // make the times differ
+	}
+	replay(a, movingShip(257000002, 59.5, 5.5)) // first seen inside
+
+	events, exists := a.GeofenceEvents(approach)
+	if !exists || len(events) != 2 {
+		t.Fatalf("Expected two events, got %v", events)
+	}
+	if events[0].Kind != GeofenceEnter || events[1].Kind != GeofenceExit ||
+		events[0].MMSI != 257000001 || events[0].Fence != "Approach" ||
+		!events[1].Time.After(events[0].Time) {
+		t.Errorf("Expected ENTER and then EXIT, got %+v", events)
+	}
+	if events, _ := a.GeofenceEvents(tankers); len(events) != 0 {
+		t.Errorf("Expected the filter to exclude the ship of unknown type, got %+v", events)
+	}
+
+	// the subscription only covers the exit
+	streamed := []string{}
+	for len(updates) != 0 {
+		if update := string(<-updates); strings.Contains(update, `"event":"geofence"`) {
+			streamed = append(streamed, update)
+		}
+	}
+	if len(streamed) != 1 || !strings.Contains(streamed[0], `"kind":"EXIT"`) {
+		t.Errorf("Expected the EXIT event to be streamed, got %v", streamed)
+	}
+
+	lines := []string{}
+	for len(decoded) != 0 {
+		if line := string((<-decoded).Raw); strings.Contains(line, `"event":"geofence"`) {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) != 2 || !strings.Contains(lines[0], `"kind":"ENTER"`) {
+		t.Errorf("Expected both events in the decoded stream, got %v", lines)
+	}
+
+	if !a.RemoveGeofence(approach) || a.RemoveGeofence(approach) {
+		t.Error("Expected the fence to be removed once")
+	}
+	if _, exists := a.GeofenceEvents(approach); exists {
+		t.Error("Expected the events of the removed fence to be gone")
+	}
+}
+
+func TestGeofenceEventsAreBounded(t *testing.T) {
+	a := NewArchive(10, 0, 0, 0, 0, 0, 0)
+	rect, _ := geo.NewRectangle(59, 5, 60, 6)
+	id := a.AddGeofence("Approach", *rect, storage.MatchFilter{})
+	for i := 0; i < geofenceEvents+1; i++ {
+		a.fences.record(id, GeofenceEvent{MMSI: uint32(i)})
+	}
+	if events, _ := a.GeofenceEvents(id); len(events) != geofenceEvents || events[0].MMSI != 1 {
+		t.Errorf("Expected the oldest event to be dropped, got %d events", len(events))
+	}
+}
+
+func TestGeofencesHTTP(t *testing.T) {
+	a := NewArchive(10, 0, 0, 0, 0, 0, 0)
+	allowed, _ := forwarder.ParseNetblocks("127.0.0.1/32")
+	admin := &forwarder.Access{Allow: allowed}
+	handler := NewAPIHandler("", "", nil, nil, nil, nil, a, ClientLimits{}, nil, nil, admin, defaultReadyWindow, false)
+	request := func(method, path, remote string) (int, string) {
+		r := httptest.NewRequest(method, path, nil)
+		r.RemoteAddr = remote + ":1234"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		body, _ := io.ReadAll(w.Result().Body)
+		return w.Result().StatusCode, string(body)
+	}
+
+	for _, c := range []struct {
+		method, path, remote string
+		status               int
+		body                 string
+	}{
+		{"POST", "/api/v1/geofences?name=Approach&bbox=5,59,6,60&types=80-89", "127.0.0.1", http.StatusCreated, `{"id":1}`},
+		{"POST", "/api/v1/geofences?name=Approach&bbox=5,59,6,60", "192.0.2.1", http.StatusForbidden, ""},
+		{"POST", "/api/v1/geofences?bbox=5,59,6,60", "127.0.0.1", http.StatusBadRequest, ""},
+		{"POST", "/api/v1/geofences?name=x&bbox=170,59,-170,60", "127.0.0.1", http.StatusBadRequest, ""},
+		{"POST", "/api/v1/geofences?name=x&bbox=5,59,6", "127.0.0.1", http.StatusBadRequest, ""},
+		{"POST", "/api/v1/geofences?name=x&bbox=5,59,6,60&types=x", "127.0.0.1", http.StatusBadRequest, ""},
+		{"GET", "/api/v1/geofences", "192.0.2.1", http.StatusOK, `[{"id":1,"name":"Approach","bbox":[5,59,6,60]}]`},
+		{"GET", "/api/v1/geofences/1/events", "192.0.2.1", http.StatusOK, `[]`},
+		{"GET", "/api/v1/geofences/2/events", "192.0.2.1", http.StatusNotFound, ""},
+		{"GET", "/api/v1/geofences/x/events", "192.0.2.1", http.StatusNotFound, ""},
+		{"PUT", "/api/v1/geofences", "127.0.0.1", http.StatusMethodNotAllowed, ""},
+		{"DELETE", "/api/v1/geofences/1", "192.0.2.1", http.StatusForbidden, ""},
+		{"DELETE", "/api/v1/geofences/1", "127.0.0.1", http.StatusNoContent, ""},
+		{"DELETE", "/api/v1/geofences/1", "127.0.0.1", http.StatusNotFound, ""},
+		{"GET", "/api/v1/geofences", "192.0.2.1", http.StatusOK, `[]`},
+	} {
+		status, body := request(c.method, c.path, c.remote)
+		if status != c.status || (c.body != "" && body != c.body) {
+			t.Errorf("%s %s from %s: expected %d %s, got %d %s", c.method, c.path, c.remote,
+				c.status, c.body, status, body)
+		}
+	}
+}
+
+func TestGeofenceFormTooLarge(t *testing.T) {
+	a := NewArchive(10, 0, 0, 0, 0, 0, 0)
+	allowed, _ := forwarder.ParseNetblocks("127.0.0.1/32")
+	admin := &forwarder.Access{Allow: allowed}
+	handler := NewAPIHandler("", "", nil, nil, nil, nil, a, ClientLimits{}, nil, nil, admin, defaultReadyWindow, false)
+	post := func(form string) int {
+		// a MultiReader has no known length, so the body is sent chunked
+		body := io.MultiReader(strings.NewReader(form))
+		r := httptest.NewRequest("POST", "/api/v1/geofences", body)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.TransferEncoding = []string{"chunked"}
+		r.RemoteAddr = "127.0.0.1:1234"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Result().StatusCode
+	}
+
+	form := "name=Approach&bbox=5,59,6,60"
+	if status := post(form); status != http.StatusCreated {
+		t.Errorf("Expected a small chunked form to be accepted, got %d", status)
+	}
+	padding := "&x=" + strings.Repeat("x", maxGeofenceForm)
+	if status := post(form + padding); status != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected %d for a chunked form over %d bytes, got %d",
+			http.StatusRequestEntityTooLarge, maxGeofenceForm, status)
+	}
+	if len(a.Geofences()) != 1 {
+		t.Errorf("Expected only the small form to add a geofence, got %d", len(a.Geofences()))
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Health checks for supervisors such as systemd or Kubernetes:
+// /healthz only tells that HTTP is being served, while /readyz also requires
+// that data is coming in.
+// They are polled often, so they are not access logged or rate limited.
+
+// Paths of the health checks
+const (
+	healthzPath = "/healthz"
+	readyzPath  = "/readyz"
+)
+
+// defaultReadyWindow is how recently a message must have been saved for the
+// server to be ready, unless -ready-window is given.
+const defaultReadyWindow = time.Minute
+
+// readiness is the response of /readyz.
+type readiness struct {
+	Ready       bool       `json:"ready"`
+	Sources     int32      `json:"sources"`                // connected, see ListenerConnections
+	LastMessage *time.Time `json:"last_message,omitempty"` // omitted if none has been saved
+	Problems    []string   `json:"problems,omitempty"`     // why it's not ready
+}
+
+// checkReadiness returns whether at least one source is connected and
+// the archive has saved a message within window.
+func checkReadiness(a *Archive, window time.Duration, now time.Time) readiness {
+	r := readiness{Sources: atomic.LoadInt32(&ListenerConnections)}
+	if r.Sources <= 0 {
+		r.Problems = append(r.Problems, "no sources are connected")
+	}
+	last := a.LastMessage()
+	if !last.IsZero() {
+		r.LastMessage = &last
+	}
+	if last.IsZero() || now.Sub(last) > window {
+		r.Problems = append(r.Problems, "no message saved in the last "+window.String())
+	}
+	r.Ready = len(r.Problems) == 0
+	return r
+}
+
+// healthz responds 200 as long as the server is running.
+func healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if r.Method != "HEAD" {
+		writeAll(w, r, []byte("ok\n"), "healthz")
+	}
+}
+
+// readyz responds 200 if the server is ready, and 503 otherwise,
+// with the state as JSON.
+func readyz(w http.ResponseWriter, r *http.Request, a *Archive, window time.Duration) {
+	state := checkReadiness(a, window, time.Now())
+	body, err := json.Marshal(state)
+	if err != nil {
+		Log.Error("Error JSON-encoding readiness: %s", err.Error())
+		writeError(w, r, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if !state.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if r.Method != "HEAD" {
+		writeAll(w, r, body, "readyz JSON")
+	}
+}
+
+// readinessCheckInterval is how often watchReadiness checks.
+const readinessCheckInterval = 5 * time.Second
+
+// watchReadiness exits the process if it hasn't been ready for longer than
+// maxUnready, so that a supervisor restarts it. Never returns.
+func watchReadiness(a *Archive, window, maxUnready time.Duration) {
+	unreadySince := time.Now() // sources need some time to connect at startup too
+	for now := range time.Tick(readinessCheckInterval) {
+		state := checkReadiness(a, window, now)
+		if state.Ready {
+			unreadySince = now
+		} else if now.Sub(unreadySince) > maxUnready {
+			Log.Fatal("Not ready for more than %s: %v", maxUnready, state.Problems)
+		}
+	}
+}
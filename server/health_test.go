@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	l "github.com/tormol/AIS/logger"
+)
+
+func TestReadiness(t *testing.T) {
+	a := NewArchive(10, 0, 0, 0, 0, 0, 0)
+	request := func() (int, readiness) {
+		w := httptest.NewRecorder()
+		readyz(w, httptest.NewRequest("GET", readyzPath, nil), a, time.Minute)
+		var state readiness
+		if err := json.Unmarshal(w.Body.Bytes(), &state); err != nil {
+			t.Fatalf("Invalid JSON %q: %s", w.Body.String(), err.Error())
+		}
+		return w.Code, state
+	}
+
+	if status, state := request(); status != http.StatusServiceUnavailable || state.Ready ||
+		len(state.Problems) != 2 || state.LastMessage != nil {
+		t.Errorf("Expected 503 without sources and messages, got %d %+v", status, state)
+	}
+
+	atomic.AddInt32(&ListenerConnections, 1)
+	defer atomic.AddInt32(&ListenerConnections, -1)
+	atomic.StoreInt64(&a.lastSaved, time.Now().Add(-2*time.Minute).UnixNano())
+	if status, state := request(); status != http.StatusServiceUnavailable || state.Ready ||
+		len(state.Problems) != 1 || !strings.Contains(state.Problems[0], "no message") || state.LastMessage == nil {
+		t.Errorf("Expected 503 with an old message, got %d %+v", status, state)
+	}
+
+	replay(a, positionReport(1, 257000001, 60, 5).sentences())
+	if status, state := request(); status != http.StatusOK || !state.Ready || len(state.Problems) != 0 {
+		t.Errorf("Expected 200 with a source and a recent message, got %d %+v", status, state)
+	}
+}
+
+func TestHealthChecksAreNotLogged(t *testing.T) {
+	out := &logBuffer{}
+	logger := l.NewLogger(out, l.Info)
+	defer logger.Close()
+	mux := http.NewServeMux()
+	mux.HandleFunc(healthzPath, healthz)
+	handler := accessLogHandler(mux, "", logger, l.Info, false)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", healthzPath, nil))
+	if w.Code != http.StatusOK || w.Body.String() != "ok\n" {
+		t.Errorf("Expected 200 ok, got %d %q", w.Code, w.Body.String())
+	} else if out.Len() != 0 {
+		t.Errorf("Expected health checks to not be logged, got %q", out.String())
+	}
+
+	handler = accessLogHandler(pathPrefixHandler("/ais", mux), "/ais", logger, l.Info, false)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/ais"+healthzPath, nil))
+	if w.Code != http.StatusOK || out.Len() != 0 {
+		t.Errorf("Expected health checks under the prefix to not be logged, got %d %q", w.Code, out.String())
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", healthzPath, nil))
+	if w.Code != http.StatusNotFound || !strings.Contains(out.String(), "GET "+healthzPath+" ") {
+		t.Errorf("Expected a request for %s without the prefix to be logged, got %d %q", healthzPath, w.Code, out.String())
+	}
+}
@@ -1,14 +1,27 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"math"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/tormol/AIS/forwarder"
+	"github.com/tormol/AIS/geo"
+	l "github.com/tormol/AIS/logger"
+	"github.com/tormol/AIS/storage"
 )
 
 func writeAll(w http.ResponseWriter, r *http.Request, data []byte, what string) {
@@ -27,6 +40,17 @@ func rootLocationPrefix(r *http.Request) string {
 	// Concatenate multiple values in case the header is set by multiple reverse proxies.
 	// strings.Join() treats nil as an empty list and returns "" if the header is absent
 	rl := strings.Join(r.Header["X-Root-Location"], "")
+	if !validPathPrefix(rl) {
+		return "" // simply ignore the header
+	}
+	// Could remove trailing slash if present, but the fix would only apply to
+	// the last header
+	return rl
+}
+
+// validPathPrefix returns true if p is empty or an absolute path that can be
+// put into links without escaping.
+func validPathPrefix(p string) bool {
 	// Prevent escaping out of links which could lead to XSS.
 	// This is in all likelyhood not necessary:
 	// The only way for websites to send custom headers is via JavaScript and
@@ -37,12 +61,56 @@ func rootLocationPrefix(r *http.Request) string {
 	// termination characters, and ensure it's an absolute path on the same domain.
 	// (cross-domain prefixes aren't useful, as then an absolute path without
 	// domain would work just fine.)
-	if strings.ContainsAny(rl, "'\"`?# \t") || (rl != "" && rl[0] != '/') {
-		return "" // simply ignore the header
+	// "//" would start a protocol-relative URL to another domain.
+	return !strings.ContainsAny(p, "'\"`?#<> \t\\") && (p == "" || p[0] == '/') && !strings.HasPrefix(p, "//")
+}
+
+// pathPrefixKey is the request context key for the -path-prefix.
+type pathPrefixKey struct{}
+
+// rootPrefix returns what to put before absolute paths in links and redirects:
+// the X-Root-Location header if there is one, otherwise the -path-prefix.
+func rootPrefix(r *http.Request) string {
+	if rl := rootLocationPrefix(r); rl != "" {
+		return rl
 	}
-	// Could remove trailing slash if present, but the fix would only apply to
-	// the last header
-	return rl
+	prefix, _ := r.Context().Value(pathPrefixKey{}).(string)
+	return prefix
+}
+
+// pathPrefixHandler serves the website and the API under prefix, by removing
+// it from the path before passing requests on to h.
+// Paths outside the prefix are not found, and the prefix itself redirects to
+// the prefix with a trailing slash.
+// prefix can be empty, and otherwise must start but not end with a slash.
+func pathPrefixHandler(prefix string, h http.Handler) http.Handler {
+	if prefix == "" {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = r.WithContext(context.WithValue(r.Context(), pathPrefixKey{}, prefix))
+		if r.URL.Path == prefix {
+			target := rootPrefix(r) + "/"
+			if r.URL.RawQuery != "" {
+				target += "?" + r.URL.RawQuery
+			}
+			http.Redirect(w, r, target, http.StatusPermanentRedirect)
+			return
+		} else if !strings.HasPrefix(r.URL.Path, prefix+"/") {
+			writeError(w, r, http.StatusNotFound, "Not found")
+			return
+		}
+		u := *r.URL // WithContext() doesn't copy the URL
+		u.Path = u.Path[len(prefix):]
+		u.RawPath = strings.TrimPrefix(u.RawPath, prefix)
+		r.URL = &u
+		if strings.HasPrefix(r.RequestURI, prefix+"/") {
+			r.RequestURI = r.RequestURI[len(prefix):]
+		} else { // escaped or absolute
+			r.RequestURI = u.RequestURI()
+		}
+		h.ServeHTTP(w, r)
+	})
 }
 
 func writeError(w http.ResponseWriter, r *http.Request, status int, desc string) {
@@ -52,7 +120,7 @@ func writeError(w http.ResponseWriter, r *http.Request, status int, desc string)
 		content = `{"error":"` + desc + `"}`
 	} else {
 		w.Header().Add("Content-type", "text/html; charset=UTF-8")
-		root := rootLocationPrefix(r) + "/"
+		root := rootPrefix(r) + "/"
 		content = `<!DOCTYPE html><html lang="en">` +
 			`<head><title>` + strconv.Itoa(status) + `</title></head>` +
 			`<body><h1>` + desc + `</h1><hr/><a href="` + root + `">Go to front page</a></body>` +
@@ -64,29 +132,1016 @@ func writeError(w http.ResponseWriter, r *http.Request, status int, desc string)
 	}
 }
 
-func inArea(w http.ResponseWriter, r *http.Request, params string, db *Archive) {
-	if r.Method != "GET" {
-		writeError(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+// maxPrecision is the highest number of decimals that can be requested.
+// float64 doesn't have more significant digits than that anyway.
+const maxPrecision = 15
+
+// parsePrecision parses the optional "precision" query parameter,
+// which is the number of decimals to round coordinates to.
+// Returns geo.DefaultPrecision if the parameter is absent.
+func parsePrecision(query url.Values) (int, bool) {
+	param := query.Get("precision")
+	if param == "" {
+		return geo.DefaultPrecision, true
+	}
+	precision, err := strconv.Atoi(param)
+	if err != nil || precision < 0 || precision > maxPrecision {
+		return 0, false
+	}
+	return precision, true
+}
+
+// parseExtrapolate parses the optional boolean "extrapolate" query parameter,
+// which makes in_area and with_mmsi project moving ships to the current time.
+func parseExtrapolate(query url.Values) (bool, bool) {
+	param := query.Get("extrapolate")
+	if param == "" {
+		return false, true
+	}
+	extrapolate, err := strconv.ParseBool(param)
+	return extrapolate, err == nil
+}
+
+// parseCodes parses a comma-separated list of numbers and ranges such as
+// "30,31,70-79", where every number must be between 0 and max.
+func parseCodes(list string, max int) ([]uint8, error) {
+	codes := []uint8{}
+	for _, part := range strings.Split(list, ",") {
+		from, to := part, part
+		if dash := strings.IndexByte(part, '-'); dash != -1 {
+			from, to = part[:dash], part[dash+1:]
+		}
+		first, err := strconv.Atoi(from)
+		if err != nil || first < 0 || first > max {
+			return nil, fmt.Errorf("%q is not a number between 0 and %d", from, max)
+		}
+		last, err := strconv.Atoi(to)
+		if err != nil || last < first || last > max {
+			return nil, fmt.Errorf("%q is not a valid range", part)
+		}
+		for code := first; code <= last; code++ {
+			codes = append(codes, uint8(code))
+		}
+	}
+	return codes, nil
+}
+
+// bboxParams returns the values of all bbox parameters in a raw query string.
+// url.ParseQuery() ignores parameters containing semicolons since Go 1.17,
+// but they are used to separate multiple boxes in one parameter.
+func bboxParams(rawQuery string) []string {
+	bboxes := []string{}
+	for _, param := range strings.Split(rawQuery, "&") {
+		if strings.HasPrefix(param, "bbox=") {
+			bbox, err := url.QueryUnescape(param[len("bbox="):])
+			if err != nil {
+				bbox = param[len("bbox="):] // will fail as malformed
+			}
+			bboxes = append(bboxes, bbox)
+		}
+	}
+	return bboxes
+}
+
+// etagPrefix makes ETags from different runs of the server different,
+// as the change counter starts from zero again.
+var etagPrefix = strconv.FormatInt(time.Now().Unix(), 36)
+
+// changesETag creates a weak ETag from Archive.Changes().
+func changesETag(changes uint64) string {
+	return `W/"` + etagPrefix + "-" + strconv.FormatUint(changes, 10) + `"`
+}
+
+// etagMatches compares an ETag with the If-None-Match header(s) of a request,
+// using weak comparison.
+func etagMatches(r *http.Request, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, header := range r.Header.Values("If-None-Match") {
+		for _, tag := range strings.Split(header, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Limits on the size of requests, to reject absurd ones before doing any work.
+// Only POST /api/v1/geofences reads a body, and a form that big is plenty for it,
+// but endpoints that need a different limit should set it with http.MaxBytesReader.
+const (
+	maxURLLength = 8 << 10
+	maxBodySize  = 4 << 10
+	maxBoxes     = 64 // per request, across all bbox parameters
+)
+
+// tooManyBoxes checks the number of boxes in bbox parameters before they're parsed.
+func tooManyBoxes(bboxes []string) bool {
+	boxes := 0
+	for _, bbox := range bboxes {
+		boxes += strings.Count(bbox, ";") + 1
+	}
+	return boxes > maxBoxes
+}
+
+// limitHandler rejects requests with too long URLs or bodies with 413,
+// and makes reading more than maxBodySize of the body fail.
+func limitHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.RequestURI) > maxURLLength {
+			writeError(w, r, http.StatusRequestEntityTooLarge, "URL too long")
+			return
+		}
+		if r.ContentLength > maxBodySize {
+			writeError(w, r, http.StatusRequestEntityTooLarge, "Request body too large")
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxBodySize)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// ClientLimits are the limits per client IP that NewAPIHandler enforces.
+// The zero value disables them.
+type ClientLimits struct {
+	Rate       float64 // API requests per second, 0 disables rate limiting
+	Burst      int     // API requests a client can make at once after being idle
+	Streams    int     // concurrent streams, 0 means no limit
+	TrustProxy bool    // take the client IP from X-Forwarded-For, like accessLogHandler
+}
+
+// rateLimiterIdle is how long a client must be idle before its bucket is forgotten.
+// If the rate is so low that buckets aren't full after this, idle clients get a fresh burst.
+const rateLimiterIdle = 5 * time.Minute
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// rateLimiter is a token bucket per client IP.
+type rateLimiter struct {
+	rate    float64
+	burst   float64
+	mu      sync.Mutex
+	clients map[string]*tokenBucket
+	swept   time.Time // when idle clients were last removed
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		clients: make(map[string]*tokenBucket),
+		swept:   time.Now(),
+	}
+}
+
+// allow takes a token from the bucket of ip if there is one,
+// otherwise it returns how long until there will be.
+func (rl *rateLimiter) allow(ip string, now time.Time) (bool, time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if now.Sub(rl.swept) > rateLimiterIdle {
+		rl.evictIdle(now)
+		rl.swept = now
+	}
+	b, ok := rl.clients[ip]
+	if !ok {
+		b = &tokenBucket{tokens: rl.burst, updated: now}
+		rl.clients[ip] = b
+	} else if elapsed := now.Sub(b.updated); elapsed > 0 {
+		b.tokens = math.Min(rl.burst, b.tokens+elapsed.Seconds()*rl.rate)
+		b.updated = now
+	}
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / rl.rate * float64(time.Second))
+}
+
+// evictIdle removes the clients that haven't made a request in rateLimiterIdle,
+// so that scans from many addresses don't fill up the memory. rl must be locked.
+func (rl *rateLimiter) evictIdle(now time.Time) {
+	for ip, b := range rl.clients {
+		if now.Sub(b.updated) > rateLimiterIdle {
+			delete(rl.clients, ip)
+		}
+	}
+}
+
+// streamLimiter counts the open streams of each client IP.
+// Clients are removed when their last stream closes.
+type streamLimiter struct {
+	max    int
+	mu     sync.Mutex
+	active map[string]int
+}
+
+// start returns false if ip already has max streams open.
+func (sl *streamLimiter) start(ip string) bool {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	if sl.active[ip] >= sl.max {
+		return false
+	}
+	sl.active[ip]++
+	return true
+}
+
+func (sl *streamLimiter) stop(ip string) {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	if sl.active[ip] <= 1 {
+		delete(sl.active, ip)
+	} else {
+		sl.active[ip]--
+	}
+}
+
+// clientLimitHandler rejects requests with 429 when a client exceeds limits.
+// Paths under /api/ are rate limited, except streams which are limited by
+// how many a client can have open at once instead.
+func clientLimitHandler(h http.Handler, limits ClientLimits, streams ...string) http.Handler {
+	if limits.Rate <= 0 && limits.Streams <= 0 {
+		return h
+	}
+	requests := newRateLimiter(limits.Rate, limits.Burst)
+	open := &streamLimiter{max: limits.Streams, active: make(map[string]int)}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r, limits.TrustProxy)
+		isStream := false
+		for _, path := range streams {
+			if r.URL.Path == path {
+				isStream = true
+				break
+			}
+		}
+		if isStream && limits.Streams > 0 {
+			if !open.start(ip) {
+				writeError(w, r, http.StatusTooManyRequests, "Too many open streams")
+				return
+			}
+			defer open.stop(ip)
+		} else if !isStream && limits.Rate > 0 && strings.HasPrefix(r.URL.Path, "/api/") {
+			if ok, wait := requests.allow(ip, time.Now()); !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				writeError(w, r, http.StatusTooManyRequests, "Too many requests")
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// accessLogWriter records the status and size of a response.
+// It forwards Flush() and Hijack() so that streaming endpoints still work.
+type accessLogWriter struct {
+	http.ResponseWriter
+	status int // 0 until written
+	bytes  int64
+}
+
+func (aw *accessLogWriter) WriteHeader(status int) {
+	if aw.status == 0 {
+		aw.status = status
+	}
+	aw.ResponseWriter.WriteHeader(status)
+}
+
+func (aw *accessLogWriter) Write(data []byte) (int, error) {
+	if aw.status == 0 {
+		aw.status = http.StatusOK
+	}
+	n, err := aw.ResponseWriter.Write(data)
+	aw.bytes += int64(n)
+	return n, err
+}
+
+// Flush does nothing if the underlying ResponseWriter cannot flush.
+func (aw *accessLogWriter) Flush() {
+	if flusher, ok := aw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (aw *accessLogWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := aw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("The connection cannot be hijacked")
+	}
+	conn, rw, err := hj.Hijack()
+	if err == nil { // the handler writes the response itself
+		aw.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+// truncateDecimals shortens all decimal fractions in s to three digits.
+func truncateDecimals(s string) string {
+	b := make([]byte, 0, len(s))
+	decimals := -1 // not in a fraction
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '.' && i > 0 && s[i-1] >= '0' && s[i-1] <= '9' {
+			decimals = 0
+		} else if decimals >= 0 && c >= '0' && c <= '9' {
+			decimals++
+			if decimals > 3 {
+				continue
+			}
+		} else {
+			decimals = -1
+		}
+		b = append(b, c)
+	}
+	return string(b)
+}
+
+// accessLogPath removes the precision of bounding boxes beyond three decimals
+// from the path and query, so that they can be grouped by the area.
+func accessLogPath(u *url.URL) string {
+	path := u.Path
+	if strings.HasPrefix(path, "/api/v1/in_area/") {
+		path = truncateDecimals(path)
+	}
+	if u.RawQuery == "" {
+		return path
+	}
+	params := strings.Split(u.RawQuery, "&")
+	for i, param := range params {
+		if strings.HasPrefix(param, "bbox=") {
+			if bbox, err := url.QueryUnescape(param[len("bbox="):]); err == nil {
+				params[i] = "bbox=" + truncateDecimals(bbox)
+			}
+		}
+	}
+	return path + "?" + strings.Join(params, "&")
+}
+
+// clientAddr returns the address of the client, which is taken from
+// X-Forwarded-For when trustProxy is true and the header is present.
+func clientAddr(r *http.Request, trustProxy bool) string {
+	if forwardedFor := r.Header.Get("X-Forwarded-For"); trustProxy && forwardedFor != "" {
+		// the first is the client, the others are proxies
+		return strings.TrimSpace(strings.Split(forwardedFor, ",")[0])
+	}
+	return r.RemoteAddr
+}
+
+// clientIP is clientAddr without the port.
+func clientIP(r *http.Request, trustProxy bool) string {
+	addr := clientAddr(r, trustProxy)
+	if ip, _, err := net.SplitHostPort(addr); err == nil {
+		return ip
+	}
+	return addr
+}
+
+// accessLogHandler logs every request with its status, response size and duration,
+// except health checks.
+// pathPrefix is removed before recognizing health checks, like pathPrefixHandler does.
+// If trustProxy is true the client is taken from X-Forwarded-For when present.
+func accessLogHandler(h http.Handler, pathPrefix string, logger *l.Logger, level l.Level, trustProxy bool) http.Handler {
+	if level > logger.Treshold {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, pathPrefix+"/") {
+			if path := r.URL.Path[len(pathPrefix):]; path == healthzPath || path == readyzPath {
+				h.ServeHTTP(w, r)
+				return
+			}
+		}
+		started := time.Now()
+		aw := &accessLogWriter{ResponseWriter: w}
+		h.ServeHTTP(aw, r)
+		remote := clientAddr(r, trustProxy)
+		if aw.status == 0 { // the handler wrote nothing
+			aw.status = http.StatusOK
+		}
+		logger.LogFields(level, r.Method+" "+accessLogPath(r.URL), map[string]interface{}{
+			"status":   aw.status,
+			"bytes":    aw.bytes,
+			"remote":   remote,
+			"duration": l.RoundDuration(time.Since(started), time.Microsecond),
+		})
+	})
+}
+
+// parseMatchFilter parses the types, status, min_speed and include_own
+// parameters into filter.
+// The error is a message for the client.
+func parseMatchFilter(query url.Values, filter *storage.MatchFilter) error {
+	if param := query.Get("types"); param != "" {
+		codes, err := parseCodes(param, 255)
+		if err != nil {
+			return errors.New("Invalid types: " + err.Error())
+		}
+		filter.Types = make(map[storage.ShipType]bool, len(codes))
+		for _, code := range codes {
+			filter.Types[storage.ShipType(code)] = true
+		}
+	}
+	if param := query.Get("status"); param != "" {
+		codes, err := parseCodes(param, 15)
+		if err != nil {
+			return errors.New("Invalid status: " + err.Error())
+		}
+		filter.Status = make(map[storage.ShipNavStatus]bool, len(codes))
+		for _, code := range codes {
+			filter.Status[storage.ShipNavStatus(code)] = true
+		}
+	}
+	if param := query.Get("min_speed"); param != "" {
+		minSpeed, err := strconv.ParseFloat(param, 32)
+		if err != nil || !(minSpeed >= 0 && minSpeed <= storage.SpeedAtLeast) {
+			return errors.New("min_speed must be a number of knots between 0 and 102.2")
+		}
+		filter.MinSpeed = float32(minSpeed)
+	}
+	if param := query.Get("include_own"); param != "" {
+		var err error
+		filter.IncludeOwnShip, err = strconv.ParseBool(param)
+		if err != nil {
+			return errors.New("Invalid value for include_own")
+		}
+	}
+	return nil
+}
+
+// areaBBoxes returns the bounding boxes of in_area and atons, which are in the
+// path if the route has a bbox parameter and it's not empty,
+// and otherwise bbox parameters in the query.
+func areaBBoxes(r *http.Request, params map[string]string) []string {
+	if bbox := params["bbox"]; bbox != "" {
+		return []string{bbox}
+	}
+	return bboxParams(r.URL.RawQuery)
+}
+
+// inAreaRoute creates the handler for the in_area and atons routes.
+func inAreaRoute(items storage.Items, db *Archive) func(http.ResponseWriter, *http.Request, map[string]string) {
+	return func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+		if bboxes := areaBBoxes(r, params); len(bboxes) != 0 {
+			inArea(w, r, bboxes, items, db)
+		} else {
+			writeError(w, r, http.StatusNotFound, "bbox parameter required")
+		}
+	}
+}
+
+// inArea serves ships within one or more bounding boxes.
+// bboxes can be repeated parameters, and each of them can contain multiple
+// boxes separated by semicolons.
+// items is overridden by the ships_only parameter.
+func inArea(w http.ResponseWriter, r *http.Request, bboxes []string, items storage.Items, db *Archive) {
+	query := r.URL.Query()
+	precision, ok := parsePrecision(query)
+	if !ok {
+		writeError(w, r, http.StatusBadRequest, "Invalid precision")
+		return
+	}
+	terse := false
+	if param := query.Get("terse"); param != "" {
+		var err error
+		terse, err = strconv.ParseBool(param)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, "Invalid value for terse")
+			return
+		}
+	}
+	extrapolate, ok := parseExtrapolate(query)
+	if !ok {
+		writeError(w, r, http.StatusBadRequest, "Invalid value for extrapolate")
+		return
+	} else if extrapolate && terse {
+		writeError(w, r, http.StatusBadRequest, "extrapolate cannot be combined with terse")
+		return
+	}
+	verbose := false
+	if param := query.Get("verbose"); param != "" {
+		var err error
+		verbose, err = strconv.ParseBool(param)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, "Invalid value for verbose")
+			return
+		} else if verbose && terse {
+			writeError(w, r, http.StatusBadRequest, "verbose cannot be combined with terse")
+			return
+		}
+	}
+	shapes := false
+	if param := query.Get("shapes"); param != "" {
+		var err error
+		shapes, err = strconv.ParseBool(param)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, "Invalid value for shapes")
+			return
+		} else if shapes && terse {
+			writeError(w, r, http.StatusBadRequest, "shapes cannot be combined with terse")
+			return
+		}
+	}
+	limit := 0
+	if param := query.Get("limit"); param != "" {
+		var err error
+		limit, err = strconv.Atoi(param)
+		if err != nil || limit <= 0 {
+			writeError(w, r, http.StatusBadRequest, "limit must be a positive number")
+			return
+		} else if terse {
+			writeError(w, r, http.StatusBadRequest, "limit cannot be combined with terse")
+			return
+		}
+	}
+	filter := storage.MatchFilter{Items: items}
+	if param := query.Get("ships_only"); param != "" {
+		shipsOnly, err := strconv.ParseBool(param)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, "Invalid value for ships_only")
+			return
+		} else if shipsOnly && items == storage.OnlyAtoNs {
+			writeError(w, r, http.StatusBadRequest, "ships_only cannot be used for aids to navigation")
+			return
+		} else if shipsOnly {
+			filter.Items = storage.OnlyShips
+		}
+	}
+	if err := parseMatchFilter(query, &filter); err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	gridSize := 0.0
+	if param := query.Get("cluster"); param != "" {
+		var err error
+		gridSize, err = strconv.ParseFloat(param, 64)
+		if err != nil || !(gridSize > 0 && gridSize <= storage.MaxClusterGrid) {
+			writeError(w, r, http.StatusBadRequest, "cluster must be a grid size in degrees, at most 45")
+			return
+		} else if terse {
+			writeError(w, r, http.StatusBadRequest, "cluster cannot be combined with terse")
+			return
+		} else if extrapolate {
+			writeError(w, r, http.StatusBadRequest, "cluster cannot be combined with extrapolate")
+			return
+		} else if verbose {
+			writeError(w, r, http.StatusBadRequest, "cluster cannot be combined with verbose")
+			return
+		} else if limit != 0 {
+			writeError(w, r, http.StatusBadRequest, "cluster cannot be combined with limit")
+			return
+		} else if shapes {
+			writeError(w, r, http.StatusBadRequest, "cluster cannot be combined with shapes")
+			return
+		}
+	}
+	if tooManyBoxes(bboxes) {
+		writeError(w, r, http.StatusRequestEntityTooLarge, "Too many bboxes")
+		return
+	}
+	rects, err := geo.ParseViewRects(bboxes)
+	if err != nil { // malformed, out of range or south > north
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	// Clients poll this, so avoid rebuilding and sending the same response.
+	// Any change to any ship changes the ETag, not only changes within the area.
+	// Extrapolated positions change without any changes, so they never match.
+	w.Header().Set("Cache-Control", "no-cache")
+	// from before searching, so that the response includes every change up to it
+	etag := changesETag(db.Changes())
+	if !extrapolate && etagMatches(r, etag) {
+		w.Header().Set("ETag", etag)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	} else if !extrapolate {
+		w.Header().Set("ETag", etag)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if gridSize != 0 {
+		json, _ := db.FindClustered(rects, filter, gridSize, precision)
+		writeAll(w, r, []byte(json), "in_area JSON")
+	} else if terse {
+		json, _ := db.FindWithin(rects, filter, precision, true, false, false, false, 0)
+		writeAll(w, r, []byte(json), "in_area JSON")
+	} else if err := db.WriteWithin(w, rects, filter, precision, extrapolate, verbose, shapes, limit); err != nil {
+		Log.Info("IO error serving in_area JSON to %s: %s", r.Host, err.Error())
+	}
+}
+
+// safetyMessages serves the stored safety-related messages,
+// or only those received within the duration of the since parameter.
+func safetyMessages(w http.ResponseWriter, r *http.Request, db *Archive) {
+	var since time.Time
+	if param := r.URL.Query().Get("since"); param != "" {
+		duration, err := time.ParseDuration(param)
+		if err != nil || duration <= 0 {
+			writeError(w, r, http.StatusBadRequest, "Invalid duration for since")
+			return
+		}
+		since = time.Now().Add(-duration)
+	}
+	writeJSON(w, r, db.SafetyMessages(since), "safety messages")
+}
+
+// weather serves the meteorological reports within one or more bounding boxes.
+func weather(w http.ResponseWriter, r *http.Request, bboxes []string, db *Archive) {
+	if len(bboxes) == 0 {
+		writeError(w, r, http.StatusNotFound, "bbox parameter required")
+		return
+	} else if tooManyBoxes(bboxes) {
+		writeError(w, r, http.StatusRequestEntityTooLarge, "Too many bboxes")
+		return
+	}
+	rects, err := geo.ParseViewRects(bboxes)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	writeAll(w, r, []byte(db.Weather(rects)), "weather JSON")
+}
+
+// reloadSources handles POST /api/v1/sources/reload,
+// which re-reads -sources-file.
+func reloadSources(w http.ResponseWriter, r *http.Request,
+	sources *SourceManager, adminAccess *forwarder.Access) {
+	if !adminAccess.AllowsAddr(r.RemoteAddr) {
+		writeError(w, r, http.StatusForbidden, "Forbidden")
+		return
+	}
+	err := errNoSourceFile
+	added, removed := 0, 0
+	if sources != nil {
+		added, removed, err = sources.ReloadFile()
+	}
+	if err == errNoSourceFile {
+		writeError(w, r, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		Log.Error("Failed to reload sources, keeping the old ones: %s", err.Error())
+		writeError(w, r, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	Log.Info("Sources reloaded by %s: %d added, %d removed", r.RemoteAddr, added, removed)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// reconnectSource handles POST /api/v1/sources/$name/reconnect,
+// which restarts reading from a source even if it has given up.
+func reconnectSource(w http.ResponseWriter, r *http.Request, name string,
+	sources *SourceManager, adminAccess *forwarder.Access) {
+	if !adminAccess.AllowsAddr(r.RemoteAddr) {
+		writeError(w, r, http.StatusForbidden, "Forbidden")
+		return
+	}
+	err := errNoSuchSource
+	if sources != nil {
+		err = sources.Start(name)
+	}
+	if err == errNoSuchSource {
+		writeError(w, r, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		writeError(w, r, http.StatusConflict, err.Error())
+		return
+	}
+	Log.Info("%s reconnected by %s", name, r.RemoteAddr)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Limits for POST /api/v1/geofences: the maximum length of the name in bytes,
+// and of the whole form when it's sent as a body.
+const (
+	maxGeofenceName = 100
+	maxGeofenceForm = 4 << 10
+)
+
+// addGeofence handles POST /api/v1/geofences, which creates a fence from the
+// parameters name, bbox and the filters of in_area, either in the query or as a form.
+func addGeofence(w http.ResponseWriter, r *http.Request, db *Archive, adminAccess *forwarder.Access) {
+	if !adminAccess.AllowsAddr(r.RemoteAddr) {
+		writeError(w, r, http.StatusForbidden, "Forbidden")
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxGeofenceForm)
+	if err := r.ParseForm(); err != nil {
+		// Content-Length is checked by limitHandler, but chunked bodies only fail here.
+		if errors.As(err, new(*http.MaxBytesError)) {
+			writeError(w, r, http.StatusRequestEntityTooLarge, "Request body too large")
+		} else {
+			writeError(w, r, http.StatusBadRequest, "Malformed form")
+		}
+		return
+	}
+	name := r.Form.Get("name")
+	if name == "" || len(name) > maxGeofenceName {
+		writeError(w, r, http.StatusBadRequest, "name must be between 1 and 100 bytes")
+		return
+	}
+	rect, err := geo.ParseBBox(r.Form.Get("bbox"))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	filter := storage.MatchFilter{}
+	if err := parseMatchFilter(r.Form, &filter); err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	id := db.AddGeofence(name, rect, filter)
+	Log.Info("Geofence %d %q added by %s", id, name, r.RemoteAddr)
+	created, _ := json.Marshal(map[string]int{"id": id})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	writeAll(w, r, created, "geofence id")
+}
+
+// parseGeofenceID parses the $id of /api/v1/geofences/$id,
+// and responds 404 if it's not a positive integer.
+func parseGeofenceID(w http.ResponseWriter, r *http.Request, param string) (int, bool) {
+	id, err := strconv.Atoi(param)
+	if err != nil || id <= 0 {
+		writeError(w, r, http.StatusNotFound, "Not found")
+		return 0, false
+	}
+	return id, true
+}
+
+// removeGeofence handles DELETE /api/v1/geofences/$id.
+func removeGeofence(w http.ResponseWriter, r *http.Request, idParam string, db *Archive, adminAccess *forwarder.Access) {
+	if id, ok := parseGeofenceID(w, r, idParam); !ok {
+		return
+	} else if !adminAccess.AllowsAddr(r.RemoteAddr) {
+		writeError(w, r, http.StatusForbidden, "Forbidden")
+	} else if !db.RemoveGeofence(id) {
+		writeError(w, r, http.StatusNotFound, "No such geofence")
+	} else {
+		Log.Info("Geofence %d removed by %s", id, r.RemoteAddr)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// listGeofenceEvents handles GET /api/v1/geofences/$id/events,
+// which returns the most recent ships that entered or left it, oldest first.
+func listGeofenceEvents(w http.ResponseWriter, r *http.Request, idParam string, db *Archive) {
+	id, ok := parseGeofenceID(w, r, idParam)
+	if !ok {
+		return
+	}
+	list, exists := db.GeofenceEvents(id)
+	if !exists {
+		writeError(w, r, http.StatusNotFound, "No such geofence")
+		return
+	}
+	writeJSON(w, r, list, "geofence events")
+}
+
+// withIMO redirects to with_mmsi for the MMSI that last sent an IMO number,
+// with the same parameters.
+func withIMO(w http.ResponseWriter, r *http.Request, params string, db *Archive) {
+	imo, err := strconv.ParseUint(params, 10, 32)
+	if err != nil || !storage.ValidIMO(uint32(imo)) {
+		writeError(w, r, http.StatusBadRequest, "Invalid IMO number")
+		return
+	}
+	mmsi, known := db.WithIMO(uint32(imo))
+	if !known {
+		writeError(w, r, http.StatusNotFound, "No ship with that IMO number")
+		return
+	}
+	target := fmt.Sprintf("%s/api/v2/with_mmsi/%d", rootPrefix(r), mmsi)
+	if r.URL.RawQuery != "" {
+		target += "?" + r.URL.RawQuery
+	}
+	// temporary because the ship can change MMSI again
+	http.Redirect(w, r, target, http.StatusTemporaryRedirect)
+}
+
+// withMMSI serves all known information about a ship and its tracklog,
+// as GeoJSON, CSV or KML. (see trackFormat)
+func withMMSI(w http.ResponseWriter, r *http.Request, params string, db *Archive) {
+	mmsi, err := strconv.ParseUint(params, 10, 32)
+	if err != nil || !storage.ValidMMSI(uint32(mmsi)) {
+		writeError(w, r, http.StatusBadRequest, "Invalid MMSI")
 		return
 	}
-	// parse coordinates
-	minLon, minLat, maxLon, maxLat := math.NaN(), math.NaN(), math.NaN(), math.NaN()
-	// I want to error on trailing characters, but Sscanf() ignores everything after the
-	// pattern. My workaround is to add an extra catch-anything (except empty) pattern, and
-	// looking at the number of successfully parsed valuss.
-	var remainder string
-	parsed, _ := fmt.Sscanf(params, "%f,%f,%f,%f%s", &minLon, &minLat, &maxLon, &maxLat, &remainder)
-	if parsed != 4 {
-		writeError(w, r, http.StatusBadRequest, "Malformed coordinates")
+	query := r.URL.Query()
+	precision, ok := parsePrecision(query)
+	if !ok {
+		writeError(w, r, http.StatusBadRequest, "Invalid precision")
 		return
 	}
-	json, err := db.FindWithin(minLat, minLon, maxLat, maxLon)
-	if err != nil { // out of range or min > max (FIXME rectangles crossing the date line)
-		writeError(w, r, http.StatusBadRequest, "Malformed coordinates")
+	maxPoints := 0
+	if param := query.Get("points"); param != "" {
+		maxPoints, err = strconv.Atoi(param)
+		if err != nil || maxPoints < 2 { // a LineString needs at least two
+			writeError(w, r, http.StatusBadRequest, "points must be an integer of at least 2")
+			return
+		}
+	}
+	since := time.Duration(0)
+	if param := query.Get("since"); param != "" {
+		since, err = time.ParseDuration(param)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, "Invalid duration for since")
+			return
+		}
+	}
+	// the format can be chosen by the Accept header, so caches must not mix them up
+	w.Header().Add("Vary", "Accept")
+	format, ok := trackFormat(r)
+	if !ok {
+		writeError(w, r, http.StatusBadRequest, "format must be geojson, csv or kml")
+		return
+	}
+	extrapolate, ok := parseExtrapolate(query)
+	if !ok {
+		writeError(w, r, http.StatusBadRequest, "Invalid value for extrapolate")
+		return
+	} else if extrapolate && format != formatGeoJSON {
+		writeError(w, r, http.StatusBadRequest, "extrapolate is only supported for GeoJSON")
+		return
+	}
+	if format != formatGeoJSON {
+		info, pos, track, known := db.Track(uint32(mmsi), maxPoints, since)
+		if !known {
+			writeError(w, r, http.StatusNotFound, "No ship with that MMSI")
+			return
+		}
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%09d.%s"`, mmsi, format))
+		if format == formatCSV {
+			w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+			if err := writeTrackCSV(w, track, precision); err != nil {
+				Log.Info("IO error serving with_mmsi CSV to %s: %s", r.Host, err.Error())
+			}
+			return
+		}
+		kml, err := trackKML(uint32(mmsi), info, pos, track, precision)
+		if err != nil {
+			Log.Error("Error encoding KML for %09d: %s", mmsi, err.Error())
+			writeError(w, r, http.StatusInternalServerError, "Internal server error")
+			return
+		}
+		w.Header().Set("Content-Type", kmlContentType)
+		writeAll(w, r, kml, "with_mmsi KML")
+		return
+	}
+	json := db.Select(uint32(mmsi), precision, maxPoints, since, extrapolate)
+	if json == "" {
+		writeError(w, r, http.StatusNotFound, "No ship with that MMSI")
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
-	writeAll(w, r, []byte(json), "in_area JSON")
+	writeAll(w, r, []byte(json), "with_mmsi JSON")
+}
+
+// How often to ping streaming clients, so that dead connections are noticed
+// even if nothing happens in their area.
+const streamPingInterval = 30 * time.Second
+
+// stream sends the ships within one or more bounding boxes over a WebSocket,
+// followed by every update to a ship within the area or moving out of it.
+// The first message is a GeoJSON FeatureCollection, the updates are single Features.
+func stream(w http.ResponseWriter, r *http.Request, bboxes []string, db *Archive) {
+	if tooManyBoxes(bboxes) {
+		writeError(w, r, http.StatusRequestEntityTooLarge, "Too many bboxes")
+		return
+	}
+	rects, err := geo.ParseViewRects(bboxes)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	ws, ok := upgradeWebsocket(w, r)
+	if !ok {
+		return
+	}
+	defer ws.Close()
+	// Subscribe before searching so that no update is missed.
+	// Updates that are already included in the search are sent again.
+	updates, unsubscribe := db.Subscribe(rects)
+	defer unsubscribe()
+	json, _ := db.FindWithin(rects, storage.MatchFilter{}, geo.DefaultPrecision, false, false, false, false, 0)
+	err = ws.WriteText([]byte(json))
+	ping := time.NewTicker(streamPingInterval)
+	defer ping.Stop()
+	for err == nil {
+		select {
+		case update := <-updates:
+			err = ws.WriteText(update)
+		case <-ping.C:
+			err = ws.writeFrame(wsPing, nil)
+		case <-ws.closed:
+			return
+		}
+	}
+	Log.Info("IO error streaming to %s: %s", r.RemoteAddr, err.Error())
+}
+
+// acceptsGzip parses an Accept-Encoding header.
+// Only gzip is supported, so other encodings and their preference doesn't matter.
+func acceptsGzip(acceptEncoding string) bool {
+	for _, coding := range strings.Split(acceptEncoding, ",") {
+		params := strings.Split(coding, ";")
+		name := strings.ToLower(strings.TrimSpace(params[0]))
+		if name != "gzip" && name != "*" {
+			continue
+		}
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(param[2:], 64)
+				if err != nil || q <= 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// gzipResponseWriter compresses the body if it turns out there is one.
+// Whether to compress is decided when the status is written, because
+// bodiless responses such as 304 must stay empty, and already compressed
+// images are not worth compressing again.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz          *gzip.Writer // nil until compression is decided on
+	wroteHeader bool
+}
+
+func (gw *gzipResponseWriter) WriteHeader(status int) {
+	if gw.wroteHeader {
+		return
+	}
+	gw.wroteHeader = true
+	h := gw.Header()
+	if status >= 200 && status != http.StatusNoContent && status != http.StatusNotModified &&
+		h.Get("Content-Encoding") == "" &&
+		!strings.HasPrefix(h.Get("Content-Type"), "image/") {
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length") // of the uncompressed content
+		gw.gz = gzip.NewWriter(gw.ResponseWriter)
+	}
+	gw.ResponseWriter.WriteHeader(status)
+}
+
+func (gw *gzipResponseWriter) Write(data []byte) (int, error) {
+	if !gw.wroteHeader {
+		if gw.Header().Get("Content-Type") == "" {
+			// would otherwise sniff the compressed data
+			gw.Header().Set("Content-Type", http.DetectContentType(data))
+		}
+		gw.WriteHeader(http.StatusOK)
+	}
+	if gw.gz == nil {
+		return gw.ResponseWriter.Write(data)
+	}
+	return gw.gz.Write(data)
+}
+
+// close finishes the compressed stream.
+func (gw *gzipResponseWriter) close() error {
+	if gw.gz == nil {
+		return nil
+	}
+	return gw.gz.Close()
+}
+
+// compressHandler gzips responses for clients that support it.
+// Streaming endpoints where latency matters must be listed in uncompressed,
+// as compression buffers the data.
+// Range requests are also not compressed, because the ranges would then refer to
+// the compressed content.
+func compressHandler(h http.Handler, uncompressed ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, path := range uncompressed {
+			if r.URL.Path == path {
+				h.ServeHTTP(w, r)
+				return
+			}
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
+		if r.Method == "HEAD" || r.Header.Get("Range") != "" ||
+			!acceptsGzip(r.Header.Get("Accept-Encoding")) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		gw := &gzipResponseWriter{ResponseWriter: w}
+		h.ServeHTTP(gw, r)
+		if err := gw.close(); err != nil {
+			Log.Info("IO error finishing compressed response for %s to %s: %s",
+				r.URL.Path, r.Host, err.Error())
+		}
+	})
 }
 
 func echoStaticFile(w http.ResponseWriter, r *http.Request, path string) {
@@ -110,6 +1165,7 @@ func echoStaticFile(w http.ResponseWriter, r *http.Request, path string) {
 	}
 	if !stat.Mode().IsRegular() { // directory or something else
 		writeError(w, r, http.StatusForbidden, "Forbidden")
+		return
 	}
 	f, err := os.Open(path)
 	if err != nil {
@@ -126,72 +1182,459 @@ func echoStaticFile(w http.ResponseWriter, r *http.Request, path string) {
 	}
 }
 
-// HTTPServer starts the HTTP server and never returns.
-// For static files to be found, the server must be launched in the parent of StaticRootDir.
-func HTTPServer(on_addr string, staticRootDir string, newForwarder chan<- forwarder.Conn, db *Archive) {
-	if len(staticRootDir) == 0 {
-		staticRootDir = "."
-	} else if staticRootDir[len(staticRootDir)-1] == '/' {
-		staticRootDir = staticRootDir[:len(staticRootDir)-1]
+// echoIndexFile serves index.html with a <base href> of rootPrefix() inserted
+// into its <head>, so that the relative URLs of the page and the API requests
+// of script.js include the prefix even if the page is at the prefix without
+// a trailing slash.
+func echoIndexFile(w http.ResponseWriter, r *http.Request, path string) {
+	prefix := rootPrefix(r)
+	if prefix == "" {
+		echoStaticFile(w, r, path)
+		return
+	} else if r.Method != "GET" && r.Method != "HEAD" {
+		writeError(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, "Not found")
+		if !os.IsNotExist(err) {
+			Log.Warning("Unexpected error reading %s: %s", path, err.Error())
+		}
+		return
+	}
+	if head := bytes.Index(content, []byte("<head>")); head != -1 {
+		head += len("<head>")
+		base := []byte(`<base href="` + prefix + `/">`)
+		content = append(content[:head:head], append(base, content[head:]...)...)
 	}
+	// no modification time, as the prefix can differ between requests
+	http.ServeContent(w, r, path, time.Time{}, bytes.NewReader(content))
+}
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("/api/v1/raw", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == "GET" {
-			w.Header().Set("Content-Type", "text/plain; charset=ascii")
-			forwarder.ToHTTP(newForwarder, w, r)
-		} else {
-			writeError(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+// traceHandler starts (POST), stops (DELETE) or shows (GET) a trace of the
+// messages from one ship. See Tracer.
+func traceHandler(w http.ResponseWriter, r *http.Request, adminAccess *forwarder.Access) {
+	// traces include ships that are hidden by -suppress-classes
+	if !adminAccess.AllowsAddr(r.RemoteAddr) {
+		writeError(w, r, http.StatusForbidden, "Forbidden")
+		return
+	}
+	switch r.Method {
+	case "GET":
+	case "POST":
+		query := r.URL.Query()
+		mmsi, err := strconv.ParseUint(query.Get("mmsi"), 10, 32)
+		if err != nil || !storage.ValidMMSI(uint32(mmsi)) {
+			writeError(w, r, http.StatusBadRequest, "Invalid MMSI")
+			return
 		}
-	})
-	mux.HandleFunc("/api/v1/in_area", func(w http.ResponseWriter, r *http.Request) {
-		if strings.HasPrefix(r.RequestURI, "/api/v1/in_area?bbox=") {
-			inArea(w, r, r.RequestURI[len("/api/v1/in_area?bbox="):], db)
-		} else {
-			writeError(w, r, http.StatusNotFound, "bbox parameter required")
+		duration := 10 * time.Minute
+		if param := query.Get("duration"); param != "" {
+			duration, err = time.ParseDuration(param)
+			if err != nil || duration <= 0 {
+				writeError(w, r, http.StatusBadRequest, "Invalid duration")
+				return
+			}
 		}
-	})
-	// "?bbox="" is the norm for such APIs, but IMO "/" is cleaner, so allow that too
-	mux.HandleFunc("/api/v1/in_area/", func(w http.ResponseWriter, r *http.Request) {
-		params := r.RequestURI[len("/api/v1/in_area/"):]
-		params = strings.TrimPrefix(params, "?bbox=")
-		inArea(w, r, params, db)
-	})
-	mux.HandleFunc("/api/v2/with_mmsi/", func(w http.ResponseWriter, r *http.Request) {
-		params := r.RequestURI[len("/api/v2/with_mmsi/"):]
-		if r.Method != "GET" {
-			writeError(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+		Trace.Start(uint32(mmsi), query.Get("source"), duration)
+		Log.Info("Tracing %d from %q for %s", mmsi, query.Get("source"), duration)
+	case "DELETE":
+		Trace.Stop()
+	}
+	json, err := Trace.JSON()
+	if err != nil {
+		Log.Error("Error JSON-encoding trace: %s", err.Error())
+		writeError(w, r, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	writeAll(w, r, json, "trace JSON")
+}
+
+// forwardStream forwards messages to the client until it disconnects,
+// optionally filtered by bbox=, mmsi=, types= and max_per_ship= in the query.
+// If allowTags is true, tags=1 prefixes every sentence with a TAG block.
+// If allowResume is true, resume_after= starts with the lines after that
+// sequence number, see forwarder.SequencedManager.
+func forwardStream(w http.ResponseWriter, r *http.Request, add chan<- forwarder.Conn,
+	access *forwarder.Access, contentType string, allowTags, allowResume bool) {
+	if !access.AllowsAddr(r.RemoteAddr) {
+		writeError(w, r, http.StatusForbidden, "Forbidden")
+		return
+	}
+	if tooManyBoxes(bboxParams(r.URL.RawQuery)) {
+		writeError(w, r, http.StatusRequestEntityTooLarge, "Too many bboxes")
+		return
+	}
+	filter, err := forwarder.ParseFilter(r.URL.RawQuery)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	tags := false
+	if param := r.URL.Query().Get("tags"); param != "" && allowTags {
+		if tags, err = strconv.ParseBool(param); err != nil {
+			writeError(w, r, http.StatusBadRequest, "Invalid tags parameter")
 			return
 		}
-		mmsi, err := strconv.Atoi(params)
-		if err != nil || mmsi <= 0 || mmsi > 999999999 {
-			writeError(w, r, http.StatusBadRequest, "Invalid MMSI")
+	}
+	var resumeAfter *uint64
+	if param := r.URL.Query().Get("resume_after"); param != "" && allowResume {
+		seq, err := strconv.ParseUint(param, 10, 64)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, "Invalid resume_after parameter")
 			return
 		}
-		json := db.Select(uint32(mmsi))
-		if json == "" {
-			writeError(w, r, http.StatusNotFound, "No ship with that MMSI")
+		resumeAfter = &seq
+	}
+	w.Header().Set("Content-Type", contentType)
+	forwarder.ToHTTP(add, w, r, filter, tags, resumeAfter)
+}
+
+// Timeouts for slow or idle clients.
+// There is no read or write timeout, because the streams last as long as the client wants.
+const (
+	httpReadHeaderTimeout = 10 * time.Second
+	httpIdleTimeout       = 2 * time.Minute
+)
+
+// HTTPServer serves handler on on_addr and never returns.
+// If certFile and keyFile are set it serves HTTPS instead of HTTP.
+// Requests are logged with accessLogLevel, see accessLogHandler for pathPrefix and trustProxy.
+func HTTPServer(on_addr string, handler http.Handler, certFile, keyFile string,
+	pathPrefix string, accessLogLevel l.Level, trustProxy bool) {
+	server := &http.Server{
+		Addr:              on_addr,
+		Handler:           accessLogHandler(handler, pathPrefix, Log, accessLogLevel, trustProxy),
+		ReadHeaderTimeout: httpReadHeaderTimeout,
+		IdleTimeout:       httpIdleTimeout,
+	}
+	var err error
+	if certFile != "" {
+		err = server.ListenAndServeTLS(certFile, keyFile)
+	} else {
+		err = server.ListenAndServe()
+	}
+	Log.Fatal("HTTP server: %s", err.Error())
+}
+
+// hstsMaxAge is how long browsers should only use HTTPS, one year.
+const hstsMaxAge = 365 * 24 * 60 * 60
+
+// hstsHandler tells browsers to only use HTTPS from now on.
+// It should only wrap the handler served over HTTPS.
+func hstsHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Strict-Transport-Security", "max-age="+strconv.Itoa(hstsMaxAge))
+		h.ServeHTTP(w, r)
+	})
+}
+
+// redirectToHTTPSHandler sends all requests to the same path over HTTPS on httpsPort.
+// The X-Root-Location prefix is kept, so redirects through a reverse proxy work.
+func redirectToHTTPSHandler(httpsPort uint) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if host == "" || strings.ContainsAny(host, "/\\@") {
+			writeError(w, r, http.StatusBadRequest, "Invalid Host header")
 			return
 		}
-		w.Header().Set("Content-Type", "application/json")
-		writeAll(w, r, []byte(json), "with_mmsi JSON")
+		if strings.Contains(host, ":") { // IPv6 address
+			host = "[" + host + "]"
+		}
+		if httpsPort != 443 {
+			host += ":" + strconv.Itoa(int(httpsPort))
+		}
+		target := "https://" + host + rootLocationPrefix(r) + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusPermanentRedirect)
 	})
+}
+
+// route is an endpoint of the API.
+// Segments of the path that start with ':' are parameters, which match any
+// single segment and are passed to handle by name.
+type route struct {
+	Methods     []string `json:"methods"`
+	Path        string   `json:"path"`
+	Query       []string `json:"query,omitempty"` // the parameters it takes in the query, for documentation
+	Description string   `json:"description"`
+	handle      func(w http.ResponseWriter, r *http.Request, params map[string]string)
+}
+
+// muxPattern returns what to register the route as in a http.ServeMux:
+// the path itself, or the directory before the first parameter.
+func (rt *route) muxPattern() string {
+	if i := strings.Index(rt.Path, "/:"); i != -1 {
+		return rt.Path[:i+1]
+	}
+	return rt.Path
+}
+
+// match returns the parameters in path if it matches the route.
+func (rt *route) match(path string) (map[string]string, bool) {
+	pattern, segments := strings.Split(rt.Path, "/"), strings.Split(path, "/")
+	if len(pattern) != len(segments) {
+		return nil, false
+	}
+	params := make(map[string]string)
+	for i, p := range pattern {
+		if strings.HasPrefix(p, ":") {
+			params[p[1:]] = segments[i]
+		} else if p != segments[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+// allows checks whether the route accepts a method.
+func (rt *route) allows(method string) bool {
+	for _, m := range rt.Methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// registerRoutes adds the routes to mux.
+// Routes with the same mux pattern share a handler, which responds
+// 405 if the path matches but not the method, and 404 if nothing matches.
+func registerRoutes(mux *http.ServeMux, routes []route) {
+	patterns := []string{}
+	byPattern := make(map[string][]*route)
+	for i := range routes {
+		pattern := routes[i].muxPattern()
+		if _, exists := byPattern[pattern]; !exists {
+			patterns = append(patterns, pattern)
+		}
+		byPattern[pattern] = append(byPattern[pattern], &routes[i])
+	}
+	for _, pattern := range patterns {
+		candidates := byPattern[pattern]
+		mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+			wrongMethod := false
+			for _, rt := range candidates {
+				if params, ok := rt.match(r.URL.Path); !ok {
+					continue
+				} else if !rt.allows(r.Method) {
+					wrongMethod = true
+				} else {
+					rt.handle(w, r, params)
+					return
+				}
+			}
+			if wrongMethod {
+				writeError(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+			} else {
+				writeError(w, r, http.StatusNotFound, "Not found")
+			}
+		})
+	}
+}
+
+// listRoutes serves GET /api, which describes the endpoints.
+func listRoutes(w http.ResponseWriter, r *http.Request, routes []route) {
+	writeJSON(w, r, struct {
+		Endpoints []route `json:"endpoints"`
+	}{routes}, "endpoints")
+}
+
+// writeJSON encodes v as the response, and logs an error if that fails.
+// what is used in the log messages.
+func writeJSON(w http.ResponseWriter, r *http.Request, v interface{}, what string) {
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		Log.Error("Error JSON-encoding %s: %s", what, err.Error())
+		writeError(w, r, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	writeAll(w, r, encoded, what+" JSON")
+}
+
+// NewAPIHandler creates the handler for the API and the website,
+// with request limits, limits per client and compression.
+// For static files to be found, the server must be launched in the parent of StaticRootDir.
+// pathPrefix is where the website and the API are served from, such as "/ais",
+// or "" for the root, see pathPrefixHandler.
+// Only clients allowed by rawAccess can use /api/v1/raw and the decoded stream,
+// the password is not used.
+// Only clients allowed by adminAccess can list the raw clients, reconnect sources,
+// change geofences and trace ships.
+// /readyz requires a message to have been saved within readyWindow.
+// The endpoints under /api/v1/debug/ that are expensive or reveal too much
+// are only served if debugEndpoints is true.
+func NewAPIHandler(staticRootDir, pathPrefix string, newForwarder chan<- forwarder.Conn,
+	forwarderStats forwarder.StatsRequests, newDecodedForwarder chan<- forwarder.Conn,
+	rawAccess *forwarder.Access, db *Archive, limits ClientLimits,
+	sources *SourceManager, throughput *Throughput, adminAccess *forwarder.Access,
+	readyWindow time.Duration, debugEndpoints bool) http.Handler {
+	if len(staticRootDir) == 0 {
+		staticRootDir = "."
+	} else if staticRootDir[len(staticRootDir)-1] == '/' {
+		staticRootDir = staticRootDir[:len(staticRootDir)-1]
+	}
+
+	get, post, getOrHead := []string{"GET"}, []string{"POST"}, []string{"GET", "HEAD"}
+	inAreaParams := []string{"bbox", "precision", "terse", "extrapolate", "verbose", "shapes", "limit", "cluster",
+		"ships_only", "types", "status", "min_speed", "include_own"}
+	var routes []route
+	routes = []route{
+		{get, "/api", nil, "Lists the endpoints of the API",
+			func(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+				listRoutes(w, r, routes)
+			}},
+		{get, "/api/v1/in_area", inAreaParams, "Ships and aids to navigation within one or more bounding boxes, as GeoJSON",
+			inAreaRoute(storage.AllItems, db)},
+		// "?bbox="" is the norm for such APIs, but IMO "/" is cleaner, so allow that too
+		{get, "/api/v1/in_area/:bbox", inAreaParams[1:], "Like in_area, with the bounding boxes in the path",
+			inAreaRoute(storage.AllItems, db)},
+		{get, "/api/v1/atons", []string{"bbox", "precision", "terse", "extrapolate", "verbose", "limit", "cluster"},
+			"Aids to navigation within one or more bounding boxes, as GeoJSON",
+			inAreaRoute(storage.OnlyAtoNs, db)},
+		{get, "/api/v1/safety_messages", []string{"since"},
+			"Recent safety-related text messages, newest first",
+			func(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+				safetyMessages(w, r, db)
+			}},
+		{get, "/api/v1/weather", []string{"bbox"},
+			"The latest meteorological report from each position within one or more bounding boxes, as GeoJSON",
+			func(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+				weather(w, r, bboxParams(r.URL.RawQuery), db)
+			}},
+		{get, "/api/v2/with_mmsi/:mmsi", []string{"precision", "points", "since", "format", "extrapolate"},
+			"A ship and its track, as GeoJSON, CSV or KML",
+			func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+				withMMSI(w, r, params["mmsi"], db)
+			}},
+		{get, "/api/v2/with_imo/:imo", nil, "Redirects to with_mmsi for the MMSI that last sent the IMO number",
+			func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+				withIMO(w, r, params["imo"], db)
+			}},
+		{get, "/api/v1/stream", []string{"bbox"}, "WebSocket with the ships within bounding boxes and updates to them",
+			func(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+				stream(w, r, bboxParams(r.URL.RawQuery), db)
+			}},
+		{get, "/api/v1/raw", []string{"bbox", "mmsi", "types", "max_per_ship", "tags"}, "Stream of the received NMEA sentences",
+			func(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+				forwardStream(w, r, newForwarder, rawAccess, "text/plain; charset=ascii", true, false)
+			}},
+		{get, "/api/v1/decoded", []string{"bbox", "mmsi", "types", "max_per_ship", "resume_after"},
+			"Stream of the stored messages as numbered JSON lines",
+			func(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+				forwardStream(w, r, newDecodedForwarder, rawAccess, "application/x-ndjson", false, true)
+			}},
+		// the first name of the decoded stream, kept for existing clients
+		{get, "/api/v1/json-stream", []string{"bbox", "mmsi", "types", "max_per_ship", "resume_after"},
+			"The same as /api/v1/decoded",
+			func(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+				forwardStream(w, r, newDecodedForwarder, rawAccess, "application/x-ndjson", false, true)
+			}},
+		{get, "/api/v1/clients", nil, "The clients of the raw stream",
+			func(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+				// it lists the addresses of the clients
+				if !adminAccess.AllowsAddr(r.RemoteAddr) {
+					writeError(w, r, http.StatusForbidden, "Forbidden")
+					return
+				}
+				writeJSON(w, r, forwarderStats.Stats(), "clients")
+			}},
+		{get, "/api/v1/sources", nil, "The sources and their state",
+			func(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+				writeJSON(w, r, sources.Status(), "sources")
+			}},
+		{post, "/api/v1/sources/reload", nil, "Re-reads -sources-file",
+			func(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+				reloadSources(w, r, sources, adminAccess)
+			}},
+		{post, "/api/v1/sources/:name/reconnect", nil, "Connects to a source again",
+			func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+				reconnectSource(w, r, params["name"], sources, adminAccess)
+			}},
+		{get, "/api/v1/geofences", nil, "Lists the geofences",
+			func(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+				writeJSON(w, r, db.Geofences(), "geofences")
+			}},
+		{post, "/api/v1/geofences", []string{"name", "bbox", "types", "status", "min_speed", "include_own"},
+			"Creates a geofence",
+			func(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+				addGeofence(w, r, db, adminAccess)
+			}},
+		{[]string{"DELETE"}, "/api/v1/geofences/:id", nil, "Removes a geofence",
+			func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+				removeGeofence(w, r, params["id"], db, adminAccess)
+			}},
+		{get, "/api/v1/geofences/:id/events", nil, "The last ships that entered or left a geofence",
+			func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+				listGeofenceEvents(w, r, params["id"], db)
+			}},
+		{get, "/api/v1/stats", nil, "What the archive contains",
+			func(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+				writeJSON(w, r, db.Stats(), "stats")
+			}},
+		{get, "/api/v1/stats/throughput", []string{"window", "resolution"},
+			"Forwarded and duplicate messages per interval, in total and per type",
+			func(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+				throughputHandler(w, r, throughput)
+			}},
+		{get, "/api/v1/export.csv", nil, "Every known ship as CSV",
+			func(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+				w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+				if err := db.ExportCSV(w); err != nil {
+					Log.Info("IO error serving CSV export to %s: %s", r.Host, err.Error())
+				}
+			}},
+		{get, "/api/v1/debug/channel_management", nil, "Recent channel management and group assignment messages",
+			func(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+				w.Header().Set("Content-Type", "application/json")
+				writeAll(w, r, []byte(db.RegionalCommands()), "channel_management JSON")
+			}},
+		{getOrHead, healthzPath, nil, "Responds 200 while the server is running",
+			func(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+				healthz(w, r)
+			}},
+		{getOrHead, readyzPath, nil, "Responds 200 if sources are connected and messages are coming in",
+			func(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+				readyz(w, r, db, readyWindow)
+			}},
+	}
+	if debugEndpoints {
+		routes = append(routes, route{get, "/api/v1/debug/rtree", nil,
+			"The bounding rectangles of the nodes of the spatial index, as GeoJSON",
+			func(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+				w.Header().Set("Content-Type", "application/json")
+				writeAll(w, r, []byte(db.DebugRTree()), "R-tree GeoJSON")
+			}}, route{[]string{"GET", "POST", "DELETE"}, "/api/v1/debug/trace", []string{"mmsi", "source", "duration"},
+			"Shows, starts or stops a trace of the messages from a ship",
+			func(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+				traceHandler(w, r, adminAccess)
+			}})
+	}
+
+	mux := http.NewServeMux()
+	registerRoutes(mux, routes)
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		// http.ServeFile doesn't support custom 404 pages,
 		// so echoStaticFile and this reimplements most of it.
 		if strings.HasSuffix(r.RequestURI, "/index.html") {
 			l := len(r.RequestURI) - len("index.html")
-			http.Redirect(w, r, r.RequestURI[:l], http.StatusPermanentRedirect)
+			http.Redirect(w, r, rootPrefix(r)+r.RequestURI[:l], http.StatusPermanentRedirect)
 			return
 		}
 		if r.RequestURI == "/" {
 			// I don't expect multiple directories of static html files
-			echoStaticFile(w, r, staticRootDir+"/index.html")
+			echoIndexFile(w, r, staticRootDir+"/index.html")
 		} else {
 			// if the URI contains '?', let it 404
 			echoStaticFile(w, r, staticRootDir+r.RequestURI)
 		}
 	})
-	err := http.ListenAndServe(on_addr, mux)
-	Log.Fatal("HTTP server: %s", err.Error())
+	streams := []string{"/api/v1/raw", "/api/v1/decoded", "/api/v1/json-stream", "/api/v1/stream"}
+	handler := clientLimitHandler(limitHandler(compressHandler(mux, streams...)), limits, streams...)
+	return pathPrefixHandler(pathPrefix, handler)
 }
@@ -0,0 +1,1053 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tormol/AIS/forwarder"
+	"github.com/tormol/AIS/geo"
+	l "github.com/tormol/AIS/logger"
+	"github.com/tormol/AIS/nmeais"
+	"github.com/tormol/AIS/storage"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	cases := []struct {
+		header  string
+		accepts bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"deflate, gzip;q=1.0, *;q=0.5", true},
+		{"br, GZIP", true},
+		{"gzip;q=0", false},
+		{"identity", false},
+		{"*", true},
+		{"xgzip", false},
+	}
+	for _, c := range cases {
+		if acceptsGzip(c.header) != c.accepts {
+			t.Errorf("acceptsGzip(%q) should be %t", c.header, c.accepts)
+		}
+	}
+}
+
+func TestCompressHandler(t *testing.T) {
+	json := `{"type":"FeatureCollection","features":[` + strings.Repeat(`{"type":"Feature"},`, 100) + `{}]}`
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/in_area", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		writeAll(w, r, []byte(json), "in_area JSON")
+	})
+	mux.HandleFunc("/api/v1/raw", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=ascii")
+		w.Write([]byte("!AIVDM,1,1,,A,14S:Eb001ePRmHBTAAFnrmV60PRk,0*1F\r\n"))
+	})
+	mux.HandleFunc("/unchanged", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotModified)
+	})
+	handler := compressHandler(mux, "/api/v1/raw")
+
+	request := func(path, acceptEncoding string) *http.Response {
+		r := httptest.NewRequest("GET", path, nil)
+		if acceptEncoding != "" {
+			r.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Result()
+	}
+
+	resp := request("/api/v1/in_area", "gzip, deflate")
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Expected gzip encoding, got %q", resp.Header.Get("Content-Encoding"))
+	}
+	if resp.Header.Get("Vary") != "Accept-Encoding" {
+		t.Errorf("Expected Vary: Accept-Encoding, got %q", resp.Header.Get("Vary"))
+	}
+	gz, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decoded) != json {
+		t.Errorf("Decompressed response differs:\n%s", decoded)
+	}
+
+	resp = request("/api/v1/in_area", "")
+	body, _ := io.ReadAll(resp.Body)
+	if resp.Header.Get("Content-Encoding") != "" || string(body) != json {
+		t.Errorf("Expected uncompressed response without Accept-Encoding, got %q", resp.Header.Get("Content-Encoding"))
+	}
+
+	resp = request("/api/v1/raw", "gzip")
+	body, _ = io.ReadAll(resp.Body)
+	if resp.Header.Get("Content-Encoding") != "" || !strings.HasPrefix(string(body), "!AIVDM") {
+		t.Errorf("Expected raw stream to not be compressed, got %q %q",
+			resp.Header.Get("Content-Encoding"), body)
+	}
+
+	resp = request("/unchanged", "gzip")
+	body, _ = io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusNotModified || resp.Header.Get("Content-Encoding") != "" || len(body) != 0 {
+		t.Errorf("Expected an empty uncompressed 304, got %d %q %q",
+			resp.StatusCode, resp.Header.Get("Content-Encoding"), body)
+	}
+}
+
+// The terse format and precision must survive compression.
+func TestGzipTerse(t *testing.T) {
+	a := NewArchive(10, 0, 0, 0, 0, 0, 0)
+	saveSentence(t, a, "!BSVDM,1,1,,A,14S:Eb001ePRmHBTAAFnrmV60PRk,0*1F\r\n") // 305305000 at 63.39,7.61
+	handler := NewAPIHandler("", "", nil, nil, nil, nil, a, ClientLimits{}, nil, nil, nil, defaultReadyWindow, false)
+	r := httptest.NewRequest("GET", "/api/v1/in_area?bbox=7,63,8,64&terse=true&precision=2", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	resp := w.Result()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Expected a gzipped 200, got %d %q", resp.StatusCode, resp.Header.Get("Content-Encoding"))
+	}
+	gz, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var terse struct {
+		MMSI []uint32   `json:"mmsi"`
+		Lat  []float64  `json:"lat"`
+		Lon  []float64  `json:"lon"`
+		COG  []*float32 `json:"cog"`
+	}
+	if err := json.Unmarshal(body, &terse); err != nil {
+		t.Fatalf("Invalid terse JSON %q: %s", body, err.Error())
+	}
+	if len(terse.MMSI) != 1 || len(terse.Lat) != 1 || len(terse.Lon) != 1 || len(terse.COG) != 1 ||
+		terse.MMSI[0] != 305305000 {
+		t.Fatalf("Expected one ship in aligned arrays, got %s", body)
+	}
+	if terse.Lat[0] != 63.39 || terse.Lon[0] != 7.61 {
+		t.Errorf("Expected the coordinates rounded to two decimals, got %s", body)
+	}
+}
+
+// saveSentence decodes a single-sentence message and saves it in the archive.
+func saveSentence(t *testing.T, a *Archive, sentence string) {
+	s, err := nmeais.ParseSentence([]byte(sentence), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ma := nmeais.NewMessageAssembler(1, time.Second, "test")
+	m, err := ma.Accept(s)
+	if err != nil || m == nil {
+		t.Fatalf("Sentence is not a complete message: %v", err)
+	}
+	messages := make(chan *nmeais.Message, 1)
+	messages <- m
+	close(messages)
+	a.Save(messages) // returns when the channel is empty
+}
+
+func TestInAreaNotModified(t *testing.T) {
+	a := NewArchive(10, 0, 0, 0, 0, 0, 0)
+	saveSentence(t, a, "!BSVDM,1,1,,A,14S:Eb001ePRmHBTAAFnrmV60PRk,0*1F\r\n")
+	request := func(ifNoneMatch string) *http.Response {
+		r := httptest.NewRequest("GET", "/api/v1/in_area?bbox=-180,-90,180,90", nil)
+		if ifNoneMatch != "" {
+			r.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		w := httptest.NewRecorder()
+		inArea(w, r, bboxParams(r.URL.RawQuery), storage.AllItems, a)
+		return w.Result()
+	}
+
+	first := request("")
+	etag := first.Header.Get("ETag")
+	if first.StatusCode != http.StatusOK || etag == "" {
+		t.Fatalf("Expected 200 with an ETag, got %d %q", first.StatusCode, etag)
+	}
+	if first.Header.Get("Cache-Control") != "no-cache" {
+		t.Errorf("Expected Cache-Control: no-cache, got %q", first.Header.Get("Cache-Control"))
+	}
+
+	second := request(etag)
+	body, _ := io.ReadAll(second.Body)
+	if second.StatusCode != http.StatusNotModified || len(body) != 0 {
+		t.Errorf("Expected an empty 304 when nothing changed, got %d %q", second.StatusCode, body)
+	}
+	if second.Header.Get("ETag") != etag {
+		t.Errorf("Expected the 304 to have the same ETag, got %q", second.Header.Get("ETag"))
+	}
+	if r := request(`"other", ` + strings.TrimPrefix(etag, "W/")); r.StatusCode != http.StatusNotModified {
+		t.Errorf("Expected strong and listed ETags to match weakly, got %d", r.StatusCode)
+	}
+
+	saveSentence(t, a, "!BSVDM,1,1,,B,144atH00000Lf9nSffVf49TP00S9,0*1D\r\n")
+	third := request(etag)
+	if third.StatusCode != http.StatusOK || third.Header.Get("ETag") == etag {
+		t.Errorf("Expected 200 with a new ETag after an update, got %d %q",
+			third.StatusCode, third.Header.Get("ETag"))
+	}
+}
+
+func TestInAreaCluster(t *testing.T) {
+	a := NewArchive(10, 0, 0, 0, 0, 0, 0)
+	saveSentence(t, a, "!BSVDM,1,1,,A,14S:Eb001ePRmHBTAAFnrmV60PRk,0*1F\r\n")
+	saveSentence(t, a, "!BSVDM,1,1,,B,144atH00000Lf9nSffVf49TP00S9,0*1D\r\n")
+	request := func(query string) (int, string) {
+		r := httptest.NewRequest("GET", "/api/v1/in_area?bbox=-180,-90,180,90&"+query, nil)
+		w := httptest.NewRecorder()
+		inArea(w, r, bboxParams(r.URL.RawQuery), storage.AllItems, a)
+		body, _ := io.ReadAll(w.Result().Body)
+		return w.Result().StatusCode, string(body)
+	}
+	for _, query := range []string{"cluster=0", "cluster=46", "cluster=NaN", "cluster=x", "cluster=5&terse=true"} {
+		if status, _ := request(query); status != http.StatusBadRequest {
+			t.Errorf("Expected %q to be rejected, got %d", query, status)
+		}
+	}
+	if status, body := request("cluster=10"); status != http.StatusOK || !strings.Contains(body, `"count":2`) {
+		t.Errorf("Expected both ships in one cluster, got %d %s", status, body)
+	}
+}
+
+func TestAidsToNavigation(t *testing.T) {
+	a := NewArchive(10, 0, 0, 0, 0, 0, 0)
+	saveSentence(t, a, "!BSVDM,1,1,,A,14S:Eb001ePRmHBTAAFnrmV60PRk,0*1F\r\n")
+	saveSentence(t, a, "!AIVDM,1,1,,B,E>kb9O9aS@7PUh10dh19@;0Tah2cWrfP:l?M`00003vP100,0*01\r\n")
+	request := func(path string, items storage.Items) (int, string) {
+		r := httptest.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		inArea(w, r, bboxParams(r.URL.RawQuery), items, a)
+		body, _ := io.ReadAll(w.Result().Body)
+		return w.Result().StatusCode, string(body)
+	}
+	const aton = `"id":993692028`
+	const ship = `"id":305305000`
+	status, body := request("/api/v1/in_area?bbox=-180,-90,180,90", storage.AllItems)
+	if status != http.StatusOK || !strings.Contains(body, aton) || !strings.Contains(body, ship) {
+		t.Errorf("Expected both the ship and the aid, got %d %s", status, body)
+	}
+	if !strings.Contains(body, `"name":"SF OAK BAY BR VAIS E","item_type":"Aid to navigation",`+
+		`"aton_type":"Beacon, special mark","off_position":false`) {
+		t.Errorf("Expected the properties of the aid, got %s", body)
+	}
+	status, body = request("/api/v1/in_area?bbox=-180,-90,180,90&ships_only=1", storage.AllItems)
+	if status != http.StatusOK || strings.Contains(body, aton) || !strings.Contains(body, ship) {
+		t.Errorf("Expected only the ship, got %d %s", status, body)
+	}
+	status, body = request("/api/v1/atons?bbox=-180,-90,180,90", storage.OnlyAtoNs)
+	if status != http.StatusOK || !strings.Contains(body, aton) || strings.Contains(body, ship) {
+		t.Errorf("Expected only the aid, got %d %s", status, body)
+	}
+	status, _ = request("/api/v1/atons?bbox=-180,-90,180,90&ships_only=true", storage.OnlyAtoNs)
+	if status != http.StatusBadRequest {
+		t.Errorf("Expected ships_only to be rejected for aids, got %d", status)
+	}
+	status, _ = request("/api/v1/in_area?bbox=-180,-90,180,90&ships_only=x", storage.AllItems)
+	if status != http.StatusBadRequest {
+		t.Errorf("Expected invalid ships_only to be rejected, got %d", status)
+	}
+
+	selected := a.Select(993692028, 6, 0, 0, false)
+	for _, expected := range []string{`"item_type":"Aid to navigation"`, `"virtual_aton":true`,
+		`"name":"SF OAK BAY BR VAIS E"`, `"latitude":37.805622`} {
+		if !strings.Contains(selected, expected) {
+			t.Errorf("Expected %s in %s", expected, selected)
+		}
+	}
+}
+
+func TestInAreaFilters(t *testing.T) {
+	a := NewArchive(10, 0, 0, 0, 0, 0, 0)
+	ships := []struct {
+		mmsi   uint32
+		typ    storage.ShipType
+		status storage.ShipNavStatus
+		speed  float32
+	}{
+		{257000001, 30, 7, 3},     // fishing
+		{257000002, 70, 0, 12},    // cargo under way
+		{257000003, 75, 1, 0},     // cargo at anchor
+		{257000004, 0, 15, 102.3}, // nothing known
+		{257000005, 0, 0, 5},      // own ship, see below
+	}
+	for i, s := range ships {
+		pos := storage.UnknownPos
+		pos.At = time.Now()
+		pos.Pos = geo.Point{Lat: 59 + float64(i)/100, Long: 5}
+		pos.NavStatus, pos.Speed = s.status, s.speed
+		a.rt.InsertData(pos.Pos.Lat, pos.Pos.Long, s.mmsi)
+		a.db.UpdateDynamic(s.mmsi, "test", pos)
+		if s.typ != 0 {
+			a.db.UpdateStatic(s.mmsi, "test", time.Now(), storage.ShipInfo{VesselType: s.typ})
+		}
+	}
+	a.db.MarkOwnShip(257000005)
+	request := func(query string) (int, int) {
+		r := httptest.NewRequest("GET", "/api/v1/in_area?bbox=4,58,6,60&"+query, nil)
+		w := httptest.NewRecorder()
+		inArea(w, r, bboxParams(r.URL.RawQuery), storage.AllItems, a)
+		body, _ := io.ReadAll(w.Result().Body)
+		return w.Result().StatusCode, strings.Count(string(body), `"type":"Feature"`)
+	}
+	for _, c := range []struct {
+		query string
+		found int
+	}{
+		{"", 4},
+		{"types=30", 1},
+		{"types=70-79", 2},
+		{"types=30,70-79", 3},
+		{"types=0", 1},
+		{"status=0,1", 2},
+		{"min_speed=0.5", 2},
+		{"types=70-79&status=0", 1},
+		{"types=70-79&min_speed=0.5&cluster=10", 1},
+		{"include_own=1", 5},
+		{"include_own=0", 4},
+		{"include_own=1&status=0", 2},
+		{"include_own=1&types=30", 1},
+	} {
+		if status, found := request(c.query); status != http.StatusOK || found != c.found {
+			t.Errorf("Expected %d ships with %q, got %d %d", c.found, c.query, status, found)
+		}
+	}
+	for _, query := range []string{"types=x", "types=79-70", "types=70-", "types=256",
+		"status=16", "status=-1", "min_speed=-1", "min_speed=fast", "include_own=x"} {
+		if status, _ := request(query); status != http.StatusBadRequest {
+			t.Errorf("Expected %q to be rejected, got %d", query, status)
+		}
+	}
+}
+
+func TestExtrapolate(t *testing.T) {
+	a := NewArchive(10, 0, 0, 0, 0, 0, 0)
+	pos := storage.UnknownPos
+	pos.At = time.Now().Add(-10 * time.Minute)
+	pos.Pos = geo.Point{Lat: 60, Long: 5}
+	pos.NavStatus, pos.Speed, pos.Course = 0, 12, 90
+	a.db.UpdateDynamic(257000001, "test", pos)
+	a.rt.InsertData(60, 5, 257000001)
+	request := func(path, query, etag string) *http.Response {
+		r := httptest.NewRequest("GET", path+"?"+query, nil)
+		r.Header.Set("If-None-Match", etag)
+		w := httptest.NewRecorder()
+		if strings.Contains(path, "with_mmsi") {
+			withMMSI(w, r, "257000001", a)
+		} else {
+			inArea(w, r, bboxParams(r.URL.RawQuery), storage.AllItems, a)
+		}
+		return w.Result()
+	}
+	inArea := "/api/v1/in_area"
+	etag := request(inArea, "bbox=-180,-90,180,90", "").Header.Get("ETag")
+	r := request(inArea, "bbox=-180,-90,180,90&extrapolate=1&precision=5", etag)
+	body, _ := io.ReadAll(r.Body)
+	if r.StatusCode != http.StatusOK || r.Header.Get("ETag") != "" {
+		t.Errorf("Expected 200 without ETag when extrapolating, got %d %q", r.StatusCode, r.Header.Get("ETag"))
+	} else if !strings.Contains(string(body), `"coordinates":[5.02,60]`) ||
+		!strings.Contains(string(body), `"reported_position":[5,60]`) ||
+		!strings.Contains(string(body), `"position_age_seconds":600`) {
+		t.Errorf("Expected the ship to be projected three minutes east, got %s", body)
+	}
+	r = request("/api/v1/with_mmsi/257000001", "extrapolate=true&precision=5", "")
+	body, _ = io.ReadAll(r.Body)
+	if !strings.Contains(string(body), `"coordinates":[5.02,60]`) || !strings.Contains(string(body), `"reported_position":[5,60]`) {
+		t.Errorf("Expected with_mmsi to extrapolate, got %d %s", r.StatusCode, body)
+	}
+	for _, query := range []string{"extrapolate=x", "extrapolate=1&terse=1", "extrapolate=1&cluster=5"} {
+		if r := request(inArea, "bbox=-180,-90,180,90&"+query, ""); r.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected in_area?%s to be rejected, got %d", query, r.StatusCode)
+		}
+	}
+	if r := request("/api/v1/with_mmsi/257000001", "extrapolate=1&format=csv", ""); r.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected extrapolate to be rejected for CSV, got %d", r.StatusCode)
+	}
+}
+
+func TestWithMMSIFormats(t *testing.T) {
+	a := NewArchive(10, 0, 0, 0, 0, 0, 0)
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for i := 0; i < 3; i++ {
+		pos := storage.UnknownPos
+		pos.At = start.Add(time.Duration(i) * time.Minute)
+		pos.Pos = geo.Point{Lat: 59 + float64(i)/10, Long: 5}
+		if i != 1 {
+			pos.Speed, pos.Course = 12.5, 90
+		}
+		a.db.UpdateDynamic(257000001, "test", pos)
+	}
+	a.db.UpdateStatic(257000001, "test", time.Now(), storage.ShipInfo{ShipName: "A&B <C>"})
+	request := func(query, accept string) *http.Response {
+		r := httptest.NewRequest("GET", "/api/v2/with_mmsi/257000001"+query, nil)
+		if accept != "" {
+			r.Header.Set("Accept", accept)
+		}
+		w := httptest.NewRecorder()
+		withMMSI(w, r, "257000001", a)
+		return w.Result()
+	}
+
+	csvResponse := request("?format=csv", "")
+	rows, err := csv.NewReader(csvResponse.Body).ReadAll()
+	if err != nil || len(rows) != 4 {
+		t.Fatalf("Expected a header and three rows, got %v %v", rows, err)
+	}
+	if strings.Join(rows[0], ",") != "time,lat,lon,speed,course" {
+		t.Errorf("Unexpected CSV header %v", rows[0])
+	}
+	expected := start.UTC().Format(time.RFC3339) + ",59,5,12.5,90"
+	if strings.Join(rows[1], ",") != expected || strings.Join(rows[2][3:], ",") != "," {
+		t.Errorf("Expected %s and no speed or course in the second row, got %v", expected, rows)
+	}
+	if cd := csvResponse.Header.Get("Content-Disposition"); !strings.Contains(cd, `filename="257000001.csv"`) {
+		t.Errorf("Expected a filename with the MMSI, got %q", cd)
+	}
+	if r := request("", "text/html, text/csv;q=0.9"); r.Header.Get("Content-Type") != "text/csv; charset=utf-8" {
+		t.Errorf("Expected CSV from the Accept header, got %q", r.Header.Get("Content-Type"))
+	}
+
+	kmlResponse := request("", kmlContentType)
+	if kmlResponse.Header.Get("Content-Type") != kmlContentType {
+		t.Errorf("Expected KML from the Accept header, got %q", kmlResponse.Header.Get("Content-Type"))
+	}
+	if vary := kmlResponse.Header.Get("Vary"); vary != "Accept" {
+		t.Errorf("Expected Vary: Accept, got %q", vary)
+	}
+	var doc kmlDocument
+	if err := xml.NewDecoder(kmlResponse.Body).Decode(&doc); err != nil {
+		t.Fatalf("Invalid KML: %s", err.Error())
+	}
+	geometry := doc.Placemark.MultiGeometry
+	if doc.Placemark.Name != "A&B <C>" || geometry.LineString == nil || geometry.Point == nil {
+		t.Fatalf("Expected the name, a LineString and a Point, got %+v", doc)
+	}
+	if n := len(strings.Fields(geometry.LineString.Coordinates)); n != 3 {
+		t.Errorf("Expected three coordinates in the LineString, got %d", n)
+	}
+	if geometry.Point.Coordinates != "5,59.2" {
+		t.Errorf("Expected the current position as the Point, got %q", geometry.Point.Coordinates)
+	}
+
+	if r := request("?format=json", ""); r.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected an invalid format to be rejected, got %d", r.StatusCode)
+	}
+	if r := request("", "application/json"); r.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("Expected GeoJSON by default, got %q", r.Header.Get("Content-Type"))
+	}
+}
+
+func TestWithMMSIStates(t *testing.T) {
+	a := NewArchive(10, 0, 0, 0, 0, 0, 0)
+	type feature struct {
+		Geometry *struct {
+			Type        string
+			Coordinates json.RawMessage
+		}
+		Properties map[string]interface{}
+	}
+	type featureCollection struct {
+		Features []feature
+	}
+	request := func(mmsi string) (int, featureCollection) {
+		r := httptest.NewRequest("GET", "/api/v2/with_mmsi/"+mmsi, nil)
+		w := httptest.NewRecorder()
+		withMMSI(w, r, mmsi, a)
+		var fc featureCollection
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &fc); err != nil {
+				t.Fatalf("Invalid GeoJSON for %s: %s", mmsi, err.Error())
+			}
+		}
+		return w.Code, fc
+	}
+
+	if code, _ := request("257000001"); code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown ship, got %d", code)
+	}
+
+	a.db.UpdateStatic(257000001, "test", time.Now(), storage.ShipInfo{ShipName: "STATIC"})
+	code, fc := request("257000001")
+	if code != http.StatusOK || len(fc.Features) != 1 {
+		t.Fatalf("Expected 200 and only the properties for a ship without position, got %d %+v", code, fc)
+	}
+	if fc.Features[0].Geometry != nil {
+		t.Errorf("Expected a null geometry, got %+v", fc.Features[0].Geometry)
+	}
+	if fc.Features[0].Properties["name"] != "STATIC" {
+		t.Errorf("Expected the name in the properties, got %+v", fc.Features[0].Properties)
+	}
+
+	pos := storage.UnknownPos
+	pos.At = time.Now().Add(-time.Minute)
+	pos.Pos = geo.Point{Lat: 59, Long: 5}
+	a.db.UpdateDynamic(257000001, "test", pos)
+	_, fc = request("257000001")
+	if len(fc.Features) != 1 || fc.Features[0].Geometry == nil || fc.Features[0].Geometry.Type != "Point" {
+		t.Fatalf("Expected only a point for a ship with one position, got %+v", fc)
+	}
+
+	pos.At = time.Now()
+	pos.Pos = geo.Point{Lat: 59.1, Long: 5}
+	a.db.UpdateDynamic(257000001, "test", pos)
+	_, fc = request("257000001")
+	if len(fc.Features) != 2 || fc.Features[1].Geometry == nil || fc.Features[1].Geometry.Type != "LineString" {
+		t.Errorf("Expected a point and a tracklog, got %+v", fc)
+	}
+}
+
+func TestAPIHandler(t *testing.T) {
+	static := t.TempDir()
+	for name, content := range map[string]string{
+		"index.html":  "<html>map</html>",
+		"script.js":   "var ships = {}",
+		".secret":     "password",
+		"sub/page.js": "// in a directory",
+	} {
+		path := filepath.Join(static, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a := NewArchive(10, 0, 0, 0, 0, 0, 0)
+	saveSentence(t, a, "!BSVDM,1,1,,A,14S:Eb001ePRmHBTAAFnrmV60PRk,0*1F\r\n") // 305305000 at 63.39,7.61
+	handler := NewAPIHandler(static+"/", "", nil, nil, nil, nil, a, ClientLimits{}, nil, nil, nil, defaultReadyWindow, false)
+	request := func(method, uri string) *http.Response {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(method, uri, nil))
+		return w.Result()
+	}
+
+	for _, c := range []struct {
+		method, uri string
+		status      int
+		contains    string
+	}{
+		{"GET", "/api/v1/in_area?bbox=7,63,8,64", http.StatusOK, `"id":305305000`},
+		{"GET", "/api/v1/in_area/7,63,8,64", http.StatusOK, `"id":305305000`},
+		{"GET", "/api/v1/in_area?bbox=7,64,8,63", http.StatusBadRequest, ""},
+		{"GET", "/api/v1/in_area?bbox=x", http.StatusBadRequest, ""},
+		{"POST", "/api/v1/in_area?bbox=7,63,8,64", http.StatusMethodNotAllowed, ""},
+		{"GET", "/api/v2/with_mmsi/305305000", http.StatusOK, `"mmsi":305305000`},
+		{"GET", "/api/v2/with_mmsi/305305001", http.StatusNotFound, ""},
+		{"GET", "/api/v2/with_mmsi/ship", http.StatusBadRequest, ""},
+		{"GET", "/", http.StatusOK, "<html>map</html>"},
+		{"GET", "/script.js", http.StatusOK, "var ships"},
+		{"GET", "/sub/page.js", http.StatusOK, "in a directory"},
+		{"GET", "/.secret", http.StatusForbidden, ""},
+		{"GET", "/sub/", http.StatusForbidden, ""},
+		{"GET", "/missing.js", http.StatusNotFound, ""},
+		{"POST", "/script.js", http.StatusMethodNotAllowed, ""},
+	} {
+		resp := request(c.method, c.uri)
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != c.status || !strings.Contains(string(body), c.contains) {
+			t.Errorf("%s %s: expected %d with %q, got %d %q", c.method, c.uri, c.status, c.contains,
+				resp.StatusCode, body)
+		}
+	}
+
+	for uri, to := range map[string]string{"/index.html": "/", "/sub/index.html": "/sub/"} {
+		resp := request("GET", uri)
+		if resp.StatusCode != http.StatusPermanentRedirect || resp.Header.Get("Location") != to {
+			t.Errorf("Expected %s to redirect to %s, got %d %q", uri, to,
+				resp.StatusCode, resp.Header.Get("Location"))
+		}
+	}
+}
+
+func TestPathPrefix(t *testing.T) {
+	static := t.TempDir()
+	for name, content := range map[string]string{
+		"index.html": "<html><head><title>map</title></head></html>",
+		"script.js":  "var ships = {}",
+	} {
+		if err := os.WriteFile(filepath.Join(static, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a := NewArchive(10, 0, 0, 0, 0, 0, 0)
+	saveSentence(t, a, "!BSVDM,1,1,,A,14S:Eb001ePRmHBTAAFnrmV60PRk,0*1F\r\n") // 305305000 at 63.39,7.61
+	a.db.UpdateStatic(305305000, "test", time.Now(), storage.ShipInfo{IMO: 9074729})
+	handler := NewAPIHandler(static, "/ais", nil, nil, nil, nil, a, ClientLimits{}, nil, nil, nil, defaultReadyWindow, false)
+	request := func(uri string, header ...string) *http.Response {
+		r := httptest.NewRequest("GET", uri, nil)
+		if len(header) != 0 {
+			r.Header.Set("X-Root-Location", header[0])
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Result()
+	}
+
+	for _, c := range []struct {
+		uri      string
+		status   int
+		contains string
+	}{
+		{"/ais/api/v1/in_area?bbox=7,63,8,64", http.StatusOK, `"id":305305000`},
+		{"/ais/api/v1/in_area/7,63,8,64", http.StatusOK, `"id":305305000`},
+		{"/ais/api/v2/with_mmsi/305305000", http.StatusOK, `"mmsi":305305000`},
+		{"/ais/", http.StatusOK, `<head><base href="/ais/"><title>`},
+		{"/ais/script.js", http.StatusOK, "var ships"},
+		{"/ais/missing.js", http.StatusNotFound, `href="/ais/"`},
+		{"/", http.StatusNotFound, `href="/ais/"`},
+		{"/api/v1/in_area?bbox=7,63,8,64", http.StatusNotFound, ""},
+		{"/aisx/script.js", http.StatusNotFound, ""},
+		{"/script.js", http.StatusNotFound, ""},
+	} {
+		resp := request(c.uri)
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != c.status || !strings.Contains(string(body), c.contains) {
+			t.Errorf("%s: expected %d with %q, got %d %q", c.uri, c.status, c.contains, resp.StatusCode, body)
+		}
+	}
+
+	for _, c := range []struct {
+		uri, header, to string
+		status          int
+	}{
+		{"/ais", "", "/ais/", http.StatusPermanentRedirect},
+		{"/ais/index.html", "", "/ais/", http.StatusPermanentRedirect},
+		{"/ais/index.html", "/proxied", "/proxied/", http.StatusPermanentRedirect},
+		{"/ais/api/v2/with_imo/9074729", "", "/ais/api/v2/with_mmsi/305305000", http.StatusTemporaryRedirect},
+	} {
+		resp := request(c.uri, c.header)
+		if resp.StatusCode != c.status || resp.Header.Get("Location") != c.to {
+			t.Errorf("Expected %s to redirect to %s, got %d %q", c.uri, c.to,
+				resp.StatusCode, resp.Header.Get("Location"))
+		}
+	}
+	// the header overrides the prefix in links
+	body, _ := io.ReadAll(request("/ais/", "/proxied").Body)
+	if !strings.Contains(string(body), `<base href="/proxied/">`) {
+		t.Errorf("Expected the base to be the X-Root-Location, got %q", body)
+	}
+}
+
+// Requests every endpoint listed by /api, and checks that it's routed to a
+// handler and not rejected by the router.
+func TestAPIDiscovery(t *testing.T) {
+	a := NewArchive(10, 0, 0, 0, 0, 0, 0)
+	saveSentence(t, a, "!BSVDM,1,1,,A,14S:Eb001ePRmHBTAAFnrmV60PRk,0*1F\r\n") // 305305000 at 63.39,7.61
+	stats := forwarder.NewStatsRequests()
+	go forwarder.Manager(Log, make(chan forwarder.Packet), make(chan forwarder.Conn), stats)
+	// so that the streams and admin endpoints respond right away
+	onlyPrivate, _ := forwarder.ParseNetblocks("10.0.0.0/8")
+	access := &forwarder.Access{Allow: onlyPrivate}
+	handler := NewAPIHandler("", "", nil, stats, nil, access, a, ClientLimits{}, nil, nil, access, defaultReadyWindow, false)
+	request := func(method, uri string) (int, string) {
+		r := httptest.NewRequest(method, uri, nil)
+		r.Header.Set("Accept", "application/json")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		body, _ := io.ReadAll(w.Result().Body)
+		return w.Result().StatusCode, string(body)
+	}
+
+	status, body := request("GET", "/api")
+	var doc struct {
+		Endpoints []struct {
+			Methods     []string `json:"methods"`
+			Path        string   `json:"path"`
+			Query       []string `json:"query"`
+			Description string   `json:"description"`
+		} `json:"endpoints"`
+	}
+	if status != http.StatusOK {
+		t.Fatalf("Expected /api to respond 200, got %d %s", status, body)
+	} else if err := json.Unmarshal([]byte(body), &doc); err != nil {
+		t.Fatal(err)
+	}
+	paths := make(map[string]bool)
+	examples := map[string]string{":bbox": "7,63,8,64", ":mmsi": "305305000", ":imo": "9176187",
+		":name": "ais", ":id": "1"}
+	for _, e := range doc.Endpoints {
+		paths[e.Path] = true
+		if len(e.Methods) == 0 || e.Description == "" {
+			t.Errorf("Expected %s to have methods and a description, got %+v", e.Path, e)
+		}
+		segments := strings.Split(e.Path, "/")
+		for i, segment := range segments {
+			if example, isParam := examples[segment]; isParam {
+				segments[i] = example
+			} else if strings.HasPrefix(segment, ":") {
+				t.Fatalf("No example value for %s in %s", segment, e.Path)
+			}
+		}
+		uri := strings.Join(segments, "/")
+		if len(e.Query) != 0 && e.Query[0] == "bbox" {
+			uri += "?bbox=" + examples[":bbox"]
+		}
+		for _, method := range e.Methods {
+			status, body := request(method, uri)
+			if status == http.StatusMethodNotAllowed || body == `{"error":"Not found"}` {
+				t.Errorf("%s %s was not routed: %d %s", method, uri, status, body)
+			}
+		}
+		if status, _ := request("PATCH", uri); status != http.StatusMethodNotAllowed {
+			t.Errorf("Expected PATCH %s to not be allowed, got %d", uri, status)
+		}
+	}
+	for _, path := range []string{"/api", "/api/v1/in_area", "/api/v1/in_area/:bbox", "/api/v2/with_mmsi/:mmsi",
+		"/api/v1/geofences/:id/events", "/api/v1/stream", healthzPath} {
+		if !paths[path] {
+			t.Errorf("Expected %s to be listed", path)
+		}
+	}
+
+	for _, c := range []struct {
+		method, uri string
+		status      int
+	}{
+		{"GET", "/api/v1/geofences/1", http.StatusMethodNotAllowed},
+		{"GET", "/api/v1/sources/ais/restart", http.StatusNotFound},
+		{"GET", "/api/v2/with_mmsi/305305000/track", http.StatusNotFound},
+		{"GET", "/api/v1/in_area", http.StatusNotFound},     // no bbox
+		{"GET", "/api/v1/debug/rtree", http.StatusNotFound}, // needs -debug-endpoints
+		{"GET", "/api/v1/debug/trace", http.StatusNotFound}, // so does this
+		{"GET", "/api/v1/clients", http.StatusForbidden},    // only for -admin-allow
+	} {
+		if status, body := request(c.method, c.uri); status != c.status {
+			t.Errorf("%s %s: expected %d, got %d %s", c.method, c.uri, c.status, status, body)
+		}
+	}
+
+	handler = NewAPIHandler("", "", nil, stats, nil, access, a, ClientLimits{}, nil, nil, access, defaultReadyWindow, true)
+	status, body = request("GET", "/api/v1/debug/rtree")
+	if status != http.StatusOK || !strings.Contains(body, `"type":"Point","coordinates":[7.6`) {
+		t.Errorf("Expected the single leaf of the R-tree as a point, got %d %s", status, body)
+	}
+	if status, body = request("GET", "/api/v1/debug/trace"); status != http.StatusForbidden {
+		t.Errorf("Expected traces to be forbidden outside -admin-allow, got %d %s", status, body)
+	}
+	for _, uri := range []string{"/api/v1/debug/trace", "/api/v1/clients"} {
+		r := httptest.NewRequest("GET", uri, nil)
+		r.RemoteAddr = "10.0.0.1:1234"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Result().StatusCode != http.StatusOK {
+			t.Errorf("Expected %s to be shown to -admin-allow, got %d", uri, w.Result().StatusCode)
+		}
+	}
+}
+
+func TestRequestLimits(t *testing.T) {
+	a := NewArchive(10, 0, 0, 0, 0, 0, 0)
+	handler := limitHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := io.ReadAll(r.Body); err != nil {
+			writeError(w, r, http.StatusRequestEntityTooLarge, "Request body too large")
+			return
+		}
+		inArea(w, r, bboxParams(r.URL.RawQuery), storage.AllItems, a)
+	}))
+	request := func(method, query string, body io.Reader) *http.Response {
+		r := httptest.NewRequest(method, "/api/v1/in_area?"+query, body)
+		r.Header.Set("Accept", "application/json")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Result()
+	}
+	expect := func(resp *http.Response, status int, what string) {
+		if resp.StatusCode != status {
+			t.Errorf("Expected %d for %s, got %d", status, what, resp.StatusCode)
+		}
+		if status != http.StatusOK && resp.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("Expected a JSON error for %s, got %q", what, resp.Header.Get("Content-Type"))
+		}
+	}
+
+	box := "5.5,58.9,5.9,59.1"
+	expect(request("GET", "bbox="+box, nil), http.StatusOK, "a normal request")
+	expect(request("GET", "bbox="+strings.Repeat(box+";", maxBoxes-1)+box, nil),
+		http.StatusOK, "the maximum number of boxes")
+	expect(request("GET", "bbox="+strings.Repeat(box+";", maxBoxes)+box, nil),
+		http.StatusRequestEntityTooLarge, "too many boxes")
+	expect(request("GET", strings.Repeat("bbox="+box+"&", maxBoxes+1), nil),
+		http.StatusRequestEntityTooLarge, "too many bbox parameters")
+	expect(request("GET", "bbox="+box+"&x="+strings.Repeat("x", maxURLLength), nil),
+		http.StatusRequestEntityTooLarge, "a too long URL")
+	expect(request("POST", "bbox="+box, strings.NewReader(strings.Repeat("x", maxBodySize+1))),
+		http.StatusRequestEntityTooLarge, "a too large body")
+	// without Content-Length
+	body := io.MultiReader(strings.NewReader(strings.Repeat("x", maxBodySize)), strings.NewReader("x"))
+	expect(request("POST", "bbox="+box, body), http.StatusRequestEntityTooLarge, "a too large streamed body")
+}
+
+// logBuffer is a bytes.Buffer that can be passed to l.NewLogger()
+type logBuffer struct {
+	bytes.Buffer
+}
+
+func (lb *logBuffer) Close() error {
+	return nil
+}
+
+func TestAccessLog(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/in_area", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ships"))
+	})
+	mux.HandleFunc("/api/v1/raw", func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			t.Error("Expected the ResponseWriter to still be a Flusher")
+			return
+		}
+		w.Write([]byte("!AIVDM"))
+		flusher.Flush()
+	})
+	out := &logBuffer{}
+	logger := l.NewLogger(out, l.Info)
+	defer logger.Close()
+	handler := accessLogHandler(mux, "", logger, l.Info, true)
+
+	request := func(path, forwardedFor string) *httptest.ResponseRecorder {
+		out.Reset()
+		r := httptest.NewRequest("GET", path, nil)
+		if forwardedFor != "" {
+			r.Header.Set("X-Forwarded-For", forwardedFor)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	expectLogged := func(parts ...string) {
+		line := out.String()
+		if strings.Count(line, "\n") != 1 {
+			t.Errorf("Expected one line, got %q", line)
+		}
+		for _, part := range parts {
+			if !strings.Contains(line, part) {
+				t.Errorf("Expected %q in %q", part, line)
+			}
+		}
+	}
+
+	request("/api/v1/in_area?bbox=5.123456,59.1,-6.98765,60.0001;1,2,3,4&precision=4", "")
+	expectLogged("GET /api/v1/in_area?bbox=5.123,59.1,-6.987,60.000;1,2,3,4&precision=4 ",
+		"status=200", "bytes=5", "remote=192.0.2.1:1234", "duration=")
+
+	request("/nothing", "203.0.113.7, 10.0.0.1")
+	expectLogged("GET /nothing ", "status=404", "remote=203.0.113.7 ")
+
+	if w := request("/api/v1/raw", ""); !w.Flushed {
+		t.Error("Expected the flush to reach the underlying ResponseWriter")
+	}
+	expectLogged("GET /api/v1/raw ", "status=200", "bytes=6")
+
+	out.Reset()
+	accessLogHandler(mux, "", logger, l.Ignore, true).ServeHTTP(httptest.NewRecorder(),
+		httptest.NewRequest("GET", "/nothing", nil))
+	if out.Len() != 0 {
+		t.Errorf("Expected nothing to be logged at level Ignore, got %q", out.String())
+	}
+}
+
+func TestRedirectToHTTPS(t *testing.T) {
+	cases := []struct {
+		port     uint
+		host     string
+		uri      string
+		root     string
+		expected string
+	}{
+		{443, "example.com", "/", "", "https://example.com/"},
+		{443, "example.com:80", "/api/v1/in_area?bbox=1,2,3,4", "", "https://example.com/api/v1/in_area?bbox=1,2,3,4"},
+		{8443, "localhost:8080", "/index.html", "", "https://localhost:8443/index.html"},
+		{443, "[::1]:80", "/", "", "https://[::1]/"},
+		{443, "example.com", "/api/v1/clients", "/ais", "https://example.com/ais/api/v1/clients"},
+		{443, "example.com", "/", "//evil.com", "https://example.com/"},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", c.uri, nil)
+		r.Host = c.host
+		if c.root != "" {
+			r.Header.Set("X-Root-Location", c.root)
+		}
+		w := httptest.NewRecorder()
+		redirectToHTTPSHandler(c.port).ServeHTTP(w, r)
+		if w.Code != http.StatusPermanentRedirect {
+			t.Errorf("%s%s: expected redirect, got %d", c.host, c.uri, w.Code)
+		} else if location := w.Header().Get("Location"); location != c.expected {
+			t.Errorf("%s%s with root %q: expected %s, got %s", c.host, c.uri, c.root, c.expected, location)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Host = "evil.com/x"
+	w := httptest.NewRecorder()
+	redirectToHTTPSHandler(443).ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected invalid host to be rejected, got %d %s", w.Code, w.Header().Get("Location"))
+	}
+}
+
+func TestHSTS(t *testing.T) {
+	h := hstsHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "https://example.com/", nil))
+	if w.Code != http.StatusNoContent {
+		t.Errorf("Expected the wrapped handler to run, got %d", w.Code)
+	}
+	if hsts := w.Header().Get("Strict-Transport-Security"); hsts != "max-age=31536000" {
+		t.Errorf("Unexpected Strict-Transport-Security %q", hsts)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	// slow enough that no tokens are added during the test
+	h := clientLimitHandler(ok, ClientLimits{Rate: 0.01, Burst: 5})
+	request := func(remote, path string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		r.RemoteAddr = remote
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	for i := 1; i <= 5; i++ {
+		if w := request("192.0.2.1:1234", "/api/v1/in_area?bbox=0,0,1,1"); w.Code != http.StatusOK {
+			t.Fatalf("Request %d within the burst got %d", i, w.Code)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		// with another port, as browsers would open new connections
+		w := request("192.0.2.1:4321", "/api/v1/in_area?bbox=0,0,1,1")
+		if w.Code != http.StatusTooManyRequests {
+			t.Fatalf("Request %d after the burst got %d", i+6, w.Code)
+		}
+		// a token is added every 100 seconds
+		if retry := w.Header().Get("Retry-After"); retry != "100" && retry != "99" {
+			t.Errorf("Unexpected Retry-After %q", retry)
+		}
+	}
+	if w := request("192.0.2.2:1234", "/api/v1/in_area?bbox=0,0,1,1"); w.Code != http.StatusOK {
+		t.Errorf("Other IP got %d", w.Code)
+	}
+	if w := request("192.0.2.1:1234", "/index.html"); w.Code != http.StatusOK {
+		t.Errorf("Static files should not be limited, got %d", w.Code)
+	}
+
+	// X-Forwarded-For is only used when trusted
+	h = clientLimitHandler(ok, ClientLimits{Rate: 0.01, Burst: 1, TrustProxy: true})
+	for i, client := range []string{"198.51.100.1", "198.51.100.2"} {
+		r := httptest.NewRequest("GET", "/api/v1/stats", nil)
+		r.RemoteAddr = "127.0.0.1:8000"
+		r.Header.Set("X-Forwarded-For", client+", 127.0.0.1")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Errorf("Forwarded client %d got %d", i+1, w.Code)
+		}
+	}
+}
+
+func TestRateLimiterEvictsIdle(t *testing.T) {
+	rl := newRateLimiter(1, 2)
+	start := time.Now()
+	rl.allow("192.0.2.1", start)
+	rl.allow("192.0.2.2", start.Add(rateLimiterIdle/2))
+	if len(rl.clients) != 2 {
+		t.Fatalf("Expected 2 clients, got %d", len(rl.clients))
+	}
+	// idle clients are removed at most once per rateLimiterIdle
+	rl.allow("192.0.2.2", start.Add(rateLimiterIdle+time.Second))
+	if _, ok := rl.clients["192.0.2.1"]; ok || len(rl.clients) != 1 {
+		t.Errorf("Expected the idle client to be removed, got %d clients", len(rl.clients))
+	}
+}
+
+func TestStreamLimit(t *testing.T) {
+	release := make(chan struct{})
+	streaming := make(chan struct{})
+	stream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		streaming <- struct{}{}
+		<-release
+	})
+	h := clientLimitHandler(stream, ClientLimits{Streams: 2}, "/api/v1/raw")
+	request := func(remote string) int {
+		r := httptest.NewRequest("GET", "/api/v1/raw", nil)
+		r.RemoteAddr = remote
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+	done := make(chan int)
+	for i := 0; i < 2; i++ {
+		go func() { done <- request("192.0.2.1:1234") }()
+		<-streaming
+	}
+	if code := request("192.0.2.1:5678"); code != http.StatusTooManyRequests {
+		t.Errorf("Third stream got %d", code)
+	}
+	go func() { done <- request("192.0.2.2:1234") }()
+	<-streaming // another IP can open streams
+	release <- struct{}{}
+	<-done
+	// now a new stream from the first IP should be allowed
+	go func() { done <- request("192.0.2.1:1234") }()
+	select {
+	case <-streaming:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stream not allowed after another closed")
+	}
+	close(release)
+	for i := 0; i < 3; i++ {
+		<-done
+	}
+}
+
+func TestWithIMO(t *testing.T) {
+	a := NewArchive(10, 0, 0, 0, 0, 0, 0)
+	a.db.UpdateStatic(257000001, "test", time.Now(), storage.ShipInfo{IMO: 9074729})
+	cases := []struct {
+		path     string
+		root     string
+		status   int
+		location string
+	}{
+		{"/api/v2/with_imo/9074729", "", http.StatusTemporaryRedirect, "/api/v2/with_mmsi/257000001"},
+		{"/api/v2/with_imo/9074729?points=2&since=1h", "/ais", http.StatusTemporaryRedirect,
+			"/ais/api/v2/with_mmsi/257000001?points=2&since=1h"},
+		{"/api/v2/with_imo/9074728", "", http.StatusBadRequest, ""}, // wrong check digit
+		{"/api/v2/with_imo/abc", "", http.StatusBadRequest, ""},
+		{"/api/v2/with_imo/9176187", "", http.StatusNotFound, ""},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", c.path, nil)
+		if c.root != "" {
+			r.Header.Set("X-Root-Location", c.root)
+		}
+		w := httptest.NewRecorder()
+		withIMO(w, r, strings.SplitN(r.URL.Path[len("/api/v2/with_imo/"):], "?", 2)[0], a)
+		if w.Code != c.status {
+			t.Errorf("%s: expected %d, got %d", c.path, c.status, w.Code)
+		} else if location := w.Header().Get("Location"); location != c.location {
+			t.Errorf("%s: expected redirect to %q, got %q", c.path, c.location, location)
+		}
+	}
+}
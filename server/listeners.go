@@ -2,48 +2,190 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"sync/atomic"
 	"time"
 
 	"github.com/cenkalti/backoff"
+	l "github.com/tormol/AIS/logger"
+	"github.com/tormol/AIS/nmeais"
 )
 
 const minRetryInterval = 5 * time.Second
 const noteWorthyWait = 1 * time.Minute
 const maxRetryInterval = 1 * time.Hour
 
+// reconnectLogInterval limits how often connection errors are logged for each source
+const reconnectLogInterval = 10 * time.Minute
+
 // stop trying to reconnect if the source has been down for this long
 const giveUpAfter = 7 * 24 * time.Hour
 
+// defaultSourceTimeout is the timeout of sources that don't specify one.
+const defaultSourceTimeout = 5 * time.Second
+
 // ListenerConnections stores how many sources the server is currently
 // connected to. It must be accessed through atomic operations.
 var ListenerConnections = int32(0)
 
-func newSourceBackoff() *backoff.ExponentialBackOff {
-	eb := backoff.NewExponentialBackOff()
-	eb.InitialInterval = minRetryInterval
-	eb.MaxInterval = maxRetryInterval
-	eb.MaxElapsedTime = giveUpAfter
-	eb.Reset() // current interval
-	return eb
+// A connection must have been up for healthyAfter or received healthyBytes
+// before the backoff is reset, so that a source which sends a little and
+// then fails keeps waiting longer between attempts.
+const healthyAfter = 30 * time.Second
+const healthyBytes = 64 * 1024
+
+// sourceError is a failure to connect to or read from a source.
+// The message is only formatted if it's logged.
+type sourceError struct {
+	op  string // such as "read error"
+	err error
+}
+
+func (e *sourceError) Error() string {
+	return e.op + ": " + e.err.Error()
+}
+
+// clockFunc lets the backoff use the clock of a reconnector.
+type clockFunc func() time.Time
+
+func (cf clockFunc) Now() time.Time {
+	return cf()
+}
+
+// reconnector connects to a source, reads from it until it fails,
+// and then waits on an exponential backoff before connecting again.
+type reconnector struct {
+	name         string
+	addr         string // only logged when giving up
+	backoff      *backoff.ExponentialBackOff
+	healthyAfter time.Duration
+	healthyBytes int
+	failing      bool            // the first failure of the current outage has been logged
+	stop         <-chan struct{} // closing it closes the connection and ends run(), can be nil
+	logger       *l.Logger
+	now          func() time.Time
+	sleep        func(time.Duration)
+}
+
+func newReconnector(name, addr string) *reconnector {
+	rc := &reconnector{
+		name:         name,
+		addr:         addr,
+		backoff:      backoff.NewExponentialBackOff(),
+		healthyAfter: healthyAfter,
+		healthyBytes: healthyBytes,
+		logger:       Log,
+		now:          time.Now,
+	}
+	rc.sleep = func(d time.Duration) {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-rc.stop:
+		}
+	}
+	rc.backoff.InitialInterval = minRetryInterval
+	rc.backoff.MaxInterval = maxRetryInterval
+	rc.backoff.MaxElapsedTime = giveUpAfter
+	rc.backoff.Clock = clockFunc(func() time.Time { return rc.now() })
+	rc.backoff.Reset() // current interval
+	return rc
+}
+
+// run connects and reads from the source until the backoff gives up or
+// stop is closed.
+// connect should return *sourceError so that it's clear what failed.
+// accept is called with what is read and when the read started.
+func (rc *reconnector) run(connect func() (io.ReadCloser, error), bufferSize int,
+	accept func([]byte, time.Time)) {
+	buf := make([]byte, bufferSize)
+	for !rc.stopped() {
+		err := rc.readConnection(connect, buf, accept)
+		if rc.stopped() || rc.failed(err) {
+			return
+		}
+	}
 }
 
-func handleSourceError(b *backoff.ExponentialBackOff, name, addr, err string) bool {
-	nb := b.NextBackOff()
-	if nb == backoff.Stop {
-		Log.Error("Giving up connectiong to %s (%s)", name, addr)
+// stopped returns true if stop has been closed.
+func (rc *reconnector) stopped() bool {
+	select {
+	case <-rc.stop:
 		return true
-	} else if nb > noteWorthyWait {
-		Log.Warning(err)
+	default:
+		return false
 	}
-	time.Sleep(nb)
+}
+
+// readConnection makes one connection attempt and reads until it fails.
+func (rc *reconnector) readConnection(connect func() (io.ReadCloser, error), buf []byte,
+	accept func([]byte, time.Time)) error {
+	conn, err := connect()
+	if err != nil {
+		return err
+	}
+	atomic.AddInt32(&ListenerConnections, 1)
+	defer atomic.AddInt32(&ListenerConnections, -1)
+	done := make(chan struct{})
+	defer close(done)
+	go func() { // closing the connection is the only way to interrupt Read()
+		select {
+		case <-done:
+		case <-rc.stop:
+		}
+		closeAndCheck(conn, rc.name)
+	}()
+	connected := rc.now()
+	received, healthy := 0, false
+	for {
+		readStarted := rc.now()
+		n, err := conn.Read(buf)
+		if n > 0 {
+			accept(buf[:n], readStarted)
+		}
+		if err != nil {
+			return &sourceError{"read error", err}
+		}
+		received += n
+		if !healthy && (received >= rc.healthyBytes || rc.now().Sub(connected) >= rc.healthyAfter) {
+			healthy = true
+			rc.backoff.Reset()
+			rc.failing = false
+		}
+	}
+}
+
+// failed logs the error and waits before the next attempt,
+// or returns true if the source has been failing for too long.
+// The first failure after the source was healthy is always logged,
+// later ones only when the wait is long.
+func (rc *reconnector) failed(err error) (giveUp bool) {
+	wait := rc.backoff.NextBackOff()
+	if wait == backoff.Stop {
+		rc.logger.Error("Giving up connecting to %s (%s): %s", rc.name, rc.addr, err.Error())
+		return true
+	} else if !rc.failing {
+		rc.failing = true
+		rc.logger.Info("%s: %s, reconnecting in %s", rc.name, err.Error(), wait.Round(time.Second))
+	} else if wait > noteWorthyWait {
+		rc.logger.Limited(rc.name+"_reconnect", reconnectLogInterval).Warning(
+			"%s: %s, reconnecting in %s", rc.name, err.Error(), wait.Round(time.Second))
+	}
+	rc.sleep(wait)
 	return false
 }
 
@@ -54,79 +196,129 @@ func closeAndCheck(c io.Closer, name string) {
 	}
 }
 
-func readFile(path string, parser *PacketParser) {
+// gzipMagic is the first bytes of gzip files.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// readFile reads sentences from a file, which is decompressed if it's gzipped.
+// If path ends with a slash, every file in the directory is read in order of
+// their names, such as the hourly files from Recorder.
+// loops is how many times to read the file, a negative number repeats it forever.
+// pace limits how many lines are read per second, 0 reads as fast as possible.
+// If there are no other sources when it's done the server exits.
+func readFile(path string, loops, pace int, parser *PacketParser) {
 	defer parser.Close()
+	atomic.AddInt32(&ListenerConnections, 1)
+	next := time.Now() // when to read the next line if paced
+loop:
+	for i := 0; i != loops; i++ {
+		paths := []string{path}
+		if strings.HasSuffix(path, "/") {
+			var err error
+			paths, err = listDirectory(path) // again for each loop to include new files
+			Log.FatalIfErr(err, "read directory")
+		}
+		for _, p := range paths {
+			if !readFileOnce(p, pace, &next, parser) {
+				break loop
+			}
+		}
+	}
+	after := atomic.AddInt32(&ListenerConnections, -1)
+	Log.FatalIf(after == 0, "EOF")
+}
+
+// readFileOnce reads the file from start to end, and returns false if there was an error.
+func readFileOnce(path string, pace int, next *time.Time, parser *PacketParser) bool {
 	file, err := os.Open(path)
 	Log.FatalIfErr(err, "open file")
 	defer closeAndCheck(file, parser.SourceName)
-	atomic.AddInt32(&ListenerConnections, 1)
 	reader := bufio.NewReaderSize(file, 512)
-	lines := 0
+	if magic, _ := reader.Peek(len(gzipMagic)); strings.HasSuffix(path, ".gz") ||
+		bytes.Equal(magic, gzipMagic) {
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			Log.Error("Error reading %s: %s", parser.SourceName, err.Error())
+			return false
+		}
+		defer closeAndCheck(gz, parser.SourceName)
+		reader = bufio.NewReaderSize(gz, 512)
+	}
 	for {
+		if pace != 0 {
+			*next = next.Add(time.Second / time.Duration(pace))
+			time.Sleep(time.Until(*next))
+		}
 		readStarted := time.Now()
 		line, err := reader.ReadBytes(byte('\n'))
-		lines++
-		Log.Info("line %d", lines)
+		if err == io.EOF && len(line) != 0 {
+			// don't merge the last line with the first when looping
+			line = append(line, '\n')
+		}
 		parser.Accept(line, readStarted)
-		if err != nil {
-			if err != io.EOF {
-				Log.Error("Error reading %s: %s",
-					parser.SourceName, err.Error())
-			}
-			break
+		if err == io.EOF {
+			return true
+		} else if err != nil {
+			Log.Error("Error reading %s: %s",
+				parser.SourceName, err.Error())
+			return false
 		}
 	}
-	after := atomic.AddInt32(&ListenerConnections, -1)
-	Log.FatalIf(after == 0, "EOF")
 }
 
-func readTCP(addr string, silenceTimeout time.Duration, parser *PacketParser) {
+// readTCP reads from a raw TCP connection, which is wrapped in TLS if
+// tlsConfig is not nil.
+// sendFirst is written to the connection after connecting, for sources that
+// want a login line or similar.
+// bufferSize is the most that is read at a time.
+// It reconnects until it gives up or stop is closed, and then closes parser.
+func readTCP(addr string, silenceTimeout time.Duration, tlsConfig *tls.Config, sendFirst []byte,
+	bufferSize int, parser *PacketParser, stop <-chan struct{}) {
 	defer parser.Close()
-	b := newSourceBackoff()
-	for {
-		err := func() string { // scope for the defers
-			addr, err := net.ResolveTCPAddr("tcp", addr)
-			if err != nil {
-				return fmt.Sprintf("Failed to resolve %ss adress (%s): %s",
-					parser.SourceName, addr, err.Error())
-			}
-			conn, err := net.DialTCP("tcp", nil, addr)
-			if err != nil {
-				return fmt.Sprintf("Failed to connect to %s: %s",
-					parser.SourceName, err.Error())
-			}
-			atomic.AddInt32(&ListenerConnections, 1)
-			defer atomic.AddInt32(&ListenerConnections, -1)
-			defer closeAndCheck(conn, parser.SourceName)
-			// conn.CloseWrite() // causes EOFs from Kystverket
-			buf := make([]byte, 4096)
-			for {
-				readStarted := time.Now()
-				conn.SetReadDeadline(readStarted.Add(silenceTimeout))
-				n, err := conn.Read(buf)
-				if err != nil {
-					return fmt.Sprintf("%s read error: %s",
-						parser.SourceName, err.Error())
-				}
-				parser.Accept(buf[:n], readStarted)
-				b.Reset()
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	connect := func() (io.ReadCloser, error) {
+		var conn net.Conn
+		var err error
+		if tlsConfig != nil {
+			conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+		} else {
+			conn, err = dialer.Dial("tcp", addr)
+		}
+		if err != nil {
+			return nil, &sourceError{"failed to connect", err}
+		}
+		// conn.CloseWrite() // causes EOFs from Kystverket
+		if len(sendFirst) != 0 {
+			conn.SetWriteDeadline(time.Now().Add(silenceTimeout))
+			if _, err := conn.Write(sendFirst); err != nil {
+				closeAndCheck(conn, parser.SourceName)
+				return nil, &sourceError{"write error", err}
 			}
-		}()
-		if handleSourceError(b, parser.SourceName, addr, err) {
-			break
 		}
+		return &timeoutConn{Conn: conn, timeout: silenceTimeout}, nil
 	}
+	rc := newReconnector(parser.SourceName, addr)
+	rc.stop = stop
+	rc.run(connect, bufferSize, parser.Accept)
 }
 
-func readHTTP(url string, silenceTimeout time.Duration, parser *PacketParser) {
+// readHTTP reads the body of a HTTP or HTTPS response.
+// User info in the URL is sent as basic authentication, and is not logged.
+// tlsConfig can be nil to use the system's CAs.
+// bufferSize is the most that is read at a time.
+// It reconnects until it gives up or stop is closed, and then closes parser.
+func readHTTP(rawURL string, silenceTimeout time.Duration, tlsConfig *tls.Config, bufferSize int,
+	parser *PacketParser, stop <-chan struct{}) {
 	defer parser.Close()
-	b := newSourceBackoff()
-	// I think this modifies the global variable.
-	// Trying to copy it results in a warning about copying mutexes,
-	// and I don't know weither that's OK in this case.
-	// The shortened timeout should be harmless
-	transport := (http.DefaultTransport.(*http.Transport))
+	u, err := url.Parse(rawURL)
+	if err != nil { // checked by parseSource
+		Log.Error("Invalid URL for %s: %s", parser.SourceName, err.Error())
+		return
+	}
+	user := u.User
+	u.User = nil
+	transport := http.DefaultTransport.(*http.Transport).Clone()
 	transport.DialContext = newTimeoutConnDialer(silenceTimeout)
+	transport.TLSClientConfig = tlsConfig
 	// net/http/httptrace doesn't seem to have anything for packets of body
 	client := http.Client{
 		Transport: transport,
@@ -136,69 +328,337 @@ func readHTTP(url string, silenceTimeout time.Duration, parser *PacketParser) {
 				return http.ErrUseLastResponse
 			}
 			Log.Warning("%ss %s redirects to %s",
-				parser.SourceName, via[0].URL, req.URL)
+				parser.SourceName, via[0].URL, req.URL.Redacted())
 			return nil
 		},
 		Timeout: 0, // From start to close
 	}
-	for {
-		err := func() string { // scope for the defers
-			request, err := http.NewRequest("GET", url, nil)
-			if err != nil {
-				return fmt.Sprintf("Failed to create request for %s: %s", url, err.Error())
+	connect := func() (io.ReadCloser, error) {
+		request, err := http.NewRequest("GET", u.String(), nil)
+		if err != nil {
+			return nil, &sourceError{"failed to create request", err}
+		}
+		if user != nil {
+			password, _ := user.Password()
+			request.SetBasicAuth(user.Username(), password)
+		}
+		resp, err := client.Do(request)
+		if err != nil {
+			return nil, &sourceError{"failed to connect", err}
+		}
+		if resp.StatusCode != http.StatusOK {
+			closeAndCheck(resp.Body, parser.SourceName)
+			return nil, &sourceError{"bad response", errors.New(resp.Status)}
+		}
+		// Body is only ReadCloser, and GzipReader isn't Conn so type asserting won't work.
+		// If it did we could set its timeout directly
+		// We could also check and branch to two different implementations.
+		// if resp.Body.(net.Conn) != nil {
+		// 	Log.Debug("http.Response.Body is a %T", resp.Body)
+		// }
+		// Can also try to http.Hijack it,
+		// if I can force HTTP/1.1 and no compression thet could work.
+		return resp.Body, nil
+	}
+	rc := newReconnector(parser.SourceName, u.String())
+	rc.stop = stop
+	rc.run(connect, bufferSize, parser.Accept)
+}
+
+// maxDatagram is the largest payload of an UDP datagram over IPv4,
+// so that a datagram is never truncated by a small -read-buffer.
+const maxDatagram = 65507
+
+// udpSender is a listening UDP socket whose reads record who sent each datagram.
+type udpSender struct {
+	*net.UDPConn
+	pl *packetLogger
+}
+
+func (u *udpSender) Read(buf []byte) (int, error) {
+	n, from, err := u.ReadFromUDP(buf)
+	if n > 0 && from != nil {
+		u.pl.sentBy(from.String(), n)
+	}
+	return n, err
+}
+
+// readUDP listens on a local UDP address and passes every datagram to parser,
+// from any number of senders.
+// Sentences split across datagrams are merged, but senders that both split
+// sentences at the same time will garble each other's.
+// There is no silence timeout, as a receiver can have nothing to send,
+// but the socket is bound again after a read error.
+// It listens until it gives up or stop is closed, and then closes parser.
+func readUDP(addr string, bufferSize int, parser *PacketParser, stop <-chan struct{}) {
+	defer parser.Close()
+	connect := func() (io.ReadCloser, error) {
+		local, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			return nil, &sourceError{"invalid address", err}
+		}
+		conn, err := net.ListenUDP("udp", local)
+		if err != nil {
+			return nil, &sourceError{"failed to listen", err}
+		}
+		return &udpSender{UDPConn: conn, pl: &parser.pl}, nil
+	}
+	if bufferSize < maxDatagram {
+		bufferSize = maxDatagram
+	}
+	rc := newReconnector(parser.SourceName, addr)
+	rc.stop = stop
+	rc.run(connect, bufferSize, parser.Accept)
+}
+
+// Source is a parsed source argument.
+type Source struct {
+	Name      string
+	URL       string // can contain a password
+	Timeout   time.Duration
+	SendFirst []byte // for tcp:// and tls://
+	Loop      bool   // restart files from the beginning when the end is reached
+	Pace      int    // max sentences per second from files, 0 means no limit
+	Strict    bool   // reject sentences without a checksum
+	Filter    SourceFilter
+}
+
+// scheme returns the protocol part of the URL, or "" if there is none.
+func (s *Source) scheme() string {
+	if i := strings.Index(s.URL, "://"); i != -1 {
+		return s.URL[:i]
+	}
+	return ""
+}
+
+// redactURL replaces any password in an URL with "xxxxx".
+// If the URL cannot be parsed the username is also replaced.
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err == nil && u.User == nil {
+		return rawURL
+	} else if err == nil {
+		return u.Redacted()
+	}
+	// hide all of the user info if the URL is invalid
+	start := strings.Index(rawURL, "://")
+	at := strings.LastIndexByte(rawURL, '@')
+	if start != -1 && at > start {
+		return rawURL[:start+3] + "xxxxx" + rawURL[at:]
+	}
+	return rawURL
+}
+
+// parseSource parses a source argument of the form
+// [name[:timeout][,option]...=]URL
+// where the options are loop, pace=N/s, strict, sendfirst="...",
+// drop_ownship, drop_mmsi=N,... and bbox=minLat,minLong,maxLat,maxLong.
+// sendfirst is a Go string literal, which means it can contain escapes
+// such as \r\n.
+// If there is no name, the URL without any password is used as name.
+// The error messages names the source, but never contains a password.
+func parseSource(arg string, defaultTimeout time.Duration) (Source, error) {
+	s := Source{URL: arg, Timeout: defaultTimeout}
+	fail := func(format string, args ...interface{}) (Source, error) {
+		name := s.Name
+		if name == "" {
+			name = redactURL(arg)
+		}
+		return Source{}, fmt.Errorf("Source %s: "+format, append([]interface{}{name}, args...)...)
+	}
+	// The prefix ends with the first '=' outside of sendfirst,
+	// but an URL without prefix can also contain '=', so stop at "://".
+	if i := strings.IndexAny(arg, ":,="); i != -1 && !strings.HasPrefix(arg[i:], "://") {
+		s.Name = arg[:i]
+		rest := arg[i:]
+		if s.Name == "" {
+			return fail("name cannot be empty")
+		}
+		if rest[0] == ':' {
+			end := strings.IndexAny(rest, ",=")
+			if end == -1 {
+				return fail("missing '=' between timeout and URL")
 			}
-			resp, err := client.Do(request)
-			if err != nil {
-				return fmt.Sprintf("Failed to connect to %s: %s",
-					parser.SourceName, err.Error())
+			timeout, err := time.ParseDuration(rest[1:end])
+			if err != nil || timeout <= 0 {
+				return fail("invalid timeout %q", rest[1:end])
 			}
-			atomic.AddInt32(&ListenerConnections, 1)
-			defer atomic.AddInt32(&ListenerConnections, -1)
-			defer closeAndCheck(resp.Body, parser.SourceName)
-			// Body is only ReadCloser, and GzipReader isn't Conn so type asserting won't work.
-			// If it did we could set its timeout directly
-			// We could also check and branch to two different implementations.
-			// if resp.Body.(net.Conn) != nil {
-			// 	Log.Debug("http.Response.Body is a %T", resp.Body)
-			// }
-			// Can also try to http.Hijack it,
-			// if I can force HTTP/1.1 and no compression thet could work.
-
-			buf := make([]byte, 4096)
-			for {
-				readStarted := time.Now() // FIXME reuse time.Now() from timeoutConn.Read()?
-				n, err := resp.Body.Read(buf)
+			s.Timeout = timeout
+			rest = rest[end:]
+		}
+		for rest[0] == ',' {
+			end := strings.IndexAny(rest[1:], ",=") + 1
+			if end == 0 {
+				return fail("missing '=' before the URL")
+			}
+			option := rest[1:end]
+			rest = rest[end:]
+			switch option {
+			case "loop":
+				s.Loop = true
+			case "strict":
+				s.Strict = true
+			case "drop_ownship":
+				s.Filter.DropOwnShip = true
+			case "drop_mmsi", "bbox":
+				// the values contain commas, so they end at the first
+				// character that cannot be part of them
+				end = strings.IndexFunc(rest[1:], func(r rune) bool {
+					return !strings.ContainsRune("0123456789.,-", r)
+				}) + 1
+				if rest[0] != '=' || end == 0 {
+					return fail("%s needs a value followed by '=' and the URL", option)
+				}
+				value := strings.TrimSuffix(rest[1:end], ",")
+				rest = rest[1+len(value):]
+				var err error
+				if option == "drop_mmsi" {
+					s.Filter.DropMMSI, err = parseDropMMSI(value)
+				} else {
+					s.Filter.BBox, err = parseLatLongBox(value)
+				}
 				if err != nil {
-					return fmt.Sprintf("%s read error: %s",
-						parser.SourceName, err.Error())
+					return fail("invalid %s: %s", option, err.Error())
+				}
+			case "pace":
+				end = strings.IndexAny(rest[1:], ",=") + 1
+				if rest[0] != '=' || end == 0 {
+					return fail("pace needs a value such as 200/s")
 				}
-				parser.Accept(buf[:n], readStarted)
-				b.Reset()
+				pace, err := strconv.ParseUint(strings.TrimSuffix(rest[1:end], "/s"), 10, 31)
+				if err != nil || pace == 0 || !strings.HasSuffix(rest[1:end], "/s") {
+					return fail("invalid pace %q, expected sentences per second such as 200/s", rest[1:end])
+				}
+				s.Pace = int(pace)
+				rest = rest[end:]
+			case "sendfirst":
+				quoted, err := strconv.QuotedPrefix(rest[1:])
+				if rest[0] != '=' || err != nil {
+					return fail("sendfirst must be a quoted string")
+				}
+				unquoted, _ := strconv.Unquote(quoted)
+				s.SendFirst = []byte(unquoted)
+				rest = rest[1+len(quoted):]
+				if rest == "" {
+					return fail("missing '=' before the URL")
+				}
+			default:
+				return fail("unknown option %q", option)
 			}
-		}()
-		if handleSourceError(b, parser.SourceName, url, err) {
-			break
 		}
+		if rest[0] != '=' || len(rest) == 1 {
+			return fail("missing URL")
+		}
+		s.URL = rest[1:]
+	}
+	if s.Name == "" {
+		s.Name = redactURL(s.URL)
+	}
+	switch s.scheme() {
+	case "http", "https":
+		if _, err := url.Parse(s.URL); err != nil {
+			return fail("invalid URL")
+		}
+	case "tcp", "tls":
+	case "udp-listen":
+		_, port, err := net.SplitHostPort(s.URL[len("udp-listen://"):])
+		if _, perr := strconv.ParseUint(port, 10, 16); err != nil || perr != nil {
+			return fail("invalid address to listen on, expected udp-listen://[host]:port")
+		}
+	case "sim":
+		if _, err := parseSimulation(s.URL); err != nil {
+			return fail("%s", err.Error())
+		}
+	case "file", "":
+		if len(s.SendFirst) != 0 {
+			return fail("sendfirst is only supported for tcp:// and tls://")
+		}
+		return s, nil
+	default:
+		return fail("unsupported protocol %s", s.scheme())
+	}
+	if s.Loop || s.Pace != 0 {
+		return fail("loop and pace are only supported for files")
+	}
+	if len(s.SendFirst) != 0 && s.scheme() != "tcp" && s.scheme() != "tls" {
+		return fail("sendfirst is only supported for tcp:// and tls://")
 	}
+	return s, nil
 }
 
-// Read sets up the connection an AIS source and the handlin of its data.
+// loadSourcesFile reads a file with one source argument per line,
+// in the syntax of parseSource.
+// Empty lines and lines starting with # are skipped.
+func loadSourcesFile(path string) ([]Source, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	sources := []Source{}
+	for i, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		s, err := parseSource(line, defaultSourceTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %s", path, i+1, err.Error())
+		}
+		sources = append(sources, s)
+	}
+	return sources, nil
+}
+
+// loadCA creates a TLS configuration which trusts the certificates in a PEM file.
+func loadCA(path string) (*tls.Config, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("No certificates in %s", path)
+	}
+	return &tls.Config{RootCAs: pool}, nil
+}
+
+// read connects to an AIS source and parses its data until the reader
+// gives up, reaches the end of a file or stop is closed.
 // Internally it calls out to different connection types based on the protocol
 // in the URL.
-func Read(name, url string, timeout time.Duration, merger *SourceMerger) *PacketParser {
-	ph := NewPacketParser(name, Log, merger.Accept)
-	if strings.HasPrefix(url, "http://") {
-		go readHTTP(url, timeout, ph)
-	} else if strings.HasPrefix(url, "tcp://") {
-		go readTCP(url[len("tcp://"):], timeout, ph)
-	} else if strings.HasPrefix(url, "file://") {
-		go readFile(url[len("file://"):], ph)
-	} else if strings.Contains(url, "://") {
-		Log.Fatal("%s has unsupported protocol: %s", name, url)
-	} else {
-		go readFile(url, ph)
-	}
-	return ph
+// sourceTLS is used for https:// and tls:// sources, and can be nil to use
+// the system's CAs.
+// parserQueue is the number of sentences that can wait to be parsed,
+// and readBuffer is the most that is read from TCP and HTTP sources at a time.
+// udp-listen:// sources listen on the address after ://, such as :10110.
+// Files cannot be stopped.
+func read(s Source, sourceTLS *tls.Config, parserQueue, readBuffer int,
+	dst func(*nmeais.Message), stop <-chan struct{}) {
+	ph := NewPacketParser(s.Name, s.Strict, s.Filter, parserQueue, Log, dst)
+	switch s.scheme() {
+	case "http", "https":
+		readHTTP(s.URL, s.Timeout, sourceTLS, readBuffer, ph, stop)
+	case "tcp":
+		readTCP(s.URL[len("tcp://"):], s.Timeout, nil, s.SendFirst, readBuffer, ph, stop)
+	case "tls":
+		if sourceTLS == nil {
+			sourceTLS = &tls.Config{}
+		}
+		readTCP(s.URL[len("tls://"):], s.Timeout, sourceTLS, s.SendFirst, readBuffer, ph, stop)
+	case "udp-listen":
+		readUDP(s.URL[len("udp-listen://"):], readBuffer, ph, stop)
+	case "sim":
+		sim, _ := parseSimulation(s.URL) // validated by parseSource()
+		readSimulation(sim, ph, stop)
+	case "file", "":
+		loops := 1
+		if s.Loop {
+			loops = -1
+		}
+		readFile(strings.TrimPrefix(s.URL, "file://"), loops, s.Pace, ph)
+	default:
+		Log.Fatal("%s has unsupported protocol: %s", s.Name, s.URL)
+	}
 }
 
 // Adapted from https://gist.github.com/jbardin/9663312
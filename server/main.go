@@ -1,13 +1,17 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"os"
 	"os/signal"
 	"runtime"
 	"runtime/pprof"
+	"strconv"
 	"strings"
 	"sync/atomic"
 	"syscall"
@@ -15,7 +19,7 @@ import (
 
 	"github.com/tormol/AIS/forwarder"
 	l "github.com/tormol/AIS/logger"
-	"github.com/tormol/AIS/nmeais"
+	"github.com/tormol/AIS/storage"
 )
 
 // Log holds the logger instance used throuhgout most of the program.
@@ -24,21 +28,82 @@ import (
 var Log = l.NewLogger(os.Stderr, l.Info)
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "decode" {
+		os.Exit(runDecode(os.Args[2:], os.Stdin, os.Stdout, os.Stderr))
+	}
 	cpuprofile := flag.String("cpuprofile", "", "write CPU profile to file")
 	memprofile := flag.String("memprofile", "", "write memory profile to file")
 	httpPort := flag.Uint("http-port", 0, "Run web server on port. Default is 80")
+	httpsPort := flag.Uint("https-port", 0, "Serve HTTPS on port when -tls-cert is set, and redirect -http-port there. Default is 443")
+	tlsCert := flag.String("tls-cert", "", "PEM file with the certificate (chain) to serve HTTPS with. Requires -tls-key")
+	tlsKey := flag.String("tls-key", "", "PEM file with the private key for -tls-cert")
 	rawPort := flag.Uint("raw-port", 0, "Forward messages over raw TCP and UDP on port. Default is 23 (the telnet port)")
+	jsonPort := flag.Uint("json-port", 0, "Also forward decoded messages as JSON lines over TCP on port. Default is to only serve them over HTTP")
+	decodedReplay := flag.Uint("decoded-replay", 5000, "Number of decoded messages remembered for clients that reconnect with resume_after")
 	local := flag.Bool("local", false, "Listen only on localhost, and change the default ports to 8080 and 8023")
 	webPath := flag.String("web-directory", "static", "Path to the directory to serve files on the website from")
-	historyLength := flag.Uint("history-length", 0, "Number of positions to remember for each ship. Default is 100")
+	pathPrefix := flag.String("path-prefix", "", "Serve the website and the API under this path, such as /ais, for reverse proxies that don't remove it")
+	historyLength := flag.Uint("history-length", 300, "Maximum number of positions to remember for each ship. 0 remembers only the latest")
+	historyRetain := flag.Float64("history-retain", storage.DefaultHistoryRetain, "Fraction of -history-length positions kept when the history of a ship is full")
+	historySpan := flag.Duration("history-span", 12*time.Hour, "Forget positions this much older than the newest position of a ship. 0 means no limit")
+	historyDistance := flag.Float64("history-distance", 50, "Minimum distance in meters between remembered positions, unless -history-interval has passed")
+	historyInterval := flag.Duration("history-interval", 10*time.Minute, "Remember a position after this duration even if the ship hasn't moved -history-distance")
 	goneThreshold := flag.Duration("gone-threshold", 24*time.Hour, "Duration of no update after which to hide a ship that wasn't moving. Default is one day")
 	leftAreaThreshold := flag.Duration("left-area-threshold", 24*time.Hour, "Duration of no update after which to hide a ship that was moving. Default is to match -gone-treshold")
+	statusChanges := flag.Uint("status-changes", 20, "Number of navigation status changes to remember for each ship")
+	skipImplausible := flag.Bool("skip-implausible", false, "Don't remember positions that imply a speed above 110 knots, which are probably corrupted")
+	indexShards := flag.Uint("index-shards", 1, "Split the spatial index into this many bands of longitude, which lets updates in different bands run concurrently")
+	checkMMSI := flag.Bool("check-mmsi", true, "Don't store ships with MMSIs whose leading digits don't match any kind of station, such as from test transmitters")
+	maxShips := flag.Uint("max-ships", 0, "Forget the least recently updated ships when there are more than this many. 0 means no limit")
+	maxExtrapolation := flag.Duration("max-extrapolation", storage.DefaultMaxExtrapolation, "How far ahead ?extrapolate=1 projects positions. 0 disables extrapolation")
+	rawAllow := flag.String("raw-allow", "", "Comma-separated CIDR ranges allowed to receive forwarded messages. Default is everybody")
+	sourcesFile := flag.String("sources-file", "", "Also read sources from this file, one per line, and reload it on SIGHUP")
+	adminAllow := flag.String("admin-allow", "127.0.0.1,::1", "Comma-separated CIDR ranges allowed to use the admin API, such as reconnecting sources")
+	rawPassword := flag.String("raw-password", "", "Password TCP forwarding clients must send as \"AUTH $password\" first")
+	forwardTags := flag.Bool("forward-tags", false, "Prefix sentences forwarded over TCP and UDP with a TAG block with receive time and source")
+	recordDir := flag.String("record-dir", "", "Also append every message that isn't a duplicate to one file per hour in this directory")
+	recordKeep := flag.Duration("record-keep", 7*24*time.Hour, "Delete files in -record-dir that are older than this. 0 keeps them forever")
+	recordSync := flag.Duration("record-sync", 10*time.Second, "How often files in -record-dir are synced to disk. 0 syncs after every message")
+	forwardOwn := flag.Bool("forward-own", false, "Also forward own-ship (VDO) sentences to raw clients")
+	forwardBuffer := flag.Uint("forward-buffer", forwarder.DefaultConnBufferSize, "Bytes of messages that can wait to be sent to each forwarding client before the oldest are dropped")
+	outputDelay := flag.Duration("output-delay", 0, "Hold messages this long before forwarding them to raw clients, such as 10m. The API and the decoded stream are not delayed")
+	outputDelayBuffer := flag.Uint("output-delay-buffer", forwarder.DefaultMaxDelayedBytes, "Bytes of messages -output-delay can hold before the oldest are dropped")
+	correctSkew := flag.Bool("correct-skew", false, "Subtract how late each source delivers messages (estimated from base station reports, at most 5 minutes) from the time of its positions")
+	suppressClasses := flag.String("suppress-classes", "", "Vessel types to leave out of everything the server outputs, such as 35,55 for military and law enforcement. Ranges such as 50-59 are allowed. They're still stored")
+	forwardWriteTimeout := flag.Duration("forward-write-timeout", forwarder.DefaultWriteTimeout, "Disconnect TCP forwarding clients that haven't accepted anything for this long. 0 disables it")
+	parserQueue := flag.Uint("parser-queue", 200, "Number of sentences per source that can wait to be parsed before reading blocks")
+	archiveQueue := flag.Uint("archive-queue", 0, "Number of messages that can wait for each save worker before parsing blocks")
+	saveWorkers := flag.Uint("save-workers", uint(runtime.GOMAXPROCS(0)), "Number of goroutines saving messages to the archive. Default is the number of CPUs Go uses")
+	readBuffer := flag.Uint("read-buffer", 4096, "Maximum number of bytes read from a TCP or HTTP source at a time")
+	sourceCA := flag.String("source-ca", "", "PEM file with the CA certificate(s) to trust for https:// and tls:// sources instead of the system's")
+	httpLogLevel := flag.String("http-log-level", "info", "Level to log HTTP requests at, ignore disables the access log")
+	trustProxy := flag.Bool("trust-proxy", false, "Log and limit the client from X-Forwarded-For instead of the address connecting, when behind a reverse proxy")
+	readyWindow := flag.Duration("ready-window", defaultReadyWindow, "/readyz fails if no message has been received for this long")
+	maxUnready := flag.Duration("max-unready", 0, "Exit if /readyz has failed for this long, so that a supervisor restarts the server. 0 disables it")
+	rateLimit := flag.Float64("rate-limit", 10, "Maximum API requests per second from one IP address. 0 disables the limit")
+	rateBurst := flag.Uint("rate-burst", 50, "Number of API requests one IP address can make at once before -rate-limit applies")
+	streamLimit := flag.Uint("stream-limit", 3, "Maximum number of streams one IP address can have open at once. 0 disables the limit")
+	logJSON := flag.Bool("log-json", false, "Write log messages as one JSON object per line")
+	logFile := flag.String("log-file", "", "Append log messages to this file instead of stderr, and reopen it on SIGHUP")
+	safetyMessages := flag.Uint("safety-messages", defaultSafetyMessages, "Number of recent safety-related text messages (type 12 and 14) to keep")
+	debugEndpoints := flag.Bool("debug-endpoints", false, "Serve /api/v1/debug/rtree, which shows the structure of the spatial index, and /api/v1/debug/trace for -admin-allow")
 	help := flag.Bool("h", false, "Print this help and exit")
 	flag.Parse()
 	if *help {
 		flag.Usage()
 		return
 	}
+	var logTo io.WriteCloser = os.Stderr
+	if *logFile != "" {
+		f, err := openLogFile(*logFile)
+		Log.FatalIfErr(err, "open -log-file")
+		logTo = f
+	}
+	if *logJSON {
+		Log = l.NewJSONLogger(logTo, l.Info)
+	} else if *logFile != "" {
+		Log = l.NewLogger(logTo, l.Info)
+	}
 	if *cpuprofile != "" {
 		f, err := os.Create(*cpuprofile)
 		Log.FatalIfErr(err, "create CPU profile file")
@@ -51,41 +116,164 @@ func main() {
 	log.SetOutput(Log.WriteAdapter(l.Warning))
 	log.SetFlags(0) // Log will add the date and time when wanted
 
-	a := NewArchive(*historyLength, *goneThreshold, *leftAreaThreshold) //Archive is used to control the reading and writing of ais info to and from the data structures
-	toArchive := make(chan *nmeais.Message)
-	go a.Save(toArchive) //Saves the stream of messages to the Archive
+	a := NewArchive(*historyLength, *historySpan, *historyDistance, *historyInterval,
+		*goneThreshold, *leftAreaThreshold, *statusChanges) //Archive is used to control the reading and writing of ais info to and from the data structures
+	a.db.SkipImplausible = *skipImplausible
+	a.db.MaxExtrapolation = *maxExtrapolation
+	Log.FatalIf(*historyRetain < 0 || *historyRetain >= 1, "-history-retain must be at least 0 and less than 1")
+	a.db.HistoryRetain = *historyRetain
+	a.maxShips = int(*maxShips)
+	a.db.Evictable = a.maxShips > 0
+	a.allowImplausibleMMSI = !*checkMMSI
+	a.safety = storage.NewSafetyMessageLog(*safetyMessages)
+	if *suppressClasses != "" {
+		types, err := parseCodes(*suppressClasses, 255)
+		Log.FatalIfErr(err, "parse -suppress-classes")
+		a.db.SuppressTypes = make(map[storage.ShipType]bool, len(types))
+		for _, t := range types {
+			a.db.SuppressTypes[storage.ShipType(t)] = true
+		}
+	}
+	if *indexShards > 1 {
+		Log.FatalIf(*indexShards > 360, "-index-shards cannot be more than 360")
+		a.rt = storage.NewShardedRTree(int(*indexShards))
+	}
+	toDecodedForwarder := make(chan forwarder.Packet)
+	a.ForwardDecoded(toDecodedForwarder)
+	Log.FatalIf(*saveWorkers == 0, "-save-workers cannot be zero")
+	toArchive := a.StartSaving(int(*saveWorkers), int(*archiveQueue)) //Saves the stream of messages to the Archive
 	//Use the Archive to retrieve info about position, tracklog, etc..
 
-	newForwarder := make(chan forwarder.Conn, 20)
-	httpAddr, rawAddr := assembleAddrs(*local, *httpPort, *rawPort)
-	go HTTPServer(httpAddr, *webPath, newForwarder, a)
-	go forwarder.TCPServer(Log, rawAddr, newForwarder)
-	go forwarder.UDPServer(Log, rawAddr, newForwarder)
+	allowed, err := forwarder.ParseNetblocks(*rawAllow)
+	Log.FatalIfErr(err, "parse -raw-allow")
+	rawAccess := &forwarder.Access{Allow: allowed, Password: *rawPassword}
 
-	toForwarder := make(chan []byte)
-	go forwarder.Manager(Log, toForwarder, newForwarder)
+	adminAllowed, err := forwarder.ParseNetblocks(*adminAllow)
+	Log.FatalIfErr(err, "parse -admin-allow")
+	Log.FatalIf(len(adminAllowed) == 0, "-admin-allow cannot be empty")
+	adminAccess := &forwarder.Access{Allow: adminAllowed}
 
-	sm := NewSourceMerger(Log, toForwarder, toArchive)
+	var sourceTLS *tls.Config // nil uses the system's CAs
+	if *sourceCA != "" {
+		sourceTLS, err = loadCA(*sourceCA)
+		Log.FatalIfErr(err, "load -source-ca")
+	}
+	Log.FatalIf(*readBuffer == 0, "-read-buffer cannot be zero")
+	Log.FatalIf(*forwardBuffer == 0, "-forward-buffer cannot be zero")
+	forwarder.ConnBufferSize = int(*forwardBuffer)
+	forwarder.WriteTimeout = *forwardWriteTimeout
+	toForwarder := make(chan forwarder.Packet)
+	sm := NewSourceMerger(Log, toForwarder, toArchive.Route, a.KnownPosition)
+	sm.ForwardOwnShip = *forwardOwn
+	sm.Skew = NewClockSkew()
+	if *correctSkew {
+		sm.Skew.Correct = true
+		a.skew = sm.Skew
+	}
+	if a.db.SuppressTypes != nil {
+		sm.Suppress = a.db.Suppressed
+	}
+	if *recordDir != "" {
+		sm.Recorder, err = NewRecorder(*recordDir, *recordKeep, *recordSync)
+		Log.FatalIfErr(err, "create -record-dir")
+		defer sm.Recorder.Close()
+	}
+	sources := NewSourceManager(sourceTLS, int(*parserQueue), int(*readBuffer), sm.Accept)
+	sources.Skew = sm.Skew
+
+	newForwarder := make(chan forwarder.Conn, 20)
+	forwarderStats := forwarder.NewStatsRequests()
+	httpAddr, httpsAddr, rawAddr := assembleAddrs(*local, *httpPort, *httpsPort, *rawPort)
+	Log.FatalIf((*tlsCert == "") != (*tlsKey == ""), "-tls-cert and -tls-key must be used together")
+	accessLogLevel, err := l.ParseLevel(*httpLogLevel)
+	Log.FatalIfErr(err, "parse -http-log-level")
+	Log.FatalIf(accessLogLevel == l.Fatal, "-http-log-level cannot be fatal")
+	newDecodedForwarder := make(chan forwarder.Conn, 20)
+	limits := ClientLimits{Rate: *rateLimit, Burst: int(*rateBurst), Streams: int(*streamLimit), TrustProxy: *trustProxy}
+	*pathPrefix = strings.TrimSuffix(*pathPrefix, "/")
+	Log.FatalIf(!validPathPrefix(*pathPrefix), "-path-prefix must be a path starting with /, such as /ais")
+	handler := NewAPIHandler(*webPath, *pathPrefix, newForwarder, forwarderStats, newDecodedForwarder, rawAccess, a, limits,
+		sources, sm.Throughput(), adminAccess, *readyWindow, *debugEndpoints)
+	if *tlsCert != "" {
+		_, port, _ := net.SplitHostPort(httpsAddr)
+		redirectPort, _ := strconv.Atoi(port)
+		go HTTPServer(httpAddr, redirectToHTTPSHandler(uint(redirectPort)), "", "", *pathPrefix, accessLogLevel, *trustProxy)
+		go HTTPServer(httpsAddr, hstsHandler(handler), *tlsCert, *tlsKey, *pathPrefix, accessLogLevel, *trustProxy)
+	} else {
+		go HTTPServer(httpAddr, handler, "", "", *pathPrefix, accessLogLevel, *trustProxy)
+	}
+	go forwarder.TCPServer(Log, rawAddr, newForwarder, rawAccess, *forwardTags)
+	go forwarder.UDPServer(Log, rawAddr, newForwarder, rawAccess, *forwardTags)
+	if *jsonPort != 0 {
+		host, _, _ := net.SplitHostPort(rawAddr)
+		jsonAddr := net.JoinHostPort(host, strconv.Itoa(int(*jsonPort)))
+		go forwarder.TCPServer(Log, jsonAddr, newDecodedForwarder, rawAccess, false)
+	}
+
+	if *outputDelay > 0 {
+		Log.FatalIf(*outputDelayBuffer == 0, "-output-delay-buffer cannot be zero")
+		delayed := make(chan forwarder.Packet)
+		go forwarder.Delay(Log, toForwarder, delayed, *outputDelay, int(*outputDelayBuffer))
+		go forwarder.Manager(Log, delayed, newForwarder, forwarderStats)
+	} else {
+		go forwarder.Manager(Log, toForwarder, newForwarder, forwarderStats)
+	}
+	// the decoded stream has its own manager so that JSON and NMEA clients don't get each others packets
+	go forwarder.SequencedManager(Log, toDecodedForwarder, newDecodedForwarder, nil,
+		forwarder.NewReplay(int(*decodedReplay)))
+	if *maxUnready > 0 {
+		go watchReadiness(a, *readyWindow, *maxUnready)
+	}
 
 	Log.AddPeriodic("main", 1*time.Minute, 1*time.Hour, func(c *l.Composer, _ time.Duration) {
-		c.Writeln("Number of ships: %d", a.NumberOfShips())
-		c.Writeln("waiting to be registered: %d/%d", len(toArchive), cap(toArchive))
+		stats := a.Stats()
+		c.Writeln("Number of ships: %d (%d in the last %s)", stats.Indexed, stats.Recent, recentShips)
+		c.Writeln("with static info: %d, position only: %d, history points: %d",
+			stats.WithStatic, stats.PositionOnly, stats.HistoryPoints)
+		c.Writeln("R-tree height: %d, nodes: %d", stats.TreeHeight, stats.TreeNodes)
+		c.Writeln("ships removed while being looked up: %d", stats.Vanished)
+		c.Writeln("implausible positions: %d, jitter between receivers: %d, evicted ships: %d",
+			stats.Implausible, stats.Jitter, stats.Evicted)
+		c.Writeln("messages skipped: %d undecodable, %d bad MMSI, %d implausible MMSI, %d bad coordinates, %d without position; %d positions not indexed",
+			stats.Skipped.Undecodable, stats.Skipped.BadMMSI, stats.Skipped.ImplausibleMMSI, stats.Skipped.BadCoordinates,
+			stats.Skipped.NoPosition, stats.NotIndexed)
+		waiting, capacity := toArchive.Queued()
+		c.Writeln("waiting to be registered, per worker: %v (max %d each)", waiting, capacity)
 		c.Writeln("waiting to be forwarded: %d/%d", len(toForwarder), cap(toForwarder))
 		c.Writeln("waiting to start forwarding: %d/%d", len(newForwarder), cap(newForwarder))
+		if sm.Recorder != nil {
+			c.Writeln("messages that could not be recorded: %d", sm.Recorder.Dropped())
+		}
 		c.Writeln("source connections: %d", atomic.LoadInt32(&ListenerConnections))
+		clients := forwarderStats.Stats()
+		c.Writeln("forwarding clients: %d", len(clients))
+		for _, client := range clients {
+			if client.Dropped != 0 {
+				c.Writeln("\t%s has dropped %d of %d packets since %s", client.Remote,
+					client.Dropped, client.Sent, client.Connected.Format(time.Stamp))
+			}
+			if client.Suppressed != 0 {
+				c.Writeln("\t%s has skipped %d packets because of max_per_ship since %s", client.Remote,
+					client.Suppressed, client.Connected.Format(time.Stamp))
+			}
+		}
 	})
 
-	sources := flag.Args()
-	if len(sources) == 0 {
+	if flag.NArg() == 0 && *sourcesFile == "" {
 		Log.Fatal("Need at least one AIS source")
 	}
-	for _, s := range sources {
-		Log.Debug("source %s", s)
-		name, url, timeout, err := parseSource(s, 5*time.Second)
+	for _, s := range flag.Args() {
+		source, err := parseSource(s, defaultSourceTimeout)
 		if err != nil {
 			Log.Fatal("%s", err.Error())
 		}
-		Read(name, url, timeout, sm)
+		Log.Debug("source %s", source.Name)
+		Log.FatalIfErr(sources.Add(source), "add source")
+	}
+	if *sourcesFile != "" {
+		added, err := sources.LoadFile(*sourcesFile)
+		Log.FatalIfErr(err, "load -sources-file")
+		Log.Debug("%d sources from %s", added, *sourcesFile)
 	}
 
 	signalChan := make(chan os.Signal, 1)
@@ -93,8 +281,33 @@ func main() {
 	// SIGPIPE is also received when a TCP raw listener disconnects,
 	// and if it was what Log wrote to that broke, nothing can be written anyway.
 	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
+	if *logFile != "" || *sourcesFile != "" {
+		// SIGHUP is what logrotate sends after moving the log file
+		signal.Notify(signalChan, syscall.SIGHUP)
+	}
 	// Here we wait for CTRL-C or some other kill signal
-	<-signalChan
+	for <-signalChan == syscall.SIGHUP {
+		if *sourcesFile != "" {
+			added, removed, err := sources.ReloadFile()
+			if err != nil {
+				Log.Error("Failed to reload %s, keeping the old sources: %s", *sourcesFile, err.Error())
+			} else {
+				Log.Info("Reloaded %s: %d sources added, %d removed", *sourcesFile, added, removed)
+			}
+		}
+		if *logFile == "" {
+			continue
+		}
+		f, err := openLogFile(*logFile)
+		if err != nil {
+			Log.Error("Failed to reopen %s, continuing with the old file: %s", *logFile, err.Error())
+			continue
+		}
+		if err = Log.SetOutput(f); err != nil {
+			Log.Warning("Failed to close the old log file: %s", err.Error())
+		}
+		Log.Info("Reopened %s", *logFile)
+	}
 	if *memprofile != "" {
 		f, err := os.Create(*memprofile)
 		Log.FatalIfErr(err, "create memory profile file")
@@ -106,44 +319,34 @@ func main() {
 	Log.RunAllPeriodic()
 }
 
-func parseSource(s string, defaultTimeout time.Duration) (
-	name, url string, timeout time.Duration, err error,
-) {
-	beforeURL := strings.Index(s, "=")
-	url = s[beforeURL+1:]
-	name = url
-	timeout = defaultTimeout
-	if beforeURL != -1 {
-		name = s[:beforeURL]
-		beforeConf := strings.Index(s[:beforeURL], ":")
-		if beforeConf != -1 {
-			name = s[:beforeConf]
-			timeout, err = time.ParseDuration(s[beforeConf+1 : beforeURL])
-			if err != nil {
-				err = fmt.Errorf("Invalid timeout for source %s: %s", name, err.Error())
-			}
-		}
-	}
-	return
+// openLogFile opens a file for appending log messages, creating it if necessary.
+func openLogFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
 }
 
-func assembleAddrs(local bool, httpPort uint, rawPort uint) (httpAddr string, rawAddr string) {
+func assembleAddrs(local bool, httpPort, httpsPort, rawPort uint) (httpAddr, httpsAddr, rawAddr string) {
 	// an empty host listens on all network interfaces
 	host := ""
 	defaultHttpPort := uint(80)
+	defaultHttpsPort := uint(443)
 	defaultRawPort := uint(23)
 	if local {
 		host = "localhost"
 		defaultHttpPort = 8080
+		defaultHttpsPort = 8443
 		defaultRawPort = 8023
 	}
 	if httpPort == 0 {
 		httpPort = defaultHttpPort
 	}
+	if httpsPort == 0 {
+		httpsPort = defaultHttpsPort
+	}
 	if rawPort == 0 {
 		rawPort = defaultRawPort
 	}
 	httpAddr = fmt.Sprintf("%s:%d", host, httpPort)
+	httpsAddr = fmt.Sprintf("%s:%d", host, httpsPort)
 	rawAddr = fmt.Sprintf("%s:%d", host, rawPort)
 	return
 }
@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+func TestAssembleAddrs(t *testing.T) {
+	cases := []struct {
+		local                        bool
+		http, https, raw             uint
+		httpAddr, httpsAddr, rawAddr string
+	}{
+		{false, 0, 0, 0, ":80", ":443", ":23"},
+		{true, 0, 0, 0, "localhost:8080", "localhost:8443", "localhost:8023"},
+		{true, 2080, 2443, 2023, "localhost:2080", "localhost:2443", "localhost:2023"},
+		{false, 0, 4443, 0, ":80", ":4443", ":23"},
+	}
+	for _, c := range cases {
+		httpAddr, httpsAddr, rawAddr := assembleAddrs(c.local, c.http, c.https, c.raw)
+		if httpAddr != c.httpAddr || httpsAddr != c.httpsAddr || rawAddr != c.rawAddr {
+			t.Errorf("assembleAddrs(%t, %d, %d, %d) = %q, %q, %q, expected %q, %q, %q",
+				c.local, c.http, c.https, c.raw, httpAddr, httpsAddr, rawAddr,
+				c.httpAddr, c.httpsAddr, c.rawAddr)
+		}
+	}
+}
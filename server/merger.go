@@ -2,16 +2,22 @@ package main
 
 import (
 	"fmt"
+	"sort"
+	"strings"
 	"sync/atomic"
 	"time"
 
+	"github.com/tormol/AIS/forwarder"
 	l "github.com/tormol/AIS/logger"
 	"github.com/tormol/AIS/nmeais"
+	"github.com/tormol/AIS/storage"
 )
 
 const (
 	// MergeHistory is the minimum time messages are kept to be compared againts new messages.
 	MergeHistory = 2 * time.Second
+	// loggedCountries is how many of the countries with the most messages are logged.
+	loggedCountries = 10
 )
 
 // SourceMerger is a wrapper around nmeais.DuplicateTester that does logging and forwarding.
@@ -19,26 +25,49 @@ const (
 type SourceMerger struct {
 	// if DuplicateTester was inlined we could have used its mutex instead of atomic operations,
 	// but the separation of concerns is worth it.
-	logger            *l.Logger
-	toForwarder       chan<- []byte
-	toArchive         chan<- *nmeais.Message
-	dt                *nmeais.DuplicateTester
-	periodForwarded   [28]uint64 // use atomic operations
-	periodDuplicates  [28]uint64 // use atomic operations
-	allTimeForwarded  [28]uint64 // only accessed by logger
-	allTimeDuplicates [28]uint64 // only accessed by logger
-	// These four arrays together take nearly a kilobyte
+	logger           *l.Logger
+	toForwarder      chan<- forwarder.Packet
+	toArchive        func(*nmeais.Message) (blocked time.Duration)
+	knownPos         func(mmsi uint32) (lat, long float64, known bool)
+	dt               *nmeais.DuplicateTester
+	throughput       *Throughput
+	loggedForwarded  [nmeais.MaxType + 1]uint64 // throughput.AllTime() when last logged, only accessed by logger
+	loggedDuplicates [nmeais.MaxType + 1]uint64 // only accessed by logger
+	// periodArchiveBlocked is nanoseconds toArchive was blocked, use atomic operations
+	periodArchiveBlocked  int64
+	allTimeArchiveBlocked time.Duration // only accessed by logger
+	periodMID             [800]uint64   // forwarded messages by MID, 0 for none; use atomic operations
+	// Send VDO messages to raw clients too; they're always archived.
+	// Must be set before Accept is called.
+	ForwardOwnShip bool
+	// Also write the messages that are not duplicates to files if not nil.
+	// Must be set before Accept is called.
+	Recorder *Recorder
+	// Don't forward messages from ships this returns true for if not nil.
+	// They're still archived and recorded.
+	// Must be set before Accept is called.
+	Suppress func(mmsi uint32) bool
+	// Estimate how late each source is from the messages with a time if not nil,
+	// including duplicates.
+	// Must be set before Accept is called.
+	Skew *ClockSkew
 }
 
 // NewSourceMerger returns a reference because it starts an internal goroutine.
+// toArchive is normally SaveRouter.Route.
+// knownPos is used to filter forwarded messages without a position by where
+// the ship is.
 func NewSourceMerger(log *l.Logger,
-	toForwarder chan<- []byte, toArchive chan<- *nmeais.Message,
+	toForwarder chan<- forwarder.Packet, toArchive func(*nmeais.Message) (blocked time.Duration),
+	knownPos func(mmsi uint32) (lat, long float64, known bool),
 ) *SourceMerger {
 	sm := &SourceMerger{
 		logger:      log,
 		dt:          nmeais.NewDuplicateTester(MergeHistory),
+		throughput:  NewThroughput(),
 		toForwarder: toForwarder,
 		toArchive:   toArchive,
+		knownPos:    knownPos,
 		// remaining are zero
 	}
 	log.AddPeriodic("source_merger", 30*time.Second, 30*time.Minute,
@@ -46,13 +75,12 @@ func NewSourceMerger(log *l.Logger,
 			pTotal, aTotal := uint64(0), uint64(0)
 			indexes, pf, pd := "Type:      ", "Forwarded: ", "Duplicates:"
 			af, ad := pf, pd
-			for i := 0; i < 28; i++ {
-				pfn := atomic.SwapUint64(&sm.periodForwarded[i], 0) // load and reset
-				pdn := atomic.SwapUint64(&sm.periodDuplicates[i], 0)
-				afn := sm.allTimeForwarded[i]
-				adn := sm.allTimeDuplicates[i]
-				sm.allTimeForwarded[i] += pfn
-				sm.allTimeDuplicates[i] += pdn
+			forwarded, duplicates := sm.throughput.AllTime()
+			for i := 0; i <= nmeais.MaxType; i++ {
+				pfn := forwarded[i] - sm.loggedForwarded[i]
+				pdn := duplicates[i] - sm.loggedDuplicates[i]
+				afn := forwarded[i]
+				adn := duplicates[i]
 				pTotal += pfn + pdn
 				aTotal += afn + adn
 				if pfn > 0 { // the first one cannot be a duplicate
@@ -63,33 +91,135 @@ func NewSourceMerger(log *l.Logger,
 					ad += fmt.Sprintf(" %5d", adn)
 				}
 			}
+			sm.loggedForwarded, sm.loggedDuplicates = forwarded, duplicates
 			c.Writeln("SourceMerger: total %d (all time: %d), per type:\n%s\n%s\n%s\n%s\n%s",
 				pTotal, aTotal, indexes, pf, pd, af, ad,
 			)
+			blocked := time.Duration(atomic.SwapInt64(&sm.periodArchiveBlocked, 0))
+			sm.allTimeArchiveBlocked += blocked
+			c.Writeln("Countries: %s", sm.countries())
+			if blocked != 0 {
+				c.SetLevel(l.Warning)
+			}
+			c.Writeln("Blocked by archive: %s (all time: %s)",
+				l.RoundDuration(blocked, time.Millisecond),
+				l.RoundDuration(sm.allTimeArchiveBlocked, time.Millisecond),
+			)
 		},
 	)
 	return sm
 }
 
 // Accept logs m's type and sends it to forwarder and Archive if it haen't a duplicate.
+// Messages with an empty payload or type 0 are dropped.
+// Own-ship (VDO) messages are only sent to the forwarder if ForwardOwnShip is set,
+// and messages that Suppress returns true for are not sent to it.
 func (sm *SourceMerger) Accept(m *nmeais.Message) {
-	t := m.Type()
-	if t > 27 {
-		t = 0 // unknown
+	if m.Type() == 0 {
+		sm.logger.Limited(m.SourceName+"_bad", badSentenceLogInterval).
+			Info("%s\nMessage has no type", l.Escape([]byte(m.Text())))
+		if Trace.Active() {
+			Trace.Record(m, "merger", "no type", "")
+		}
+		return
 	}
+	if sm.Skew != nil {
+		sm.Skew.Observe(m)
+	}
+	t := m.KnownType()
 	if sm.dt.IsDuplicate(m) {
-		atomic.AddUint64(&sm.periodDuplicates[t], 1)
+		sm.throughput.Add(t, true)
+		if Trace.Active() {
+			Trace.Record(m, "merger", "duplicate", "")
+		}
 	} else {
-		atomic.AddUint64(&sm.periodForwarded[t], 1)
-		sm.toForwarder <- []byte(m.Text())
-		sm.toArchive <- m // TODO move parts of archive.Saver here
+		sm.throughput.Add(t, false)
+		mmsi, _ := m.MMSI()
+		atomic.AddUint64(&sm.periodMID[storage.Mmsi(mmsi).MID()], 1)
+		if Trace.Active() {
+			Trace.Record(m, "merger", "forwarded", "")
+		}
+		if (sm.ForwardOwnShip || !m.IsOwnShip()) && (sm.Suppress == nil || !sm.Suppress(mmsi)) {
+			sm.toForwarder <- sm.packet(m)
+		}
+		if sm.Recorder != nil {
+			sm.Recorder.Record(m.Text())
+		}
+		if blocked := sm.toArchive(m); blocked != 0 {
+			atomic.AddInt64(&sm.periodArchiveBlocked, int64(blocked))
+		}
+	}
+}
+
+// Throughput returns the counts of forwarded and duplicate messages over time.
+func (sm *SourceMerger) Throughput() *Throughput {
+	return sm.throughput
+}
+
+// packet creates what the forwarder needs to filter and tag messages.
+func (sm *SourceMerger) packet(m *nmeais.Message) forwarder.Packet {
+	mmsi, _ := m.MMSI()
+	p := forwarder.Packet{Raw: []byte(m.Text()), MMSI: mmsi, Type: m.Type(),
+		Received: m.Received(), Source: m.SourceName}
+	p.Lat, p.Lon, p.HasPos = m.Position()
+	if !p.HasPos {
+		p.Lat, p.Lon, p.HasPos = sm.knownPos(p.MMSI)
+	}
+	return p
+}
+
+// countries resets the per-MID counts and formats the countries with the
+// most messages, such as "NO 1200, SE 300, other 20, no MID 5".
+// MIDs of the same country are combined.
+func (sm *SourceMerger) countries() string {
+	perCountry := make(map[string]uint64)
+	for mid := range sm.periodMID {
+		n := atomic.SwapUint64(&sm.periodMID[mid], 0)
+		if n == 0 {
+			continue
+		}
+		country := "no MID"
+		if mid != 0 {
+			// any MMSI with this MID
+			country = storage.Mmsi(uint32(mid) * 1000000).Alpha2()
+			if country == "" {
+				country = fmt.Sprintf("MID %d", mid)
+			}
+		}
+		perCountry[country] += n
+	}
+	sorted := make([]string, 0, len(perCountry))
+	for country := range perCountry {
+		sorted = append(sorted, country)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if perCountry[sorted[i]] != perCountry[sorted[j]] {
+			return perCountry[sorted[i]] > perCountry[sorted[j]]
+		}
+		return sorted[i] < sorted[j]
+	})
+	parts := []string{}
+	other := uint64(0)
+	for i, country := range sorted {
+		if i < loggedCountries {
+			parts = append(parts, fmt.Sprintf("%s %d", country, perCountry[country]))
+		} else {
+			other += perCountry[country]
+		}
+	}
+	if other != 0 {
+		parts = append(parts, fmt.Sprintf("other %d", other))
+	}
+	if len(parts) == 0 {
+		return "none"
 	}
+	return strings.Join(parts, ", ")
 }
 
-// Close closes the channel which makes future calls to Accept block forever.
+// Close closes the forwarder channel which makes future calls to Accept block forever.
+// The archive must be stopped separately, such as with SaveRouter.Close.
 func (sm *SourceMerger) Close() {
 	sm.dt.Close()
 	close(sm.toForwarder)
-	close(sm.toArchive)
 	sm.logger.RemovePeriodic("source_merger")
 }
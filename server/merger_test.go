@@ -0,0 +1,73 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tormol/AIS/forwarder"
+	l "github.com/tormol/AIS/logger"
+	"github.com/tormol/AIS/nmeais"
+)
+
+// forwarded returns the MMSIs of the packets a SourceMerger sends to the
+// forwarder, and how many messages it sends to the archive.
+func forwarded(forwardOwnShip bool, packet string) ([]uint32, int) {
+	packets, archived := forwardedPackets(forwardOwnShip, packet)
+	mmsis := []uint32{}
+	for _, p := range packets {
+		mmsis = append(mmsis, p.MMSI)
+	}
+	return mmsis, archived
+}
+
+// forwardedPackets returns the packets a SourceMerger sends to the forwarder,
+// and how many messages it sends to the archive.
+func forwardedPackets(forwardOwnShip bool, packet string) ([]forwarder.Packet, int) {
+	logger := l.NewLogger(&logBuffer{}, l.Info)
+	toForwarder := make(chan forwarder.Packet, 100)
+	toArchive := make(chan *nmeais.Message, 100)
+	route := func(m *nmeais.Message) time.Duration {
+		toArchive <- m
+		return 0
+	}
+	sm := NewSourceMerger(logger, toForwarder, route, func(uint32) (float64, float64, bool) {
+		return 0, 0, false
+	})
+	sm.ForwardOwnShip = forwardOwnShip
+	pp := &PacketParser{async: make(chan sendSentence, 100), SourceName: "test", logger: logger}
+	pp.Accept([]byte(packet), time.Now())
+	close(pp.async)
+	decodeSentences(pp, sm.Accept)
+	sm.Close()
+	packets := []forwarder.Packet{}
+	for p := range toForwarder {
+		packets = append(packets, p)
+	}
+	return packets, len(toArchive)
+}
+
+func TestOwnShipIsNotForwarded(t *testing.T) {
+	packet := positionReport(1, 257000001, 59, 5).sentences() +
+		positionReport(1, 257000002, 59.1, 5).ownShip()
+	mmsis, archived := forwarded(false, packet)
+	if len(mmsis) != 1 || mmsis[0] != 257000001 || archived != 2 {
+		t.Errorf("Expected only the VDM to be forwarded but both archived, got %v and %d", mmsis, archived)
+	}
+	mmsis, archived = forwarded(true, packet)
+	if len(mmsis) != 2 || archived != 2 {
+		t.Errorf("Expected both to be forwarded with ForwardOwnShip, got %v and %d", mmsis, archived)
+	}
+}
+
+// The forwarder drops whole packets when a client is slow, so the sentences
+// of a message must be in the same packet.
+func TestMultiSentenceMessagesAreOnePacket(t *testing.T) {
+	static := staticReport(5, 257000001).sentences()
+	packets, _ := forwardedPackets(false, static+positionReport(1, 257000001, 59, 5).sentences())
+	if len(packets) != 2 || string(packets[0].Raw) != static {
+		t.Fatalf("Expected the two sentences of the type 5 message in the first packet, got %d packets", len(packets))
+	} else if strings.Count(string(packets[0].Raw), "!AIVDM") != 2 {
+		t.Errorf("Expected two sentences, got %q", packets[0].Raw)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"sort"
 	"sync"
 	"time"
 
@@ -18,6 +19,16 @@ const (
 	// of a multi-part message.
 	// Increasing it from 3 seconds seemed to help with bad reception.
 	maxMessageTimespan = 1 * time.Minute
+	// badSentenceLogInterval limits how often invalid input from a source is logged,
+	// as a source that sends garbage can send thousands of sentences per second.
+	badSentenceLogInterval = 1 * time.Second
+	// How often to look for multi-part messages that will never be completed.
+	expireInterval = 1 * time.Second
+	// maxFragmentLength limits how much of a sentence split across packets is
+	// kept while waiting for the rest. It's generous for any legal sentence with
+	// a TAG block, but stops a source that never sends a newline or '!'
+	// (such as an HTML error page) from using up memory.
+	maxFragmentLength = 1024
 )
 
 // PacketParser splits and merges packets into sentences, and merges sentences into messages.
@@ -25,19 +36,27 @@ const (
 // used for simplicity. This is not optimal but they should be close enough for it not to matter.
 type PacketParser struct {
 	incomplete []byte
+	resyncing  bool              // an oversized fragment was dropped, and the next sentence hasn't been found yet
 	async      chan sendSentence // stored to let Close() close it
 	SourceName string
+	Strict     bool // also reject sentences without a checksum
+	Filter     SourceFilter
 	logger     *l.Logger
 	pl         packetLogger
 }
 
 // NewPacketParser creates a new PacketParser
 // Spawns a goroutine with a reference to the returned struct.
+// queue is how many sentences can wait to be parsed before Accept() blocks.
+// Messages dropped by filter are not passed to dst.
 // Call .Close() to stop it.
-func NewPacketParser(source string, log *l.Logger, dst func(*nmeais.Message)) *PacketParser {
+func NewPacketParser(source string, strict bool, filter SourceFilter, queue int, log *l.Logger,
+	dst func(*nmeais.Message)) *PacketParser {
 	pp := &PacketParser{
-		async:      make(chan sendSentence, 200),
+		async:      make(chan sendSentence, queue),
 		SourceName: source,
+		Strict:     strict,
+		Filter:     filter,
 		logger:     log,
 		pl:         newPacketLogger(),
 	}
@@ -45,7 +64,11 @@ func NewPacketParser(source string, log *l.Logger, dst func(*nmeais.Message)) *P
 		2*time.Second, 10*time.Minute,
 		func(c *l.Composer, s time.Duration) {
 			c.Writeln("%s", pp.SourceName)
-			pp.pl.log(c, s)
+			// sources that are still connecting don't warn
+			if received := pp.pl.log(c, s); received == 0 && s >= time.Minute {
+				c.SetLevel(l.Warning)
+				c.Writeln("%s: nothing received in the last %s", pp.SourceName, l.RoundDuration(s, time.Second))
+			}
 		},
 	)
 	go decodeSentences(pp, dst)
@@ -60,30 +83,58 @@ func (pp *PacketParser) Close() {
 
 // Accept merges and splits packets into sentences,
 // and then sends the copied sentence(s) to a channel.
-// Will block on that channel if it is full.
+// Will block on that channel if it is full, and the time spent blocked is counted.
 // (bufferSlice cannot be sent to buffered channels because slicing doesn't copy.)
 func (pp *PacketParser) Accept(bufferSlice []byte, received time.Time) {
-	if len(pp.incomplete) == 0 && len(bufferSlice) != 0 && bufferSlice[0] != byte('!') {
-		pp.logger.Info("%s\nPacket doesn't start with '!'", l.Escape(bufferSlice))
+	if len(pp.incomplete) == 0 && len(bufferSlice) != 0 && bufferSlice[0] != byte('!') && !pp.resyncing {
+		pp.logger.Limited(pp.SourceName+"_bad", badSentenceLogInterval).
+			Info("%s\nPacket doesn't start with '!'", l.Escape(bufferSlice))
 	}
 	pp.pl.register(len(pp.incomplete) != 0, bufferSlice, received)
 	for len(bufferSlice) != 0 {
 		sText, used := nmeais.FirstSentenceInBuffer(pp.incomplete, bufferSlice)
 		if used == -1 {
 			pp.incomplete = sText
+			if len(sText) > maxFragmentLength {
+				pp.dropFragment()
+			}
 			return
 		}
 		pp.incomplete = []byte{}
+		pp.resyncing = false
 		if len(sText) == 0 && len(bufferSlice) == used {
-			pp.logger.Info("%s\nNo sentence in packet", l.Escape(bufferSlice))
+			pp.logger.Limited(pp.SourceName+"_bad", badSentenceLogInterval).
+				Info("%s\nNo sentence in packet", l.Escape(bufferSlice))
 			return
 		}
 		bufferSlice = bufferSlice[used:]
-		pp.async <- sendSentence{
+		ss := sendSentence{
 			received: received,
 			text:     sText,
 		}
+		select {
+		case pp.async <- ss:
+		default: // only measure when full, to not call time.Now() for every sentence
+			blockStarted := time.Now()
+			pp.async <- ss
+			pp.pl.blocked(time.Since(blockStarted))
+		}
+	}
+}
+
+// dropFragment discards an oversized pp.incomplete.
+// The rest of the line is skipped by searching the following packets for the
+// next '!', which is what FirstSentenceInBuffer() does when incomplete is empty.
+func (pp *PacketParser) dropFragment() {
+	start := pp.incomplete
+	if len(start) > 100 {
+		start = start[:100]
 	}
+	pp.logger.Limited(pp.SourceName+"_bad", badSentenceLogInterval).
+		Debug("%s: Dropped %d bytes without a sentence end:\n%s...", pp.SourceName, len(pp.incomplete), l.Escape(start))
+	pp.pl.dropped(&pp.pl.oversized)
+	pp.incomplete = []byte{}
+	pp.resyncing = true
 }
 
 // Sends sentences and timestamp from the reader goroutine to a reader-specific backend:
@@ -101,27 +152,69 @@ func decodeSentences(pp *PacketParser, callback func(*nmeais.Message)) {
 	ma := nmeais.NewMessageAssembler(maxSentencesBetween, maxMessageTimespan, pp.SourceName)
 	ok := 0
 	logbad := func(source []byte, why string, args ...interface{}) {
-		c := pp.logger.Compose(l.Debug)
-		if ok != 0 {
+		c := pp.logger.Limited(pp.SourceName+"_bad", badSentenceLogInterval).Compose(l.Debug)
+		if ok != 0 && c.Enabled() {
 			c.Writeln("%s: ...%d ok...", pp.SourceName, ok)
 			ok = 0
 		}
 		c.Writeln(l.Escape(source))
 		c.Finish(why, args...)
 	}
-	for sentence := range pp.async {
+	expire := time.NewTicker(expireInterval)
+	defer expire.Stop()
+	tagOffset := time.Duration(0) // how far behind TAG block timestamps are
+	for {
+		var sentence sendSentence
+		select {
+		case now := <-expire.C:
+			abandoned := ma.Expire(now.Add(tagOffset))
+			for _, am := range abandoned {
+				pp.logger.Limited(pp.SourceName+"_bad", badSentenceLogInterval).Debug(
+					"%s: Incomplete message dropped: got %d of %d parts with SMID %d in %s",
+					pp.SourceName, am.Received, am.Parts, am.SMID, l.RoundDuration(am.Age, time.Second))
+			}
+			pp.pl.abandoned(len(abandoned))
+			continue
+		case next, open := <-pp.async:
+			if !open {
+				return
+			}
+			sentence = next
+		}
 		s, err := nmeais.ParseSentence(sentence.text, sentence.received)
 		// err = s.Validate(err)
 		if err != nil {
 			logbad(sentence.text, err.Error())
 			continue
 		}
+		pp.pl.checked(s.Checksum)
+		if pp.Strict && s.Checksum == nmeais.ChecksumAbsent {
+			logbad(sentence.text, "No checksum")
+			continue
+		} else if pp.Filter.dropsSentence(&s) {
+			pp.pl.dropped(&pp.pl.filtered.OwnShip)
+			continue
+		}
+		// TAG block timestamps are more accurate for buffered or replayed feeds.
+		// Sentences without one, such as later parts of a multi-sentence
+		// message, get a time relative to the last one.
+		if !s.TagTime.IsZero() {
+			tagOffset = s.TagTime.Sub(sentence.received)
+		}
+		s.Received = s.Received.Add(tagOffset)
 		ok++
 		message, err := ma.Accept(s)
 		if err != nil {
 			logbad(sentence.text, "Incomplete message dropped: %s", err.Error())
 		}
 		if message != nil {
+			if counter := pp.Filter.dropsMessage(message, &pp.pl.filtered); counter != nil {
+				pp.pl.dropped(counter)
+				continue
+			}
+			if Trace.Active() {
+				Trace.Record(message, "assembler", "complete", "%d sentence(s)", len(message.Sentences()))
+			}
 			callback(message)
 		}
 	}
@@ -134,11 +227,40 @@ type packetLogger struct {
 	readTime            time.Duration
 	packets             uint64
 	splitSentences      uint64 // across packets
+	oversized           uint64 // fragments dropped for exceeding maxFragmentLength
+	totalOversized      uint64
 	bytes               uint64
 	totalReadTime       time.Duration
 	totalSplitSentences uint64
 	totalBytes          uint64
 	totalPackets        uint64
+	abandonedMessages   uint64 // incomplete multi-part messages dropped by MessageAssembler.Expire()
+	totalAbandoned      uint64
+	checksums           checksumCounts // of parsed sentences
+	totalChecksums      checksumCounts
+	blockedTime         time.Duration // waiting for space in PacketParser.async
+	totalBlockedTime    time.Duration
+	filtered            filterCounts // by PacketParser.Filter
+	totalFiltered       filterCounts
+	senders             map[string]*senderCounts // of udp-listen:// sources, since start
+}
+
+// senderCounts is what one remote address has sent to an UDP source.
+type senderCounts struct {
+	packets uint64
+	bytes   uint64
+}
+
+// maxSenders limits how many remote addresses are counted separately,
+// the rest are counted together as otherSenders.
+const maxSenders = 50
+const otherSenders = "others"
+
+// checksumCounts counts sentences by their nmeais.ChecksumResult
+type checksumCounts struct {
+	Passed uint64
+	Absent uint64
+	Failed uint64
 }
 
 func newPacketLogger() packetLogger {
@@ -147,9 +269,67 @@ func newPacketLogger() packetLogger {
 	}
 }
 
-// Log prints some statistics to lc.
+// abandoned counts incomplete multi-part messages that were dropped.
+func (pl *packetLogger) abandoned(n int) {
+	if n != 0 {
+		pl.statsLock.Lock()
+		pl.abandonedMessages += uint64(n)
+		pl.statsLock.Unlock()
+	}
+}
+
+// dropped increments a counter of filtered sentences or messages,
+// which must be a field of pl.filtered, or of dropped fragments (pl.oversized).
+func (pl *packetLogger) dropped(counter *uint64) {
+	pl.statsLock.Lock()
+	*counter++
+	pl.statsLock.Unlock()
+}
+
+// sentBy counts a packet from a remote address.
+func (pl *packetLogger) sentBy(addr string, bytes int) {
+	pl.statsLock.Lock()
+	defer pl.statsLock.Unlock()
+	if pl.senders == nil {
+		pl.senders = make(map[string]*senderCounts)
+	}
+	sc, exists := pl.senders[addr]
+	if !exists && len(pl.senders) >= maxSenders {
+		addr = otherSenders
+		sc, exists = pl.senders[addr]
+	}
+	if !exists {
+		sc = &senderCounts{}
+		pl.senders[addr] = sc
+	}
+	sc.packets++
+	sc.bytes += uint64(bytes)
+}
+
+// blocked adds to the time Accept() has waited for the parser to keep up.
+func (pl *packetLogger) blocked(d time.Duration) {
+	pl.statsLock.Lock()
+	pl.blockedTime += d
+	pl.statsLock.Unlock()
+}
+
+// checked counts the checksum result of a parsed sentence.
+func (pl *packetLogger) checked(result nmeais.ChecksumResult) {
+	pl.statsLock.Lock()
+	switch result {
+	case nmeais.ChecksumPassed:
+		pl.checksums.Passed++
+	case nmeais.ChecksumAbsent:
+		pl.checksums.Absent++
+	case nmeais.ChecksumFailed:
+		pl.checksums.Failed++
+	}
+	pl.statsLock.Unlock()
+}
+
+// Log prints some statistics to lc, and returns the number of packets since the last call.
 // It must not be called in parallell with with Accept().
-func (pl *packetLogger) log(c *l.Composer, sinceLast time.Duration) {
+func (pl *packetLogger) log(c *l.Composer, sinceLast time.Duration) (packets uint64) {
 	pl.statsLock.Lock()
 	defer pl.statsLock.Unlock()
 
@@ -157,6 +337,15 @@ func (pl *packetLogger) log(c *l.Composer, sinceLast time.Duration) {
 	pl.totalPackets += pl.packets
 	pl.totalReadTime += pl.readTime
 	pl.totalSplitSentences += pl.splitSentences
+	pl.totalAbandoned += pl.abandonedMessages
+	pl.totalOversized += pl.oversized
+	pl.totalBlockedTime += pl.blockedTime
+	pl.totalChecksums.Passed += pl.checksums.Passed
+	pl.totalChecksums.Absent += pl.checksums.Absent
+	pl.totalChecksums.Failed += pl.checksums.Failed
+	pl.totalFiltered.OwnShip += pl.filtered.OwnShip
+	pl.totalFiltered.MMSI += pl.filtered.MMSI
+	pl.totalFiltered.Outside += pl.filtered.Outside
 	avg := time.Duration(0)
 	if pl.packets != 0 {
 		avg = time.Duration(pl.readTime.Nanoseconds()/int64(pl.packets)) * time.Nanosecond
@@ -167,27 +356,79 @@ func (pl *packetLogger) log(c *l.Composer, sinceLast time.Duration) {
 	}
 
 	now := time.Now()
-	c.Writeln("\ttotal: listened for %s/%s, %sB, %s/%s packets w/split sentence, avg read: %s",
+	c.Writeln("\ttotal: listened for %s/%s, %sB, %s/%s packets w/split sentence, avg read: %s, incomplete multi-part dropped: %d",
 		l.RoundDuration(pl.totalReadTime, time.Second),
 		l.RoundDuration(now.Sub(pl.started), time.Second),
 		l.SiMultiple(pl.totalBytes, 1024, 'M'),
 		l.SiMultiple(pl.totalSplitSentences, 1000, 'M'),
 		l.SiMultiple(pl.totalPackets, 1000, 'M'),
 		totalAvg.String(),
+		pl.totalAbandoned,
 	)
-	c.Writeln("\tsince last: %s/%s, %sB, %s/%s packets w/split sentence, avg read: %s",
+	c.Writeln("\t\tchecksum passed/absent/failed: %s/%s/%s, blocked by parsing: %s",
+		l.SiMultiple(pl.totalChecksums.Passed, 1000, 'M'),
+		l.SiMultiple(pl.totalChecksums.Absent, 1000, 'M'),
+		l.SiMultiple(pl.totalChecksums.Failed, 1000, 'M'),
+		l.RoundDuration(pl.totalBlockedTime, time.Millisecond),
+	)
+	if pl.totalFiltered != (filterCounts{}) {
+		c.Writeln("\t\tdropped own-ship/MMSI/outside bbox: %s/%s/%s",
+			l.SiMultiple(pl.totalFiltered.OwnShip, 1000, 'M'),
+			l.SiMultiple(pl.totalFiltered.MMSI, 1000, 'M'),
+			l.SiMultiple(pl.totalFiltered.Outside, 1000, 'M'),
+		)
+	}
+	if pl.totalOversized != 0 {
+		c.Writeln("\t\toversized fragments dropped: %s", l.SiMultiple(pl.totalOversized, 1000, 'M'))
+	}
+	addrs := make([]string, 0, len(pl.senders))
+	for addr := range pl.senders {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	for _, addr := range addrs {
+		c.Writeln("\t\tfrom %s: %s packets, %sB", addr,
+			l.SiMultiple(pl.senders[addr].packets, 1000, 'M'),
+			l.SiMultiple(pl.senders[addr].bytes, 1024, 'M'),
+		)
+	}
+	c.Writeln("\tsince last: %s/%s, %sB, %s/%s packets w/split sentence, avg read: %s, incomplete multi-part dropped: %d",
 		l.RoundDuration(pl.readTime, time.Second),
 		l.RoundDuration(sinceLast, time.Second),
 		l.SiMultiple(pl.bytes, 1024, 'M'),
 		l.SiMultiple(pl.splitSentences, 1000, 'M'),
 		l.SiMultiple(pl.packets, 1000, 'M'),
 		avg.String(),
+		pl.abandonedMessages,
+	)
+	c.Writeln("\t\tchecksum passed/absent/failed: %s/%s/%s, blocked by parsing: %s",
+		l.SiMultiple(pl.checksums.Passed, 1000, 'M'),
+		l.SiMultiple(pl.checksums.Absent, 1000, 'M'),
+		l.SiMultiple(pl.checksums.Failed, 1000, 'M'),
+		l.RoundDuration(pl.blockedTime, time.Millisecond),
 	)
+	if pl.filtered != (filterCounts{}) {
+		c.Writeln("\t\tdropped own-ship/MMSI/outside bbox: %s/%s/%s",
+			l.SiMultiple(pl.filtered.OwnShip, 1000, 'M'),
+			l.SiMultiple(pl.filtered.MMSI, 1000, 'M'),
+			l.SiMultiple(pl.filtered.Outside, 1000, 'M'),
+		)
+	}
+	if pl.oversized != 0 {
+		c.Writeln("\t\toversized fragments dropped: %s", l.SiMultiple(pl.oversized, 1000, 'M'))
+	}
 
+	packets = pl.packets
 	pl.splitSentences = 0
+	pl.abandonedMessages = 0
+	pl.oversized = 0
+	pl.checksums = checksumCounts{}
+	pl.filtered = filterCounts{}
+	pl.blockedTime = 0
 	pl.bytes = 0
 	pl.packets = 0
 	pl.readTime = 0
+	return packets
 }
 
 func (pl *packetLogger) register(incomplete bool, bufferSlice []byte, readStarted time.Time) {
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// recordFileFormat is the name of the file for each hour, in UTC.
+	recordFileFormat = "2006-01-02T15.nmea"
+	// recordQueue is how many messages can wait to be written before they're dropped.
+	recordQueue = 10000
+	// recordErrorLogInterval is how often failing to create a file is logged,
+	// as it's retried for every message.
+	recordErrorLogInterval = 1 * time.Minute
+)
+
+// Recorder appends the forwarded messages to one file per hour in a
+// directory, and deletes files that are older than keep.
+// The files can be replayed with a file:// source ending in /.
+// Messages are written by an internal goroutine so that a slow disk doesn't
+// hold up the merger; when its queue is full messages are dropped instead.
+type Recorder struct {
+	dir          string
+	keep         time.Duration // 0 keeps files forever
+	syncInterval time.Duration // 0 syncs after every message
+	queue        chan string
+	dropped      uint64 // use atomic operations
+	stop         chan struct{}
+	stopped      chan struct{}
+	now          func() time.Time // replaced by tests
+}
+
+// NewRecorder creates dir if it doesn't exist and starts writing to it.
+// Files are synced to disk at least every syncInterval.
+func NewRecorder(dir string, keep, syncInterval time.Duration) (*Recorder, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	r := newRecorder(dir, keep, syncInterval, time.Now)
+	go r.run()
+	return r, nil
+}
+
+// newRecorder creates a recorder without starting it.
+func newRecorder(dir string, keep, syncInterval time.Duration, now func() time.Time) *Recorder {
+	return &Recorder{
+		dir:          dir,
+		keep:         keep,
+		syncInterval: syncInterval,
+		queue:        make(chan string, recordQueue),
+		stop:         make(chan struct{}),
+		stopped:      make(chan struct{}),
+		now:          now,
+	}
+}
+
+// Record queues the text of a message to be written, or drops it if the queue is full.
+func (r *Recorder) Record(text string) {
+	select {
+	case r.queue <- text:
+	default:
+		atomic.AddUint64(&r.dropped, 1)
+	}
+}
+
+// Dropped returns how many messages have been dropped because the queue was
+// full or a file couldn't be created.
+func (r *Recorder) Dropped() uint64 {
+	return atomic.LoadUint64(&r.dropped)
+}
+
+// Close writes the queued messages, syncs and closes the current file.
+// Messages recorded afterwards are ignored.
+func (r *Recorder) Close() {
+	close(r.stop)
+	<-r.stopped
+}
+
+// recordFile is the file being written to.
+type recordFile struct {
+	name   string
+	file   *os.File
+	writer *bufio.Writer
+	dirty  bool // written to since last synced
+}
+
+// sync flushes and syncs the file if it has been written to.
+func (rf *recordFile) sync() {
+	if rf.file == nil || !rf.dirty {
+		return
+	}
+	if err := rf.writer.Flush(); err != nil {
+		Log.Error("Error writing to %s: %s", rf.file.Name(), err.Error())
+	} else if err = rf.file.Sync(); err != nil {
+		Log.Error("Error syncing %s: %s", rf.file.Name(), err.Error())
+	}
+	rf.dirty = false
+}
+
+// close syncs and closes the file, if there is one.
+func (rf *recordFile) close() {
+	if rf.file != nil {
+		rf.sync()
+		closeAndCheck(rf.file, rf.file.Name())
+		*rf = recordFile{}
+	}
+}
+
+// run writes queued messages until Close is called.
+func (r *Recorder) run() {
+	defer close(r.stopped)
+	var current recordFile
+	defer current.close()
+	var tick <-chan time.Time
+	if r.syncInterval > 0 {
+		ticker := time.NewTicker(r.syncInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	r.expire()
+	for {
+		select {
+		case text := <-r.queue:
+			r.write(&current, text)
+		case <-tick:
+			current.sync()
+		case <-r.stop:
+			for {
+				select {
+				case text := <-r.queue:
+					r.write(&current, text)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// write appends text to the file for the current hour,
+// after switching to it and deleting expired files if the hour has changed.
+func (r *Recorder) write(current *recordFile, text string) {
+	name := r.now().UTC().Format(recordFileFormat)
+	if name != current.name {
+		current.close()
+		r.expire()
+		path := filepath.Join(r.dir, name)
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			Log.Limited("recorder", recordErrorLogInterval).Error("Cannot record messages: %s", err.Error())
+			atomic.AddUint64(&r.dropped, 1)
+			return
+		}
+		*current = recordFile{name: name, file: f, writer: bufio.NewWriter(f)}
+	}
+	current.writer.WriteString(text)
+	if !strings.HasSuffix(text, "\n") {
+		current.writer.WriteString("\r\n")
+	}
+	current.dirty = true
+	if r.syncInterval == 0 {
+		current.sync()
+	}
+}
+
+// expire deletes the files whose hour ended more than keep ago.
+// Files with other names are left alone.
+func (r *Recorder) expire() {
+	if r.keep == 0 {
+		return
+	}
+	entries, err := os.ReadDir(r.dir)
+	if err != nil {
+		Log.Error("Cannot delete old recordings: %s", err.Error())
+		return
+	}
+	cutoff := r.now().Add(-r.keep)
+	for _, e := range entries {
+		hour, err := time.Parse(recordFileFormat, e.Name())
+		if err != nil || e.IsDir() || !hour.Add(time.Hour).Before(cutoff) {
+			continue
+		}
+		if err = os.Remove(filepath.Join(r.dir, e.Name())); err != nil {
+			Log.Error("Cannot delete old recording: %s", err.Error())
+		}
+	}
+}
+
+// listDirectory returns the paths of the files in a directory, sorted by name
+// like os.ReadDir().
+// Hidden files and subdirectories are skipped.
+func listDirectory(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	paths := []string{}
+	for _, e := range entries {
+		if !e.IsDir() && !strings.HasPrefix(e.Name(), ".") {
+			paths = append(paths, filepath.Join(dir, e.Name()))
+		}
+	}
+	return paths, nil
+}
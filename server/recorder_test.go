@@ -0,0 +1,101 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	l "github.com/tormol/AIS/logger"
+	"github.com/tormol/AIS/nmeais"
+)
+
+func TestRecorder(t *testing.T) {
+	dir := t.TempDir()
+	readRecording := func(name string) string {
+		content, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(content)
+	}
+	messages := []string{}
+	for i := uint32(0); i < 5; i++ {
+		messages = append(messages, positionReport(1, 257000000+i, 59, 5).sentences())
+	}
+	messages[2] = staticReport(5, 257000002).sentences() // two sentences
+	os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("not a recording\n"), 0644)
+
+	now := time.Date(2024, 6, 1, 13, 59, 0, 0, time.UTC)
+	r := newRecorder(dir, 2*time.Hour, 0, func() time.Time { return now })
+	var current recordFile
+	r.write(&current, messages[0])
+	now = now.Add(2 * time.Minute)
+	r.write(&current, messages[1])
+	r.write(&current, messages[2])
+	if content := readRecording("2024-06-01T13.nmea"); content != messages[0] {
+		t.Errorf("Expected the first message in the file of 13:00, got %q", content)
+	}
+	if content := readRecording("2024-06-01T14.nmea"); content != messages[1]+messages[2] {
+		t.Errorf("Expected the next two messages in the file of 14:00, got %q", content)
+	}
+
+	// 13:00-14:00 is more than two hours ago, but not 14:00-15:00
+	now = time.Date(2024, 6, 1, 16, 30, 0, 0, time.UTC)
+	r.write(&current, messages[3])
+	current.close()
+	if _, err := os.Stat(filepath.Join(dir, "2024-06-01T13.nmea")); !os.IsNotExist(err) {
+		t.Errorf("Expected the file of 13:00 to be deleted, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "notes.txt")); err != nil {
+		t.Errorf("Expected other files to be left alone, got %s", err.Error())
+	}
+
+	r = newRecorder(dir, 2*time.Hour, time.Hour, func() time.Time { return now })
+	go r.run()
+	r.Record(messages[4])
+	r.Close() // syncs
+	r.Record(messages[4])
+	if content := readRecording("2024-06-01T16.nmea"); content != messages[3]+messages[4] {
+		t.Errorf("Expected the last two messages once in the file of 16:00, got %q", content)
+	}
+
+	r = newRecorder(dir, 0, 0, time.Now) // not started, so the queue fills up
+	for i := 0; i <= recordQueue; i++ {
+		r.Record(messages[0])
+	}
+	if dropped := r.Dropped(); dropped != 1 {
+		t.Errorf("Expected one message to be dropped when the queue is full, got %d", dropped)
+	}
+
+	// a file where the directory should be makes creating files fail
+	r = newRecorder(filepath.Join(dir, "notes.txt"), 0, 0, time.Now)
+	var unwritable recordFile
+	for i := 0; i < 3; i++ {
+		r.write(&unwritable, messages[0])
+	}
+	if dropped := r.Dropped(); dropped != 3 || unwritable.file != nil {
+		t.Errorf("Expected every message to be dropped when the file cannot be created, got %d", dropped)
+	}
+
+	// keep readFile from exiting the program when it's done
+	atomic.AddInt32(&ListenerConnections, 1)
+	defer atomic.AddInt32(&ListenerConnections, -1)
+	pp := &PacketParser{async: make(chan sendSentence, 100), SourceName: "test",
+		logger: l.NewLogger(&logBuffer{}, l.Debug)}
+	go readFile(dir+"/", 1, 0, pp) // closes pp.async
+	mmsis := []uint32{}
+	decodeSentences(pp, func(m *nmeais.Message) {
+		mmsi, _ := m.MMSI()
+		mmsis = append(mmsis, mmsi)
+	})
+	if len(mmsis) != 4 {
+		t.Fatalf("Expected the four remaining messages when replaying the directory, got %v", mmsis)
+	}
+	for i, mmsi := range mmsis {
+		if mmsi != 257000001+uint32(i) {
+			t.Errorf("Expected the messages in the order they were recorded, got %v", mmsis)
+		}
+	}
+}
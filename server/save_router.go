@@ -0,0 +1,66 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/tormol/AIS/nmeais"
+)
+
+// SaveRouter spreads messages over several goroutines that save them to an
+// Archive. Messages are routed by MMSI, so that all messages about a ship are
+// saved by the same worker in the order they were received.
+type SaveRouter struct {
+	queues []chan *nmeais.Message
+	done   sync.WaitGroup
+}
+
+// StartSaving starts workers goroutines that run Save, each with a queue of
+// queue messages, and returns the router that feeds them.
+func (a *Archive) StartSaving(workers, queue int) *SaveRouter {
+	sr := &SaveRouter{queues: make([]chan *nmeais.Message, workers)}
+	for i := range sr.queues {
+		sr.queues[i] = make(chan *nmeais.Message, queue)
+		sr.done.Add(1)
+		go func(q chan *nmeais.Message) {
+			a.Save(q)
+			sr.done.Done()
+		}(sr.queues[i])
+	}
+	return sr
+}
+
+// Route sends a message to the worker for its ship,
+// and returns how long it had to wait because the queue was full.
+// Messages without an MMSI go to the first worker.
+func (sr *SaveRouter) Route(m *nmeais.Message) time.Duration {
+	mmsi, _ := m.MMSI()
+	q := sr.queues[int(mmsi%uint32(len(sr.queues)))]
+	select {
+	case q <- m:
+		return 0
+	default: // only measure when full
+		blockStarted := time.Now()
+		q <- m
+		return time.Since(blockStarted)
+	}
+}
+
+// Queued returns how many messages are waiting for each worker,
+// and how many can wait.
+func (sr *SaveRouter) Queued() (waiting []int, capacity int) {
+	waiting = make([]int, len(sr.queues))
+	for i, q := range sr.queues {
+		waiting[i] = len(q)
+	}
+	return waiting, cap(sr.queues[0])
+}
+
+// Close waits until the workers have saved all queued messages and stopped.
+// Route must not be called afterwards.
+func (sr *SaveRouter) Close() {
+	for _, q := range sr.queues {
+		close(q)
+	}
+	sr.done.Wait()
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	l "github.com/tormol/AIS/logger"
+	"github.com/tormol/AIS/nmeais"
+)
+
+// parseMessages assembles the messages in packets,
+// where packet i is received interval*i after start.
+func parseMessages(packets []string, start time.Time, interval time.Duration) []*nmeais.Message {
+	logger := l.NewLogger(&logBuffer{}, l.Info)
+	pp := &PacketParser{async: make(chan sendSentence, 100), SourceName: "test", logger: logger}
+	messages := []*nmeais.Message{}
+	parsed := make(chan struct{})
+	go func() {
+		decodeSentences(pp, func(m *nmeais.Message) { messages = append(messages, m) })
+		close(parsed)
+	}()
+	for i, p := range packets {
+		pp.Accept([]byte(p), start.Add(time.Duration(i)*interval))
+	}
+	close(pp.async)
+	<-parsed
+	return messages
+}
+
+// movingFleet returns a packet per minute with a position report from every ship,
+// which moves a little north each time.
+func movingFleet(ships, minutes int) []string {
+	packets := make([]string, minutes)
+	for minute := range packets {
+		var sb strings.Builder
+		for i := 0; i < ships; i++ {
+			lat, long := 58+float64(i%100)/10, 5+float64(i/100)/10
+			sb.WriteString(positionReport(1, 257000000+uint32(i), lat+float64(minute)*0.001, long).sentences())
+		}
+		packets[minute] = sb.String()
+	}
+	return packets
+}
+
+func TestSaveRouterKeepsTheOrderOfEachShip(t *testing.T) {
+	const ships, minutes = 500, 8
+	start := time.Now().Add(-minutes * time.Minute)
+	messages := parseMessages(movingFleet(ships, minutes), start, time.Minute)
+	if len(messages) != ships*minutes {
+		t.Fatalf("Expected %d messages, got %d", ships*minutes, len(messages))
+	}
+	a := NewArchive(10, 0, 0, 0, 0, 0, 0)
+	router := a.StartSaving(8, 10)
+	for _, m := range messages {
+		router.Route(m)
+	}
+	router.Close()
+
+	if stats := a.Stats(); stats.Ships != ships || stats.Indexed != ships {
+		t.Fatalf("Expected %d ships in the index, got %+v", ships, stats)
+	}
+	for i := 0; i < ships; i++ {
+		mmsi := 257000000 + uint32(i)
+		_, pos, track, _ := a.Track(mmsi, 0, 0)
+		// a message saved after a newer one would be ignored
+		if len(track) != minutes {
+			t.Fatalf("Expected %09d to have all %d positions, got %d", mmsi, minutes, len(track))
+		}
+		for j := 1; j < len(track); j++ {
+			if !track[j].At.After(track[j-1].At) || track[j].Pos.Lat <= track[j-1].Pos.Lat {
+				t.Fatalf("Expected the track of %09d to be in order, got %v", mmsi, track)
+			}
+		}
+		if pos.Pos != track[len(track)-1].Pos {
+			t.Errorf("Expected the position of %09d to be the last one, got %v", mmsi, pos.Pos)
+		}
+		if lat, long, _ := a.KnownPosition(mmsi); lat != pos.Pos.Lat || long != pos.Pos.Long {
+			t.Errorf("Expected %09d to be indexed at %v, got %f,%f", mmsi, pos.Pos, lat, long)
+		}
+	}
+}
+
+// Compares saving a minute of traffic from 3000 ships, plus their static
+// reports, with different numbers of workers.
+func BenchmarkSaveWorkers(b *testing.B) {
+	const ships = 3000
+	packets := movingFleet(ships, 6)
+	rand.Seed(1)
+	for _, i := range rand.Perm(ships)[:ships/6] {
+		packets[rand.Intn(len(packets))] += staticReport(5, 257000000+uint32(i)).sentences()
+	}
+	messages := parseMessages(packets, time.Now().Add(-6*time.Minute), time.Minute)
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("%d", workers), func(b *testing.B) {
+			started := time.Now()
+			for n := 0; n < b.N; n++ {
+				a := NewArchive(10, 0, 0, 0, 0, 0, 0)
+				router := a.StartSaving(workers, 100)
+				for _, m := range messages {
+					router.Route(m)
+				}
+				router.Close()
+			}
+			b.ReportMetric(float64(len(messages)*b.N)/time.Since(started).Seconds(), "msgs/s")
+		})
+	}
+}
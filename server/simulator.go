@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/tormol/AIS/geo"
+	"github.com/tormol/AIS/nmeais"
+)
+
+// A sim:// source generates ships that move around inside an area,
+// for working on the website without a live feed.
+// The messages are encoded as NMEA sentences and parsed like from any other source.
+
+// simulation is the parameters of a sim:// source.
+type simulation struct {
+	ships    int
+	area     *geo.Rectangle
+	maxSpeed float64 // knots
+	rate     float64 // messages per second
+	seed     int64
+}
+
+// simShip is the state of one generated ship.
+type simShip struct {
+	mmsi     uint32
+	name     string
+	callsign string
+	shipType uint8
+	pos      geo.Point
+	speed    float64 // knots
+	course   float64 // degrees
+	moved    time.Time
+}
+
+// simStaticChance is the probability that a message is a type 5 instead of a position report.
+const simStaticChance = 0.05
+
+var simNameParts = [2][]string{
+	{"NORDIC", "POLAR", "SILVER", "NORTHERN", "BLUE", "STORM", "COASTAL", "RAPID"},
+	{"STAR", "EXPLORER", "SPIRIT", "QUEEN", "FALCON", "TRADER", "WIND", "HARVEST"},
+}
+var simShipTypes = []uint8{30, 36, 37, 52, 60, 70, 80}
+
+// parseSimulation parses an URL of the form
+// sim://?ships=N&area=minLat,minLong,maxLat,maxLong&speed=knots&rate=N&seed=N
+// where all parameters are optional.
+func parseSimulation(rawURL string) (simulation, error) {
+	sim := simulation{ships: 20, maxSpeed: 20, rate: 10, seed: time.Now().UnixNano()}
+	sim.area, _ = geo.NewRectangle(58.5, 5, 59.5, 6.5) // around Stavanger
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return sim, err
+	}
+	for param, values := range u.Query() {
+		value := values[len(values)-1]
+		switch param {
+		case "ships":
+			sim.ships, err = strconv.Atoi(value)
+			if err == nil && (sim.ships <= 0 || sim.ships > 100000) {
+				err = fmt.Errorf("must be between 1 and 100000")
+			}
+		case "area":
+			sim.area, err = parseLatLongBox(value)
+			if err == nil {
+				min, max := sim.area.Min(), sim.area.Max()
+				if min.Lat == max.Lat || min.Long == max.Long || max.Lat >= 85 || min.Lat <= -85 {
+					err = fmt.Errorf("must have an area and not include the poles")
+				}
+			}
+		case "speed":
+			sim.maxSpeed, err = strconv.ParseFloat(value, 64)
+			if err == nil && (sim.maxSpeed < 0 || sim.maxSpeed > 100) {
+				err = fmt.Errorf("must be between 0 and 100 knots")
+			}
+		case "rate":
+			sim.rate, err = strconv.ParseFloat(value, 64)
+			if err == nil && (sim.rate <= 0 || sim.rate > 100000) {
+				err = fmt.Errorf("must be between 0 and 100000 messages per second")
+			}
+		case "seed":
+			sim.seed, err = strconv.ParseInt(value, 10, 64)
+		default:
+			err = fmt.Errorf("unknown parameter")
+		}
+		if err != nil {
+			return sim, fmt.Errorf("invalid %s: %s", param, err.Error())
+		}
+	}
+	return sim, nil
+}
+
+// newShips creates ships with unique random MMSIs at random positions in the area.
+func (sim *simulation) newShips(rng *rand.Rand, now time.Time) []simShip {
+	ships := make([]simShip, 0, sim.ships)
+	used := make(map[uint32]bool, sim.ships)
+	min, max := sim.area.Min(), sim.area.Max()
+	for len(ships) < sim.ships {
+		mmsi := uint32(201+rng.Intn(575))*1000000 + uint32(rng.Intn(1000000))
+		if used[mmsi] {
+			continue
+		}
+		used[mmsi] = true
+		ships = append(ships, simShip{
+			mmsi: mmsi,
+			name: simNameParts[0][rng.Intn(len(simNameParts[0]))] + " " +
+				simNameParts[1][rng.Intn(len(simNameParts[1]))],
+			callsign: fmt.Sprintf("SIM%04d", len(ships)%10000),
+			shipType: simShipTypes[rng.Intn(len(simShipTypes))],
+			pos: geo.Point{
+				Lat:  min.Lat + rng.Float64()*(max.Lat-min.Lat),
+				Long: min.Long + rng.Float64()*(max.Long-min.Long),
+			},
+			speed:  rng.Float64() * sim.maxSpeed,
+			course: rng.Float64() * 360,
+			moved:  now,
+		})
+	}
+	return ships
+}
+
+// wrap moves v that has left [min, max] in one direction in from the other side.
+func wrap(v, min, max float64) float64 {
+	span := max - min
+	v = math.Mod(v-min, span)
+	if v < 0 {
+		v += span
+	}
+	return min + v
+}
+
+// move advances a ship along its course to now, turning it slightly.
+// Ships that leave the area enter it again on the opposite side.
+func (sim *simulation) move(s *simShip, rng *rand.Rand, now time.Time) {
+	s.pos = geo.ProjectPosition(s.pos, s.course, s.speed, now.Sub(s.moved))
+	s.moved = now
+	min, max := sim.area.Min(), sim.area.Max()
+	s.pos.Lat = wrap(s.pos.Lat, min.Lat, max.Lat)
+	s.pos.Long = wrap(s.pos.Long, min.Long, max.Long)
+	s.course = math.Mod(s.course+rng.Float64()*10-5+360, 360)
+}
+
+// message encodes a position report or occasionally static data for the ship.
+func (sim *simulation) message(s *simShip, rng *rand.Rand, smid uint8) string {
+	channel := byte('A' + rng.Intn(2))
+	if rng.Float64() < simStaticChance {
+		return nmeais.EncodeStaticVoyageData(nmeais.StaticVoyageData{
+			MMSI:        s.mmsi,
+			Callsign:    s.callsign,
+			Name:        s.name,
+			ShipType:    s.shipType,
+			ToBow:       40,
+			ToStern:     10,
+			ToPort:      5,
+			ToStarboard: 5,
+			ETAHour:     24,
+			ETAMinute:   60,
+			Draught:     50,
+			Destination: "SIMULATION",
+		}).Sentences(channel, smid)
+	}
+	status := uint8(0) // under way using engine
+	if s.speed < 0.5 {
+		status = 1 // at anchor
+	}
+	return nmeais.EncodePositionReport(nmeais.PositionReport{
+		Type:    1,
+		MMSI:    s.mmsi,
+		Status:  status,
+		Turn:    -128,
+		Speed:   float32(s.speed),
+		Lat:     s.pos.Lat,
+		Long:    s.pos.Long,
+		Course:  float32(s.course),
+		Heading: uint16(math.Round(s.course)) % 360,
+		Second:  uint8(s.moved.UTC().Second()),
+	}).Sentences(channel, 0)
+}
+
+// readSimulation generates messages from the ships in turn until stop is closed,
+// and then closes parser.
+func readSimulation(sim simulation, parser *PacketParser, stop <-chan struct{}) {
+	defer parser.Close()
+	atomic.AddInt32(&ListenerConnections, 1)
+	defer atomic.AddInt32(&ListenerConnections, -1)
+	rng := rand.New(rand.NewSource(sim.seed))
+	ships := sim.newShips(rng, time.Now())
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / sim.rate))
+	defer ticker.Stop()
+	for i := 0; ; i++ {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			s := &ships[i%len(ships)]
+			sim.move(s, rng, now)
+			parser.Accept([]byte(sim.message(s, rng, uint8(i%10))), now)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"math/rand"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/andmarios/aislib"
+	l "github.com/tormol/AIS/logger"
+	"github.com/tormol/AIS/nmeais"
+)
+
+func TestParseSimulation(t *testing.T) {
+	sim, err := parseSimulation("sim://?ships=50&area=58,5,62,11&speed=20&rate=100&seed=3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	min, max := sim.area.Min(), sim.area.Max()
+	if sim.ships != 50 || sim.maxSpeed != 20 || sim.rate != 100 || sim.seed != 3 ||
+		min.Lat != 58 || min.Long != 5 || max.Lat != 62 || max.Long != 11 {
+		t.Errorf("Unexpected parameters %+v", sim)
+	}
+	if sim, err = parseSimulation("sim://"); err != nil || sim.ships == 0 || sim.area == nil {
+		t.Errorf("Expected defaults, got %+v, %v", sim, err)
+	}
+	for _, invalid := range []string{
+		"sim://?ships=0",
+		"sim://?area=58,5,62",
+		"sim://?area=62,5,58,11",
+		"sim://?area=80,5,89,11",
+		"sim://?speed=-1",
+		"sim://?rate=0",
+		"sim://?unknown=1",
+	} {
+		if _, err := parseSimulation(invalid); err == nil {
+			t.Errorf("Expected %s to be rejected", invalid)
+		}
+	}
+	if _, err := parseSource("demo=sim://?ships=x", defaultSourceTimeout); err == nil {
+		t.Error("Expected parseSource() to validate sim:// URLs")
+	}
+}
+
+func TestSimulatedShipsWrap(t *testing.T) {
+	sim, _ := parseSimulation("sim://?area=58,5,59,6")
+	rng := rand.New(rand.NewSource(1))
+	start := time.Now()
+	s := simShip{speed: 60, course: 0, moved: start}
+	s.pos.Lat, s.pos.Long = 58.9, 5.5
+	sim.move(&s, rng, start.Add(12*time.Minute)) // 12 nautical miles north
+	if s.pos.Lat < 58.05 || s.pos.Lat > 58.15 || s.pos.Long < 5.4 || s.pos.Long > 5.6 {
+		t.Errorf("Expected the ship to wrap around to 58.1,5.5, got %+v", s.pos)
+	}
+	s.course = 270
+	sim.move(&s, rng, start.Add(72*time.Minute)) // one hour west
+	if s.pos.Long < 5 || s.pos.Long > 6 || s.pos.Lat < 58 || s.pos.Lat > 59 {
+		t.Errorf("Expected the ship to stay in the area, got %+v", s.pos)
+	}
+}
+
+func TestSimulation(t *testing.T) {
+	sim, err := parseSimulation("sim://?ships=5&area=58,5,62,11&speed=20&rate=2000&seed=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mu := sync.Mutex{}
+	messages := []*nmeais.Message{}
+	parser := NewPacketParser("sim", true, SourceFilter{}, 200, l.NewLogger(os.Stderr, l.Info), func(m *nmeais.Message) {
+		mu.Lock()
+		messages = append(messages, m)
+		mu.Unlock()
+	})
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		readSimulation(sim, parser, stop)
+		close(done)
+	}()
+	time.Sleep(200 * time.Millisecond)
+	close(stop)
+	<-done
+	time.Sleep(10 * time.Millisecond) // let the parser finish
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(messages) < 20 {
+		t.Fatalf("Expected many messages, got %d", len(messages))
+	}
+	ships := make(map[uint32]bool)
+	for _, m := range messages {
+		mmsi, _ := m.MMSI()
+		ships[mmsi] = true
+		switch m.Type() {
+		case 1:
+			r, err := aislib.DecodeClassAPositionReport(m.ArmoredPayload())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.Lat < 58 || r.Lat > 62 || r.Lon < 5 || r.Lon > 11 {
+				t.Errorf("Expected positions inside the area, got %f,%f", r.Lat, r.Lon)
+			} else if r.Speed > 20 || r.Course >= 360 || r.Heading >= 360 {
+				t.Errorf("Unexpected speed %f, course %f or heading %d", r.Speed, r.Course, r.Heading)
+			}
+		case 5:
+			d, err := aislib.DecodeStaticVoyageData(m.ArmoredPayload())
+			if err != nil {
+				t.Fatal(err)
+			} else if d.MMSI != mmsi || d.VesselName == "" {
+				t.Errorf("Unexpected static data %+v", d)
+			}
+		default:
+			t.Errorf("Unexpected message type %d", m.Type())
+		}
+	}
+	if len(ships) != 5 {
+		t.Errorf("Expected messages from 5 ships, got %d", len(ships))
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+// Estimates how late each source delivers messages
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tormol/AIS/nmeais"
+)
+
+const (
+	// skewWeight is how much each new sample moves the average.
+	skewWeight = 0.1
+	// minSkewSamples is how many samples are needed before an estimate is used.
+	// The estimate starts at their median.
+	minSkewSamples = 5
+	// maxSkewSample is how far off a timestamp can be before it's assumed
+	// to be from a base station with a wrong clock and ignored.
+	maxSkewSample = time.Hour
+	// maxSkewOutlier is how far from the estimate a sample can be once
+	// there is one, so that a single bad clock doesn't move it much.
+	maxSkewOutlier = 5 * time.Minute
+	// maxSkewCorrection is the most receive times are corrected by.
+	maxSkewCorrection = 5 * time.Minute
+	// minUTCBits is the length of type 4 and 11 messages up to and
+	// including the UTC second.
+	minUTCBits = 78
+)
+
+// ClockSkew estimates how long after they were sent each source delivers
+// messages, from the UTC time in base station reports (type 4) and UTC
+// responses (type 11), as an exponentially weighted moving average of
+// receive time minus message time.
+// Sources that buffer messages before relaying them, such as aggregators,
+// have a positive skew, which can be subtracted from the receive time of
+// their messages so that their positions compete fairly with those from
+// sources that deliver them immediately.
+//
+// Position reports only have the UTC second, which cannot tell a delay of
+// 90 seconds from one of 30, so they're not used.
+type ClockSkew struct {
+	// Correct makes Correction() return the estimates.
+	// Must be set before messages are saved.
+	Correct bool
+	lock    sync.RWMutex
+	sources map[string]*skewEstimate
+}
+
+// skewEstimate is the estimate for one source.
+type skewEstimate struct {
+	seconds float64 // moving average of receive time minus message time
+	samples uint64
+	first   [minSkewSamples]float64 // the samples before there is an estimate
+}
+
+// NewClockSkew creates an estimator without any estimates.
+func NewClockSkew() *ClockSkew {
+	return &ClockSkew{sources: make(map[string]*skewEstimate)}
+}
+
+// utcTime decodes the time of a type 4 or 11 message,
+// or returns false if the message is some other type or has no valid time.
+func utcTime(m *nmeais.Message) (time.Time, bool) {
+	if t := m.Type(); t != 4 && t != 11 {
+		return time.Time{}, false
+	}
+	bits := m.Bits()
+	if bits.Len() < minUTCBits {
+		return time.Time{}, false
+	}
+	year, month, day := int(bits.Uint(38, 14)), int(bits.Uint(52, 4)), int(bits.Uint(56, 5))
+	hour, minute, second := int(bits.Uint(61, 5)), int(bits.Uint(66, 6)), int(bits.Uint(72, 6))
+	// 0 or 24/60 means not available
+	if year == 0 || month == 0 || month > 12 || day == 0 || hour >= 24 || minute >= 60 || second >= 60 {
+		return time.Time{}, false
+	}
+	at := time.Date(year, time.Month(month), day, hour, minute, second, 0, time.UTC)
+	if at.Day() != day { // such as February 30th
+		return time.Time{}, false
+	}
+	return at, true
+}
+
+// Observe updates the estimate for the source of m if it has a UTC time.
+func (cs *ClockSkew) Observe(m *nmeais.Message) {
+	at, ok := utcTime(m)
+	if !ok || m.Received().IsZero() {
+		return
+	}
+	cs.add(m.SourceName, m.Received().Sub(at))
+}
+
+// add adds a sample to the estimate of a source, unless it's an outlier.
+// The estimate starts at the median of the first samples, so that a bad
+// first sample doesn't make every later one an outlier.
+func (cs *ClockSkew) add(source string, skew time.Duration) {
+	if skew > maxSkewSample || skew < -maxSkewSample {
+		return
+	}
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	e := cs.sources[source]
+	if e == nil {
+		e = &skewEstimate{}
+		cs.sources[source] = e
+	}
+	if e.samples < minSkewSamples {
+		e.first[e.samples] = skew.Seconds()
+		e.samples++
+		if e.samples == minSkewSamples {
+			sorted := e.first[:]
+			sort.Float64s(sorted)
+			e.seconds = sorted[minSkewSamples/2]
+		}
+		return
+	} else if math.Abs(skew.Seconds()-e.seconds) > maxSkewOutlier.Seconds() {
+		return
+	}
+	e.seconds += (skew.Seconds() - e.seconds) * skewWeight
+	e.samples++
+}
+
+// Estimate returns the estimated skew of a source, and false if there are
+// too few samples or cs is nil.
+func (cs *ClockSkew) Estimate(source string) (time.Duration, bool) {
+	if cs == nil {
+		return 0, false
+	}
+	cs.lock.RLock()
+	defer cs.lock.RUnlock()
+	e := cs.sources[source]
+	if e == nil || e.samples < minSkewSamples {
+		return 0, false
+	}
+	return time.Duration(e.seconds * float64(time.Second)), true
+}
+
+// Correction returns how much to subtract from the receive time of messages
+// from the source: the estimated skew if Correct is set, but never negative
+// or more than maxSkewCorrection.
+// Sources that appear to be ahead are not corrected, as a message cannot
+// have been received before it was sent.
+func (cs *ClockSkew) Correction(source string) time.Duration {
+	if cs == nil || !cs.Correct {
+		return 0
+	}
+	skew, ok := cs.Estimate(source)
+	if !ok || skew < 0 {
+		return 0
+	} else if skew > maxSkewCorrection {
+		return maxSkewCorrection
+	}
+	return skew
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tormol/AIS/nmeais"
+)
+
+// baseStationReport creates a type 4 message with the UTC time at.
+func baseStationReport(mmsi uint32, at time.Time) payloadBits {
+	at = at.UTC()
+	pb := payloadBits{}
+	pb.put(6, 4)
+	pb.put(2, 0)
+	pb.put(30, int64(mmsi))
+	pb.put(14, int64(at.Year()))
+	pb.put(4, int64(at.Month()))
+	pb.put(5, int64(at.Day()))
+	pb.put(5, int64(at.Hour()))
+	pb.put(6, int64(at.Minute()))
+	pb.put(6, int64(at.Second()))
+	pb.put(1, 0)
+	pb.put(28, int64(5*600000))
+	pb.put(27, int64(60*600000))
+	pb.put(4, 1) // GPS
+	pb.put(uint(168-len(pb)), 0)
+	return pb
+}
+
+// withSecond replaces the UTC second of a type 1 position report.
+func (pb payloadBits) withSecond(second uint8) payloadBits {
+	secondBits := payloadBits{}
+	secondBits.put(6, int64(second))
+	copy(pb[137:143], secondBits)
+	return pb
+}
+
+// receivedFrom parses a packet received at a time from a source.
+func receivedFrom(source string, pb payloadBits, received time.Time) *nmeais.Message {
+	m := parseMessages([]string{pb.sentences()}, received, 0)[0]
+	m.SourceName = source
+	return m
+}
+
+func TestClockSkew(t *testing.T) {
+	cs := NewClockSkew()
+	cs.Correct = true
+	sent := time.Now().Truncate(time.Second).Add(-time.Hour)
+	for i := 0; i < 30; i++ {
+		report := baseStationReport(2570000, sent)
+		cs.Observe(receivedFrom("direct", report, sent))
+		delay := 90*time.Second + time.Duration(i%3-1)*10*time.Second
+		cs.Observe(receivedFrom("aggregator", report, sent.Add(delay)))
+		sent = sent.Add(10 * time.Second)
+	}
+	if skew, ok := cs.Estimate("aggregator"); !ok || skew < 85*time.Second || skew > 95*time.Second {
+		t.Errorf("Expected the aggregator to be about 90s late, got %s (%t)", skew, ok)
+	}
+	if skew, ok := cs.Estimate("direct"); !ok || skew < -time.Second || skew > time.Second {
+		t.Errorf("Expected the direct source to not be late, got %s (%t)", skew, ok)
+	}
+	if _, ok := cs.Estimate("unknown"); ok {
+		t.Error("Expected no estimate for a source without base station reports")
+	}
+
+	// a base station with a wrong clock, and a single delayed report
+	before, _ := cs.Estimate("direct")
+	cs.Observe(receivedFrom("direct", baseStationReport(2570000, sent.Add(-2*time.Hour)), sent))
+	cs.Observe(receivedFrom("direct", baseStationReport(2570000, sent.Add(-10*time.Minute)), sent))
+	if after, _ := cs.Estimate("direct"); after != before {
+		t.Errorf("Expected outliers to be ignored, the estimate went from %s to %s", before, after)
+	}
+
+	for i := 0; i < minSkewSamples; i++ {
+		cs.Observe(receivedFrom("ahead", baseStationReport(2570000, sent.Add(time.Minute)), sent))
+		cs.Observe(receivedFrom("buffering", baseStationReport(2570000, sent.Add(-20*time.Minute)), sent))
+	}
+	if c := cs.Correction("ahead"); c != 0 {
+		t.Errorf("Expected sources that are ahead to not be corrected, got %s", c)
+	}
+	if c := cs.Correction("buffering"); c != maxSkewCorrection {
+		t.Errorf("Expected the correction to be capped at %s, got %s", maxSkewCorrection, c)
+	}
+	// the first report is from a base station with a wrong clock
+	cs.Observe(receivedFrom("bad start", baseStationReport(2570000, sent.Add(-40*time.Minute)), sent))
+	for i := 0; i < 20; i++ {
+		sent = sent.Add(10 * time.Second)
+		cs.Observe(receivedFrom("bad start", baseStationReport(2570000, sent), sent.Add(2*time.Second)))
+	}
+	if skew, ok := cs.Estimate("bad start"); !ok || skew < time.Second || skew > 3*time.Second {
+		t.Errorf("Expected a bad first sample to not decide the estimate, got %s (%t)", skew, ok)
+	}
+
+	cs.Correct = false
+	if c := cs.Correction("aggregator"); c != 0 {
+		t.Errorf("Expected no correction unless enabled, got %s", c)
+	}
+	var none *ClockSkew
+	if c := none.Correction("aggregator"); c != 0 {
+		t.Errorf("Expected no correction without an estimator, got %s", c)
+	}
+}
+
+func TestSkewCorrectionOrdersPositions(t *testing.T) {
+	const mmsi = 257012345
+	start := time.Now().Truncate(time.Hour).Add(-time.Hour)
+	a := positionReport(1, mmsi, 60.000, 5).withSecond(0)
+	c := positionReport(1, mmsi, 60.002, 5).withSecond(0)
+	// sent between a and c, but delivered 90 seconds late
+	b := positionReport(1, mmsi, 60.001, 5).withSecond(30)
+
+	for _, correct := range []bool{true, false} {
+		archive := NewArchive(10, 0, 0, 0, 0, 0, 0)
+		archive.skew = NewClockSkew()
+		archive.skew.Correct = correct
+		for i := 0; i < minSkewSamples; i++ {
+			archive.skew.add("aggregator", 90*time.Second)
+		}
+		messages := make(chan *nmeais.Message, 3)
+		messages <- receivedFrom("direct", a, start)
+		messages <- receivedFrom("direct", c, start.Add(time.Minute))
+		messages <- receivedFrom("aggregator", b, start.Add(2*time.Minute))
+		close(messages)
+		archive.Save(messages)
+
+		_, pos, track, _ := archive.Track(mmsi, 0, 0)
+		if correct {
+			if pos.Pos.Lat != 60.002 {
+				t.Errorf("Expected the late position to not replace a newer one, the ship is at %f", pos.Pos.Lat)
+			}
+			for i := 1; i < len(track); i++ {
+				if track[i].At.Before(track[i-1].At) {
+					t.Errorf("Expected the track to be in order, got %+v", track)
+				}
+			}
+		} else if pos.Pos.Lat != 60.001 {
+			t.Errorf("Expected the late position to replace the newer one without correction, the ship is at %f", pos.Pos.Lat)
+		}
+	}
+}
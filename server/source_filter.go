@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/tormol/AIS/geo"
+	"github.com/tormol/AIS/nmeais"
+	"github.com/tormol/AIS/storage"
+)
+
+// SourceFilter is rules for which messages from a source to drop before they
+// are merged with the other sources, stored and forwarded.
+// The zero value drops nothing.
+type SourceFilter struct {
+	DropOwnShip bool            // sentences with identifiers ending in O, such as !AIVDO
+	DropMMSI    map[uint32]bool // nil drops none
+	BBox        *geo.Rectangle  // drop position reports outside this, nil drops none
+}
+
+// filterCounts counts messages dropped by a SourceFilter, for each rule.
+type filterCounts struct {
+	OwnShip uint64 // sentences, as they're dropped before being assembled into messages
+	MMSI    uint64
+	Outside uint64
+}
+
+// equal compares all the rules of two filters.
+func (f *SourceFilter) equal(other *SourceFilter) bool {
+	if f.DropOwnShip != other.DropOwnShip || len(f.DropMMSI) != len(other.DropMMSI) ||
+		(f.BBox == nil) != (other.BBox == nil) {
+		return false
+	} else if f.BBox != nil && (f.BBox.Min() != other.BBox.Min() || f.BBox.Max() != other.BBox.Max()) {
+		return false
+	}
+	for mmsi := range f.DropMMSI {
+		if !other.DropMMSI[mmsi] {
+			return false
+		}
+	}
+	return true
+}
+
+// dropsSentence returns true if the sentence should be dropped.
+func (f *SourceFilter) dropsSentence(s *nmeais.Sentence) bool {
+	return f.DropOwnShip && s.IsOwnShip()
+}
+
+// dropsMessage returns the counter to increment if the message should be
+// dropped, or nil if it should be kept.
+// Only position reports are checked against the bounding box, and also
+// position reports without a position are kept.
+func (f *SourceFilter) dropsMessage(m *nmeais.Message, counts *filterCounts) *uint64 {
+	if mmsi, ok := m.MMSI(); ok && f.DropMMSI != nil && f.DropMMSI[mmsi] {
+		return &counts.MMSI
+	}
+	if f.BBox != nil {
+		lat, long, ok := m.Position()
+		if ok && !f.BBox.ContainsPoint(geo.Point{Lat: lat, Long: long}) {
+			return &counts.Outside
+		}
+	}
+	return nil
+}
+
+// parseDropMMSI parses the value of the drop_mmsi source option.
+func parseDropMMSI(value string) (map[uint32]bool, error) {
+	drop := make(map[uint32]bool)
+	for _, s := range strings.Split(value, ",") {
+		mmsi, err := strconv.ParseUint(s, 10, 32)
+		if err != nil || !storage.ValidMMSI(uint32(mmsi)) {
+			return nil, fmt.Errorf("invalid MMSI %q", s)
+		}
+		drop[uint32(mmsi)] = true
+	}
+	return drop, nil
+}
+
+// parseLatLongBox parses a rectangle of the form minLat,minLong,maxLat,maxLong,
+// which is used by the bbox source option and the area of sim:// sources.
+func parseLatLongBox(value string) (*geo.Rectangle, error) {
+	var minLat, minLong, maxLat, maxLong float64
+	var remainder string
+	parsed, _ := fmt.Sscanf(value, "%f,%f,%f,%f%s", &minLat, &minLong, &maxLat, &maxLong, &remainder)
+	if parsed != 4 {
+		return nil, fmt.Errorf("must be minLat,minLong,maxLat,maxLong")
+	}
+	return geo.NewRectangle(minLat, minLong, maxLat, maxLong)
+}
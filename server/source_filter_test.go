@@ -0,0 +1,127 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	l "github.com/tormol/AIS/logger"
+	"github.com/tormol/AIS/nmeais"
+)
+
+// filterSentences passes sentences through a PacketParser with the filter,
+// and returns the MMSIs of the messages that were kept and what it counted.
+func filterSentences(t *testing.T, filter SourceFilter, sentences string) ([]uint32, filterCounts) {
+	mu := sync.Mutex{}
+	kept := []uint32{}
+	pp := NewPacketParser("filter_test", false, filter, 200, l.NewLogger(&logBuffer{}, l.Info),
+		func(m *nmeais.Message) {
+			mu.Lock()
+			mmsi, _ := m.MMSI()
+			kept = append(kept, mmsi)
+			mu.Unlock()
+		})
+	pp.Accept([]byte(sentences), time.Now())
+	// the last message, which no filter drops, makes sure the others have been handled
+	done := make(chan struct{})
+	pp.Accept([]byte(staticReport(24, 999999999).sentences()), time.Now())
+	go func() {
+		for {
+			mu.Lock()
+			last := len(kept) != 0 && kept[len(kept)-1] == 999999999
+			mu.Unlock()
+			if last {
+				close(done)
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for the parser")
+	}
+	pp.Close()
+	pp.pl.statsLock.Lock()
+	defer pp.pl.statsLock.Unlock()
+	return kept[:len(kept)-1], pp.pl.filtered
+}
+
+func TestDropOwnShip(t *testing.T) {
+	ownShip := (&nmeais.PayloadWriter{})
+	ownShip.PutUint(6, 1)
+	ownShip.PutUint(2, 0)
+	ownShip.PutUint(30, 257000002)
+	ownShip.PutUint(130, 0)
+	armored, padding := ownShip.Armored()
+	vdo, err := nmeais.EncodeSentence("AIVDO", 1, 0, 10, 'A', armored, padding)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sentences := positionReport(1, 257000001, 60, 5).sentences() + vdo
+	kept, counts := filterSentences(t, SourceFilter{}, sentences)
+	if len(kept) != 2 {
+		t.Errorf("Expected both messages to be kept without filter, got %v", kept)
+	}
+	kept, counts = filterSentences(t, SourceFilter{DropOwnShip: true}, sentences)
+	if len(kept) != 1 || kept[0] != 257000001 || counts != (filterCounts{OwnShip: 1}) {
+		t.Errorf("Expected the AIVDO to be dropped, got %v and %+v", kept, counts)
+	}
+}
+
+func TestDropMMSI(t *testing.T) {
+	filter := SourceFilter{DropMMSI: map[uint32]bool{257000002: true, 257000003: true}}
+	kept, counts := filterSentences(t, filter, positionReport(1, 257000001, 60, 5).sentences()+
+		positionReport(18, 257000002, 60, 5).sentences()+
+		staticReport(5, 257000003).sentences()+ // two sentences
+		staticReport(5, 257000004).sentences())
+	if len(kept) != 2 || kept[0] != 257000001 || kept[1] != 257000004 || counts != (filterCounts{MMSI: 2}) {
+		t.Errorf("Expected 257000002 and 257000003 to be dropped, got %v and %+v", kept, counts)
+	}
+}
+
+func TestDropOutsideBBox(t *testing.T) {
+	bbox, err := parseLatLongBox("58,5,62,11")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept, counts := filterSentences(t, SourceFilter{BBox: bbox},
+		positionReport(1, 257000001, 60, 5.5).sentences()+
+			positionReport(1, 257000002, 63, 5.5).sentences()+ // north of the box
+			positionReport(18, 257000003, 60, 4).sentences()+ // west of the box
+			positionReport(1, 257000004, 91, 181).sentences()+ // not available
+			staticReport(5, 257000005).sentences())
+	if len(kept) != 3 || kept[0] != 257000001 || kept[1] != 257000004 || kept[2] != 257000005 ||
+		counts != (filterCounts{Outside: 2}) {
+		t.Errorf("Expected positions outside the box to be dropped, got %v and %+v", kept, counts)
+	}
+}
+
+func TestParseSourceFilters(t *testing.T) {
+	s, err := parseSource("rx,drop_ownship,drop_mmsi=257000001,257000002,bbox=58,5,62,11,strict=tcp://localhost:1", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Filter.DropOwnShip || len(s.Filter.DropMMSI) != 2 || !s.Filter.DropMMSI[257000002] ||
+		s.Filter.BBox == nil || s.Filter.BBox.Min().Lat != 58 || s.Filter.BBox.Max().Long != 11 ||
+		!s.Strict || s.URL != "tcp://localhost:1" {
+		t.Errorf("Unexpected source %+v", s)
+	}
+	other, _ := parseSource("rx,bbox=58,5,62,11,drop_mmsi=257000002,257000001,drop_ownship,strict=tcp://localhost:1", time.Second)
+	if !s.equal(&other) {
+		t.Error("Expected the order of options to not matter")
+	}
+	for _, invalid := range []string{
+		"rx,drop_mmsi=tcp://localhost:1",
+		"rx,drop_mmsi=0=tcp://localhost:1",
+		"rx,drop_mmsi=1,,2=tcp://localhost:1",
+		"rx,bbox=58,5,62=tcp://localhost:1",
+		"rx,bbox=62,5,58,11=tcp://localhost:1",
+		"rx,bbox=58,5,62,11",
+	} {
+		if _, err := parseSource(invalid, time.Second); err == nil {
+			t.Errorf("Expected %s to be rejected", invalid)
+		}
+	}
+}
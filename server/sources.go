@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tormol/AIS/nmeais"
+)
+
+// SourceManager owns the goroutines reading from the sources, so that
+// sources can be restarted after they have given up, without restarting the
+// server and losing what the archive knows.
+type SourceManager struct {
+	sourceTLS   *tls.Config
+	parserQueue int
+	readBuffer  int
+	dst         func(*nmeais.Message)
+	read        func(s Source, stop <-chan struct{}) // replaced by tests
+	mu          sync.Mutex
+	sources     map[string]*managedSource
+	file        string // set by LoadFile
+	// The estimates are included in Status() if not nil.
+	// Must be set before Status is called.
+	Skew *ClockSkew
+}
+
+// managedSource is a source and its current or latest reader.
+type managedSource struct {
+	Source
+	run      *sourceRun
+	restarts int
+	fromFile bool // added by Reload
+}
+
+// sourceRun is one reader goroutine.
+type sourceRun struct {
+	stop     chan struct{}
+	done     chan struct{} // closed when the reader has returned and closed its PacketParser
+	started  time.Time
+	finished time.Time // zero while running
+	stopped  bool      // by Stop() instead of giving up or reaching the end of a file
+}
+
+// SourceStatus is what the SourceManager knows about a source.
+type SourceStatus struct {
+	Name     string    `json:"name"`
+	State    string    `json:"state"` // "running", "stopped", "gave up" or "finished"
+	Since    time.Time `json:"since"`
+	Restarts int       `json:"restarts"`
+	// how late messages arrive, if estimated
+	ClockSkew *float64 `json:"clock_skew_seconds,omitempty"`
+}
+
+// Errors from SourceManager.Stop and SourceManager.Start
+var (
+	errNoSuchSource = errors.New("No source with that name")
+	errFileSource   = errors.New("Files cannot be restarted")
+	errNoSourceFile = errors.New("No -sources-file to reload")
+)
+
+// NewSourceManager creates a manager that reads from sources with the
+// parameters of read(), and passes messages to dst.
+func NewSourceManager(sourceTLS *tls.Config, parserQueue, readBuffer int,
+	dst func(*nmeais.Message)) *SourceManager {
+	sm := &SourceManager{
+		sourceTLS:   sourceTLS,
+		parserQueue: parserQueue,
+		readBuffer:  readBuffer,
+		dst:         dst,
+		sources:     make(map[string]*managedSource),
+	}
+	sm.read = func(s Source, stop <-chan struct{}) {
+		read(s, sm.sourceTLS, sm.parserQueue, sm.readBuffer, sm.dst, stop)
+	}
+	return sm
+}
+
+// Add registers a source and starts reading from it.
+func (sm *SourceManager) Add(s Source) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if _, exists := sm.sources[s.Name]; exists {
+		return fmt.Errorf("There is already a source named %s", s.Name)
+	}
+	ms := &managedSource{Source: s}
+	sm.sources[s.Name] = ms
+	sm.start(ms)
+	return nil
+}
+
+// start starts a new reader for the source. sm.mu must be held.
+func (sm *SourceManager) start(ms *managedSource) {
+	run := &sourceRun{
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+		started: time.Now(),
+	}
+	ms.run = run
+	go func() {
+		sm.read(ms.Source, run.stop)
+		sm.mu.Lock()
+		run.finished = time.Now()
+		sm.mu.Unlock()
+		close(run.done)
+	}()
+}
+
+// get returns the source with the name, or an error if there is none
+// or it's a file. sm.mu must be held.
+func (sm *SourceManager) get(name string) (*managedSource, error) {
+	ms, exists := sm.sources[name]
+	if !exists {
+		return nil, errNoSuchSource
+	} else if scheme := ms.scheme(); scheme == "file" || scheme == "" {
+		return nil, errFileSource
+	}
+	return ms, nil
+}
+
+// Stop stops reading from a source and waits until the reader has closed its
+// PacketParser. Stopping a source that isn't running does nothing.
+func (sm *SourceManager) Stop(name string) error {
+	sm.mu.Lock()
+	ms, err := sm.get(name)
+	if err != nil {
+		sm.mu.Unlock()
+		return err
+	}
+	run := ms.run
+	if run.finished.IsZero() && !run.stopped {
+		run.stopped = true
+		close(run.stop)
+	}
+	sm.mu.Unlock()
+	<-run.done
+	return nil
+}
+
+// Start reconnects to a source, by stopping the current reader if it's still
+// running and then starting a new one.
+func (sm *SourceManager) Start(name string) error {
+	if err := sm.Stop(name); err != nil {
+		return err
+	}
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	ms, exists := sm.sources[name]
+	if !exists { // removed by a concurrent Reload()
+		return errNoSuchSource
+	} else if !ms.run.finished.IsZero() { // not started by a concurrent Start()
+		ms.restarts++
+		sm.start(ms)
+	}
+	return nil
+}
+
+// equal compares all fields of two sources.
+func (s *Source) equal(other *Source) bool {
+	return s.Name == other.Name && s.URL == other.URL && s.Timeout == other.Timeout &&
+		bytes.Equal(s.SendFirst, other.SendFirst) && s.Loop == other.Loop &&
+		s.Pace == other.Pace && s.Strict == other.Strict && s.Filter.equal(&other.Filter)
+}
+
+// Reload makes the sources added by earlier calls to Reload match desired:
+// New sources are started, sources that are no longer desired or have
+// changed are stopped, and unchanged sources are left alone, so that their
+// connection and backoff are kept.
+// Sources added with Add() cannot be changed, and files are not supported.
+// Nothing is changed if desired is invalid.
+func (sm *SourceManager) Reload(desired []Source) (added, removed int, err error) {
+	sm.mu.Lock()
+	wanted := make(map[string]bool, len(desired))
+	for _, s := range desired {
+		if wanted[s.Name] {
+			sm.mu.Unlock()
+			return 0, 0, fmt.Errorf("There are multiple sources named %s", s.Name)
+		} else if ms, exists := sm.sources[s.Name]; exists && !ms.fromFile {
+			sm.mu.Unlock()
+			return 0, 0, fmt.Errorf("There is already a source named %s", s.Name)
+		} else if scheme := s.scheme(); scheme == "file" || scheme == "" {
+			sm.mu.Unlock()
+			return 0, 0, fmt.Errorf("%s: %s", s.Name, errFileSource.Error())
+		}
+		wanted[s.Name] = true
+	}
+	// stop the removed and changed sources
+	stopped := []*sourceRun{}
+	for name, ms := range sm.sources {
+		if !ms.fromFile {
+			continue
+		}
+		keep := false
+		for i := range desired {
+			if desired[i].Name == name {
+				keep = ms.Source.equal(&desired[i])
+				break
+			}
+		}
+		if !keep {
+			if ms.run.finished.IsZero() && !ms.run.stopped {
+				ms.run.stopped = true
+				close(ms.run.stop)
+			}
+			stopped = append(stopped, ms.run)
+			delete(sm.sources, name)
+		}
+	}
+	sm.mu.Unlock()
+	// a changed source must have removed its periodic logger before the
+	// new one with the same name is added
+	for _, run := range stopped {
+		<-run.done
+	}
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	for _, s := range desired {
+		if _, exists := sm.sources[s.Name]; !exists {
+			ms := &managedSource{Source: s, fromFile: true}
+			sm.sources[s.Name] = ms
+			sm.start(ms)
+			added++
+		}
+	}
+	return added, len(stopped), nil
+}
+
+// LoadFile reads sources from a file with loadSourcesFile and starts them,
+// and remembers the path for ReloadFile.
+func (sm *SourceManager) LoadFile(path string) (added int, err error) {
+	sm.mu.Lock()
+	sm.file = path
+	sm.mu.Unlock()
+	added, _, err = sm.ReloadFile()
+	return added, err
+}
+
+// ReloadFile reads the file passed to LoadFile again and calls Reload.
+// The running sources are not changed if the file cannot be read or parsed.
+func (sm *SourceManager) ReloadFile() (added, removed int, err error) {
+	sm.mu.Lock()
+	path := sm.file
+	sm.mu.Unlock()
+	if path == "" {
+		return 0, 0, errNoSourceFile
+	}
+	desired, err := loadSourcesFile(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	return sm.Reload(desired)
+}
+
+// Status returns the state of all sources, sorted by name.
+func (sm *SourceManager) Status() []SourceStatus {
+	if sm == nil {
+		return []SourceStatus{}
+	}
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	status := make([]SourceStatus, 0, len(sm.sources))
+	for name, ms := range sm.sources {
+		s := SourceStatus{Name: name, State: "running", Since: ms.run.started, Restarts: ms.restarts}
+		if !ms.run.finished.IsZero() {
+			s.Since = ms.run.finished
+			if ms.run.stopped {
+				s.State = "stopped"
+			} else if scheme := ms.scheme(); scheme == "file" || scheme == "" {
+				s.State = "finished"
+			} else {
+				s.State = "gave up"
+			}
+		}
+		if skew, ok := sm.Skew.Estimate(name); ok {
+			seconds := math.Round(skew.Seconds()*10) / 10
+			s.ClockSkew = &seconds
+		}
+		status = append(status, s)
+	}
+	sort.Slice(status, func(i, j int) bool {
+		return status[i].Name < status[j].Name
+	})
+	return status
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tormol/AIS/forwarder"
+	"github.com/tormol/AIS/nmeais"
+)
+
+func TestReconnectSource(t *testing.T) {
+	// get a free port, and close it so that connecting is refused
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	messages := make(chan *nmeais.Message, 1)
+	sources := NewSourceManager(nil, 200, 4096, func(m *nmeais.Message) {
+		messages <- m
+	})
+	source, err := parseSource("refusing=tcp://"+addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = sources.Add(source); err != nil {
+		t.Fatal(err)
+	}
+	if err = sources.Add(source); err == nil {
+		t.Error("Expected adding a source with the same name to fail")
+	}
+	time.Sleep(50 * time.Millisecond) // let it fail and start waiting
+
+	listener, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Skipf("Cannot listen on %s again: %s", addr, err.Error())
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("!BSVDM,1,1,,B,144atH00000Lf9nSffVf49TP00S9,0*1D\r\n"))
+		time.Sleep(time.Second)
+	}()
+
+	reconnect := func(remote string) int {
+		r := httptest.NewRequest("POST", "/api/v1/sources/refusing/reconnect", nil)
+		r.RemoteAddr = remote
+		w := httptest.NewRecorder()
+		adminAccess := &forwarder.Access{Allow: []*net.IPNet{{IP: net.IPv4(127, 0, 0, 1), Mask: net.CIDRMask(32, 32)}}}
+		reconnectSource(w, r, "refusing", sources, adminAccess)
+		return w.Code
+	}
+	if code := reconnect("192.0.2.1:1234"); code != http.StatusForbidden {
+		t.Errorf("Expected reconnecting from outside -admin-allow to be forbidden, got %d", code)
+	}
+	if code := reconnect("127.0.0.1:1234"); code != http.StatusNoContent {
+		t.Fatalf("Expected reconnecting to succeed, got %d", code)
+	}
+	// without the reconnect the next attempt would be after five seconds
+	select {
+	case m := <-messages:
+		if mmsi, _ := m.MMSI(); mmsi != 273316960 {
+			t.Errorf("Expected a message from 273316960, got %d", mmsi)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Timed out waiting for the source to reconnect")
+	}
+	status := sources.Status()
+	if len(status) != 1 || status[0].State != "running" || status[0].Restarts != 1 {
+		t.Errorf("Expected the source to be running after one restart, got %+v", status)
+	}
+
+	if err = sources.Stop("refusing"); err != nil {
+		t.Fatal(err)
+	}
+	if status = sources.Status(); status[0].State != "stopped" {
+		t.Errorf("Expected the source to be stopped, got %+v", status)
+	}
+	if err = sources.Start("unknown"); err != errNoSuchSource {
+		t.Errorf("Expected an unknown source to be rejected, got %v", err)
+	}
+}
+
+func TestReloadSources(t *testing.T) {
+	sources := NewSourceManager(nil, 200, 4096, nil)
+	started := make(chan string, 10)
+	stopped := make(chan string, 10)
+	sources.read = func(s Source, stop <-chan struct{}) {
+		started <- s.Name + " " + s.URL
+		<-stop
+		stopped <- s.Name + " " + s.URL
+	}
+	parse := func(args ...string) []Source {
+		list := []Source{}
+		for _, arg := range args {
+			s, err := parseSource(arg, defaultSourceTimeout)
+			if err != nil {
+				t.Fatal(err)
+			}
+			list = append(list, s)
+		}
+		return list
+	}
+	expect := func(events chan string, what string, want ...string) {
+		got := []string{}
+		for len(events) != 0 || len(got) < len(want) {
+			select {
+			case e := <-events:
+				got = append(got, e)
+			case <-time.After(time.Second):
+				t.Fatalf("Expected %s %v, got %v", what, want, got)
+			}
+		}
+		sort.Strings(got)
+		if strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Errorf("Expected %s %v, got %v", what, want, got)
+		}
+	}
+
+	if err := sources.Add(parse("cli=tcp://cli:1")[0]); err != nil {
+		t.Fatal(err)
+	}
+	expect(started, "started", "cli tcp://cli:1")
+	added, removed, err := sources.Reload(parse("a=tcp://a:1", "b=tcp://b:1", "c=tcp://c:1"))
+	if err != nil || added != 3 || removed != 0 {
+		t.Fatalf("Expected 3 added, got %d, %d, %v", added, removed, err)
+	}
+	expect(started, "started", "a tcp://a:1", "b tcp://b:1", "c tcp://c:1")
+
+	// a is unchanged, b is removed, c is changed and d is new
+	added, removed, err = sources.Reload(parse("a=tcp://a:1", "c=tcp://c:2", "d=tcp://d:1"))
+	if err != nil || added != 2 || removed != 2 {
+		t.Fatalf("Expected 2 added and 2 removed, got %d, %d, %v", added, removed, err)
+	}
+	expect(stopped, "stopped", "b tcp://b:1", "c tcp://c:1")
+	expect(started, "started", "c tcp://c:2", "d tcp://d:1")
+
+	invalid := [][]Source{
+		parse("a=tcp://a:1", "a=tcp://a:2"), // duplicate
+		parse("cli=tcp://cli:2"),            // added with Add
+		parse("file=file:///dev/null"),
+	}
+	for _, desired := range invalid {
+		if _, _, err := sources.Reload(desired); err == nil {
+			t.Errorf("Expected %v to be rejected", desired)
+		}
+	}
+	expect(stopped, "stopped")
+	expect(started, "started")
+	names := []string{}
+	for _, s := range sources.Status() {
+		names = append(names, s.Name)
+	}
+	if strings.Join(names, ",") != "a,c,cli,d" {
+		t.Errorf("Expected the sources to be unchanged, got %v", names)
+	}
+}
+
+func TestLoadSourcesFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sources")
+	content := "# comment\n\n  a=tcp://a:1  \nb:10s,strict=tcp://b:1\n"
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	list, err := loadSourcesFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].Name != "a" || list[0].Timeout != defaultSourceTimeout ||
+		list[1].Name != "b" || list[1].Timeout != 10*time.Second || !list[1].Strict {
+		t.Errorf("Unexpected sources %+v", list)
+	}
+
+	if err = os.WriteFile(path, []byte("a=tcp://a:1\nb,unknown=tcp://b:1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = loadSourcesFile(path); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("Expected an error on line 2, got %v", err)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/tormol/AIS/nmeais"
+)
+
+const (
+	// throughputBucket is the duration counted by each bucket of Throughput.
+	throughputBucket = time.Minute
+	// throughputBuckets is how many buckets Throughput remembers, one day.
+	throughputBuckets = 24 * 60
+)
+
+// typeCounts is the number of messages of each type, indexed by
+// nmeais.Message.KnownType().
+type typeCounts [nmeais.MaxType + 1]uint32
+
+// throughputCounts is what SourceMerger counted during one minute.
+type throughputCounts struct {
+	forwarded  typeCounts
+	duplicates typeCounts
+}
+
+// Throughput counts the messages SourceMerger forwards and drops as
+// duplicates, per type and minute for the last day, and since it started.
+// It is synchronized internally.
+type Throughput struct {
+	lock              sync.Mutex
+	buckets           [throughputBuckets]throughputCounts // a ring, indexed by minutes since the epoch
+	newest            int64                               // the minute of the newest bucket
+	allTimeForwarded  [nmeais.MaxType + 1]uint64
+	allTimeDuplicates [nmeais.MaxType + 1]uint64
+	now               func() time.Time // replaced by tests
+}
+
+// NewThroughput creates an empty Throughput.
+func NewThroughput() *Throughput {
+	tp := &Throughput{now: time.Now}
+	tp.newest = tp.minute(tp.now())
+	return tp
+}
+
+// minute returns the number of whole throughputBuckets since the epoch.
+func (tp *Throughput) minute(t time.Time) int64 {
+	return t.Unix() / int64(throughputBucket/time.Second)
+}
+
+// advance clears the buckets of the minutes that have passed since the newest
+// bucket. tp.lock must be held.
+func (tp *Throughput) advance(now time.Time) {
+	current := tp.minute(now)
+	if current <= tp.newest {
+		return
+	}
+	passed := current - tp.newest
+	if passed > throughputBuckets {
+		passed = throughputBuckets
+	}
+	for m := current - passed + 1; m <= current; m++ {
+		tp.buckets[m%throughputBuckets] = throughputCounts{}
+	}
+	tp.newest = current
+}
+
+// Add counts a message of type t, which must be from KnownType().
+func (tp *Throughput) Add(t uint8, duplicate bool) {
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+	tp.advance(tp.now())
+	b := &tp.buckets[tp.newest%throughputBuckets]
+	if duplicate {
+		b.duplicates[t]++
+		tp.allTimeDuplicates[t]++
+	} else {
+		b.forwarded[t]++
+		tp.allTimeForwarded[t]++
+	}
+}
+
+// AllTime returns the number of messages of each type since tp was created.
+func (tp *Throughput) AllTime() (forwarded, duplicates [nmeais.MaxType + 1]uint64) {
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+	return tp.allTimeForwarded, tp.allTimeDuplicates
+}
+
+// ThroughputSeries is the message rate over a window, as what was counted in
+// each interval of resolution, oldest first.
+// The last interval includes the current, incomplete minute.
+type ThroughputSeries struct {
+	Start      time.Time `json:"start"` // of the first interval
+	Resolution int       `json:"resolution_seconds"`
+	Forwarded  []uint64  `json:"forwarded"`
+	Duplicates []uint64  `json:"duplicates"`
+	// per message type, only types seen in the window are included
+	ByType map[uint8]*ThroughputTypeSeries `json:"by_type"`
+}
+
+// ThroughputTypeSeries is ThroughputSeries for one message type.
+type ThroughputTypeSeries struct {
+	Forwarded  []uint64 `json:"forwarded"`
+	Duplicates []uint64 `json:"duplicates"`
+}
+
+// Series sums the buckets of the last window into intervals of resolution.
+// Both must be whole minutes, window cannot be more than a day and must be
+// a multiple of resolution.
+// A nil Throughput returns zeroes.
+func (tp *Throughput) Series(window, resolution time.Duration) ThroughputSeries {
+	points := int(window / resolution)
+	perPoint := int64(resolution / throughputBucket)
+	s := ThroughputSeries{
+		Resolution: int(resolution / time.Second),
+		Forwarded:  make([]uint64, points),
+		Duplicates: make([]uint64, points),
+		ByType:     make(map[uint8]*ThroughputTypeSeries),
+	}
+	if tp == nil {
+		now := time.Now().Truncate(throughputBucket)
+		s.Start = now.Add(throughputBucket - window)
+		return s
+	}
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+	tp.advance(tp.now())
+	first := tp.newest - int64(points)*perPoint + 1
+	s.Start = time.Unix(first*int64(throughputBucket/time.Second), 0)
+	for m := first; m <= tp.newest; m++ {
+		i := int((m - first) / perPoint)
+		b := &tp.buckets[m%throughputBuckets]
+		for t := range b.forwarded {
+			if b.forwarded[t] == 0 && b.duplicates[t] == 0 {
+				continue
+			}
+			ts := s.ByType[uint8(t)]
+			if ts == nil {
+				ts = &ThroughputTypeSeries{make([]uint64, points), make([]uint64, points)}
+				s.ByType[uint8(t)] = ts
+			}
+			ts.Forwarded[i] += uint64(b.forwarded[t])
+			ts.Duplicates[i] += uint64(b.duplicates[t])
+			s.Forwarded[i] += uint64(b.forwarded[t])
+			s.Duplicates[i] += uint64(b.duplicates[t])
+		}
+	}
+	return s
+}
+
+// parseMinutes parses a duration parameter that must be a positive number of
+// whole minutes, or returns def if it's empty.
+func parseMinutes(param string, def time.Duration) (time.Duration, bool) {
+	if param == "" {
+		return def, true
+	}
+	d, err := time.ParseDuration(param)
+	return d, err == nil && d > 0 && d%throughputBucket == 0
+}
+
+// throughputHandler serves the message rate of the last window (default 1h)
+// in intervals of resolution (default 1m).
+func throughputHandler(w http.ResponseWriter, r *http.Request, tp *Throughput) {
+	query := r.URL.Query()
+	window, ok := parseMinutes(query.Get("window"), time.Hour)
+	if !ok || window > throughputBuckets*throughputBucket {
+		writeError(w, r, http.StatusBadRequest, "window must be whole minutes and at most 24h")
+		return
+	}
+	resolution, ok := parseMinutes(query.Get("resolution"), throughputBucket)
+	if !ok || window%resolution != 0 {
+		writeError(w, r, http.StatusBadRequest, "resolution must be whole minutes and divide window")
+		return
+	}
+	writeJSON(w, r, tp.Series(window, resolution), "throughput")
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestThroughputBuckets(t *testing.T) {
+	now := time.Date(2017, 3, 1, 12, 0, 30, 0, time.UTC)
+	tp := &Throughput{now: func() time.Time { return now }}
+	tp.newest = tp.minute(now)
+	// minute i gets i forwarded type 1 messages and one duplicate,
+	// and every third minute a type 5
+	for i := 0; i < 12; i++ {
+		for j := 0; j < i; j++ {
+			tp.Add(1, false)
+		}
+		tp.Add(1, true)
+		if i%3 == 0 {
+			tp.Add(5, false)
+		}
+		now = now.Add(time.Minute)
+	}
+	now = now.Add(-time.Minute) // in the last minute
+
+	s := tp.Series(10*time.Minute, time.Minute)
+	if expected := time.Date(2017, 3, 1, 12, 2, 0, 0, time.UTC); !s.Start.Equal(expected) || s.Resolution != 60 {
+		t.Errorf("Expected one minute points from %s, got %s and %d", expected, s.Start, s.Resolution)
+	}
+	for i := range s.Forwarded {
+		minute := i + 2
+		expected := uint64(minute)
+		if minute%3 == 0 {
+			expected++
+		}
+		if s.Forwarded[i] != expected || s.Duplicates[i] != 1 || s.ByType[1].Forwarded[i] != uint64(minute) {
+			t.Errorf("Expected %d forwarded and 1 duplicate in minute %d, got %d and %d",
+				expected, minute, s.Forwarded[i], s.Duplicates[i])
+		}
+	}
+	if len(s.ByType) != 2 || s.ByType[5].Forwarded[1] != 1 || s.ByType[5].Forwarded[2] != 0 {
+		t.Errorf("Expected type 5 every third minute, got %+v", s.ByType)
+	}
+
+	s = tp.Series(10*time.Minute, 5*time.Minute)
+	// minutes 2 to 6 and 7 to 11, plus the type 5s in 3, 6 and 9
+	if len(s.Forwarded) != 2 || s.Forwarded[0] != 2+3+4+5+6+2 || s.Forwarded[1] != 7+8+9+10+11+1 ||
+		s.Duplicates[0] != 5 || s.Duplicates[1] != 5 {
+		t.Errorf("Expected two sums of five minutes, got %v and %v", s.Forwarded, s.Duplicates)
+	}
+
+	forwarded, duplicates := tp.AllTime()
+	if forwarded[1] != 66 || forwarded[5] != 4 || duplicates[1] != 12 {
+		t.Errorf("Expected all time counts of 66, 4 and 12, got %d, %d and %d",
+			forwarded[1], forwarded[5], duplicates[1])
+	}
+
+	// buckets are cleared when the clock comes around
+	now = now.Add(23*time.Hour + 55*time.Minute)
+	tp.Add(1, false)
+	s = tp.Series(24*time.Hour, time.Hour)
+	if len(s.Forwarded) != 24 || s.Forwarded[0] != 7+8+9+10+11+1 || s.Forwarded[23] != 1 {
+		t.Errorf("Expected minutes 7 to 11 in the first hour and one in the last, got %v", s.Forwarded)
+	}
+	now = now.Add(48 * time.Hour)
+	if s = tp.Series(24*time.Hour, 24*time.Hour); s.Forwarded[0] != 0 || len(s.ByType) != 0 {
+		t.Errorf("Expected nothing after two idle days, got %v", s.Forwarded)
+	}
+}
+
+func TestThroughputParameters(t *testing.T) {
+	for query, status := range map[string]int{
+		"":                          http.StatusOK,
+		"?window=6h&resolution=5m":  http.StatusOK,
+		"?window=24h&resolution=1h": http.StatusOK,
+		"?window=25h":               http.StatusBadRequest,
+		"?window=90s":               http.StatusBadRequest,
+		"?window=1h&resolution=7m":  http.StatusBadRequest,
+		"?window=-1h":               http.StatusBadRequest,
+		"?resolution=x":             http.StatusBadRequest,
+	} {
+		w := httptest.NewRecorder()
+		throughputHandler(w, httptest.NewRequest("GET", "/api/v1/stats/throughput"+query, nil), NewThroughput())
+		if w.Code != status {
+			t.Errorf("%q: expected %d, got %d %s", query, status, w.Code, w.Body.String())
+		}
+	}
+
+	w := httptest.NewRecorder()
+	throughputHandler(w, httptest.NewRequest("GET", "/api/v1/stats/throughput?window=6h&resolution=5m", nil), nil)
+	var s ThroughputSeries
+	if err := json.Unmarshal(w.Body.Bytes(), &s); err != nil {
+		t.Fatalf("Invalid JSON %q: %s", w.Body.String(), err.Error())
+	}
+	if len(s.Forwarded) != 72 || len(s.Duplicates) != 72 || s.Resolution != 300 {
+		t.Errorf("Expected 72 points of 5 minutes, got %s", w.Body.String())
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tormol/AIS/nmeais"
+)
+
+const (
+	// maxTraceRecords bounds the memory used by a trace.
+	// Records after that are counted but not kept.
+	maxTraceRecords = 1000
+	// maxTraceDuration prevents a forgotten trace from slowing the server down forever.
+	maxTraceDuration = time.Hour
+)
+
+// TraceRecord is what one stage of the pipeline did with a message.
+type TraceRecord struct {
+	At       time.Time `json:"at"`
+	Stage    string    `json:"stage"`
+	Decision string    `json:"decision"`
+	Source   string    `json:"source"`
+	Details  string    `json:"details,omitempty"`
+}
+
+// Tracer records what happens to the messages from one ship as they go
+// through the pipeline, which is easier than correlating log messages when
+// debugging why a ship's data looks wrong.
+// Only one trace can be active at a time.
+// Stages should check Active() before calling Record(), which is all the
+// overhead there is when no trace is active.
+type Tracer struct {
+	active  int32 // atomic, non-zero while a trace might be active
+	lock    sync.Mutex
+	mmsi    uint32
+	source  string // empty means all sources
+	until   time.Time
+	records []TraceRecord
+	dropped int
+}
+
+// Trace is the tracer used by all stages.
+var Trace = &Tracer{}
+
+// Start replaces any previous trace with one for messages from mmsi
+// that lasts for duration (at most maxTraceDuration).
+// If source is not empty, only messages from that source are traced.
+func (t *Tracer) Start(mmsi uint32, source string, duration time.Duration) {
+	if duration > maxTraceDuration {
+		duration = maxTraceDuration
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.mmsi = mmsi
+	t.source = source
+	t.until = time.Now().Add(duration)
+	t.records = nil
+	t.dropped = 0
+	atomic.StoreInt32(&t.active, 1)
+}
+
+// Stop ends the current trace, but keeps its records.
+func (t *Tracer) Stop() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.until = time.Now()
+	atomic.StoreInt32(&t.active, 0)
+}
+
+// Active returns false if no trace is active, and true if one might be.
+func (t *Tracer) Active() bool {
+	return atomic.LoadInt32(&t.active) != 0
+}
+
+// Record stores what a stage did with a message, if the message is traced.
+func (t *Tracer) Record(m *nmeais.Message, stage, decision, details string, args ...interface{}) {
+	now := time.Now()
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if now.After(t.until) {
+		atomic.StoreInt32(&t.active, 0)
+		return
+	}
+	if mmsi, _ := m.MMSI(); (t.source != "" && m.SourceName != t.source) || mmsi != t.mmsi {
+		return
+	}
+	if len(t.records) >= maxTraceRecords {
+		t.dropped++
+		return
+	}
+	if len(args) != 0 {
+		details = fmt.Sprintf(details, args...)
+	}
+	t.records = append(t.records, TraceRecord{now, stage, decision, m.SourceName, details})
+}
+
+// Records returns a copy of the records of the current or previous trace.
+func (t *Tracer) Records() []TraceRecord {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return append([]TraceRecord{}, t.records...)
+}
+
+// JSON describes the current or previous trace and returns its records.
+func (t *Tracer) JSON() ([]byte, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	records := t.records
+	if records == nil {
+		records = []TraceRecord{}
+	}
+	return json.Marshal(struct {
+		MMSI    uint32        `json:"mmsi"`
+		Source  string        `json:"source,omitempty"`
+		Active  bool          `json:"active"`
+		Until   time.Time     `json:"until"`
+		Dropped int           `json:"dropped"`
+		Records []TraceRecord `json:"records"`
+	}{t.mmsi, t.source, time.Now().Before(t.until), t.until, t.dropped, records})
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/tormol/AIS/forwarder"
+	l "github.com/tormol/AIS/logger"
+)
+
+// replay sends sentences through the whole pipeline from packet parsing to
+// the archive, and returns when everything has been saved.
+func replay(a *Archive, packet string) {
+	logger := l.NewLogger(os.Stderr, l.Debug)
+	toArchive := a.StartSaving(1, 0) // so that tests know the order ships are saved in
+	toForwarder := make(chan forwarder.Packet, 100)
+	sm := NewSourceMerger(logger, toForwarder, toArchive.Route, a.KnownPosition)
+	pp := &PacketParser{async: make(chan sendSentence, 100), SourceName: "test", logger: logger}
+	pp.Accept([]byte(packet), time.Now())
+	close(pp.async)
+	decodeSentences(pp, sm.Accept)
+	sm.Close()
+	toArchive.Close()
+}
+
+func TestTrace(t *testing.T) {
+	defer Trace.Stop()
+	fixture := "!BSVDM,1,1,,A,14S:Eb001ePRmHBTAAFnrmV60PRk,0*1F\r\n" + // 305305000
+		"!BSVDM,1,1,,B,144atH00000Lf9nSffVf49TP00S9,0*1D\r\n" + // 273316960
+		"!BSVDM,1,1,,B,144atH00000Lf9nSffVf49TP00S9,0*1D\r\n" // duplicate
+
+	a := NewArchive(10, 0, 0, 0, 0, 0, 0)
+	Trace.Start(273316960, "", time.Minute)
+	replay(a, fixture)
+	expected := []struct{ stage, decision string }{
+		{"assembler", "complete"},
+		{"merger", "forwarded"},
+		{"assembler", "complete"},
+		{"merger", "duplicate"},
+		{"archive", "position saved"},
+	}
+	// the archive runs concurrently with the other stages
+	records := Trace.Records()
+	got := map[string][]string{}
+	for _, r := range records {
+		got[r.Stage] = append(got[r.Stage], r.Decision)
+		if r.Source != "test" {
+			t.Errorf("Expected source test, got %q", r.Source)
+		}
+	}
+	if len(records) != len(expected) {
+		t.Fatalf("Expected %d records, got %v", len(expected), records)
+	}
+	for _, e := range expected {
+		if len(got[e.stage]) == 0 || got[e.stage][0] != e.decision {
+			t.Fatalf("Expected %s to be %s, got %v", e.stage, e.decision, records)
+		}
+		got[e.stage] = got[e.stage][1:]
+	}
+	for i := 1; i < len(records); i++ {
+		if records[i].At.Before(records[i-1].At) {
+			t.Errorf("Expected records to be in order: %v", records)
+		}
+	}
+	if records[0].Stage != "assembler" || records[1].Stage != "merger" {
+		t.Errorf("Expected the assembler to be before the merger: %v", records)
+	}
+
+	Trace.Start(273316960, "other", time.Minute)
+	replay(a, fixture)
+	if records := Trace.Records(); len(records) != 0 {
+		t.Errorf("Expected messages from other sources to not be traced, got %v", records)
+	}
+
+	Trace.Start(273316960, "", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	replay(a, fixture)
+	if records := Trace.Records(); len(records) != 0 {
+		t.Errorf("Expected no records after the trace expired, got %v", records)
+	}
+	if Trace.Active() {
+		t.Error("Expected the trace to be inactive after expiring")
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/xml"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tormol/AIS/geo"
+	"github.com/tormol/AIS/storage"
+)
+
+// Formats the tracklog of a ship can be served in by with_mmsi.
+const (
+	formatGeoJSON = "geojson"
+	formatCSV     = "csv"
+	formatKML     = "kml"
+)
+
+const kmlContentType = "application/vnd.google-earth.kml+xml"
+
+// trackFormat decides which format to serve with_mmsi in, from the format
+// parameter or else the Accept header.
+// Returns false if the format parameter is invalid.
+func trackFormat(r *http.Request) (string, bool) {
+	switch format := r.URL.Query().Get("format"); format {
+	case formatGeoJSON, formatCSV, formatKML:
+		return format, true
+	case "":
+	default:
+		return "", false
+	}
+	// The first supported type is used, quality values are ignored.
+	for _, accept := range r.Header["Accept"] {
+		for _, mediaType := range strings.Split(accept, ",") {
+			mediaType, _, err := mime.ParseMediaType(mediaType)
+			if err != nil {
+				continue
+			}
+			switch mediaType {
+			case "text/csv":
+				return formatCSV, true
+			case kmlContentType:
+				return formatKML, true
+			case "application/json", "application/geo+json":
+				return formatGeoJSON, true
+			}
+		}
+	}
+	return formatGeoJSON, true
+}
+
+// writeTrackCSV writes the tracklog as CSV with the columns
+// time, lat, lon, speed and course. Unknown speed and course are empty.
+func writeTrackCSV(w io.Writer, track []storage.TrackPoint, precision int) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"time", "lat", "lon", "speed", "course"})
+	formatFloat32 := func(f float32) string {
+		if math.IsNaN(float64(f)) {
+			return ""
+		}
+		return strconv.FormatFloat(geo.RoundTo(float64(f), precision), 'f', -1, 32)
+	}
+	for _, tp := range track {
+		pos := tp.Pos.Rounded(precision)
+		cw.Write([]string{
+			tp.At.UTC().Format(time.RFC3339),
+			strconv.FormatFloat(pos.Lat, 'f', -1, 64),
+			strconv.FormatFloat(pos.Long, 'f', -1, 64),
+			formatFloat32(tp.Speed),
+			formatFloat32(tp.Course),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// kmlDocument is the subset of KML used for tracklogs.
+type kmlDocument struct {
+	XMLName   xml.Name     `xml:"http://www.opengis.net/kml/2.2 kml"`
+	Placemark kmlPlacemark `xml:"Document>Placemark"`
+}
+
+type kmlPlacemark struct {
+	Name          string `xml:"name"`
+	MultiGeometry struct {
+		LineString *kmlCoordinates `xml:"LineString,omitempty"`
+		Point      *kmlCoordinates `xml:"Point,omitempty"`
+	}
+}
+
+type kmlCoordinates struct {
+	// longitude,latitude pairs separated by space
+	Coordinates string `xml:"coordinates"`
+}
+
+// kmlCoordinatesOf formats points in the order KML wants.
+func kmlCoordinatesOf(points []geo.Point, precision int) *kmlCoordinates {
+	pairs := make([]string, len(points))
+	for i, p := range points {
+		p = p.Rounded(precision)
+		pairs[i] = strconv.FormatFloat(p.Long, 'f', -1, 64) + "," + strconv.FormatFloat(p.Lat, 'f', -1, 64)
+	}
+	return &kmlCoordinates{strings.Join(pairs, " ")}
+}
+
+// trackKML creates a KML document with a placemark named after the ship,
+// containing the tracklog as a LineString and the current position as a Point.
+// The LineString is left out if there are less than two positions,
+// and the Point if the position is not known.
+func trackKML(mmsi uint32, info storage.ShipInfo, pos storage.ShipPos,
+	track []storage.TrackPoint, precision int) ([]byte, error) {
+	doc := kmlDocument{}
+	doc.Placemark.Name = info.ShipName
+	if doc.Placemark.Name == "" {
+		doc.Placemark.Name = strconv.FormatUint(uint64(mmsi), 10)
+	}
+	if len(track) >= 2 {
+		points := make([]geo.Point, len(track))
+		for i := range track {
+			points[i] = track[i].Pos
+		}
+		doc.Placemark.MultiGeometry.LineString = kmlCoordinatesOf(points, precision)
+	}
+	if !math.IsNaN(pos.Pos.Lat) {
+		doc.Placemark.MultiGeometry.Point = kmlCoordinatesOf([]geo.Point{pos.Pos}, precision)
+	}
+	kml, err := xml.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), kml...), nil
+}
@@ -0,0 +1,201 @@
+package main
+
+// A minimal server side of the WebSocket protocol (RFC 6455),
+// enough to push text messages to browsers.
+// Clients have nothing to say except ping and close, so fragmented and long
+// messages from them are not supported.
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Appended to the client's key before hashing it, defined by the RFC.
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Frame opcodes
+const (
+	wsText  = 0x1
+	wsClose = 0x8
+	wsPing  = 0x9
+	wsPong  = 0xa
+)
+
+// Close status codes
+const (
+	wsNormalClosure   = 1000
+	wsProtocolError   = 1002
+	wsMessageTooLarge = 1009
+)
+
+const (
+	wsMaxIncoming  = 125 // the maximum length of control frames
+	wsWriteTimeout = 10 * time.Second
+)
+
+// websocket is an upgraded connection.
+type websocket struct {
+	conn      net.Conn
+	rw        *bufio.ReadWriter
+	writeLock sync.Mutex
+	closeSent bool          // protected by writeLock
+	closed    chan struct{} // closed when the client closes or the connection fails
+}
+
+// headerHasToken checks whether a comma-separated header contains a token,
+// ignoring case.
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, header := range h.Values(name) {
+		for _, t := range strings.Split(header, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// upgradeWebsocket performs the opening handshake.
+// On failure an error response has been written, or the connection is closed.
+func upgradeWebsocket(w http.ResponseWriter, r *http.Request) (*websocket, bool) {
+	if r.Method != "GET" {
+		writeError(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+		return nil, false
+	}
+	if !headerHasToken(r.Header, "Connection", "upgrade") ||
+		!headerHasToken(r.Header, "Upgrade", "websocket") {
+		w.Header().Set("Upgrade", "websocket")
+		writeError(w, r, http.StatusUpgradeRequired, "WebSocket required")
+		return nil, false
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Header.Get("Sec-WebSocket-Version") != "13" || key == "" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		writeError(w, r, http.StatusBadRequest, "Unsupported WebSocket version")
+		return nil, false
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		Log.Error("Cannot take over the connection of %s", r.URL.Path)
+		writeError(w, r, http.StatusInternalServerError, "Cannot upgrade the connection")
+		return nil, false
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		Log.Warning("Cannot take over the connection from %s: %s", r.RemoteAddr, err.Error())
+		return nil, false
+	}
+	accept := sha1.Sum([]byte(key + websocketGUID))
+	ws := &websocket{conn: conn, rw: rw, closed: make(chan struct{})}
+	ws.writeLock.Lock()
+	conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(accept[:]) + "\r\n\r\n")
+	err = rw.Flush()
+	ws.writeLock.Unlock()
+	if err != nil {
+		Log.Info("IO error upgrading the connection from %s: %s", r.RemoteAddr, err.Error())
+		conn.Close()
+		return nil, false
+	}
+	go ws.readFrames()
+	return ws, true
+}
+
+// writeFrame sends an unmasked and unfragmented frame.
+func (ws *websocket) writeFrame(opcode byte, payload []byte) error {
+	header := [10]byte{0x80 | opcode} // FIN
+	headerLen := 2
+	switch {
+	case len(payload) < 126:
+		header[1] = byte(len(payload))
+	case len(payload) <= 0xffff:
+		header[1] = 126
+		binary.BigEndian.PutUint16(header[2:], uint16(len(payload)))
+		headerLen = 4
+	default:
+		header[1] = 127
+		binary.BigEndian.PutUint64(header[2:], uint64(len(payload)))
+		headerLen = 10
+	}
+	ws.writeLock.Lock()
+	defer ws.writeLock.Unlock()
+	if ws.closeSent {
+		return io.ErrClosedPipe
+	}
+	if opcode == wsClose {
+		ws.closeSent = true
+	}
+	ws.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	ws.rw.Write(header[:headerLen])
+	ws.rw.Write(payload)
+	return ws.rw.Flush()
+}
+
+// WriteText sends a text message, which must be valid UTF-8.
+func (ws *websocket) WriteText(message []byte) error {
+	return ws.writeFrame(wsText, message)
+}
+
+// closeFrame sends a close frame with a status code, if one hasn't been sent already.
+func (ws *websocket) closeFrame(status uint16) {
+	var payload [2]byte
+	binary.BigEndian.PutUint16(payload[:], status)
+	ws.writeFrame(wsClose, payload[:])
+}
+
+// Close tells the client the connection is closing, and closes it.
+func (ws *websocket) Close() {
+	ws.closeFrame(wsNormalClosure)
+	ws.conn.Close()
+}
+
+// readFrames answers pings and close frames until the connection is closed,
+// and ignores everything else.
+func (ws *websocket) readFrames() {
+	defer close(ws.closed)
+	for {
+		var head [2]byte
+		if _, err := io.ReadFull(ws.rw, head[:]); err != nil {
+			return
+		}
+		opcode := head[0] & 0x0f
+		length := int(head[1] & 0x7f)
+		if head[1]&0x80 == 0 { // clients must mask their frames
+			ws.closeFrame(wsProtocolError)
+			return
+		}
+		if length > wsMaxIncoming {
+			ws.closeFrame(wsMessageTooLarge)
+			return
+		}
+		var mask [4]byte
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(ws.rw, mask[:]); err != nil {
+			return
+		}
+		if _, err := io.ReadFull(ws.rw, payload); err != nil {
+			return
+		}
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+		switch opcode {
+		case wsPing:
+			ws.writeFrame(wsPong, payload)
+		case wsClose:
+			ws.writeFrame(wsClose, payload) // echo the status code
+			return
+		}
+	}
+}
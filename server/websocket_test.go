@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readTestFrame reads an unmasked frame from the server.
+func readTestFrame(t *testing.T, br *bufio.Reader) (byte, []byte) {
+	var head [2]byte
+	if _, err := io.ReadFull(br, head[:]); err != nil {
+		t.Fatal(err)
+	}
+	if head[1]&0x80 != 0 {
+		t.Fatal("Server frames must not be masked")
+	}
+	length := uint64(head[1])
+	switch length {
+	case 126:
+		var ext [2]byte
+		io.ReadFull(br, ext[:])
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		io.ReadFull(br, ext[:])
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(br, payload); err != nil {
+		t.Fatal(err)
+	}
+	return head[0] & 0x0f, payload
+}
+
+// writeTestFrame sends a masked frame like a browser would.
+func writeTestFrame(t *testing.T, conn net.Conn, opcode byte, payload []byte) {
+	mask := []byte{1, 2, 3, 4}
+	frame := append([]byte{0x80 | opcode, 0x80 | byte(len(payload))}, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	if _, err := conn.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStream(t *testing.T) {
+	a := NewArchive(10, 0, 0, 0, 0, 0, 0)
+	saveSentence(t, a, "!BSVDM,1,1,,A,14S:Eb001ePRmHBTAAFnrmV60PRk,0*1F\r\n") // 305305000 at 63.39,7.61
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stream(w, r, bboxParams(r.URL.RawQuery), a)
+	}))
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("GET /api/v1/stream?bbox=6,62,7,63 HTTP/1.1\r\n" +
+		"Host: localhost\r\n" +
+		"Connection: keep-alive, Upgrade\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Sec-WebSocket-Version: 13\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n"))
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the example from RFC 6455
+	if resp.StatusCode != http.StatusSwitchingProtocols ||
+		resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("Expected 101 with the correct accept key, got %d %q",
+			resp.StatusCode, resp.Header.Get("Sec-WebSocket-Accept"))
+	}
+
+	opcode, snapshot := readTestFrame(t, br)
+	if opcode != wsText || !strings.HasPrefix(string(snapshot), `{"type":"FeatureCollection"`) ||
+		strings.Contains(string(snapshot), "305305000") {
+		t.Fatalf("Expected an empty FeatureCollection, got %d %s", opcode, snapshot)
+	}
+
+	saveSentence(t, a, "!BSVDM,1,1,,A,14S:Eb001ePRmHBTAAFnrmV60PRk,0*1F\r\n")
+	saveSentence(t, a, "!BSVDM,1,1,,B,144atH00000Lf9nSffVf49TP00S9,0*1D\r\n") // 273316960 at 62.44,6.27
+	opcode, update := readTestFrame(t, br)
+	if opcode != wsText || !strings.HasPrefix(string(update), `{"type":"Feature"`) ||
+		!strings.Contains(string(update), "273316960") {
+		t.Fatalf("Expected the ship within the area, got %d %s", opcode, update)
+	}
+
+	writeTestFrame(t, conn, wsPing, []byte("hello"))
+	if opcode, payload := readTestFrame(t, br); opcode != wsPong || string(payload) != "hello" {
+		t.Errorf("Expected pong with the same payload, got %d %q", opcode, payload)
+	}
+	writeTestFrame(t, conn, wsClose, []byte{0x03, 0xe8})
+	if opcode, payload := readTestFrame(t, br); opcode != wsClose || string(payload) != "\x03\xe8" {
+		t.Errorf("Expected the close frame to be echoed, got %d %q", opcode, payload)
+	}
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Errorf("Expected the server to close the connection, got %v", err)
+	}
+}
+
+func TestStreamRequiresUpgrade(t *testing.T) {
+	a := NewArchive(10, 0, 0, 0, 0, 0, 0)
+	request := func(query string) int {
+		r := httptest.NewRequest("GET", "/api/v1/stream?"+query, nil)
+		w := httptest.NewRecorder()
+		stream(w, r, bboxParams(r.URL.RawQuery), a)
+		return w.Code
+	}
+	if code := request("bbox=6,62,7,63"); code != http.StatusUpgradeRequired {
+		t.Errorf("Expected 426 without upgrade headers, got %d", code)
+	}
+	if code := request("bbox=6,63,7,62"); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid bbox, got %d", code)
+	}
+}
@@ -0,0 +1,78 @@
+package storage
+
+import (
+	"strconv"
+	"time"
+)
+
+// AtoNType is the kind of aid to navigation, from type 21 messages.
+type AtoNType uint8
+
+var atonTypeNames = [32]string{
+	"Not specified",
+	"Reference point",
+	"RACON",
+	"Fixed structure off shore",
+	"Reserved",
+	"Light, without sectors",
+	"Light, with sectors",
+	"Leading light front",
+	"Leading light rear",
+	"Beacon, cardinal N",
+	"Beacon, cardinal E",
+	"Beacon, cardinal S",
+	"Beacon, cardinal W",
+	"Beacon, port hand",
+	"Beacon, starboard hand",
+	"Beacon, preferred channel port hand",
+	"Beacon, preferred channel starboard hand",
+	"Beacon, isolated danger",
+	"Beacon, safe water",
+	"Beacon, special mark",
+	"Cardinal mark N",
+	"Cardinal mark E",
+	"Cardinal mark S",
+	"Cardinal mark W",
+	"Port hand mark",
+	"Starboard hand mark",
+	"Preferred channel port hand",
+	"Preferred channel starboard hand",
+	"Isolated danger",
+	"Safe water",
+	"Special mark",
+	"Light vessel / LANBY / rigs",
+}
+
+// String returns the kind of aid as a string, E.g. "Cardinal mark N".
+func (t AtoNType) String() string {
+	if int(t) < len(atonTypeNames) {
+		return atonTypeNames[t]
+	}
+	return "AtoNType(" + strconv.Itoa(int(t)) + ")"
+}
+
+// AtoNInfo is what's known only about aids to navigation.
+// Ships have nil instead.
+type AtoNInfo struct {
+	Type        AtoNType
+	OffPosition bool // A floating aid is not at its charted position
+	Virtual     bool // The aid doesn't physically exist
+}
+
+// atonItemType replaces the kind of MMSI as item_type for aids to navigation,
+// because their MMSIs don't always follow the 99MIDXXXX scheme.
+var atonItemType = MmsiAtoN.String()
+
+// UpdateAtoN updates the position, name and dimensions of an aid to
+// navigation, and marks it as one.
+// See UpdateDynamic and UpdateStatic for the other parameters.
+func (db *ShipDB) UpdateAtoN(mmsi uint32, source string, received time.Time,
+	pos ShipPos, info ShipInfo, aton AtoNInfo) {
+	db.UpdateDynamic(mmsi, source, pos)
+	db.UpdateStatic(mmsi, source, received, info)
+	if s := db.get(mmsi); s != nil {
+		s.mu.Lock()
+		s.AtoN = &aton
+		s.mu.Unlock()
+	}
+}
@@ -0,0 +1,70 @@
+package storage
+
+import (
+	"github.com/tormol/AIS/geo"
+	l "github.com/tormol/AIS/logger"
+)
+
+// Properties of a node in the GeoJSON from DebugGeoJSON()
+type rTreeNodeProp struct {
+	Shard   int `json:"shard"`   // always 0 for an RTree
+	Height  int `json:"height"`  // 0 for leaves
+	Entries int `json:"entries"` // children or boats
+}
+
+// DebugGeoJSON returns the minimum bounding rectangles of every node in the
+// tree as a GeoJSON FeatureCollection, parents before their children.
+// Nodes that contain a single position are Points, and those with no width
+// or no height are LineStrings.
+// The boats themselves are not included.
+// Large overlapping rectangles means the tree has degenerated.
+func (rt *RTree) DebugGeoJSON(logger *l.Logger) string {
+	fc := newFeatureCollection(0)
+	rt.snapshot().root.appendLayout(&fc, 0)
+	return fc.encode(logger)
+}
+
+// DebugGeoJSON returns the nodes of all the shards, see RTree.DebugGeoJSON().
+func (st *ShardedRTree) DebugGeoJSON(logger *l.Logger) string {
+	fc := newFeatureCollection(0)
+	for i, rt := range st.shards {
+		rt.snapshot().root.appendLayout(&fc, i)
+	}
+	return fc.encode(logger)
+}
+
+// appendLayout adds a feature for the node and each node below it,
+// unless the node is an empty root.
+func (n *node) appendLayout(fc *FeatureCollection, shard int) {
+	if len(n.entries) == 0 {
+		return
+	}
+	fc.Features = append(fc.Features, Feature{
+		Type:       "Feature",
+		Geometry:   rectangleGeometry(mbrOf(n.entries...)),
+		Properties: rTreeNodeProp{Shard: shard, Height: n.height, Entries: len(n.entries)},
+	})
+	if !n.isLeaf() {
+		for _, e := range n.entries {
+			e.child.appendLayout(fc, shard)
+		}
+	}
+}
+
+// rectangleGeometry returns the outline of a rectangle, or a point or line if
+// it has no area, because such polygons are invalid.
+func rectangleGeometry(r *geo.Rectangle) *Geometry {
+	min, max := r.Min(), r.Max()
+	if min == max {
+		return &Geometry{Coordinates: []geo.Point{min}}
+	} else if min.Lat == max.Lat || min.Long == max.Long {
+		return &Geometry{Coordinates: []geo.Point{min, max}}
+	}
+	return &Geometry{Polygon: true, Coordinates: []geo.Point{
+		min,
+		{Lat: min.Lat, Long: max.Long},
+		max,
+		{Lat: max.Lat, Long: min.Long},
+		min,
+	}}
+}
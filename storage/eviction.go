@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"container/heap"
+	"sync/atomic"
+	"time"
+
+	"github.com/tormol/AIS/geo"
+)
+
+// On a global feed the number of ships grows without bound, and many of them
+// are corrupted MMSIs that are only seen once. EvictOldest keeps the number of
+// ships bounded by removing those that were updated the longest ago.
+// To find them without looking at every ship, ShipDB keeps a heap of ships
+// keyed on when they were last updated, if ShipDB.Evictable is set.
+// Entries are only added when ships are added, so they go stale as ships are
+// updated. A stale entry is pushed back with the current time of its ship
+// when it's popped. As ShipPos.At never decreases, every key is at most the
+// current time of its ship, so an entry that isn't stale when popped is the
+// least recently updated ship.
+
+// lruEntry is a ship as it was when added to or pushed back into the heap.
+type lruEntry struct {
+	mmsi uint32
+	at   time.Time // ShipPos.At, zero for ships without a position
+	seq  uint64    // ships that were updated at the same time are evicted in the order they were added
+}
+
+// updateHeap is a min-heap of ships by when they were last updated,
+// for use with container/heap.
+// It knows where every ship is, so that removed ships can be dropped.
+type updateHeap struct {
+	entries []lruEntry
+	index   map[uint32]int // mmsi -> position in entries
+}
+
+func (h *updateHeap) Len() int { return len(h.entries) }
+func (h *updateHeap) Less(i, j int) bool {
+	if !h.entries[i].at.Equal(h.entries[j].at) {
+		return h.entries[i].at.Before(h.entries[j].at)
+	}
+	return h.entries[i].seq < h.entries[j].seq
+}
+func (h *updateHeap) Swap(i, j int) {
+	h.entries[i], h.entries[j] = h.entries[j], h.entries[i]
+	h.index[h.entries[i].mmsi] = i
+	h.index[h.entries[j].mmsi] = j
+}
+func (h *updateHeap) Push(e interface{}) {
+	entry := e.(lruEntry)
+	h.index[entry.mmsi] = len(h.entries)
+	h.entries = append(h.entries, entry)
+}
+func (h *updateHeap) Pop() interface{} {
+	e := h.entries[len(h.entries)-1]
+	h.entries = h.entries[:len(h.entries)-1]
+	delete(h.index, e.mmsi)
+	return e
+}
+
+// track adds a new ship to the heap, if ships can be evicted.
+// db.rw must be held for writing.
+func (db *ShipDB) track(mmsi uint32) {
+	if !db.Evictable {
+		return
+	}
+	db.lruSeq++
+	heap.Push(&db.lru, lruEntry{mmsi: mmsi, seq: db.lruSeq})
+}
+
+// untrack removes a ship that is being removed from the heap.
+// db.rw must be held for writing.
+func (db *ShipDB) untrack(mmsi uint32) {
+	if i, ok := db.lru.index[mmsi]; ok {
+		heap.Remove(&db.lru, i)
+	}
+}
+
+// EvictedShip is a ship removed by EvictOldest,
+// with the position it might be indexed by.
+type EvictedShip struct {
+	MMSI uint32
+	Pos  geo.Point // NaN if the ship never had a position
+}
+
+// EvictOldest removes the least recently updated ships until at most max
+// remain, and returns them so that they can be removed from any index.
+// Ships that have only sent static information go first.
+// Nothing is removed unless db.Evictable was set before the ships were added.
+func (db *ShipDB) EvictOldest(max int) []EvictedShip {
+	if db.Count() <= max {
+		return nil
+	}
+	removed := []*ship{}
+	db.rw.Lock()
+	for len(db.ships) > max && db.lru.Len() != 0 {
+		e := heap.Pop(&db.lru).(lruEntry)
+		s := db.ships[e.mmsi]
+		if s == nil {
+			continue // already removed
+		}
+		s.mu.Lock() // nothing locks db.rw while holding a ship
+		at := s.At
+		s.mu.Unlock()
+		if at.After(e.at) {
+			e.at = at
+			heap.Push(&db.lru, e)
+			continue
+		}
+		delete(db.ships, e.mmsi)
+		removed = append(removed, s)
+	}
+	db.rw.Unlock()
+	evicted := make([]EvictedShip, len(removed))
+	for i, s := range removed {
+		evicted[i] = EvictedShip{MMSI: s.MMSI, Pos: db.forget(s)}
+	}
+	atomic.AddUint64(&db.evicted, uint64(len(evicted)))
+	return evicted
+}
+
+// Evicted returns the number of ships removed by EvictOldest.
+func (db *ShipDB) Evicted() uint64 {
+	return atomic.LoadUint64(&db.evicted)
+}
@@ -0,0 +1,102 @@
+package storage
+
+import "sync/atomic"
+
+// Items selects which of the ships and aids to navigation found in an area to include.
+type Items uint8
+
+const (
+	AllItems  Items = iota
+	OnlyShips       // everything except aids to navigation
+	OnlyAtoNs
+)
+
+// MatchFilter selects which of the ships and aids to navigation found in an
+// area to include. The zero value includes everything except own ships.
+// Ships where a filtered value is unknown are excluded, unless the code that
+// means not available is included.
+type MatchFilter struct {
+	Items    Items
+	Types    map[ShipType]bool      // nil includes all types
+	Status   map[ShipNavStatus]bool // nil includes all statuses
+	MinSpeed float32                // in knots, zero also includes unknown speed
+	// Include the receiving stations themselves, see ShipDB.MarkOwnShip
+	IncludeOwnShip bool
+}
+
+// filtersShips returns false if the filter includes everything in db.
+func (f *MatchFilter) filtersShips(db *ShipDB) bool {
+	excludesOwnShips := !f.IncludeOwnShip && atomic.LoadUint64(&db.ownShips) != 0
+	return f.Items != AllItems || f.Types != nil || f.Status != nil || f.MinSpeed != 0 || excludesOwnShips ||
+		db.SuppressTypes != nil
+}
+
+// includes checks a ship against the filter. s must be locked.
+func (f *MatchFilter) includes(s *ship) bool {
+	isAtoN := s.AtoN != nil
+	if s.ownShip && !f.IncludeOwnShip {
+		return false
+	} else if f.Items != AllItems && isAtoN != (f.Items == OnlyAtoNs) {
+		return false
+	} else if f.Types != nil && !f.Types[s.VesselType] {
+		return false
+	} else if f.Status != nil && !f.Status[s.NavStatus] {
+		return false
+	}
+	// NaN is never >=
+	return f.MinSpeed == 0 || s.Speed >= f.MinSpeed
+}
+
+// Includes checks a single ship against the filter,
+// and returns false if the ship is unknown or has a type in db.SuppressTypes.
+func (db *ShipDB) Includes(mmsi uint32, filter MatchFilter) bool {
+	s := db.get(mmsi)
+	if s == nil {
+		return false
+	}
+	return db.includes(s, &filter)
+}
+
+// includes checks a ship against the filter and db.SuppressTypes.
+// s must not be locked.
+func (db *ShipDB) includes(s *ship, filter *MatchFilter) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !db.SuppressTypes[s.VesselType] && filter.includes(s)
+}
+
+// Suppressed returns whether the type of a ship is in SuppressTypes.
+// Ships without static information have an unknown type,
+// and are only suppressed if that is.
+func (db *ShipDB) Suppressed(mmsi uint32) bool {
+	if db.SuppressTypes == nil {
+		return false
+	}
+	s := db.get(mmsi)
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return db.SuppressTypes[s.VesselType]
+}
+
+// FilterMatches removes the matches that the filter doesn't include,
+// and those with a type in db.SuppressTypes.
+// Matches that are not in db are kept, as they're skipped later anyway.
+func FilterMatches(matches *[]Match, db *ShipDB, filter MatchFilter) {
+	if !filter.filtersShips(db) {
+		return
+	}
+	kept := (*matches)[:0]
+	for _, m := range *matches {
+		include := true
+		if s := db.get(m.MMSI); s != nil {
+			include = db.includes(s, &filter)
+		}
+		if include {
+			kept = append(kept, m)
+		}
+	}
+	*matches = kept
+}
@@ -0,0 +1,183 @@
+package storage
+
+// Writes search results while the index is searched
+
+import (
+	"encoding/json"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/tormol/AIS/geo"
+	l "github.com/tormol/AIS/logger"
+)
+
+// featureBatch is how many features featureWriter encodes at a time,
+// as encoding each one separately is slower.
+const featureBatch = 256
+
+// featureWriter writes a GeoJSON FeatureCollection a few features at a time,
+// so that big results aren't collected in a slice first.
+// Without truncation the output is the same as encoding a FeatureCollection.
+type featureWriter struct {
+	w       io.Writer
+	batch   []Feature // not encoded yet
+	logger  *l.Logger
+	written int   // number of features, including those in batch
+	started bool  // the first feature has been written
+	err     error // from writing to w, nothing more is written after it
+}
+
+// newFeatureWriter starts a FeatureCollection, which must be finished with close().
+func newFeatureWriter(w io.Writer, logger *l.Logger) *featureWriter {
+	fw := &featureWriter{w: w, logger: logger, batch: make([]Feature, 0, featureBatch)}
+	fw.write([]byte(`{"type":"FeatureCollection","features":[`))
+	return fw
+}
+
+// add writes a feature when there are enough to encode.
+// Returns false if writing has failed.
+func (fw *featureWriter) add(f Feature) bool {
+	fw.batch = append(fw.batch, f)
+	fw.written++
+	if len(fw.batch) == featureBatch {
+		fw.flush()
+	}
+	return fw.err == nil
+}
+
+// flush encodes and writes the features in the batch.
+// If they cannot be encoded, the error is logged and they're left out.
+func (fw *featureWriter) flush() {
+	if len(fw.batch) == 0 {
+		return
+	}
+	b, err := json.Marshal(fw.batch)
+	for i := range fw.batch {
+		fw.batch[i] = Feature{} // don't keep the properties alive
+	}
+	fw.batch = fw.batch[:0]
+	if err != nil {
+		fw.logger.Error("Error JSON-encoding features: %s", err.Error())
+		return
+	}
+	b = b[1 : len(b)-1] // remove the []
+	if fw.started {
+		fw.write([]byte{','})
+	}
+	fw.started = true
+	fw.write(b)
+}
+
+// write writes to w unless it has failed before.
+func (fw *featureWriter) write(b []byte) {
+	if fw.err == nil {
+		_, fw.err = fw.w.Write(b)
+	}
+}
+
+// close ends the FeatureCollection, with "truncated":true after the
+// features if truncated, and returns the first error from writing.
+func (fw *featureWriter) close(truncated bool) error {
+	fw.flush()
+	if truncated {
+		fw.write([]byte(`],"truncated":true}`))
+	} else {
+		fw.write([]byte(`]}`))
+	}
+	return fw.err
+}
+
+// matchEncoder looks up, filters and writes one match at a time,
+// for StreamMatches and WriteMatches.
+type matchEncoder struct {
+	fw                           *featureWriter
+	db                           *ShipDB
+	filter                       MatchFilter
+	filters                      bool // filter.filtersShips(db)
+	precision, limit             int
+	extrapolate, verbose, shapes bool
+	now                          time.Time
+	vanished                     uint64
+	truncated                    bool
+}
+
+func newMatchEncoder(w io.Writer, db *ShipDB, filter MatchFilter, precision int,
+	extrapolate, verbose, shapes bool, limit int, logger *l.Logger) *matchEncoder {
+	return &matchEncoder{
+		fw:          newFeatureWriter(w, logger),
+		db:          db,
+		filter:      filter,
+		filters:     filter.filtersShips(db),
+		precision:   precision,
+		limit:       limit,
+		extrapolate: extrapolate,
+		verbose:     verbose,
+		shapes:      shapes,
+		now:         time.Now(),
+	}
+}
+
+// add writes the match if the ship is known and included.
+// Returns false when there should be no more matches,
+// because limit has been reached or writing has failed.
+func (me *matchEncoder) add(m Match) bool {
+	testHookBeforeJoin(m)
+	s := me.db.get(m.MMSI)
+	if s == nil { // removed since the index was searched, see getMatches
+		me.vanished++
+		return true
+	} else if me.filters && !me.db.includes(s, &me.filter) {
+		return true
+	}
+	f, ok := me.db.matchFeature(s, m, me.precision, me.extrapolate, me.verbose, me.shapes, me.now)
+	if !ok {
+		return true
+	} else if me.limit > 0 && me.fw.written >= me.limit {
+		me.truncated = true
+		return false
+	}
+	return me.fw.add(f)
+}
+
+// close ends the FeatureCollection and returns the results.
+func (me *matchEncoder) close() (truncated bool, err error) {
+	if me.vanished != 0 {
+		atomic.AddUint64(&me.db.vanished, me.vanished)
+	}
+	return me.truncated, me.fw.close(me.truncated)
+}
+
+// StreamMatches writes the ships and aids to navigation that index finds
+// within any of rects and that filter includes to w, as the same GeoJSON
+// FeatureCollection as FindWithinAny, FilterMatches and Matches produce,
+// but without building a list of the matches: each feature is encoded as
+// the index is searched.
+// If shapes is true, ships with known dimensions and heading are drawn as
+// polygons, see shipOutline().
+// If limit is positive at most that many features are written, and if there
+// were more, the FeatureCollection has "truncated":true.
+// Returns whether it was truncated, and the first error from writing to w,
+// after which the search stops.
+func StreamMatches(w io.Writer, index Index, rects []geo.Rectangle, db *ShipDB, filter MatchFilter,
+	precision int, extrapolate, verbose, shapes bool, limit int, logger *l.Logger) (truncated bool, err error) {
+	me := newMatchEncoder(w, db, filter, precision, extrapolate, verbose, shapes, limit, logger)
+	index.VisitWithinAny(rects, func(mmsi uint32, lat, long float64) bool {
+		return me.add(Match{mmsi, lat, long})
+	})
+	return me.close()
+}
+
+// WriteMatches is StreamMatches for matches that have already been found,
+// so that the index doesn't need to stay locked while writing to w.
+// Ships that have been removed since are left out.
+func WriteMatches(w io.Writer, matches []Match, db *ShipDB, filter MatchFilter,
+	precision int, extrapolate, verbose, shapes bool, limit int, logger *l.Logger) (truncated bool, err error) {
+	me := newMatchEncoder(w, db, filter, precision, extrapolate, verbose, shapes, limit, logger)
+	for _, m := range matches {
+		if !me.add(m) {
+			break
+		}
+	}
+	return me.close()
+}
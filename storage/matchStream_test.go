@@ -0,0 +1,197 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tormol/AIS/geo"
+	l "github.com/tormol/AIS/logger"
+)
+
+// featureIDs returns the MMSIs of a FeatureCollection in order, and whether it's truncated.
+func featureIDs(t *testing.T, text string) ([]uint32, bool) {
+	var fc struct {
+		Type     string
+		Features []struct {
+			ID uint32
+		}
+		Truncated bool
+	}
+	if err := json.Unmarshal([]byte(text), &fc); err != nil || fc.Type != "FeatureCollection" {
+		t.Fatalf("Bad FeatureCollection: %v\n%s", err, text)
+	}
+	ids := make([]uint32, len(fc.Features))
+	for i, f := range fc.Features {
+		ids[i] = f.ID
+	}
+	return ids, fc.Truncated
+}
+
+func TestStreamMatches(t *testing.T) {
+	quiet := l.NewLogger(os.Stderr, l.Error)
+	db, rt := clusterTestDB(2000, -80, -180, 80, 180)
+	sharded := NewShardedRTree(12)
+	for mmsi := uint32(1); mmsi <= 2000; mmsi++ {
+		lat, long, _ := db.KnownCoords(mmsi)
+		sharded.InsertData(lat, long, mmsi)
+		if mmsi%3 == 0 {
+			db.UpdateStatic(mmsi, "test", time.Now(), ShipInfo{VesselType: 70, ShipName: "CARGO"})
+		}
+	}
+	areas := map[string][]geo.Rectangle{
+		"world":        geo.SplitViewRect(-90, -180, 90, 180),
+		"antimeridian": geo.SplitViewRect(-30, 150, 30, -150),
+		"overlapping":  append(geo.SplitViewRect(0, 0, 40, 40), geo.SplitViewRect(20, 20, 60, 60)...),
+	}
+	filters := map[string]MatchFilter{
+		"none":  {},
+		"cargo": {Types: map[ShipType]bool{70: true}},
+	}
+	indexes := map[string]Index{"RTree": rt, "ShardedRTree": sharded}
+	for indexName, index := range indexes {
+		for areaName, rects := range areas {
+			for filterName, filter := range filters {
+				matches := index.FindWithinAny(rects)
+				FilterMatches(matches, db, filter)
+				collected := Matches(matches, db, 5, false, false, quiet)
+				var streamed strings.Builder
+				truncated, err := StreamMatches(&streamed, index, rects, db, filter, 5, false, false, false, 0, quiet)
+				if err != nil || truncated {
+					t.Fatalf("%s %s %s: truncated=%t err=%v", indexName, areaName, filterName, truncated, err)
+				}
+				if streamed.String() != collected {
+					t.Errorf("%s %s %s: streamed and collected matches differ:\n%s\n%s",
+						indexName, areaName, filterName, streamed.String(), collected)
+				}
+				var written strings.Builder
+				WriteMatches(&written, *index.FindWithinAny(rects), db, filter, 5, false, false, false, 0, quiet)
+				if written.String() != collected {
+					t.Errorf("%s %s %s: written and collected matches differ:\n%s\n%s",
+						indexName, areaName, filterName, written.String(), collected)
+				}
+				if ids, _ := featureIDs(t, collected); len(ids) == 0 {
+					t.Errorf("%s %s %s: expected some ships", indexName, areaName, filterName)
+				}
+			}
+		}
+	}
+
+	rects := areas["world"]
+	all, _ := featureIDs(t, Matches(rt.FindWithinAny(rects), db, 5, false, false, quiet))
+	for _, limit := range []int{1, 100, len(all), len(all) + 1} {
+		var streamed strings.Builder
+		truncated, _ := StreamMatches(&streamed, rt, rects, db, MatchFilter{}, 5, false, false, false, limit, quiet)
+		ids, marked := featureIDs(t, streamed.String())
+		expected := limit
+		if limit > len(all) {
+			expected = len(all)
+		}
+		if len(ids) != expected || truncated != (limit < len(all)) || marked != truncated {
+			t.Errorf("limit=%d: expected %d of %d ships and truncated=%t, got %d, %t and %t",
+				limit, expected, len(all), limit < len(all), len(ids), truncated, marked)
+		}
+		var written strings.Builder
+		WriteMatches(&written, *rt.FindWithinAny(rects), db, MatchFilter{}, 5, false, false, false, limit, quiet)
+		if written.String() != streamed.String() {
+			t.Errorf("limit=%d: expected WriteMatches to truncate the same way", limit)
+		}
+	}
+}
+
+// failingWriter fails after accepting some bytes.
+type failingWriter struct {
+	left int
+}
+
+func (fw *failingWriter) Write(b []byte) (int, error) {
+	if len(b) > fw.left {
+		return 0, errors.New("disconnected")
+	}
+	fw.left -= len(b)
+	return len(b), nil
+}
+
+func TestStreamMatchesStopsOnError(t *testing.T) {
+	db, rt := clusterTestDB(5000, -90, -180, 90, 180)
+	visited := 0
+	index := visitCounter{rt, &visited}
+	w := &failingWriter{left: 100}
+	_, err := StreamMatches(w, index, geo.SplitViewRect(-90, -180, 90, 180), db, MatchFilter{}, 5, false, false, false, 0, nil)
+	if err == nil {
+		t.Error("Expected the error from writing")
+	}
+	if visited == 0 || visited >= 5000 {
+		t.Errorf("Expected the search to stop soon after the error, visited %d of 5000", visited)
+	}
+}
+
+// visitCounter counts the boats an index visits.
+type visitCounter struct {
+	*RTree
+	visited *int
+}
+
+func (vc visitCounter) VisitWithinAny(rects []geo.Rectangle, visit func(mmsi uint32, lat, long float64) bool) {
+	vc.RTree.VisitWithinAny(rects, func(mmsi uint32, lat, long float64) bool {
+		*vc.visited++
+		return visit(mmsi, lat, long)
+	})
+}
+
+func TestVisitWithinStops(t *testing.T) {
+	db, rt := clusterTestDB(1000, -90, -180, 90, 180)
+	sharded := NewShardedRTree(10)
+	for mmsi := uint32(1); mmsi <= 1000; mmsi++ {
+		lat, long, _ := db.KnownCoords(mmsi)
+		sharded.InsertData(lat, long, mmsi)
+	}
+	world, _ := geo.NewRectangle(-90, -180, 90, 180)
+	for name, index := range map[string]Index{"RTree": rt, "ShardedRTree": sharded} {
+		visited := 0
+		index.VisitWithin(world, func(uint32, float64, float64) bool {
+			visited++
+			return visited < 10
+		})
+		if visited != 10 {
+			t.Errorf("%s: expected VisitWithin to stop after 10 boats, visited %d", name, visited)
+		}
+		visited = 0
+		index.VisitWithinAny(geo.SplitViewRect(-90, -180, 90, 180), func(uint32, float64, float64) bool {
+			visited++
+			return true
+		})
+		if visited != 1000 {
+			t.Errorf("%s: expected VisitWithinAny to visit all 1000 boats once, visited %d", name, visited)
+		}
+	}
+}
+
+// BenchmarkWorldQuery produces the map of the whole world with 50k named
+// ships by collecting the matches first and by streaming them.
+func BenchmarkWorldQuery(b *testing.B) {
+	quiet := l.NewLogger(os.Stderr, l.Error)
+	db, rt := clusterTestDB(50000, -90, -180, 90, 180)
+	for mmsi := uint32(1); mmsi <= 50000; mmsi++ {
+		db.UpdateStatic(mmsi, "test", time.Now(), ShipInfo{VesselType: 70, Length: 100, ShipName: "NAME"})
+	}
+	rects := geo.SplitViewRect(-90, -180, 90, 180)
+	b.Run("collected", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			matches := rt.FindWithinAny(rects)
+			FilterMatches(matches, db, MatchFilter{})
+			Matches(matches, db, 5, false, false, quiet)
+		}
+	})
+	b.Run("streamed", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var sb strings.Builder
+			StreamMatches(&sb, rt, rects, db, MatchFilter{}, 5, false, false, false, 0, quiet)
+		}
+	})
+}
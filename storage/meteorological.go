@@ -0,0 +1,177 @@
+package storage
+
+// Keeps the latest weather report from each weather station
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tormol/AIS/geo"
+	l "github.com/tormol/AIS/logger"
+	"github.com/tormol/AIS/nmeais"
+)
+
+// MetReport is a meteorological and hydrological report,
+// when it was measured and when it was received.
+type MetReport struct {
+	At       time.Time
+	Received time.Time
+	nmeais.Meteorological
+}
+
+// metKey is a position rounded to 1/1000 degree, so that reports from the
+// same weather station replace each other even if the position jitters.
+// Coast stations send the reports of several weather stations under their
+// own MMSI, so that cannot be used.
+type metKey struct {
+	lat, long int32
+}
+
+func metKeyOf(p geo.Point) metKey {
+	return metKey{int32(math.Round(p.Lat * 1000)), int32(math.Round(p.Long * 1000))}
+}
+
+// MetDB stores the latest meteorological report (AIS message type 8 with
+// DAC 1 and FI 31) from each position.
+// The number of positions is bounded, so that a misbehaving or spoofing
+// source can't use up memory.
+type MetDB struct {
+	mu           sync.Mutex
+	maxPositions int
+	reports      map[metKey]MetReport
+}
+
+// NewMetDB creates an empty MetDB which keeps the reports from at most
+// maxPositions positions.
+func NewMetDB(maxPositions uint) *MetDB {
+	return &MetDB{
+		maxPositions: int(maxPositions),
+		reports:      make(map[metKey]MetReport),
+	}
+}
+
+// Add stores a report, replacing any earlier report from the same position.
+// If there are too many positions, the one that was received least recently
+// is forgotten.
+func (md *MetDB) Add(report MetReport) {
+	if md.maxPositions <= 0 {
+		return
+	}
+	key := metKeyOf(report.Pos)
+	md.mu.Lock()
+	defer md.mu.Unlock()
+	if _, known := md.reports[key]; !known && len(md.reports) >= md.maxPositions {
+		md.forgetOldest()
+	}
+	md.reports[key] = report
+}
+
+// forgetOldest removes the report that was received least recently.
+// `md.mu` should be held while calling this.
+func (md *MetDB) forgetOldest() {
+	var oldest metKey
+	var oldestAt time.Time
+	first := true
+	for key, report := range md.reports {
+		if first || report.Received.Before(oldestAt) {
+			oldest, oldestAt, first = key, report.Received, false
+		}
+	}
+	delete(md.reports, oldest)
+}
+
+// Positions returns the number of positions with a stored report.
+func (md *MetDB) Positions() int {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+	return len(md.reports)
+}
+
+// MetProperties are the properties of a weather report in GeoJSON.
+// Values that are not available are left out.
+type MetProperties struct {
+	Station          uint32    `json:"station"`
+	At               time.Time `json:"time"`
+	Received         time.Time `json:"received"`
+	WindSpeed        *float32  `json:"wind_speed,omitempty"`
+	GustSpeed        *float32  `json:"gust_speed,omitempty"`
+	WindDirection    *float32  `json:"wind_direction,omitempty"`
+	GustDirection    *float32  `json:"gust_direction,omitempty"`
+	AirTemperature   *float32  `json:"air_temperature,omitempty"`
+	Humidity         *float32  `json:"humidity,omitempty"`
+	DewPoint         *float32  `json:"dew_point,omitempty"`
+	AirPressure      *float32  `json:"air_pressure,omitempty"`
+	Visibility       *float32  `json:"visibility,omitempty"`
+	VisibilityOver   bool      `json:"visibility_greater,omitempty"`
+	WaterLevel       *float32  `json:"water_level,omitempty"`
+	WaveHeight       *float32  `json:"wave_height,omitempty"`
+	WavePeriod       *float32  `json:"wave_period,omitempty"`
+	WaveDirection    *float32  `json:"wave_direction,omitempty"`
+	WaterTemperature *float32  `json:"water_temperature,omitempty"`
+}
+
+// ifAvailable returns a pointer to v rounded to two decimals, or nil if v is NaN.
+func ifAvailable(v float32) *float32 {
+	if math.IsNaN(float64(v)) {
+		return nil
+	}
+	v = roundFloat32(v, 2)
+	return &v
+}
+
+// Properties returns the station, times and available values of the report.
+func (r *MetReport) Properties() MetProperties {
+	return MetProperties{
+		Station:          r.Station,
+		At:               r.At,
+		Received:         r.Received,
+		WindSpeed:        ifAvailable(r.WindSpeed),
+		GustSpeed:        ifAvailable(r.GustSpeed),
+		WindDirection:    ifAvailable(r.WindDirection),
+		GustDirection:    ifAvailable(r.GustDirection),
+		AirTemperature:   ifAvailable(r.AirTemperature),
+		Humidity:         ifAvailable(r.Humidity),
+		DewPoint:         ifAvailable(r.DewPoint),
+		AirPressure:      ifAvailable(r.AirPressure),
+		Visibility:       ifAvailable(r.Visibility),
+		VisibilityOver:   r.VisibilityOver,
+		WaterLevel:       ifAvailable(r.WaterLevel),
+		WaveHeight:       ifAvailable(r.WaveHeight),
+		WavePeriod:       ifAvailable(r.WavePeriod),
+		WaveDirection:    ifAvailable(r.WaveDirection),
+		WaterTemperature: ifAvailable(r.WaterTemperature),
+	}
+}
+
+// GeoJSON returns the reports within any of rects as a GeoJSON
+// FeatureCollection of points, sorted by position.
+func (md *MetDB) GeoJSON(rects []geo.Rectangle, logger *l.Logger) string {
+	md.mu.Lock()
+	found := make([]MetReport, 0, len(md.reports))
+	for _, report := range md.reports {
+		for i := range rects {
+			if rects[i].ContainsPoint(report.Pos) {
+				found = append(found, report)
+				break
+			}
+		}
+	}
+	md.mu.Unlock()
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].Pos.Lat != found[j].Pos.Lat {
+			return found[i].Pos.Lat < found[j].Pos.Lat
+		}
+		return found[i].Pos.Long < found[j].Pos.Long
+	})
+	fc := newFeatureCollection(len(found))
+	for i := range found {
+		fc.Features = append(fc.Features, Feature{
+			Type:       "Feature",
+			Geometry:   &Geometry{Coordinates: []geo.Point{found[i].Pos}},
+			Properties: found[i].Properties(),
+		})
+	}
+	return fc.encode(logger)
+}
@@ -0,0 +1,76 @@
+package storage
+
+import (
+	"encoding/json"
+	"math"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/tormol/AIS/geo"
+	l "github.com/tormol/AIS/logger"
+	"github.com/tormol/AIS/nmeais"
+)
+
+// metReport creates a report where only the air temperature is available.
+func metReport(lat, long float64, temperature float32, received time.Time) MetReport {
+	na := float32(math.NaN())
+	r := MetReport{At: received, Received: received, Meteorological: nmeais.Meteorological{
+		Station:        2579999,
+		Pos:            geo.Point{Lat: lat, Long: long},
+		AirTemperature: temperature,
+	}}
+	for _, v := range []*float32{&r.WindSpeed, &r.GustSpeed, &r.WindDirection, &r.GustDirection,
+		&r.Humidity, &r.DewPoint, &r.AirPressure, &r.Visibility, &r.WaterLevel,
+		&r.WaveHeight, &r.WavePeriod, &r.WaveDirection, &r.WaterTemperature} {
+		*v = na
+	}
+	return r
+}
+
+func TestMetDB(t *testing.T) {
+	md := NewMetDB(2)
+	at := time.Date(2024, 1, 14, 10, 20, 0, 0, time.UTC)
+	md.Add(metReport(60.4, 5.3167, -3.5, at))
+	md.Add(metReport(60.40001, 5.3167, -4, at.Add(10*time.Minute))) // replaces
+	md.Add(metReport(58.9, 5.6, 1.5, at.Add(5*time.Minute)))
+	if md.Positions() != 2 {
+		t.Errorf("Expected reports from two positions, got %d", md.Positions())
+	}
+
+	var fc struct {
+		Features []struct {
+			Geometry struct {
+				Coordinates []float64 `json:"coordinates"`
+			} `json:"geometry"`
+			Properties map[string]interface{} `json:"properties"`
+		} `json:"features"`
+	}
+	rects, _ := geo.ParseViewRects([]string{"5,60,6,61"})
+	geojson := md.GeoJSON(rects, l.NewLogger(os.Stderr, l.Warning))
+	if err := json.Unmarshal([]byte(geojson), &fc); err != nil {
+		t.Fatalf("Invalid GeoJSON %q: %s", geojson, err.Error())
+	}
+	if len(fc.Features) != 1 {
+		t.Fatalf("Expected only the report within the bbox, got %s", geojson)
+	}
+	expected := map[string]interface{}{"station": 2579999.0, "air_temperature": -4.0,
+		"time": "2024-01-14T10:30:00Z", "received": "2024-01-14T10:30:00Z"}
+	if p := fc.Features[0].Properties; len(p) != len(expected) {
+		t.Errorf("Expected only the available values, got %v", p)
+	} else {
+		for k, v := range expected {
+			if p[k] != v {
+				t.Errorf("Expected %s to be %v, got %v", k, v, p[k])
+			}
+		}
+	}
+
+	// the report from 58.9,5.6 was received least recently
+	md.Add(metReport(63.4, 10.4, 0, at.Add(20*time.Minute)))
+	rects, _ = geo.ParseViewRects([]string{"0,50,20,70"})
+	if geojson = md.GeoJSON(rects, l.NewLogger(os.Stderr, l.Warning)); json.Unmarshal([]byte(geojson), &fc) != nil ||
+		len(fc.Features) != 2 || fc.Features[0].Geometry.Coordinates[1] != 60.40001 {
+		t.Errorf("Expected the oldest position to be forgotten, got %s", geojson)
+	}
+}
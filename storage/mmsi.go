@@ -0,0 +1,430 @@
+package storage
+
+import (
+	"strconv"
+)
+
+// Mmsi stands for Maritime Mobile Service Identity and is used to identify the
+// sender of AIS messages. It should be displayed as 9 digits.
+type Mmsi uint32
+
+// MmsiKind is the type of station identified by a MMSI,
+// decided by the leading digits as described in ITU-R M.585.
+type MmsiKind uint8
+
+const (
+	MmsiInvalid         MmsiKind = iota
+	MmsiShip                     // MIDXXXXXX
+	MmsiGroup                    // 0MIDXXXXX
+	MmsiCoastStation             // 00MIDXXXX
+	MmsiSARAircraft              // 111MIDXXX
+	MmsiHandheld                 // 8MIDXXXXX
+	MmsiParentShipCraft          // 98MIDXXXX, craft associated with a parent ship
+	MmsiAtoN                     // 99MIDXXXX, aid to navigation
+	MmsiSART                     // 970XXYYYY, search and rescue transmitter
+	MmsiMOB                      // 972XXYYYY, man overboard device
+	MmsiEPIRB                    // 974XXYYYY, emergency position indicating radio beacon
+)
+
+var mmsiKindNames = [...]string{
+	MmsiInvalid:         "Invalid MMSI",
+	MmsiShip:            "Ship",
+	MmsiGroup:           "Group of ships",
+	MmsiCoastStation:    "Coast station",
+	MmsiSARAircraft:     "SAR aircraft",
+	MmsiHandheld:        "Handheld radio",
+	MmsiParentShipCraft: "Craft associated with parent ship",
+	MmsiAtoN:            "Aid to navigation",
+	MmsiSART:            "AIS-SART",
+	MmsiMOB:             "Man overboard device",
+	MmsiEPIRB:           "EPIRB",
+}
+
+// String returns a short description of the kind, E.g. "Ship" or "Coast station".
+func (k MmsiKind) String() string {
+	if int(k) < len(mmsiKindNames) {
+		return mmsiKindNames[k]
+	}
+	return "MmsiKind(" + strconv.Itoa(int(k)) + ")"
+}
+
+// ValidMMSI returns whether a number can be an MMSI: not zero and at most nine digits.
+func ValidMMSI(mmsi uint32) bool {
+	return mmsi != 0 && mmsi <= 999999999
+}
+
+// Plausible returns whether the leading digits of the MMSI are those of a kind
+// of station, so that it's not MmsiInvalid.
+// Garbage decodes and test transmitters often use MMSIs that aren't.
+func (m Mmsi) Plausible() bool {
+	return m.Kind() != MmsiInvalid
+}
+
+// Kind returns what kind of station the MMSI belongs to.
+func (m Mmsi) Kind() MmsiKind {
+	k, _ := m.split()
+	return k
+}
+
+// MID returns the Maritime Identification Digits of the MMSI,
+// or 0 if the kind of MMSI doesn't have one.
+// The MID is not necessarily in the table of assigned MIDs.
+func (m Mmsi) MID() uint16 {
+	_, mid := m.split()
+	return mid
+}
+
+// split extracts both the kind and the MID, which need the same checks.
+func (m Mmsi) split() (MmsiKind, uint16) {
+	// a MID starts with 2-7, which is what separates ships from the other kinds
+	with := func(kind MmsiKind, mid uint32) (MmsiKind, uint16) {
+		if mid < 200 || mid >= 800 {
+			return MmsiInvalid, 0
+		}
+		return kind, uint16(mid)
+	}
+	switch {
+	case m >= 1000000000:
+		return MmsiInvalid, 0
+	case m >= 200000000 && m < 800000000:
+		return with(MmsiShip, uint32(m)/1000000)
+	case m < 10000000:
+		return with(MmsiCoastStation, uint32(m)/10000)
+	case m < 100000000:
+		return with(MmsiGroup, uint32(m)/100000)
+	case m/1000000 == 111:
+		return with(MmsiSARAircraft, uint32(m)/1000%1000)
+	case m >= 800000000 && m < 900000000:
+		return with(MmsiHandheld, uint32(m)/100000%1000)
+	case m/10000000 == 98:
+		return with(MmsiParentShipCraft, uint32(m)/10000%1000)
+	case m/10000000 == 99:
+		return with(MmsiAtoN, uint32(m)/10000%1000)
+	case m/1000000 == 970:
+		return MmsiSART, 0
+	case m/1000000 == 972:
+		return MmsiMOB, 0
+	case m/1000000 == 974:
+		return MmsiEPIRB, 0
+	}
+	return MmsiInvalid, 0
+}
+
+// Country returns the name of the country or territory the MMSI belongs to,
+// or an empty string if it doesn't have a MID or the MID is not assigned.
+func (m Mmsi) Country() string {
+	return midTable[m.MID()].Country
+}
+
+// Alpha2 returns the ISO 3166-1 alpha-2 code of the country or territory the
+// MMSI belongs to, or an empty string if unknown.
+func (m Mmsi) Alpha2() string {
+	return midTable[m.MID()].Alpha2
+}
+
+// String returns the kind and country of the MMSI,
+// E.g. "Ship, Norway" or "Coast station, France".
+func (m *Mmsi) String() string {
+	if country := m.Country(); country != "" {
+		return m.Kind().String() + ", " + country
+	}
+	return m.Kind().String()
+}
+
+// midTable contains the Maritime Identification Digits assigned by the ITU,
+// with short country names and the ISO code of the territory.
+// Based on https://www.itu.int/en/ITU-R/terrestrial/fmd/Pages/mid.aspx
+var midTable = map[uint16]struct{ Country, Alpha2 string }{
+	201: {"Albania", "AL"},
+	202: {"Andorra", "AD"},
+	203: {"Austria", "AT"},
+	204: {"Azores", "PT"},
+	205: {"Belgium", "BE"},
+	206: {"Belarus", "BY"},
+	207: {"Bulgaria", "BG"},
+	208: {"Vatican City", "VA"},
+	209: {"Cyprus", "CY"},
+	210: {"Cyprus", "CY"},
+	211: {"Germany", "DE"},
+	212: {"Cyprus", "CY"},
+	213: {"Georgia", "GE"},
+	214: {"Moldova", "MD"},
+	215: {"Malta", "MT"},
+	216: {"Armenia", "AM"},
+	218: {"Germany", "DE"},
+	219: {"Denmark", "DK"},
+	220: {"Denmark", "DK"},
+	224: {"Spain", "ES"},
+	225: {"Spain", "ES"},
+	226: {"France", "FR"},
+	227: {"France", "FR"},
+	228: {"France", "FR"},
+	229: {"Malta", "MT"},
+	230: {"Finland", "FI"},
+	231: {"Faroe Islands", "FO"},
+	232: {"United Kingdom", "GB"},
+	233: {"United Kingdom", "GB"},
+	234: {"United Kingdom", "GB"},
+	235: {"United Kingdom", "GB"},
+	236: {"Gibraltar", "GI"},
+	237: {"Greece", "GR"},
+	238: {"Croatia", "HR"},
+	239: {"Greece", "GR"},
+	240: {"Greece", "GR"},
+	241: {"Greece", "GR"},
+	242: {"Morocco", "MA"},
+	243: {"Hungary", "HU"},
+	244: {"Netherlands", "NL"},
+	245: {"Netherlands", "NL"},
+	246: {"Netherlands", "NL"},
+	247: {"Italy", "IT"},
+	248: {"Malta", "MT"},
+	249: {"Malta", "MT"},
+	250: {"Ireland", "IE"},
+	251: {"Iceland", "IS"},
+	252: {"Liechtenstein", "LI"},
+	253: {"Luxembourg", "LU"},
+	254: {"Monaco", "MC"},
+	255: {"Madeira", "PT"},
+	256: {"Malta", "MT"},
+	257: {"Norway", "NO"},
+	258: {"Norway", "NO"},
+	259: {"Norway", "NO"},
+	261: {"Poland", "PL"},
+	262: {"Montenegro", "ME"},
+	263: {"Portugal", "PT"},
+	264: {"Romania", "RO"},
+	265: {"Sweden", "SE"},
+	266: {"Sweden", "SE"},
+	267: {"Slovakia", "SK"},
+	268: {"San Marino", "SM"},
+	269: {"Switzerland", "CH"},
+	270: {"Czech Republic", "CZ"},
+	271: {"Turkey", "TR"},
+	272: {"Ukraine", "UA"},
+	273: {"Russia", "RU"},
+	274: {"North Macedonia", "MK"},
+	275: {"Latvia", "LV"},
+	276: {"Estonia", "EE"},
+	277: {"Lithuania", "LT"},
+	278: {"Slovenia", "SI"},
+	279: {"Serbia", "RS"},
+	301: {"Anguilla", "AI"},
+	303: {"Alaska", "US"},
+	304: {"Antigua and Barbuda", "AG"},
+	305: {"Antigua and Barbuda", "AG"},
+	306: {"Curaçao, Sint Maarten and Caribbean Netherlands", "CW"},
+	307: {"Aruba", "AW"},
+	308: {"Bahamas", "BS"},
+	309: {"Bahamas", "BS"},
+	310: {"Bermuda", "BM"},
+	311: {"Bahamas", "BS"},
+	312: {"Belize", "BZ"},
+	314: {"Barbados", "BB"},
+	316: {"Canada", "CA"},
+	319: {"Cayman Islands", "KY"},
+	321: {"Costa Rica", "CR"},
+	323: {"Cuba", "CU"},
+	325: {"Dominica", "DM"},
+	327: {"Dominican Republic", "DO"},
+	329: {"Guadeloupe", "GP"},
+	330: {"Grenada", "GD"},
+	331: {"Greenland", "GL"},
+	332: {"Guatemala", "GT"},
+	334: {"Honduras", "HN"},
+	336: {"Haiti", "HT"},
+	338: {"United States", "US"},
+	339: {"Jamaica", "JM"},
+	341: {"Saint Kitts and Nevis", "KN"},
+	343: {"Saint Lucia", "LC"},
+	345: {"Mexico", "MX"},
+	347: {"Martinique", "MQ"},
+	348: {"Montserrat", "MS"},
+	350: {"Nicaragua", "NI"},
+	351: {"Panama", "PA"},
+	352: {"Panama", "PA"},
+	353: {"Panama", "PA"},
+	354: {"Panama", "PA"},
+	355: {"Panama", "PA"},
+	356: {"Panama", "PA"},
+	357: {"Panama", "PA"},
+	358: {"Puerto Rico", "PR"},
+	359: {"El Salvador", "SV"},
+	361: {"Saint Pierre and Miquelon", "PM"},
+	362: {"Trinidad and Tobago", "TT"},
+	364: {"Turks and Caicos Islands", "TC"},
+	366: {"United States", "US"},
+	367: {"United States", "US"},
+	368: {"United States", "US"},
+	369: {"United States", "US"},
+	370: {"Panama", "PA"},
+	371: {"Panama", "PA"},
+	372: {"Panama", "PA"},
+	373: {"Panama", "PA"},
+	374: {"Panama", "PA"},
+	375: {"Saint Vincent and the Grenadines", "VC"},
+	376: {"Saint Vincent and the Grenadines", "VC"},
+	377: {"Saint Vincent and the Grenadines", "VC"},
+	378: {"British Virgin Islands", "VG"},
+	379: {"United States Virgin Islands", "VI"},
+	401: {"Afghanistan", "AF"},
+	403: {"Saudi Arabia", "SA"},
+	405: {"Bangladesh", "BD"},
+	408: {"Bahrain", "BH"},
+	410: {"Bhutan", "BT"},
+	412: {"China", "CN"},
+	413: {"China", "CN"},
+	414: {"China", "CN"},
+	416: {"Taiwan", "TW"},
+	417: {"Sri Lanka", "LK"},
+	419: {"India", "IN"},
+	422: {"Iran", "IR"},
+	423: {"Azerbaijan", "AZ"},
+	425: {"Iraq", "IQ"},
+	428: {"Israel", "IL"},
+	431: {"Japan", "JP"},
+	432: {"Japan", "JP"},
+	434: {"Turkmenistan", "TM"},
+	436: {"Kazakhstan", "KZ"},
+	437: {"Uzbekistan", "UZ"},
+	438: {"Jordan", "JO"},
+	440: {"South Korea", "KR"},
+	441: {"South Korea", "KR"},
+	443: {"Palestine", "PS"},
+	445: {"North Korea", "KP"},
+	447: {"Kuwait", "KW"},
+	450: {"Lebanon", "LB"},
+	451: {"Kyrgyzstan", "KG"},
+	453: {"Macao", "MO"},
+	455: {"Maldives", "MV"},
+	457: {"Mongolia", "MN"},
+	459: {"Nepal", "NP"},
+	461: {"Oman", "OM"},
+	463: {"Pakistan", "PK"},
+	466: {"Qatar", "QA"},
+	468: {"Syria", "SY"},
+	470: {"United Arab Emirates", "AE"},
+	471: {"United Arab Emirates", "AE"},
+	472: {"Tajikistan", "TJ"},
+	473: {"Yemen", "YE"},
+	475: {"Yemen", "YE"},
+	477: {"Hong Kong", "HK"},
+	478: {"Bosnia and Herzegovina", "BA"},
+	501: {"Adélie Land", "TF"},
+	503: {"Australia", "AU"},
+	506: {"Myanmar", "MM"},
+	508: {"Brunei", "BN"},
+	510: {"Micronesia", "FM"},
+	511: {"Palau", "PW"},
+	512: {"New Zealand", "NZ"},
+	514: {"Cambodia", "KH"},
+	515: {"Cambodia", "KH"},
+	516: {"Christmas Island", "CX"},
+	518: {"Cook Islands", "CK"},
+	520: {"Fiji", "FJ"},
+	523: {"Cocos (Keeling) Islands", "CC"},
+	525: {"Indonesia", "ID"},
+	529: {"Kiribati", "KI"},
+	531: {"Laos", "LA"},
+	533: {"Malaysia", "MY"},
+	536: {"Northern Mariana Islands", "MP"},
+	538: {"Marshall Islands", "MH"},
+	540: {"New Caledonia", "NC"},
+	542: {"Niue", "NU"},
+	544: {"Nauru", "NR"},
+	546: {"French Polynesia", "PF"},
+	548: {"Philippines", "PH"},
+	550: {"Timor-Leste", "TL"},
+	553: {"Papua New Guinea", "PG"},
+	555: {"Pitcairn Islands", "PN"},
+	557: {"Solomon Islands", "SB"},
+	559: {"American Samoa", "AS"},
+	561: {"Samoa", "WS"},
+	563: {"Singapore", "SG"},
+	564: {"Singapore", "SG"},
+	565: {"Singapore", "SG"},
+	566: {"Singapore", "SG"},
+	567: {"Thailand", "TH"},
+	570: {"Tonga", "TO"},
+	572: {"Tuvalu", "TV"},
+	574: {"Vietnam", "VN"},
+	576: {"Vanuatu", "VU"},
+	577: {"Vanuatu", "VU"},
+	578: {"Wallis and Futuna", "WF"},
+	601: {"South Africa", "ZA"},
+	603: {"Angola", "AO"},
+	605: {"Algeria", "DZ"},
+	607: {"Saint Paul and Amsterdam Islands", "TF"},
+	608: {"Ascension Island", "SH"},
+	609: {"Burundi", "BI"},
+	610: {"Benin", "BJ"},
+	611: {"Botswana", "BW"},
+	612: {"Central African Republic", "CF"},
+	613: {"Cameroon", "CM"},
+	615: {"Congo", "CG"},
+	616: {"Comoros", "KM"},
+	617: {"Cabo Verde", "CV"},
+	618: {"Crozet Archipelago", "TF"},
+	619: {"Côte d'Ivoire", "CI"},
+	620: {"Comoros", "KM"},
+	621: {"Djibouti", "DJ"},
+	622: {"Egypt", "EG"},
+	624: {"Ethiopia", "ET"},
+	625: {"Eritrea", "ER"},
+	626: {"Gabon", "GA"},
+	627: {"Ghana", "GH"},
+	629: {"Gambia", "GM"},
+	630: {"Guinea-Bissau", "GW"},
+	631: {"Equatorial Guinea", "GQ"},
+	632: {"Guinea", "GN"},
+	633: {"Burkina Faso", "BF"},
+	634: {"Kenya", "KE"},
+	635: {"Kerguelen Islands", "TF"},
+	636: {"Liberia", "LR"},
+	637: {"Liberia", "LR"},
+	638: {"South Sudan", "SS"},
+	642: {"Libya", "LY"},
+	644: {"Lesotho", "LS"},
+	645: {"Mauritius", "MU"},
+	647: {"Madagascar", "MG"},
+	649: {"Mali", "ML"},
+	650: {"Mozambique", "MZ"},
+	654: {"Mauritania", "MR"},
+	655: {"Malawi", "MW"},
+	656: {"Niger", "NE"},
+	657: {"Nigeria", "NG"},
+	659: {"Namibia", "NA"},
+	660: {"Réunion", "RE"},
+	661: {"Rwanda", "RW"},
+	662: {"Sudan", "SD"},
+	663: {"Senegal", "SN"},
+	664: {"Seychelles", "SC"},
+	665: {"Saint Helena", "SH"},
+	666: {"Somalia", "SO"},
+	667: {"Sierra Leone", "SL"},
+	668: {"São Tomé and Príncipe", "ST"},
+	669: {"Eswatini", "SZ"},
+	670: {"Chad", "TD"},
+	671: {"Togo", "TG"},
+	672: {"Tunisia", "TN"},
+	674: {"Tanzania", "TZ"},
+	675: {"Uganda", "UG"},
+	676: {"DR Congo", "CD"},
+	677: {"Tanzania", "TZ"},
+	678: {"Zambia", "ZM"},
+	679: {"Zimbabwe", "ZW"},
+	701: {"Argentina", "AR"},
+	710: {"Brazil", "BR"},
+	720: {"Bolivia", "BO"},
+	725: {"Chile", "CL"},
+	730: {"Colombia", "CO"},
+	735: {"Ecuador", "EC"},
+	740: {"Falkland Islands", "FK"},
+	745: {"French Guiana", "GF"},
+	750: {"Guyana", "GY"},
+	755: {"Paraguay", "PY"},
+	760: {"Peru", "PE"},
+	765: {"Suriname", "SR"},
+	770: {"Uruguay", "UY"},
+	775: {"Venezuela", "VE"},
+}
@@ -0,0 +1,133 @@
+package storage
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMmsi(t *testing.T) {
+	cases := []struct {
+		mmsi    Mmsi
+		kind    MmsiKind
+		mid     uint16
+		country string
+		alpha2  string
+	}{
+		{257000001, MmsiShip, 257, "Norway", "NO"},
+		{258226000, MmsiShip, 258, "Norway", "NO"},
+		{259999999, MmsiShip, 259, "Norway", "NO"},
+		{2570001, MmsiCoastStation, 257, "Norway", "NO"},
+		{25700001, MmsiGroup, 257, "Norway", "NO"},
+		{992576001, MmsiAtoN, 257, "Norway", "NO"},
+		{982570001, MmsiParentShipCraft, 257, "Norway", "NO"},
+		{338123456, MmsiShip, 338, "United States", "US"},
+		{367430530, MmsiShip, 367, "United States", "US"},
+		{111366001, MmsiSARAircraft, 366, "United States", "US"},
+		{836912345, MmsiHandheld, 369, "United States", "US"},
+		{306000001, MmsiShip, 306, "Curaçao, Sint Maarten and Caribbean Netherlands", "CW"},
+		{970010001, MmsiSART, 0, "", ""},
+		{972010001, MmsiMOB, 0, "", ""},
+		{974010001, MmsiEPIRB, 0, "", ""},
+		{260000001, MmsiShip, 260, "", ""}, // not assigned
+		{0, MmsiInvalid, 0, "", ""},
+		{100000000, MmsiInvalid, 0, "", ""},
+		{900000000, MmsiInvalid, 0, "", ""},
+		{199999, MmsiInvalid, 0, "", ""},     // coast station with MID 019
+		{111123456, MmsiInvalid, 0, "", ""},  // SAR aircraft with MID 123
+		{1000000000, MmsiInvalid, 0, "", ""}, // ten digits
+	}
+	for _, c := range cases {
+		if kind := c.mmsi.Kind(); kind != c.kind {
+			t.Errorf("%09d: expected kind %s, got %s", c.mmsi, c.kind, kind)
+		}
+		if mid := c.mmsi.MID(); mid != c.mid {
+			t.Errorf("%09d: expected MID %d, got %d", c.mmsi, c.mid, mid)
+		}
+		if country := c.mmsi.Country(); country != c.country {
+			t.Errorf("%09d: expected country %q, got %q", c.mmsi, c.country, country)
+		}
+		if alpha2 := c.mmsi.Alpha2(); alpha2 != c.alpha2 {
+			t.Errorf("%09d: expected alpha-2 %q, got %q", c.mmsi, c.alpha2, alpha2)
+		}
+	}
+
+	for mid, c := range midTable {
+		if mid < 200 || mid >= 800 || c.Country == "" || len(c.Alpha2) != 2 ||
+			strings.ToUpper(c.Alpha2) != c.Alpha2 {
+			t.Errorf("Bad MID table entry %d: %+v", mid, c)
+		}
+	}
+}
+
+func TestPlausibleMMSI(t *testing.T) {
+	good := []uint32{
+		257000001, // ship
+		775123456, // ship with the highest MID
+		2570001,   // coast station
+		2320004,   // coast station
+		25700001,  // group of ships
+		111257001, // SAR aircraft
+		111366001, // SAR aircraft
+		992576001, // aid to navigation
+		993692028, // aid to navigation
+		982570001, // craft associated with a parent ship
+		836912345, // handheld radio
+		970010001, // AIS-SART
+		972010001, // man overboard device
+		974010001, // EPIRB
+	}
+	bad := []uint32{
+		1,
+		123,
+		999999,    // coast station with MID 099
+		123456789, // starts with 1 but isn't a SAR aircraft
+		111123456, // SAR aircraft with MID 123
+		199999999,
+		900000000,
+		999999999,
+		975000001, // not a kind of 97
+	}
+	for _, mmsi := range good {
+		if !ValidMMSI(mmsi) || !Mmsi(mmsi).Plausible() {
+			t.Errorf("Expected %09d to be valid and plausible", mmsi)
+		}
+	}
+	for _, mmsi := range bad {
+		if !ValidMMSI(mmsi) || Mmsi(mmsi).Plausible() {
+			t.Errorf("Expected %09d to be valid but not plausible", mmsi)
+		}
+	}
+	for _, mmsi := range []uint32{0, 1000000000, 4294967295} {
+		if ValidMMSI(mmsi) || Mmsi(mmsi).Plausible() {
+			t.Errorf("Expected %d to be invalid", mmsi)
+		}
+	}
+}
+
+func TestMmsiJSON(t *testing.T) {
+	db := NewShipDB(100, 0, 0, 0, 0, 0, 0)
+	db.UpdateStatic(257000001, "test", time.Now(), ShipInfo{ShipName: "NORWEGIAN"})
+	db.UpdateStatic(260000001, "test", time.Now(), ShipInfo{ShipName: "UNASSIGNED"})
+	var p struct {
+		ItemType string `json:"item_type"`
+		Country  *string
+		Flag     *string
+	}
+	b, _ := json.Marshal(db.get(257000001))
+	if err := json.Unmarshal(b, &p); err != nil {
+		t.Fatal(err)
+	}
+	if p.ItemType != "Ship" || p.Country == nil || *p.Country != "Norway" || p.Flag == nil || *p.Flag != "NO" {
+		t.Errorf("Unexpected MMSI properties in %s", b)
+	}
+	p.Country, p.Flag = nil, nil
+	b, _ = json.Marshal(db.get(260000001))
+	if err := json.Unmarshal(b, &p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Country != nil || p.Flag != nil {
+		t.Errorf("Expected country and flag of unassigned MID to be omitted, got %s", b)
+	}
+}
@@ -0,0 +1,72 @@
+package storage
+
+// Draws ships to scale from their dimensions and heading
+
+import (
+	"math"
+
+	"github.com/tormol/AIS/geo"
+)
+
+// maxOutlineMeters is the longest and widest a ship is drawn.
+// Larger dimensions are probably from corrupt messages; no ship is this long.
+const maxOutlineMeters = 500
+
+// bowFraction is how much of the length is the pointed bow of outlines.
+const bowFraction = 0.2
+
+// hullCorner is a corner of an outline, in meters from the AIS transmitter.
+type hullCorner struct {
+	ahead, starboard float64
+}
+
+// shipOutline returns the hull of a ship as a counterclockwise ring of five
+// corners: a rectangle with a pointed bow, placed and turned so that the
+// transmitter is at pos.
+// Returns nil if the dimensions or the heading is unknown,
+// or if pos is so close to a pole that the ship cannot be drawn in degrees.
+// `s.mu` should be held while calling this.
+func shipOutline(s *ship, pos geo.Point, precision int) *Geometry {
+	info := &s.ShipInfo
+	if s.AtoN != nil || info.Length == 0 || info.Width == 0 || !isFinite(s.BowHeading) || geo.NearPole(pos.Lat) {
+		return nil
+	}
+	// The offsets are from the center, see the archive.
+	length, width := float64(info.Length), float64(info.Width)
+	toBow := float64(int16(info.Length/2) - info.LengthOffset)
+	toStarboard := float64(int16(info.Width/2) - info.WidthOffset)
+	if toBow < 0 || toBow > length || toStarboard < 0 || toStarboard > width {
+		return nil
+	}
+	if length > maxOutlineMeters {
+		toBow *= maxOutlineMeters / length
+		length = maxOutlineMeters
+	}
+	if width > maxOutlineMeters {
+		toStarboard *= maxOutlineMeters / width
+		width = maxOutlineMeters
+	}
+	toStern, toPort := length-toBow, width-toStarboard
+	shoulder := toBow - length*bowFraction
+	corners := [...]hullCorner{
+		{-toStern, toStarboard},
+		{shoulder, toStarboard},
+		{toBow, (toStarboard - toPort) / 2},
+		{shoulder, -toPort},
+		{-toStern, -toPort},
+	}
+	ring := make([]geo.Point, 0, len(corners)+1)
+	for _, c := range corners {
+		bearing := float64(s.BowHeading) + math.Atan2(c.starboard, c.ahead)*180/math.Pi
+		p := geo.OffsetPoint(pos, bearing, math.Hypot(c.ahead, c.starboard))
+		// don't split ships on the antimeridian, see regionPolygon()
+		if p.Long-pos.Long > 180 {
+			p.Long -= 360
+		} else if p.Long-pos.Long < -180 {
+			p.Long += 360
+		}
+		ring = append(ring, p.Rounded(precision))
+	}
+	ring = append(ring, ring[0])
+	return &Geometry{Coordinates: ring, Polygon: true}
+}
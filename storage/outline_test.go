@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/tormol/AIS/geo"
+)
+
+// outlineOf returns the geometry of a ship with the given dimensions and heading, at 60°N 5°E.
+func outlineOf(t *testing.T, toBow, toStern, toPort, toStarboard uint16, heading float32, shapes bool) *Geometry {
+	return outlineAt(t, 60, toBow, toStern, toPort, toStarboard, heading, shapes)
+}
+
+// outlineAt is outlineOf at another latitude.
+func outlineAt(t *testing.T, lat float64, toBow, toStern, toPort, toStarboard uint16, heading float32, shapes bool) *Geometry {
+	db := NewShipDB(100, 0, 50, time.Minute, 0, 0, 0)
+	now := time.Now()
+	pos := UnknownPos
+	pos.At, pos.Received = now, now
+	pos.Pos = geo.Point{Lat: lat, Long: 5}
+	pos.BowHeading = heading
+	db.UpdateDynamic(1, "test", pos)
+	length, width := toBow+toStern, toPort+toStarboard
+	db.UpdateStatic(1, "test", now, ShipInfo{
+		ShipName:     "TEST",
+		Length:       length,
+		Width:        width,
+		LengthOffset: int16(length/2) - int16(toBow),
+		WidthOffset:  int16(width/2) - int16(toStarboard),
+	})
+	f, ok := db.matchFeature(db.get(1), Match{MMSI: 1, Lat: lat, Long: 5}, geo.FullPrecision, false, false, shapes, now)
+	if !ok {
+		t.Fatal("No feature for the ship")
+	}
+	return f.Geometry
+}
+
+func TestShipOutline(t *testing.T) {
+	pos := geo.Point{Lat: 60, Long: 5}
+	g := outlineOf(t, 80, 20, 15, 5, 90, true)
+	ring := g.Coordinates
+	if !g.Polygon || len(ring) != 6 || ring[0] != ring[5] {
+		t.Fatalf("Expected a closed ring of five corners, got %+v", g)
+	}
+	// the shoelace formula is positive for counterclockwise rings
+	area := 0.0
+	for i := 0; i < len(ring)-1; i++ {
+		area += ring[i].Long*ring[i+1].Lat - ring[i+1].Long*ring[i].Lat
+	}
+	if area <= 0 {
+		t.Errorf("Expected a counterclockwise ring, got %v", ring)
+	}
+	bow := ring[2]
+	for _, p := range ring {
+		if p.Long > bow.Long {
+			t.Errorf("Expected the bow to be furthest east when heading 090, got %v", ring)
+		}
+	}
+	// the transmitter is 5 m from starboard of a 20 m wide ship, so 5 m south of the center line
+	if d := pos.HaversineDistanceTo(bow); math.Abs(d-math.Hypot(80, 5)) > 0.5 || bow.Lat <= pos.Lat {
+		t.Errorf("Expected the bow 80 m ahead on the center line, got %.1f m away at %v", d, bow)
+	}
+	if d := pos.HaversineDistanceTo(ring[0]); math.Abs(d-math.Hypot(20, 5)) > 0.5 || ring[0].Lat >= pos.Lat {
+		t.Errorf("Expected the stern on starboard to be 20 m behind and 5 m south, got %.1f m away at %v", d, ring[0])
+	}
+
+	if g := outlineOf(t, 80, 20, 15, 5, float32(math.NaN()), true); g.Polygon || len(g.Coordinates) != 1 {
+		t.Errorf("Expected a point without a heading, got %+v", g)
+	}
+	if g := outlineOf(t, 0, 0, 0, 0, 90, true); g.Polygon || len(g.Coordinates) != 1 {
+		t.Errorf("Expected a point without dimensions, got %+v", g)
+	}
+	if g := outlineOf(t, 80, 20, 15, 5, 90, false); g.Polygon || len(g.Coordinates) != 1 {
+		t.Errorf("Expected a point without shapes, got %+v", g)
+	}
+	for _, lat := range []float64{90, -90, 89.995} {
+		if g := outlineAt(t, lat, 80, 20, 15, 5, 90, true); g.Polygon || len(g.Coordinates) != 1 {
+			t.Errorf("Expected a point at latitude %f, got %+v", lat, g)
+		}
+	}
+
+	g = outlineOf(t, 511, 511, 63, 63, 0, true)
+	// heading north, so the length is the difference in latitude
+	if !g.Polygon {
+		t.Errorf("Expected absurd dimensions to be clamped, got %+v", g)
+	} else if length := (g.Coordinates[2].Lat - g.Coordinates[0].Lat) * 60 * 1852; length > maxOutlineMeters+1 {
+		t.Errorf("Expected absurd dimensions to be clamped, the outline is %.0f m long", length)
+	}
+}
@@ -12,12 +12,17 @@ Notes:
     - Leaf nodes contains entries of the form  <mbr, mmsi>
      - Wiki: best performance has been experienced with a minimum fill of 30%–40% of the maximum number of entries
     - Boats are stored as zero-area rectangles instead of points, because it works better with the R*tree
+    - Readers never lock: Writers copy every node they change (and the path to it from the root),
+      and then publish the new root atomically. Readers search the published root, which never changes.
+      The parent pointers are only used by writers, and always point to the newest copy.
 */
 
 import (
 	"errors"
 	"log"
 	"sort"
+	"sync"
+	"sync/atomic"
 
 	"github.com/tormol/AIS/geo"
 )
@@ -26,14 +31,58 @@ const RTree_M = 5 //max entries per node.
 const RTree_m = 2 //min entries per node.	40% of M is best
 
 // RTree is a two-dimensional R*-tree implementation with float64 positions and uint32 values
+// It can be searched while it's being updated, but only one update runs at a time.
 type RTree struct {
+	root       *node  //The root being changed, only accessed with writeLock held
+	numOfBoats int    //Also only accessed with writeLock held
+	gen        uint64 //Nodes with this generation haven't been published yet and can be changed in place
+	writeLock  sync.Mutex
+	published  atomic.Value //*snapshot: what readers see
+}
+
+// snapshot is the state of the tree after an update.
+type snapshot struct {
 	root       *node
 	numOfBoats int
 }
 
+// publish makes the changes visible to readers.
+// Nodes must be copied before they are changed after this.
+func (rt *RTree) publish() {
+	rt.published.Store(&snapshot{rt.root, rt.numOfBoats})
+	rt.gen++
+}
+
+// snapshot returns the most recently published state.
+func (rt *RTree) snapshot() *snapshot {
+	return rt.published.Load().(*snapshot)
+}
+
 // NumOfBoats return the total number of boats stored in the structure.
 func (rt *RTree) NumOfBoats() int {
-	return rt.numOfBoats
+	return rt.snapshot().numOfBoats
+}
+
+// Height returns the number of levels in the tree, including the leaves.
+func (rt *RTree) Height() int {
+	return rt.snapshot().root.height + 1
+}
+
+// NodeCount walks the tree to count its nodes.
+// Together with Height() and NumOfBoats() it can show if the tree has degenerated.
+func (rt *RTree) NodeCount() int {
+	return rt.snapshot().root.count()
+}
+
+// count returns the number of nodes in the subtree.
+func (n *node) count() int {
+	nodes := 1
+	if !n.isLeaf() {
+		for _, e := range n.entries {
+			nodes += e.child.count()
+		}
+	}
+	return nodes
 }
 
 // Match is used to store a match found when searching the tree.
@@ -47,6 +96,7 @@ type node struct {
 	parent  *node   //Points to parent node
 	entries []entry //Array of all the node's entries    (should have a default length of M+1)
 	height  int     //Height of the node ( = number of edges between node and a leafnode)
+	gen     uint64  //The generation of the tree when the node was created or copied
 }
 
 // isLeaf returns true of the node is a leafnode.
@@ -101,17 +151,58 @@ func (e byDist) Less(i, j int) bool { return e[i].dist < e[j].dist }
 
 // NewRTree returns a pointer to a new R-Tree object.
 func NewRTree() *RTree { //TODO could take M (and m) as input?
-	return &RTree{
+	rt := &RTree{
 		root: &node{
 			parent:  nil,
 			entries: make([]entry, 0, RTree_M+1),
 			height:  0,
 		},
 	}
+	rt.publish()
+	return rt
+}
+
+// writable returns a node that can be changed in place instead of n.
+// If n has been published it's copied, and so is its parent (recursively),
+// and the copy replaces n in the tree.
+func (rt *RTree) writable(n *node) *node {
+	if n.gen == rt.gen {
+		return n
+	}
+	c := &node{
+		parent:  n.parent,
+		entries: make([]entry, len(n.entries), RTree_M+1),
+		height:  n.height,
+		gen:     rt.gen,
+	}
+	copy(c.entries, n.entries)
+	if !c.isLeaf() {
+		for _, e := range c.entries {
+			e.child.parent = c
+		}
+	}
+	if n == rt.root {
+		rt.root = c
+		return c
+	}
+	idx, err := n.parentEntriesIdx()
+	CheckErr(err, "writable could not find the node in its parent")
+	c.parent = rt.writable(n.parent)
+	c.parent.entries[idx].child = c
+	return c
 }
 
 // InsertData inserts a new boat into the tree structure.
 func (rt *RTree) InsertData(lat, long float64, mmsi uint32) error {
+	rt.writeLock.Lock()
+	defer rt.writeLock.Unlock()
+	err := rt.insertData(lat, long, mmsi)
+	rt.publish()
+	return err
+}
+
+// insertData is InsertData without locking or publishing.
+func (rt *RTree) insertData(lat, long float64, mmsi uint32) error {
 	r, err := geo.NewRectangle(lat, long, lat, long)
 	if err != nil {
 		return err
@@ -129,7 +220,7 @@ func (rt *RTree) InsertData(lat, long float64, mmsi uint32) error {
 // insert inserts an entry into a node at a given height.
 func (rt *RTree) insert(height int, newEntry entry, first bool) { //first is needed in case of overflowTreatment, it should normaly be true
 	//[I1]    ChooseSubtree with height as a parameter to find the node N
-	n := rt.chooseSubtree(newEntry.mbr, height)
+	n := rt.writable(rt.chooseSubtree(newEntry.mbr, height))
 	//If an internal entry is re-inserted, the node's parent pointer must be updated
 	if height >= 1 {
 		newEntry.child.parent = n
@@ -145,6 +236,7 @@ func (rt *RTree) insert(height int, newEntry entry, first bool) { //first is nee
 					parent:  nil,
 					entries: make([]entry, 0, RTree_M+1),
 					height:  rt.root.height + 1,
+					gen:     rt.gen,
 				}
 				nEntry := entry{mbr: n.recalculateMBR(), child: n}
 				nnEntry := entry{mbr: nn.recalculateMBR(), child: nn}
@@ -187,29 +279,38 @@ func (rt *RTree) overflowTreatment(n *node, first bool) (bool, *node) { //return
 // reInsert is uses to re-insert some of the entries of the node.
 // It is used when the node is full.
 func (rt *RTree) reInsert(n *node) {
-	//[RI1] for all M+1 entries: compute distance between their center and the center of the mbr of n
 	//    Finding the center of the MBR of n
 	i, err := n.parentEntriesIdx()
 	CheckErr(err, "reInsert had some trouble locating the entry in the parent node")
 	centerOfMBR := n.parent.entries[i].mbr.Center()
-	//    Computing the distance for all entries in n
-	for _, ent := range n.entries {
-		ent.dist = ent.mbr.Center().DistanceTo(centerOfMBR)
-	}
-	//[RI2] sort the entries by distance in decreasing order
-	sort.Sort(sort.Reverse(byDist(n.entries)))
-	//[RI3]    remove the first p entries from n, and adjust mbr of n
+	//[RI2] & [RI3]    remove the first p entries from n, and adjust mbr of n
 	f := (RTree_M * 0.3) //30% of M performs best according to [9]
 	p := int(f)
-	tmp := make([]entry, p)
-	copy(tmp, n.entries[:p])
-	n.entries = n.entries[p:] //TODO now the cap of n.entries is only 8...
+	removed := n.removeFarthest(centerOfMBR, p)
 	newMBR := n.recalculateMBR()
 	n.parent.entries[i].mbr = newMBR
 	//[RI4]    starting with min distance: invoke insert to reinsert the entries
-	for k := len(tmp) - 1; k >= 0; k-- {
-		rt.insert(n.height, tmp[k], false) // "first" is set to false because the entry has previously been inserted
+	for k := len(removed) - 1; k >= 0; k-- {
+		rt.insert(n.height, removed[k], false) // "first" is set to false because the entry has previously been inserted
+	}
+}
+
+// removeFarthest removes the p entries whose center is farthest from center,
+// and returns them sorted by decreasing distance.
+// The remaining entries are moved to a new slice with room for M+1 entries,
+// so that appending to n.entries won't overwrite the returned entries.
+func (n *node) removeFarthest(center geo.Point, p int) []entry {
+	//[RI1]    for all M+1 entries: compute distance between their center and the center of the mbr of n
+	for i := range n.entries {
+		n.entries[i].dist = n.entries[i].mbr.Center().DistanceTo(center)
 	}
+	//[RI2] sort the entries by distance in decreasing order
+	sort.Sort(sort.Reverse(byDist(n.entries)))
+	removed := n.entries[:p]
+	remaining := make([]entry, len(n.entries)-p, RTree_M+1)
+	copy(remaining, n.entries[p:])
+	n.entries = remaining
+	return removed
 }
 
 // chooseSubtree chooses the leaf node (or the best node of a given height) in which to place a new entry.
@@ -285,6 +386,7 @@ func (n *node) split() (*node, error) {
 		parent:  n.parent,
 		entries: []entry{},
 		height:  n.height,
+		gen:     n.gen,
 	}
 	for i, e := range n.entries {
 		if i < RTree_m-1+k {
@@ -421,42 +523,89 @@ func mbrOf(entries ...entry) *geo.Rectangle {
 }
 
 // FindWithin returns all the boats that overlaps a given rectangle of the map [0].
+// It doesn't block or get blocked by updates, but might not see the most recent one.
 func (rt *RTree) FindWithin(r *geo.Rectangle) *[]Match {
-	n := rt.root
-	matches := []entry{}
-	if !n.isLeaf() {
-		matches = append(matches, n.searchChildren(r, matches)...)
-	} else { //only need to search the root node
-		for _, e := range n.entries {
-			if geo.Overlaps(e.mbr, r) {
-				matches = append(matches, e)
-			}
+	matches := []Match{}
+	rt.VisitWithin(r, func(mmsi uint32, lat, long float64) bool {
+		matches = append(matches, Match{mmsi, lat, long})
+		return true
+	})
+	return &matches
+}
+
+// VisitWithin calls visit for each boat that overlaps a rectangle while the
+// tree is being searched, and stops searching when visit returns false.
+// Like FindWithin it searches the most recently published version of the tree.
+func (rt *RTree) VisitWithin(r *geo.Rectangle, visit func(mmsi uint32, lat, long float64) bool) {
+	rt.snapshot().root.visitWithin(r, visit)
+}
+
+// FindWithinAny returns all the boats that overlaps at least one of the rectangles.
+// Boats within multiple rectangles are only returned once.
+// All the rectangles are searched in the same version of the tree.
+func (rt *RTree) FindWithinAny(rects []geo.Rectangle) *[]Match {
+	all := []Match{}
+	rt.VisitWithinAny(rects, func(mmsi uint32, lat, long float64) bool {
+		all = append(all, Match{mmsi, lat, long})
+		return true
+	})
+	return &all
+}
+
+// VisitWithinAny is VisitWithin for boats that overlaps at least one of the rectangles.
+// Boats within multiple rectangles are only visited once.
+// All the rectangles are searched in the same version of the tree.
+func (rt *RTree) VisitWithinAny(rects []geo.Rectangle, visit func(mmsi uint32, lat, long float64) bool) {
+	root := rt.snapshot().root
+	visit = visitOnce(len(rects), visit)
+	for i := range rects {
+		if !root.visitWithin(&rects[i], visit) {
+			return
 		}
 	}
-	return rt.toMatches(matches)
 }
 
-// searchChildren is the recursive method for finding the nodes whose mbr overlaps the searchBox [0].
-func (n *node) searchChildren(searchBox *geo.Rectangle, matches []entry) []entry { //TODO Test performance by searching children concurrently?
-	if !n.isLeaf() { //Internal node:
-		for _, e := range n.entries {
-			if geo.Overlaps(e.mbr, searchBox) {
-				matches = e.child.searchChildren(searchBox, matches) //recursively search the child node
-			}
+// visitOnce returns a visit function that skips boats that have already been
+// visited, if there are several searches where a boat could be found again.
+func visitOnce(searches int, visit func(mmsi uint32, lat, long float64) bool) func(mmsi uint32, lat, long float64) bool {
+	if searches <= 1 {
+		return visit
+	}
+	seen := make(map[uint32]struct{})
+	return func(mmsi uint32, lat, long float64) bool {
+		if _, dup := seen[mmsi]; dup {
+			return true
 		}
-	} else { //Leaf node:
-		for _, e := range n.entries {
-			if geo.Overlaps(e.mbr, searchBox) {
-				matches = append(matches, e)
+		seen[mmsi] = struct{}{}
+		return visit(mmsi, lat, long)
+	}
+}
+
+// visitWithin is the recursive method for finding the boats whose mbr overlaps the searchBox [0].
+// Returns false if visit stopped the search.
+func (n *node) visitWithin(searchBox *geo.Rectangle, visit func(mmsi uint32, lat, long float64) bool) bool { //TODO Test performance by searching children concurrently?
+	for _, e := range n.entries {
+		if !geo.Overlaps(e.mbr, searchBox) {
+			continue
+		}
+		if !n.isLeaf() { //Internal node: recursively search the child node
+			if !e.child.visitWithin(searchBox, visit) {
+				return false
 			}
+		} else if pos := e.mbr.Max(); !visit(e.mmsi, pos.Lat, pos.Long) {
+			return false
 		}
 	}
-	return matches
+	return true
 }
 
 // Update is used to update the location of a boat that is already stored in the structure.
 // It deletes the old entry, and inserts a new entry.
+// Readers see both changes at once, so the boat never disappears.
 func (rt *RTree) Update(mmsi uint32, oldLat, oldLong, newLat, newLong float64) error {
+	rt.writeLock.Lock()
+	defer rt.writeLock.Unlock()
+	defer rt.publish()
 	// Old coordinates
 	oldR, err := geo.NewRectangle(oldLat, oldLong, oldLat, oldLong)
 	if err != nil {
@@ -468,15 +617,29 @@ func (rt *RTree) Update(mmsi uint32, oldLat, oldLong, newLat, newLong float64) e
 		return err
 	}
 	// Inserts the new coordinates
-	rt.InsertData(newLat, newLong, mmsi)
+	rt.insertData(newLat, newLong, mmsi)
 	return nil
 }
 
+// Remove deletes a boat from the structure.
+func (rt *RTree) Remove(mmsi uint32, lat, long float64) error {
+	rt.writeLock.Lock()
+	defer rt.writeLock.Unlock()
+	r, err := geo.NewRectangle(lat, long, lat, long)
+	if err != nil {
+		return errors.New("Illegal coordinates, please use <latitude, longitude> coodinates")
+	}
+	err = rt.delete(mmsi, r)
+	rt.publish()
+	return err
+}
+
 // delete removes the Point(zero-area Rectangle) from the RTree [0].
 func (rt *RTree) delete(mmsi uint32, r *geo.Rectangle) error {
 	//D1 [Find node containing record] (and also the index of the entry)
 	l, idx := rt.root.findLeaf(mmsi, r)
 	if l != nil && idx >= 0 {
+		l = rt.writable(l)
 		//D2 [Delete record]
 		l.entries = append(l.entries[:idx], l.entries[idx+1:]...)
 		//D3 [Propagate changes]
@@ -561,15 +724,6 @@ func (n *node) parentEntriesIdx() (int, error) {
 	return -1, errors.New("This node is not found in parent's entries")
 }
 
-// toMatches returns a slice of Match-objects that can be used to create GeoJSON output
-func (rt *RTree) toMatches(matches []entry) *[]Match {
-	s := []Match{}
-	for _, m := range matches {
-		s = append(s, Match{m.mmsi, m.mbr.Max().Lat, m.mbr.Max().Long})
-	}
-	return &s
-}
-
 // CheckErr is a function for checking an error.
 // Takes the error and a message as input and does log.Fatalf() if error.
 func CheckErr(err error, message string) {
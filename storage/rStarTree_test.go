@@ -3,6 +3,7 @@ package storage
 import (
 	"math"
 	"math/rand"
+	"sync"
 	"testing"
 
 	"github.com/tormol/AIS/geo"
@@ -46,6 +47,69 @@ func TestCondenseSingleLeaf(t *testing.T) {
 	rt.Update(1, 1.0, 1.0, -1.0, -1.0)
 }
 
+// leafEntry creates a leaf entry for a boat at lat,long.
+func leafEntry(mmsi uint32, lat, long float64) entry {
+	r, _ := geo.NewRectangle(lat, long, lat, long)
+	return entry{mbr: r, mmsi: mmsi}
+}
+
+func TestReInsertRemovesFarthest(t *testing.T) {
+	// n is overfull, and the boat farthest from the center of its MBR is
+	// closer to the other leaf. (the MBR is symmetric along one axis so the
+	// outlier must also be at the edge in the other)
+	n := &node{height: 0, entries: []entry{
+		leafEntry(0, 0, 0.5),
+		leafEntry(1, 1, 0),
+		leafEntry(2, 1, 1),
+		leafEntry(3, 9, 1), // the outlier
+		leafEntry(4, 2, 0),
+		leafEntry(5, 2, 1),
+	}}
+	other := &node{height: 0, entries: []entry{
+		leafEntry(6, 10, 1),
+		leafEntry(7, 11, 1),
+	}}
+	root := &node{height: 1, entries: []entry{
+		{mbr: n.recalculateMBR(), child: n},
+		{mbr: other.recalculateMBR(), child: other},
+	}}
+	n.parent, other.parent = root, root
+	rt := &RTree{root: root, numOfBoats: 8}
+
+	rt.reInsert(n)
+	if len(n.entries) != RTree_M || cap(n.entries) < RTree_M+1 {
+		t.Fatalf("expected %d entries with room for one more, got %d/%d",
+			RTree_M, len(n.entries), cap(n.entries))
+	}
+	for _, e := range n.entries {
+		if e.mmsi == 3 {
+			t.Error("the outlier was not removed")
+		}
+	}
+	if len(other.entries) != 3 || other.entries[2].mmsi != 3 {
+		t.Errorf("the outlier wasn't reinserted into the closest leaf: %v", other.entries)
+	}
+	if n.parent.entries[0].mbr.Max().Lat != 2 {
+		t.Errorf("the MBR of n wasn't shrunk: %v", *n.parent.entries[0].mbr)
+	}
+}
+
+func TestRemoveFarthest(t *testing.T) {
+	n := &node{entries: make([]entry, 0, RTree_M+1)}
+	for i, lat := range []float64{3, -1, 0, 7, -5, 2} {
+		n.entries = append(n.entries, leafEntry(uint32(i), lat, 0))
+	}
+	removed := n.removeFarthest(geo.Point{Lat: 0, Long: 0}, 2)
+	if len(removed) != 2 || removed[0].mmsi != 3 || removed[1].mmsi != 4 {
+		t.Fatalf("expected boat 3 and 4 to be removed, got %v", removed)
+	}
+	// appending to n must not overwrite the removed entries
+	n.entries = append(n.entries, leafEntry(6, 0, 0), leafEntry(7, 0, 0))
+	if removed[0].mmsi != 3 || removed[1].mmsi != 4 {
+		t.Errorf("removed entries were overwritten: %v", removed)
+	}
+}
+
 func TestInsertData(t *testing.T) {
 	num := 100000
 	rt := NewRTree()
@@ -83,7 +147,15 @@ func TestInsertData(t *testing.T) {
 		t.Log("FindAll did not find the correct amount of boats. Found", numFound, ", expected", num)
 		t.Fail()
 	}
-
+	// every node except the root has between RTree_m and RTree_M entries
+	if nodes := rt.NodeCount(); nodes <= num/RTree_M || nodes >= num {
+		t.Errorf("Expected between %d and %d nodes, got %d", num/RTree_M, num, nodes)
+	}
+	minHeight := int(math.Ceil(math.Log(float64(num)) / math.Log(RTree_M)))
+	maxHeight := int(math.Log(float64(num))/math.Log(RTree_m)) + 1
+	if h := rt.Height(); h < minHeight || h > maxHeight {
+		t.Errorf("Expected the height to be between %d and %d, got %d", minHeight, maxHeight, h)
+	}
 }
 
 func TestUpdate(t *testing.T) {
@@ -136,6 +208,32 @@ func TestUpdate(t *testing.T) {
 	}
 }
 
+func TestRemove(t *testing.T) {
+	rt := NewRTree()
+	boats := createBoats(1000)
+	for _, b := range boats {
+		rt.InsertData(b.lat, b.long, b.mmsi)
+	}
+	for _, b := range boats[:900] {
+		if err := rt.Remove(b.mmsi, b.lat, b.long); err != nil {
+			t.Fatalf("Failed to remove %v: %s", b, err.Error())
+		}
+	}
+	all, _ := geo.NewRectangle(-90, -180, 90, 180)
+	found := *rt.FindWithin(all)
+	if rt.NumOfBoats() != 100 || len(found) != 100 {
+		t.Fatalf("Expected 100 boats left, got %d and found %d", rt.NumOfBoats(), len(found))
+	}
+	for _, m := range found {
+		if m.MMSI < boats[900].mmsi {
+			t.Errorf("Found removed boat %d", m.MMSI)
+		}
+	}
+	if err := rt.Remove(boats[0].mmsi, boats[0].lat, boats[0].long); err == nil {
+		t.Error("Expected removing a boat twice to fail")
+	}
+}
+
 func TestWithin(t *testing.T) {
 	//Inserting the points
 	rt := NewRTree()
@@ -200,6 +298,88 @@ func TestWithin(t *testing.T) {
 	}
 }
 
+func TestFindWithinAny(t *testing.T) {
+	rt := NewRTree()
+	for i, p := range [][2]float64{{0, 0}, {1, 1}, {2, 2}, {10, 10}, {-10, 170}} {
+		rt.InsertData(p[0], p[1], uint32(i))
+	}
+	rect := func(minLat, minLong, maxLat, maxLong float64) geo.Rectangle {
+		r, _ := geo.NewRectangle(minLat, minLong, maxLat, maxLong)
+		return *r
+	}
+	cases := []struct {
+		rects    []geo.Rectangle
+		expected []uint32
+	}{
+		{[]geo.Rectangle{}, []uint32{}},
+		{[]geo.Rectangle{rect(-1, -1, 1.5, 1.5)}, []uint32{0, 1}},
+		// overlapping
+		{[]geo.Rectangle{rect(-1, -1, 1.5, 1.5), rect(0.5, 0.5, 3, 3)}, []uint32{0, 1, 2}},
+		{[]geo.Rectangle{rect(-1, -1, 3, 3), rect(-1, -1, 3, 3)}, []uint32{0, 1, 2}},
+		// disjoint
+		{[]geo.Rectangle{rect(-1, -1, 0.5, 0.5), rect(9, 9, 11, 11), rect(-11, 160, -9, 180)}, []uint32{0, 3, 4}},
+	}
+	for i, c := range cases {
+		matches := *rt.FindWithinAny(c.rects)
+		found := make(map[uint32]int)
+		for _, m := range matches {
+			found[m.MMSI]++
+		}
+		if len(matches) != len(c.expected) || len(found) != len(c.expected) {
+			t.Errorf("case %d: expected %v, got %v", i, c.expected, matches)
+			continue
+		}
+		for _, mmsi := range c.expected {
+			if found[mmsi] != 1 {
+				t.Errorf("case %d: expected %v, got %v", i, c.expected, matches)
+				break
+			}
+		}
+	}
+}
+
+func TestConcurrentFindWithin(t *testing.T) {
+	num := 1000
+	rt := NewRTree()
+	boats := createBoats(num)
+	for _, b := range boats {
+		rt.InsertData(b.lat, b.long, b.mmsi)
+	}
+	newBoats := createBoats(10000) // every boat is moved ten times
+	all, _ := geo.NewRectangle(-90, -180, 90, 180)
+	stop := make(chan struct{})
+	wg := sync.WaitGroup{}
+	for r := 0; r < 8; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if found := len(*rt.FindWithin(all)); found != num {
+					t.Errorf("Found %d boats while updating, expected %d", found, num)
+					return
+				}
+			}
+		}()
+	}
+	for i, nb := range newBoats {
+		b := &boats[i%num]
+		if err := rt.Update(b.mmsi, b.lat, b.long, nb.lat, nb.long); err != nil {
+			t.Fatalf("Update %d failed: %s", i, err.Error())
+		}
+		b.lat, b.long = nb.lat, nb.long
+	}
+	close(stop)
+	wg.Wait()
+	if found := len(*rt.FindWithin(all)); found != num || rt.NumOfBoats() != num {
+		t.Errorf("Expected %d boats after updating, found %d and counted %d", num, found, rt.NumOfBoats())
+	}
+}
+
 /*	BENCHMARKS	*/
 func BenchmarkInsertData(b *testing.B) {
 	rt := NewRTree()
@@ -252,6 +432,24 @@ func BenchmarkFindWithin18x18(b *testing.B) {
 	}
 }
 
+//Searching 1x1 rectangles around the clusters of clustered boats
+func BenchmarkFindWithinClustered(b *testing.B) {
+	rt := NewRTree()
+	boats, centers := createClusteredBoats(25000, 50)
+	for i := 0; i < len(boats); i++ {
+		rt.InsertData(boats[i].lat, boats[i].long, boats[i].mmsi)
+	}
+	rects := make([]*geo.Rectangle, b.N)
+	for i := range rects {
+		c := centers[rand.Intn(len(centers))]
+		rects[i], _ = geo.NewRectangle(c.lat-0.5, c.long-0.5, c.lat+0.5, c.long+0.5)
+	}
+	b.ResetTimer() //start the timer from here
+	for i := 0; i < b.N; i++ {
+		rt.FindWithin(rects[i])
+	}
+}
+
 func BenchmarkFindAll(b *testing.B) {
 	rt := NewRTree()
 	boats := createBoats(25000)
@@ -265,6 +463,64 @@ func BenchmarkFindAll(b *testing.B) {
 	}
 }
 
+//Searching 18x18 rectangles from all CPUs while the boats are being moved
+func BenchmarkFindWithinWhileUpdating(b *testing.B) {
+	rt := NewRTree()
+	boats := createBoats(25000)
+	for i := 0; i < len(boats); i++ {
+		rt.InsertData(boats[i].lat, boats[i].long, boats[i].mmsi)
+	}
+	newBoats := createBoats(len(boats))
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i = (i + 1) % len(boats) {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			rt.Update(boats[i].mmsi, boats[i].lat, boats[i].long, newBoats[i].lat, newBoats[i].long)
+			boats[i], newBoats[i] = newBoats[i], boats[i] // same MMSI
+		}
+	}()
+	rects := createFixedSizeRects(1000)
+	b.ResetTimer() //start the timer from here
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			rt.FindWithin(rects[i%len(rects)])
+		}
+	})
+	b.StopTimer()
+	close(stop)
+	<-done
+}
+
+// Create n boats spread around nClusters random points, like ships near ports.
+// Also returns the centers of the clusters.
+func createClusteredBoats(n, nClusters int) ([]testBoat, []testBoat) {
+	mmsiCount = 0 //reset the mmsi
+	centers := make([]testBoat, nClusters)
+	for i := range centers {
+		centers[i] = testBoat{
+			long: float64(rand.Int31n(170)) * RandSign(),
+			lat:  float64(rand.Int31n(80)) * RandSign(),
+		}
+	}
+	boats := make([]testBoat, n)
+	for i := range boats {
+		c := centers[i%nClusters]
+		boats[i] = testBoat{
+			mmsi: mmsiCount,
+			long: c.long + rand.NormFloat64(),
+			lat:  c.lat + rand.NormFloat64(),
+		}
+		mmsiCount++
+	}
+	return boats, centers
+}
+
 // Creates n random rectangles
 func createRects(n int) []*geo.Rectangle {
 	rects := make([]*geo.Rectangle, n, n)
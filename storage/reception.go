@@ -0,0 +1,145 @@
+package storage
+
+// Counts how often and from where each ship is received
+
+import (
+	"sync"
+	"time"
+)
+
+// maxReceptionSources is how many different sources are remembered for each ship.
+const maxReceptionSources = 8
+
+// intervalWeight is how much each new interval between position reports
+// moves the average, see reception.addPosition().
+const intervalWeight = 0.125
+
+// reception is statistics about the messages received about a ship, for
+// finding out which ships have reliable tracks and where coverage is poor.
+// As there is one per ship it's kept small: source names are stored as
+// numbers from ShipDB.sources, and times as Unix nanoseconds.
+type reception struct {
+	firstSeen    int64                       // when the first message was received
+	lastPosition int64                       // when the last position report was received
+	positions    uint32                      // position reports received
+	statics      uint32                      // static reports received
+	interval     float32                     // moving average of seconds between position reports
+	sources      [maxReceptionSources]uint16 // from sourceNames.id(), 0 for none
+}
+
+// seen counts a message received at from source.
+// Messages received at an unknown time only count.
+func (r *reception) seen(source uint16, at time.Time) {
+	if !at.IsZero() && (r.firstSeen == 0 || at.UnixNano() < r.firstSeen) {
+		r.firstSeen = at.UnixNano()
+	}
+	for i, s := range r.sources {
+		if s == source {
+			break
+		} else if s == 0 {
+			r.sources[i] = source
+			break
+		}
+	}
+}
+
+// addPosition counts a position report received at from source, and updates
+// the exponentially weighted moving average of intervals between them.
+// Reports received before the previous one don't change the average.
+func (r *reception) addPosition(source uint16, at time.Time) {
+	r.positions++
+	r.seen(source, at)
+	if at.IsZero() {
+		return
+	}
+	if r.lastPosition != 0 && at.UnixNano() > r.lastPosition {
+		interval := float32(time.Duration(at.UnixNano() - r.lastPosition).Seconds())
+		if r.interval == 0 {
+			r.interval = interval
+		} else {
+			r.interval += (interval - r.interval) * intervalWeight
+		}
+	}
+	if at.UnixNano() > r.lastPosition {
+		r.lastPosition = at.UnixNano()
+	}
+}
+
+// addStatic counts a static report received at from source.
+func (r *reception) addStatic(source uint16, at time.Time) {
+	r.statics++
+	r.seen(source, at)
+}
+
+// sourceNames gives each source a number so that ships don't need to store
+// the names, see reception.
+type sourceNames struct {
+	lock  sync.RWMutex
+	ids   map[string]uint16
+	names []string
+}
+
+// maxSourceNames bounds the memory used by sourceNames,
+// sources after that are not remembered by any ship.
+const maxSourceNames = 1<<16 - 1
+
+// id returns the number of a source, which is never 0,
+// or 0 if there are too many sources.
+func (sn *sourceNames) id(name string) uint16 {
+	sn.lock.RLock()
+	id, known := sn.ids[name]
+	sn.lock.RUnlock()
+	if known {
+		return id
+	}
+	sn.lock.Lock()
+	defer sn.lock.Unlock()
+	if id, known = sn.ids[name]; known {
+		return id
+	} else if len(sn.names) >= maxSourceNames {
+		return 0
+	} else if sn.ids == nil {
+		sn.ids = make(map[string]uint16)
+	}
+	sn.names = append(sn.names, name)
+	id = uint16(len(sn.names))
+	sn.ids[name] = id
+	return id
+}
+
+// name returns the name of a source from id().
+func (sn *sourceNames) name(id uint16) string {
+	sn.lock.RLock()
+	defer sn.lock.RUnlock()
+	return sn.names[id-1]
+}
+
+// receptionProp is how reception is shown in shipProp.
+type receptionProp struct {
+	Positions       uint32     `json:"position_messages"`
+	Statics         uint32     `json:"static_messages"`
+	Sources         []string   `json:"sources"` // at most maxReceptionSources
+	FirstSeen       *time.Time `json:"first_seen,omitempty"`
+	AverageInterval *float32   `json:"average_interval_seconds,omitempty"` // of position reports
+}
+
+// receptionProperties returns the reception statistics of a ship.
+// `s.mu` should be held while calling this.
+func (db *ShipDB) receptionProperties(s *ship) *receptionProp {
+	r := &s.reception
+	prop := &receptionProp{Positions: r.positions, Statics: r.statics, Sources: []string{}}
+	for _, id := range r.sources {
+		if id != 0 {
+			prop.Sources = append(prop.Sources, db.sources.name(id))
+		}
+	}
+	if r.firstSeen != 0 {
+		firstSeen := time.Unix(0, r.firstSeen).UTC()
+		prop.FirstSeen = &firstSeen
+	}
+	if r.interval != 0 {
+		interval := roundFloat32(r.interval, 1)
+		prop.AverageInterval = &interval
+	}
+	return prop
+}
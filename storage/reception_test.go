@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/tormol/AIS/geo"
+)
+
+// receptionOf returns the reception object of a ship from SelectTrack.
+func receptionOf(t *testing.T, db *ShipDB, mmsi uint32) receptionProp {
+	var fc struct {
+		Features []struct {
+			Properties struct {
+				Reception receptionProp `json:"reception"`
+			} `json:"properties"`
+		} `json:"features"`
+	}
+	selected := db.SelectTrack(mmsi, geo.FullPrecision, 0, 0, false, nil)
+	if err := json.Unmarshal([]byte(selected), &fc); err != nil || len(fc.Features) == 0 {
+		t.Fatalf("Bad JSON from SelectTrack: %v\n%s", err, selected)
+	}
+	return fc.Features[0].Properties.Reception
+}
+
+func TestReception(t *testing.T) {
+	db := NewShipDB(100, 0, 50, time.Minute, 0, 0, 0)
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	received := start
+	for i := 0; i < 50; i++ {
+		// ten seconds apart, then two seconds apart
+		if i >= 25 {
+			received = received.Add(2 * time.Second)
+		} else if i > 0 {
+			received = received.Add(10 * time.Second)
+		}
+		pos := UnknownPos
+		pos.At, pos.Received = received, received
+		pos.Pos = geo.Point{Lat: 60, Long: 5 + float64(i)/100}
+		source := "a"
+		if i%2 == 1 {
+			source = "b"
+		}
+		db.UpdateDynamic(1, source, pos)
+		if i == 24 {
+			expectInterval := float32(10)
+			if r := receptionOf(t, db, 1); r.AverageInterval == nil || *r.AverageInterval != expectInterval {
+				t.Errorf("Expected an average interval of 10s after 25 reports, got %+v", r)
+			}
+		}
+	}
+	db.UpdateStatic(1, "a", received, ShipInfo{ShipName: "TEST"})
+	db.UpdateStatic(1, "b", received, ShipInfo{ShipName: "TEST"})
+
+	r := receptionOf(t, db, 1)
+	if r.Positions != 50 || r.Statics != 2 {
+		t.Errorf("Expected 50 position and 2 static messages, got %+v", r)
+	}
+	if len(r.Sources) != 2 || r.Sources[0] != "a" || r.Sources[1] != "b" {
+		t.Errorf("Expected sources a and b, got %v", r.Sources)
+	}
+	if r.FirstSeen == nil || !r.FirstSeen.Equal(start) {
+		t.Errorf("Expected first seen %s, got %v", start, r.FirstSeen)
+	}
+	// each interval moves the average 1/8 of the way, so after 25 it's close
+	if r.AverageInterval == nil || math.Abs(float64(*r.AverageInterval)-2) > 0.5 {
+		t.Errorf("Expected an average interval close to 2s, got %+v", r)
+	}
+
+	for i := 0; i < 2*maxReceptionSources; i++ {
+		db.UpdateStatic(2, fmt.Sprintf("source%d", i), received, ShipInfo{ShipName: "TEST"})
+	}
+	if r := receptionOf(t, db, 2); len(r.Sources) != maxReceptionSources || r.AverageInterval != nil {
+		t.Errorf("Expected %d sources and no interval, got %+v", maxReceptionSources, r)
+	}
+
+	matches := []Match{{MMSI: 1, Lat: 60, Long: 5.49}}
+	var fc struct {
+		Features []struct {
+			Properties mProp `json:"properties"`
+		} `json:"features"`
+	}
+	if err := json.Unmarshal([]byte(Matches(&matches, db, 5, false, true, nil)), &fc); err != nil {
+		t.Fatal(err)
+	} else if len(fc.Features) != 1 || fc.Features[0].Properties.FirstSeen == nil ||
+		!fc.Features[0].Properties.FirstSeen.Equal(start) {
+		t.Errorf("Expected first_seen with verbose, got %+v", fc.Features)
+	}
+	if text := Matches(&matches, db, 5, false, false, nil); strings.Contains(text, "first_seen") {
+		t.Errorf("Expected no first_seen without verbose, got %s", text)
+	}
+}
+
+func TestReceptionIsSmall(t *testing.T) {
+	if size := unsafe.Sizeof(reception{}); size > 100 {
+		t.Errorf("Expected the reception statistics of a ship to use at most 100 bytes, they use %d", size)
+	}
+}
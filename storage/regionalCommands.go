@@ -0,0 +1,193 @@
+package storage
+
+// Keeps recent channel management and group assignment commands for diagnostics
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tormol/AIS/geo"
+	l "github.com/tormol/AIS/logger"
+	"github.com/tormol/AIS/nmeais"
+)
+
+// ReceivedCommand is a regional command and when it was received.
+type ReceivedCommand struct {
+	At time.Time
+	nmeais.RegionalCommand
+}
+
+// RegionalCommandLog keeps the most recent regional commands (AIS message
+// type 22 and 23) from each base station.
+// They aren't acted on, but explain why ships in an area might suddenly change
+// how often they report.
+// Both the number of commands per station and the number of stations are
+// bounded, so that a misbehaving or spoofing source can't use up memory.
+type RegionalCommandLog struct {
+	mu          sync.Mutex
+	perStation  int
+	maxStations int
+	stations    map[uint32][]ReceivedCommand // oldest first
+}
+
+// NewRegionalCommandLog creates an empty log which keeps at most perStation
+// commands from each of at most maxStations stations.
+func NewRegionalCommandLog(perStation, maxStations uint) *RegionalCommandLog {
+	return &RegionalCommandLog{
+		perStation:  int(perStation),
+		maxStations: int(maxStations),
+		stations:    make(map[uint32][]ReceivedCommand),
+	}
+}
+
+// Add stores a command, and forgets the oldest one from the same station if
+// it has sent too many.
+// If there are too many stations, the station that was heard from least
+// recently is forgotten.
+func (rl *RegionalCommandLog) Add(at time.Time, rc nmeais.RegionalCommand) {
+	if rl.perStation <= 0 || rl.maxStations <= 0 {
+		return
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	commands, known := rl.stations[rc.Station]
+	if !known && len(rl.stations) >= rl.maxStations {
+		rl.forgetQuietestStation()
+	}
+	if len(commands) >= rl.perStation {
+		copy(commands, commands[len(commands)-rl.perStation+1:])
+		commands = commands[:rl.perStation-1]
+	}
+	rl.stations[rc.Station] = append(commands, ReceivedCommand{at, rc})
+}
+
+// forgetQuietestStation removes the station with the oldest most recent command.
+// `rl.mu` should be held while calling this.
+func (rl *RegionalCommandLog) forgetQuietestStation() {
+	quietest, first := uint32(0), true
+	var quietestAt time.Time
+	for station, commands := range rl.stations {
+		last := commands[len(commands)-1].At
+		if first || last.Before(quietestAt) {
+			quietest, quietestAt, first = station, last, false
+		}
+	}
+	delete(rl.stations, quietest)
+}
+
+// Stations returns the number of stations with stored commands.
+func (rl *RegionalCommandLog) Stations() int {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return len(rl.stations)
+}
+
+// FromStation returns a copy of the stored commands from a station, oldest first.
+func (rl *RegionalCommandLog) FromStation(mmsi uint32) []ReceivedCommand {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return append([]ReceivedCommand{}, rl.stations[mmsi]...)
+}
+
+// regionPolygon returns the region of a command as a counterclockwise ring,
+// or nil if the command is addressed or the corners are invalid.
+// Regions crossing the antimeridian get eastern longitudes above 180,
+// which the map draws correctly.
+func regionPolygon(rc *nmeais.RegionalCommand) *Geometry {
+	if rc.Addressed || !geo.LegalCoord(rc.NE.Lat, rc.NE.Long) ||
+		!geo.LegalCoord(rc.SW.Lat, rc.SW.Long) || rc.SW.Lat > rc.NE.Lat {
+		return nil
+	}
+	east := rc.NE.Long
+	if east < rc.SW.Long {
+		east += 360
+	}
+	return &Geometry{Polygon: true, Coordinates: []geo.Point{
+		{Lat: rc.SW.Lat, Long: rc.SW.Long},
+		{Lat: rc.SW.Lat, Long: east},
+		{Lat: rc.NE.Lat, Long: east},
+		{Lat: rc.NE.Lat, Long: rc.SW.Long},
+		{Lat: rc.SW.Lat, Long: rc.SW.Long},
+	}}
+}
+
+// Properties of a type 22 command
+type channelManagementProp struct {
+	Type         uint8      `json:"type"`
+	Station      uint32     `json:"station"`
+	Received     time.Time  `json:"received"`
+	ChannelA     uint16     `json:"channel_a"`
+	ChannelB     uint16     `json:"channel_b"`
+	TxRxMode     uint8      `json:"txrx_mode"`
+	LowPower     bool       `json:"low_power"`
+	NarrowA      bool       `json:"narrow_a"`
+	NarrowB      bool       `json:"narrow_b"`
+	ZoneSize     uint8      `json:"zone_size"`
+	Destinations *[2]uint32 `json:"destinations,omitempty"`
+}
+
+// Properties of a type 23 command
+type groupAssignmentProp struct {
+	Type           uint8     `json:"type"`
+	Station        uint32    `json:"station"`
+	Received       time.Time `json:"received"`
+	StationType    uint8     `json:"station_type"`
+	ShipType       uint8     `json:"ship_type"`
+	TxRxMode       uint8     `json:"txrx_mode"`
+	ReportInterval uint8     `json:"report_interval"`
+	QuietTime      uint8     `json:"quiet_time"`
+}
+
+// GeoJSON returns all stored commands as a GeoJSON FeatureCollection,
+// grouped by station and oldest first.
+// The region is the geometry of each feature, addressed commands have a null geometry.
+func (rl *RegionalCommandLog) GeoJSON(logger *l.Logger) string {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	stations := make([]uint32, 0, len(rl.stations))
+	for station := range rl.stations {
+		stations = append(stations, station)
+	}
+	sort.Slice(stations, func(i, j int) bool { return stations[i] < stations[j] })
+	fc := newFeatureCollection(0)
+	for _, station := range stations {
+		for _, c := range rl.stations[station] {
+			f := Feature{
+				Type:     "Feature",
+				Geometry: regionPolygon(&c.RegionalCommand),
+			}
+			if c.Type == 22 {
+				p := channelManagementProp{
+					Type:     c.Type,
+					Station:  c.Station,
+					Received: c.At,
+					ChannelA: c.ChannelA,
+					ChannelB: c.ChannelB,
+					TxRxMode: c.TxRxMode,
+					LowPower: c.LowPower,
+					NarrowA:  c.NarrowA,
+					NarrowB:  c.NarrowB,
+					ZoneSize: c.ZoneSize,
+				}
+				if c.Addressed {
+					p.Destinations = &c.Destinations
+				}
+				f.Properties = p
+			} else {
+				f.Properties = groupAssignmentProp{
+					Type:           c.Type,
+					Station:        c.Station,
+					Received:       c.At,
+					StationType:    c.StationType,
+					ShipType:       c.ShipType,
+					TxRxMode:       c.TxRxMode,
+					ReportInterval: c.ReportInterval,
+					QuietTime:      c.QuietTime,
+				}
+			}
+			fc.Features = append(fc.Features, f)
+		}
+	}
+	return fc.encode(logger)
+}
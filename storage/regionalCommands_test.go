@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/tormol/AIS/geo"
+	l "github.com/tormol/AIS/logger"
+	"github.com/tormol/AIS/nmeais"
+)
+
+func TestRegionalCommandLogBounds(t *testing.T) {
+	rl := NewRegionalCommandLog(3, 2)
+	start := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		at := start.Add(time.Duration(i) * time.Minute)
+		rl.Add(at, nmeais.RegionalCommand{Type: 22, Station: 2570001, ZoneSize: uint8(i)})
+	}
+	commands := rl.FromStation(2570001)
+	if len(commands) != 3 {
+		t.Fatalf("Expected 3 commands, got %d", len(commands))
+	}
+	for i, c := range commands {
+		if c.ZoneSize != uint8(i+2) {
+			t.Errorf("Expected command %d to be the %dth, got the %dth", i, i+2, c.ZoneSize)
+		}
+	}
+
+	rl.Add(start.Add(10*time.Minute), nmeais.RegionalCommand{Type: 23, Station: 2570002})
+	if rl.Stations() != 2 {
+		t.Errorf("Expected 2 stations, got %d", rl.Stations())
+	}
+	// 2570001 was heard from least recently
+	rl.Add(start.Add(11*time.Minute), nmeais.RegionalCommand{Type: 23, Station: 2570003})
+	if rl.Stations() != 2 {
+		t.Errorf("Expected still 2 stations, got %d", rl.Stations())
+	}
+	if len(rl.FromStation(2570001)) != 0 {
+		t.Error("Expected the quietest station to be forgotten")
+	}
+	if len(rl.FromStation(2570002)) != 1 || len(rl.FromStation(2570003)) != 1 {
+		t.Error("Expected the two most recent stations to be kept")
+	}
+}
+
+func TestRegionalCommandGeoJSON(t *testing.T) {
+	rl := NewRegionalCommandLog(2, 10)
+	at := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+	rl.Add(at, nmeais.RegionalCommand{
+		Type:    22,
+		Station: 2570001,
+		NE:      geo.Point{Lat: 59.5, Long: 6.25},
+		SW:      geo.Point{Lat: 58.5, Long: 5},
+	})
+	rl.Add(at, nmeais.RegionalCommand{
+		Type:         22,
+		Station:      2570002,
+		Addressed:    true,
+		Destinations: [2]uint32{257000001, 257000002},
+	})
+	var fc struct {
+		Type     string
+		Features []struct {
+			Geometry *struct {
+				Type        string
+				Coordinates [][]geo.Point
+			}
+			Properties map[string]interface{}
+		}
+	}
+	logger := l.NewLogger(os.Stderr, l.Debug)
+	if err := json.Unmarshal([]byte(rl.GeoJSON(logger)), &fc); err != nil {
+		t.Fatal(err)
+	}
+	if fc.Type != "FeatureCollection" || len(fc.Features) != 2 {
+		t.Fatalf("Expected a FeatureCollection with 2 features: %v", fc)
+	}
+	region := fc.Features[0].Geometry
+	if region == nil || region.Type != "Polygon" || len(region.Coordinates) != 1 {
+		t.Fatalf("Expected a polygon with one ring: %v", region)
+	}
+	sw, se := geo.Point{Lat: 58.5, Long: 5}, geo.Point{Lat: 58.5, Long: 6.25}
+	ne, nw := geo.Point{Lat: 59.5, Long: 6.25}, geo.Point{Lat: 59.5, Long: 5}
+	expected := []geo.Point{sw, se, ne, nw, sw}
+	if len(region.Coordinates[0]) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, region.Coordinates[0])
+	}
+	for i, p := range expected {
+		if region.Coordinates[0][i] != p {
+			t.Errorf("Expected %v, got %v", expected, region.Coordinates[0])
+			break
+		}
+	}
+	if fc.Features[1].Geometry != nil {
+		t.Errorf("Expected addressed command to have no geometry: %v", fc.Features[1].Geometry)
+	}
+	if _, ok := fc.Features[1].Properties["destinations"]; !ok {
+		t.Error("Expected addressed command to have destinations")
+	}
+}
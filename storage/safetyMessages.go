@@ -0,0 +1,102 @@
+package storage
+
+// Keeps recent safety-related text messages
+
+import (
+	"sync"
+	"time"
+
+	"github.com/tormol/AIS/nmeais"
+)
+
+// SafetyRepeatWindow is how long after a safety message the same text from
+// the same station is considered a retransmission and ignored.
+const SafetyRepeatWindow = 10 * time.Minute
+
+// ReceivedSafetyMessage is a safety-related message and when it was received.
+type ReceivedSafetyMessage struct {
+	Received    time.Time `json:"received"`
+	Type        uint8     `json:"type"`
+	Source      uint32    `json:"source"`
+	Destination uint32    `json:"destination,omitempty"` // only for type 12
+	Text        string    `json:"text"`
+}
+
+// SafetyMessageLog keeps the most recent addressed and broadcast
+// safety-related messages (AIS message type 12 and 14) in a ring buffer.
+type SafetyMessageLog struct {
+	mu       sync.Mutex
+	messages []ReceivedSafetyMessage // ring buffer, oldest at next when full
+	next     int
+	full     bool
+}
+
+// NewSafetyMessageLog creates an empty log which keeps at most size messages.
+func NewSafetyMessageLog(size uint) *SafetyMessageLog {
+	return &SafetyMessageLog{messages: make([]ReceivedSafetyMessage, size)}
+}
+
+// Add stores a message, replacing the oldest one if the log is full.
+// Messages with the same source and text as one received less than
+// SafetyRepeatWindow before or after are ignored, and Add returns false for them.
+func (sl *SafetyMessageLog) Add(at time.Time, sm nmeais.SafetyMessage) bool {
+	if len(sl.messages) == 0 {
+		return false
+	}
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	for i := 0; i < sl.len(); i++ {
+		prev := &sl.messages[i]
+		apart := at.Sub(prev.Received)
+		if apart < 0 {
+			apart = -apart
+		}
+		if prev.Source == sm.Source && prev.Text == sm.Text && apart < SafetyRepeatWindow {
+			return false
+		}
+	}
+	sl.messages[sl.next] = ReceivedSafetyMessage{
+		Received:    at,
+		Type:        sm.Type,
+		Source:      sm.Source,
+		Destination: sm.Destination,
+		Text:        sm.Text,
+	}
+	sl.next = (sl.next + 1) % len(sl.messages)
+	if sl.next == 0 {
+		sl.full = true
+	}
+	return true
+}
+
+// len returns the number of stored messages.
+// `sl.mu` should be held while calling this.
+func (sl *SafetyMessageLog) len() int {
+	if sl.full {
+		return len(sl.messages)
+	}
+	return sl.next
+}
+
+// Len returns the number of stored messages.
+func (sl *SafetyMessageLog) Len() int {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	return sl.len()
+}
+
+// Since returns the messages received after since, newest first.
+// Messages are stored in the order they're added, which with several
+// sources isn't always the order they were received in.
+func (sl *SafetyMessageLog) Since(since time.Time) []ReceivedSafetyMessage {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	found := []ReceivedSafetyMessage{}
+	for i := 0; i < sl.len(); i++ {
+		m := sl.messages[(sl.next-1-i+len(sl.messages))%len(sl.messages)]
+		if m.Received.After(since) {
+			found = append(found, m)
+		}
+	}
+	return found
+}
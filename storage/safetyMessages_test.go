@@ -0,0 +1,45 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tormol/AIS/nmeais"
+)
+
+func TestSafetyMessageLog(t *testing.T) {
+	sl := NewSafetyMessageLog(3)
+	start := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+	at := func(minutes int) time.Time {
+		return start.Add(time.Duration(minutes) * time.Minute)
+	}
+	warning := nmeais.SafetyMessage{Type: 14, Source: 2570001, Text: "BUOY OFF POSITION"}
+	if !sl.Add(at(0), warning) {
+		t.Error("Expected the first message to be stored")
+	}
+	if sl.Add(at(9), warning) || sl.Len() != 1 {
+		t.Error("Expected a retransmission within 10 minutes to be ignored")
+	}
+	other := warning
+	other.Source = 2570002
+	if !sl.Add(at(1), other) {
+		t.Error("Expected the same text from another station to be stored")
+	}
+	if !sl.Add(at(10), warning) {
+		t.Error("Expected the same text after 10 minutes to be stored")
+	}
+	if since := sl.Since(at(0)); len(since) != 2 || since[0].Received != at(10) || since[1].Source != 2570002 {
+		t.Errorf("Expected the two last messages, newest first, got %+v", since)
+	}
+
+	addressed := nmeais.SafetyMessage{Type: 12, Source: 257012345, Destination: 2570001, Text: "QSL"}
+	sl.Add(at(11), addressed)
+	all := sl.Since(time.Time{})
+	if sl.Len() != 3 || len(all) != 3 || all[0].Destination != 2570001 || all[2].Source != 2570002 {
+		t.Errorf("Expected the oldest message to be replaced, got %+v", all)
+	}
+
+	if NewSafetyMessageLog(0).Add(at(0), warning) {
+		t.Error("Expected nothing to be stored in an empty log")
+	}
+}
@@ -0,0 +1,165 @@
+package storage
+
+import (
+	"math"
+
+	"github.com/tormol/AIS/geo"
+	l "github.com/tormol/AIS/logger"
+)
+
+// Index is the methods of RTree that the archive uses,
+// so that it can use a ShardedRTree instead.
+type Index interface {
+	InsertData(lat, long float64, mmsi uint32) error
+	Update(mmsi uint32, oldLat, oldLong, newLat, newLong float64) error
+	Remove(mmsi uint32, lat, long float64) error
+	FindWithin(r *geo.Rectangle) *[]Match
+	FindWithinAny(rects []geo.Rectangle) *[]Match
+	VisitWithin(r *geo.Rectangle, visit func(mmsi uint32, lat, long float64) bool)
+	VisitWithinAny(rects []geo.Rectangle, visit func(mmsi uint32, lat, long float64) bool)
+	NumOfBoats() int
+	Height() int
+	NodeCount() int
+	DebugGeoJSON(logger *l.Logger) string
+}
+
+// ShardedRTree is an index split into one RTree per band of longitude,
+// so that updates in different bands don't wait for each other, and searches
+// of small areas only look in the bands they overlap.
+// Rectangles cannot cross the date line (geo.SplitViewRect splits those),
+// so each one overlaps a continuous range of bands, and the first and last
+// bands only meet at the date line.
+// A boat that moves to another band is inserted there before it's removed
+// from the old one, and searches remove the duplicate.
+type ShardedRTree struct {
+	shards    []*RTree
+	bandWidth float64 // degrees of longitude per shard
+}
+
+// NewShardedRTree creates an index with shards bands of equal width,
+// which must be between 1 and 360.
+func NewShardedRTree(shards int) *ShardedRTree {
+	if shards < 1 || shards > 360 {
+		panic("number of shards must be between 1 and 360")
+	}
+	st := &ShardedRTree{
+		shards:    make([]*RTree, shards),
+		bandWidth: 360 / float64(shards),
+	}
+	for i := range st.shards {
+		st.shards[i] = NewRTree()
+	}
+	return st
+}
+
+// band returns the index of the shard for a longitude.
+// 180 belongs to the last band.
+func (st *ShardedRTree) band(long float64) int {
+	i := int(math.Floor((long + 180) / st.bandWidth))
+	if i < 0 {
+		return 0
+	} else if i >= len(st.shards) {
+		return len(st.shards) - 1
+	}
+	return i
+}
+
+// InsertData inserts a new boat into the shard of its longitude.
+func (st *ShardedRTree) InsertData(lat, long float64, mmsi uint32) error {
+	return st.shards[st.band(long)].InsertData(lat, long, mmsi)
+}
+
+// Update moves a boat, to another shard if it has crossed into another band.
+func (st *ShardedRTree) Update(mmsi uint32, oldLat, oldLong, newLat, newLong float64) error {
+	from, to := st.band(oldLong), st.band(newLong)
+	if from == to {
+		return st.shards[from].Update(mmsi, oldLat, oldLong, newLat, newLong)
+	}
+	if err := st.shards[to].InsertData(newLat, newLong, mmsi); err != nil {
+		return err
+	}
+	return st.shards[from].Remove(mmsi, oldLat, oldLong)
+}
+
+// Remove deletes a boat from the shard of its longitude.
+func (st *ShardedRTree) Remove(mmsi uint32, lat, long float64) error {
+	return st.shards[st.band(long)].Remove(mmsi, lat, long)
+}
+
+// FindWithin returns the boats within a rectangle,
+// searching only the shards it overlaps.
+func (st *ShardedRTree) FindWithin(r *geo.Rectangle) *[]Match {
+	return st.FindWithinAny([]geo.Rectangle{*r})
+}
+
+// FindWithinAny returns all the boats within at least one of the rectangles,
+// without duplicates.
+// Unlike RTree, the shards are not searched in the same version,
+// so a boat being moved between shards might be missing.
+func (st *ShardedRTree) FindWithinAny(rects []geo.Rectangle) *[]Match {
+	all := []Match{}
+	st.VisitWithinAny(rects, func(mmsi uint32, lat, long float64) bool {
+		all = append(all, Match{mmsi, lat, long})
+		return true
+	})
+	return &all
+}
+
+// VisitWithin calls visit for each boat within a rectangle,
+// see VisitWithinAny.
+func (st *ShardedRTree) VisitWithin(r *geo.Rectangle, visit func(mmsi uint32, lat, long float64) bool) {
+	st.VisitWithinAny([]geo.Rectangle{*r}, visit)
+}
+
+// VisitWithinAny calls visit once for each boat within at least one of the
+// rectangles, searching only the shards they overlap, and stops searching
+// when visit returns false.
+// The shards are not searched in the same version, like in FindWithinAny.
+func (st *ShardedRTree) VisitWithinAny(rects []geo.Rectangle, visit func(mmsi uint32, lat, long float64) bool) {
+	searches := 0
+	for i := range rects {
+		searches += st.band(rects[i].Max().Long) - st.band(rects[i].Min().Long) + 1
+	}
+	// a boat that is being moved to another shard can be in both
+	visit = visitOnce(searches, visit)
+	stopped := false
+	stop := func(mmsi uint32, lat, long float64) bool {
+		stopped = !visit(mmsi, lat, long)
+		return !stopped
+	}
+	for i := range rects {
+		r := &rects[i]
+		for b := st.band(r.Min().Long); b <= st.band(r.Max().Long) && !stopped; b++ {
+			st.shards[b].VisitWithin(r, stop)
+		}
+	}
+}
+
+// NumOfBoats returns the number of boats in all the shards.
+func (st *ShardedRTree) NumOfBoats() int {
+	sum := 0
+	for _, rt := range st.shards {
+		sum += rt.NumOfBoats()
+	}
+	return sum
+}
+
+// Height returns the height of the tallest shard.
+func (st *ShardedRTree) Height() int {
+	max := 0
+	for _, rt := range st.shards {
+		if h := rt.Height(); h > max {
+			max = h
+		}
+	}
+	return max
+}
+
+// NodeCount returns the number of nodes in all the shards.
+func (st *ShardedRTree) NodeCount() int {
+	sum := 0
+	for _, rt := range st.shards {
+		sum += rt.NodeCount()
+	}
+	return sum
+}
@@ -0,0 +1,197 @@
+package storage
+
+import (
+	"encoding/json"
+	"math/rand"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/tormol/AIS/geo"
+	l "github.com/tormol/AIS/logger"
+)
+
+func TestShardBands(t *testing.T) {
+	st := NewShardedRTree(24)
+	for long, band := range map[float64]int{-180: 0, -165.0001: 0, -165: 1, 0: 12, 179.99: 23, 180: 23} {
+		if b := st.band(long); b != band {
+			t.Errorf("Expected longitude %f to be in band %d, got %d", long, band, b)
+		}
+	}
+}
+
+// sortedMMSIs returns the MMSIs of matches in increasing order.
+func sortedMMSIs(matches *[]Match) []uint32 {
+	mmsis := make([]uint32, len(*matches))
+	for i, m := range *matches {
+		mmsis[i] = m.MMSI
+	}
+	sort.Slice(mmsis, func(i, j int) bool { return mmsis[i] < mmsis[j] })
+	return mmsis
+}
+
+func TestShardedEqualsSingleTree(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	single, sharded := NewRTree(), NewShardedRTree(24)
+	randomPoint := func() (float64, float64) {
+		switch rng.Intn(10) {
+		case 0: // on the date line or a band boundary
+			return rng.Float64()*180 - 90, float64(rng.Intn(25))*15 - 180
+		default:
+			return rng.Float64()*180 - 90, rng.Float64()*360 - 180
+		}
+	}
+	type boat struct{ lat, long float64 }
+	boats := make([]boat, 5000)
+	for i := range boats {
+		boats[i].lat, boats[i].long = randomPoint()
+		single.InsertData(boats[i].lat, boats[i].long, uint32(i))
+		sharded.InsertData(boats[i].lat, boats[i].long, uint32(i))
+	}
+	for i := 0; i < len(boats); i += 2 { // many of these cross into another band
+		lat, long := randomPoint()
+		if err := single.Update(uint32(i), boats[i].lat, boats[i].long, lat, long); err != nil {
+			t.Fatal(err)
+		} else if err = sharded.Update(uint32(i), boats[i].lat, boats[i].long, lat, long); err != nil {
+			t.Fatal(err)
+		}
+		boats[i] = boat{lat, long}
+	}
+	for i := 1; i < len(boats); i += 10 {
+		single.Remove(uint32(i), boats[i].lat, boats[i].long)
+		if err := sharded.Remove(uint32(i), boats[i].lat, boats[i].long); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if single.NumOfBoats() != sharded.NumOfBoats() {
+		t.Fatalf("Expected %d boats, got %d", single.NumOfBoats(), sharded.NumOfBoats())
+	}
+
+	for q := 0; q < 500; q++ {
+		lat1, long1 := randomPoint()
+		lat2, long2 := randomPoint()
+		if q%5 == 0 { // small, like most map views
+			lat2, long2 = lat1+rng.Float64()*5, long1+rng.Float64()*5
+		}
+		if lat2 < lat1 {
+			lat1, lat2 = lat2, lat1
+		}
+		rects := geo.SplitViewRect(lat1, long1, lat2, long2)
+		expected, found := sortedMMSIs(single.FindWithinAny(rects)), sortedMMSIs(sharded.FindWithinAny(rects))
+		if len(expected) != len(found) {
+			t.Fatalf("Expected %d boats within %v, found %d", len(expected), rects, len(found))
+		}
+		for i := range expected {
+			if expected[i] != found[i] {
+				t.Fatalf("Expected %v within %v, found %v", expected, rects, found)
+			}
+		}
+	}
+}
+
+// clusteredTraffic returns positions where most are in Norwegian waters,
+// like the feed from Kystverket.
+func clusteredTraffic(rng *rand.Rand, n int) []geo.Point {
+	points := make([]geo.Point, n)
+	for i := range points {
+		if rng.Intn(10) != 0 {
+			points[i] = geo.Point{Lat: 57 + rng.Float64()*14, Long: 4 + rng.Float64()*27}
+		} else {
+			points[i] = geo.Point{Lat: rng.Float64()*140 - 70, Long: rng.Float64()*360 - 180}
+		}
+	}
+	return points
+}
+
+// benchmarkConcurrent measures updates and searches of small areas from
+// several goroutines, where each goroutine moves its own boats.
+func benchmarkConcurrent(b *testing.B, index Index) {
+	const workers, boatsPerWorker = 8, 2000
+	rng := rand.New(rand.NewSource(1))
+	boats := clusteredTraffic(rng, workers*boatsPerWorker)
+	for i, p := range boats {
+		index.InsertData(p.Lat, p.Long, uint32(i))
+	}
+	moves := clusteredTraffic(rng, b.N)
+	views := clusteredTraffic(rng, b.N)
+	b.ResetTimer()
+	wg := sync.WaitGroup{}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < b.N; i += workers {
+				if i%2 == 0 {
+					mmsi := w*boatsPerWorker + i/workers%boatsPerWorker
+					old := boats[mmsi]
+					index.Update(uint32(mmsi), old.Lat, old.Long, moves[i].Lat, moves[i].Long)
+					boats[mmsi] = moves[i]
+				} else {
+					if view, err := geo.NewRectangle(views[i].Lat, views[i].Long, views[i].Lat+1, views[i].Long+2); err == nil {
+						index.FindWithin(view)
+					}
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+}
+
+func BenchmarkConcurrentSingleTree(b *testing.B) {
+	benchmarkConcurrent(b, NewRTree())
+}
+
+func BenchmarkConcurrent24Shards(b *testing.B) {
+	benchmarkConcurrent(b, NewShardedRTree(24))
+}
+
+func TestDebugGeoJSON(t *testing.T) {
+	type layout struct {
+		Features []struct {
+			Geometry struct {
+				Type        string          `json:"type"`
+				Coordinates json.RawMessage `json:"coordinates"`
+			} `json:"geometry"`
+			Properties rTreeNodeProp `json:"properties"`
+		} `json:"features"`
+	}
+	decode := func(geojson string) layout {
+		var l layout
+		if err := json.Unmarshal([]byte(geojson), &l); err != nil {
+			t.Fatalf("Invalid GeoJSON %q: %s", geojson, err.Error())
+		}
+		return l
+	}
+	logger := l.NewLogger(os.Stderr, l.Warning)
+
+	if fc := decode(NewRTree().DebugGeoJSON(logger)); len(fc.Features) != 0 {
+		t.Errorf("Expected no features for an empty tree, got %+v", fc)
+	}
+	rt := NewRTree()
+	rt.InsertData(63.4, 10.4, 257000000)
+	fc := decode(rt.DebugGeoJSON(logger))
+	if len(fc.Features) != 1 || fc.Features[0].Geometry.Type != "Point" ||
+		string(fc.Features[0].Geometry.Coordinates) != "[10.4,63.4]" {
+		t.Errorf("Expected a single point, got %+v", fc)
+	}
+
+	sharded := NewShardedRTree(24)
+	for i, p := range clusteredTraffic(rand.New(rand.NewSource(1)), 2000) {
+		sharded.InsertData(p.Lat, p.Long, uint32(i))
+	}
+	fc = decode(sharded.DebugGeoJSON(logger))
+	if len(fc.Features) != sharded.NodeCount() {
+		t.Errorf("Expected one feature per node (%d), got %d", sharded.NodeCount(), len(fc.Features))
+	}
+	shards := make(map[int]bool)
+	for _, f := range fc.Features {
+		shards[f.Properties.Shard] = true
+		if f.Properties.Entries == 0 || f.Properties.Entries > RTree_M {
+			t.Errorf("Expected between 1 and %d entries, got %+v", RTree_M, f.Properties)
+		}
+	}
+	if len(shards) < 2 {
+		t.Errorf("Expected nodes from several shards, got %v", shards)
+	}
+}
@@ -6,8 +6,10 @@ import (
 	"encoding/json"
 	"errors"
 	"math"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	ais "github.com/andmarios/aislib"
@@ -15,37 +17,6 @@ import (
 	l "github.com/tormol/AIS/logger"
 )
 
-// Mmsi stands for Maritime Mobile Service Identity and is used to identify the
-// sender of AIS messages. It should be displayed as 9 digits.
-type Mmsi uint32
-
-// CountryCode returns the country identified by the "Maritime Identification Digits" of the mmsi.
-func (m Mmsi) CountryCode() string {
-	s := m.String()
-	a := strings.Split(s, ",")
-	if len(a) > 1 {
-		return a[1]
-	}
-	return " - "
-}
-
-// Type returns the type of the type of vessel according to the MMSI.
-// E.g. "Ship", "Coastal Station", "MOB —Man Overboard Device", etc.
-func (m Mmsi) Type() string {
-	s := m.String()
-	a := strings.Split(s, ",")
-	if len(a) > 1 {
-		return a[0]
-	}
-	return " - "
-}
-
-// String returns the string representation of the Mmsi-object.
-// E.g. "Ship, Norway" or "Coastal Station, France".
-func (m *Mmsi) String() string {
-	return ais.DecodeMMSI(uint32(*m))
-}
-
 // ShipNavStatus contains the navigation status code.
 // E.g. "Under way using engine", "At anchor", "Not under command", etc.
 type ShipNavStatus uint8
@@ -106,37 +77,111 @@ func (a Accuracy) MarshalJSON() ([]byte, error) {
 }
 
 // Geometry is used to create GeoJSON "geometry" fields.
-// Works for both GeoJSON "Point" and "LineString" objects.
+// Works for GeoJSON "Point", "LineString" and "Polygon" objects.
 type Geometry struct {
-	Coordinates []geo.Point `json:"coordinates"`
+	Coordinates []geo.Point
+	Polygon     bool // Coordinates is the single ring of a polygon
 }
 
-// MarshalJSON returns either a GeoJSON "Point" or a GeoJSON "LineString" object.
+// MarshalJSON returns a GeoJSON "Point", "LineString" or "Polygon" object.
 func (g Geometry) MarshalJSON() ([]byte, error) {
-	if len(g.Coordinates) >= 2 { // GeoJSON "LineString"
-		c, _ := json.Marshal(g.Coordinates)
-		b := []byte{'{', '"', 't', 'y', 'p', 'e', '"', ':', '"', 'L', 'i', 'n', 'e', 'S', 't', 'r', 'i', 'n', 'g', '"', ',', '"', 'c', 'o', 'o', 'r', 'd', 'i', 'n', 'a', 't', 'e', 's', '"', ':'}
-		b = append(b, c...)
-		return append(b, '}'), nil
-	} else if len(g.Coordinates) == 1 { // GeoJSON "Point"
-		c, _ := json.Marshal(g.Coordinates[0])
-		b := []byte{'{', '"', 't', 'y', 'p', 'e', '"', ':', '"', 'P', 'o', 'i', 'n', 't', '"', ',', '"', 'c', 'o', 'o', 'r', 'd', 'i', 'n', 'a', 't', 'e', 's', '"', ':'}
-		b = append(b, c...)
-		return append(b, '}'), nil
+	var object struct {
+		Type        string      `json:"type"`
+		Coordinates interface{} `json:"coordinates"`
+	}
+	if g.Polygon {
+		object.Type, object.Coordinates = "Polygon", [][]geo.Point{g.Coordinates}
+	} else if len(g.Coordinates) >= 2 {
+		object.Type, object.Coordinates = "LineString", g.Coordinates
+	} else if len(g.Coordinates) == 1 {
+		object.Type, object.Coordinates = "Point", g.Coordinates[0]
+	} else {
+		return []byte{}, errors.New("Not enough coordinates")
+	}
+	return json.Marshal(object)
+}
+
+// Feature is a GeoJSON Feature.
+type Feature struct {
+	Type       string      `json:"type"`         // always "Feature"
+	ID         uint32      `json:"id,omitempty"` // zero for clusters and commands
+	Geometry   *Geometry   `json:"geometry"`     // null for addressed commands
+	Properties interface{} `json:"properties"`   // one of the *Prop structs
+}
+
+// FeatureCollection is a GeoJSON FeatureCollection.
+type FeatureCollection struct {
+	Type     string    `json:"type"` // always "FeatureCollection"
+	Features []Feature `json:"features"`
+}
+
+// newFeatureCollection creates an empty FeatureCollection with room for n features.
+func newFeatureCollection(n int) FeatureCollection {
+	return FeatureCollection{Type: "FeatureCollection", Features: make([]Feature, 0, n)}
+}
+
+// encode returns the JSON of the collection,
+// or an empty collection if it cannot be encoded.
+func (fc *FeatureCollection) encode(logger *l.Logger) string {
+	b, err := json.Marshal(fc)
+	if err != nil {
+		logger.Error("Error JSON-encoding FeatureCollection of %d features: %s", len(fc.Features), err.Error())
+		return `{"type":"FeatureCollection","features":[]}`
 	}
-	return []byte{}, errors.New("Not enough coordinates")
+	return string(b)
 }
 
 // ShipPos stores information gathered from AIS message type 1-3, 18-19 and 27.
 type ShipPos struct {
-	At          time.Time     // Calculated from UTCSecond and time packet was received
-	Pos         geo.Point     // A GeoJSON object must have a position, therefore this field can not be omitted
-	PosAccuracy Accuracy      // High or low
-	NavStatus   ShipNavStatus // Whether the ship is moored or fishing, etc
-	BowHeading  float32       // Orientation of the ship, in degrees with zero north
-	Course      float32       // Direction of movement, in degrees with zero north
-	Speed       float32       // Speed over ground, in knots
-	RateOfTurn  float32       // in degrees/minute
+	At           time.Time     // Calculated from UTCSecond and time packet was received
+	Received     time.Time     // When the packet was received, zero if unknown
+	Pos          geo.Point     // A GeoJSON object must have a position, therefore this field can not be omitted
+	PosAccuracy  Accuracy      // High or low
+	NavStatus    ShipNavStatus // Whether the ship is moored or fishing, etc
+	BowHeading   float32       // Orientation of the ship, in degrees with zero north
+	Course       float32       // Direction of movement, in degrees with zero north
+	Speed        float32       // Speed over ground, in knots
+	SpeedAtLeast bool          // Speed is 102.2 knots or more
+	RateOfTurn   float32       // in degrees/minute
+	Resolution   float32       // of Pos in meters, 0 for normal position reports
+}
+
+// Values of the position report fields that mean not available,
+// after converting to degrees and knots.
+const (
+	LatNotAvailable     = 91
+	LongNotAvailable    = 181
+	HeadingNotAvailable = 511
+	CourseNotAvailable  = 360
+	SpeedNotAvailable   = 102.3
+	SpeedAtLeast        = 102.2 // or faster
+)
+
+// SanitizePos replaces the values in a decoded position report that mean not
+// available, or are out of range, with the NaN of UnknownPos.
+// Both coordinates are replaced if one of them is invalid.
+func SanitizePos(p ShipPos) ShipPos {
+	if !(p.Pos.Lat >= -90 && p.Pos.Lat <= 90 && p.Pos.Long >= -180 && p.Pos.Long <= 180) {
+		p.Pos = UnknownPos.Pos // includes LatNotAvailable, LongNotAvailable and NaN
+	}
+	if !(p.BowHeading >= 0 && p.BowHeading < 360) {
+		p.BowHeading = UnknownPos.BowHeading // includes HeadingNotAvailable
+	}
+	if !(p.Course >= 0 && p.Course < 360) {
+		p.Course = UnknownPos.Course // includes CourseNotAvailable
+	}
+	// compare with halfway between the values to not depend on float rounding
+	if !(p.Speed >= 0 && p.Speed < (SpeedAtLeast+SpeedNotAvailable)/2) {
+		p.Speed = UnknownPos.Speed
+		p.SpeedAtLeast = false
+	} else if p.Speed > SpeedAtLeast-0.05 {
+		p.Speed = SpeedAtLeast
+		p.SpeedAtLeast = true
+	}
+	if !isFinite(p.RateOfTurn) {
+		p.RateOfTurn = UnknownPos.RateOfTurn
+	}
+	return p
 }
 
 // UnknownPos contains the default values used when there is no information
@@ -145,7 +190,7 @@ type ShipPos struct {
 // 0.0/0.0 (or any indirection thereof) gives a division by zero error.
 // This is intentional: https://github.com/golang/go/issues/2196#issuecomment-66058380
 var UnknownPos = ShipPos{
-	Pos:         geo.Point{math.NaN(), math.NaN()},
+	Pos:         geo.Point{Lat: math.NaN(), Long: math.NaN()},
 	PosAccuracy: false,
 	NavStatus:   ShipNavStatus(15),
 	BowHeading:  float32(math.NaN()),
@@ -166,6 +211,58 @@ type ShipInfo struct {
 	ShipName     string    `json:"name,omitempty"`
 	Dest         string    `json:"destination,omitempty"`
 	ETA          time.Time `json:"eta,omitempty"`
+	IMO          uint32    `json:"imo,omitempty"` // zero if not available, see ValidIMO
+}
+
+// merge overwrites the fields that are set in update, so that messages which
+// only contain some of the fields (such as the two parts of type 24) don't
+// erase the others.
+// The offsets are only used together with the length or width.
+func (info *ShipInfo) merge(update ShipInfo) {
+	if update.VesselType != 0 {
+		info.VesselType = update.VesselType
+	}
+	if update.Draught != 0 {
+		info.Draught = update.Draught
+	}
+	if update.Length != 0 {
+		info.Length, info.LengthOffset = update.Length, update.LengthOffset
+	}
+	if update.Width != 0 {
+		info.Width, info.WidthOffset = update.Width, update.WidthOffset
+	}
+	if update.Callsign != "" {
+		info.Callsign = update.Callsign
+	}
+	if update.ShipName != "" {
+		info.ShipName = update.ShipName
+	}
+	if update.Dest != "" {
+		info.Dest = update.Dest
+	}
+	if !update.ETA.IsZero() {
+		info.ETA = update.ETA
+	}
+	if update.IMO != 0 {
+		info.IMO = update.IMO
+	}
+}
+
+// ValidIMO returns true if imo is a seven digit IMO ship identification
+// number with a correct check digit.
+// Zero means not available, and some ships send other invalid numbers,
+// which shouldn't be used to link ships.
+func ValidIMO(imo uint32) bool {
+	if imo < 1000000 || imo > 9999999 {
+		return false
+	}
+	check := imo % 10
+	sum := uint32(0)
+	for weight := uint32(2); weight <= 7; weight++ {
+		imo /= 10
+		sum += (imo % 10) * weight
+	}
+	return sum%10 == check
 }
 
 // UnknownInfo contains the default values used when there is no information
@@ -180,82 +277,257 @@ var UnknownInfo = ShipInfo{
 	VesselType:   ShipType(0),
 }
 
+// ETAFromFields creates the estimated time of arrival from the fields of a
+// static voyage data message, which doesn't include the year.
+// The year is chosen so that the ETA is between one month before and eleven
+// months after received, which is also when the result will be in UTC.
+// Returns the zero time if month or day is not available (0) or invalid.
+// Hour 24 and minute 60 mean not available, and are replaced by zero.
+func ETAFromFields(month, day, hour, minute uint8, received time.Time) time.Time {
+	if hour >= 24 {
+		hour = 0
+	}
+	if minute >= 60 {
+		minute = 0
+	}
+	eta := func(year int) time.Time {
+		return time.Date(year, time.Month(month), int(day), int(hour), int(minute), 0, 0, time.UTC)
+	}
+	// time.Date normalizes invalid dates such as February 30th into March,
+	// and also the 29th if the year isn't a leap year.
+	valid := func(t time.Time) bool {
+		return t.Month() == time.Month(month) && t.Day() == int(day)
+	}
+	if month == 0 || day == 0 || !valid(eta(2000)) {
+		return time.Time{}
+	}
+	received = received.UTC()
+	t := eta(received.Year())
+	if t.Before(received.AddDate(0, -1, 0)) {
+		t = eta(received.Year() + 1)
+	} else if t.After(received.AddDate(0, 11, 0)) {
+		t = eta(received.Year() - 1)
+	}
+	if !valid(t) {
+		return time.Time{}
+	}
+	return t
+}
+
+// TrackPoint is a position in the tracklog of a ship.
+type TrackPoint struct {
+	Pos    geo.Point
+	At     time.Time
+	Speed  float32 // NaN if not available
+	Course float32 // NaN if not available
+}
+
 // ship contains all the information about a specific mmsi.
 type ship struct {
-	MMSI     uint32      `json:"mmsi"`
-	ShipInfo             // Contains the static information about the ship
-	ShipPos              // Contains information about the current position, speed, heading, etc.
-	history  []geo.Point // Stores the ship's tracklog
-	mu       *sync.Mutex
+	MMSI       uint32       `json:"mmsi"`
+	ShipInfo                // Contains the static information about the ship
+	ShipPos                 // Contains information about the current position, speed, heading, etc.
+	history    []TrackPoint // Stores the ship's tracklog, thinned by ShipDB.addToHistory()
+	mu         *sync.Mutex
+	static     bool           // ShipInfo has been set, counted by ShipDB.withStatic
+	PosSource  string         // The source ShipPos was last received from
+	InfoSource string         // The source ShipInfo was last received from
+	InfoAt     time.Time      // When ShipInfo was last received
+	statusLog  []statusChange // oldest first, bounded by ShipDB.statusChanges
+	AtoN       *AtoNInfo      // Set if this is an aid to navigation
+	ownShip    bool           // Sent by the receiving station itself, counted by ShipDB.ownShips
+	// Set when a ship with the same IMO number has been seen with another MMSI,
+	// such as after it has been reflagged.
+	previousMMSI uint32    // the MMSI this ship had before
+	replacedBy   uint32    // the MMSI this ship has now
+	replacedAt   time.Time // when the new MMSI sent the IMO number, compared with ShipPos.Received
+	// The source whose positions win when several receivers hear the ship,
+	// see ShipDB.prefer().
+	preferredSource string
+	preference      int // counts up for updates from preferredSource and down for others, see prefer()
+	reception       reception
+}
+
+// statusChange is a change of the navigation status of a ship.
+type statusChange struct {
+	At       time.Time
+	From, To ShipNavStatus
+}
+
+// statusChangeProp is how a statusChange is shown in shipProp.
+type statusChangeProp struct {
+	At   time.Time `json:"at"`
+	From string    `json:"from"`
+	To   string    `json:"to"`
+}
+
+// historyPoints returns the positions of the tracklog that are not older than since.
+// Pass the zero time to get all.
+func (s *ship) historyPoints(since time.Time) []geo.Point {
+	points := make([]geo.Point, 0, len(s.history))
+	for _, tp := range s.history {
+		if !tp.At.Before(since) {
+			points = append(points, tp.Pos)
+		}
+	}
+	return points
+}
+
+// downsample returns at most maxPoints points evenly spaced through points,
+// always including the first and the last.
+// maxPoints must be at least two, or zero to not downsample.
+func downsample(points []geo.Point, maxPoints int) []geo.Point {
+	if maxPoints <= 0 || len(points) <= maxPoints {
+		return points
+	}
+	sampled := make([]geo.Point, maxPoints)
+	for i := range sampled {
+		sampled[i] = points[sampleIndex(i, len(points), maxPoints)]
+	}
+	return sampled
+}
+
+// sampleIndex returns the index of the i-th of maxPoints points evenly spaced
+// through length points, rounded.
+func sampleIndex(i, length, maxPoints int) int {
+	return (i*(length-1) + (maxPoints-1)/2) / (maxPoints - 1)
 }
 
 func isFinite(v float32) bool {
 	return !(math.IsNaN(float64(v)) || math.IsInf(float64(v), 0))
 }
 
+// roundFloat32 is geo.RoundTo for the float32 fields of ShipPos.
+func roundFloat32(v float32, decimals int) float32 {
+	return float32(geo.RoundTo(float64(v), decimals))
+}
+
+// motionPrecision is how many decimals to round speed, course and rate of
+// turn to: at most one, because AIS has a resolution of a tenth of a knot or
+// degree, and what the decimals of float32 become in float64 is only noise.
+func motionPrecision(precision int) int {
+	if precision < 0 || precision > 1 {
+		return 1
+	}
+	return precision
+}
+
+// shipProp is the properties of a ship in Select(), with unknown fields omitted.
+type shipProp struct {
+	// captialized because the marshaller ignores private fields
+	MMSI    uint32 `json:"mmsi"`
+	Type    string `json:"item_type"`         // The type of vessel (decoded from the mmsi)
+	Country string `json:"country,omitempty"` // The ships country (decoded from the mmsi)
+	Flag    string `json:"flag,omitempty"`    // ISO 3166-1 alpha-2 code of Country
+	// from ShipPos
+	Time          time.Time  `json:"last_updated"`
+	Received      *time.Time `json:"received,omitempty"`
+	PosAge        *int64     `json:"position_age_seconds,omitempty"` // since Time
+	PosSource     string     `json:"position_source,omitempty"`
+	Latitude      *float64   `json:"latitude,omitempty"`
+	Longitude     *float64   `json:"longitude,omitempty"`
+	ReportedPos   *geo.Point `json:"reported_position,omitempty"` // when the geometry is extrapolated
+	Accuracy      string     `json:"accuracy"`
+	Resolution    float32    `json:"position_resolution_m,omitempty"` // of long-range reports
+	NavStatus     *string    `json:"status,omitempty"`
+	NavStatusCode *uint8     `json:"status_code,omitempty"` // the number NavStatus is decoded from
+	Heading       *float32   `json:"heading,omitempty"`
+	Course        *float32   `json:"course,omitempty"`
+	Speed         *float32   `json:"speed,omitempty"`
+	SpeedAtLeast  bool       `json:"speed_at_least,omitempty"` // speed is 102.2 or more
+	RateOfTurn    *float32   `json:"rate_of_turn,omitempty"`
+	// from ShipInfo
+	VesselType     *string    `json:"vessel_type,omitempty"`
+	VesselTypeCode *uint8     `json:"vessel_type_code,omitempty"` // the number VesselType is decoded from
+	IMO            *uint32    `json:"imo,omitempty"`
+	PreviousMMSI   uint32     `json:"previous_mmsi,omitempty"` // of a ship with the same IMO
+	ReplacedBy     uint32     `json:"replaced_by_mmsi,omitempty"`
+	Draught        *float32   `json:"draught,omitempty"`
+	Length         *uint16    `json:"length,omitempty"`
+	Width          *uint16    `json:"width,omitempty"`
+	LengthOffset   *int16     `json:"lengthoffset,omitempty"` // from center
+	WidthOffset    *int16     `json:"widthoffset,omitempty"`  // from center
+	Callsign       *string    `json:"callSign,omitempty"`
+	ShipName       *string    `json:"name,omitempty"`
+	Dest           *string    `json:"destination,omitempty"`
+	ETA            *time.Time `json:"eta,omitempty"`
+	InfoSource     string     `json:"static_source,omitempty"`
+	InfoAt         *time.Time `json:"static_updated,omitempty"`
+	// oldest first
+	StatusChanges []statusChangeProp `json:"status_changes,omitempty"`
+	Reception     *receptionProp     `json:"reception,omitempty"` // only in SelectTrack
+	// aids to navigation only
+	AtoNType    *string `json:"aton_type,omitempty"`
+	OffPosition *bool   `json:"off_position,omitempty"`
+	Virtual     *bool   `json:"virtual_aton,omitempty"`
+}
+
 // MarshalJSON is used by the json Marshaler.
 // The json value of the ShipPos object with NaN fields ommitted.
 func (s *ship) MarshalJSON() ([]byte, error) {
-	var jsonfriendly struct {
-		// captialized because the marshaller ignores private fields
-		MMSI    uint32 `json:"mmsi"`
-		Type    string `json:"item_type"` // The type of vessel (decoded from the mmsi)
-		Country string `json:"country"`   // The ships country (decoded from the mmsi)
-		// from ShipPos
-		Time       time.Time `json:"last_updated"`
-		Latitude   *float64  `json:"latitude,omitempty"`
-		Longitude  *float64  `json:"longitude,omitempty"`
-		Accuracy   string    `json:"accuracy"`
-		NavStatus  *string   `json:"status,omitempty"`
-		Heading    *float32  `json:"heading,omitempty"`
-		Course     *float32  `json:"course,omitempty"`
-		Speed      *float32  `json:"speed,omitempty"`
-		RateOfTurn *float32  `json:"rate_of_turn,omitempty"`
-		// from ShipInfo
-		VesselType   *string   `json:"vessel_type,omitempty"`
-		Draught      *float32  `json:"draught,omitempty"`
-		Length       *uint16   `json:"length,omitempty"`
-		Width        *uint16   `json:"width,omitempty"`
-		LengthOffset *int16    `json:"lengthoffset,omitempty"` // from center
-		WidthOffset  *int16    `json:"widthoffset,omitempty"`  // from center
-		Callsign     *string   `json:"callSign,omitempty"`
-		ShipName     *string   `json:"name,omitempty"`
-		Dest         *string   `json:"destination,omitempty"`
-		ETA          time.Time `json:"eta,omitempty"`
-	}
+	return json.Marshal(s.properties(geo.FullPrecision))
+}
 
+// properties returns the fields to show about the ship, with position rounded
+// to precision decimals, and speed, course and rate of turn to motionPrecision(precision).
+func (s *ship) properties(precision int) shipProp {
+	var jsonfriendly shipProp
 	jsonfriendly.MMSI = s.MMSI
-	jsonfriendly.Type = Mmsi(s.MMSI).Type()
-	jsonfriendly.Country = strings.TrimSpace(Mmsi(s.MMSI).CountryCode())
+	jsonfriendly.PreviousMMSI = s.previousMMSI
+	jsonfriendly.ReplacedBy = s.replacedBy
+	jsonfriendly.Type = Mmsi(s.MMSI).Kind().String()
+	jsonfriendly.Country = Mmsi(s.MMSI).Country()
+	jsonfriendly.Flag = Mmsi(s.MMSI).Alpha2()
 
 	jsonfriendly.Time = s.At
-	if !math.IsNaN(s.Pos.Lat) && !math.IsInf(s.Pos.Lat, 0) {
-		jsonfriendly.Latitude = &s.Pos.Lat
+	if !s.Received.IsZero() {
+		jsonfriendly.Received = &s.Received
+	}
+	if !s.At.IsZero() {
+		age := int64(time.Since(s.At) / time.Second)
+		jsonfriendly.PosAge = &age
+	}
+	jsonfriendly.PosSource = s.PosSource
+	// round copies so that the stored values are unaffected
+	pos := s.Pos.Rounded(precision)
+	if !math.IsNaN(pos.Lat) && !math.IsInf(pos.Lat, 0) {
+		jsonfriendly.Latitude = &pos.Lat
 	}
-	if !math.IsNaN(s.Pos.Long) && !math.IsInf(s.Pos.Long, 0) {
-		jsonfriendly.Longitude = &s.Pos.Long
+	if !math.IsNaN(pos.Long) && !math.IsInf(pos.Long, 0) {
+		jsonfriendly.Longitude = &pos.Long
 	}
 	jsonfriendly.Accuracy = s.PosAccuracy.String()
+	jsonfriendly.Resolution = s.Resolution
 	if s.NavStatus != 15 {
-		s := s.NavStatus.String()
-		jsonfriendly.NavStatus = &s
+		status, code := s.NavStatus.String(), uint8(s.NavStatus)
+		jsonfriendly.NavStatus = &status
+		jsonfriendly.NavStatusCode = &code
 	}
 	if isFinite(s.BowHeading) {
 		jsonfriendly.Heading = &s.BowHeading
 	}
 	if isFinite(s.Course) {
-		jsonfriendly.Course = &s.Course
+		course := roundFloat32(s.Course, motionPrecision(precision))
+		jsonfriendly.Course = &course
 	}
 	if isFinite(s.Speed) {
-		jsonfriendly.Speed = &s.Speed
+		speed := roundFloat32(s.Speed, motionPrecision(precision))
+		jsonfriendly.Speed = &speed
+		jsonfriendly.SpeedAtLeast = s.SpeedAtLeast
 	}
 	if isFinite(s.RateOfTurn) {
-		jsonfriendly.RateOfTurn = &s.RateOfTurn
+		rot := roundFloat32(s.RateOfTurn, motionPrecision(precision))
+		jsonfriendly.RateOfTurn = &rot
 	}
 
 	shipTypeStr := s.ShipInfo.VesselType.String()
 	if shipTypeStr != "Not available" && shipTypeStr != "" {
+		code := uint8(s.ShipInfo.VesselType)
 		jsonfriendly.VesselType = &shipTypeStr
+		jsonfriendly.VesselTypeCode = &code
+	}
+	if ValidIMO(s.ShipInfo.IMO) {
+		jsonfriendly.IMO = &s.ShipInfo.IMO
 	}
 	if s.ShipInfo.Draught != 0 { // FIXME does this mean unknown?
 		draught := float32(s.ShipInfo.Draught) / 10
@@ -277,9 +549,29 @@ func (s *ship) MarshalJSON() ([]byte, error) {
 	if len(s.ShipInfo.Dest) != 0 {
 		jsonfriendly.Dest = &s.ShipInfo.Dest
 	}
-	jsonfriendly.ETA = s.ShipInfo.ETA // hope time has an empty
-
-	return json.Marshal(jsonfriendly)
+	if !s.ShipInfo.ETA.IsZero() {
+		jsonfriendly.ETA = &s.ShipInfo.ETA
+	}
+	jsonfriendly.InfoSource = s.InfoSource
+	if !s.InfoAt.IsZero() {
+		jsonfriendly.InfoAt = &s.InfoAt
+	}
+	for _, c := range s.statusLog {
+		jsonfriendly.StatusChanges = append(jsonfriendly.StatusChanges,
+			statusChangeProp{c.At, c.From.String(), c.To.String()})
+	}
+	if s.AtoN != nil {
+		atonType := s.AtoN.Type.String()
+		offPosition, virtual := s.AtoN.OffPosition, s.AtoN.Virtual
+		jsonfriendly.Type = atonItemType
+		jsonfriendly.AtoNType = &atonType
+		jsonfriendly.OffPosition = &offPosition
+		jsonfriendly.Virtual = &virtual
+	}
+	if s.ownShip {
+		jsonfriendly.Type = ownShipItemType
+	}
+	return jsonfriendly
 }
 
 // The presence of the ship.
@@ -294,8 +586,13 @@ const (
 )
 
 // Check whether the ship has stopped sending, and compact history if it left the area.
+// A ship that has been replaced by another MMSI has left the area until it
+// sends a new position, but its history is kept.
 // `s.mu` should be held while calling this.
 func (db *ShipDB) CheckPresence(s *ship, now time.Time) ShipState {
+	if s.replacedBy != 0 && !s.Received.After(s.replacedAt) {
+		return ShipLeftArea
+	}
 	if s.ShipPos.NavStatus.Stopped() {
 		if db.goneThreshold > 0 && now.Sub(s.At) > db.goneThreshold {
 			return ShipInactive
@@ -303,7 +600,7 @@ func (db *ShipDB) CheckPresence(s *ship, now time.Time) ShipState {
 	} else {
 		if db.leftAreaThreshold > 0 && now.Sub(s.At) > db.leftAreaThreshold {
 			if len(s.history) > 2 {
-				newHist := make([]geo.Point, 2)
+				newHist := make([]TrackPoint, 2)
 				newHist[0] = s.history[0]
 				newHist[1] = s.history[len(s.history)-1]
 				s.history = newHist
@@ -314,25 +611,228 @@ func (db *ShipDB) CheckPresence(s *ship, now time.Time) ShipState {
 	return ShipPresent
 }
 
-// ShipDB contains all the ships.
+// ShipDB contains all the ships,
+// and which MMSI last sent each IMO number in imos.
 type ShipDB struct {
+	vanished          uint64 // first for alignment of atomic operations
+	withStatic        uint64 // number of ships with static information, also atomic
+	ownShips          uint64 // number of ships marked by MarkOwnShip, also atomic
+	implausible       uint64 // positions that implied speeds above MaxPlausibleSpeed, also atomic
+	jitter            uint64 // positions dropped by isJitter(), also atomic
+	evicted           uint64 // ships removed by EvictOldest, also atomic
 	ships             map[uint32]*ship
+	imos              map[uint32]uint32
 	rw                *sync.RWMutex
 	historyMax        int           // maximum number of points allowed to be stored in the history
-	historyMin        int           // number of positions retained when the history is full
+	historySpan       time.Duration // Points older than this compared to the newest are removed, zero means no limit.
+	minDistance       float64       // in meters: closer points are thinned out unless minInterval has passed
+	minInterval       time.Duration // A point is kept if this much time has passed, even if it's close
 	goneThreshold     time.Duration // Duration without update after which a ship that was not moving is hidden from map.
 	leftAreaThreshold time.Duration // Duration without update after which a ship that was moving is hidden from map.
+	statusChanges     int           // maximum number of navigation status changes remembered for each ship
+	lru               updateHeap    // for finding the least recently updated ships, see eviction.go
+	lruSeq            uint64        // incremented for every ship added to lru
+	sources           sourceNames   // for reception
+	// Don't add positions that imply speeds above MaxPlausibleSpeed to the tracklog.
+	// Must be set before the first update.
+	SkipImplausible bool
+	// How far ahead positions are projected when extrapolating,
+	// positions older than this are projected this far. Zero disables it.
+	MaxExtrapolation time.Duration
+	// The fraction of historyMax points that are kept when the history is
+	// full, between 0 and 1. A high value purges more often.
+	// Must be set before the first update.
+	HistoryRetain float64
+	// Ships with these types are left out by FilterMatches and Includes,
+	// and Suppressed returns true for them. They're still stored.
+	// Must be set before the first update.
+	SuppressTypes map[ShipType]bool
+	// Remember when ships were updated, so that EvictOldest can remove the oldest.
+	// Must be set before the first update.
+	Evictable bool
 }
 
+// DefaultMaxExtrapolation is the initial value of ShipDB.MaxExtrapolation.
+const DefaultMaxExtrapolation = 3 * time.Minute
+
+// DefaultHistoryRetain is the initial value of ShipDB.HistoryRetain.
+const DefaultHistoryRetain = 0.6
+
 // NewShipDB creates and returns a pointer to a new ShipInfo object.
-func NewShipDB(historyMax uint, goneThreshold, leftAreaThreshold time.Duration) *ShipDB {
+// A position is only added to the tracklog if it's more than minDistance
+// meters or minInterval away from the previous one.
+// The tracklog is limited to historyMax points and to historySpan.
+// With historyMax 0 only the latest position is kept, as it's needed to
+// check the next one, so Select returns no tracklog.
+// The last statusChanges changes of navigation status are remembered,
+// zero disables it.
+func NewShipDB(historyMax uint, historySpan time.Duration,
+	minDistance float64, minInterval time.Duration,
+	goneThreshold, leftAreaThreshold time.Duration, statusChanges uint) *ShipDB {
 	return &ShipDB{
-		make(map[uint32]*ship),
-		&sync.RWMutex{},
-		int(historyMax),
-		int(float32(historyMax) * 0.6),
-		goneThreshold,
-		leftAreaThreshold,
+		ships:             make(map[uint32]*ship),
+		imos:              make(map[uint32]uint32),
+		rw:                &sync.RWMutex{},
+		historyMax:        int(historyMax),
+		historySpan:       historySpan,
+		minDistance:       minDistance,
+		minInterval:       minInterval,
+		goneThreshold:     goneThreshold,
+		leftAreaThreshold: leftAreaThreshold,
+		statusChanges:     int(statusChanges),
+		lru:               updateHeap{index: make(map[uint32]int)},
+		MaxExtrapolation:  DefaultMaxExtrapolation,
+		HistoryRetain:     DefaultHistoryRetain,
+	}
+}
+
+// metersPerDegree converts distances from geo.Point.DistanceTo() to meters.
+// A minute of latitude is one nautical mile. A degree of longitude is shorter
+// except at the equator, so the distance is overestimated when moving east or west.
+const metersPerDegree = 60 * 1852
+
+// farEnough returns true if both points should be kept in the tracklog.
+func (db *ShipDB) farEnough(a, b TrackPoint) bool {
+	return a.Pos.DistanceTo(b.Pos)*metersPerDegree > db.minDistance ||
+		b.At.Sub(a.At) > db.minInterval
+}
+
+// stoppedDrift is how many meters a moored or anchored ship must move from
+// its last remembered position for a new position to be remembered.
+const stoppedDrift = 10
+
+// drifted returns true if a stopped ship has moved far enough that the new
+// position isn't redundant.
+func drifted(last, pos geo.Point) bool {
+	return last.DistanceTo(pos)*metersPerDegree > stoppedDrift
+}
+
+// MaxPlausibleSpeed is the speed in knots above which movement to a new
+// position is assumed to be caused by a corrupted position.
+// Movements shorter than a nautical mile are never implausible,
+// so that imprecise positions received close together are not flagged.
+const MaxPlausibleSpeed = 110
+
+// plausible returns false if a ship cannot have moved from the last point in
+// its tracklog to pos by at.
+func plausible(last TrackPoint, pos geo.Point, at time.Time) bool {
+	meters := last.Pos.HaversineDistanceTo(pos)
+	if meters <= 1852 {
+		return true
+	}
+	hours := at.Sub(last.At).Hours()
+	return hours > 0 && meters/1852/hours <= MaxPlausibleSpeed
+}
+
+// Implausible returns the number of positions that implied a speed above
+// MaxPlausibleSpeed since the previous position of the ship.
+func (db *ShipDB) Implausible() uint64 {
+	return atomic.LoadUint64(&db.implausible)
+}
+
+// When two receivers hear the same ship, their clocks and delays differ a
+// little, so interleaving their positions makes the track zigzag.
+// A position from another source than the current one that is at most
+// jitterWindow and jitterDistance meters away from it is therefore dropped,
+// unless its source is the preferred one, in which case it replaces the
+// current position even if it's older.
+const (
+	jitterWindow   = 2 * time.Second
+	jitterDistance = 50
+	// maxPreference is how many more updates other sources must provide
+	// than the preferred source before one of them takes over.
+	maxPreference = 5
+)
+
+// prefer counts an update from source, and returns true if source is
+// the preferred source of the ship. The first source is preferred until
+// other sources have provided maxPreference more of the recent updates,
+// so that it keeps the ship when several sources hear all of its reports.
+// `s.mu` should be held while calling this.
+func (db *ShipDB) prefer(s *ship, source string) bool {
+	if source == s.preferredSource {
+		if s.preference < maxPreference {
+			s.preference++
+		}
+		return true
+	}
+	s.preference--
+	if s.preference <= 0 || s.preferredSource == "" {
+		s.preferredSource = source
+		s.preference = maxPreference
+		return true
+	}
+	return false
+}
+
+// isJitter returns true if a position is so close in time and space to the
+// current position from another source that it's probably the same fix with
+// a different clock or delay.
+// `s.mu` should be held while calling this.
+func isJitter(s *ship, source string, update ShipPos) bool {
+	dt := update.At.Sub(s.At)
+	return source != s.PosSource && s.PosSource != "" && update.Resolution == s.Resolution &&
+		dt <= jitterWindow && dt >= -jitterWindow &&
+		s.Pos.DistanceTo(update.Pos)*metersPerDegree <= jitterDistance
+}
+
+// coarseFixDelay is how much newer a position with a coarser resolution must
+// be to replace the current one, and how much older a finer position can be
+// and still replace a coarser one.
+// Long-range reports (type 27) from satellites can arrive long after the
+// fix, and their time is when they were received.
+const coarseFixDelay = 10 * time.Minute
+
+// replacesPos returns whether an update is better than the current
+// position of a ship, by comparing both time and resolution.
+func replacesPos(current, update *ShipPos) bool {
+	switch {
+	case update.Resolution > current.Resolution:
+		return update.At.Sub(current.At) > coarseFixDelay
+	case update.Resolution < current.Resolution:
+		return update.At.After(current.At.Add(-coarseFixDelay))
+	default:
+		return update.At.After(current.At)
+	}
+}
+
+// Jitter returns the number of positions dropped because another source
+// had sent nearly the same position just before, see isJitter().
+func (db *ShipDB) Jitter() uint64 {
+	return atomic.LoadUint64(&db.jitter)
+}
+
+// addToHistory adds a position to the tracklog of the ship while keeping it thin and bounded.
+// The last point is always the latest position, but is replaced by the next
+// one unless it's far enough from the point before it.
+// `s.mu` should be held while calling this.
+func (db *ShipDB) addToHistory(s *ship, tp TrackPoint) {
+	n := len(s.history)
+	if n >= 2 && !db.farEnough(s.history[n-2], s.history[n-1]) {
+		s.history[n-1] = tp
+	} else {
+		if n >= db.historyMax && n > 0 { //purge the slice
+			keep := int(float64(db.historyMax) * db.HistoryRetain)
+			if keep >= db.historyMax {
+				keep = db.historyMax - 1 // make room for tp
+			}
+			if keep < 0 {
+				keep = 0
+			}
+			// copy() handles overlapping slices, so this keeps the last points in order
+			copy(s.history[:keep], s.history[n-keep:])
+			s.history = s.history[:keep]
+		}
+		s.history = append(s.history, tp)
+	}
+	if db.historySpan > 0 {
+		old := 0
+		for old < len(s.history)-1 && tp.At.Sub(s.history[old].At) > db.historySpan {
+			old++
+		}
+		if old > 0 {
+			s.history = s.history[:copy(s.history, s.history[old:])]
+		}
 	}
 }
 
@@ -352,63 +852,257 @@ func (db *ShipDB) get(mmsi uint32) *ship {
 	return s
 }
 
+// testHookBeforeJoin is called for each match before they're looked up in Matches and TerseMatches,
+// to let tests remove ships at the worst possible moment.
+var testHookBeforeJoin = func(Match) {}
+
+// getMatches returns the ships of matches from the index, with nil for those
+// that have been removed since the index was searched.
+// That is an expected race and not an error, so it's only counted.
+// The map is locked once for all of them instead of once per ship, as
+// whole-world views can have tens of thousands of matches.
+func (db *ShipDB) getMatches(matches []Match) []*ship {
+	for _, m := range matches {
+		testHookBeforeJoin(m)
+	}
+	ships := make([]*ship, len(matches))
+	vanished := uint64(0)
+	db.rw.RLock()
+	for i, m := range matches {
+		ships[i] = db.ships[m.MMSI]
+		if ships[i] == nil {
+			vanished++
+		}
+	}
+	db.rw.RUnlock()
+	if vanished != 0 {
+		atomic.AddUint64(&db.vanished, vanished)
+	}
+	return ships
+}
+
+// Vanished returns the number of ships that were found in the index but had
+// been removed before they could be looked up.
+func (db *ShipDB) Vanished() uint64 {
+	return atomic.LoadUint64(&db.vanished)
+}
+
+// remove forgets a ship.
+// The caller is responsible for removing it from any index.
+func (db *ShipDB) remove(mmsi uint32) {
+	db.rw.Lock()
+	s := db.ships[mmsi]
+	delete(db.ships, mmsi)
+	db.untrack(mmsi)
+	db.rw.Unlock()
+	if s != nil {
+		db.forget(s)
+	}
+}
+
+// forget updates the counters and the IMO index for a ship that has been
+// removed from the map, and returns its last position.
+func (db *ShipDB) forget(s *ship) geo.Point {
+	s.mu.Lock()
+	if s.static {
+		atomic.AddUint64(&db.withStatic, ^uint64(0))
+	}
+	if s.ownShip {
+		atomic.AddUint64(&db.ownShips, ^uint64(0))
+	}
+	imo, pos := s.IMO, s.Pos
+	s.mu.Unlock()
+	db.rw.Lock()
+	if db.imos[imo] == s.MMSI {
+		delete(db.imos, imo)
+	}
+	db.rw.Unlock()
+	return pos
+}
+
 // addShip creates a new ship object in the map, and returns a pointer to it.
 func (db *ShipDB) addShip(mmsi uint32) *ship {
 	// Creating the new ship-object
 	newS := &ship{
-		mmsi,
-		UnknownInfo,
-		UnknownPos,
-		make([]geo.Point, 0, db.historyMax),
-		&sync.Mutex{},
+		MMSI:     mmsi,
+		ShipInfo: UnknownInfo,
+		ShipPos:  UnknownPos,
+		history:  make([]TrackPoint, 0, db.historyMax),
+		mu:       &sync.Mutex{},
 	}
 	db.rw.Lock()
 	// Check that it doesnt overwrite some other value.
 	s, ok := db.ships[mmsi]
 	if !ok {
 		db.ships[mmsi] = newS
+		db.track(mmsi)
 		s = newS
 	}
 	db.rw.Unlock()
 	return s
 }
 
-// UpdateStatic updates the ship's static information.
-func (db *ShipDB) UpdateStatic(mmsi uint32, update ShipInfo) {
+// UpdateStatic updates the ship's static information,
+// and remembers which source it was received from and when.
+// Fields that are zero or empty in update are not changed.
+// If the IMO number was last sent by another MMSI, the ships are linked,
+// and the other is hidden from the map until it sends a new position.
+func (db *ShipDB) UpdateStatic(mmsi uint32, source string, received time.Time, update ShipInfo) {
 	s := db.get(mmsi)
 	if s == nil {
 		s = db.addShip(mmsi)
 	}
+	previous := uint32(0)
+	if ValidIMO(update.IMO) {
+		previous = db.indexIMO(update.IMO, mmsi)
+	}
+	if old := db.get(previous); old != nil {
+		old.mu.Lock()
+		old.replacedBy, old.replacedAt = mmsi, received
+		old.mu.Unlock()
+	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.ShipInfo = update
+	if previous != 0 {
+		s.previousMMSI = previous
+	}
+	if ValidIMO(update.IMO) {
+		// it's the current MMSI of the ship again
+		s.replacedBy, s.replacedAt = 0, time.Time{}
+	}
+	s.ShipInfo.merge(update)
+	s.reception.addStatic(db.sources.id(source), received)
+	s.InfoSource = source
+	s.InfoAt = received
+	if !s.static {
+		s.static = true
+		atomic.AddUint64(&db.withStatic, 1)
+	}
 }
 
-// UpdateDynamic updates the ship's dynamic information.
-func (db *ShipDB) UpdateDynamic(mmsi uint32, update ShipPos) {
+// ownShipItemType replaces the kind of MMSI as item_type for own ships.
+const ownShipItemType = "Own ship"
+
+// MarkOwnShip flags a known ship as the receiving station itself,
+// which is learned from VDO sentences and not received over the air.
+// Own ships are hidden from the map unless asked for, see MatchFilter.
+// Returns true if the ship is known and wasn't already marked.
+func (db *ShipDB) MarkOwnShip(mmsi uint32) bool {
+	s := db.get(mmsi)
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ownShip {
+		return false
+	}
+	s.ownShip = true
+	atomic.AddUint64(&db.ownShips, 1)
+	return true
+}
+
+// indexIMO remembers that imo was last sent by mmsi,
+// and returns the MMSI that sent it before if that was another one.
+func (db *ShipDB) indexIMO(imo, mmsi uint32) (previous uint32) {
+	db.rw.Lock()
+	defer db.rw.Unlock()
+	previous = db.imos[imo]
+	db.imos[imo] = mmsi
+	if previous == mmsi {
+		return 0
+	}
+	return previous
+}
+
+// WithIMO returns the MMSI that last sent the IMO number.
+func (db *ShipDB) WithIMO(imo uint32) (mmsi uint32, known bool) {
+	db.rw.RLock()
+	defer db.rw.RUnlock()
+	mmsi, known = db.imos[imo]
+	return mmsi, known
+}
+
+// UpdateDynamic updates the ship's dynamic information,
+// and remembers which source it was received from.
+// Values that mean not available are replaced, see SanitizePos.
+// Positions that imply an implausible speed are counted,
+// and not added to the tracklog if SkipImplausible is set.
+// Positions from other receivers than the preferred one of the ship are
+// dropped if they're barely different from the current one, see isJitter(),
+// and so are positions that are older or coarser than the current one,
+// see replacesPos().
+// Returns whether the update replaced the current position.
+func (db *ShipDB) UpdateDynamic(mmsi uint32, source string, update ShipPos) bool {
+	update = SanitizePos(update)
 	s := db.get(mmsi)
 	if s == nil {
 		s = db.addShip(mmsi)
 	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	// Check that the updated information is newer than the current info.
-	if update.At.After(s.At) {
-		hasPos := isFinite(float32(update.Pos.Lat)) && isFinite(float32(update.Pos.Long))
-		isRedundant := update.NavStatus.Stopped() && s.ShipPos.NavStatus.Stopped()
-		if hasPos && (!isRedundant || len(s.history) == 0) {
-			if len(s.history) >= db.historyMax { //purge the slice
-				copy(s.history[:db.historyMin], s.history[db.historyMax-db.historyMin:])
-				s.history = s.history[:db.historyMin]
-			}
-			s.history = append(s.history, geo.Point{update.Pos.Lat, update.Pos.Long})
+	s.reception.addPosition(db.sources.id(source), update.Received)
+	preferred := db.prefer(s, source)
+	hasPos := isFinite(float32(update.Pos.Lat)) && isFinite(float32(update.Pos.Long))
+	jitter := hasPos && isJitter(s, source, update)
+	if jitter && !preferred {
+		atomic.AddUint64(&db.jitter, 1)
+		return false
+	}
+	// Check that the updated information is newer or finer than the current info,
+	// unless it's the preferred source's version of the current position.
+	if !jitter && !replacesPos(&s.ShipPos, &update) {
+		return false
+	}
+	if jitter || !update.At.After(s.At) {
+		// replace the other source's or the coarser position in the tracklog,
+		// as long as that doesn't make it go back in time
+		n := len(s.history)
+		if n != 0 && s.history[n-1].At.Equal(s.At) && (n < 2 || s.history[n-2].At.Before(update.At)) {
+			s.history[n-1] = TrackPoint{update.Pos, update.At, update.Speed, update.Course}
+		}
+	} else {
+		if hasPos && len(s.history) != 0 && !plausible(s.history[len(s.history)-1], update.Pos, update.At) {
+			atomic.AddUint64(&db.implausible, 1)
+			hasPos = !db.SkipImplausible
 		}
-		s.ShipPos = update
+		isRedundant := update.NavStatus.Stopped() && s.ShipPos.NavStatus.Stopped() &&
+			len(s.history) != 0 && !drifted(s.history[len(s.history)-1].Pos, update.Pos)
+		if hasPos && !isRedundant {
+			db.addToHistory(s, TrackPoint{update.Pos, update.At, update.Speed, update.Course})
+		}
+	}
+	if !s.At.IsZero() && update.NavStatus != s.NavStatus {
+		db.addStatusChange(s, statusChange{update.At, s.NavStatus, update.NavStatus})
+	}
+	s.ShipPos = update
+	s.PosSource = source
+	return true
+}
+
+// addStatusChange appends to the status log of the ship, and drops the oldest
+// change if the log is full.
+// `s.mu` should be held while calling this.
+func (db *ShipDB) addStatusChange(s *ship, c statusChange) {
+	if db.statusChanges <= 0 {
+		return
+	}
+	if len(s.statusLog) >= db.statusChanges {
+		n := copy(s.statusLog, s.statusLog[len(s.statusLog)-db.statusChanges+1:])
+		s.statusLog = s.statusLog[:n]
 	}
+	s.statusLog = append(s.statusLog, c)
 }
 
 // Coords returns the coordinates of the ship.
 func (db *ShipDB) Coords(mmsi uint32) (lat, long float64) {
+	lat, long, _ = db.KnownCoords(mmsi)
+	return
+}
+
+// KnownCoords returns the coordinates of the ship and whether it's known,
+// with a single lookup so that the ship can't be removed in between.
+func (db *ShipDB) KnownCoords(mmsi uint32) (lat, long float64, known bool) {
 	s := db.get(mmsi)
 	if s != nil {
 		s.mu.Lock()
@@ -416,66 +1110,216 @@ func (db *ShipDB) Coords(mmsi uint32) (lat, long float64) {
 		lat = s.Pos.Lat
 		long = s.Pos.Long
 	}
-	return
+	return lat, long, s != nil
+}
+
+// ShipCounts summarizes the ships in a ShipDB.
+type ShipCounts struct {
+	Ships         int `json:"ships"`
+	Recent        int `json:"recent"`         // sent a position within the duration passed to Counts()
+	WithStatic    int `json:"with_static"`    // has static information such as name
+	PositionOnly  int `json:"position_only"`  // has a position but no static information
+	HistoryPoints int `json:"history_points"` // in the tracklogs of all ships
+}
+
+// Name returns the name of the ship, or "" if it's unknown.
+func (db *ShipDB) Name(mmsi uint32) string {
+	s := db.get(mmsi)
+	if s == nil {
+		return ""
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ShipName
 }
 
-// GeoJSON Feature structure.
-type feature struct {
-	Type       string           `json:"type"`
-	ID         uint32           `json:"id"`
-	Geometry   Geometry         `json:"geometry"`
-	Properties *json.RawMessage `json:"properties"`
+// snapshot returns the ships that are currently in the DB, sorted by MMSI.
+// The map is only locked while copying the pointers.
+func (db *ShipDB) snapshot() []*ship {
+	db.rw.RLock()
+	ships := make([]*ship, 0, len(db.ships))
+	for _, s := range db.ships {
+		ships = append(ships, s)
+	}
+	db.rw.RUnlock()
+	sort.Slice(ships, func(i, j int) bool { return ships[i].MMSI < ships[j].MMSI })
+	return ships
 }
 
-var emptyJSONObject = json.RawMessage(`{}`) //empty struct
+// Count returns the number of ships.
+func (db *ShipDB) Count() int {
+	db.rw.RLock()
+	defer db.rw.RUnlock()
+	return len(db.ships)
+}
+
+// ForEach calls fn with a copy of the information about every ship, in order
+// of MMSI, until it returns false.
+// The ships are those that were in the DB when ForEach was called, except
+// those that have been removed since. Each ship is only locked while it's
+// being copied, so fn can take its time.
+func (db *ShipDB) ForEach(fn func(mmsi uint32, info ShipInfo, pos ShipPos, history []geo.Point) bool) {
+	for _, s := range db.snapshot() {
+		s.mu.Lock()
+		info, pos := s.ShipInfo, s.ShipPos
+		history := s.historyPoints(time.Time{})
+		s.mu.Unlock()
+		if db.get(s.MMSI) != s {
+			continue // removed or replaced
+		}
+		if !fn(s.MMSI, info, pos, history) {
+			return
+		}
+	}
+}
+
+// Counts iterates over the ships to count them.
+// The map is only locked while copying the ship pointers,
+// and each ship is only locked while it's being counted.
+func (db *ShipDB) Counts(recent time.Duration) ShipCounts {
+	ships := db.snapshot()
+	c := ShipCounts{
+		Ships:      len(ships),
+		WithStatic: int(atomic.LoadUint64(&db.withStatic)),
+	}
+	since := time.Now().Add(-recent)
+	for _, s := range ships {
+		s.mu.Lock()
+		if s.At.After(since) {
+			c.Recent++
+		}
+		if !s.static && len(s.history) != 0 {
+			c.PositionOnly++
+		}
+		c.HistoryPoints += len(s.history)
+		s.mu.Unlock()
+	}
+	return c
+}
+
+// roundedPoints returns a rounded copy of points.
+// If no rounding is requested, points itself is returned.
+func roundedPoints(points []geo.Point, precision int) []geo.Point {
+	if precision < 0 {
+		return points
+	}
+	rounded := make([]geo.Point, len(points))
+	for i, p := range points {
+		rounded[i] = p.Rounded(precision)
+	}
+	return rounded
+}
+
+// extrapolated returns where the ship is projected to be at now based on its
+// last position, course and speed, or false if it shouldn't be extrapolated:
+// because it's not moving, is moored or at anchor, or its course or speed is unknown.
+// Positions older than db.MaxExtrapolation are only projected that far.
+// The ship must be locked.
+func (db *ShipDB) extrapolated(s *ship, now time.Time) (geo.Point, bool) {
+	age := now.Sub(s.At)
+	if db.MaxExtrapolation <= 0 || s.At.IsZero() || age <= 0 ||
+		!geo.LegalCoord(s.Pos.Lat, s.Pos.Long) || s.NavStatus.Stopped() ||
+		!isFinite(s.Course) || !isFinite(s.Speed) || s.Speed <= 0 {
+		return s.Pos, false
+	}
+	if age > db.MaxExtrapolation {
+		age = db.MaxExtrapolation
+	}
+	return geo.ProjectPosition(s.Pos, float64(s.Course), float64(s.Speed), age), true
+}
 
 // Select returns the info about the ship and its tracklog as a geojson FeatureCollection object.
-func (db *ShipDB) Select(mmsi uint32, logger *l.Logger) string {
+// Coordinates, speed and course are rounded to precision decimals,
+// pass geo.FullPrecision to not round.
+func (db *ShipDB) Select(mmsi uint32, precision int, logger *l.Logger) string {
+	return db.SelectTrack(mmsi, precision, 0, 0, false, logger)
+}
+
+// SelectTrack is Select with a limited tracklog:
+// it's downsampled to at most maxPoints positions (which must be at least 2),
+// and positions older than since are left out.
+// Zero disables either limit.
+// If extrapolate is true the current location is where the ship is projected
+// to be now, see extrapolated().
+func (db *ShipDB) SelectTrack(mmsi uint32, precision, maxPoints int, since time.Duration,
+	extrapolate bool, logger *l.Logger) string {
 	s := db.get(mmsi)
 	if s == nil {
 		return ""
 	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	db.CheckPresence(s, time.Now()) // but display the info we keep regardsless
-	p, err := json.Marshal(s)
-	if err != nil {
-		logger.Error("error converting info for %u to JSON: %s", mmsi, err.Error())
-		return ""
+	now := time.Now()
+	db.CheckPresence(s, now) // but display the info we keep regardsless
+	cutoff := time.Time{}
+	if since != 0 {
+		cutoff = now.Add(-since)
+	}
+	fc := newFeatureCollection(2)
+	// The current location and all the properties,
+	// or only the properties if the ship hasn't sent a position yet.
+	prop := s.properties(precision)
+	prop.Reception = db.receptionProperties(s)
+	point := Feature{
+		Type: "Feature",
+		ID:   mmsi,
+	}
+	if !math.IsNaN(s.Pos.Lat) {
+		pos := s.Pos
+		if extrapolate {
+			if projected, ok := db.extrapolated(s, now); ok {
+				reported := s.Pos.Rounded(precision)
+				prop.ReportedPos = &reported
+				pos = projected
+			}
+		}
+		point.Geometry = &Geometry{Coordinates: []geo.Point{pos.Rounded(precision)}}
 	}
-	prop := json.RawMessage(p)
-	var features string
-	if len(s.history) != 0 { //The geojson point of the current location and all the properties
-		feature1 := feature{
+	point.Properties = prop
+	fc.Features = append(fc.Features, point)
+
+	//Making the LineString object of the ships tracklog (must contain at least 2 points).
+	track := downsample(s.historyPoints(cutoff), maxPoints)
+	if len(track) >= 2 {
+		fc.Features = append(fc.Features, Feature{
 			Type:       "Feature",
 			ID:         mmsi,
-			Geometry:   Geometry{[]geo.Point{s.Pos}}, // The geojson geometry field,
-			Properties: &prop,
-		}
-		b1, err := json.Marshal(feature1)
-		if err != nil {
-			logger.Error("error converting position for %u to JSON: %s", mmsi, err.Error())
-			return ""
+			Geometry:   &Geometry{Coordinates: roundedPoints(track, precision)},
+			Properties: struct{}{},
+		})
+	}
+	return fc.encode(logger)
+}
+
+// Track returns a copy of the static information, current position and
+// tracklog of a ship, with the tracklog limited like in SelectTrack.
+// known is false if there is no ship with the MMSI.
+func (db *ShipDB) Track(mmsi uint32, maxPoints int, since time.Duration) (info ShipInfo, pos ShipPos, track []TrackPoint, known bool) {
+	s := db.get(mmsi)
+	if s == nil {
+		return info, pos, nil, false
+	}
+	cutoff := time.Time{}
+	if since != 0 {
+		cutoff = time.Now().Add(-since)
+	}
+	s.mu.Lock()
+	info, pos = s.ShipInfo, s.ShipPos
+	track = make([]TrackPoint, 0, len(s.history))
+	for _, tp := range s.history {
+		if !tp.At.Before(cutoff) {
+			track = append(track, tp)
 		}
-		features = string(b1)
-
-		//Making the LineString object of the ships tracklog (must contain at least 2 points).
-		if len(s.history) >= 2 {
-			feature2 := feature{
-				Type:       "Feature",
-				ID:         mmsi,
-				Geometry:   Geometry{s.history},
-				Properties: &emptyJSONObject,
-			}
-			b2, err := json.Marshal(feature2)
-			if err != nil {
-				logger.Error("error converting position history for %u to JSON: %s", mmsi, err.Error())
-				return ""
-			}
-			features = features + ",\n" + string(b2)
+	}
+	s.mu.Unlock()
+	if maxPoints > 0 && len(track) > maxPoints {
+		sampled := make([]TrackPoint, maxPoints)
+		for i := range sampled {
+			sampled[i] = track[sampleIndex(i, len(track), maxPoints)]
 		}
+		track = sampled
 	}
-	return `{"type":"FeatureCollection","features":[` + features + `]}`
+	return info, pos, track, true
 }
 
 // Contains a set of "name, height" values.
@@ -483,45 +1327,250 @@ func (db *ShipDB) Select(mmsi uint32, logger *l.Logger) string {
 type mProp struct {
 	Name   string `json:"name,omitempty"`
 	Length uint16 `json:"length,omitempty"`
+	// so that markers can be colored by type, see ShipType
+	VesselTypeCode uint8 `json:"vessel_type_code,omitempty"`
+	// aids to navigation and own ships only
+	ItemType    string `json:"item_type,omitempty"`
+	AtoNType    string `json:"aton_type,omitempty"`
+	OffPosition *bool  `json:"off_position,omitempty"`
+	// extrapolated ships only
+	ReportedPos *geo.Point `json:"reported_position,omitempty"`
+	PosAge      *int64     `json:"position_age_seconds,omitempty"`
+	// verbose only
+	FirstSeen *time.Time `json:"first_seen,omitempty"`
 }
 
 // Matches produces the geojson FeatureCollection containing all the matching ships along with the length and name of the ship.
-func Matches(matches *[]Match, db *ShipDB, logger *l.Logger) string { //TODO move this to archive.go instead?
-	features := []string{}
+// Coordinates are rounded to precision decimals, pass geo.FullPrecision to not round.
+// If extrapolate is true, moving ships are placed where they're projected to be now.
+// If verbose is true, when each ship was first seen is included.
+// See StreamMatches for producing it while searching the index.
+func Matches(matches *[]Match, db *ShipDB, precision int, extrapolate, verbose bool, logger *l.Logger) string { //TODO move this to archive.go instead?
+	var sb strings.Builder
+	fw := newFeatureWriter(&sb, logger)
 	now := time.Now()
-	for _, m := range *matches {
-		s := db.get(m.MMSI)
+	for i, s := range db.getMatches(*matches) {
 		if s == nil {
-			logger.Error("Ship %u exists in R-tree but not in MMSI map", m.MMSI)
 			continue
 		}
-		point := Geometry{[]geo.Point{geo.Point{m.Lat, m.Long}}}
+		m := (*matches)[i]
+		if f, ok := db.matchFeature(s, m, precision, extrapolate, verbose, false, now); ok {
+			fw.add(f)
+		}
+	}
+	fw.close(false) // cannot fail
+	return sb.String()
+}
+
+// matchFeature produces the GeoJSON Feature of a ship on the map,
+// or false if it has left the area.
+// If extrapolate is true and the ship is moving, the Feature is placed where
+// it's projected to be at now, and the position from m is in the properties.
+// If verbose is true, the properties also include when the ship was first seen.
+// If shapes is true, ships with known dimensions and heading are a Polygon of
+// their outline instead of a Point, see shipOutline().
+func (db *ShipDB) matchFeature(s *ship, m Match, precision int, extrapolate, verbose, shapes bool, now time.Time) (Feature, bool) {
+	pos := geo.Point{Lat: m.Lat, Long: m.Long}
+	s.mu.Lock()
+	prop := mProp{Name: s.ShipName, Length: s.Length, VesselTypeCode: uint8(s.VesselType)}
+	if s.AtoN != nil {
+		offPosition := s.AtoN.OffPosition
+		prop.ItemType = atonItemType
+		prop.AtoNType = s.AtoN.Type.String()
+		prop.OffPosition = &offPosition
+	}
+	if s.ownShip {
+		prop.ItemType = ownShipItemType
+	}
+	if extrapolate {
+		if projected, ok := db.extrapolated(s, now); ok {
+			reported, age := pos.Rounded(precision), int64(now.Sub(s.At)/time.Second)
+			prop.ReportedPos, prop.PosAge = &reported, &age
+			pos = projected
+		}
+	}
+	if verbose && s.reception.firstSeen != 0 {
+		firstSeen := time.Unix(0, s.reception.firstSeen).UTC()
+		prop.FirstSeen = &firstSeen
+	}
+	var outline *Geometry
+	if shapes {
+		outline = shipOutline(s, pos, precision)
+	}
+	presence := db.CheckPresence(s, now)
+	s.mu.Unlock()
+	if presence == ShipLeftArea {
+		return Feature{}, false // TODO remove from R-tree
+	}
+	if outline == nil {
+		outline = &Geometry{Coordinates: []geo.Point{pos.Rounded(precision)}}
+	}
+	return Feature{
+		Type:       "Feature",
+		ID:         m.MMSI,
+		Geometry:   outline,
+		Properties: prop,
+	}, true
+}
+
+// MapFeature returns the same GeoJSON Feature as Matches would for a single ship,
+// or an empty string if the ship is unknown or has left the area.
+func (db *ShipDB) MapFeature(mmsi uint32, precision int, logger *l.Logger) string {
+	s := db.get(mmsi)
+	if s == nil {
+		return ""
+	}
+	s.mu.Lock()
+	m := Match{MMSI: mmsi, Lat: s.Pos.Lat, Long: s.Pos.Long}
+	s.mu.Unlock()
+	f, ok := db.matchFeature(s, m, precision, false, false, false, time.Now())
+	if !ok {
+		return ""
+	}
+	b, err := json.Marshal(f)
+	if err != nil {
+		logger.Error("Error JSON-encoding map feature for %d: %s", mmsi, err.Error())
+		return ""
+	}
+	return string(b)
+}
+
+// terseMatches is the compact alternative to the FeatureCollection of Matches.
+// The arrays are parallel: index i of each array belongs to the same ship.
+type terseMatches struct {
+	MMSI      []uint32   `json:"mmsi"`
+	Latitude  []float64  `json:"lat"`
+	Longitude []float64  `json:"lon"`
+	Course    []*float32 `json:"cog"` // null if unknown
+}
+
+// TerseMatches produces the same ships as Matches, but as parallel arrays of
+// MMSI, latitude, longitude and course over ground instead of GeoJSON.
+// Name and length are not included.
+func TerseMatches(matches *[]Match, db *ShipDB, precision int, logger *l.Logger) string {
+	t := terseMatches{
+		MMSI:      make([]uint32, 0, len(*matches)),
+		Latitude:  make([]float64, 0, len(*matches)),
+		Longitude: make([]float64, 0, len(*matches)),
+		Course:    make([]*float32, 0, len(*matches)),
+	}
+	now := time.Now()
+	for i, s := range db.getMatches(*matches) {
+		if s == nil {
+			continue
+		}
+		m := (*matches)[i]
 		s.mu.Lock()
-		p, err := json.Marshal(mProp{s.ShipName, s.Length})
+		course := s.Course
 		presence := db.CheckPresence(s, now)
 		s.mu.Unlock()
-		if err != nil {
-			logger.Error("Error JSON-encoding map info of %u: %s", m.MMSI, err.Error())
-			continue //skip this ship
+		if presence == ShipLeftArea {
+			continue
+		}
+		var cog *float32
+		if isFinite(course) {
+			rounded := roundFloat32(course, motionPrecision(precision))
+			cog = &rounded
+		}
+		t.MMSI = append(t.MMSI, m.MMSI)
+		t.Latitude = append(t.Latitude, geo.RoundTo(m.Lat, precision))
+		t.Longitude = append(t.Longitude, geo.RoundTo(m.Long, precision))
+		t.Course = append(t.Course, cog)
+	}
+	b, err := json.Marshal(t)
+	if err != nil {
+		logger.Error("Error JSON-encoding terse matches: %s", err.Error())
+		return `{"mmsi":[],"lat":[],"lon":[],"cog":[]}`
+	}
+	return string(b)
+}
+
+// MaxClusterGrid is the largest grid size accepted by ClusteredMatches, in degrees.
+const MaxClusterGrid = 45.0
+
+// clusterCell identifies a cell of the grid within one of the searched rectangles.
+type clusterCell struct {
+	rect      int
+	lat, long int64
+}
+
+// cluster is the ships within one cell
+type cluster struct {
+	cell  clusterCell
+	first Match
+	ship  *ship // of first
+	count int
+}
+
+// clusterProp is the properties of a cluster Feature
+type clusterProp struct {
+	Count int `json:"count"`
+}
+
+// ClusteredMatches is Matches with ships aggregated into the cells of a grid
+// with gridSize degrees between the lines, which must be between 0 and MaxClusterGrid.
+// Cells with more than one ship becomes a Point at the center of the part of
+// the cell that is within the rectangle, with the number of ships as the only
+// property. Cells with one ship have the same Feature as in Matches.
+// rects should be the rectangles that were searched to get matches.
+func ClusteredMatches(matches *[]Match, rects []geo.Rectangle, gridSize float64,
+	db *ShipDB, precision int, logger *l.Logger) string {
+	cells := make(map[clusterCell]*cluster)
+	clusters := []*cluster{} // in the order of matches
+	now := time.Now()
+	for i, s := range db.getMatches(*matches) {
+		if s == nil {
+			continue
 		}
+		m := (*matches)[i]
+		s.mu.Lock()
+		presence := db.CheckPresence(s, now)
+		s.mu.Unlock()
 		if presence == ShipLeftArea {
-			continue // TODO remove from R-tree
+			continue
 		}
-		prop := json.RawMessage(p)
-		f := feature{
-			Type:       "Feature",
-			ID:         m.MMSI,
-			Geometry:   point,
-			Properties: &prop,
+		cell := clusterCell{
+			lat:  int64(math.Floor(m.Lat / gridSize)),
+			long: int64(math.Floor(m.Long / gridSize)),
+		}
+		for i := range rects {
+			if rects[i].ContainsPoint(geo.Point{Lat: m.Lat, Long: m.Long}) {
+				cell.rect = i
+				break
+			}
+		}
+		c := cells[cell]
+		if c == nil {
+			c = &cluster{cell: cell, first: m, ship: s}
+			cells[cell] = c
+			clusters = append(clusters, c)
+		}
+		c.count++
+	}
+
+	fc := newFeatureCollection(len(clusters))
+	for _, c := range clusters {
+		if c.count == 1 {
+			if f, ok := db.matchFeature(c.ship, c.first, precision, false, false, false, now); ok {
+				fc.Features = append(fc.Features, f)
+			}
+			continue
 		}
-		b, err := json.Marshal(f)
-		if err != nil {
-			logger.Error("Error JSON-encoding map feature for %u: %s", m.MMSI, err.Error())
-			continue //skip this ship
+		min := geo.Point{Lat: float64(c.cell.lat) * gridSize, Long: float64(c.cell.long) * gridSize}
+		max := geo.Point{Lat: min.Lat + gridSize, Long: min.Long + gridSize}
+		if c.cell.rect < len(rects) { // clamp to the searched area
+			r := &rects[c.cell.rect]
+			min.Lat, min.Long = math.Max(min.Lat, r.Min().Lat), math.Max(min.Long, r.Min().Long)
+			max.Lat, max.Long = math.Min(max.Lat, r.Max().Lat), math.Min(max.Long, r.Max().Long)
 		}
-		features = append(features, string(b))
+		center := geo.Point{Lat: (min.Lat + max.Lat) / 2, Long: (min.Long + max.Long) / 2}
+		fc.Features = append(fc.Features, Feature{
+			Type:       "Feature",
+			Geometry:   &Geometry{Coordinates: []geo.Point{center.Rounded(precision)}},
+			Properties: clusterProp{c.count},
+		})
 	}
-	return `{"type":"FeatureCollection","features":[` + strings.Join(features, ",\n") + `]}`
+	return fc.encode(logger)
 }
 
 /*
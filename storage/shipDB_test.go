@@ -3,12 +3,16 @@ package storage
 
 import (
 	"encoding/json"
+	"math"
 	"math/rand"
+	"os"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/tormol/AIS/geo"
+	l "github.com/tormol/AIS/logger"
 )
 
 func randShipsPos(nShips, nMessages int) *map[uint32][]ShipPos {
@@ -28,19 +32,28 @@ func randShipPos(extra int) ShipPos {
 	lat := float64(rand.Int31n(90)) * RandSign()
 	posAcc := Accuracy(true)
 	navstat := ShipNavStatus(uint8(0))
-	bowHeading := uint16(rand.Int31n(360))
+	bowHeading := float32(rand.Int31n(360))
 	course := float32(rand.Int31n(360))
 	speed := float32(rand.Int31n(80))
 	rot := float32(rand.Int31n(360))
-	return ShipPos{time.Now().Add(time.Duration(extra) * time.Nanosecond), geo.Point{lat, long}, posAcc, navstat, bowHeading, course, speed, rot}
+	return ShipPos{
+		At:          time.Now().Add(time.Duration(extra) * time.Nanosecond),
+		Pos:         geo.Point{Lat: lat, Long: long},
+		PosAccuracy: posAcc,
+		NavStatus:   navstat,
+		BowHeading:  bowHeading,
+		Course:      course,
+		Speed:       speed,
+		RateOfTurn:  rot,
+	}
 }
 
 func new(n, m int) (*ShipDB, *map[uint32][]ShipPos) {
-	db := NewShipDB()
+	db := NewShipDB(100, 0, 0, 0, 0, 0, 0)
 	ships := randShipsPos(n, m)
 	for mmsi, s := range *ships {
 		for _, m := range s {
-			db.UpdateDynamic(mmsi, m)
+			db.UpdateDynamic(mmsi, "test", m)
 		}
 	}
 	return db, ships
@@ -49,7 +62,7 @@ func new(n, m int) (*ShipDB, *map[uint32][]ShipPos) {
 /*TESTS*/
 //Check for errors and concurrency
 func TestUpdateDynamic(t *testing.T) {
-	db := NewShipDB()
+	db := NewShipDB(100, 0, 0, 0, 0, 0, 0)
 	var wg sync.WaitGroup
 	nShips := 100
 	nMessages := 80
@@ -59,7 +72,7 @@ func TestUpdateDynamic(t *testing.T) {
 		go func(messages []ShipPos, mmsi uint32) {
 			defer wg.Done()
 			for _, m := range messages {
-				db.UpdateDynamic(mmsi, m)
+				db.UpdateDynamic(mmsi, "test", m)
 			}
 		}(s, mmsi)
 	}
@@ -73,8 +86,67 @@ func TestUpdateDynamic(t *testing.T) {
 	}
 }
 
+func TestSanitizePos(t *testing.T) {
+	nan := float32(math.NaN())
+	valid := ShipPos{Pos: geo.Point{Lat: 60, Long: 5}, BowHeading: 359, Course: 359.9, Speed: 102.1, RateOfTurn: -708}
+	cases := []struct {
+		name     string
+		change   func(p *ShipPos)
+		expected func(p *ShipPos)
+	}{
+		{"valid", func(p *ShipPos) {}, func(p *ShipPos) {}},
+		{"latitude not available", func(p *ShipPos) { p.Pos.Lat = LatNotAvailable },
+			func(p *ShipPos) { p.Pos = UnknownPos.Pos }},
+		{"longitude not available", func(p *ShipPos) { p.Pos.Long = LongNotAvailable },
+			func(p *ShipPos) { p.Pos = UnknownPos.Pos }},
+		{"position not available", func(p *ShipPos) { p.Pos = geo.Point{Lat: 91, Long: 181} },
+			func(p *ShipPos) { p.Pos = UnknownPos.Pos }},
+		{"latitude out of range", func(p *ShipPos) { p.Pos.Lat = -95 },
+			func(p *ShipPos) { p.Pos = UnknownPos.Pos }},
+		{"heading not available", func(p *ShipPos) { p.BowHeading = HeadingNotAvailable },
+			func(p *ShipPos) { p.BowHeading = nan }},
+		{"heading out of range", func(p *ShipPos) { p.BowHeading = 360 },
+			func(p *ShipPos) { p.BowHeading = nan }},
+		{"course not available", func(p *ShipPos) { p.Course = CourseNotAvailable },
+			func(p *ShipPos) { p.Course = nan }},
+		{"course out of range", func(p *ShipPos) { p.Course = 409.5 },
+			func(p *ShipPos) { p.Course = nan }},
+		{"speed not available", func(p *ShipPos) { p.Speed = 1023.0 / 10 },
+			func(p *ShipPos) { p.Speed = nan }},
+		{"speed at least", func(p *ShipPos) { p.Speed = 1022.0 / 10 },
+			func(p *ShipPos) { p.Speed, p.SpeedAtLeast = SpeedAtLeast, true }},
+		{"negative speed", func(p *ShipPos) { p.Speed = -1 },
+			func(p *ShipPos) { p.Speed = nan }},
+		{"infinite rate of turn", func(p *ShipPos) { p.RateOfTurn = float32(math.Inf(1)) },
+			func(p *ShipPos) { p.RateOfTurn = nan }},
+	}
+	same := func(a, b float32) bool {
+		return a == b || (math.IsNaN(float64(a)) && math.IsNaN(float64(b)))
+	}
+	for _, c := range cases {
+		input, expected := valid, valid
+		c.change(&input)
+		c.expected(&expected)
+		got := SanitizePos(input)
+		if !same(float32(got.Pos.Lat), float32(expected.Pos.Lat)) ||
+			!same(float32(got.Pos.Long), float32(expected.Pos.Long)) ||
+			!same(got.BowHeading, expected.BowHeading) || !same(got.Course, expected.Course) ||
+			!same(got.Speed, expected.Speed) || got.SpeedAtLeast != expected.SpeedAtLeast ||
+			!same(got.RateOfTurn, expected.RateOfTurn) {
+			t.Errorf("%s: expected %+v, got %+v", c.name, expected, got)
+		}
+	}
+
+	// not recorded in the history
+	db := NewShipDB(100, 0, 0, 0, 0, 0, 0)
+	db.UpdateDynamic(1, "test", ShipPos{At: time.Now(), Pos: geo.Point{Lat: 91, Long: 5}})
+	if db.Counts(time.Minute).HistoryPoints != 0 {
+		t.Error("Expected a position with only one coordinate not available to not be added to the history")
+	}
+}
+
 func TestUpdateStatic(t *testing.T) {
-	db := NewShipDB()
+	db := NewShipDB(100, 0, 0, 0, 0, 0, 0)
 	n := 1500 //number of ships
 	m := 300  //number of updates per ship
 	var wg sync.WaitGroup
@@ -83,7 +155,7 @@ func TestUpdateStatic(t *testing.T) {
 		go func(mmsi uint32) {
 			defer wg.Done()
 			for j := 0; j < m; j++ {
-				db.UpdateStatic(mmsi, ShipInfo{1, 1, 1, 1, 1, 1, "CALL", "NAME", "SOME_DEST", time.Now()})
+				db.UpdateStatic(mmsi, "test", time.Now(), ShipInfo{1, 1, 1, 1, 1, 1, "CALL", "NAME", "SOME_DEST", time.Now(), 0})
 			}
 		}(uint32(i))
 	}
@@ -112,7 +184,7 @@ func TestUpdateStatic(t *testing.T) {
 		{uint32(n + 1), ShipInfo{Length: 20, Dest: "NEW_DEST"}}, //updating mmsi: n+1
 	}
 	for _, c := range cases {
-		db.UpdateStatic(c.mmsi, c.message)
+		db.UpdateStatic(c.mmsi, "test", time.Now(), c.message)
 	}
 	//Testing if the ships updated correctly:
 	if db.ships[uint32(n+2)].ShipName != "NEW_NAME" {
@@ -130,7 +202,7 @@ func TestUpdateStatic(t *testing.T) {
 			t.Fail()
 		} else {
 			m := randShipPos(1)
-			db.UpdateDynamic(c.mmsi, m)
+			db.UpdateDynamic(c.mmsi, "test", m)
 		}
 	}
 }
@@ -140,7 +212,7 @@ func TestGeoJSON(t *testing.T) {
 		mmsi    uint32
 		call    string
 		dest    string
-		heading uint16
+		heading float32
 		name    string
 		length  uint16
 	}{
@@ -148,15 +220,25 @@ func TestGeoJSON(t *testing.T) {
 		{1, "CALL1", "", 1, "NAME1", 10},
 		{2, "", "", 360, "", 20},
 		{3, "", "", 90, "", 30},
+		{5, "CALL\\5", "DEST\"5\"", 180, "NAME \"5\"\nSECOND LINE", 40},
 	}
 	for _, c := range cases {
-		i := ship{c.mmsi, Mmsi(c.mmsi).Type(), Mmsi(c.mmsi).CountryCode(), ShipInfo{Length: c.length, Dest: c.dest, Callsign: c.call, ShipName: c.name}, ShipPos{BowHeading: c.heading}, []geo.Point{}, &sync.Mutex{}}
+		i := &ship{
+			MMSI:     c.mmsi,
+			ShipInfo: ShipInfo{Length: c.length, Dest: c.dest, Callsign: c.call, ShipName: c.name},
+			ShipPos:  ShipPos{BowHeading: c.heading},
+			history:  []TrackPoint{},
+			mu:       &sync.Mutex{},
+		}
 		p, err := json.Marshal(i)
 		if err != nil {
 			t.Log("ERROR", err)
 			t.Fail()
 		}
-		var b ship
+		var b struct {
+			ShipInfo
+			BowHeading float32 `json:"heading"`
+		}
 		err = json.Unmarshal(p, &b)
 		if err != nil {
 			t.Log("ERROR, could not unmarshal the ship object:", string(p), "... got error: ", err)
@@ -186,6 +268,90 @@ func TestGeoJSON(t *testing.T) {
 	}
 }
 
+func TestSourceAttribution(t *testing.T) {
+	db := NewShipDB(100, 0, 0, 0, 0, 0, 0)
+	now := time.Now().Truncate(time.Second)
+	pos := ShipPos{At: now.Add(-time.Minute), Pos: geo.Point{Lat: 60, Long: 5}}
+	db.UpdateStatic(257000001, "first", now.Add(-time.Hour), ShipInfo{ShipName: "NAME"})
+	db.UpdateDynamic(257000001, "first", pos)
+	db.UpdateStatic(257000001, "second", now.Add(-30*time.Minute), ShipInfo{ShipName: "NAME"})
+	older := pos
+	older.At = pos.At.Add(-time.Second)
+	db.UpdateDynamic(257000001, "second", older) // ignored
+
+	p, err := json.Marshal(db.get(257000001))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		PosSource  string    `json:"position_source"`
+		PosAge     int64     `json:"position_age_seconds"`
+		InfoSource string    `json:"static_source"`
+		InfoAt     time.Time `json:"static_updated"`
+	}
+	if err = json.Unmarshal(p, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.PosSource != "first" || got.PosAge < 60 || got.PosAge > 120 {
+		t.Errorf("Expected the position from first a minute ago, got %s", string(p))
+	}
+	if got.InfoSource != "second" || !got.InfoAt.Equal(now.Add(-30*time.Minute)) {
+		t.Errorf("Expected the static information from second half an hour ago, got %s", string(p))
+	}
+}
+
+func TestFeatureCollectionEscaping(t *testing.T) {
+	const name = "NAME \"WITH\" QUOTES\nAND NEWLINE"
+	db := NewShipDB(100, 0, 0, 0, 0, 0, 0)
+	pos := UnknownPos
+	pos.At = time.Now()
+	pos.Pos = geo.Point{Lat: 59, Long: 5.5}
+	db.UpdateDynamic(1, "test", pos)
+	pos.Pos.Lat += 0.01
+	pos.At = pos.At.Add(time.Minute)
+	db.UpdateDynamic(1, "test", pos)
+	db.UpdateStatic(1, "test", time.Now(), ShipInfo{ShipName: name, Length: 10})
+
+	var fc struct {
+		Type     string
+		Features []struct {
+			Type     string
+			ID       uint32
+			Geometry struct {
+				Type        string
+				Coordinates json.RawMessage
+			}
+			Properties struct {
+				Name string
+			}
+		}
+	}
+	matches := []Match{{MMSI: 1, Lat: 59, Long: 5.5}}
+	for what, text := range map[string]string{
+		"Select":  db.Select(1, geo.FullPrecision, nil),
+		"Matches": Matches(&matches, db, geo.FullPrecision, false, false, nil),
+	} {
+		if err := json.Unmarshal([]byte(text), &fc); err != nil {
+			t.Errorf("%s produced invalid JSON %s: %s", what, text, err.Error())
+			continue
+		}
+		if fc.Type != "FeatureCollection" || len(fc.Features) == 0 {
+			t.Errorf("%s: expected a FeatureCollection, got %s", what, text)
+			continue
+		}
+		f := fc.Features[0]
+		if f.Type != "Feature" || f.ID != 1 || f.Geometry.Type != "Point" || f.Properties.Name != name {
+			t.Errorf("%s: unexpected first feature in %s", what, text)
+		}
+		if what == "Matches" && len(fc.Features) != 1 {
+			t.Errorf("Expected Matches to have one feature, got %d", len(fc.Features))
+		}
+	}
+	if text := db.Select(1, geo.FullPrecision, nil); !strings.Contains(text, `"type":"LineString"`) {
+		t.Errorf("Expected Select to include the track, got %s", text)
+	}
+}
+
 func TestCoords(t *testing.T) {
 	n := 500
 	m := 123
@@ -261,14 +427,860 @@ func TestShipNavStatus(t *testing.T) {
 	}
 }
 
+func TestCodeFields(t *testing.T) {
+	db := NewShipDB(100, 0, 0, 0, 0, 0, 0)
+	for _, mmsi := range []uint32{257000001, 257000002} {
+		pos := UnknownPos
+		pos.At = time.Now()
+		pos.Pos = geo.Point{Lat: 59, Long: 5}
+		if mmsi == 257000001 {
+			pos.NavStatus = 0 // a valid code that must not be omitted
+		}
+		db.UpdateDynamic(mmsi, "test", pos)
+	}
+	db.UpdateStatic(257000001, "test", time.Now(), ShipInfo{VesselType: 70})
+
+	known := db.Select(257000001, 5, nil)
+	for _, want := range []string{`"status":"Under way using engine"`, `"status_code":0`,
+		`"vessel_type":"Cargo"`, `"vessel_type_code":70`} {
+		if !strings.Contains(known, want) {
+			t.Errorf("expected %s in %s", want, known)
+		}
+	}
+	unknown := db.Select(257000002, 5, nil)
+	for _, absent := range []string{`"status`, `"vessel_type`} {
+		if strings.Contains(unknown, absent) {
+			t.Errorf("expected no %s fields for status 15 and type 0 in %s", absent, unknown)
+		}
+	}
+
+	matches := []Match{{MMSI: 257000001, Lat: 59, Long: 5}, {MMSI: 257000002, Lat: 59, Long: 5}}
+	text := Matches(&matches, db, 5, false, false, nil)
+	if strings.Count(text, `"vessel_type_code":70`) != 1 || strings.Count(text, `"vessel_type_code"`) != 1 {
+		t.Errorf("expected the type code of only the first ship in %s", text)
+	}
+}
+
+func TestTerseMatches(t *testing.T) {
+	db := NewShipDB(100, 0, 0, 0, 0, 0, 0)
+	positions := []struct {
+		mmsi      uint32
+		lat, long float64
+		course    float32
+	}{
+		{257000001, 59.0470833333, 5.4538666666, 281.94},
+		{257000002, -33.8567844, -0.0000001, float32(math.NaN())},
+		{257000003, 0, 179.9999999, 0},
+	}
+	matches := []Match{}
+	for _, p := range positions {
+		pos := UnknownPos
+		pos.At = time.Now()
+		pos.Pos = geo.Point{Lat: p.lat, Long: p.long}
+		pos.Course = p.course
+		db.UpdateDynamic(p.mmsi, "test", pos)
+		matches = append(matches, Match{MMSI: p.mmsi, Lat: p.lat, Long: p.long})
+	}
+	matches = append(matches, Match{MMSI: 1}) // not in db; should be skipped
+
+	var got struct {
+		MMSI []uint32   `json:"mmsi"`
+		Lat  []float64  `json:"lat"`
+		Lon  []float64  `json:"lon"`
+		Cog  []*float32 `json:"cog"`
+	}
+	quiet := l.NewLogger(os.Stderr, l.Debug) // Debug only prints Debug
+	text := TerseMatches(&matches, db, 5, quiet)
+	if err := json.Unmarshal([]byte(text), &got); err != nil {
+		t.Fatalf("invalid JSON %s: %s", text, err.Error())
+	}
+	n := len(positions)
+	if len(got.MMSI) != n || len(got.Lat) != n || len(got.Lon) != n || len(got.Cog) != n {
+		t.Fatalf("arrays are not aligned: %s", text)
+	}
+	for i, p := range positions {
+		if got.MMSI[i] != p.mmsi {
+			t.Errorf("index %d: expected mmsi %d got %d", i, p.mmsi, got.MMSI[i])
+		}
+		if got.Lat[i] != geo.RoundTo(p.lat, 5) || got.Lon[i] != geo.RoundTo(p.long, 5) {
+			t.Errorf("index %d: expected %f,%f got %f,%f",
+				i, p.lat, p.long, got.Lat[i], got.Lon[i])
+		}
+		if isFinite(p.course) != (got.Cog[i] != nil) {
+			t.Errorf("index %d: expected cog %f got %v", i, p.course, got.Cog[i])
+		}
+	}
+	expected := `{"mmsi":[257000001,257000002,257000003],` +
+		`"lat":[59.04708,-33.85678,0],"lon":[5.45387,0,180],"cog":[281.9,null,0]}`
+	if text != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, text)
+	}
+}
+
+// clusterTestDB creates a ShipDB and R-tree with n ships at random positions
+// within the box.
+func clusterTestDB(n int, minLat, minLong, maxLat, maxLong float64) (*ShipDB, *RTree) {
+	db := NewShipDB(10, 0, 0, 0, 0, 0, 0)
+	rt := NewRTree()
+	for i := 1; i <= n; i++ {
+		pos := UnknownPos
+		pos.At = time.Now()
+		pos.Pos = geo.Point{
+			Lat:  minLat + rand.Float64()*(maxLat-minLat),
+			Long: minLong + rand.Float64()*(maxLong-minLong),
+		}
+		db.UpdateDynamic(uint32(i), "test", pos)
+		rt.InsertData(pos.Pos.Lat, pos.Pos.Long, uint32(i))
+	}
+	return db, rt
+}
+
+func TestClusteredMatches(t *testing.T) {
+	quiet := l.NewLogger(os.Stderr, l.Debug)
+	db, rt := clusterTestDB(1000, 58, 4, 62, 8)
+	// the box cuts through grid cells on all sides
+	rects := geo.SplitViewRect(58.5, 4.5, 61.5, 7.5)
+	matches := rt.FindWithinAny(rects)
+
+	var unclustered, clustered struct {
+		Features []struct {
+			ID         uint32
+			Geometry   struct{ Coordinates [2]float64 }
+			Properties struct {
+				Count int
+			}
+		}
+	}
+	if err := json.Unmarshal([]byte(Matches(matches, db, 5, false, false, quiet)), &unclustered); err != nil {
+		t.Fatal(err)
+	}
+	text := ClusteredMatches(matches, rects, 1, db, 5, quiet)
+	if err := json.Unmarshal([]byte(text), &clustered); err != nil {
+		t.Fatalf("invalid JSON %s: %s", text, err.Error())
+	}
+	sum, clusters := 0, 0
+	for _, f := range clustered.Features {
+		lon, lat := f.Geometry.Coordinates[0], f.Geometry.Coordinates[1]
+		if !rects[0].ContainsPoint(geo.Point{Lat: lat, Long: lon}) {
+			t.Errorf("Expected every feature to be within the box, got %f,%f", lon, lat)
+		}
+		if f.ID != 0 { // a single ship
+			sum++
+			continue
+		}
+		sum += f.Properties.Count
+		clusters++
+		if f.Properties.Count < 2 {
+			t.Errorf("Expected clusters to have at least two ships, got %d", f.Properties.Count)
+		}
+		// cells are clamped to the box, so the centers of the edge cells are not at .5
+		if lat != 58.75 && lat != 59.5 && lat != 60.5 && lat != 61.25 {
+			t.Errorf("Unexpected cluster center latitude %f", lat)
+		}
+		if lon != 4.75 && lon != 5.5 && lon != 6.5 && lon != 7.25 {
+			t.Errorf("Unexpected cluster center longitude %f", lon)
+		}
+	}
+	if sum != len(unclustered.Features) {
+		t.Errorf("Expected the clusters to contain %d ships, got %d", len(unclustered.Features), sum)
+	}
+	if clusters == 0 || clusters > 16 {
+		t.Errorf("Expected at most 4x4 clusters, got %d", clusters)
+	}
+}
+
+func TestETAFromFields(t *testing.T) {
+	at := func(s string) time.Time {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			panic(err)
+		}
+		return t
+	}
+	cases := []struct {
+		name                     string
+		month, day, hour, minute uint8
+		received                 string
+		expected                 string // empty for zero time
+	}{
+		{"same year", 5, 7, 23, 30, "2017-04-20T12:00:00Z", "2017-05-07T23:30:00Z"},
+		{"recently passed", 4, 1, 0, 0, "2017-04-20T12:00:00Z", "2017-04-01T00:00:00Z"},
+		{"next year", 3, 1, 6, 0, "2017-04-20T12:00:00Z", "2018-03-01T06:00:00Z"},
+		{"december to january", 1, 2, 8, 15, "2017-12-30T22:00:00Z", "2018-01-02T08:15:00Z"},
+		{"january to december", 12, 28, 16, 0, "2018-01-03T10:00:00Z", "2017-12-28T16:00:00Z"},
+		{"not available", 0, 0, 24, 60, "2017-04-20T12:00:00Z", ""},
+		{"month not available", 0, 7, 23, 30, "2017-04-20T12:00:00Z", ""},
+		{"day not available", 5, 0, 23, 30, "2017-04-20T12:00:00Z", ""},
+		{"hour and minute not available", 5, 7, 24, 60, "2017-04-20T12:00:00Z", "2017-05-07T00:00:00Z"},
+		{"invalid month", 13, 7, 12, 0, "2017-04-20T12:00:00Z", ""},
+		{"invalid day", 2, 30, 12, 0, "2017-04-20T12:00:00Z", ""},
+		{"leap day", 2, 29, 12, 0, "2016-01-20T12:00:00Z", "2016-02-29T12:00:00Z"},
+		{"leap day in other year", 2, 29, 12, 0, "2017-01-20T12:00:00Z", ""},
+	}
+	for _, c := range cases {
+		got := ETAFromFields(c.month, c.day, c.hour, c.minute, at(c.received))
+		if c.expected == "" && !got.IsZero() {
+			t.Errorf("%s: expected zero time, got %s", c.name, got)
+		} else if c.expected != "" && !got.Equal(at(c.expected)) {
+			t.Errorf("%s: expected %s, got %s", c.name, c.expected, got)
+		}
+	}
+
+	db := NewShipDB(100, 0, 0, 0, 0, 0, 0)
+	db.UpdateStatic(1, "test", time.Now(), ShipInfo{ShipName: "NO ETA"})
+	p, err := json.Marshal(db.get(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(p), `"eta"`) {
+		t.Errorf("Expected zero ETA to be omitted, got %s", p)
+	}
+}
+
+func TestStatusChanges(t *testing.T) {
+	db := NewShipDB(100, 0, 0, 0, 0, 0, 2)
+	start := time.Now().Add(-time.Hour)
+	update := func(minutes int, status ShipNavStatus) {
+		pos := UnknownPos
+		pos.At = start.Add(time.Duration(minutes) * time.Minute)
+		pos.Pos = geo.Point{Lat: 59 + float64(minutes)/100, Long: 5}
+		pos.NavStatus = status
+		db.UpdateDynamic(1, "test", pos)
+	}
+	changes := func() []statusChangeProp {
+		var fc struct {
+			Features []struct {
+				Properties struct {
+					StatusChanges []statusChangeProp `json:"status_changes"`
+				}
+			}
+		}
+		text := db.Select(1, geo.FullPrecision, nil)
+		if err := json.Unmarshal([]byte(text), &fc); err != nil || len(fc.Features) == 0 {
+			t.Fatalf("Invalid Select() output %s: %v", text, err)
+		}
+		return fc.Features[0].Properties.StatusChanges
+	}
+	const moored, underWay = ShipNavStatus(5), ShipNavStatus(0)
+	check := func(got []statusChangeProp, expected ...statusChangeProp) {
+		if len(got) != len(expected) {
+			t.Fatalf("Expected %d status changes, got %+v", len(expected), got)
+		}
+		for i := range expected {
+			if !got[i].At.Equal(expected[i].At) || got[i].From != expected[i].From || got[i].To != expected[i].To {
+				t.Errorf("Expected status change %d to be %+v, got %+v", i, expected[i], got[i])
+			}
+		}
+	}
+	change := func(minutes int, from, to ShipNavStatus) statusChangeProp {
+		return statusChangeProp{start.Add(time.Duration(minutes) * time.Minute), from.String(), to.String()}
+	}
+
+	update(0, moored)
+	update(1, moored)
+	check(changes())
+	update(2, underWay)
+	update(3, underWay)
+	update(4, moored)
+	check(changes(), change(2, moored, underWay), change(4, underWay, moored))
+	update(5, underWay)
+	check(changes(), change(4, underWay, moored), change(5, moored, underWay))
+	update(3, moored) // older than the current position
+	check(changes(), change(4, underWay, moored), change(5, moored, underWay))
+}
+
+func TestForEach(t *testing.T) {
+	db := NewShipDB(100, 0, 0, 0, 0, 0, 0)
+	start := time.Now().Add(-time.Hour)
+	update := func(mmsi uint32, i int) {
+		pos := UnknownPos
+		pos.At = start.Add(time.Duration(i) * time.Second)
+		pos.Pos = geo.Point{Lat: 59 + float64(i)/1000, Long: 5}
+		db.UpdateDynamic(mmsi, "test", pos)
+	}
+	for mmsi := uint32(1); mmsi <= 10; mmsi++ {
+		update(mmsi, 0)
+		update(mmsi, 1)
+	}
+	db.UpdateStatic(11, "test", time.Now(), ShipInfo{ShipName: "NO POSITION"})
+	if db.Count() != 11 {
+		t.Errorf("Expected 11 ships, got %d", db.Count())
+	}
+
+	visited := []uint32{}
+	db.ForEach(func(mmsi uint32, info ShipInfo, pos ShipPos, history []geo.Point) bool {
+		visited = append(visited, mmsi)
+		if mmsi == 11 && info.ShipName != "NO POSITION" {
+			t.Errorf("Expected the name of ship 11, got %q", info.ShipName)
+		} else if mmsi != 11 && len(history) != 2 {
+			t.Errorf("Expected two positions for ship %d, got %v", mmsi, history)
+		}
+		for i := range history {
+			history[i] = geo.Point{} // must not change the ship
+		}
+		return true
+	})
+	if len(visited) != 11 || visited[0] != 1 || visited[10] != 11 {
+		t.Errorf("Expected all ships in order of MMSI, got %v", visited)
+	}
+	if lat, _ := db.Coords(1); lat != 59.001 || db.get(1).history[0].Pos.Lat != 59 {
+		t.Error("Expected the history to be copied")
+	}
+	visited = visited[:0]
+	db.ForEach(func(mmsi uint32, _ ShipInfo, _ ShipPos, _ []geo.Point) bool {
+		visited = append(visited, mmsi)
+		return len(visited) < 3
+	})
+	if len(visited) != 3 {
+		t.Errorf("Expected iteration to stop after three ships, got %v", visited)
+	}
+
+	// run with -race
+	var wg sync.WaitGroup
+	for mmsi := uint32(1); mmsi <= 10; mmsi++ {
+		wg.Add(1)
+		go func(mmsi uint32) {
+			defer wg.Done()
+			for i := 2; i < 200; i++ {
+				update(mmsi, i)
+			}
+		}(mmsi)
+	}
+	for i := 0; i < 20; i++ {
+		db.ForEach(func(mmsi uint32, _ ShipInfo, pos ShipPos, history []geo.Point) bool {
+			if mmsi != 11 && (len(history) == 0 || history[len(history)-1] != pos.Pos) {
+				t.Errorf("Expected the last point of the history to be the position of %d", mmsi)
+			}
+			return true
+		})
+	}
+	wg.Wait()
+}
+
+func TestSelectPrecision(t *testing.T) {
+	db := NewShipDB(100, 0, 0, 0, 0, 0, 0)
+	pos := UnknownPos
+	pos.At = time.Now()
+	pos.Pos = geo.Point{Lat: -59.0470833333, Long: -0.0000001}
+	pos.Speed = 12.6666666
+	db.UpdateDynamic(1, "test", pos)
+	text := db.Select(1, 3, nil)
+	// speed never gets more than one decimal
+	for _, want := range []string{`"coordinates":[0,-59.047]`, `"speed":12.7`, `"latitude":-59.047`} {
+		if !strings.Contains(text, want) {
+			t.Errorf("expected %s in %s", want, text)
+		}
+	}
+	if text := db.Select(1, 0, nil); !strings.Contains(text, `"speed":13`) {
+		t.Errorf("expected the speed rounded to an integer in %s", text)
+	}
+	if db.ships[1].Pos.Lat != -59.0470833333 || db.ships[1].Speed != 12.6666666 {
+		t.Errorf("Select() modified the stored values: %v", db.ships[1].ShipPos)
+	}
+}
+
+// Feed a ship moving north at speed m/s with one position per second.
+func feedStraightTrack(db *ShipDB, mmsi uint32, start time.Time, seconds int, speed float64) {
+	for i := 0; i < seconds; i++ {
+		pos := UnknownPos
+		pos.At = start.Add(time.Duration(i) * time.Second)
+		pos.Pos = geo.Point{Lat: 58 + float64(i)*speed/metersPerDegree, Long: 5.5}
+		pos.NavStatus = 0 // under way using engine
+		db.UpdateDynamic(mmsi, "test", pos)
+	}
+}
+
+func TestHistoryThinning(t *testing.T) {
+	db := NewShipDB(100, 0, 50, time.Minute, 0, 0, 0)
+	start := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+	feedStraightTrack(db, 1, start, 5*60, 5) // 1.5 km in 5 minutes
+	history := db.ships[1].history
+	if len(history) < 25 || len(history) > 31 {
+		t.Errorf("Expected about 30 points 50m apart, got %d", len(history))
+	}
+	for i := 1; i < len(history)-1; i++ { // the last point is the latest position
+		if !db.farEnough(history[i-1], history[i]) {
+			t.Errorf("Point %d is too close to the previous: %v and %v", i, history[i-1], history[i])
+		}
+	}
+	last := history[len(history)-1]
+	if !last.At.Equal(start.Add(5*time.Minute - time.Second)) {
+		t.Errorf("Expected the last point to be the latest position, but it's from %s", last.At)
+	}
+
+	// a slow ship is kept by time
+	feedStraightTrack(db, 2, start, 10*60, 0.05) // 30 meters in 10 minutes
+	if n := len(db.ships[2].history); n < 10 || n > 12 {
+		t.Errorf("Expected about one point per minute for a slow ship, got %d", n)
+	}
+}
+
+func TestHistoryBounds(t *testing.T) {
+	db := NewShipDB(100, 0, 50, time.Minute, 0, 0, 0)
+	start := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+	feedStraightTrack(db, 1, start, 60*60, 10) // 36 km in an hour
+	if n := len(db.ships[1].history); n > 100 || n < 60 {
+		t.Errorf("Expected the count to be bounded by 100, got %d", n)
+	}
+
+	db = NewShipDB(1000, 10*time.Minute, 50, time.Minute, 0, 0, 0)
+	feedStraightTrack(db, 1, start, 60*60, 10)
+	history := db.ships[1].history
+	span := history[len(history)-1].At.Sub(history[0].At)
+	if span > 10*time.Minute || span < 9*time.Minute {
+		t.Errorf("Expected the history to span 10 minutes, got %s", span)
+	}
+}
+
+func TestHistoryPurgeKeepsTheNewest(t *testing.T) {
+	start := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+	db := NewShipDB(100, 0, 0, 0, 0, 0, 0)
+	for i := 0; i < 150; i++ {
+		pos := UnknownPos
+		pos.At = start.Add(time.Duration(i) * time.Second)
+		pos.Pos = geo.Point{Lat: 60 + float64(i)/1000, Long: 5}
+		db.UpdateDynamic(1, "test", pos)
+	}
+	history := db.ships[1].history
+	if len(history) < 60 || len(history) > 100 {
+		t.Fatalf("Expected between 60 and 100 points, got %d", len(history))
+	}
+	for i, tp := range history {
+		expected := 150 - len(history) + i
+		if tp.At != start.Add(time.Duration(expected)*time.Second) || tp.Pos.Lat != 60+float64(expected)/1000 {
+			t.Fatalf("Expected point %d to be number %d, got %v", i, expected, tp)
+		}
+	}
+}
+
+func TestHistoryCapacity(t *testing.T) {
+	start := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+	for _, c := range []struct {
+		max    uint
+		retain float64
+		min    int // after more than max positions
+	}{
+		{0, DefaultHistoryRetain, 1},
+		{5, DefaultHistoryRetain, 4},
+		{5, 0, 1},
+		{300, DefaultHistoryRetain, 181},
+		{300, 0.95, 286},
+	} {
+		db := NewShipDB(c.max, 0, 0, 0, 0, 0, 0)
+		db.HistoryRetain = c.retain
+		if cap(db.addShip(1).history) != int(c.max) {
+			t.Errorf("%d: expected the history to be allocated with capacity %d, got %d",
+				c.max, c.max, cap(db.ships[1].history))
+		}
+		for i := 0; i < 1000; i++ {
+			pos := UnknownPos
+			pos.At = start.Add(time.Duration(i) * time.Second)
+			pos.Pos = geo.Point{Lat: 60 + float64(i)/1000, Long: 5}
+			db.UpdateDynamic(1, "test", pos)
+			n := len(db.ships[1].history)
+			if n > int(c.max) && n > 1 {
+				t.Fatalf("%d/%.2f: expected at most %d points, got %d", c.max, c.retain, c.max, n)
+			} else if i > int(c.max) && n < c.min {
+				t.Fatalf("%d/%.2f: expected at least %d points, got %d", c.max, c.retain, c.min, n)
+			}
+		}
+		if last := db.ships[1].history[len(db.ships[1].history)-1]; !last.At.Equal(start.Add(999 * time.Second)) {
+			t.Errorf("%d/%.2f: expected the last point to be the latest position, got %v", c.max, c.retain, last)
+		}
+		features := strings.Count(db.Select(1, 5, nil), `"Feature"`)
+		if expected := map[bool]int{true: 1, false: 2}[c.max == 0]; features != expected {
+			t.Errorf("%d/%.2f: expected %d features, got %d", c.max, c.retain, expected, features)
+		}
+	}
+}
+
+func TestStoppedShipDrifting(t *testing.T) {
+	start := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+	db := NewShipDB(100, 0, 0, 0, 0, 0, 0)
+	for i, lat := range []float64{60, 60.00001, 60, 60.001, 60.00101, 60.002} {
+		pos := UnknownPos
+		pos.At = start.Add(time.Duration(i) * time.Minute)
+		pos.Pos = geo.Point{Lat: lat, Long: 5}
+		pos.NavStatus = 1 // at anchor
+		db.UpdateDynamic(1, "test", pos)
+	}
+	// a meter of movement is redundant, but not the 111 meter steps
+	history := db.ships[1].history
+	if len(history) != 3 || history[1].Pos.Lat != 60.001 || history[2].Pos.Lat != 60.002 {
+		t.Errorf("Expected only the positions that drifted to be remembered, got %v", history)
+	}
+}
+
+// Two receivers hear a ship moving north, one with a clock that is off and
+// a position that is a few meters east.
+func TestReceiverJitter(t *testing.T) {
+	start := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+	db := NewShipDB(100, 0, 0, 0, 0, 0, 0)
+	report := func(source string, i int, clock time.Duration, east float64) {
+		pos := UnknownPos
+		pos.At = start.Add(time.Duration(i)*3*time.Second + clock)
+		pos.Pos = geo.Point{Lat: 60 + float64(i)*15/metersPerDegree, Long: 5.5 + east/metersPerDegree*2}
+		pos.NavStatus = 0 // under way using engine
+		db.UpdateDynamic(1, source, pos)
+	}
+	for i := 0; i < 40; i++ {
+		if i%2 == 1 { // the other one arrives first with a slightly older timestamp
+			report("other", i, -500*time.Millisecond, 5)
+			report("first", i, 0, 0)
+		} else { // and then later with a newer one
+			report("first", i, 0, 0)
+			report("other", i, time.Second, 5)
+		}
+	}
+	history := db.ships[1].history
+	if len(history) != 40 {
+		t.Errorf("Expected one point per transmission, got %d", len(history))
+	}
+	for i, tp := range history {
+		if tp.Pos.Long != 5.5 {
+			t.Fatalf("Expected only positions from the first receiver, point %d is %v", i, tp)
+		} else if i != 0 && !tp.At.After(history[i-1].At) {
+			t.Fatalf("Expected the track to go forwards in time, point %d is %v after %v", i, tp, history[i-1])
+		}
+	}
+	if db.ships[1].PosSource != "first" || db.Jitter() != 20 {
+		t.Errorf("Expected the position from first and 20 dropped, got %s and %d", db.ships[1].PosSource, db.Jitter())
+	}
+
+	// when the preferred receiver stops, the other one takes over
+	for i := 40; i < 50; i++ {
+		report("other", i, time.Second, 5)
+	}
+	if n := len(db.ships[1].history); n != 50 || db.ships[1].PosSource != "other" || db.ships[1].preferredSource != "other" {
+		t.Errorf("Expected the other receiver to take over, got %d points from %s, preferring %s",
+			n, db.ships[1].PosSource, db.ships[1].preferredSource)
+	}
+}
+
+func TestImplausibleSpeed(t *testing.T) {
+	start := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+	update := func(db *ShipDB, seconds int, lat float64) {
+		pos := UnknownPos
+		pos.At = start.Add(time.Duration(seconds) * time.Second)
+		pos.Pos = geo.Point{Lat: lat, Long: 5}
+		db.UpdateDynamic(1, "test", pos)
+	}
+	for _, skip := range []bool{false, true} {
+		db := NewShipDB(100, 0, 0, 0, 0, 0, 0)
+		db.SkipImplausible = skip
+		update(db, 0, 59)
+		update(db, 60, 59.001)   // 111 meters in a minute, 3.6 knots
+		update(db, 120, 59.2)    // 22 km in a minute
+		update(db, 180, 59.0015) // back again
+		update(db, 240, 59.002)
+		update(db, 600, 59.1) // 11 km in 6 minutes, 98 knots
+		// without skipping, moving back from the implausible position also counts
+		implausible, points := uint64(2), 6
+		if skip {
+			implausible, points = 1, 5
+		}
+		if n := db.Implausible(); n != implausible {
+			t.Errorf("Expected %d implausible positions with SkipImplausible=%t, got %d", implausible, skip, n)
+		}
+		history := db.ships[1].history
+		if len(history) != points {
+			t.Errorf("Expected %d points with SkipImplausible=%t, got %v", points, skip, history)
+		} else if skip && history[2].Pos.Lat != 59.0015 {
+			t.Errorf("Expected the implausible position to be skipped, got %v", history)
+		}
+	}
+}
+
+func TestExtrapolation(t *testing.T) {
+	now := time.Now()
+	update := func(db *ShipDB, mmsi uint32, status ShipNavStatus, speed, course float32) {
+		pos := UnknownPos
+		pos.At = now.Add(-10 * time.Minute)
+		pos.Pos = geo.Point{Lat: 60, Long: 5}
+		pos.NavStatus, pos.Speed, pos.Course = status, speed, course
+		db.UpdateDynamic(mmsi, "test", pos)
+	}
+	db := NewShipDB(100, 0, 0, 0, 0, 0, 0)
+	update(db, 1, 0, 12, 90)
+	update(db, 2, 5, 12, 90) // moored
+	update(db, 3, 0, 12, float32(math.NaN()))
+	update(db, 4, 0, 0, 90)
+	cases := []struct {
+		mmsi     uint32
+		expected geo.Point
+	}{
+		{1, geo.Point{Lat: 60, Long: 5.02}}, // 0.6 nm in the 3 minutes it's capped to
+		{2, geo.Point{Lat: 60, Long: 5}},
+		{3, geo.Point{Lat: 60, Long: 5}},
+		{4, geo.Point{Lat: 60, Long: 5}},
+	}
+	for _, c := range cases {
+		m := Match{MMSI: c.mmsi, Lat: 60, Long: 5}
+		f, _ := db.matchFeature(db.ships[c.mmsi], m, 5, true, false, false, now)
+		prop := f.Properties.(mProp)
+		if p := f.Geometry.Coordinates[0]; p != c.expected {
+			t.Errorf("Expected %d to be at %v, got %v", c.mmsi, c.expected, p)
+		} else if extrapolated := c.expected.Long != 5; (prop.ReportedPos != nil) != extrapolated {
+			t.Errorf("Expected reported_position for %d to be %t, got %v", c.mmsi, extrapolated, prop.ReportedPos)
+		} else if extrapolated && (*prop.ReportedPos != geo.Point{Lat: 60, Long: 5} || *prop.PosAge != 600) {
+			t.Errorf("Expected the reported position and age, got %v and %d", *prop.ReportedPos, *prop.PosAge)
+		}
+	}
+	if f, _ := db.matchFeature(db.ships[1], Match{MMSI: 1, Lat: 60, Long: 5}, 5, false, false, false, now); f.Properties.(mProp).ReportedPos != nil {
+		t.Error("Expected no extrapolation unless asked for")
+	}
+	text := db.SelectTrack(1, 5, 0, 0, true, nil)
+	if !strings.Contains(text, `"coordinates":[5.02,60]`) || !strings.Contains(text, `"reported_position":[5,60]`) {
+		t.Errorf("Expected Select to extrapolate, got %s", text)
+	}
+	db.MaxExtrapolation = 0
+	if text := db.SelectTrack(1, 5, 0, 0, true, nil); strings.Contains(text, "reported_position") {
+		t.Errorf("Expected extrapolation to be disabled, got %s", text)
+	}
+}
+
+func TestEvictOldest(t *testing.T) {
+	start := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+	update := func(db *ShipDB, mmsi uint32, seconds int) {
+		pos := UnknownPos
+		pos.At = start.Add(time.Duration(seconds) * time.Second)
+		pos.Pos = geo.Point{Lat: 60, Long: float64(mmsi) / 100}
+		db.UpdateDynamic(mmsi, "test", pos)
+	}
+	db := NewShipDB(10, 0, 0, 0, 0, 0, 0)
+	db.Evictable = true
+	for mmsi := uint32(5001); mmsi <= 5010; mmsi++ {
+		db.UpdateStatic(mmsi, "test", start, ShipInfo{ShipName: "STATIC ONLY"})
+	}
+	// insert the ships in random order of time, so that the order they were added doesn't help
+	times := rand.New(rand.NewSource(1)).Perm(1000)
+	for i, seconds := range times {
+		update(db, uint32(i+1), seconds)
+		db.EvictOldest(100)
+	}
+	if n, evicted := db.Count(), db.Evicted(); n != 100 || evicted != 910 {
+		t.Fatalf("Expected 100 ships after evicting 910, got %d and %d", n, evicted)
+	}
+	for i, seconds := range times {
+		if kept := db.get(uint32(i+1)) != nil; kept != (seconds >= 900) {
+			t.Errorf("Expected ship %d updated after %ds to be kept: %t, got %t", i+1, seconds, seconds >= 900, kept)
+		}
+	}
+
+	// updating the ships that would go next saves them
+	mmsiAt := make(map[int]uint32)
+	for i, seconds := range times {
+		mmsiAt[seconds] = uint32(i + 1)
+	}
+	for seconds := 900; seconds < 910; seconds++ {
+		update(db, mmsiAt[seconds], 2000+seconds)
+	}
+	for mmsi := uint32(2001); mmsi <= 2010; mmsi++ {
+		update(db, mmsi, 1500)
+	}
+	evicted := db.EvictOldest(100)
+	if len(evicted) != 10 {
+		t.Fatalf("Expected 10 ships to be evicted, got %v", evicted)
+	}
+	for i, e := range evicted {
+		if e.MMSI != mmsiAt[910+i] || e.Pos.Long != float64(e.MMSI)/100 {
+			t.Errorf("Expected ship %d to be evicted as number %d, got %v", mmsiAt[910+i], i, e)
+		}
+	}
+	if evicted := db.EvictOldest(100); evicted != nil {
+		t.Errorf("Expected nothing more to evict, got %v", evicted)
+	}
+
+	// removed ships are dropped from the heap
+	db.remove(mmsiAt[950])
+	if n := db.lru.Len(); n != 99 {
+		t.Errorf("Expected 99 ships in the heap after removing one, got %d", n)
+	}
+
+	// nothing is remembered unless eviction is enabled
+	db = NewShipDB(10, 0, 0, 0, 0, 0, 0)
+	for mmsi := uint32(1); mmsi <= 10; mmsi++ {
+		update(db, mmsi, int(mmsi))
+	}
+	if evicted := db.EvictOldest(5); db.lru.Len() != 0 || len(evicted) != 0 {
+		t.Errorf("Expected no heap and nothing to be evicted when not Evictable, got %d %v", db.lru.Len(), evicted)
+	}
+}
+
+// trackOf returns the coordinates of the LineString in the output of Select,
+// or nil if there is none.
+func trackOf(t *testing.T, selected string) [][2]float64 {
+	var fc struct {
+		Features []struct {
+			Geometry struct {
+				Type        string          `json:"type"`
+				Coordinates json.RawMessage `json:"coordinates"`
+			} `json:"geometry"`
+		} `json:"features"`
+	}
+	if err := json.Unmarshal([]byte(selected), &fc); err != nil {
+		t.Fatalf("Invalid JSON: %s\n%s", err.Error(), selected)
+	}
+	for _, f := range fc.Features {
+		if f.Geometry.Type == "LineString" {
+			var coords [][2]float64
+			if err := json.Unmarshal(f.Geometry.Coordinates, &coords); err != nil {
+				t.Fatal(err)
+			}
+			return coords
+		}
+	}
+	return nil
+}
+
+func TestSelectTrack(t *testing.T) {
+	db := NewShipDB(100, 0, 50, time.Minute, 0, 0, 0)
+	start := time.Now().Add(-10 * time.Minute)
+	lat := func(i int) float64 { return 58 + float64(i)*1000/metersPerDegree }
+	for i := 0; i < 5; i++ { // one kilometer and two minutes apart
+		pos := UnknownPos
+		pos.At = start.Add(time.Duration(i) * 2 * time.Minute)
+		pos.Pos = geo.Point{Lat: lat(i), Long: 5.5}
+		db.UpdateDynamic(1, "test", pos)
+	}
+	first, last := [2]float64{5.5, lat(0)}, [2]float64{5.5, lat(4)}
+
+	track := trackOf(t, db.SelectTrack(1, geo.FullPrecision, 2, 0, false, nil))
+	if len(track) != 2 || track[0] != first || track[1] != last {
+		t.Errorf("Expected points=2 to give the first and last position, got %v", track)
+	}
+	track = trackOf(t, db.SelectTrack(1, geo.FullPrecision, 3, 0, false, nil))
+	if len(track) != 3 || track[0] != first || track[1][1] != lat(2) || track[2] != last {
+		t.Errorf("Expected points=3 to give the first, middle and last position, got %v", track)
+	}
+	track = trackOf(t, db.SelectTrack(1, geo.FullPrecision, 50, 0, false, nil))
+	if len(track) != 5 || track[0] != first || track[4] != last {
+		t.Errorf("Expected points > history to give the whole history, got %v", track)
+	}
+	track = trackOf(t, db.SelectTrack(1, geo.FullPrecision, 0, 7*time.Minute, false, nil))
+	if len(track) != 3 || track[2] != last {
+		t.Errorf("Expected since=7m to give the last three positions, got %v", track)
+	}
+	selected := db.SelectTrack(1, geo.FullPrecision, 0, -time.Hour, false, nil)
+	if track = trackOf(t, selected); track != nil {
+		t.Errorf("Expected since in the future to give no tracklog, got %v", track)
+	}
+	if !strings.Contains(selected, `"type":"Point"`) {
+		t.Errorf("Expected the current position even without a tracklog: %s", selected)
+	}
+}
+
+// bufferCloser lets a logger write to a buffer
+type bufferCloser struct {
+	strings.Builder
+}
+
+func (bc *bufferCloser) Close() error { return nil }
+
+func TestShipRemovedBeforeJoin(t *testing.T) {
+	db := NewShipDB(100, 0, 0, 0, 0, 0, 0)
+	rt := NewRTree()
+	for mmsi := uint32(1); mmsi <= 3; mmsi++ {
+		pos := UnknownPos
+		pos.At = time.Now()
+		pos.Pos = geo.Point{Lat: 59, Long: 5 + float64(mmsi)/10}
+		db.UpdateDynamic(mmsi, "test", pos)
+		rt.InsertData(pos.Pos.Lat, pos.Pos.Long, mmsi)
+	}
+	all, _ := geo.NewRectangle(-90, -180, 90, 180)
+	matches := rt.FindWithin(all)
+	if len(*matches) != 3 {
+		t.Fatalf("Expected 3 matches, got %d", len(*matches))
+	}
+	// remove ship 2 when the first ship is looked up
+	testHookBeforeJoin = func(m Match) {
+		db.remove(2)
+	}
+	defer func() { testHookBeforeJoin = func(Match) {} }()
+	logged := &bufferCloser{}
+	logger := l.NewLogger(logged, l.Error)
+
+	var fc struct {
+		Features []struct {
+			ID uint32 `json:"id"`
+		} `json:"features"`
+	}
+	if err := json.Unmarshal([]byte(Matches(matches, db, geo.FullPrecision, false, false, logger)), &fc); err != nil {
+		t.Fatal(err)
+	}
+	if len(fc.Features) != 2 || fc.Features[0].ID == 2 || fc.Features[1].ID == 2 {
+		t.Errorf("Expected ship 2 to be absent: %v", fc.Features)
+	}
+	var terse struct {
+		MMSI []uint32 `json:"mmsi"`
+		Lat  []float64
+	}
+	if err := json.Unmarshal([]byte(TerseMatches(matches, db, geo.FullPrecision, logger)), &terse); err != nil {
+		t.Fatal(err)
+	}
+	if len(terse.MMSI) != 2 || len(terse.Lat) != 2 || terse.MMSI[0] == 2 || terse.MMSI[1] == 2 {
+		t.Errorf("Expected ship 2 to be absent: %v", terse)
+	}
+	if db.Vanished() != 2 {
+		t.Errorf("Expected ship 2 to be counted once per lookup, got %d", db.Vanished())
+	}
+	if logged.Len() != 0 {
+		t.Errorf("Expected nothing to be logged, got %s", logged.String())
+	}
+
+	if _, _, known := db.KnownCoords(2); known {
+		t.Error("Expected KnownCoords() to not know ship 2")
+	}
+	if selected := db.Select(2, geo.FullPrecision, logger); selected != "" {
+		t.Errorf("Expected Select() to not find ship 2, got %s", selected)
+	}
+}
+
+// Matches looks up all the ships at once, which must not race with or
+// block updates, and run it with -race.
+func TestMatchesWhileUpdatingStatic(t *testing.T) {
+	quiet := l.NewLogger(os.Stderr, l.Debug)
+	db, rt := clusterTestDB(1000, 58, 4, 62, 8)
+	matches := rt.FindWithinAny(geo.SplitViewRect(58, 4, 62, 8))
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			mmsi := uint32(i%1000 + 1)
+			db.UpdateStatic(mmsi, "test", time.Now(), ShipInfo{Length: uint16(i), ShipName: "SHIP " + string(rune('A'+i%26))})
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		var fc struct {
+			Features []struct {
+				ID uint32 `json:"id"`
+			} `json:"features"`
+		}
+		if err := json.Unmarshal([]byte(Matches(matches, db, 5, false, false, quiet)), &fc); err != nil {
+			t.Fatal(err)
+		}
+		if len(fc.Features) != 1000 {
+			t.Fatalf("Expected all 1000 ships, got %d", len(fc.Features))
+		}
+	}
+	close(stop)
+	<-done
+}
+
 /*BENCHMARKS*/
 // Add n ships with 1 checkpoints
 func BenchmarkUpdateDynamic_ships(b *testing.B) {
 	ships := randShipsPos(b.N, 1) //n ships with 1 checkpoint
-	db := NewShipDB()
+	db := NewShipDB(100, 0, 0, 0, 0, 0, 0)
 	b.ResetTimer() //start the timer from here
 	for mmsi, s := range *ships {
-		db.UpdateDynamic(mmsi, s[0])
+		db.UpdateDynamic(mmsi, "test", s[0])
 	}
 }
 
@@ -278,31 +1290,105 @@ func BenchmarkUpdateDynamic_checkpoints(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		ships[i] = randShipPos(i)
 	}
-	db := NewShipDB()
+	db := NewShipDB(100, 0, 0, 0, 0, 0, 0)
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		db.UpdateDynamic(uint32(i), ships[i])
+		db.UpdateDynamic(uint32(i), "test", ships[i])
 	}
 }
 
 // Adding n ships
 func BenchmarkUpdateStatic(b *testing.B) {
-	db := NewShipDB()
+	db := NewShipDB(100, 0, 0, 0, 0, 0, 0)
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		db.UpdateStatic(uint32(i), ShipInfo{1, 1, 1, 1, 1, 1, "CALL", "NAME", "SOME_DEST", time.Now()})
+		db.UpdateStatic(uint32(i), "test", time.Now(), ShipInfo{1, 1, 1, 1, 1, 1, "CALL", "NAME", "SOME_DEST", time.Now(), 0})
 	}
 }
 
 func BenchmarkSelect(b *testing.B) {
 	db, _ := new(b.N, 100) // n ships with 100 positions
 	for i := 0; i < b.N; i++ {
-		db.UpdateDynamic(uint32(i), ShipPos{time.Now(), geo.Point{1, 1}, false, 0, 0, 0, 0, 0})
+		db.UpdateDynamic(uint32(i), "test", ShipPos{At: time.Now(), Pos: geo.Point{Lat: 1, Long: 1}})
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		db.Select(uint32(i), geo.FullPrecision, nil)
+	}
+}
+
+// BenchmarkClusteredMatches clusters the world view with 100k ships into 5 degree cells.
+func BenchmarkClusteredMatches(b *testing.B) {
+	quiet := l.NewLogger(os.Stderr, l.Debug)
+	db, rt := clusterTestDB(100000, -90, -180, 90, 180)
+	rects := geo.SplitViewRect(-90, -180, 90, 180)
+	matches := rt.FindWithinAny(rects)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ClusteredMatches(matches, rects, 5, db, 3, quiet)
 	}
+}
+
+// BenchmarkMatches produces the map of the whole world with 50k named ships.
+func BenchmarkMatches(b *testing.B) {
+	quiet := l.NewLogger(os.Stderr, l.Debug)
+	db, rt := clusterTestDB(50000, -90, -180, 90, 180)
+	for mmsi := uint32(1); mmsi <= 50000; mmsi++ {
+		db.UpdateStatic(mmsi, "test", time.Now(), ShipInfo{VesselType: 70, Length: 100, ShipName: "NAME"})
+	}
+	rects := geo.SplitViewRect(-90, -180, 90, 180)
+	matches := rt.FindWithinAny(rects)
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		db.Select(uint32(i))
+		Matches(matches, db, 5, false, false, quiet)
 	}
 }
 
+// BenchmarkMatchesWhileUpdating produces the world map with 50k ships from
+// all CPUs, while the positions are updated.
+func BenchmarkMatchesWhileUpdating(b *testing.B) {
+	quiet := l.NewLogger(os.Stderr, l.Debug)
+	db, rt := clusterTestDB(50000, -90, -180, 90, 180)
+	rects := geo.SplitViewRect(-90, -180, 90, 180)
+	matches := rt.FindWithinAny(rects)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		pos := UnknownPos
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			m := (*matches)[i%len(*matches)]
+			pos.At, pos.Pos = time.Now(), geo.Point{Lat: m.Lat, Long: m.Long}
+			db.UpdateDynamic(m.MMSI, "test", pos)
+		}
+	}()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			Matches(matches, db, 5, false, false, quiet)
+		}
+	})
+	b.StopTimer()
+	close(stop)
+	<-done
+}
+
 //References: https://golang.org/doc/articles/race_detector.html
+
+func TestValidIMO(t *testing.T) {
+	for _, imo := range []uint32{9074729, 9176187, 1234567} {
+		if !ValidIMO(imo) {
+			t.Errorf("%d should be valid", imo)
+		}
+	}
+	for _, imo := range []uint32{0, 9074728, 907472, 90747290, 1234560} {
+		if ValidIMO(imo) {
+			t.Errorf("%d should be invalid", imo)
+		}
+	}
+}